@@ -161,6 +161,18 @@ func main() {
 		service.Router.HandleFunc("/admin/update_buyer_datacenter_settings", isAdminAuthorized(adminUpdateBuyerDatacenterSettingsHandler)).Methods("PUT")
 		service.Router.HandleFunc("/admin/delete_buyer_datacenter_settings/{buyerId}/{datacenterId}", isAdminAuthorized(adminDeleteBuyerDatacenterSettingsHandler)).Methods("DELETE")
 
+		service.Router.HandleFunc("/admin/create_buyer_datacenter_route_shader", isAdminAuthorized(adminCreateBuyerDatacenterRouteShaderHandler)).Methods("POST")
+		service.Router.HandleFunc("/admin/buyer_datacenter_route_shaders", isAdminAuthorized(adminReadBuyerDatacenterRouteShadersHandler)).Methods("GET")
+		service.Router.HandleFunc("/admin/buyer_datacenter_route_shader/{buyerId}/{datacenterId}", isAdminAuthorized(adminReadBuyerDatacenterRouteShaderHandler)).Methods("GET")
+		service.Router.HandleFunc("/admin/update_buyer_datacenter_route_shader", isAdminAuthorized(adminUpdateBuyerDatacenterRouteShaderHandler)).Methods("PUT")
+		service.Router.HandleFunc("/admin/delete_buyer_datacenter_route_shader/{buyerId}/{datacenterId}", isAdminAuthorized(adminDeleteBuyerDatacenterRouteShaderHandler)).Methods("DELETE")
+
+		service.Router.HandleFunc("/admin/create_buyer_country_route_shader", isAdminAuthorized(adminCreateBuyerCountryRouteShaderHandler)).Methods("POST")
+		service.Router.HandleFunc("/admin/buyer_country_route_shaders", isAdminAuthorized(adminReadBuyerCountryRouteShadersHandler)).Methods("GET")
+		service.Router.HandleFunc("/admin/buyer_country_route_shader/{buyerId}/{country}", isAdminAuthorized(adminReadBuyerCountryRouteShaderHandler)).Methods("GET")
+		service.Router.HandleFunc("/admin/update_buyer_country_route_shader", isAdminAuthorized(adminUpdateBuyerCountryRouteShaderHandler)).Methods("PUT")
+		service.Router.HandleFunc("/admin/delete_buyer_country_route_shader/{buyerId}/{country}", isAdminAuthorized(adminDeleteBuyerCountryRouteShaderHandler)).Methods("DELETE")
+
 		service.Router.HandleFunc("/admin/create_relay_keypair", isAdminAuthorized(adminCreateRelayKeypairHandler)).Methods("POST")
 		service.Router.HandleFunc("/admin/relay_keypairs", isAdminAuthorized(adminReadRelayKeypairsHandler)).Methods("GET")
 		service.Router.HandleFunc("/admin/relay_keypair/{relayKeypairId}", isAdminAuthorized(adminReadRelayKeypairHandler)).Methods("GET")
@@ -252,6 +264,9 @@ func main() {
 							keys = append(keys, fmt.Sprintf("relay_%016x_packets_received_per_second", relayIds[i]))
 							keys = append(keys, fmt.Sprintf("relay_%016x_bandwidth_sent_kbps", relayIds[i]))
 							keys = append(keys, fmt.Sprintf("relay_%016x_bandwidth_received_kbps", relayIds[i]))
+							for j := range relayHealthKeys {
+								keys = append(keys, fmt.Sprintf("relay_%016x_health_%s", relayIds[i], relayHealthKeys[j]))
+							}
 						}
 						relayTimeSeriesWatcher.SetKeys(keys)
 					}
@@ -326,6 +341,7 @@ func main() {
 		service.Router.HandleFunc("/portal/sessions", isPortalAuthorized(portalSessionsHandler))
 		service.Router.HandleFunc("/portal/sessions/{page}", isPortalAuthorized(portalSessionsHandler))
 		service.Router.HandleFunc("/portal/session/{session_id}", isPortalAuthorized(portalSessionDataHandler))
+		service.Router.HandleFunc("/portal/session/{session_id}/decisions", isPortalAuthorized(portalSessionDecisionsHandler))
 
 		service.Router.HandleFunc("/portal/servers/{page}", isPortalAuthorized(portalServersHandler))
 		service.Router.HandleFunc("/portal/server/{server_id}", isPortalAuthorized(portalServerDataHandler))
@@ -336,6 +352,7 @@ func main() {
 		service.Router.HandleFunc("/portal/relays/{page}", isPortalAuthorized(portalRelaysHandler))
 		service.Router.HandleFunc("/portal/all_relays", isPortalAuthorized(portalAllRelaysHandler))
 		service.Router.HandleFunc("/portal/relay/{relay_name}", isPortalAuthorized(portalRelayDataHandler))
+		service.Router.HandleFunc("/portal/relay/{relay_name}/health", isPortalAuthorized(portalRelayHealthHandler))
 
 		service.Router.HandleFunc("/portal/buyers", isPortalAuthorized(portalBuyersHandler))
 		service.Router.HandleFunc("/portal/buyers/{page}", isPortalAuthorized(portalBuyersHandler))
@@ -710,6 +727,108 @@ func portalSessionDataHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+type PortalDecisionRoute struct {
+	Cost         int32                            `json:"cost"`
+	WeightedCost int32                            `json:"weighted_cost"`
+	NumRelays    uint32                           `json:"num_relays"`
+	RelayIds     [constants.MaxRouteRelays]uint64 `json:"relay_ids"`
+	RelayNames   [constants.MaxRouteRelays]string `json:"relay_names"`
+	Chosen       bool                             `json:"chosen"`
+}
+
+type PortalDecisionData struct {
+	Timestamp                 uint64                `json:"timestamp,string"`
+	SliceNumber               uint32                `json:"slice_number"`
+	Reason                    string                `json:"reason"`
+	RouteStateFlags           []string              `json:"route_state_flags"`
+	DirectRTT                 uint32                `json:"direct_rtt"`
+	NextRTT                   uint32                `json:"next_rtt"`
+	AcceptableLatency         int32                 `json:"acceptable_latency"`
+	LatencyReductionThreshold int32                 `json:"latency_reduction_threshold"`
+	Route                     *PortalDecisionRoute  `json:"route"`
+	CandidateRoutes           []PortalDecisionRoute `json:"candidate_routes"`
+}
+
+type PortalSessionDecisionsResponse struct {
+	Decisions []PortalDecisionData `json:"decisions"`
+}
+
+func upgradeDecisionRoute(database *db.Database, cost int32, weightedCost int32, numRelays uint32, relayIds [constants.MaxRouteRelays]uint64, output *PortalDecisionRoute) {
+	output.Cost = cost
+	output.WeightedCost = weightedCost
+	output.NumRelays = numRelays
+	output.RelayIds = relayIds
+	for i := 0; i < int(numRelays); i++ {
+		if database != nil {
+			relay := database.GetRelay(relayIds[i])
+			if relay != nil {
+				output.RelayNames[i] = relay.Name
+			}
+		}
+	}
+}
+
+func upgradeDecisionData(database *db.Database, input *portal.DecisionData, output *PortalDecisionData) {
+	output.Timestamp = input.Timestamp
+	output.SliceNumber = input.SliceNumber
+	output.Reason = portal.DecisionReasonString(input.Reason)
+	output.RouteStateFlags = portal.RouteStateFlagStrings(input.RouteStateFlags)
+	output.DirectRTT = input.DirectRTT
+	output.NextRTT = input.NextRTT
+	output.AcceptableLatency = input.AcceptableLatency
+	output.LatencyReductionThreshold = input.LatencyReductionThreshold
+	if input.RouteNumRelays > 0 {
+		output.Route = &PortalDecisionRoute{Chosen: true}
+		upgradeDecisionRoute(database, input.RouteCost, input.RouteCost, input.RouteNumRelays, input.RouteRelayIds, output.Route)
+	}
+	output.CandidateRoutes = make([]PortalDecisionRoute, input.NumCandidateRoutes)
+	for i := 0; i < int(input.NumCandidateRoutes); i++ {
+		candidate := &input.CandidateRoutes[i]
+		upgradeDecisionRoute(database, candidate.Cost, candidate.WeightedCost, candidate.NumRelays, candidate.RelayIds, &output.CandidateRoutes[i])
+		output.CandidateRoutes[i].Chosen = candidate.NumRelays == input.RouteNumRelays && candidate.RelayIds == input.RouteRelayIds
+	}
+}
+
+func portalSessionDecisionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	sessionId, err := strconv.ParseUint(vars["session_id"], 16, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	database := service.Database()
+	if database == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	decisionData := portal.GetSessionDecisions(service.Context, redisPortalClient, sessionId)
+	if decisionData == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(decisionData) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	response := PortalSessionDecisionsResponse{}
+	response.Decisions = make([]PortalDecisionData, len(decisionData))
+	for i := range decisionData {
+		upgradeDecisionData(database, &decisionData[i], &response.Decisions[i])
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(response)
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 type PortalServerData struct {
@@ -864,6 +983,8 @@ type PortalRelayData struct {
 	StartTime                           uint64   `json:"start_time,string"`
 	RelayFlags                          uint64   `json:"relay_flags,string"`
 	RelayVersion                        string   `json:"relay_version"`
+	Utilization                         uint32   `json:"utilization"`
+	HealthScore                         float32  `json:"health_score"`
 	SellerId                            uint64   `json:"seller_id,string"`
 	SellerName                          string   `json:"seller_name"`
 	SellerCode                          string   `json:"seller_code"`
@@ -892,6 +1013,8 @@ func upgradeRelayData(database *db.Database, input *portal.RelayData, output *Po
 	output.StartTime = input.StartTime
 	output.RelayFlags = input.RelayFlags
 	output.RelayVersion = input.RelayVersion
+	output.Utilization = input.Utilization
+	output.HealthScore = input.HealthScore
 	currentTime := uint64(time.Now().Unix())
 	if database != nil {
 		relay := database.GetRelay(input.RelayId)
@@ -923,6 +1046,16 @@ type PortalRelaysResponse struct {
 	NumPages   int               `json:"num_pages"`
 }
 
+// sortRelaysByHealth puts the least healthy relays first. relays that haven't been scored yet have a health score of zero, so they go last
+func sortRelaysByHealth(relays []*portal.RelayData) {
+	sort.SliceStable(relays, func(i, j int) bool {
+		if relays[i].HealthScore == 0 || relays[j].HealthScore == 0 {
+			return relays[j].HealthScore == 0 && relays[i].HealthScore != 0
+		}
+		return relays[i].HealthScore < relays[j].HealthScore
+	})
+}
+
 func portalRelaysHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	page, err := strconv.ParseInt(vars["page"], 10, 64)
@@ -934,6 +1067,9 @@ func portalRelaysHandler(w http.ResponseWriter, r *http.Request) {
 	begin, end, outputPage, numPages := core.DoPagination_Simple(int(page), len(relays))
 	sort.Slice(relays, func(i, j int) bool { return relays[i].RelayName < relays[j].RelayName })
 	sort.SliceStable(relays, func(i, j int) bool { return relays[i].NumSessions > relays[j].NumSessions })
+	if r.URL.Query().Get("sort") == "health" {
+		sortRelaysByHealth(relays)
+	}
 	relays = relays[begin:end]
 	response := PortalRelaysResponse{}
 	database := service.Database()
@@ -953,6 +1089,9 @@ func portalAllRelaysHandler(w http.ResponseWriter, r *http.Request) {
 	relays := portal.GetRelayList(service.Context, redisPortalClient, relayNames)
 	sort.Slice(relays, func(i, j int) bool { return relays[i].RelayName < relays[j].RelayName })
 	sort.SliceStable(relays, func(i, j int) bool { return relays[i].NumSessions > relays[j].NumSessions })
+	if r.URL.Query().Get("sort") == "health" {
+		sortRelaysByHealth(relays)
+	}
 	response := PortalRelaysResponse{}
 	database := service.Database()
 	response.Relays = make([]PortalRelayData, len(relays))
@@ -1003,6 +1142,72 @@ func portalRelayDataHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// relay health time series are written once per-minute by the relay backend, as relay_<relay id>_health_<key>
+var relayHealthKeys = []string{"score", "uptime", "reachability", "mean_rtt_ratio", "max_rtt_ratio", "packet_loss"}
+
+type PortalRelayHealthResponse struct {
+	RelayName               string    `json:"relay_name"`
+	RelayId                 uint64    `json:"relay_id,string"`
+	HealthScore             float32   `json:"health_score"`
+	Score_Timestamps        []uint64  `json:"score_timestamps,string"`
+	Score_Values            []float32 `json:"score_values"`
+	Uptime_Timestamps       []uint64  `json:"uptime_timestamps,string"`
+	Uptime_Values           []float32 `json:"uptime_values"`
+	Reachability_Timestamps []uint64  `json:"reachability_timestamps,string"`
+	Reachability_Values     []float32 `json:"reachability_values"`
+	MeanRTTRatio_Timestamps []uint64  `json:"mean_rtt_ratio_timestamps,string"`
+	MeanRTTRatio_Values     []float32 `json:"mean_rtt_ratio_values"`
+	MaxRTTRatio_Timestamps  []uint64  `json:"max_rtt_ratio_timestamps,string"`
+	MaxRTTRatio_Values      []float32 `json:"max_rtt_ratio_values"`
+	PacketLoss_Timestamps   []uint64  `json:"packet_loss_timestamps,string"`
+	PacketLoss_Values       []float32 `json:"packet_loss_values"`
+}
+
+func portalRelayHealthHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	relayName := vars["relay_name"]
+
+	database := service.Database()
+	if database == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	relay := database.GetRelayByName(relayName)
+	if relay == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	response := PortalRelayHealthResponse{}
+
+	response.RelayName = relay.Name
+	response.RelayId = relay.Id
+
+	relayData := portal.GetRelayData(service.Context, redisPortalClient, relayName)
+	if relayData != nil {
+		response.HealthScore = relayData.HealthScore
+	}
+
+	if enableRedisTimeSeries {
+		timestamps := []*[]uint64{&response.Score_Timestamps, &response.Uptime_Timestamps, &response.Reachability_Timestamps, &response.MeanRTTRatio_Timestamps, &response.MaxRTTRatio_Timestamps, &response.PacketLoss_Timestamps}
+		values := []*[]float32{&response.Score_Values, &response.Uptime_Values, &response.Reachability_Values, &response.MeanRTTRatio_Values, &response.MaxRTTRatio_Values, &response.PacketLoss_Values}
+		relayTimeSeriesWatcher.Lock()
+		for i := range relayHealthKeys {
+			relayTimeSeriesWatcher.GetFloat32Values(timestamps[i], values[i], fmt.Sprintf("relay_%016x_health_%s", relay.Id, relayHealthKeys[i]))
+		}
+		relayTimeSeriesWatcher.Unlock()
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(response)
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 type PortalBuyer struct {
@@ -2334,6 +2539,257 @@ func adminDeleteBuyerDatacenterSettingsHandler(w http.ResponseWriter, r *http.Re
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+type AdminCreateBuyerDatacenterRouteShaderResponse struct {
+	Override admin.BuyerDatacenterRouteShader `json:"override"`
+	Error    string                           `json:"error"`
+}
+
+func adminCreateBuyerDatacenterRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	var response AdminCreateBuyerDatacenterRouteShaderResponse
+	var override admin.BuyerDatacenterRouteShader
+	err := json.NewDecoder(r.Body).Decode(&override)
+	if err != nil {
+		core.Error("failed to read buyer datacenter route shader data in create buyer datacenter route shader request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = controller.CreateBuyerDatacenterRouteShader(&override)
+	if err != nil {
+		core.Error("failed to create buyer datacenter route shader: %v", err)
+		response.Error = err.Error()
+	} else {
+		core.Debug("create buyer datacenter route shader %d.%d -> %+v", override.BuyerId, override.DatacenterId, override)
+		response.Override = override
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminReadBuyerDatacenterRouteShadersResponse struct {
+	Overrides []admin.BuyerDatacenterRouteShader `json:"overrides"`
+	Error     string                             `json:"error"`
+}
+
+func adminReadBuyerDatacenterRouteShadersHandler(w http.ResponseWriter, r *http.Request) {
+	overrides, err := controller.ReadBuyerDatacenterRouteShaders()
+	response := AdminReadBuyerDatacenterRouteShadersResponse{Overrides: overrides}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminReadBuyerDatacenterRouteShaderResponse struct {
+	Override admin.BuyerDatacenterRouteShader `json:"override"`
+	Error    string                           `json:"error"`
+}
+
+func adminReadBuyerDatacenterRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	buyerId, err := strconv.ParseUint(vars["buyerId"], 10, 64)
+	if err != nil {
+		core.Error("read buyer datacenter route shader could not parse buyer id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	datacenterId, err := strconv.ParseUint(vars["datacenterId"], 10, 64)
+	if err != nil {
+		core.Error("read buyer datacenter route shader could not parse datacenter id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	override, err := controller.ReadBuyerDatacenterRouteShader(buyerId, datacenterId)
+	response := AdminReadBuyerDatacenterRouteShaderResponse{Override: override}
+	if err != nil {
+		core.Error("failed to read buyer datacenter route shader: %v", err)
+		response.Error = err.Error()
+	} else {
+		core.Debug("read buyer datacenter route shader %d.%d -> %+v", buyerId, datacenterId, override)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminUpdateBuyerDatacenterRouteShaderResponse struct {
+	Override admin.BuyerDatacenterRouteShader `json:"override"`
+	Error    string                           `json:"error"`
+}
+
+func adminUpdateBuyerDatacenterRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	var override admin.BuyerDatacenterRouteShader
+	err := json.NewDecoder(r.Body).Decode(&override)
+	if err != nil {
+		core.Error("failed to decode update buyer datacenter route shader request json: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	response := AdminUpdateBuyerDatacenterRouteShaderResponse{Override: override}
+	err = controller.UpdateBuyerDatacenterRouteShader(&override)
+	if err != nil {
+		core.Error("failed to update buyer datacenter route shader: %v", err)
+		response.Error = err.Error()
+	} else {
+		core.Debug("update buyer datacenter route shader %d.%d -> %+v", override.BuyerId, override.DatacenterId, override)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminDeleteBuyerDatacenterRouteShaderResponse struct {
+	Error string `json:"error"`
+}
+
+func adminDeleteBuyerDatacenterRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	buyerId, err := strconv.ParseUint(vars["buyerId"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	datacenterId, err := strconv.ParseUint(vars["datacenterId"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	core.Debug("delete buyer datacenter route shader %d.%d", buyerId, datacenterId)
+	response := AdminDeleteBuyerDatacenterRouteShaderResponse{}
+	err = controller.DeleteBuyerDatacenterRouteShader(buyerId, datacenterId)
+	if err != nil {
+		core.Error("failed to delete buyer datacenter route shader: %v", err)
+		response.Error = err.Error()
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type AdminCreateBuyerCountryRouteShaderResponse struct {
+	Override admin.BuyerCountryRouteShader `json:"override"`
+	Error    string                        `json:"error"`
+}
+
+func adminCreateBuyerCountryRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	var response AdminCreateBuyerCountryRouteShaderResponse
+	var override admin.BuyerCountryRouteShader
+	err := json.NewDecoder(r.Body).Decode(&override)
+	if err != nil {
+		core.Error("failed to read buyer country route shader data in create buyer country route shader request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = controller.CreateBuyerCountryRouteShader(&override)
+	if err != nil {
+		core.Error("failed to create buyer country route shader: %v", err)
+		response.Error = err.Error()
+	} else {
+		core.Debug("create buyer country route shader %d.%s -> %+v", override.BuyerId, override.Country, override)
+		response.Override = override
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminReadBuyerCountryRouteShadersResponse struct {
+	Overrides []admin.BuyerCountryRouteShader `json:"overrides"`
+	Error     string                          `json:"error"`
+}
+
+func adminReadBuyerCountryRouteShadersHandler(w http.ResponseWriter, r *http.Request) {
+	overrides, err := controller.ReadBuyerCountryRouteShaders()
+	response := AdminReadBuyerCountryRouteShadersResponse{Overrides: overrides}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminReadBuyerCountryRouteShaderResponse struct {
+	Override admin.BuyerCountryRouteShader `json:"override"`
+	Error    string                        `json:"error"`
+}
+
+func adminReadBuyerCountryRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	buyerId, err := strconv.ParseUint(vars["buyerId"], 10, 64)
+	if err != nil {
+		core.Error("read buyer country route shader could not parse buyer id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	country := vars["country"]
+	override, err := controller.ReadBuyerCountryRouteShader(buyerId, country)
+	response := AdminReadBuyerCountryRouteShaderResponse{Override: override}
+	if err != nil {
+		core.Error("failed to read buyer country route shader: %v", err)
+		response.Error = err.Error()
+	} else {
+		core.Debug("read buyer country route shader %d.%s -> %+v", buyerId, country, override)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminUpdateBuyerCountryRouteShaderResponse struct {
+	Override admin.BuyerCountryRouteShader `json:"override"`
+	Error    string                        `json:"error"`
+}
+
+func adminUpdateBuyerCountryRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	var override admin.BuyerCountryRouteShader
+	err := json.NewDecoder(r.Body).Decode(&override)
+	if err != nil {
+		core.Error("failed to decode update buyer country route shader request json: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	response := AdminUpdateBuyerCountryRouteShaderResponse{Override: override}
+	err = controller.UpdateBuyerCountryRouteShader(&override)
+	if err != nil {
+		core.Error("failed to update buyer country route shader: %v", err)
+		response.Error = err.Error()
+	} else {
+		core.Debug("update buyer country route shader %d.%s -> %+v", override.BuyerId, override.Country, override)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AdminDeleteBuyerCountryRouteShaderResponse struct {
+	Error string `json:"error"`
+}
+
+func adminDeleteBuyerCountryRouteShaderHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	buyerId, err := strconv.ParseUint(vars["buyerId"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	country := vars["country"]
+	core.Debug("delete buyer country route shader %d.%s", buyerId, country)
+	response := AdminDeleteBuyerCountryRouteShaderResponse{}
+	err = controller.DeleteBuyerCountryRouteShader(buyerId, country)
+	if err != nil {
+		core.Error("failed to delete buyer country route shader: %v", err)
+		response.Error = err.Error()
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 type AdminCreateRelayKeypairResponse struct {
 	RelayKeypair admin.RelayKeypairData `json:"relay_keypair"`
 	Error        string                 `json:"error"`
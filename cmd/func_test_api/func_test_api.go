@@ -1022,6 +1022,8 @@ func test_route_shader() {
 		RouteSwitchThreshold:          10,
 		RouteSelectThreshold:          5,
 		ForceNext:                     true,
+		JitterWeight:                  0.5,
+		PacketLossWeight:              2.0,
 	}
 
 	routeShaderId := uint64(0)
@@ -664,9 +664,10 @@ func test_optimize() {
 }
 
 const (
-	magicBackendBin = "./magic_backend"
-	relayGatewayBin = "./relay_gateway"
-	relayBackendBin = "./relay_backend"
+	magicBackendBin  = "./magic_backend"
+	relayGatewayBin  = "./relay_gateway"
+	relayBackendBin  = "./relay_backend"
+	serverBackendBin = "./server_backend"
 )
 
 func test_relay_backend() {
@@ -1078,6 +1079,344 @@ func test_relay_backend() {
 	}
 }
 
+func test_server_backend_affinity() {
+
+	fmt.Printf("test_server_backend_affinity\n")
+
+	const NumServerBackends = 3
+	const NumServers = 30
+
+	// setup a database with a buyer and a datacenter
+
+	var buyerPublicKey [crypto.SDK_CRYPTO_SIGN_PUBLIC_KEY_BYTES]byte
+	var buyerPrivateKey [crypto.SDK_CRYPTO_SIGN_PRIVATE_KEY_BYTES]byte
+	crypto.SDK_SignKeypair(buyerPublicKey[:], buyerPrivateKey[:])
+
+	buyerId := uint64(0x1111111122222222)
+
+	database := db.CreateDatabase()
+
+	database.CreationTime = time.Now().String()
+	database.Creator = "test"
+
+	buyer := db.Buyer{}
+	buyer.Id = buyerId
+	buyer.Name = "buyer"
+	buyer.Live = true
+	buyer.PublicKey = buyerPublicKey[:]
+	database.BuyerMap[buyerId] = &buyer
+
+	datacenterId := common.DatacenterId("local")
+
+	datacenter := db.Datacenter{}
+	datacenter.Id = datacenterId
+	datacenter.Name = "local"
+	database.DatacenterMap[datacenterId] = &datacenter
+
+	database.BuyerDatacenterSettings[buyerId] = make(map[uint64]*db.BuyerDatacenterSettings)
+	database.BuyerDatacenterSettings[buyerId][datacenterId] = &db.BuyerDatacenterSettings{BuyerId: buyerId, DatacenterId: datacenterId, EnableAcceleration: true}
+
+	databaseData := database.GetBinary()
+
+	// serve a route matrix containing the database, so the server backends have what they need to process packets
+
+	routeMatrixServer := &http.Server{Addr: "127.0.0.1:45200"}
+
+	routeMatrixServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routeMatrix := common.RouteMatrix{}
+		routeMatrix.Version = common.RouteMatrixVersion_Write
+		routeMatrix.CreatedAt = uint64(time.Now().Unix())
+		routeMatrix.BinFileBytes = int32(len(databaseData))
+		routeMatrix.BinFileData = databaseData
+		data, err := routeMatrix.Write()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	})
+
+	go routeMatrixServer.ListenAndServe()
+
+	defer routeMatrixServer.Close()
+
+	// start the magic backend
+
+	fmt.Printf("starting magic backend\n")
+
+	magic_backend_cmd := exec.Command(magicBackendBin)
+	if magic_backend_cmd == nil {
+		panic("could not create magic backend!\n")
+	}
+
+	magic_backend_cmd.Env = os.Environ()
+	magic_backend_cmd.Env = append(magic_backend_cmd.Env, "HTTP_PORT=41007")
+
+	var magic_backend_output bytes.Buffer
+	magic_backend_cmd.Stdout = &magic_backend_output
+	magic_backend_cmd.Stderr = &magic_backend_output
+	magic_backend_cmd.Start()
+
+	defer func() {
+		magic_backend_cmd.Process.Signal(os.Interrupt)
+		magic_backend_cmd.Wait()
+	}()
+
+	// start the server backends. the first server backend stands in for the load balancer
+
+	serverBackendAddresses := make([]net.UDPAddr, NumServerBackends)
+	for i := range serverBackendAddresses {
+		serverBackendAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 45000+i))
+	}
+
+	loadBalancerAddress := serverBackendAddresses[0]
+
+	server_backend_cmds := make([]*exec.Cmd, NumServerBackends)
+
+	for i := 0; i < NumServerBackends; i++ {
+
+		fmt.Printf("starting server backend %d\n", i)
+
+		cmd := exec.Command(serverBackendBin)
+		if cmd == nil {
+			panic("could not create server backend!\n")
+		}
+
+		cmd.Env = os.Environ()
+		cmd.Env = append(cmd.Env, fmt.Sprintf("UDP_PORT=%d", 45000+i))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("HTTP_PORT=%d", 45100+i))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERVER_BACKEND_ADDRESS=%s", loadBalancerAddress.String()))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("BACKEND_AFFINITY_ADDRESS=%s", serverBackendAddresses[i].String()))
+		cmd.Env = append(cmd.Env, "ENABLE_BACKEND_AFFINITY=1")
+		cmd.Env = append(cmd.Env, "ROUTE_MATRIX_URL=http://127.0.0.1:45200/route_matrix")
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERVER_BACKEND_PUBLIC_KEY=%s", TestServerBackendPublicKey))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERVER_BACKEND_PRIVATE_KEY=%s", TestServerBackendPrivateKey))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("RELAY_BACKEND_PUBLIC_KEY=%s", TestRelayBackendPublicKey))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("RELAY_BACKEND_PRIVATE_KEY=%s", TestRelayBackendPrivateKey))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PING_KEY=%s", TestPingKey))
+		cmd.Env = append(cmd.Env, "DEBUG_LOGS=0")
+
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		cmd.Start()
+
+		server_backend_cmds[i] = cmd
+	}
+
+	defer func() {
+		for i := range server_backend_cmds {
+			server_backend_cmds[i].Process.Signal(os.Kill)
+			server_backend_cmds[i].Wait()
+		}
+	}()
+
+	// create the servers
+
+	serverAddresses := make([]net.UDPAddr, NumServers)
+	serverConns := make([]*net.UDPConn, NumServers)
+
+	for i := 0; i < NumServers; i++ {
+
+		serverAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 46000+i))
+
+		lc := net.ListenConfig{}
+		lp, err := lc.ListenPacket(context.Background(), "udp", serverAddresses[i].String())
+		if err != nil {
+			panic(fmt.Sprintf("could not bind server socket: %v", err))
+		}
+
+		serverConns[i] = lp.(*net.UDPConn)
+
+		defer serverConns[i].Close()
+	}
+
+	serverBackendPublicKey := Base64String(TestServerBackendPublicKey)
+
+	version := packets.SDKVersion{Major: 1, Minor: 2, Patch: 13}
+
+	// send a request packet from a server to a server backend, and read the response, like the SDK does
+
+	sendRequest := func(index int, to net.UDPAddr, requestType int, request packets.Packet, responseType int, response packets.Packet) bool {
+
+		packetData, err := packets.SDK_WritePacket(request, requestType, constants.MaxPacketBytes, &serverAddresses[index], &to, buyerPrivateKey[:])
+		if err != nil {
+			panic(fmt.Sprintf("could not write request packet: %v", err))
+		}
+
+		conn := serverConns[index]
+
+		for attempt := 0; attempt < 10; attempt++ {
+
+			conn.WriteToUDP(packetData, &to)
+
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+			var buffer [constants.MaxPacketBytes]byte
+
+			packetBytes, _, err := conn.ReadFromUDP(buffer[:])
+			if err != nil {
+				continue
+			}
+
+			responseData := buffer[:packetBytes]
+
+			if responseData[0] != uint8(responseType) {
+				continue
+			}
+
+			var emptyMagic [8]byte
+
+			fromAddressData := core.GetAddressData(&to)
+			toAddressData := core.GetAddressData(&serverAddresses[index])
+
+			if !core.AdvancedPacketFilter(responseData, emptyMagic[:], fromAddressData, toAddressData, len(responseData)) {
+				fmt.Printf("advanced packet filter failed on response from %s\n", to.String())
+				continue
+			}
+
+			if !crypto.SDK_CheckPacketSignature(responseData, serverBackendPublicKey) {
+				fmt.Printf("signature check failed on response from %s\n", to.String())
+				continue
+			}
+
+			responseData = responseData[18 : len(responseData)-crypto.SDK_CRYPTO_SIGN_BYTES]
+
+			if err := packets.ReadPacket(responseData, response); err != nil {
+				fmt.Printf("could not read response from %s: %v\n", to.String(), err)
+				continue
+			}
+
+			return true
+		}
+
+		return false
+	}
+
+	serverUpdate := func(index int, to net.UDPAddr) (packets.SDK_ServerUpdateResponsePacket, bool) {
+		request := packets.SDK_ServerUpdateRequestPacket{
+			Version:      version,
+			BuyerId:      buyerId,
+			DatacenterId: datacenterId,
+			ServerId:     common.HashString(serverAddresses[index].String()),
+		}
+		response := packets.SDK_ServerUpdateResponsePacket{Version: version}
+		ok := sendRequest(index, to, packets.SDK_SERVER_UPDATE_REQUEST_PACKET, &request, packets.SDK_SERVER_UPDATE_RESPONSE_PACKET, &response)
+		return response, ok
+	}
+
+	// wait until all server backends have a route matrix and know about each other
+
+	fmt.Printf("waiting for server backends\n")
+
+	ready := false
+
+	for i := 0; i < 60; i++ {
+		counts := make(map[string]int)
+		for j := 0; j < NumServers; j++ {
+			if response, ok := serverUpdate(j, loadBalancerAddress); ok && response.HasBackendAddress {
+				counts[response.BackendAddress.String()]++
+			}
+		}
+		if len(counts) == NumServerBackends {
+			ready = true
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	if !ready {
+		panic("servers were not spread across all server backends")
+	}
+
+	// server init sends each server to its preferred server backend, and that server backend agrees
+
+	fmt.Printf("initializing servers\n")
+
+	preferredAddresses := make([]net.UDPAddr, NumServers)
+
+	for i := 0; i < NumServers; i++ {
+
+		request := packets.SDK_ServerInitRequestPacket{
+			Version:        version,
+			BuyerId:        buyerId,
+			DatacenterId:   datacenterId,
+			DatacenterName: "local",
+		}
+
+		response := packets.SDK_ServerInitResponsePacket{Version: version}
+
+		if !sendRequest(i, loadBalancerAddress, packets.SDK_SERVER_INIT_REQUEST_PACKET, &request, packets.SDK_SERVER_INIT_RESPONSE_PACKET, &response) {
+			panic(fmt.Sprintf("no server init response for server %d", i))
+		}
+
+		if !response.HasBackendAddress {
+			panic(fmt.Sprintf("server init response for server %d has no backend address", i))
+		}
+
+		preferredAddresses[i] = response.BackendAddress
+
+		updateResponse, ok := serverUpdate(i, preferredAddresses[i])
+		if !ok {
+			panic(fmt.Sprintf("no server update response for server %d from %s", i, preferredAddresses[i].String()))
+		}
+
+		if !updateResponse.HasBackendAddress || updateResponse.BackendAddress.String() != preferredAddresses[i].String() || updateResponse.Migrate {
+			panic(fmt.Sprintf("server %d was sent to %s, but that server backend prefers %s", i, preferredAddresses[i].String(), updateResponse.BackendAddress.String()))
+		}
+	}
+
+	// shut down the last server backend. it drains, and tells its servers to migrate to the other server backends
+
+	drainingAddress := serverBackendAddresses[NumServerBackends-1]
+
+	fmt.Printf("shutting down server backend %s\n", drainingAddress.String())
+
+	server_backend_cmds[NumServerBackends-1].Process.Signal(syscall.SIGTERM)
+
+	time.Sleep(3 * time.Second)
+
+	numMigrated := 0
+
+	for i := 0; i < NumServers; i++ {
+
+		response, ok := serverUpdate(i, preferredAddresses[i])
+		if !ok {
+			panic(fmt.Sprintf("no server update response for server %d from %s", i, preferredAddresses[i].String()))
+		}
+
+		if preferredAddresses[i].String() != drainingAddress.String() {
+			if response.Migrate || response.BackendAddress.String() != preferredAddresses[i].String() {
+				panic(fmt.Sprintf("server %d moved from %s, but its server backend is not draining", i, preferredAddresses[i].String()))
+			}
+			continue
+		}
+
+		if !response.Migrate || !response.HasBackendAddress || response.BackendAddress.String() == drainingAddress.String() {
+			panic(fmt.Sprintf("server %d was not migrated off the draining server backend", i))
+		}
+
+		// the server backend the server migrated to agrees it should be there
+
+		migratedResponse, ok := serverUpdate(i, response.BackendAddress)
+		if !ok {
+			panic(fmt.Sprintf("no server update response for server %d from %s", i, response.BackendAddress.String()))
+		}
+
+		if migratedResponse.Migrate || migratedResponse.BackendAddress.String() != response.BackendAddress.String() {
+			panic(fmt.Sprintf("server %d migrated to %s, but that server backend prefers %s", i, response.BackendAddress.String(), migratedResponse.BackendAddress.String()))
+		}
+
+		numMigrated++
+	}
+
+	if numMigrated == 0 {
+		panic("no servers were migrated")
+	}
+
+	fmt.Printf("migrated %d servers\n", numMigrated)
+}
+
 type test_function func()
 
 var googleProjectID string
@@ -1094,6 +1433,7 @@ func main() {
 		test_relay_manager,
 		test_optimize,
 		test_relay_backend,
+		test_server_backend_affinity,
 	}
 
 	var tests []test_function
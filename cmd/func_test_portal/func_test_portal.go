@@ -217,7 +217,9 @@ func RunSessionInsertThreads(threadCount int) {
 
 					score := uint32(sessionId % 1000)
 
-					sessionInserter.Insert(context.Background(), sessionId, next, score, sessionData, sliceData)
+					decisionData := portal.GenerateRandomDecisionData()
+
+					sessionInserter.Insert(context.Background(), sessionId, next, score, sessionData, sliceData, decisionData)
 
 					clientRelayData := portal.GenerateRandomClientRelayData()
 					clientRelayInserter.Insert(context.Background(), sessionId, clientRelayData)
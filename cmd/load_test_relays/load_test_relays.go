@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/networknext/next/modules/common"
@@ -21,6 +22,12 @@ var relayBackendHostname string
 var relayBackendPublicKey []byte
 var relayPrivateKey []byte
 var numRelays int
+var relayUpdateTransport string
+var relayStreamAddress string
+
+var numUpdates uint64
+var numErrors uint64
+var totalLatencyMicroseconds uint64
 
 func main() {
 
@@ -32,6 +39,14 @@ func main() {
 
 	relayBackendHostname = envvar.GetString("RELAY_BACKEND_URL", "http://127.0.0.1:30000")
 
+	relayUpdateTransport = envvar.GetString("RELAY_UPDATE_TRANSPORT", "http")
+
+	relayStreamAddress = envvar.GetString("RELAY_STREAM_ADDRESS", "127.0.0.1:40000")
+
+	if relayUpdateTransport != "http" && relayUpdateTransport != "stream" {
+		panic("relay update transport must be 'http' or 'stream'")
+	}
+
 	relayBackendPublicKey = envvar.GetBase64("RELAY_BACKEND_PUBLIC_KEY", []byte{})
 
 	if len(relayBackendPublicKey) == 0 {
@@ -44,10 +59,12 @@ func main() {
 		panic("you must supply the relay private key")
 	}
 
-	core.Log("simulating %d relays", numRelays)
+	core.Log("simulating %d relays (%s)", numRelays, relayUpdateTransport)
 
 	go SimulateRelays(service)
 
+	go PrintStats(service)
+
 	service.WaitForShutdown()
 }
 
@@ -72,6 +89,11 @@ func RunRelay(service *common.Service, index int) {
 
 	ticker := time.NewTicker(time.Second)
 
+	var streamClient *common.RelayStreamClient
+	if relayUpdateTransport == "stream" {
+		streamClient = common.CreateRelayStreamClient(relayStreamAddress, nil, 5*time.Second)
+	}
+
 	go func() {
 		for {
 			select {
@@ -136,11 +158,23 @@ func RunRelay(service *common.Service, index int) {
 
 				copy(packetData[8+encryptedBytes:], nonce)
 
-				// post to relay backend
+				// send to relay backend
+
+				updateStartTime := time.Now()
+
+				var err error
+				if streamClient != nil {
+					err = StreamBinary(streamClient, packetData)
+				} else {
+					err = PostBinary(fmt.Sprintf("%s/relay_update", relayBackendHostname), packetData)
+				}
+
+				atomic.AddUint64(&numUpdates, 1)
+				atomic.AddUint64(&totalLatencyMicroseconds, uint64(time.Since(updateStartTime).Microseconds()))
 
-				err := PostBinary(fmt.Sprintf("%s/relay_update", relayBackendHostname), packetData)
 				if err != nil {
-					core.Error("failed to post relay update to relay backend: %v", err)
+					atomic.AddUint64(&numErrors, 1)
+					core.Error("failed to send relay update to relay backend: %v", err)
 				}
 			}
 		}
@@ -176,3 +210,54 @@ func PostBinary(url string, data []byte) error {
 
 	return nil
 }
+
+func StreamBinary(client *common.RelayStreamClient, data []byte) error {
+
+	response, err := client.Request(data)
+	if err != nil {
+		return err
+	}
+
+	if len(response) == 0 {
+		return fmt.Errorf("relay update was rejected")
+	}
+
+	// relay stream responses are encrypted to the relay, so decrypt to make the comparison with http fair
+
+	if len(response) < crypto.Box_MacSize+crypto.Box_NonceSize {
+		return fmt.Errorf("relay update response is too small")
+	}
+
+	nonce := response[len(response)-crypto.Box_NonceSize:]
+	encryptedBytes := len(response) - crypto.Box_NonceSize
+
+	return crypto.Box_Decrypt(relayBackendPublicKey, relayPrivateKey, nonce, response, encryptedBytes)
+}
+
+func PrintStats(service *common.Service) {
+
+	// print the same stats for each transport, so http and relay streams can be compared
+
+	ticker := time.NewTicker(10 * time.Second)
+
+	for {
+		select {
+
+		case <-service.Context.Done():
+			return
+
+		case <-ticker.C:
+
+			updates := atomic.SwapUint64(&numUpdates, 0)
+			errors := atomic.SwapUint64(&numErrors, 0)
+			latency := atomic.SwapUint64(&totalLatencyMicroseconds, 0)
+
+			averageLatency := 0.0
+			if updates > 0 {
+				averageLatency = float64(latency) / float64(updates) / 1000.0
+			}
+
+			core.Log("%s: %d updates, %d errors, %.2fms average latency", relayUpdateTransport, updates, errors, averageLatency)
+		}
+	}
+}
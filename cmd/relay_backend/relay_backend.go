@@ -9,7 +9,8 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 	"context"
@@ -109,6 +110,57 @@ var lastTimeSeriesUpdateTime map[uint64]int64 // IMPORTANT: per-relay, we only s
 
 var enableRelayHistory bool
 
+var relayCostEstimator string
+
+var enableIncrementalOptimize bool
+
+var enableRelayQuarantine bool
+var relayQuarantineCooldown int
+
+var enableRelaySampleValidation bool
+var discardRelaySamplesBelowSpeedOfLight bool
+var discardRelayTriangleViolations bool
+
+var enableDirectionalCosts bool
+var directionalDownstreamWeight float32
+
+var enableRelayStream bool
+var relayStreamAddress string
+var relayStreamKey []byte
+
+var enableRelayManagerSnapshot bool
+var relayManagerSnapshotInterval time.Duration
+var relayManagerSnapshotMaxAge int
+var relayManagerSnapshotFile string
+
+var enableRouteMatrixDelta bool
+var routeMatrixDeltaHistorySize int
+
+var enableRouteMatrixHandover bool
+var routeMatrixConvergeCount int
+var routeMatrixConvergeTolerance float32
+
+var enableRelayUpdateRecording bool
+var relayUpdateRecordingDirectory string
+var relayUpdateRecordingMaxFileBytes int
+var relayUpdateRecordingMaxFiles int
+var relayUpdateRecorder *common.RelayUpdateRecorder
+
+type routeMatrixHistoryEntry struct {
+	hash        uint64
+	routeMatrix *common.RouteMatrix
+}
+
+var routeMatrixDeltaMutex sync.Mutex
+var routeMatrixHistory []routeMatrixHistoryEntry // oldest first, the last entry is the current route matrix
+var routeMatrixDeltaCache map[uint64][]byte      // deltas to the current route matrix, by base hash
+
+var quarantineRedisClient redis.Cmdable
+
+var relayHealthMutex sync.RWMutex
+var relayHealthData []common.RelayHealth // worst relay first
+var relayHealthScores map[uint64]float32 // by relay id
+
 func main() {
 
 	service := common.CreateService("relay_backend")
@@ -135,6 +187,50 @@ func main() {
 
 	enableRelayHistory = envvar.GetBool("ENABLE_RELAY_HISTORY", false)
 
+	relayCostEstimator = envvar.GetString("RELAY_COST_ESTIMATOR", common.CostEstimator_Max)
+
+	if relayCostEstimator != common.CostEstimator_Max && !enableRelayHistory {
+		core.Log("relay cost estimator '%s' needs relay history. enabling relay history", relayCostEstimator)
+		enableRelayHistory = true
+	}
+
+	enableIncrementalOptimize = envvar.GetBool("ENABLE_INCREMENTAL_OPTIMIZE", true)
+
+	enableRelayQuarantine = envvar.GetBool("ENABLE_RELAY_QUARANTINE", false)
+	relayQuarantineCooldown = envvar.GetInt("RELAY_QUARANTINE_COOLDOWN", 300)
+
+	enableRelaySampleValidation = envvar.GetBool("ENABLE_RELAY_SAMPLE_VALIDATION", false)
+	discardRelaySamplesBelowSpeedOfLight = envvar.GetBool("DISCARD_RELAY_SAMPLES_BELOW_SPEED_OF_LIGHT", true)
+	discardRelayTriangleViolations = envvar.GetBool("DISCARD_RELAY_TRIANGLE_VIOLATIONS", false)
+
+	enableDirectionalCosts = envvar.GetBool("ENABLE_DIRECTIONAL_COSTS", false)
+	directionalDownstreamWeight = float32(envvar.GetFloat("DIRECTIONAL_DOWNSTREAM_WEIGHT", 0.75))
+
+	if enableDirectionalCosts {
+		core.Warn("directional costs are enabled, but relays only measure round trip time, so directional costs only differ by noise")
+	}
+
+	enableRelayStream = envvar.GetBool("ENABLE_RELAY_STREAM", false)
+	relayStreamAddress = envvar.GetString("RELAY_STREAM_ADDRESS", ":40001")
+	relayStreamKey = envvar.GetBase64("RELAY_BACKEND_STREAM_KEY", []byte{})
+
+	enableRelayManagerSnapshot = envvar.GetBool("ENABLE_RELAY_MANAGER_SNAPSHOT", false)
+	relayManagerSnapshotInterval = envvar.GetDuration("RELAY_MANAGER_SNAPSHOT_INTERVAL", 10*time.Second)
+	relayManagerSnapshotMaxAge = envvar.GetInt("RELAY_MANAGER_SNAPSHOT_MAX_AGE", constants.RelayTimeout) // restored relays time out after this anyway
+	relayManagerSnapshotFile = envvar.GetString("RELAY_MANAGER_SNAPSHOT_FILE", "")
+
+	enableRouteMatrixDelta = envvar.GetBool("ENABLE_ROUTE_MATRIX_DELTA", false)
+	routeMatrixDeltaHistorySize = envvar.GetInt("ROUTE_MATRIX_DELTA_HISTORY_SIZE", 10)
+
+	enableRouteMatrixHandover = envvar.GetBool("ENABLE_ROUTE_MATRIX_HANDOVER", false)
+	routeMatrixConvergeCount = envvar.GetInt("ROUTE_MATRIX_CONVERGE_COUNT", 10)
+	routeMatrixConvergeTolerance = float32(envvar.GetFloat("ROUTE_MATRIX_CONVERGE_TOLERANCE", 0.05))
+
+	enableRelayUpdateRecording = envvar.GetBool("ENABLE_RELAY_UPDATE_RECORDING", false)
+	relayUpdateRecordingDirectory = envvar.GetString("RELAY_UPDATE_RECORDING_DIRECTORY", "relay_updates")
+	relayUpdateRecordingMaxFileBytes = envvar.GetInt("RELAY_UPDATE_RECORDING_MAX_FILE_BYTES", 100*1024*1024)
+	relayUpdateRecordingMaxFiles = envvar.GetInt("RELAY_UPDATE_RECORDING_MAX_FILES", 24)
+
 	enableGooglePubsub = envvar.GetBool("ENABLE_GOOGLE_PUBSUB", false)
 
 	enableRelayToRelayPingAnalytics = envvar.GetBool("ENABLE_RELAY_TO_RELAY_PING_ANALYTICS", false)
@@ -207,6 +303,48 @@ func main() {
 
 	core.Debug("initial delay: %d", initialDelay)
 
+	core.Debug("enable incremental optimize: %v", enableIncrementalOptimize)
+
+	core.Debug("enable relay history: %v", enableRelayHistory)
+	core.Debug("relay cost estimator: %s", relayCostEstimator)
+
+	core.Debug("enable relay quarantine: %v", enableRelayQuarantine)
+	core.Debug("relay quarantine cooldown: %d", relayQuarantineCooldown)
+
+	core.Debug("enable relay sample validation: %v", enableRelaySampleValidation)
+	core.Debug("discard relay samples below speed of light: %v", discardRelaySamplesBelowSpeedOfLight)
+	core.Debug("discard relay triangle violations: %v", discardRelayTriangleViolations)
+
+	core.Debug("enable directional costs: %v", enableDirectionalCosts)
+	core.Debug("directional downstream weight: %.2f", directionalDownstreamWeight)
+
+	core.Debug("enable relay stream: %v", enableRelayStream)
+	core.Debug("relay stream address: %s", relayStreamAddress)
+
+	// IMPORTANT: relay streams carry decrypted relay updates, so only accept them from relay gateways that know the stream key
+
+	if enableRelayStream && len(relayStreamKey) == 0 {
+		core.Error("You must supply RELAY_BACKEND_STREAM_KEY to enable relay streams")
+		os.Exit(1)
+	}
+
+	core.Debug("enable relay manager snapshot: %v", enableRelayManagerSnapshot)
+	core.Debug("relay manager snapshot interval: %s", relayManagerSnapshotInterval)
+	core.Debug("relay manager snapshot max age: %d", relayManagerSnapshotMaxAge)
+	core.Debug("relay manager snapshot file: %s", relayManagerSnapshotFile)
+
+	core.Debug("enable route matrix delta: %v", enableRouteMatrixDelta)
+	core.Debug("route matrix delta history size: %d", routeMatrixDeltaHistorySize)
+
+	core.Debug("enable route matrix handover: %v", enableRouteMatrixHandover)
+	core.Debug("route matrix converge count: %d", routeMatrixConvergeCount)
+	core.Debug("route matrix converge tolerance: %.2f", routeMatrixConvergeTolerance)
+
+	core.Debug("enable relay update recording: %v", enableRelayUpdateRecording)
+	core.Debug("relay update recording directory: %s", relayUpdateRecordingDirectory)
+	core.Debug("relay update recording max file bytes: %d", relayUpdateRecordingMaxFileBytes)
+	core.Debug("relay update recording max files: %d", relayUpdateRecordingMaxFiles)
+
 	var redisClient redis.Cmdable
 	if len(redisPortalCluster) > 0 {
 		redisClient = common.CreateRedisClusterClient(redisPortalCluster)
@@ -216,6 +354,8 @@ func main() {
 
 	relayInserter = portal.CreateRelayInserter(redisClient, relayInserterBatchSize)
 
+	quarantineRedisClient = redisClient
+
 	if enableRedisTimeSeries {
 
 		timeSeriesConfig := common.RedisTimeSeriesConfig{
@@ -303,16 +443,77 @@ func main() {
 
 	relayManager := common.CreateRelayManager(enableRelayHistory)
 
+	costEstimator, err := common.CreateCostEstimator(relayCostEstimator)
+	if err != nil {
+		core.Error("%v", err)
+		os.Exit(1)
+	}
+
+	relayManager.SetCostEstimator(costEstimator)
+
+	if enableRelayQuarantine {
+		anomalyConfig := common.DefaultRelayAnomalyConfig()
+		anomalyConfig.CooldownSeconds = int64(relayQuarantineCooldown)
+		relayManager.SetAnomalyConfig(&anomalyConfig)
+	}
+
+	if enableRelaySampleValidation {
+		validationConfig := common.DefaultRelaySampleValidationConfig()
+		validationConfig.DiscardBelowSpeedOfLight = discardRelaySamplesBelowSpeedOfLight
+		validationConfig.DiscardTriangleViolations = discardRelayTriangleViolations
+		relayManager.SetSampleValidationConfig(&validationConfig)
+	}
+
+	// optionally record relay updates and route matrix stats, so problems in production can be replayed locally
+
+	if enableRelayUpdateRecording {
+		relayUpdateRecorder, err = common.CreateRelayUpdateRecorder(common.RelayUpdateRecorderConfig{
+			Directory:    relayUpdateRecordingDirectory,
+			MaxFileBytes: relayUpdateRecordingMaxFileBytes,
+			MaxFiles:     relayUpdateRecordingMaxFiles,
+		})
+		if err != nil {
+			core.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	// restore relay manager state from a recent snapshot, so we don't have to wait for relay histories to build up again
+
+	if enableRelayManagerSnapshot && RestoreRelayManagerSnapshot(relayManager) {
+		delayMutex.Lock()
+		delayCompleted = true
+		delayMutex.Unlock()
+	}
+
 	service.Router.HandleFunc("/relay_update", relayUpdateHandler(service, relayManager)).Methods("POST")
 	service.Router.HandleFunc("/relays", relaysHandler)
 	service.Router.HandleFunc("/relay_data", relayDataHandler(service))
 	service.Router.HandleFunc("/cost_matrix", costMatrixHandler)
 	service.Router.HandleFunc("/route_matrix", routeMatrixHandler)
+	service.Router.HandleFunc("/route_matrix_delta", routeMatrixDeltaHandler)
 	service.Router.HandleFunc("/relay_counters/{relay_name}", relayCountersHandler(service, relayManager))
 	service.Router.HandleFunc("/relay_history/{src}/{dest}", relayHistoryHandler(service, relayManager))
 	service.Router.HandleFunc("/relay_manager", relayManagerHandler(service, relayManager))
 	service.Router.HandleFunc("/costs", costsHandler(service, relayManager))
 	service.Router.HandleFunc("/active_relays", activeRelaysHandler(service, relayManager))
+	service.Router.HandleFunc("/relay_health", relayHealthHandler)
+	service.Router.HandleFunc("/relay_sample_violations", relaySampleViolationsHandler(service, relayManager))
+
+	// the relay gateway can forward relay updates over a relay stream instead of posting each one over http
+
+	if enableRelayStream {
+		config := common.RelayStreamServerConfig{
+			Address:     relayStreamAddress,
+			ReadTimeout: 60 * time.Second,
+			Key:         relayStreamKey,
+		}
+		_, err := common.CreateRelayStreamServer(service.Context, config, relayStreamHandler(service, relayManager))
+		if err != nil {
+			core.Error("%v", err)
+			os.Exit(1)
+		}
+	}
 
 	service.SetHealthFunctions(sendTrafficToMe(service), machineIsHealthy, ready(service))
 
@@ -326,6 +527,12 @@ func main() {
 
 	UpdateInitialDelayState(service)
 
+	UpdateRelayHealth(service, relayManager)
+
+	if enableRelayManagerSnapshot {
+		SnapshotRelayManager(service, relayManager)
+	}
+
 	PostRelayUpdateRequest(service)
 
 	service.WaitForShutdown()
@@ -351,69 +558,140 @@ func relayUpdateHandler(service *common.Service, relayManager *common.RelayManag
 		}
 		defer r.Body.Close()
 
-		// discard if the body is too small to possibly be valid
+		processRelayUpdate(service, relayManager, body)
+	}
+}
 
-		if len(body) < 64 {
-			core.Error("relay update is too small to be valid")
-			return
-		}
+func relayStreamHandler(service *common.Service, relayManager *common.RelayManager) func(remoteAddress string, frame []byte) []byte {
 
-		// read the relay update request packet
+	return func(remoteAddress string, frame []byte) []byte {
+
+		startTime := time.Now()
 
-		var relayUpdateRequest packets.RelayUpdateRequestPacket
-		err = relayUpdateRequest.Read(body)
+		defer func() {
+			duration := time.Since(startTime)
+			if duration.Milliseconds() > 1000 {
+				core.Warn("long relay update: %s", duration.String())
+			}
+		}()
+
+		processRelayUpdate(service, relayManager, frame)
+
+		return nil
+	}
+}
+
+// processRelayUpdate reads a decrypted relay update forwarded from the relay gateway, and processes it asynchronously
+func processRelayUpdate(service *common.Service, relayManager *common.RelayManager, body []byte) {
+
+	// discard if the body is too small to possibly be valid
+
+	if len(body) < 64 {
+		core.Error("relay update is too small to be valid")
+		return
+	}
+
+	// read the relay update request packet
+
+	var relayUpdateRequest packets.RelayUpdateRequestPacket
+	err := relayUpdateRequest.Read(body)
+	if err != nil {
+		core.Error("could not read relay update: %v", err)
+		return
+	}
+
+	if relayUpdateRecorder != nil {
+		err = relayUpdateRecorder.RecordRelayUpdate(body)
 		if err != nil {
-			core.Error("could not read relay update: %v", err)
-			return
+			core.Error("%v", err)
 		}
+	}
 
-		go func() {
+	go func() {
 
-			// check if we are overloaded
+		// check if we are overloaded
 
-			currentTime := uint64(time.Now().Unix())
+		currentTime := uint64(time.Now().Unix())
 
-			if relayUpdateRequest.CurrentTime < currentTime-5 {
-				core.Error("relay update is old. relay gateway -> relay backend is overloaded!")
-			}
+		if relayUpdateRequest.CurrentTime < currentTime-5 {
+			core.Error("relay update is old. relay gateway -> relay backend is overloaded!")
+		}
 
-			// look up the relay in the database
+		// look up the relay in the database
 
-			relayData := service.RelayData()
+		relayData := service.RelayData()
 
-			relayId := common.RelayId(relayUpdateRequest.Address.String())
-			relayIndex, ok := relayData.RelayIdToIndex[relayId]
-			if !ok {
-				core.Error("unknown relay id %016x", relayId)
-				return
-			}
+		relayId := common.RelayId(relayUpdateRequest.Address.String())
+		relayIndex, ok := relayData.RelayIdToIndex[relayId]
+		if !ok {
+			core.Error("unknown relay id %016x", relayId)
+			return
+		}
 
-			relayName := relayData.RelayNames[relayIndex]
-			relayAddress := relayData.RelayAddresses[relayIndex]
+		relayName := relayData.RelayNames[relayIndex]
+		relayAddress := relayData.RelayAddresses[relayIndex]
 
-			// process samples in the relay update (this drives the cost matrix...)
+		// process samples in the relay update (this drives the cost matrix...)
 
-			core.Debug("[%s] received update for %s [%016x]", relayAddress.String(), relayName, relayId)
+		core.Debug("[%s] received update for %s [%016x]", relayAddress.String(), relayName, relayId)
 
-			numSamples := int(relayUpdateRequest.NumSamples)
+		numSamples := int(relayUpdateRequest.NumSamples)
 
-			relayManager.ProcessRelayUpdate(int64(currentTime),
-				relayId,
-				relayName,
-				relayUpdateRequest.Address,
-				int(relayUpdateRequest.SessionCount),
-				relayUpdateRequest.RelayVersion,
-				relayUpdateRequest.RelayFlags,
-				numSamples,
-				relayUpdateRequest.SampleRelayId[:numSamples],
-				relayUpdateRequest.SampleRTT[:numSamples],
-				relayUpdateRequest.SampleJitter[:numSamples],
-				relayUpdateRequest.SamplePacketLoss[:numSamples],
-				relayUpdateRequest.RelayCounters[:],
-			)
+		relayManager.ProcessRelayUpdate(int64(currentTime),
+			relayId,
+			relayName,
+			relayUpdateRequest.Address,
+			int(relayUpdateRequest.SessionCount),
+			relayUpdateRequest.RelayVersion,
+			relayUpdateRequest.RelayFlags,
+			numSamples,
+			relayUpdateRequest.SampleRelayId[:numSamples],
+			relayUpdateRequest.SampleRTT[:numSamples],
+			relayUpdateRequest.SampleJitter[:numSamples],
+			relayUpdateRequest.SamplePacketLoss[:numSamples],
+			relayUpdateRequest.RelayCounters[:],
+		)
+
+		// track the bandwidth each relay uses, in whichever direction is busiest, so we know how close it is to its port speed
+
+		relayManager.SetRelayBandwidth(relayId, relayUpdateRequest.BandwidthKbps())
+
+		// watch for relays that suddenly look broken, and quarantine them
+
+		event := relayManager.DetectRelayAnomalies(int64(currentTime), relayId, relayUpdateRequest.PacketsSentPerSecond, relayUpdateRequest.BandwidthSentKbps)
+		if event != nil {
+			publishRelayQuarantineEvent(service, event)
+		}
 
-			postRelayUpdateRequestChannel <- &relayUpdateRequest
-		}()
+		postRelayUpdateRequestChannel <- &relayUpdateRequest
+	}()
+}
+
+func publishRelayQuarantineEvent(service *common.Service, event *common.RelayQuarantineEvent) {
+
+	if event.Quarantined {
+		core.Warn("quarantined relay %s [%016x]: %s", event.RelayName, event.RelayId, event.Reason)
+	} else {
+		core.Log("released relay %s [%016x] from quarantine", event.RelayName, event.RelayId)
+	}
+
+	if !service.IsLeader() {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		core.Error("could not marshal relay quarantine event: %v", err)
+		return
+	}
+
+	pipeline := quarantineRedisClient.Pipeline()
+	pipeline.Publish(service.Context, "relay_quarantine", data)
+	pipeline.LPush(service.Context, "relay_quarantine_events", data)
+	pipeline.LTrim(service.Context, "relay_quarantine_events", 0, 999)
+	_, err = pipeline.Exec(service.Context)
+	if err != nil {
+		core.Error("could not publish relay quarantine event: %v", err)
 	}
 }
 
@@ -538,6 +816,10 @@ func PostRelayUpdateRequest(service *common.Service) {
 
 			if service.IsLeader() {
 
+				relay := &relayData.RelayArray[relayIndex]
+
+				headroom := core.RelayHeadroom(int(message.SessionCount), relay.MaxSessions, relayUpdateRequest.BandwidthKbps(), relay.PortSpeed)
+
 				relayData := portal.RelayData{
 					RelayId:      message.RelayId,
 					RelayName:    message.RelayName,
@@ -546,8 +828,13 @@ func PostRelayUpdateRequest(service *common.Service) {
 					StartTime:    message.StartTime,
 					RelayFlags:   message.RelayFlags,
 					RelayVersion: message.RelayVersion,
+					Utilization:  100 - uint32(headroom),
 				}
 
+				relayHealthMutex.RLock()
+				relayData.HealthScore = relayHealthScores[message.RelayId]
+				relayHealthMutex.RUnlock()
+
 				relayInserter.Insert(service.Context, &relayData)
 
 				if enableRedisTimeSeries {
@@ -653,7 +940,11 @@ func activeRelaysHandler(service *common.Service, relayManager *common.RelayMana
 	return func(w http.ResponseWriter, r *http.Request) {
 		activeRelays := relayManager.GetActiveRelays(time.Now().Unix())
 		for i := range activeRelays {
-			fmt.Fprintf(w, "%s, ", activeRelays[i].Name)
+			if activeRelays[i].Quarantined {
+				fmt.Fprintf(w, "%s (quarantined), ", activeRelays[i].Name)
+			} else {
+				fmt.Fprintf(w, "%s, ", activeRelays[i].Name)
+			}
 		}
 		fmt.Fprintf(w, "\n")
 	}
@@ -957,6 +1248,199 @@ func initialDelayCompleted() bool {
 	return result
 }
 
+func createRelayManagerSnapshotRedisClient() redis.Cmdable {
+	if len(redisCluster) > 0 {
+		return common.CreateRedisClusterClient(redisCluster)
+	}
+	return common.CreateRedisClient(redisHostname)
+}
+
+func RestoreRelayManagerSnapshot(relayManager *common.RelayManager) bool {
+
+	var snapshot []byte
+	var err error
+
+	if relayManagerSnapshotFile != "" {
+		snapshot, err = os.ReadFile(relayManagerSnapshotFile)
+	} else {
+		snapshot, err = createRelayManagerSnapshotRedisClient().Get(context.Background(), "relay_manager_snapshot").Bytes()
+	}
+
+	if err != nil {
+		core.Warn("could not load relay manager snapshot: %v", err)
+		return false
+	}
+
+	err = relayManager.Restore(snapshot, time.Now().Unix(), int64(relayManagerSnapshotMaxAge))
+	if err != nil {
+		core.Warn("could not restore relay manager snapshot: %v", err)
+		return false
+	}
+
+	core.Log("restored relay manager snapshot (%d bytes). skipping initial delay", len(snapshot))
+
+	return true
+}
+
+func SnapshotRelayManager(service *common.Service, relayManager *common.RelayManager) {
+
+	var redisClient redis.Cmdable
+	if relayManagerSnapshotFile == "" {
+		redisClient = createRelayManagerSnapshotRedisClient()
+	}
+
+	go func() {
+
+		ticker := time.NewTicker(relayManagerSnapshotInterval)
+
+		for {
+			select {
+
+			case <-service.Context.Done():
+				return
+
+			case <-ticker.C:
+
+				// IMPORTANT: don't overwrite a good snapshot with our own until our relay histories have built up
+
+				if !initialDelayCompleted() {
+					continue
+				}
+
+				// every relay backend gets the same relay updates, so only the leader needs to write the shared snapshot
+
+				if redisClient != nil && !service.IsLeader() {
+					continue
+				}
+
+				snapshot, err := relayManager.Snapshot(time.Now().Unix())
+				if err != nil {
+					core.Error("could not snapshot relay manager: %v", err)
+					continue
+				}
+
+				if redisClient != nil {
+					err = redisClient.Set(service.Context, "relay_manager_snapshot", snapshot, time.Duration(relayManagerSnapshotMaxAge)*time.Second).Err()
+				} else {
+					tempFile := relayManagerSnapshotFile + ".tmp"
+					err = os.WriteFile(tempFile, snapshot, 0644)
+					if err == nil {
+						err = os.Rename(tempFile, relayManagerSnapshotFile)
+					}
+				}
+
+				if err != nil {
+					core.Error("could not write relay manager snapshot: %v", err)
+					continue
+				}
+
+				core.Debug("wrote relay manager snapshot (%d bytes)", len(snapshot))
+			}
+		}
+	}()
+}
+
+func UpdateRelayHealth(service *common.Service, relayManager *common.RelayManager) {
+
+	tracker := common.CreateRelayHealthTracker(common.DefaultRelayHealthConfig())
+
+	go func() {
+
+		ticker := time.NewTicker(time.Minute)
+
+		for {
+			select {
+
+			case <-service.Context.Done():
+				return
+
+			case <-ticker.C:
+
+				currentTime := time.Now().Unix()
+
+				relayData := service.RelayData()
+
+				health := tracker.Update(currentTime, relayManager, relayData.RelayIds, relayData.RelayNames, relayData.RelayLatitudes, relayData.RelayLongitudes, float32(maxJitter), maxPacketLoss)
+
+				scores := make(map[uint64]float32, len(health))
+				for i := range health {
+					scores[health[i].RelayId] = health[i].Score
+				}
+
+				sort.SliceStable(health, func(i, j int) bool { return health[i].Score < health[j].Score })
+
+				relayHealthMutex.Lock()
+				relayHealthData = health
+				relayHealthScores = scores
+				relayHealthMutex.Unlock()
+
+				// send relay health time series data to redis if leader
+
+				if enableRedisTimeSeries && service.IsLeader() {
+
+					message := common.RedisTimeSeriesMessage{}
+					message.Timestamp = uint64(currentTime * 1000) // seconds -> milliseconds
+					message.Keys = make([]string, 0, len(health)*6)
+					message.Values = make([]float64, 0, len(health)*6)
+
+					for i := range health {
+						message.Keys = append(message.Keys,
+							fmt.Sprintf("relay_%016x_health_score", health[i].RelayId),
+							fmt.Sprintf("relay_%016x_health_uptime", health[i].RelayId),
+							fmt.Sprintf("relay_%016x_health_reachability", health[i].RelayId),
+							fmt.Sprintf("relay_%016x_health_mean_rtt_ratio", health[i].RelayId),
+							fmt.Sprintf("relay_%016x_health_max_rtt_ratio", health[i].RelayId),
+							fmt.Sprintf("relay_%016x_health_packet_loss", health[i].RelayId),
+						)
+						message.Values = append(message.Values,
+							float64(health[i].Score),
+							float64(health[i].Uptime),
+							float64(health[i].Reachability),
+							float64(health[i].MeanRTTRatio),
+							float64(health[i].MaxRTTRatio),
+							float64(health[i].PacketLoss),
+						)
+					}
+
+					timeSeriesPublisher.MessageChannel <- &message
+				}
+			}
+		}
+	}()
+}
+
+func relayHealthHandler(w http.ResponseWriter, r *http.Request) {
+	relayHealthMutex.RLock()
+	health := relayHealthData
+	relayHealthMutex.RUnlock()
+	if health == nil {
+		health = []common.RelayHealth{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
+
+type relaySampleViolationsData struct {
+	RelayId   uint64 `json:"relay_id,string"`
+	RelayName string `json:"relay_name"`
+	common.RelaySampleViolations
+}
+
+func relaySampleViolationsHandler(service *common.Service, relayManager *common.RelayManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		relayData := service.RelayData()
+		violations := relayManager.GetRelaySampleViolations(relayData.RelayIds)
+		output := make([]relaySampleViolationsData, len(violations))
+		for i := range violations {
+			output[i].RelayId = relayData.RelayIds[i]
+			output[i].RelayName = relayData.RelayNames[i]
+			output[i].RelaySampleViolations = violations[i]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(output)
+	}
+}
+
 func UpdateInitialDelayState(service *common.Service) {
 	go func() {
 		for {
@@ -1045,141 +1529,215 @@ func routeMatrixHandler(w http.ResponseWriter, r *http.Request) {
 	buffer.WriteTo(w)
 }
 
-func UpdateRouteMatrix(service *common.Service, relayManager *common.RelayManager) {
+func updateRouteMatrixHistory(routeMatrixData []byte) {
 
-	ticker := time.NewTicker(routeMatrixInterval)
+	hash := common.RouteMatrixHash(routeMatrixData)
 
-	go func() {
+	routeMatrixDeltaMutex.Lock()
+	numEntries := len(routeMatrixHistory)
+	unchanged := numEntries > 0 && routeMatrixHistory[numEntries-1].hash == hash
+	routeMatrixDeltaMutex.Unlock()
 
-		for {
-			select {
+	if unchanged {
+		return
+	}
 
-			case <-service.Context.Done():
-				return
+	routeMatrix := &common.RouteMatrix{}
+	err := routeMatrix.Read(routeMatrixData)
+	if err != nil {
+		core.Error("could not read route matrix for delta history: %v", err)
+		return
+	}
 
-			case <-ticker.C:
+	routeMatrixDeltaMutex.Lock()
+	routeMatrixHistory = append(routeMatrixHistory, routeMatrixHistoryEntry{hash: hash, routeMatrix: routeMatrix})
+	if len(routeMatrixHistory) > routeMatrixDeltaHistorySize {
+		routeMatrixHistory = routeMatrixHistory[len(routeMatrixHistory)-routeMatrixDeltaHistorySize:]
+	}
+	routeMatrixDeltaCache = make(map[uint64][]byte)
+	routeMatrixDeltaMutex.Unlock()
+}
 
-				timeStart := time.Now()
+func routeMatrixDeltaHandler(w http.ResponseWriter, r *http.Request) {
 
-				// build relays csv
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 16, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-				currentTime := time.Now().Unix()
+	routeMatrixDeltaMutex.Lock()
+	defer routeMatrixDeltaMutex.Unlock()
 
-				relayData := service.RelayData()
+	numEntries := len(routeMatrixHistory)
+	if numEntries == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-				relaysCSVDataNew := relayManager.GetRelaysCSV(currentTime, relayData.RelayIds, relayData.RelayNames, relayData.RelayAddresses)
+	current := routeMatrixHistory[numEntries-1]
 
-				// build the cost matrix
+	if since == current.hash {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-				activeRelays := relayManager.GetActiveRelays(currentTime)
+	responseData, ok := routeMatrixDeltaCache[since]
 
-				numRelays := len(relayData.RelayIds)
+	if !ok {
 
-				costs := relayManager.GetCosts(currentTime, relayData.RelayIds, float32(maxJitter), maxPacketLoss)
+		var base *common.RouteMatrix
+		for i := range routeMatrixHistory {
+			if routeMatrixHistory[i].hash == since {
+				base = routeMatrixHistory[i].routeMatrix
+				break
+			}
+		}
 
-				relayPrice := make([]byte, numRelays)
+		if base == nil {
+			core.Debug("route matrix delta handler: unknown base %016x", since)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-				copy(relayPrice, relayData.RelayPrice)
+		delta, err := common.CreateRouteMatrixDelta(base, since, current.routeMatrix, current.hash)
+		if err == nil {
+			responseData, err = delta.Write()
+		}
+		if err != nil {
+			core.Debug("route matrix delta handler: %v", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-				costMatrixNew := &common.CostMatrix{
-					Version:            common.CostMatrixVersion_Write,
-					RelayIds:           relayData.RelayIds,
-					RelayAddresses:     relayData.RelayAddresses,
-					RelayNames:         relayData.RelayNames,
-					RelayLatitudes:     relayData.RelayLatitudes,
-					RelayLongitudes:    relayData.RelayLongitudes,
-					RelayDatacenterIds: relayData.RelayDatacenterIds,
-					DestRelays:         relayData.DestRelays,
-					Costs:              costs,
-					RelayPrice:         relayPrice,
-				}
+		routeMatrixDeltaCache[since] = responseData
+	}
 
-				// optimize cost matrix -> route matrix
+	core.Debug("route matrix delta handler (%d bytes)", len(responseData))
 
-				numCPUs := runtime.NumCPU()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	buffer := bytes.NewBuffer(responseData)
+	buffer.WriteTo(w)
+}
+
+func UpdateRouteMatrix(service *common.Service, relayManager *common.RelayManager) {
+
+	ticker := time.NewTicker(routeMatrixInterval)
 
-				numSegments := relayData.NumRelays
-				if numCPUs < relayData.NumRelays {
-					numSegments = relayData.NumRelays / 5
-					if numSegments == 0 {
-						numSegments = 1
+	builder := common.CreateRouteMatrixBuilder(common.RouteMatrixBuilderConfig{
+		MaxJitter:                   float32(maxJitter),
+		MaxPacketLoss:               maxPacketLoss,
+		EnableIncrementalOptimize:   enableIncrementalOptimize,
+		EnableDirectionalCosts:      enableDirectionalCosts,
+		DirectionalDownstreamWeight: directionalDownstreamWeight,
+		ConvergeRouteMatrices:       routeMatrixConvergeCount,
+		ConvergeTolerance:           routeMatrixConvergeTolerance,
+	})
+
+	// the last route matrix epoch we published or loaded from the leader
+
+	epoch := uint64(0)
+	epochGeneration := uint64(0)
+
+	go func() {
+
+		for {
+			select {
+
+			case <-service.Context.Done():
+				return
+
+			case <-ticker.C:
+
+				// build the cost matrix and optimize it into a route matrix
+
+				currentTime := time.Now().Unix()
+
+				relayData := service.RelayData()
+
+				// the leader gives every route matrix a new epoch, shared across all relay backends, so server backends can tell which route matrix is newer when the leader changes.
+				// other relay backends keep the last epoch published by the leader, since nobody reads their route matrix until they become leader.
+				// if redis fails we keep going with a local epoch in the same generation
+
+				if service.IsLeader() {
+					nextEpoch, nextEpochGeneration, err := service.NextEpoch("route_matrix", epoch)
+					if err != nil {
+						core.Warn("%v, using local epoch", err)
+						nextEpoch, nextEpochGeneration = epoch+1, epochGeneration
 					}
+					epoch, epochGeneration = nextEpoch, nextEpochGeneration
 				}
 
-				// write cost matrix data
-
-				costMatrixDataNew, err := costMatrixNew.Write()
+				update, err := builder.Build(currentTime, epoch, epochGeneration, relayData, relayManager)
 				if err != nil {
-					core.Error("could not write cost matrix: %v", err)
+					core.Error("%v", err)
 					continue
 				}
 
-				// optimize
-
-				routeEntries := core.Optimize2(relayData.NumRelays, numSegments, costs, relayPrice, relayData.RelayDatacenterIds, relayData.DestRelays)
+				// handover: once our relay manager has converged we are ready to take over as leader
 
-				timeFinish := time.Now()
+				if enableRouteMatrixHandover && builder.Converged() {
+					service.SetConverged()
+				}
 
-				optimizeDuration := timeFinish.Sub(timeStart)
+				activeRelays := update.ActiveRelays
+				routeMatrixNew := update.RouteMatrix
+				optimizeDuration := update.OptimizeDuration
 
 				core.Debug("updated route matrix: %d relays in %dms", relayData.NumRelays, optimizeDuration.Milliseconds())
 
-				if optimizeDuration.Milliseconds() > routeMatrixInterval.Milliseconds() {
-					core.Warn("optimize can't keep up! increase the number of cores or increase ROUTE_MATRIX_INTERVAL to provide more time to complete the optimization!")
+				if update.SampleValidation.BelowSpeedOfLight > 0 || update.SampleValidation.TriangleViolations > 0 {
+					core.Warn("%d/%d relay pairs below speed of light, %d/%d relay pairs violate triangle inequality", update.SampleValidation.BelowSpeedOfLight, update.SampleValidation.NumRelayPairs, update.SampleValidation.TriangleViolations, update.SampleValidation.NumRelayPairs)
 				}
 
-				// create new route matrix
-
-				routeMatrixNew := &common.RouteMatrix{
-					CreatedAt:          uint64(currentTime),
-					Version:            common.RouteMatrixVersion_Write,
-					RelayIds:           costMatrixNew.RelayIds,
-					RelayAddresses:     costMatrixNew.RelayAddresses,
-					RelayNames:         costMatrixNew.RelayNames,
-					RelayLatitudes:     costMatrixNew.RelayLatitudes,
-					RelayLongitudes:    costMatrixNew.RelayLongitudes,
-					RelayDatacenterIds: costMatrixNew.RelayDatacenterIds,
-					DestRelays:         costMatrixNew.DestRelays,
-					RouteEntries:       routeEntries,
-					BinFileBytes:       int32(len(relayData.DatabaseBinFile)),
-					BinFileData:        relayData.DatabaseBinFile,
-					CostMatrixSize:     uint32(len(costMatrixDataNew)),
-					OptimizeTime:       uint32(optimizeDuration.Milliseconds()),
-					Costs:              costs,
-					RelayPrice:         relayPrice,
+				if enableIncrementalOptimize && !enableDirectionalCosts {
+					optimizer := builder.Optimizer()
+					core.Debug("incremental optimize: %d dirty relays, %d/%d dirty route entries (full optimize = %v)", optimizer.NumDirtyRelays, optimizer.NumDirtyEntries, len(routeMatrixNew.RouteEntries), optimizer.FullOptimize)
 				}
 
-				// write route matrix data
+				if optimizeDuration.Milliseconds() > routeMatrixInterval.Milliseconds() {
+					core.Warn("optimize can't keep up! increase the number of cores or increase ROUTE_MATRIX_INTERVAL to provide more time to complete the optimization!")
+				}
 
-				routeMatrixDataNew, err := routeMatrixNew.Write()
-				if err != nil {
-					core.Error("could not write route matrix: %v", err)
-					continue
+				// record the route matrix stats alongside relay updates, so replays can be checked against them
+
+				if relayUpdateRecorder != nil {
+					err = relayUpdateRecorder.RecordRouteMatrixUpdate(update.AnalyticsMessage(time.Now().UnixNano()/1000, relayManager.CostEstimatorName()))
+					if err != nil {
+						core.Error("%v", err)
+					}
 				}
 
 				// store our data in redis
 
-				service.Store("relays", relaysCSVDataNew)
-				service.Store("cost_matrix", costMatrixDataNew)
-				service.Store("route_matrix", routeMatrixDataNew)
+				service.Store("relays", update.RelaysCSVData)
+				service.Store("cost_matrix", update.CostMatrixData)
+				service.Store("route_matrix", update.RouteMatrixData)
+				service.Store("route_matrix_epoch", []byte(fmt.Sprintf("%d %d", epochGeneration, epoch)))
 
 				// load the leader data from redis
 
-				relaysCSVDataNew = service.Load("relays")
+				relaysCSVDataNew := service.Load("relays")
 				if relaysCSVDataNew == nil {
 					continue
 				}
 
-				costMatrixDataNew = service.Load("cost_matrix")
+				costMatrixDataNew := service.Load("cost_matrix")
 				if costMatrixDataNew == nil {
 					continue
 				}
 
-				routeMatrixDataNew = service.Load("route_matrix")
+				routeMatrixDataNew := service.Load("route_matrix")
 				if routeMatrixDataNew == nil {
 					continue
 				}
 
+				var leaderEpoch, leaderEpochGeneration uint64
+				_, err = fmt.Sscanf(string(service.Load("route_matrix_epoch")), "%d %d", &leaderEpochGeneration, &leaderEpoch)
+				if err == nil && (leaderEpochGeneration != epochGeneration || leaderEpoch > epoch) {
+					epoch, epochGeneration = leaderEpoch, leaderEpochGeneration
+				}
+
 				// serve up as official data
 
 				relaysMutex.Lock()
@@ -1194,6 +1752,10 @@ func UpdateRouteMatrix(service *common.Service, relayManager *common.RelayManage
 				routeMatrixData = routeMatrixDataNew
 				routeMatrixMutex.Unlock()
 
+				if enableRouteMatrixDelta {
+					updateRouteMatrixHistory(routeMatrixDataNew)
+				}
+
 				// analyze route matrix
 
 				analysis := routeMatrixNew.Analyze()
@@ -1246,45 +1808,10 @@ func UpdateRouteMatrix(service *common.Service, relayManager *common.RelayManage
 
 				if enableGooglePubsub {
 
-					numDestRelays := 0
-					for i := range routeMatrixNew.DestRelays {
-						if routeMatrixNew.DestRelays[i] {
-							numDestRelays++
-						}
-					}
-
-					message := messages.AnalyticsRouteMatrixUpdateMessage{}
-
-					message.Timestamp = int64(time.Now().UnixNano() / 1000) // nano -> microseconds
-					message.NumRelays = int32(len(routeMatrixNew.RelayIds))
-					message.NumActiveRelays = int32(len(activeRelays))
-					message.NumDestRelays = int32(numDestRelays)
-					message.NumDatacenters = int32(len(relayData.RelayDatacenterIds))
-					message.TotalRoutes = int32(analysis.TotalRoutes)
-					message.AverageNumRoutes = analysis.AverageNumRoutes
-					message.AverageRouteLength = analysis.AverageRouteLength
-					message.NoRoutePercent = analysis.NoRoutePercent
-					message.OneRoutePercent = analysis.OneRoutePercent
-					message.NoDirectRoutePercent = analysis.NoDirectRoutePercent
-					message.RTTBucket_NoImprovement = analysis.RTTBucket_NoImprovement
-					message.RTTBucket_0_5ms = analysis.RTTBucket_0_5ms
-					message.RTTBucket_5_10ms = analysis.RTTBucket_5_10ms
-					message.RTTBucket_10_15ms = analysis.RTTBucket_10_15ms
-					message.RTTBucket_15_20ms = analysis.RTTBucket_15_20ms
-					message.RTTBucket_20_25ms = analysis.RTTBucket_20_25ms
-					message.RTTBucket_25_30ms = analysis.RTTBucket_25_30ms
-					message.RTTBucket_30_35ms = analysis.RTTBucket_30_35ms
-					message.RTTBucket_35_40ms = analysis.RTTBucket_35_40ms
-					message.RTTBucket_40_45ms = analysis.RTTBucket_40_45ms
-					message.RTTBucket_45_50ms = analysis.RTTBucket_45_50ms
-					message.RTTBucket_50ms_Plus = analysis.RTTBucket_50ms_Plus
-					message.CostMatrixSize = int32(len(costMatrixDataNew))
-					message.RouteMatrixSize = int32(len(routeMatrixDataNew))
-					message.DatabaseSize = int32(len(relayData.DatabaseBinFile))
-					message.OptimizeTime = int32(optimizeDuration.Milliseconds())
+					message := update.AnalyticsMessage(time.Now().UnixNano()/1000, relayManager.CostEstimatorName())
 
 					if service.IsLeader() {
-						data, err := avro.Marshal(routeMatrixUpdateSchema, &message)
+						data, err := avro.Marshal(routeMatrixUpdateSchema, message)
 						if err == nil {
 							analyticsRouteMatrixUpdateProducer.MessageChannel <- data
 						} else {
@@ -36,6 +36,23 @@ var relayBackendAddresses []string
 
 var httpClient *http.Client
 
+var enableRelayStream bool
+var relayStreamAddress string
+var relayStreamMaxConnections int
+
+var enableRelayBackendStream bool
+var relayBackendStreamPort string
+var relayBackendStreamKey []byte
+
+var relayBackendStreamsMutex sync.Mutex
+var relayBackendStreams map[string]*common.RelayStreamClient
+
+var enableRelayUpdateRecording bool
+var relayUpdateRecordingDirectory string
+var relayUpdateRecordingMaxFileBytes int
+var relayUpdateRecordingMaxFiles int
+var relayUpdateRecorder *common.RelayUpdateRecorder
+
 func main() {
 
 	service := common.CreateService("relay_gateway")
@@ -45,6 +62,16 @@ func main() {
 	pingKey = envvar.GetBase64("PING_KEY", []byte{})
 	relayBackendPublicKey = envvar.GetBase64("RELAY_BACKEND_PUBLIC_KEY", []byte{})
 	relayBackendPrivateKey = envvar.GetBase64("RELAY_BACKEND_PRIVATE_KEY", []byte{})
+	enableRelayStream = envvar.GetBool("ENABLE_RELAY_STREAM", false)
+	relayStreamAddress = envvar.GetString("RELAY_STREAM_ADDRESS", ":40000")
+	relayStreamMaxConnections = envvar.GetInt("RELAY_STREAM_MAX_CONNECTIONS", 4096)
+	enableRelayBackendStream = envvar.GetBool("ENABLE_RELAY_BACKEND_STREAM", false)
+	relayBackendStreamPort = envvar.GetString("RELAY_BACKEND_STREAM_PORT", "40001")
+	relayBackendStreamKey = envvar.GetBase64("RELAY_BACKEND_STREAM_KEY", []byte{})
+	enableRelayUpdateRecording = envvar.GetBool("ENABLE_RELAY_UPDATE_RECORDING", false)
+	relayUpdateRecordingDirectory = envvar.GetString("RELAY_UPDATE_RECORDING_DIRECTORY", "relay_updates")
+	relayUpdateRecordingMaxFileBytes = envvar.GetInt("RELAY_UPDATE_RECORDING_MAX_FILE_BYTES", 100*1024*1024)
+	relayUpdateRecordingMaxFiles = envvar.GetInt("RELAY_UPDATE_RECORDING_MAX_FILES", 24)
 
 	if len(redisCluster) > 0 {
 		core.Debug("redis cluster: %v", redisCluster)
@@ -67,6 +94,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if enableRelayBackendStream && len(relayBackendStreamKey) == 0 {
+		core.Error("You must supply RELAY_BACKEND_STREAM_KEY to enable relay backend streams")
+		os.Exit(1)
+	}
+
 	core.Debug("ping key: %x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x",
 		pingKey[0],
 		pingKey[1],
@@ -106,6 +138,33 @@ func main() {
 		Timeout: 5 * time.Second,
 	}
 
+	core.Debug("enable relay stream: %v", enableRelayStream)
+	core.Debug("relay stream address: %s", relayStreamAddress)
+	core.Debug("relay stream max connections: %d", relayStreamMaxConnections)
+	core.Debug("enable relay backend stream: %v", enableRelayBackendStream)
+	core.Debug("relay backend stream port: %s", relayBackendStreamPort)
+	core.Debug("enable relay update recording: %v", enableRelayUpdateRecording)
+	core.Debug("relay update recording directory: %s", relayUpdateRecordingDirectory)
+	core.Debug("relay update recording max file bytes: %d", relayUpdateRecordingMaxFileBytes)
+	core.Debug("relay update recording max files: %d", relayUpdateRecordingMaxFiles)
+
+	// optionally record the decrypted relay updates we forward, so problems in production can be replayed locally
+
+	if enableRelayUpdateRecording {
+		var err error
+		relayUpdateRecorder, err = common.CreateRelayUpdateRecorder(common.RelayUpdateRecorderConfig{
+			Directory:    relayUpdateRecordingDirectory,
+			MaxFileBytes: relayUpdateRecordingMaxFileBytes,
+			MaxFiles:     relayUpdateRecordingMaxFiles,
+		})
+		if err != nil {
+			core.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	relayBackendStreams = make(map[string]*common.RelayStreamClient)
+
 	TrackRelayBackendInstances(service)
 
 	service.UpdateMagic()
@@ -118,6 +177,24 @@ func main() {
 
 	service.Router.HandleFunc("/relay_backends", RelayBackendsHandler)
 
+	// relays that support it can keep a relay stream open instead of posting each relay update over http.
+	// anybody can connect, so cap the number of connections, and drop connections that don't send a valid relay update soon after connecting
+
+	if enableRelayStream {
+		config := common.RelayStreamServerConfig{
+			Address:         relayStreamAddress,
+			ReadTimeout:     30 * time.Second,
+			Reply:           true,
+			MaxConnections:  relayStreamMaxConnections,
+			AcceptedTimeout: 10 * time.Second,
+		}
+		_, err := common.CreateRelayStreamServer(service.Context, config, RelayStreamHandler(GetRelayData(service), GetMagicValues(service)))
+		if err != nil {
+			core.Error("%v", err)
+			os.Exit(1)
+		}
+	}
+
 	service.WaitForShutdown()
 }
 
@@ -148,199 +225,287 @@ func RelayUpdateHandler(getRelayData func() *common.RelayData, getMagicValues fu
 		}
 		defer request.Body.Close()
 
-		// ignore the relay update if it's too small to be valid
-
-		packetBytes := len(body)
-
-		if packetBytes < 1+1+4+2+crypto.Box_MacSize+crypto.Box_NonceSize {
-			core.Error("[%s] relay update packet is too small to be valid", request.RemoteAddr)
+		responseData := processRelayUpdate(request.RemoteAddr, body, startTime, getRelayData, getMagicValues, false)
+		if responseData == nil {
 			writer.WriteHeader(http.StatusBadRequest) // 400
 			return
 		}
 
-		// read the version and decide if we can handle it
+		// send the response packet back to the relay
 
-		index := 0
-		packetData := body
-		var packetVersion uint8
-		encoding.ReadUint8(packetData, &index, &packetVersion)
+		writer.Header().Set("Content-Type", request.Header.Get("Content-Type"))
 
-		if packetVersion < packets.RelayUpdateRequestPacket_VersionMin || packetVersion > packets.RelayUpdateRequestPacket_VersionMax {
-			core.Error("[%s] invalid relay update packet version: %d", request.RemoteAddr, packetVersion)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
-		}
+		writer.Write(responseData)
+	}
+}
 
-		// read the relay address
+func RelayStreamHandler(getRelayData func() *common.RelayData, getMagicValues func() ([constants.MagicBytes]byte, [constants.MagicBytes]byte, [constants.MagicBytes]byte)) func(remoteAddress string, frame []byte) []byte {
 
-		var relayAddress net.UDPAddr
-		if !encoding.ReadAddress(packetData, &index, &relayAddress) {
-			core.Error("[%s] could not read relay address", request.RemoteAddr)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
-		}
+	return func(remoteAddress string, frame []byte) []byte {
 
-		// check if the relay exists via relay id derived from relay address
+		startTime := time.Now()
 
-		relayData := getRelayData()
+		defer func() {
+			duration := time.Since(startTime)
+			if duration.Milliseconds() > 1000 {
+				core.Warn("long relay update: %s", duration.String())
+			}
+		}()
 
-		relayId := common.RelayId(relayAddress.String())
+		// IMPORTANT: an empty response frame tells the relay that its update was rejected
 
-		relay, ok := relayData.RelayHash[relayId]
-		if !ok {
-			core.Error("[%s] unknown relay %s [%x]", request.RemoteAddr, relayAddress.String(), relayId)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
+		responseData := processRelayUpdate(remoteAddress, frame, startTime, getRelayData, getMagicValues, true)
+		if responseData == nil {
+			return []byte{}
 		}
 
-		// decrypt the relay update
+		return responseData
+	}
+}
 
-		nonce := packetData[packetBytes-crypto.Box_NonceSize:]
+// processRelayUpdate decrypts and checks a relay update, forwards it to the relay backends, and returns the response packet for the relay. Returns nil if the relay update is rejected.
+// Relay streams are not protected by TLS, so for them the response packet is encrypted to the relay, followed by the nonce.
+func processRelayUpdate(remoteAddress string, packetData []byte, startTime time.Time, getRelayData func() *common.RelayData, getMagicValues func() ([constants.MagicBytes]byte, [constants.MagicBytes]byte, [constants.MagicBytes]byte), encryptResponse bool) []byte {
 
-		encryptedData := packetData[index : packetBytes-crypto.Box_NonceSize]
-		encryptedBytes := len(encryptedData)
+	// ignore the relay update if it's too small to be valid
 
-		relayPublicKey := relay.PublicKey[:]
+	packetBytes := len(packetData)
 
-		if len(relayPublicKey) == 0 {
-			core.Error("[%s] relay public key of length 0", request.RemoteAddr)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
-		}
+	if packetBytes < 1+1+4+2+crypto.Box_MacSize+crypto.Box_NonceSize {
+		core.Error("[%s] relay update packet is too small to be valid", remoteAddress)
+		return nil
+	}
 
-		err = crypto.Box_Decrypt(relayPublicKey, relayBackendPrivateKey, nonce, encryptedData, encryptedBytes)
-		if err != nil {
-			core.Error("[%s] failed to decrypt relay update (%d bytes)", request.RemoteAddr, encryptedBytes)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
-		}
+	// read the version and decide if we can handle it
 
-		// read the timestamp in the packet
+	index := 0
+	var packetVersion uint8
+	encoding.ReadUint8(packetData, &index, &packetVersion)
 
-		var packetTimestamp uint64
+	if packetVersion < packets.RelayUpdateRequestPacket_VersionMin || packetVersion > packets.RelayUpdateRequestPacket_VersionMax {
+		core.Error("[%s] invalid relay update packet version: %d", remoteAddress, packetVersion)
+		return nil
+	}
 
-		timestampIndex := index
+	// read the relay address
 
-		encoding.ReadUint64(packetData, &index, &packetTimestamp)
+	var relayAddress net.UDPAddr
+	if !encoding.ReadAddress(packetData, &index, &relayAddress) {
+		core.Error("[%s] could not read relay address", remoteAddress)
+		return nil
+	}
 
-		currentTimestamp := uint64(startTime.Unix())
+	// check if the relay exists via relay id derived from relay address
 
-		if packetTimestamp < currentTimestamp-10 {
-			core.Error("[%s] relay update request is too old", request.RemoteAddr)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
-		}
+	relayData := getRelayData()
 
-		if packetTimestamp > currentTimestamp+10 {
-			core.Error("[%s] relay update request is in the future", request.RemoteAddr)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
-		}
+	relayId := common.RelayId(relayAddress.String())
+
+	relay, ok := relayData.RelayHash[relayId]
+	if !ok {
+		core.Error("[%s] unknown relay %s [%x]", remoteAddress, relayAddress.String(), relayId)
+		return nil
+	}
+
+	// decrypt the relay update
+
+	nonce := packetData[packetBytes-crypto.Box_NonceSize:]
 
-		// relay update accepted
+	encryptedData := packetData[index : packetBytes-crypto.Box_NonceSize]
+	encryptedBytes := len(encryptedData)
 
-		relayName := relay.Name
+	relayPublicKey := relay.PublicKey[:]
 
-		core.Log("[%s] received update for %s [%016x] (%d bytes)", request.RemoteAddr, relayName, relayId, encryptedBytes)
+	if len(relayPublicKey) == 0 {
+		core.Error("[%s] relay public key of length 0", remoteAddress)
+		return nil
+	}
 
-		var responsePacket packets.RelayUpdateResponsePacket
+	err := crypto.Box_Decrypt(relayPublicKey, relayBackendPrivateKey, nonce, encryptedData, encryptedBytes)
+	if err != nil {
+		core.Error("[%s] failed to decrypt relay update (%d bytes)", remoteAddress, encryptedBytes)
+		return nil
+	}
 
-		responsePacket.Version = packets.RelayUpdateResponsePacket_VersionWrite
-		responsePacket.Timestamp = uint64(time.Now().Unix())
-		responsePacket.TargetVersion = relay.Version
+	// read the timestamp in the packet
 
-		relayIndex := 0
+	var packetTimestamp uint64
 
-		for i := range relayData.RelayIds {
+	timestampIndex := index
 
-			if relayData.RelayIds[i] == relayId {
-				continue
-			}
+	encoding.ReadUint64(packetData, &index, &packetTimestamp)
 
-			address := relayData.RelayArray[i].PublicAddress
+	currentTimestamp := uint64(startTime.Unix())
 
-			internal := uint8(0)
-			if relay.Seller.Id == relayData.RelaySellerIds[i] &&
-				relayData.RelayArray[i].HasInternalAddress && relay.HasInternalAddress &&
-				relayData.RelayArray[i].InternalGroup == relay.InternalGroup {
-				address = relayData.RelayArray[i].InternalAddress
-				internal = 1
-			}
+	if packetTimestamp < currentTimestamp-10 {
+		core.Error("[%s] relay update request is too old", remoteAddress)
+		return nil
+	}
 
-			responsePacket.RelayId[relayIndex] = relayData.RelayIds[i]
-			responsePacket.RelayAddress[relayIndex] = address
-			responsePacket.RelayInternal[relayIndex] = internal
+	if packetTimestamp > currentTimestamp+10 {
+		core.Error("[%s] relay update request is in the future", remoteAddress)
+		return nil
+	}
 
-			relayIndex++
-		}
+	// relay update accepted
 
-		responsePacket.NumRelays = uint32(relayIndex)
+	relayName := relay.Name
 
-		responsePacket.UpcomingMagic, responsePacket.CurrentMagic, responsePacket.PreviousMagic = getMagicValues()
+	core.Log("[%s] received update for %s [%016x] (%d bytes)", remoteAddress, relayName, relayId, encryptedBytes)
 
-		responsePacket.ExpectedPublicAddress = relay.PublicAddress
+	var responsePacket packets.RelayUpdateResponsePacket
 
-		if relay.HasInternalAddress {
-			responsePacket.ExpectedHasInternalAddress = 1
-			responsePacket.ExpectedInternalAddress = relay.InternalAddress
+	responsePacket.Version = packets.RelayUpdateResponsePacket_VersionWrite
+	responsePacket.Timestamp = uint64(time.Now().Unix())
+	responsePacket.TargetVersion = relay.Version
+
+	relayIndex := 0
+
+	for i := range relayData.RelayIds {
+
+		if relayData.RelayIds[i] == relayId {
+			continue
 		}
 
-		copy(responsePacket.ExpectedRelayPublicKey[:], relay.PublicKey)
-		copy(responsePacket.ExpectedRelayBackendPublicKey[:], relayBackendPublicKey)
+		address := relayData.RelayArray[i].PublicAddress
 
-		relaySecretKey, ok := relayData.RelaySecretKeys[relay.Id]
-		if !ok {
-			core.Error("[%s] could not find relay secret key", request.RemoteAddr)
-			writer.WriteHeader(http.StatusBadRequest) // 400
-			return
+		internal := uint8(0)
+		if relay.Seller.Id == relayData.RelaySellerIds[i] &&
+			relayData.RelayArray[i].HasInternalAddress && relay.HasInternalAddress &&
+			relayData.RelayArray[i].InternalGroup == relay.InternalGroup {
+			address = relayData.RelayArray[i].InternalAddress
+			internal = 1
 		}
 
-		token := core.RouteToken{}
-		token.NextAddress = net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 10000}
-		token.PrevAddress = net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 20000}
-		core.WriteEncryptedRouteToken(&token, responsePacket.TestToken[:], relaySecretKey)
+		responsePacket.RelayId[relayIndex] = relayData.RelayIds[i]
+		responsePacket.RelayAddress[relayIndex] = address
+		responsePacket.RelayInternal[relayIndex] = internal
 
-		copy(responsePacket.PingKey[:], pingKey)
+		relayIndex++
+	}
 
-		// send the response packet back to the relay
+	responsePacket.NumRelays = uint32(relayIndex)
 
-		responseData := make([]byte, responsePacket.GetMaxSize())
+	responsePacket.UpcomingMagic, responsePacket.CurrentMagic, responsePacket.PreviousMagic = getMagicValues()
 
-		responseData = responsePacket.Write(responseData)
+	responsePacket.ExpectedPublicAddress = relay.PublicAddress
 
-		writer.Header().Set("Content-Type", request.Header.Get("Content-Type"))
+	if relay.HasInternalAddress {
+		responsePacket.ExpectedHasInternalAddress = 1
+		responsePacket.ExpectedInternalAddress = relay.InternalAddress
+	}
 
-		writer.Write(responseData)
+	copy(responsePacket.ExpectedRelayPublicKey[:], relay.PublicKey)
+	copy(responsePacket.ExpectedRelayBackendPublicKey[:], relayBackendPublicKey)
+
+	relaySecretKey, ok := relayData.RelaySecretKeys[relay.Id]
+	if !ok {
+		core.Error("[%s] could not find relay secret key", remoteAddress)
+		return nil
+	}
+
+	token := core.RouteToken{}
+	token.NextAddress = net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 10000}
+	token.PrevAddress = net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 20000}
+	core.WriteEncryptedRouteToken(&token, responsePacket.TestToken[:], relaySecretKey)
+
+	copy(responsePacket.PingKey[:], pingKey)
+
+	// write the response packet
+
+	responseData := make([]byte, responsePacket.GetMaxSize()+crypto.Box_MacSize+crypto.Box_NonceSize)
+
+	responseData = responsePacket.Write(responseData)
+
+	if encryptResponse {
+		responseBytes := len(responseData)
+		responseData = responseData[:responseBytes+crypto.Box_MacSize+crypto.Box_NonceSize]
+		nonce := responseData[responseBytes+crypto.Box_MacSize:]
+		common.RandomBytes(nonce)
+		crypto.Box_Encrypt(relayBackendPrivateKey, relayPublicKey, nonce, responseData, responseBytes)
+	}
+
+	// adjust the packet to current time so we can detect when redis is overloaded in the relay backend
+
+	encoding.WriteUint64(packetData, &timestampIndex, currentTimestamp)
+
+	// forward the decrypted relay update to the relay backends
+
+	forwardRelayUpdate(packetData[:packetBytes-(crypto.Box_MacSize+crypto.Box_NonceSize)])
 
-		// adjust the packet to current time so we can detect when redis is overloaded in the relay backend
+	return responseData
+}
+
+func forwardRelayUpdate(data []byte) {
 
-		encoding.WriteUint64(packetData, &timestampIndex, currentTimestamp)
+	// IMPORTANT: relay stream frames are only valid until the next frame is read, so take a copy
 
-		// forward the decrypted relay update to the relay backends
+	forwardData := make([]byte, len(data))
+	copy(forwardData, data)
+
+	if relayUpdateRecorder != nil {
+		err := relayUpdateRecorder.RecordRelayUpdate(forwardData)
+		if err != nil {
+			core.Error("%v", err)
+		}
+	}
 
-		mutex.Lock()
-		addresses := make([]string, len(relayBackendAddresses))
-		copy(addresses, relayBackendAddresses)
-		mutex.Unlock()
+	mutex.Lock()
+	addresses := make([]string, len(relayBackendAddresses))
+	copy(addresses, relayBackendAddresses)
+	mutex.Unlock()
 
-		for i := range addresses {
-			core.Debug("forwarding relay update to %s", addresses[i])
-			go func(index int) {
-				url := fmt.Sprintf("http://%s/relay_update", addresses[index])
-				buffer := bytes.NewBuffer(body[:packetBytes-(crypto.Box_MacSize+crypto.Box_NonceSize)])
-				forward_request, err := http.NewRequest("POST", url, buffer)
+	for i := range addresses {
+		core.Debug("forwarding relay update to %s", addresses[i])
+		go func(index int) {
+			if enableRelayBackendStream {
+				err := getRelayBackendStream(addresses[index]).Send(forwardData)
 				if err == nil {
-					response, err := httpClient.Do(forward_request)
-					if err != nil && response != nil {
-						io.Copy(io.Discard, response.Body)
-						response.Body.Close()
-					}
+					return
 				}
-			}(i)
-		}
+				core.Warn("could not forward relay update to %s over relay stream, falling back to http: %v", addresses[index], err)
+			}
+			url := fmt.Sprintf("http://%s/relay_update", addresses[index])
+			buffer := bytes.NewBuffer(forwardData)
+			forward_request, err := http.NewRequest("POST", url, buffer)
+			if err == nil {
+				response, err := httpClient.Do(forward_request)
+				if err != nil && response != nil {
+					io.Copy(io.Discard, response.Body)
+					response.Body.Close()
+				}
+			}
+		}(i)
 	}
 }
 
+func relayBackendStreamAddress(address string) string {
+
+	// relay backends accept relay streams on the same host as their http address
+
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(host, relayBackendStreamPort)
+	}
+
+	return address
+}
+
+func getRelayBackendStream(address string) *common.RelayStreamClient {
+
+	streamAddress := relayBackendStreamAddress(address)
+
+	relayBackendStreamsMutex.Lock()
+	defer relayBackendStreamsMutex.Unlock()
+
+	client, exists := relayBackendStreams[streamAddress]
+	if !exists {
+		client = common.CreateRelayStreamClient(streamAddress, relayBackendStreamKey, 5*time.Second)
+		relayBackendStreams[streamAddress] = client
+	}
+
+	return client
+}
+
 func RelayBackendsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	mutex.Lock()
@@ -422,6 +587,23 @@ func updateRelayBackendInstances(service *common.Service, redisClient redis.Cmda
 	mutex.Lock()
 	relayBackendAddresses = addresses
 	mutex.Unlock()
+
+	// close relay streams to relay backends that have gone away
+
+	streamAddresses := make(map[string]bool, len(addresses))
+	for i := range addresses {
+		streamAddresses[relayBackendStreamAddress(addresses[i])] = true
+	}
+
+	relayBackendStreamsMutex.Lock()
+	for streamAddress, client := range relayBackendStreams {
+		if !streamAddresses[streamAddress] {
+			core.Debug("closing relay stream to %s", streamAddress)
+			client.Close()
+			delete(relayBackendStreams, streamAddress)
+		}
+	}
+	relayBackendStreamsMutex.Unlock()
 }
 
 func GetRelayData(service *common.Service) func() *common.RelayData {
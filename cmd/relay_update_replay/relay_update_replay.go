@@ -0,0 +1,343 @@
+/*
+   Relay update replay
+
+   Feeds a relay update recording from the relay gateway or relay backend into a local relay manager, and builds
+   route matrices from it exactly the same way the relay backend does, at real time or accelerated speed.
+
+   Recordings from the relay backend include the stats for each route matrix it built. Each time one of these is
+   reached, a route matrix is built from the replayed relay updates and its stats are diffed against the recorded
+   stats. Recordings without route matrix stats build a route matrix every ROUTE_MATRIX_INTERVAL of recorded time.
+
+   The relay backend settings (MAX_JITTER, RELAY_COST_ESTIMATOR, ENABLE_DIRECTIONAL_COSTS etc.) are read from the
+   same env vars as the relay backend, and must match production for the route matrices to match.
+
+   The database file must be the database the relay backend was running with when the recording was made.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/core"
+	db "github.com/networknext/next/modules/database"
+	"github.com/networknext/next/modules/envvar"
+	"github.com/networknext/next/modules/messages"
+	"github.com/networknext/next/modules/packets"
+)
+
+func main() {
+
+	recordingPath := envvar.GetString("RECORDING", "relay_updates")
+	databaseFile := envvar.GetString("DATABASE_FILE", "database.bin")
+	speed := envvar.GetFloat("SPEED", 0) // 1 = real time, 10 = 10x real time, 0 = as fast as possible
+	routeMatrixInterval := envvar.GetDuration("ROUTE_MATRIX_INTERVAL", time.Second)
+	costMatrixFile := envvar.GetString("COST_MATRIX_FILE", "")
+	routeMatrixFile := envvar.GetString("ROUTE_MATRIX_FILE", "")
+	verbose := envvar.GetBool("VERBOSE", false)
+
+	maxJitter := float32(envvar.GetInt("MAX_JITTER", 1000))
+	maxPacketLoss := float32(envvar.GetFloat("MAX_PACKET_LOSS", 100.0))
+	enableRelayHistory := envvar.GetBool("ENABLE_RELAY_HISTORY", false)
+	relayCostEstimator := envvar.GetString("RELAY_COST_ESTIMATOR", common.CostEstimator_Max)
+	enableIncrementalOptimize := envvar.GetBool("ENABLE_INCREMENTAL_OPTIMIZE", true)
+	enableRelayQuarantine := envvar.GetBool("ENABLE_RELAY_QUARANTINE", false)
+	relayQuarantineCooldown := envvar.GetInt("RELAY_QUARANTINE_COOLDOWN", 300)
+	enableRelaySampleValidation := envvar.GetBool("ENABLE_RELAY_SAMPLE_VALIDATION", false)
+	discardRelaySamplesBelowSpeedOfLight := envvar.GetBool("DISCARD_RELAY_SAMPLES_BELOW_SPEED_OF_LIGHT", true)
+	discardRelayTriangleViolations := envvar.GetBool("DISCARD_RELAY_TRIANGLE_VIOLATIONS", false)
+	enableDirectionalCosts := envvar.GetBool("ENABLE_DIRECTIONAL_COSTS", false)
+	directionalDownstreamWeight := float32(envvar.GetFloat("DIRECTIONAL_DOWNSTREAM_WEIGHT", 0.75))
+
+	if relayCostEstimator != common.CostEstimator_Max && !enableRelayHistory {
+		core.Log("relay cost estimator '%s' needs relay history. enabling relay history", relayCostEstimator)
+		enableRelayHistory = true
+	}
+
+	// load the database
+
+	database, err := db.LoadDatabase(databaseFile)
+	if err != nil {
+		core.Error("could not load database: %v", err)
+		os.Exit(1)
+	}
+
+	relayData := common.CreateRelayData(database)
+
+	core.Log("loaded database with %d relays", relayData.NumRelays)
+
+	// set up the relay manager and route matrix builder the same way as the relay backend
+
+	relayManager := common.CreateRelayManager(enableRelayHistory)
+
+	costEstimator, err := common.CreateCostEstimator(relayCostEstimator)
+	if err != nil {
+		core.Error("%v", err)
+		os.Exit(1)
+	}
+
+	relayManager.SetCostEstimator(costEstimator)
+
+	if enableRelayQuarantine {
+		anomalyConfig := common.DefaultRelayAnomalyConfig()
+		anomalyConfig.CooldownSeconds = int64(relayQuarantineCooldown)
+		relayManager.SetAnomalyConfig(&anomalyConfig)
+	}
+
+	if enableRelaySampleValidation {
+		validationConfig := common.DefaultRelaySampleValidationConfig()
+		validationConfig.DiscardBelowSpeedOfLight = discardRelaySamplesBelowSpeedOfLight
+		validationConfig.DiscardTriangleViolations = discardRelayTriangleViolations
+		relayManager.SetSampleValidationConfig(&validationConfig)
+	}
+
+	builder := common.CreateRouteMatrixBuilder(common.RouteMatrixBuilderConfig{
+		MaxJitter:                   maxJitter,
+		MaxPacketLoss:               maxPacketLoss,
+		EnableIncrementalOptimize:   enableIncrementalOptimize,
+		EnableDirectionalCosts:      enableDirectionalCosts,
+		DirectionalDownstreamWeight: directionalDownstreamWeight,
+	})
+
+	// replay the recording
+
+	reader, err := common.OpenRelayUpdateRecording(recordingPath)
+	if err != nil {
+		core.Error("could not open relay update recording: %v", err)
+		os.Exit(1)
+	}
+	defer reader.Close()
+
+	numRelayUpdates := 0
+	numInvalidRelayUpdates := 0
+	numUnknownRelayUpdates := 0
+	numRouteMatrices := 0
+	numMismatchedRouteMatrices := 0
+
+	var lastUpdate *common.RouteMatrixUpdate
+
+	replayStartTime := time.Now()
+	firstTimestamp := int64(0)
+	lastBuildTimestamp := int64(0)
+	foundRouteMatrixUpdate := false
+
+	for {
+
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			core.Error("could not read relay update recording: %v", err)
+			os.Exit(1)
+		}
+
+		// wait until it's time for this record, when not replaying as fast as possible
+
+		if firstTimestamp == 0 {
+			firstTimestamp = record.Timestamp
+			lastBuildTimestamp = record.Timestamp
+		}
+
+		if speed > 0 {
+			replayTime := replayStartTime.Add(time.Duration(float64(record.Timestamp-firstTimestamp) * float64(time.Microsecond) / speed))
+			time.Sleep(time.Until(replayTime))
+		}
+
+		currentTime := record.Timestamp / 1000000 // microseconds -> seconds
+
+		switch record.Type {
+
+		case common.RelayUpdateRecordType_RelayUpdate:
+
+			var relayUpdateRequest packets.RelayUpdateRequestPacket
+			err := relayUpdateRequest.Read(record.Data)
+			if err != nil {
+				numInvalidRelayUpdates++
+				continue
+			}
+
+			relayId := common.RelayId(relayUpdateRequest.Address.String())
+			relayIndex, ok := relayData.RelayIdToIndex[relayId]
+			if !ok {
+				numUnknownRelayUpdates++
+				continue
+			}
+
+			numSamples := int(relayUpdateRequest.NumSamples)
+
+			relayManager.ProcessRelayUpdate(currentTime,
+				relayId,
+				relayData.RelayNames[relayIndex],
+				relayUpdateRequest.Address,
+				int(relayUpdateRequest.SessionCount),
+				relayUpdateRequest.RelayVersion,
+				relayUpdateRequest.RelayFlags,
+				numSamples,
+				relayUpdateRequest.SampleRelayId[:numSamples],
+				relayUpdateRequest.SampleRTT[:numSamples],
+				relayUpdateRequest.SampleJitter[:numSamples],
+				relayUpdateRequest.SamplePacketLoss[:numSamples],
+				relayUpdateRequest.RelayCounters[:],
+			)
+
+			relayManager.SetRelayBandwidth(relayId, relayUpdateRequest.BandwidthKbps())
+
+			event := relayManager.DetectRelayAnomalies(currentTime, relayId, relayUpdateRequest.PacketsSentPerSecond, relayUpdateRequest.BandwidthSentKbps)
+			if event != nil {
+				core.Log("%s: %s quarantined = %v (%s)", time.Unix(currentTime, 0).UTC().Format(time.RFC3339), event.RelayName, event.Quarantined, event.Reason)
+			}
+
+			numRelayUpdates++
+
+			// recordings without route matrix stats build route matrices on the route matrix interval
+
+			if !foundRouteMatrixUpdate && time.Duration(record.Timestamp-lastBuildTimestamp)*time.Microsecond >= routeMatrixInterval {
+				lastBuildTimestamp = record.Timestamp
+				lastUpdate = buildRouteMatrix(builder, currentTime, uint64(numRouteMatrices+1), relayData, relayManager)
+				if lastUpdate != nil {
+					numRouteMatrices++
+					if verbose {
+						printRouteMatrixUpdate(lastUpdate.AnalyticsMessage(record.Timestamp, relayManager.CostEstimatorName()))
+					}
+				}
+			}
+
+		case common.RelayUpdateRecordType_RouteMatrixUpdate:
+
+			recorded, err := record.RouteMatrixUpdate()
+			if err != nil {
+				core.Error("%v", err)
+				continue
+			}
+
+			foundRouteMatrixUpdate = true
+
+			lastUpdate = buildRouteMatrix(builder, currentTime, uint64(numRouteMatrices+1), relayData, relayManager)
+			if lastUpdate == nil {
+				continue
+			}
+
+			numRouteMatrices++
+
+			replayed := lastUpdate.AnalyticsMessage(record.Timestamp, relayManager.CostEstimatorName())
+
+			differences := diffRouteMatrixUpdate(recorded, replayed)
+			if len(differences) > 0 {
+				numMismatchedRouteMatrices++
+				core.Log("%s: route matrix does not match", time.Unix(currentTime, 0).UTC().Format(time.RFC3339))
+				for i := range differences {
+					core.Log("    %s", differences[i])
+				}
+			} else if verbose {
+				printRouteMatrixUpdate(replayed)
+			}
+		}
+	}
+
+	// optionally write out the final cost matrix and route matrix, so they can be inspected or simulated against
+
+	if lastUpdate != nil && costMatrixFile != "" {
+		err = os.WriteFile(costMatrixFile, lastUpdate.CostMatrixData, 0644)
+		if err != nil {
+			core.Error("could not write cost matrix: %v", err)
+		}
+	}
+
+	if lastUpdate != nil && routeMatrixFile != "" {
+		err = os.WriteFile(routeMatrixFile, lastUpdate.RouteMatrixData, 0644)
+		if err != nil {
+			core.Error("could not write route matrix: %v", err)
+		}
+	}
+
+	fmt.Printf("\n%d relay updates (%d invalid, %d unknown relays) replayed in %.1f seconds\n", numRelayUpdates, numInvalidRelayUpdates, numUnknownRelayUpdates, time.Since(replayStartTime).Seconds())
+
+	if foundRouteMatrixUpdate {
+		fmt.Printf("%d route matrices compared, %d did not match\n\n", numRouteMatrices, numMismatchedRouteMatrices)
+	} else {
+		fmt.Printf("%d route matrices built (no route matrix stats in recording)\n\n", numRouteMatrices)
+	}
+
+	if numMismatchedRouteMatrices > 0 {
+		os.Exit(1)
+	}
+}
+
+func buildRouteMatrix(builder *common.RouteMatrixBuilder, currentTime int64, epoch uint64, relayData *common.RelayData, relayManager *common.RelayManager) *common.RouteMatrixUpdate {
+	update, err := builder.Build(currentTime, epoch, 0, relayData, relayManager)
+	if err != nil {
+		core.Error("%v", err)
+		return nil
+	}
+	return update
+}
+
+// diffRouteMatrixUpdate compares everything in the route matrix stats that should be the same when replayed. optimize time is not compared.
+// the database binary is gob encoded maps, so its size varies slightly each time it is written. route matrix size is compared without it
+func diffRouteMatrixUpdate(recorded *messages.AnalyticsRouteMatrixUpdateMessage, replayed *messages.AnalyticsRouteMatrixUpdateMessage) []string {
+
+	type field struct {
+		name     string
+		recorded float64
+		replayed float64
+	}
+
+	fields := []field{
+		{"num relays", float64(recorded.NumRelays), float64(replayed.NumRelays)},
+		{"num active relays", float64(recorded.NumActiveRelays), float64(replayed.NumActiveRelays)},
+		{"num dest relays", float64(recorded.NumDestRelays), float64(replayed.NumDestRelays)},
+		{"num datacenters", float64(recorded.NumDatacenters), float64(replayed.NumDatacenters)},
+		{"total routes", float64(recorded.TotalRoutes), float64(replayed.TotalRoutes)},
+		{"average num routes", float64(recorded.AverageNumRoutes), float64(replayed.AverageNumRoutes)},
+		{"average route length", float64(recorded.AverageRouteLength), float64(replayed.AverageRouteLength)},
+		{"no route percent", float64(recorded.NoRoutePercent), float64(replayed.NoRoutePercent)},
+		{"one route percent", float64(recorded.OneRoutePercent), float64(replayed.OneRoutePercent)},
+		{"no direct route percent", float64(recorded.NoDirectRoutePercent), float64(replayed.NoDirectRoutePercent)},
+		{"rtt bucket no improvement", float64(recorded.RTTBucket_NoImprovement), float64(replayed.RTTBucket_NoImprovement)},
+		{"rtt bucket 0-5ms", float64(recorded.RTTBucket_0_5ms), float64(replayed.RTTBucket_0_5ms)},
+		{"rtt bucket 5-10ms", float64(recorded.RTTBucket_5_10ms), float64(replayed.RTTBucket_5_10ms)},
+		{"rtt bucket 10-15ms", float64(recorded.RTTBucket_10_15ms), float64(replayed.RTTBucket_10_15ms)},
+		{"rtt bucket 15-20ms", float64(recorded.RTTBucket_15_20ms), float64(replayed.RTTBucket_15_20ms)},
+		{"rtt bucket 20-25ms", float64(recorded.RTTBucket_20_25ms), float64(replayed.RTTBucket_20_25ms)},
+		{"rtt bucket 25-30ms", float64(recorded.RTTBucket_25_30ms), float64(replayed.RTTBucket_25_30ms)},
+		{"rtt bucket 30-35ms", float64(recorded.RTTBucket_30_35ms), float64(replayed.RTTBucket_30_35ms)},
+		{"rtt bucket 35-40ms", float64(recorded.RTTBucket_35_40ms), float64(replayed.RTTBucket_35_40ms)},
+		{"rtt bucket 40-45ms", float64(recorded.RTTBucket_40_45ms), float64(replayed.RTTBucket_40_45ms)},
+		{"rtt bucket 45-50ms", float64(recorded.RTTBucket_45_50ms), float64(replayed.RTTBucket_45_50ms)},
+		{"rtt bucket 50ms+", float64(recorded.RTTBucket_50ms_Plus), float64(replayed.RTTBucket_50ms_Plus)},
+		{"cost matrix size", float64(recorded.CostMatrixSize), float64(replayed.CostMatrixSize)},
+		{"route matrix size (excluding database)", float64(recorded.RouteMatrixSize - recorded.DatabaseSize), float64(replayed.RouteMatrixSize - replayed.DatabaseSize)},
+	}
+
+	differences := []string{}
+
+	for i := range fields {
+		if math.Abs(fields[i].recorded-fields[i].replayed) > 0.001 {
+			differences = append(differences, fmt.Sprintf("%s: recorded %.3f, replayed %.3f", fields[i].name, fields[i].recorded, fields[i].replayed))
+		}
+	}
+
+	if recorded.CostEstimator != replayed.CostEstimator {
+		differences = append(differences, fmt.Sprintf("cost estimator: recorded %s, replayed %s", recorded.CostEstimator, replayed.CostEstimator))
+	}
+
+	return differences
+}
+
+func printRouteMatrixUpdate(message *messages.AnalyticsRouteMatrixUpdateMessage) {
+	core.Log("%s: %d/%d active relays, %d total routes, %.1f average routes, %.1f%% no route, %.1f%% no direct route",
+		time.UnixMicro(message.Timestamp).UTC().Format(time.RFC3339),
+		message.NumActiveRelays,
+		message.NumRelays,
+		message.TotalRoutes,
+		message.AverageNumRoutes,
+		message.NoRoutePercent,
+		message.NoDirectRoutePercent,
+	)
+}
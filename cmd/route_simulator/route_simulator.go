@@ -0,0 +1,181 @@
+/*
+   Route simulator
+
+   Replays recorded session update and relay ping analytics messages against a saved route matrix and
+   a candidate route shader, and reports what would have happened to players compared with the route
+   decisions that were actually made.
+
+   Recorded messages are read from avro files exported from the BigQuery analytics tables, eg.
+
+       bq extract --destination_format=AVRO analytics.session_update gs://bucket/session_update.avro
+
+   The session summary file is optional, but without it sessions without relay pings have no buyer, and
+   are skipped when simulating a single buyer.
+
+   The route matrix file is the binary route matrix, as served by the relay backend at /route_matrix.
+
+   The route shader file is optional json in the same format as the route shader in the database.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/core"
+	db "github.com/networknext/next/modules/database"
+	"github.com/networknext/next/modules/envvar"
+	"github.com/networknext/next/modules/messages"
+	"github.com/networknext/next/modules/packets"
+)
+
+func main() {
+
+	sessionUpdateFile := envvar.GetString("SESSION_UPDATE_FILE", "session_update.avro")
+	sessionSummaryFile := envvar.GetString("SESSION_SUMMARY_FILE", "")
+	clientRelayPingFile := envvar.GetString("CLIENT_RELAY_PING_FILE", "client_relay_ping.avro")
+	serverRelayPingFile := envvar.GetString("SERVER_RELAY_PING_FILE", "")
+	routeMatrixFile := envvar.GetString("ROUTE_MATRIX_FILE", "route_matrix.bin")
+	routeShaderFile := envvar.GetString("ROUTE_SHADER_FILE", "")
+	buyerIdString := envvar.GetString("BUYER_ID", "")
+	verbose := envvar.GetBool("VERBOSE", false)
+
+	// optionally only simulate sessions for one buyer. buyer id is hex, the same as the portal
+
+	buyerId := uint64(0)
+	if buyerIdString != "" {
+		value, err := strconv.ParseUint(buyerIdString, 16, 64)
+		if err != nil {
+			core.Error("could not parse buyer id: %v", err)
+			os.Exit(1)
+		}
+		buyerId = value
+	}
+
+	// load the route matrix, and the database it was built with
+
+	routeMatrixData, err := os.ReadFile(routeMatrixFile)
+	if err != nil {
+		core.Error("could not read route matrix file: %v", err)
+		os.Exit(1)
+	}
+
+	routeMatrix := &common.RouteMatrix{}
+	err = routeMatrix.Read(routeMatrixData)
+	if err != nil {
+		core.Error("could not read route matrix: %v", err)
+		os.Exit(1)
+	}
+
+	database := db.CreateDatabase()
+	if len(routeMatrix.BinFileData) > 0 {
+		err = database.LoadBinary(routeMatrix.BinFileData)
+		if err != nil {
+			core.Warn("could not load database from route matrix: %v", err)
+		}
+	}
+
+	core.Log("loaded route matrix with %d relays", len(routeMatrix.RelayIds))
+
+	// load the candidate route shader
+
+	routeShader := core.NewRouteShader()
+
+	if routeShaderFile != "" {
+		routeShaderData, err := os.ReadFile(routeShaderFile)
+		if err != nil {
+			core.Error("could not read route shader file: %v", err)
+			os.Exit(1)
+		}
+		err = json.Unmarshal(routeShaderData, &routeShader)
+		if err != nil {
+			core.Error("could not parse route shader: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// load recorded messages and group them by session
+
+	sessionUpdates := readMessages[messages.AnalyticsSessionUpdateMessage](sessionUpdateFile)
+	clientRelayPings := readMessages[messages.AnalyticsClientRelayPingMessage](clientRelayPingFile)
+
+	sessionSummaries := []messages.AnalyticsSessionSummaryMessage{}
+	if sessionSummaryFile != "" {
+		sessionSummaries = readMessages[messages.AnalyticsSessionSummaryMessage](sessionSummaryFile)
+	}
+
+	serverRelayPings := []messages.AnalyticsServerRelayPingMessage{}
+	if serverRelayPingFile != "" {
+		serverRelayPings = readMessages[messages.AnalyticsServerRelayPingMessage](serverRelayPingFile)
+	}
+
+	core.Log("loaded %d session updates, %d session summaries, %d client relay pings, %d server relay pings", len(sessionUpdates), len(sessionSummaries), len(clientRelayPings), len(serverRelayPings))
+
+	sessions, unknownBuyer := common.GroupSimulatedSessions(buyerId, sessionUpdates, sessionSummaries, clientRelayPings, serverRelayPings)
+
+	if unknownBuyer > 0 {
+		core.Warn("skipped %d sessions because we don't know their buyer. set SESSION_SUMMARY_FILE to include them", unknownBuyer)
+	}
+
+	// replay each session against the candidate route shader
+
+	simulator := common.CreateRouteSimulator(routeMatrix, database, &routeShader, packets.SDK_SliceSeconds)
+	simulator.Verbose = verbose
+
+	recorded := common.SimulationResults{}
+	simulated := common.SimulationResults{}
+
+	for _, session := range sessions {
+		simulator.Record(session, &recorded)
+		simulator.Simulate(session, &simulated)
+	}
+
+	fmt.Printf("\n%d sessions, %d slices\n\n", len(sessions), recorded.Slices)
+
+	fmt.Printf("%-36s %16s %16s\n", "", "recorded", "simulated")
+	fmt.Printf("%-36s %15.1f%% %15.1f%%\n", "accelerated sessions", percent(recorded.AcceleratedSessions, recorded.Sessions), percent(simulated.AcceleratedSessions, simulated.Sessions))
+	fmt.Printf("%-36s %15.1f%% %15.1f%%\n", "slices on network next", percent(recorded.NextSlices, recorded.Slices), percent(simulated.NextSlices, simulated.Slices))
+	fmt.Printf("%-36s %14.1fms %14.1fms\n", "predicted latency reduction", average(recorded.PredictedLatencyReductionSum, recorded.NextSlices), average(simulated.PredictedLatencyReductionSum, simulated.NextSlices))
+	fmt.Printf("%-36s %14.1fms %16s\n", "measured latency reduction", average(recorded.MeasuredLatencyReductionSum, recorded.NextSlices), "-")
+	fmt.Printf("%-36s %16d %16d\n", "route changes", recorded.RouteChanges, simulated.RouteChanges)
+	fmt.Printf("%-36s %16d %16d\n", "left network next", recorded.LeftNext, simulated.LeftNext)
+	fmt.Printf("%-36s %16.2f %16.2f\n", "route changes per session", average(float64(recorded.RouteChanges), recorded.Sessions), average(float64(simulated.RouteChanges), simulated.Sessions))
+	fmt.Printf("%-36s %16.2f %16.2f\n", "bandwidth cost (price x GB)", recorded.BandwidthCost, simulated.BandwidthCost)
+	fmt.Printf("\n")
+}
+
+func readMessages[T any](filename string) []T {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		core.Error("could not open %s: %v", filename, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	result, err := messages.ReadAnalyticsExport[T](file)
+	if err != nil {
+		core.Error("could not read %s: %v", filename, err)
+		os.Exit(1)
+	}
+
+	return result
+}
+
+func percent(count int, total int) float64 {
+	if total == 0 {
+		return 0.0
+	}
+	return 100.0 * float64(count) / float64(total)
+}
+
+func average(sum float64, count int) float64 {
+	if count == 0 {
+		return 0.0
+	}
+	return sum / float64(count)
+}
@@ -54,6 +54,40 @@ var shuttingDown bool
 
 var portalNextSessionsOnly bool
 
+var relayCapacityThreshold int
+
+var enableRateLimit bool
+var sourceAddressRateLimit common.RateLimit
+var sourceAddressRateLimitMaxBuckets int
+var buyerRateLimit common.RateLimit
+var sourceAddressRateLimiter *common.RateLimiter
+var buyerRateLimiter *common.RateLimiter
+var sourceAddressRateLimitedChannel chan net.UDPAddr
+var buyerRateLimitedChannel chan uint64
+
+var enableSessionStore bool
+var enableSessionStoreRedis bool
+var sessionStoreMaxEntries int
+var sessionStoreExpire time.Duration
+var sessionStoreRedisTimeout time.Duration
+var redisSessionStoreHostname string
+var redisSessionStoreCluster []string
+var sessionStore *common.SessionStore
+
+var enableBackendAffinity bool
+var backendAffinityAddress net.UDPAddr
+var redisBackendAffinityHostname string
+var redisBackendAffinityCluster []string
+var backendAffinity *common.BackendAffinity
+
+var enableClientRelayModel bool
+var clientRelayModelCellSize float64
+var clientRelayModelSaveInterval time.Duration
+var redisClientRelayModelHostname string
+var redisClientRelayModelCluster []string
+var clientRelayModel *common.ClientRelayModel
+var clientRelayPingChannel chan *messages.AnalyticsClientRelayPingMessage
+
 var sessionInserter *portal.SessionInserter
 var sessionCruncherURL string
 var serverCruncherURL string
@@ -121,6 +155,29 @@ func main() {
 	relayBackendPublicKey = envvar.GetBase64("RELAY_BACKEND_PUBLIC_KEY", []byte{})
 	enableGooglePubsub = envvar.GetBool("ENABLE_GOOGLE_PUBSUB", false)
 	portalNextSessionsOnly = envvar.GetBool("PORTAL_NEXT_SESSIONS_ONLY", false)
+	relayCapacityThreshold = envvar.GetInt("RELAY_CAPACITY_THRESHOLD", 0)
+	enableRateLimit = envvar.GetBool("ENABLE_RATE_LIMIT", false)
+	sourceAddressRateLimit.PacketsPerSecond = envvar.GetFloat("SOURCE_ADDRESS_PACKET_RATE_LIMIT", 1000)
+	sourceAddressRateLimit.Burst = envvar.GetFloat("SOURCE_ADDRESS_PACKET_RATE_BURST", 2000)
+	sourceAddressRateLimitMaxBuckets = envvar.GetInt("SOURCE_ADDRESS_PACKET_RATE_MAX_ADDRESSES", 100000)
+	buyerRateLimit.PacketsPerSecond = envvar.GetFloat("BUYER_PACKET_RATE_LIMIT", 0)
+	buyerRateLimit.Burst = envvar.GetFloat("BUYER_PACKET_RATE_BURST", 0)
+	enableSessionStore = envvar.GetBool("ENABLE_SESSION_STORE", false)
+	enableSessionStoreRedis = envvar.GetBool("ENABLE_SESSION_STORE_REDIS", true)
+	sessionStoreMaxEntries = envvar.GetInt("SESSION_STORE_MAX_ENTRIES", 100000)
+	sessionStoreExpire = envvar.GetDuration("SESSION_STORE_EXPIRE", 5*time.Minute)
+	sessionStoreRedisTimeout = envvar.GetDuration("SESSION_STORE_REDIS_TIMEOUT", 50*time.Millisecond)
+	redisSessionStoreCluster = envvar.GetStringArray("REDIS_SESSION_STORE_CLUSTER", []string{})
+	redisSessionStoreHostname = envvar.GetString("REDIS_SESSION_STORE_HOSTNAME", "127.0.0.1:6379")
+	enableBackendAffinity = envvar.GetBool("ENABLE_BACKEND_AFFINITY", false)
+	backendAffinityAddress = envvar.GetAddress("BACKEND_AFFINITY_ADDRESS", serverBackendAddress)
+	redisBackendAffinityCluster = envvar.GetStringArray("REDIS_BACKEND_AFFINITY_CLUSTER", []string{})
+	redisBackendAffinityHostname = envvar.GetString("REDIS_BACKEND_AFFINITY_HOSTNAME", "127.0.0.1:6379")
+	enableClientRelayModel = envvar.GetBool("ENABLE_CLIENT_RELAY_MODEL", false)
+	clientRelayModelCellSize = envvar.GetFloat("CLIENT_RELAY_MODEL_CELL_SIZE", 1.0)
+	clientRelayModelSaveInterval = envvar.GetDuration("CLIENT_RELAY_MODEL_SAVE_INTERVAL", 10*time.Second)
+	redisClientRelayModelCluster = envvar.GetStringArray("REDIS_CLIENT_RELAY_MODEL_CLUSTER", []string{})
+	redisClientRelayModelHostname = envvar.GetString("REDIS_CLIENT_RELAY_MODEL_HOSTNAME", "127.0.0.1:6379")
 	sessionCruncherURL = envvar.GetString("SESSION_CRUNCHER_URL", "http://127.0.0.1:40200")
 	serverCruncherURL = envvar.GetString("SERVER_CRUNCHER_URL", "http://127.0.0.1:40300")
 	sessionInsertBatchSize = envvar.GetInt("SESSION_INSERT_BATCH_SIZE", 10000)
@@ -148,6 +205,35 @@ func main() {
 	core.Debug("server backend address: %s", serverBackendAddress.String())
 	core.Debug("enable google pubsub: %v", enableGooglePubsub)
 	core.Debug("portal next sessions only: %v", portalNextSessionsOnly)
+	core.Debug("relay capacity threshold: %d%%", relayCapacityThreshold)
+	core.Debug("enable rate limit: %v", enableRateLimit)
+	if enableRateLimit {
+		core.Debug("source address packet rate limit: %.1f/s (burst %.1f)", sourceAddressRateLimit.PacketsPerSecond, sourceAddressRateLimit.Burst)
+		core.Debug("source address packet rate max addresses: %d", sourceAddressRateLimitMaxBuckets)
+		core.Debug("buyer packet rate limit: %.1f/s (burst %.1f)", buyerRateLimit.PacketsPerSecond, buyerRateLimit.Burst)
+	}
+	core.Debug("enable session store: %v", enableSessionStore)
+	if enableSessionStore {
+		core.Debug("enable session store redis: %v", enableSessionStoreRedis)
+		core.Debug("session store max entries: %d", sessionStoreMaxEntries)
+		core.Debug("session store expire: %s", sessionStoreExpire)
+		core.Debug("session store redis timeout: %s", sessionStoreRedisTimeout)
+		core.Debug("redis session store cluster: %s", redisSessionStoreCluster)
+		core.Debug("redis session store hostname: %s", redisSessionStoreHostname)
+	}
+	core.Debug("enable backend affinity: %v", enableBackendAffinity)
+	if enableBackendAffinity {
+		core.Debug("backend affinity address: %s", backendAffinityAddress.String())
+		core.Debug("redis backend affinity cluster: %s", redisBackendAffinityCluster)
+		core.Debug("redis backend affinity hostname: %s", redisBackendAffinityHostname)
+	}
+	core.Debug("enable client relay model: %v", enableClientRelayModel)
+	if enableClientRelayModel {
+		core.Debug("client relay model cell size: %.1f degrees", clientRelayModelCellSize)
+		core.Debug("client relay model save interval: %s", clientRelayModelSaveInterval)
+		core.Debug("redis client relay model cluster: %s", redisClientRelayModelCluster)
+		core.Debug("redis client relay model hostname: %s", redisClientRelayModelHostname)
+	}
 	core.Debug("session cruncher url: %s", sessionCruncherURL)
 	core.Debug("server cruncher url: %s", serverCruncherURL)
 	core.Debug("session insert batch size: %d", sessionInsertBatchSize)
@@ -254,6 +340,73 @@ func main() {
 
 	processFallbackToDirect(service, fallbackToDirectChannel)
 
+	// initialize rate limiters
+
+	if enableRateLimit {
+
+		sourceAddressRateLimiter = common.CreateRateLimiter(sourceAddressRateLimitMaxBuckets)
+		buyerRateLimiter = common.CreateRateLimiter(0)
+
+		sourceAddressRateLimitedChannel = make(chan net.UDPAddr, channelSize)
+		buyerRateLimitedChannel = make(chan uint64, channelSize)
+
+		processRateLimited(service, sourceAddressRateLimitedChannel, buyerRateLimitedChannel)
+	}
+
+	// initialize session store
+
+	if enableSessionStore {
+
+		var redisClient redis.Cmdable
+		if enableSessionStoreRedis {
+			if len(redisSessionStoreCluster) > 0 {
+				redisClient = common.CreateRedisClusterClient(redisSessionStoreCluster)
+			} else {
+				redisClient = common.CreateRedisClient(redisSessionStoreHostname)
+			}
+		}
+
+		sessionStore = common.CreateSessionStore(service.Context, redisClient, common.SessionStoreConfig{MaxEntries: sessionStoreMaxEntries, Expire: sessionStoreExpire, RedisTimeout: sessionStoreRedisTimeout})
+	}
+
+	// initialize backend affinity
+
+	if enableBackendAffinity {
+
+		var redisClient redis.Cmdable
+		if len(redisBackendAffinityCluster) > 0 {
+			redisClient = common.CreateRedisClusterClient(redisBackendAffinityCluster)
+		} else {
+			redisClient = common.CreateRedisClient(redisBackendAffinityHostname)
+		}
+
+		backendAffinity = common.CreateBackendAffinity(redisClient, common.BackendAffinityConfig{Address: backendAffinityAddress})
+
+		backendAffinity.Start(service.Context)
+
+		updateBackendAffinityDraining()
+	}
+
+	// initialize client relay model
+
+	if enableClientRelayModel {
+
+		var redisClient redis.Cmdable
+		if len(redisClientRelayModelCluster) > 0 {
+			redisClient = common.CreateRedisClusterClient(redisClientRelayModelCluster)
+		} else {
+			redisClient = common.CreateRedisClient(redisClientRelayModelHostname)
+		}
+
+		clientRelayModel = common.CreateClientRelayModel(common.ClientRelayModelConfig{CellSize: float32(clientRelayModelCellSize)})
+
+		clientRelayModel.Start(service.Context, redisClient, clientRelayModelSaveInterval)
+
+		clientRelayPingChannel = make(chan *messages.AnalyticsClientRelayPingMessage, channelSize)
+
+		processClientRelayPings(service, clientRelayPingChannel)
+	}
+
 	// initialize portal message channels
 
 	portalSessionUpdateMessageChannel = make(chan *messages.PortalSessionUpdateMessage, channelSize)
@@ -390,6 +543,27 @@ func updateShuttingDown() {
 	}()
 }
 
+// updateBackendAffinityDraining drains this instance when it is shutting down, so servers migrate to other instances while we still answer them
+func updateBackendAffinityDraining() {
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		for {
+			select {
+
+			case <-service.Context.Done():
+				return
+
+			case <-ticker.C:
+				if !backendAffinity.IsDraining() && (isShuttingDown() || service.Stopping) {
+					core.Log("draining backend affinity. servers will migrate to other instances")
+					backendAffinity.SetDraining(true)
+					backendAffinity.Update(service.Context)
+				}
+			}
+		}
+	}()
+}
+
 func isShuttingDown() bool {
 	shuttingDownMutex.Lock()
 	value := shuttingDown
@@ -417,6 +591,8 @@ func packetHandler(conn *net.UDPConn, from *net.UDPAddr, packetData []byte) {
 
 	handler.PortalNextSessionsOnly = portalNextSessionsOnly
 
+	handler.RelayCapacityThreshold = relayCapacityThreshold
+
 	handler.PingKey = pingKey
 	handler.ServerBackendAddress = serverBackendAddress
 	handler.ServerBackendPublicKey = serverBackendPublicKey
@@ -431,6 +607,24 @@ func packetHandler(conn *net.UDPConn, from *net.UDPAddr, packetData []byte) {
 
 	handler.FallbackToDirectChannel = fallbackToDirectChannel
 
+	handler.SessionStore = sessionStore
+
+	handler.BackendAffinity = backendAffinity
+
+	if enableClientRelayModel {
+		handler.ClientRelayModel = clientRelayModel
+		handler.ClientRelayPingChannel = clientRelayPingChannel
+	}
+
+	if enableRateLimit {
+		handler.SourceAddressRateLimiter = sourceAddressRateLimiter
+		handler.SourceAddressRateLimit = sourceAddressRateLimit
+		handler.BuyerRateLimiter = buyerRateLimiter
+		handler.BuyerRateLimit = buyerRateLimit
+		handler.SourceAddressRateLimitedChannel = sourceAddressRateLimitedChannel
+		handler.BuyerRateLimitedChannel = buyerRateLimitedChannel
+	}
+
 	handler.PortalSessionUpdateMessageChannel = portalSessionUpdateMessageChannel
 	handler.PortalServerUpdateMessageChannel = portalServerUpdateMessageChannel
 	handler.PortalClientRelayUpdateMessageChannel = portalClientRelayUpdateMessageChannel
@@ -444,16 +638,26 @@ func packetHandler(conn *net.UDPConn, from *net.UDPAddr, packetData []byte) {
 	handler.AnalyticsServerRelayPingMessageChannel = analyticsServerRelayPingMessageChannel
 
 	handler.LocateIP = locateIP_Real
-	handler.GetISPAndCountry = getISPAndCountry_Real
 
 	if service.Env == "dev" {
 		handler.LocateIP = locateIP_Dev
-		handler.GetISPAndCountry = getISPAndCountry_Dev
-	} else if service.Env == "local" && service.Env == "docker" {
-		handler.GetISPAndCountry = getISPAndCountry_Local
 	}
 
+	handler.GetISPAndCountry = getISPAndCountryFunction()
+
 	handlers.SDK_PacketHandler(&handler, conn, from, packetData)
+
+	if enableRedisTimeSeries && handler.Events[handlers.SDK_HandlerEvent_UnknownPacketType] {
+		countersPublisher.MessageChannel <- "unknown_packet_type"
+	}
+
+	if enableRedisTimeSeries && handler.Events[handlers.SDK_HandlerEvent_MigrateServer] {
+		countersPublisher.MessageChannel <- "migrate_server"
+	}
+
+	if enableRedisTimeSeries && handler.Events[handlers.SDK_HandlerEvent_LearnedClientRelays] {
+		countersPublisher.MessageChannel <- "learned_client_relays"
+	}
 }
 
 func locateIP_Local(ip net.IP) (float32, float32) {
@@ -549,6 +753,15 @@ func getISPAndCountry_Real(ip net.IP) (string, string) {
 	return service.GetISPAndCountry(ip)
 }
 
+func getISPAndCountryFunction() func(ip net.IP) (string, string) {
+	if service.Env == "dev" {
+		return getISPAndCountry_Dev
+	} else if service.Env == "local" || service.Env == "docker" {
+		return getISPAndCountry_Local
+	}
+	return getISPAndCountry_Real
+}
+
 // ------------------------------------------------------------------------------------
 
 func processFallbackToDirect(service *common.Service, channel chan uint64) {
@@ -564,6 +777,72 @@ func processFallbackToDirect(service *common.Service, channel chan uint64) {
 
 // ------------------------------------------------------------------------------------
 
+func processClientRelayPings(service *common.Service, inputChannel chan *messages.AnalyticsClientRelayPingMessage) {
+
+	// pings must land in the same cell that client relay requests look up, so use the same isp lookup as the handler
+
+	getISPAndCountry := getISPAndCountryFunction()
+
+	go func() {
+		for {
+			select {
+
+			case <-service.Context.Done():
+				return
+
+			case message := <-inputChannel:
+
+				clientAddress := core.ParseAddress(message.ClientAddress)
+
+				isp, country := getISPAndCountry(clientAddress.IP)
+
+				cellKey := clientRelayModel.CellKey(isp, country, message.Latitude, message.Longitude)
+
+				clientRelayModel.AddSample(cellKey, uint64(message.ClientRelayId), float32(message.ClientRelayRTT), float32(message.ClientRelayJitter), message.ClientRelayPacketLoss, time.Now())
+			}
+		}
+	}()
+}
+
+// ------------------------------------------------------------------------------------
+
+func processRateLimited(service *common.Service, sourceAddressChannel chan net.UDPAddr, buyerChannel chan uint64) {
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		sourceAddressDropped := 0
+		buyerDropped := 0
+		for {
+			select {
+
+			case <-service.Context.Done():
+				return
+
+			case <-ticker.C:
+				if sourceAddressDropped > 0 || buyerDropped > 0 {
+					core.Warn("rate limited %d packets by source address and %d packets by buyer in the last 10 seconds", sourceAddressDropped, buyerDropped)
+				}
+				sourceAddressDropped = 0
+				buyerDropped = 0
+
+			case <-sourceAddressChannel:
+				sourceAddressDropped++
+				if enableRedisTimeSeries {
+					countersPublisher.MessageChannel <- "rate_limited_source_address"
+				}
+
+			case buyerId := <-buyerChannel:
+				buyerDropped++
+				if enableRedisTimeSeries {
+					countersPublisher.MessageChannel <- "rate_limited_buyer"
+					countersPublisher.MessageChannel <- fmt.Sprintf("rate_limited_buyer_%016x", buyerId)
+				}
+			}
+		}
+	}()
+}
+
+// ------------------------------------------------------------------------------------
+
 func processPortalSessionUpdateMessages(service *common.Service, inputChannel chan *messages.PortalSessionUpdateMessage) {
 
 	var redisClient redis.Cmdable
@@ -639,8 +918,32 @@ func processPortalSessionUpdateMessages(service *common.Service, inputChannel ch
 				GamePacketLoss:    message.GamePacketLoss,
 			}
 
+			decisionData := portal.DecisionData{
+				Timestamp:                 message.Timestamp,
+				SliceNumber:               message.SliceNumber,
+				Reason:                    message.DecisionReason,
+				RouteStateFlags:           message.DecisionRouteStateFlags,
+				DirectRTT:                 uint32(message.DirectRTT),
+				NextRTT:                   uint32(message.NextRTT),
+				AcceptableLatency:         message.DecisionAcceptableLatency,
+				LatencyReductionThreshold: message.DecisionLatencyReductionThreshold,
+				RouteCost:                 message.DecisionRouteCost,
+				RouteNumRelays:            message.DecisionRouteNumRelays,
+				RouteRelayIds:             message.DecisionRouteRelayId,
+				NumCandidateRoutes:        message.NumCandidateRoutes,
+			}
+
+			for i := 0; i < int(message.NumCandidateRoutes); i++ {
+				decisionData.CandidateRoutes[i] = portal.DecisionRoute{
+					Cost:         message.CandidateRouteCost[i],
+					WeightedCost: message.CandidateRouteWeightedCost[i],
+					NumRelays:    message.CandidateRouteNumRelays[i],
+					RelayIds:     message.CandidateRouteRelayId[i],
+				}
+			}
+
 			if message.SendToPortal {
-				sessionInserter.Insert(service.Context, sessionId, message.BestNextRTT > 0, message.BestScore, &sessionData, &sliceData)
+				sessionInserter.Insert(service.Context, sessionId, message.BestNextRTT > 0, message.BestScore, &sessionData, &sliceData, &decisionData)
 			}
 
 			if enableRedisTimeSeries {
@@ -46,6 +46,18 @@ type RouteShaderData struct {
 	RouteSwitchThreshold          int     `json:"route_switch_threshold"`
 	RouteSelectThreshold          int     `json:"route_select_threshold"`
 	ForceNext                     bool    `json:"force_next"`
+	JitterWeight                  float64 `json:"jitter_weight"`
+	PacketLossWeight              float64 `json:"packet_loss_weight"`
+	AllowedSellers                string  `json:"allowed_sellers"`
+	DeniedSellers                 string  `json:"denied_sellers"`
+	AllowedDatacenters            string  `json:"allowed_datacenters"`
+	DeniedDatacenters             string  `json:"denied_datacenters"`
+	AllowedRelays                 string  `json:"allowed_relays"`
+	DeniedRelays                  string  `json:"denied_relays"`
+	RedundantRoute                bool    `json:"redundant_route"`
+	FlapHoldSlices                int     `json:"flap_hold_slices"`
+	FlapMaxHoldSlices             int     `json:"flap_max_hold_slices"`
+	FlapDecaySlices               int     `json:"flap_decay_slices"`
 }
 
 func (controller *Controller) RouteShaderDefaults() *RouteShaderData {
@@ -63,6 +75,12 @@ func (controller *Controller) RouteShaderDefaults() *RouteShaderData {
 	data.RouteSwitchThreshold = int(routeShader.RouteSwitchThreshold)
 	data.RouteSelectThreshold = int(routeShader.RouteSelectThreshold)
 	data.ForceNext = routeShader.ForceNext
+	data.JitterWeight = float64(routeShader.JitterWeight)
+	data.PacketLossWeight = float64(routeShader.PacketLossWeight)
+	data.RedundantRoute = routeShader.RedundantRoute
+	data.FlapHoldSlices = int(routeShader.FlapHoldSlices)
+	data.FlapMaxHoldSlices = int(routeShader.FlapMaxHoldSlices)
+	data.FlapDecaySlices = int(routeShader.FlapDecaySlices)
 	return &data
 }
 
@@ -82,7 +100,19 @@ INSERT INTO route_shaders
 	max_latency_trade_off,
 	route_switch_threshold,
 	route_select_threshold,
-	force_next
+	force_next,
+	jitter_weight,
+	packet_loss_weight,
+	allowed_sellers,
+	denied_sellers,
+	allowed_datacenters,
+	denied_datacenters,
+	allowed_relays,
+	denied_relays,
+	redundant_route,
+	flap_hold_slices,
+	flap_max_hold_slices,
+	flap_decay_slices
 )
 VALUES
 (
@@ -98,7 +128,19 @@ VALUES
 	$10,
 	$11,
 	$12,
-	$13
+	$13,
+	$14,
+	$15,
+	$16,
+	$17,
+	$18,
+	$19,
+	$20,
+	$21,
+	$22,
+	$23,
+	$24,
+	$25
 )
 RETURNING route_shader_id;`
 	result := controller.pgsql.QueryRow(sql,
@@ -115,6 +157,18 @@ RETURNING route_shader_id;`
 		routeShaderData.RouteSwitchThreshold,
 		routeShaderData.RouteSelectThreshold,
 		routeShaderData.ForceNext,
+		routeShaderData.JitterWeight,
+		routeShaderData.PacketLossWeight,
+		routeShaderData.AllowedSellers,
+		routeShaderData.DeniedSellers,
+		routeShaderData.AllowedDatacenters,
+		routeShaderData.DeniedDatacenters,
+		routeShaderData.AllowedRelays,
+		routeShaderData.DeniedRelays,
+		routeShaderData.RedundantRoute,
+		routeShaderData.FlapHoldSlices,
+		routeShaderData.FlapMaxHoldSlices,
+		routeShaderData.FlapDecaySlices,
 	)
 	routeShaderId := uint64(0)
 	if err := result.Scan(&routeShaderId); err != nil {
@@ -140,7 +194,19 @@ SELECT
 	max_latency_trade_off,
 	route_switch_threshold,
 	route_select_threshold,
-	force_next
+	force_next,
+	jitter_weight,
+	packet_loss_weight,
+	allowed_sellers,
+	denied_sellers,
+	allowed_datacenters,
+	denied_datacenters,
+	allowed_relays,
+	denied_relays,
+	redundant_route,
+	flap_hold_slices,
+	flap_max_hold_slices,
+	flap_decay_slices
 FROM
 	route_shaders;`
 	rows, err := controller.pgsql.Query(sql)
@@ -165,6 +231,18 @@ FROM
 			&row.RouteSwitchThreshold,
 			&row.RouteSelectThreshold,
 			&row.ForceNext,
+			&row.JitterWeight,
+			&row.PacketLossWeight,
+			&row.AllowedSellers,
+			&row.DeniedSellers,
+			&row.AllowedDatacenters,
+			&row.DeniedDatacenters,
+			&row.AllowedRelays,
+			&row.DeniedRelays,
+			&row.RedundantRoute,
+			&row.FlapHoldSlices,
+			&row.FlapMaxHoldSlices,
+			&row.FlapDecaySlices,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("could not scan route shader row: %v\n", err)
@@ -191,7 +269,19 @@ SELECT
 	max_latency_trade_off,
 	route_switch_threshold,
 	route_select_threshold,
-	force_next
+	force_next,
+	jitter_weight,
+	packet_loss_weight,
+	allowed_sellers,
+	denied_sellers,
+	allowed_datacenters,
+	denied_datacenters,
+	allowed_relays,
+	denied_relays,
+	redundant_route,
+	flap_hold_slices,
+	flap_max_hold_slices,
+	flap_decay_slices
 FROM
 	route_shaders
 WHERE
@@ -217,6 +307,18 @@ WHERE
 			&routeShader.RouteSwitchThreshold,
 			&routeShader.RouteSelectThreshold,
 			&routeShader.ForceNext,
+			&routeShader.JitterWeight,
+			&routeShader.PacketLossWeight,
+			&routeShader.AllowedSellers,
+			&routeShader.DeniedSellers,
+			&routeShader.AllowedDatacenters,
+			&routeShader.DeniedDatacenters,
+			&routeShader.AllowedRelays,
+			&routeShader.DeniedRelays,
+			&routeShader.RedundantRoute,
+			&routeShader.FlapHoldSlices,
+			&routeShader.FlapMaxHoldSlices,
+			&routeShader.FlapDecaySlices,
 		)
 		if err != nil {
 			return routeShader, fmt.Errorf("could not scan route shader row: %v\n", err)
@@ -244,9 +346,21 @@ SET
 	max_latency_trade_off = $10,	
 	route_switch_threshold = $11,
 	route_select_threshold = $12,
-	force_next = $13
+	force_next = $13,
+	jitter_weight = $14,
+	packet_loss_weight = $15,
+	allowed_sellers = $16,
+	denied_sellers = $17,
+	allowed_datacenters = $18,
+	denied_datacenters = $19,
+	allowed_relays = $20,
+	denied_relays = $21,
+	redundant_route = $22,
+	flap_hold_slices = $23,
+	flap_max_hold_slices = $24,
+	flap_decay_slices = $25
 WHERE
-	route_shader_id = $14;`
+	route_shader_id = $26;`
 	_, err := controller.pgsql.Exec(sql,
 		routeShaderData.RouteShaderName,
 		routeShaderData.ABTest,
@@ -261,6 +375,18 @@ WHERE
 		routeShaderData.RouteSwitchThreshold,
 		routeShaderData.RouteSelectThreshold,
 		routeShaderData.ForceNext,
+		routeShaderData.JitterWeight,
+		routeShaderData.PacketLossWeight,
+		routeShaderData.AllowedSellers,
+		routeShaderData.DeniedSellers,
+		routeShaderData.AllowedDatacenters,
+		routeShaderData.DeniedDatacenters,
+		routeShaderData.AllowedRelays,
+		routeShaderData.DeniedRelays,
+		routeShaderData.RedundantRoute,
+		routeShaderData.FlapHoldSlices,
+		routeShaderData.FlapMaxHoldSlices,
+		routeShaderData.FlapDecaySlices,
 		routeShaderData.RouteShaderId,
 	)
 	return err
@@ -282,6 +408,8 @@ type BuyerData struct {
 	RouteShaderId   uint64 `json:"route_shader_id"`
 	Live            bool   `json:"live"`
 	Debug           bool   `json:"debug"`
+	PacketRateLimit int    `json:"packet_rate_limit"`
+	PacketRateBurst int    `json:"packet_rate_burst"`
 }
 
 func (controller *Controller) CreateBuyer(buyerData *BuyerData) (uint64, error) {
@@ -292,8 +420,8 @@ func (controller *Controller) CreateBuyer(buyerData *BuyerData) (uint64, error)
 			return 0, fmt.Errorf("could not create buyer: invalid public key\n")
 		}
 	}
-	sql := "INSERT INTO buyers (buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug) VALUES ($1, $2, $3, $4, $5, $6) RETURNING buyer_id;"
-	result := controller.pgsql.QueryRow(sql, buyerData.BuyerName, buyerData.BuyerCode, buyerData.PublicKeyBase64, buyerData.RouteShaderId, buyerData.Live, buyerData.Debug)
+	sql := "INSERT INTO buyers (buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug, packet_rate_limit, packet_rate_burst) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING buyer_id;"
+	result := controller.pgsql.QueryRow(sql, buyerData.BuyerName, buyerData.BuyerCode, buyerData.PublicKeyBase64, buyerData.RouteShaderId, buyerData.Live, buyerData.Debug, buyerData.PacketRateLimit, buyerData.PacketRateBurst)
 	buyerId := uint64(0)
 	if err := result.Scan(&buyerId); err != nil {
 		return 0, fmt.Errorf("could not insert buyer: %v\n", err)
@@ -303,14 +431,14 @@ func (controller *Controller) CreateBuyer(buyerData *BuyerData) (uint64, error)
 
 func (controller *Controller) ReadBuyers() ([]BuyerData, error) {
 	buyers := make([]BuyerData, 0)
-	rows, err := controller.pgsql.Query("SELECT buyer_id, buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug FROM buyers;")
+	rows, err := controller.pgsql.Query("SELECT buyer_id, buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug, packet_rate_limit, packet_rate_burst FROM buyers;")
 	if err != nil {
 		return nil, fmt.Errorf("could not read buyers: %v\n", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		row := BuyerData{}
-		if err := rows.Scan(&row.BuyerId, &row.BuyerName, &row.BuyerCode, &row.PublicKeyBase64, &row.RouteShaderId, &row.Live, &row.Debug); err != nil {
+		if err := rows.Scan(&row.BuyerId, &row.BuyerName, &row.BuyerCode, &row.PublicKeyBase64, &row.RouteShaderId, &row.Live, &row.Debug, &row.PacketRateLimit, &row.PacketRateBurst); err != nil {
 			return nil, fmt.Errorf("could not scan buyer row: %v\n", err)
 		}
 		buyers = append(buyers, row)
@@ -320,13 +448,13 @@ func (controller *Controller) ReadBuyers() ([]BuyerData, error) {
 
 func (controller *Controller) ReadBuyer(buyerId uint64) (BuyerData, error) {
 	buyer := BuyerData{}
-	rows, err := controller.pgsql.Query("SELECT buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug FROM buyers WHERE buyer_id = $1;", buyerId)
+	rows, err := controller.pgsql.Query("SELECT buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug, packet_rate_limit, packet_rate_burst FROM buyers WHERE buyer_id = $1;", buyerId)
 	if err != nil {
 		return buyer, fmt.Errorf("could not read buyer: %v\n", err)
 	}
 	defer rows.Close()
 	if rows.Next() {
-		if err := rows.Scan(&buyer.BuyerName, &buyer.BuyerCode, &buyer.PublicKeyBase64, &buyer.RouteShaderId, &buyer.Live, &buyer.Debug); err != nil {
+		if err := rows.Scan(&buyer.BuyerName, &buyer.BuyerCode, &buyer.PublicKeyBase64, &buyer.RouteShaderId, &buyer.Live, &buyer.Debug, &buyer.PacketRateLimit, &buyer.PacketRateBurst); err != nil {
 			return buyer, fmt.Errorf("could not scan buyer row: %v\n", err)
 		}
 		buyer.BuyerId = buyerId
@@ -344,8 +472,8 @@ func (controller *Controller) UpdateBuyer(buyerData *BuyerData) error {
 		}
 	}
 	// IMPORTANT: Cannot change buyer id once created
-	sql := "UPDATE buyers SET buyer_name = $1, buyer_code = $2, public_key_base64 = $3, route_shader_id = $4, live = $5, debug = $6 WHERE buyer_id = $7;"
-	_, err := controller.pgsql.Exec(sql, buyerData.BuyerName, buyerData.BuyerCode, buyerData.PublicKeyBase64, buyerData.RouteShaderId, buyerData.Live, buyerData.Debug, buyerData.BuyerId)
+	sql := "UPDATE buyers SET buyer_name = $1, buyer_code = $2, public_key_base64 = $3, route_shader_id = $4, live = $5, debug = $6, packet_rate_limit = $7, packet_rate_burst = $8 WHERE buyer_id = $9;"
+	_, err := controller.pgsql.Exec(sql, buyerData.BuyerName, buyerData.BuyerCode, buyerData.PublicKeyBase64, buyerData.RouteShaderId, buyerData.Live, buyerData.Debug, buyerData.PacketRateLimit, buyerData.PacketRateBurst, buyerData.BuyerId)
 	return err
 }
 
@@ -358,15 +486,18 @@ func (controller *Controller) DeleteBuyer(buyerId uint64) error {
 // -----------------------------------------------------------------------
 
 type SellerData struct {
-	SellerId   uint64 `json:"seller_id"`
-	SellerName string `json:"seller_name"`
-	SellerCode string `json:"seller_code"`
+	SellerId            uint64  `json:"seller_id"`
+	SellerName          string  `json:"seller_name"`
+	SellerCode          string  `json:"seller_code"`
+	PeakStartHour       int     `json:"peak_start_hour"`
+	PeakEndHour         int     `json:"peak_end_hour"`
+	PeakPriceMultiplier float64 `json:"peak_price_multiplier"`
 }
 
 func (controller *Controller) CreateSeller(sellerData *SellerData) (uint64, error) {
 	var result *sql.Row
-	sql := "INSERT INTO sellers (seller_name, seller_code) VALUES ($1, $2) RETURNING seller_id;"
-	result = controller.pgsql.QueryRow(sql, sellerData.SellerName, sellerData.SellerCode)
+	sql := "INSERT INTO sellers (seller_name, seller_code, peak_start_hour, peak_end_hour, peak_price_multiplier) VALUES ($1, $2, $3, $4, $5) RETURNING seller_id;"
+	result = controller.pgsql.QueryRow(sql, sellerData.SellerName, sellerData.SellerCode, sellerData.PeakStartHour, sellerData.PeakEndHour, sellerData.PeakPriceMultiplier)
 	sellerId := uint64(0)
 	if err := result.Scan(&sellerId); err != nil {
 		return 0, fmt.Errorf("could not insert seller: %v\n", err)
@@ -376,14 +507,14 @@ func (controller *Controller) CreateSeller(sellerData *SellerData) (uint64, erro
 
 func (controller *Controller) ReadSellers() ([]SellerData, error) {
 	sellers := make([]SellerData, 0)
-	rows, err := controller.pgsql.Query("SELECT seller_id, seller_name, seller_code FROM sellers;")
+	rows, err := controller.pgsql.Query("SELECT seller_id, seller_name, seller_code, peak_start_hour, peak_end_hour, peak_price_multiplier FROM sellers;")
 	if err != nil {
 		return nil, fmt.Errorf("could not read sellers: %v\n", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		row := SellerData{}
-		if err := rows.Scan(&row.SellerId, &row.SellerName, &row.SellerCode); err != nil {
+		if err := rows.Scan(&row.SellerId, &row.SellerName, &row.SellerCode, &row.PeakStartHour, &row.PeakEndHour, &row.PeakPriceMultiplier); err != nil {
 			return nil, fmt.Errorf("could not scan seller row: %v\n", err)
 		}
 		sellers = append(sellers, row)
@@ -393,13 +524,13 @@ func (controller *Controller) ReadSellers() ([]SellerData, error) {
 
 func (controller *Controller) ReadSeller(sellerId uint64) (SellerData, error) {
 	seller := SellerData{}
-	rows, err := controller.pgsql.Query("SELECT seller_name, seller_code FROM sellers WHERE seller_id = $1;", sellerId)
+	rows, err := controller.pgsql.Query("SELECT seller_name, seller_code, peak_start_hour, peak_end_hour, peak_price_multiplier FROM sellers WHERE seller_id = $1;", sellerId)
 	if err != nil {
 		return seller, fmt.Errorf("could not read seller: %v\n", err)
 	}
 	defer rows.Close()
 	if rows.Next() {
-		if err := rows.Scan(&seller.SellerName, &seller.SellerCode); err != nil {
+		if err := rows.Scan(&seller.SellerName, &seller.SellerCode, &seller.PeakStartHour, &seller.PeakEndHour, &seller.PeakPriceMultiplier); err != nil {
 			return seller, fmt.Errorf("could not scan seller row: %v\n", err)
 		}
 		seller.SellerId = sellerId
@@ -411,8 +542,8 @@ func (controller *Controller) ReadSeller(sellerId uint64) (SellerData, error) {
 func (controller *Controller) UpdateSeller(sellerData *SellerData) error {
 	// IMPORTANT: Cannot change seller id once created
 	var err error
-	sql := "UPDATE sellers SET seller_name = $1, seller_code = $2 WHERE seller_id = $3;"
-	_, err = controller.pgsql.Exec(sql, sellerData.SellerName, sellerData.SellerCode, sellerData.SellerId)
+	sql := "UPDATE sellers SET seller_name = $1, seller_code = $2, peak_start_hour = $3, peak_end_hour = $4, peak_price_multiplier = $5 WHERE seller_id = $6;"
+	_, err = controller.pgsql.Exec(sql, sellerData.SellerName, sellerData.SellerCode, sellerData.PeakStartHour, sellerData.PeakEndHour, sellerData.PeakPriceMultiplier, sellerData.SellerId)
 	return err
 }
 
@@ -863,6 +994,128 @@ func (controller *Controller) DeleteBuyerDatacenterSettings(buyerId uint64, data
 
 // -----------------------------------------------------------------------
 
+type BuyerDatacenterRouteShader struct {
+	BuyerId       uint64 `json:"buyer_id"`
+	DatacenterId  uint64 `json:"datacenter_id"`
+	RouteShaderId uint64 `json:"route_shader_id"`
+}
+
+func (controller *Controller) CreateBuyerDatacenterRouteShader(override *BuyerDatacenterRouteShader) error {
+	sql := "INSERT INTO buyer_datacenter_route_shaders (buyer_id, datacenter_id, route_shader_id) VALUES ($1, $2, $3);"
+	_, err := controller.pgsql.Exec(sql, override.BuyerId, override.DatacenterId, override.RouteShaderId)
+	return err
+}
+
+func (controller *Controller) ReadBuyerDatacenterRouteShaders() ([]BuyerDatacenterRouteShader, error) {
+	overrides := make([]BuyerDatacenterRouteShader, 0)
+	rows, err := controller.pgsql.Query("SELECT buyer_id, datacenter_id, route_shader_id FROM buyer_datacenter_route_shaders;")
+	if err != nil {
+		return nil, fmt.Errorf("could not read buyer datacenter route shaders: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := BuyerDatacenterRouteShader{}
+		if err := rows.Scan(&row.BuyerId, &row.DatacenterId, &row.RouteShaderId); err != nil {
+			return nil, fmt.Errorf("could not scan buyer datacenter route shader row: %v\n", err)
+		}
+		overrides = append(overrides, row)
+	}
+	return overrides, nil
+}
+
+func (controller *Controller) ReadBuyerDatacenterRouteShader(buyerId uint64, datacenterId uint64) (BuyerDatacenterRouteShader, error) {
+	override := BuyerDatacenterRouteShader{}
+	rows, err := controller.pgsql.Query("SELECT buyer_id, datacenter_id, route_shader_id FROM buyer_datacenter_route_shaders WHERE buyer_id = $1 and datacenter_id = $2;", buyerId, datacenterId)
+	if err != nil {
+		return override, fmt.Errorf("could not read buyer datacenter route shader: %v\n", err)
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&override.BuyerId, &override.DatacenterId, &override.RouteShaderId); err != nil {
+			return override, fmt.Errorf("could not scan buyer datacenter route shader row: %v\n", err)
+		}
+		return override, nil
+	} else {
+		return override, fmt.Errorf("buyer datacenter route shader %x.%x not found", buyerId, datacenterId)
+	}
+}
+
+func (controller *Controller) UpdateBuyerDatacenterRouteShader(override *BuyerDatacenterRouteShader) error {
+	// IMPORTANT: Cannot change buyer id or datacenter id once created
+	sql := "UPDATE buyer_datacenter_route_shaders SET route_shader_id = $1 WHERE buyer_id = $2 AND datacenter_id = $3;"
+	_, err := controller.pgsql.Exec(sql, override.RouteShaderId, override.BuyerId, override.DatacenterId)
+	return err
+}
+
+func (controller *Controller) DeleteBuyerDatacenterRouteShader(buyerId uint64, datacenterId uint64) error {
+	sql := "DELETE FROM buyer_datacenter_route_shaders WHERE buyer_id = $1 AND datacenter_id = $2;"
+	_, err := controller.pgsql.Exec(sql, buyerId, datacenterId)
+	return err
+}
+
+// -----------------------------------------------------------------------
+
+type BuyerCountryRouteShader struct {
+	BuyerId       uint64 `json:"buyer_id"`
+	Country       string `json:"country"`
+	RouteShaderId uint64 `json:"route_shader_id"`
+}
+
+func (controller *Controller) CreateBuyerCountryRouteShader(override *BuyerCountryRouteShader) error {
+	sql := "INSERT INTO buyer_country_route_shaders (buyer_id, country, route_shader_id) VALUES ($1, $2, $3);"
+	_, err := controller.pgsql.Exec(sql, override.BuyerId, override.Country, override.RouteShaderId)
+	return err
+}
+
+func (controller *Controller) ReadBuyerCountryRouteShaders() ([]BuyerCountryRouteShader, error) {
+	overrides := make([]BuyerCountryRouteShader, 0)
+	rows, err := controller.pgsql.Query("SELECT buyer_id, country, route_shader_id FROM buyer_country_route_shaders;")
+	if err != nil {
+		return nil, fmt.Errorf("could not read buyer country route shaders: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := BuyerCountryRouteShader{}
+		if err := rows.Scan(&row.BuyerId, &row.Country, &row.RouteShaderId); err != nil {
+			return nil, fmt.Errorf("could not scan buyer country route shader row: %v\n", err)
+		}
+		overrides = append(overrides, row)
+	}
+	return overrides, nil
+}
+
+func (controller *Controller) ReadBuyerCountryRouteShader(buyerId uint64, country string) (BuyerCountryRouteShader, error) {
+	override := BuyerCountryRouteShader{}
+	rows, err := controller.pgsql.Query("SELECT buyer_id, country, route_shader_id FROM buyer_country_route_shaders WHERE buyer_id = $1 and country = $2;", buyerId, country)
+	if err != nil {
+		return override, fmt.Errorf("could not read buyer country route shader: %v\n", err)
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&override.BuyerId, &override.Country, &override.RouteShaderId); err != nil {
+			return override, fmt.Errorf("could not scan buyer country route shader row: %v\n", err)
+		}
+		return override, nil
+	} else {
+		return override, fmt.Errorf("buyer country route shader %x.%s not found", buyerId, country)
+	}
+}
+
+func (controller *Controller) UpdateBuyerCountryRouteShader(override *BuyerCountryRouteShader) error {
+	// IMPORTANT: Cannot change buyer id or country once created
+	sql := "UPDATE buyer_country_route_shaders SET route_shader_id = $1 WHERE buyer_id = $2 AND country = $3;"
+	_, err := controller.pgsql.Exec(sql, override.RouteShaderId, override.BuyerId, override.Country)
+	return err
+}
+
+func (controller *Controller) DeleteBuyerCountryRouteShader(buyerId uint64, country string) error {
+	sql := "DELETE FROM buyer_country_route_shaders WHERE buyer_id = $1 AND country = $2;"
+	_, err := controller.pgsql.Exec(sql, buyerId, country)
+	return err
+}
+
+// -----------------------------------------------------------------------
+
 type RelayKeypairData struct {
 	RelayKeypairId   uint64 `json:"relay_keypair_id"`
 	PublicKeyBase64  string `json:"public_key_base64"`
@@ -0,0 +1,312 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/networknext/next/modules/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+	Server backend affinity.
+
+	Server backends sit behind a load balancer, so without affinity each packet from a server can land on any
+	server backend instance. This is fine while all state is in the packet, but server side state such as rate
+	limits, caches and flap damping needs each server to talk to the same instance.
+
+	Each instance registers its own address in redis, and servers are assigned to instances by hashing their
+	server id across the instances that are not draining. The server init and server update responses tell the
+	SDK which instance to send its packets to. When an instance drains, it drops out of the assignment and tells
+	the servers talking to it to migrate to another instance.
+
+	This needs SDK 1.2.13, which sends the server id in the server init request and reads the backend address
+	and migrate flag from the responses. Older SDKs keep going through the load balancer. If the instance a server
+	was assigned to stops responding to server updates, the SDK falls back to the load balancer too.
+
+	Servers are assigned with rendezvous hashing, so when an instance joins or leaves, only the servers assigned
+	to that instance move.
+*/
+
+const BackendAffinityVersion = 0 // IMPORTANT: bump this anytime you change the redis data structures!
+
+// ------------------------------------------------------------------------
+
+// BackendHash assigns keys to backend addresses with rendezvous hashing
+type BackendHash struct {
+	addresses []net.UDPAddr
+	hashes    []uint64
+}
+
+func CreateBackendHash(addresses []net.UDPAddr) *BackendHash {
+
+	// sort addresses so every instance builds the same hash from the same set of addresses
+
+	sorted := make([]net.UDPAddr, len(addresses))
+	copy(sorted, addresses)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+
+	backendHash := &BackendHash{}
+	backendHash.addresses = sorted
+	backendHash.hashes = make([]uint64, len(sorted))
+	for i := range sorted {
+		backendHash.hashes[i] = HashString(sorted[i].String())
+	}
+
+	return backendHash
+}
+
+func (backendHash *BackendHash) NumAddresses() int {
+	return len(backendHash.addresses)
+}
+
+// Get returns the address the key is assigned to, or false if there are no addresses
+func (backendHash *BackendHash) Get(key uint64) (net.UDPAddr, bool) {
+	bestIndex := -1
+	bestScore := uint64(0)
+	for i := range backendHash.hashes {
+		score := mixHash(backendHash.hashes[i] ^ key)
+		if bestIndex == -1 || score > bestScore {
+			bestIndex = i
+			bestScore = score
+		}
+	}
+	if bestIndex == -1 {
+		return net.UDPAddr{}, false
+	}
+	return backendHash.addresses[bestIndex], true
+}
+
+// mixHash is the splitmix64 finalizer. server ids are already hashes, but xor of two hashes is not random enough on its own
+func mixHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ------------------------------------------------------------------------
+
+type BackendAffinityConfig struct {
+	ServiceName    string
+	Address        net.UDPAddr   // the address servers send packets to, to reach this instance directly
+	Timeout        time.Duration // instances that haven't updated for this long are removed
+	UpdateInterval time.Duration
+}
+
+type BackendInstance struct {
+	Address    string
+	StartTime  uint64
+	UpdateTime uint64 // milliseconds
+	Draining   bool
+}
+
+type BackendAffinity struct {
+	config      BackendAffinityConfig
+	redisClient redis.Cmdable
+	startTime   time.Time
+
+	mutex       sync.RWMutex
+	draining    bool
+	instances   []BackendInstance
+	backendHash *BackendHash
+}
+
+func CreateBackendAffinity(redisClient redis.Cmdable, config BackendAffinityConfig) *BackendAffinity {
+
+	if config.ServiceName == "" {
+		config.ServiceName = "server_backend"
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if config.UpdateInterval == 0 {
+		config.UpdateInterval = time.Second
+	}
+
+	backendAffinity := &BackendAffinity{}
+	backendAffinity.config = config
+	backendAffinity.redisClient = redisClient
+	backendAffinity.startTime = time.Now()
+
+	// until we hear about other instances, all servers are assigned to us
+
+	backendAffinity.backendHash = CreateBackendHash([]net.UDPAddr{config.Address})
+
+	core.Debug("backend affinity address: %s", config.Address.String())
+
+	return backendAffinity
+}
+
+func (backendAffinity *BackendAffinity) Start(ctx context.Context) {
+
+	backendAffinity.Update(ctx)
+
+	ticker := time.NewTicker(backendAffinity.config.UpdateInterval)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				backendAffinity.Update(ctx)
+			}
+		}
+	}()
+}
+
+func backendAffinityKey(serviceName string) string {
+	return fmt.Sprintf("%s-affinity-%d", serviceName, BackendAffinityVersion)
+}
+
+// Update writes our instance entry to redis, and reassigns servers across the instances that are live and not draining
+func (backendAffinity *BackendAffinity) Update(ctx context.Context) {
+
+	currentTime := uint64(time.Now().UnixMilli())
+
+	backendAffinity.mutex.RLock()
+	draining := backendAffinity.draining
+	backendAffinity.mutex.RUnlock()
+
+	instance := BackendInstance{}
+	instance.Address = backendAffinity.config.Address.String()
+	instance.StartTime = uint64(backendAffinity.startTime.UnixNano())
+	instance.UpdateTime = currentTime
+	instance.Draining = draining
+
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(instance)
+	if err != nil {
+		core.Error("failed to write backend instance entry")
+		return
+	}
+
+	key := backendAffinityKey(backendAffinity.config.ServiceName)
+
+	if err := backendAffinity.redisClient.HSet(ctx, key, instance.Address, buffer.Bytes()).Err(); err != nil {
+		core.Error("failed to write backend instance entry: %v", err)
+	}
+
+	values, err := backendAffinity.redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		core.Error("failed to get backend instance entries: %v", err)
+		return
+	}
+
+	// convert instance data to instance entries, removing instances that have timed out
+
+	timeout := uint64(backendAffinity.config.Timeout.Milliseconds())
+
+	instances := []BackendInstance{}
+	expired := []string{}
+
+	for k, v := range values {
+		entry := BackendInstance{}
+		decoder := gob.NewDecoder(bytes.NewBuffer([]byte(v)))
+		if err := decoder.Decode(&entry); err != nil {
+			core.Debug("could not decode backend instance entry: %v", err)
+			expired = append(expired, k)
+			continue
+		}
+		if entry.UpdateTime+timeout < currentTime {
+			expired = append(expired, k)
+			continue
+		}
+		instances = append(instances, entry)
+	}
+
+	if len(expired) > 0 {
+		backendAffinity.redisClient.HDel(ctx, key, expired...)
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Address < instances[j].Address })
+
+	// servers are only assigned to instances that are not draining. we always know our own state, even if redis doesn't have it yet
+
+	addresses := []net.UDPAddr{}
+	if !draining {
+		addresses = append(addresses, backendAffinity.config.Address)
+	}
+
+	for i := range instances {
+		if instances[i].Draining || instances[i].Address == instance.Address {
+			continue
+		}
+		address, err := net.ResolveUDPAddr("udp", instances[i].Address)
+		if err != nil {
+			core.Debug("invalid backend instance address '%s'", instances[i].Address)
+			continue
+		}
+		addresses = append(addresses, *address)
+	}
+
+	backendHash := CreateBackendHash(addresses)
+
+	backendAffinity.mutex.Lock()
+	backendAffinity.instances = instances
+	if backendAffinity.draining == draining {
+		backendAffinity.backendHash = backendHash
+	}
+	backendAffinity.mutex.Unlock()
+}
+
+// SetDraining removes this instance from the assignment straight away. other instances find out on their next update
+func (backendAffinity *BackendAffinity) SetDraining(draining bool) {
+
+	backendAffinity.mutex.Lock()
+	defer backendAffinity.mutex.Unlock()
+
+	if backendAffinity.draining == draining {
+		return
+	}
+
+	backendAffinity.draining = draining
+
+	addresses := []net.UDPAddr{}
+	for i := range backendAffinity.backendHash.addresses {
+		if backendAffinity.backendHash.addresses[i].String() != backendAffinity.config.Address.String() {
+			addresses = append(addresses, backendAffinity.backendHash.addresses[i])
+		}
+	}
+	if !draining {
+		addresses = append(addresses, backendAffinity.config.Address)
+	}
+
+	backendAffinity.backendHash = CreateBackendHash(addresses)
+}
+
+func (backendAffinity *BackendAffinity) IsDraining() bool {
+	backendAffinity.mutex.RLock()
+	defer backendAffinity.mutex.RUnlock()
+	return backendAffinity.draining
+}
+
+func (backendAffinity *BackendAffinity) Address() net.UDPAddr {
+	return backendAffinity.config.Address
+}
+
+// Instances returns the live instances from the last update, including instances that are draining
+func (backendAffinity *BackendAffinity) Instances() []BackendInstance {
+	backendAffinity.mutex.RLock()
+	defer backendAffinity.mutex.RUnlock()
+	return backendAffinity.instances
+}
+
+// PreferredBackend returns the address of the instance the server should send its packets to, or false if no instance can take it
+func (backendAffinity *BackendAffinity) PreferredBackend(serverId uint64) (net.UDPAddr, bool) {
+	backendAffinity.mutex.RLock()
+	defer backendAffinity.mutex.RUnlock()
+	return backendAffinity.backendHash.Get(serverId)
+}
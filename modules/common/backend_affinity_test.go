@@ -0,0 +1,160 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/core"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendHash(t *testing.T) {
+
+	t.Parallel()
+
+	const NumAddresses = 4
+	const NumKeys = 10000
+
+	addresses := make([]net.UDPAddr, NumAddresses)
+	for i := range addresses {
+		addresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 40000+i))
+	}
+
+	// no addresses, no assignment
+
+	_, ok := common.CreateBackendHash(nil).Get(1)
+	assert.False(t, ok)
+
+	// keys are spread across all addresses, and the order addresses are passed in doesn't matter
+
+	backendHash := common.CreateBackendHash(addresses)
+
+	reversed := make([]net.UDPAddr, NumAddresses)
+	for i := range addresses {
+		reversed[i] = addresses[NumAddresses-1-i]
+	}
+
+	reversedHash := common.CreateBackendHash(reversed)
+
+	assignment := make([]net.UDPAddr, NumKeys)
+	counts := make(map[string]int)
+
+	for i := 0; i < NumKeys; i++ {
+		key := common.HashString(fmt.Sprintf("server%d", i))
+		address, ok := backendHash.Get(key)
+		assert.True(t, ok)
+		reversedAddress, _ := reversedHash.Get(key)
+		assert.Equal(t, address.String(), reversedAddress.String())
+		assignment[i] = address
+		counts[address.String()]++
+	}
+
+	assert.Equal(t, NumAddresses, len(counts))
+	for _, count := range counts {
+		assert.True(t, count > NumKeys/NumAddresses/2)
+	}
+
+	// removing an address only moves the keys that were assigned to it
+
+	removedHash := common.CreateBackendHash(addresses[1:])
+
+	for i := 0; i < NumKeys; i++ {
+		key := common.HashString(fmt.Sprintf("server%d", i))
+		address, _ := removedHash.Get(key)
+		if assignment[i].String() == addresses[0].String() {
+			assert.NotEqual(t, addresses[0].String(), address.String())
+		} else {
+			assert.Equal(t, assignment[i].String(), address.String())
+		}
+	}
+}
+
+func TestBackendAffinity(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	addressA := core.ParseAddress("127.0.0.1:40000")
+	addressB := core.ParseAddress("127.0.0.1:40001")
+
+	a := common.CreateBackendAffinity(redisClient, common.BackendAffinityConfig{Address: addressA, Timeout: 100 * time.Millisecond})
+	b := common.CreateBackendAffinity(redisClient, common.BackendAffinityConfig{Address: addressB, Timeout: 100 * time.Millisecond})
+
+	// before we hear from other instances, everything is assigned to us
+
+	address, ok := a.PreferredBackend(1)
+	assert.True(t, ok)
+	assert.Equal(t, addressA.String(), address.String())
+
+	// once both instances have updated, they agree on the assignment
+
+	a.Update(ctx)
+	b.Update(ctx)
+	a.Update(ctx)
+
+	assert.Equal(t, 2, len(a.Instances()))
+	assert.Equal(t, 2, len(b.Instances()))
+
+	counts := make(map[string]int)
+
+	for i := 0; i < 100; i++ {
+		serverId := common.HashString(fmt.Sprintf("server%d", i))
+		addressFromA, _ := a.PreferredBackend(serverId)
+		addressFromB, _ := b.PreferredBackend(serverId)
+		assert.Equal(t, addressFromA.String(), addressFromB.String())
+		counts[addressFromA.String()]++
+	}
+
+	assert.Equal(t, 2, len(counts))
+
+	// a draining instance drops out of the assignment right away, and the other instance picks that up on its next update
+
+	b.SetDraining(true)
+
+	assert.True(t, b.IsDraining())
+
+	for i := 0; i < 100; i++ {
+		address, _ := b.PreferredBackend(common.HashString(fmt.Sprintf("server%d", i)))
+		assert.Equal(t, addressA.String(), address.String())
+	}
+
+	b.Update(ctx)
+	a.Update(ctx)
+
+	assert.Equal(t, 2, len(a.Instances()))
+
+	for i := 0; i < 100; i++ {
+		address, _ := a.PreferredBackend(common.HashString(fmt.Sprintf("server%d", i)))
+		assert.Equal(t, addressA.String(), address.String())
+	}
+
+	// when every instance is draining, there is nowhere to send servers
+
+	a.SetDraining(true)
+
+	_, ok = a.PreferredBackend(1)
+	assert.False(t, ok)
+
+	a.SetDraining(false)
+
+	// instances that stop updating time out
+
+	time.Sleep(200 * time.Millisecond)
+
+	a.Update(ctx)
+
+	instances := a.Instances()
+	assert.Equal(t, 1, len(instances))
+	assert.Equal(t, addressA.String(), instances[0].Address)
+}
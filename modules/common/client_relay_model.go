@@ -0,0 +1,589 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/networknext/next/modules/core"
+	"github.com/networknext/next/modules/encoding"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+	Learning client relay selection.
+
+	GetClientRelays picks client relays by distance from where ip2location says the client is. This doesn't work
+	well for players on ISPs with bad peering, or in ranges where ip2location is wrong.
+
+	The client relay model learns from the client relay pings that sessions report. Pings are aggregated per cell,
+	where a cell is an ISP, country and lat/long square, and the client relays that ping best for a cell are
+	returned to new clients in that cell. Geography is still used to fill the rest of the client relays, so new
+	relays get pinged and learned about, and cells we haven't learned anything about yet get geography only.
+
+	The model is kept in memory, and saved to redis so it survives restarts and is shared between server backends.
+	Each cell is a redis hash with a field per relay, and only the relays updated here are written, so server backends
+	updating different relays in the same cell don't overwrite each other. A sorted set tracks when each cell was last
+	saved, so server backends only load the cells that changed since their last load, instead of the whole model.
+*/
+
+const ClientRelayModelVersion = 1 // IMPORTANT: bump this anytime you change the redis data structures!
+
+// cells saved this long before our last load are loaded again, in case clocks on server backends don't quite agree
+const clientRelayModelLoadSlack = 10 * time.Second
+
+type ClientRelayModelConfig struct {
+	CellSize         float32       // size of the lat/long square for each cell, in degrees
+	MinSamples       int           // a relay needs this many samples in a cell before it is used
+	MaxRelaysPerCell int           // the relays in a cell that were updated least recently are removed past this
+	MaxCells         int           // the cells that were updated least recently are removed past this
+	Expire           time.Duration // samples older than this are not used
+	ExploreRelays    int           // number of client relays that are always picked by geography, so we keep learning
+	PacketLossWeight float32       // milliseconds of latency per-percent packet loss
+}
+
+// ClientRelayStats is the moving average of pings from clients in a cell to a client relay
+type ClientRelayStats struct {
+	RelayId    uint64
+	Samples    uint32
+	RTT        float32
+	Jitter     float32
+	PacketLoss float32
+	LastUpdate int64 // unix seconds
+}
+
+type ClientRelayCell struct {
+	Key        uint64
+	Relays     []ClientRelayStats
+	LastUpdate int64 // unix seconds
+}
+
+type ClientRelayModel struct {
+	config ClientRelayModelConfig
+
+	mutex    sync.Mutex
+	cells    map[uint64]*list.Element
+	lru      *list.List
+	dirty    map[uint64]map[uint64]bool // relays updated in each cell since the last save
+	removed  map[uint64]map[uint64]bool // relays removed from each cell since the last save
+	lastLoad int64                      // unix seconds
+}
+
+func CreateClientRelayModel(config ClientRelayModelConfig) *ClientRelayModel {
+
+	if config.CellSize == 0 {
+		config.CellSize = 1
+	}
+
+	if config.MinSamples == 0 {
+		config.MinSamples = 10
+	}
+
+	if config.MaxRelaysPerCell == 0 {
+		config.MaxRelaysPerCell = 32
+	}
+
+	if config.MaxCells == 0 {
+		config.MaxCells = 100000
+	}
+
+	if config.Expire == 0 {
+		config.Expire = 24 * time.Hour
+	}
+
+	if config.ExploreRelays == 0 {
+		config.ExploreRelays = 2
+	}
+
+	if config.PacketLossWeight == 0 {
+		config.PacketLossWeight = 10
+	}
+
+	model := &ClientRelayModel{}
+	model.config = config
+	model.cells = make(map[uint64]*list.Element)
+	model.lru = list.New()
+	model.dirty = make(map[uint64]map[uint64]bool)
+	model.removed = make(map[uint64]map[uint64]bool)
+
+	return model
+}
+
+// CellKey returns the cell for clients with the given ISP, country and location
+func (model *ClientRelayModel) CellKey(isp string, country string, latitude float32, longitude float32) uint64 {
+	x := int(math.Floor(float64(longitude / model.config.CellSize)))
+	y := int(math.Floor(float64(latitude / model.config.CellSize)))
+	return HashString(fmt.Sprintf("%s|%s|%d|%d", isp, country, x, y))
+}
+
+// the moving average is a true average for the first samples, so the first ping doesn't count for too much or too little
+const clientRelayModelMaxSampleWeight = 20
+
+func (model *ClientRelayModel) AddSample(cellKey uint64, relayId uint64, rtt float32, jitter float32, packetLoss float32, currentTime time.Time) {
+
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+
+	cell := model.getCell(cellKey)
+
+	currentSeconds := currentTime.Unix()
+
+	cell.LastUpdate = currentSeconds
+
+	model.markRelay(model.dirty, cellKey, relayId)
+
+	index := -1
+	for i := range cell.Relays {
+		if cell.Relays[i].RelayId == relayId {
+			index = i
+			break
+		}
+	}
+
+	if index == -1 {
+		model.trimCell(cell, model.config.MaxRelaysPerCell-1)
+		cell.Relays = append(cell.Relays, ClientRelayStats{RelayId: relayId})
+		index = len(cell.Relays) - 1
+	}
+
+	stats := &cell.Relays[index]
+
+	// samples that have expired don't count towards the average any more
+
+	if currentSeconds-stats.LastUpdate > int64(model.config.Expire.Seconds()) {
+		stats.Samples = 0
+	}
+
+	stats.Samples++
+	stats.LastUpdate = currentSeconds
+
+	weight := float32(stats.Samples)
+	if weight > clientRelayModelMaxSampleWeight {
+		weight = clientRelayModelMaxSampleWeight
+	}
+
+	stats.RTT += (rtt - stats.RTT) / weight
+	stats.Jitter += (jitter - stats.Jitter) / weight
+	stats.PacketLoss += (packetLoss - stats.PacketLoss) / weight
+}
+
+// markRelay must be called with the mutex held
+func (model *ClientRelayModel) markRelay(relays map[uint64]map[uint64]bool, cellKey uint64, relayId uint64) {
+	if relays[cellKey] == nil {
+		relays[cellKey] = make(map[uint64]bool)
+	}
+	relays[cellKey][relayId] = true
+}
+
+// trimCell removes the relays updated least recently until there are at most maxRelays. It must be called with the mutex held
+func (model *ClientRelayModel) trimCell(cell *ClientRelayCell, maxRelays int) {
+	for len(cell.Relays) > maxRelays {
+		oldest := 0
+		for i := range cell.Relays {
+			if cell.Relays[i].LastUpdate < cell.Relays[oldest].LastUpdate {
+				oldest = i
+			}
+		}
+		relayId := cell.Relays[oldest].RelayId
+		cell.Relays = append(cell.Relays[:oldest], cell.Relays[oldest+1:]...)
+		if model.dirty[cell.Key] != nil {
+			delete(model.dirty[cell.Key], relayId)
+		}
+		model.markRelay(model.removed, cell.Key, relayId)
+	}
+}
+
+// getCell must be called with the mutex held
+func (model *ClientRelayModel) getCell(cellKey uint64) *ClientRelayCell {
+	if element, exists := model.cells[cellKey]; exists {
+		model.lru.MoveToFront(element)
+		return element.Value.(*ClientRelayCell)
+	}
+	cell := &ClientRelayCell{Key: cellKey}
+	model.insertCell(cell)
+	return cell
+}
+
+// insertCell must be called with the mutex held
+func (model *ClientRelayModel) insertCell(cell *ClientRelayCell) {
+	if element, exists := model.cells[cell.Key]; exists {
+		element.Value = cell
+		model.lru.MoveToFront(element)
+		return
+	}
+	model.cells[cell.Key] = model.lru.PushFront(cell)
+	for model.lru.Len() > model.config.MaxCells {
+		oldest := model.lru.Back()
+		model.lru.Remove(oldest)
+		delete(model.cells, oldest.Value.(*ClientRelayCell).Key)
+		delete(model.dirty, oldest.Value.(*ClientRelayCell).Key)
+		delete(model.removed, oldest.Value.(*ClientRelayCell).Key)
+	}
+}
+
+// GetBestRelays returns the relays that ping best from the cell, best first
+func (model *ClientRelayModel) GetBestRelays(cellKey uint64, maxRelays int, currentTime time.Time) []uint64 {
+
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+
+	element, exists := model.cells[cellKey]
+	if !exists {
+		return []uint64{}
+	}
+
+	cell := element.Value.(*ClientRelayCell)
+
+	type relayScore struct {
+		relayId uint64
+		score   float32
+	}
+
+	currentSeconds := currentTime.Unix()
+
+	scores := make([]relayScore, 0, len(cell.Relays))
+	for i := range cell.Relays {
+		stats := &cell.Relays[i]
+		if int(stats.Samples) < model.config.MinSamples || currentSeconds-stats.LastUpdate > int64(model.config.Expire.Seconds()) {
+			continue
+		}
+		scores = append(scores, relayScore{relayId: stats.RelayId, score: stats.RTT + stats.Jitter + stats.PacketLoss*model.config.PacketLossWeight})
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].relayId < scores[j].relayId })
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].score < scores[j].score })
+
+	if len(scores) > maxRelays {
+		scores = scores[:maxRelays]
+	}
+
+	relayIds := make([]uint64, len(scores))
+	for i := range scores {
+		relayIds[i] = scores[i].relayId
+	}
+
+	return relayIds
+}
+
+// GetClientRelays picks the relays that ping best from the cell, then fills the rest from the relays picked by geography.
+// Only relays in the route matrix are picked. Returns the number of client relays that were picked from the model.
+func (model *ClientRelayModel) GetClientRelays(cellKey uint64, maxClientRelays int, currentTime time.Time, relayIds []uint64, relayAddresses []net.UDPAddr, geographyRelayIds []uint64, geographyRelayAddresses []net.UDPAddr) ([]uint64, []net.UDPAddr, int) {
+
+	maxLearnedRelays := maxClientRelays - model.config.ExploreRelays
+	if maxLearnedRelays < 0 {
+		maxLearnedRelays = 0
+	}
+
+	relayIndex := make(map[uint64]int, len(relayIds))
+	for i := range relayIds {
+		relayIndex[relayIds[i]] = i
+	}
+
+	clientRelayIds := make([]uint64, 0, maxClientRelays)
+	clientRelayAddresses := make([]net.UDPAddr, 0, maxClientRelays)
+	picked := make(map[uint64]bool)
+
+	// the model can still have relays that have since left the route matrix, so ask for all of them
+
+	bestRelayIds := model.GetBestRelays(cellKey, model.config.MaxRelaysPerCell, currentTime)
+
+	for _, relayId := range bestRelayIds {
+		if len(clientRelayIds) >= maxLearnedRelays {
+			break
+		}
+		index, exists := relayIndex[relayId]
+		if !exists {
+			continue
+		}
+		clientRelayIds = append(clientRelayIds, relayId)
+		clientRelayAddresses = append(clientRelayAddresses, relayAddresses[index])
+		picked[relayId] = true
+	}
+
+	numLearned := len(clientRelayIds)
+
+	for i := range geographyRelayIds {
+		if len(clientRelayIds) >= maxClientRelays {
+			break
+		}
+		if picked[geographyRelayIds[i]] {
+			continue
+		}
+		clientRelayIds = append(clientRelayIds, geographyRelayIds[i])
+		clientRelayAddresses = append(clientRelayAddresses, geographyRelayAddresses[i])
+		picked[geographyRelayIds[i]] = true
+	}
+
+	return clientRelayIds, clientRelayAddresses, numLearned
+}
+
+func (model *ClientRelayModel) NumCells() int {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	return model.lru.Len()
+}
+
+// ------------------------------------------------------------------------
+
+func clientRelayModelKey(cellKey uint64) string {
+	return fmt.Sprintf("client-relay-model-%d-%016x", ClientRelayModelVersion, cellKey)
+}
+
+func clientRelayModelUpdatedKey() string {
+	return fmt.Sprintf("client-relay-model-%d-updated", ClientRelayModelVersion)
+}
+
+const clientRelayStatsBytes = 4 + 4 + 4 + 4 + 8
+
+func writeClientRelayStats(stats *ClientRelayStats) []byte {
+	data := make([]byte, clientRelayStatsBytes)
+	index := 0
+	encoding.WriteUint32(data, &index, stats.Samples)
+	encoding.WriteFloat32(data, &index, stats.RTT)
+	encoding.WriteFloat32(data, &index, stats.Jitter)
+	encoding.WriteFloat32(data, &index, stats.PacketLoss)
+	encoding.WriteUint64(data, &index, uint64(stats.LastUpdate))
+	return data
+}
+
+func readClientRelayStats(data []byte, stats *ClientRelayStats) bool {
+	if len(data) != clientRelayStatsBytes {
+		return false
+	}
+	index := 0
+	var lastUpdate uint64
+	encoding.ReadUint32(data, &index, &stats.Samples)
+	encoding.ReadFloat32(data, &index, &stats.RTT)
+	encoding.ReadFloat32(data, &index, &stats.Jitter)
+	encoding.ReadFloat32(data, &index, &stats.PacketLoss)
+	encoding.ReadUint64(data, &index, &lastUpdate)
+	stats.LastUpdate = int64(lastUpdate)
+	return true
+}
+
+// Save writes the relays that have changed since the last save to redis, and removes the relays that were dropped from their cell
+func (model *ClientRelayModel) Save(ctx context.Context, redisClient redis.Cmdable, currentTime time.Time) error {
+
+	type cellUpdate struct {
+		key     uint64
+		relays  []ClientRelayStats
+		removed []uint64
+	}
+
+	model.mutex.Lock()
+	cellKeys := make(map[uint64]bool, len(model.dirty)+len(model.removed))
+	for cellKey := range model.dirty {
+		cellKeys[cellKey] = true
+	}
+	for cellKey := range model.removed {
+		cellKeys[cellKey] = true
+	}
+	updates := make([]cellUpdate, 0, len(cellKeys))
+	for cellKey := range cellKeys {
+		element, exists := model.cells[cellKey]
+		if !exists {
+			continue
+		}
+		update := cellUpdate{key: cellKey}
+		cell := element.Value.(*ClientRelayCell)
+		for i := range cell.Relays {
+			if model.dirty[cellKey][cell.Relays[i].RelayId] {
+				update.relays = append(update.relays, cell.Relays[i])
+			}
+		}
+		for relayId := range model.removed[cellKey] {
+			update.removed = append(update.removed, relayId)
+		}
+		if len(update.relays) == 0 && len(update.removed) == 0 {
+			continue
+		}
+		updates = append(updates, update)
+	}
+	model.dirty = make(map[uint64]map[uint64]bool)
+	model.removed = make(map[uint64]map[uint64]bool)
+	model.mutex.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	currentSeconds := currentTime.Unix()
+
+	pipeline := redisClient.Pipeline()
+
+	for i := range updates {
+		key := clientRelayModelKey(updates[i].key)
+		if len(updates[i].removed) > 0 {
+			fields := make([]string, len(updates[i].removed))
+			for j := range updates[i].removed {
+				fields[j] = fmt.Sprintf("%016x", updates[i].removed[j])
+			}
+			pipeline.HDel(ctx, key, fields...)
+		}
+		if len(updates[i].relays) > 0 {
+			values := make([]interface{}, 0, 2*len(updates[i].relays))
+			for j := range updates[i].relays {
+				values = append(values, fmt.Sprintf("%016x", updates[i].relays[j].RelayId), writeClientRelayStats(&updates[i].relays[j]))
+			}
+			pipeline.HSet(ctx, key, values...)
+		}
+		pipeline.Expire(ctx, key, model.config.Expire)
+		pipeline.ZAdd(ctx, clientRelayModelUpdatedKey(), redis.Z{Score: float64(currentSeconds), Member: fmt.Sprintf("%016x", updates[i].key)})
+	}
+
+	pipeline.ZRemRangeByScore(ctx, clientRelayModelUpdatedKey(), "-inf", strconv.FormatInt(currentSeconds-int64(model.config.Expire.Seconds()), 10))
+	pipeline.Expire(ctx, clientRelayModelUpdatedKey(), model.config.Expire)
+
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return fmt.Errorf("could not save %d client relay model cells: %v", len(updates), err)
+	}
+
+	return nil
+}
+
+// Load reads the cells that were saved to redis since the last load, or all cells the first time, so we pick up what
+// other server backends have learned. Relays that have changed here since the last save are kept, other relays are replaced
+func (model *ClientRelayModel) Load(ctx context.Context, redisClient redis.Cmdable, currentTime time.Time) error {
+
+	currentSeconds := currentTime.Unix()
+
+	model.mutex.Lock()
+	since := model.lastLoad - int64(clientRelayModelLoadSlack.Seconds())
+	if model.lastLoad == 0 {
+		since = currentSeconds - int64(model.config.Expire.Seconds())
+	}
+	model.mutex.Unlock()
+
+	// newest first, so if there are more cells than we can hold, we get the most recently updated
+
+	members, err := redisClient.ZRevRangeByScore(ctx, clientRelayModelUpdatedKey(), &redis.ZRangeBy{Min: strconv.FormatInt(since, 10), Max: "+inf", Count: int64(model.config.MaxCells)}).Result()
+	if err != nil {
+		return fmt.Errorf("could not get updated client relay model cells: %v", err)
+	}
+
+	cellKeys := make([]uint64, 0, len(members))
+	for i := range members {
+		cellKey, err := strconv.ParseUint(members[i], 16, 64)
+		if err != nil {
+			continue
+		}
+		cellKeys = append(cellKeys, cellKey)
+	}
+
+	for end := len(cellKeys); end > 0; end -= 1000 {
+
+		// oldest first, so the most recently updated cells end up at the front of the LRU
+
+		start := end - 1000
+		if start < 0 {
+			start = 0
+		}
+
+		pipeline := redisClient.Pipeline()
+		results := make([]*redis.MapStringStringCmd, end-start)
+		for i := start; i < end; i++ {
+			results[i-start] = pipeline.HGetAll(ctx, clientRelayModelKey(cellKeys[i]))
+		}
+		if _, err := pipeline.Exec(ctx); err != nil && err != redis.Nil {
+			return fmt.Errorf("could not load client relay model cells: %v", err)
+		}
+
+		model.mutex.Lock()
+		for i := end - 1; i >= start; i-- {
+			fields, err := results[i-start].Result()
+			if err != nil || len(fields) == 0 {
+				continue
+			}
+			model.mergeCell(cellKeys[i], fields, currentSeconds)
+		}
+		model.mutex.Unlock()
+	}
+
+	model.mutex.Lock()
+	model.lastLoad = currentSeconds
+	model.mutex.Unlock()
+
+	return nil
+}
+
+// mergeCell replaces the relays in a cell with the relays loaded from redis, except relays that have changed here since the last save. It must be called with the mutex held
+func (model *ClientRelayModel) mergeCell(cellKey uint64, fields map[string]string, currentSeconds int64) {
+
+	loaded := make([]ClientRelayStats, 0, len(fields))
+	for field, value := range fields {
+		relayId, err := strconv.ParseUint(field, 16, 64)
+		if err != nil {
+			continue
+		}
+		stats := ClientRelayStats{RelayId: relayId}
+		if !readClientRelayStats([]byte(value), &stats) {
+			core.Debug("could not decode client relay model stats for relay %016x in cell %016x", relayId, cellKey)
+			continue
+		}
+		if currentSeconds-stats.LastUpdate > int64(model.config.Expire.Seconds()) || model.dirty[cellKey][relayId] {
+			continue
+		}
+		loaded = append(loaded, stats)
+	}
+
+	if len(loaded) == 0 {
+		return
+	}
+
+	cell := model.getCell(cellKey)
+
+	for i := range loaded {
+		index := -1
+		for j := range cell.Relays {
+			if cell.Relays[j].RelayId == loaded[i].RelayId {
+				index = j
+				break
+			}
+		}
+		if index == -1 {
+			cell.Relays = append(cell.Relays, loaded[i])
+		} else {
+			cell.Relays[index] = loaded[i]
+		}
+		if loaded[i].LastUpdate > cell.LastUpdate {
+			cell.LastUpdate = loaded[i].LastUpdate
+		}
+	}
+
+	model.trimCell(cell, model.config.MaxRelaysPerCell)
+}
+
+// Start loads the model from redis, then saves and loads it at the given interval
+func (model *ClientRelayModel) Start(ctx context.Context, redisClient redis.Cmdable, interval time.Duration) {
+
+	if err := model.Load(ctx, redisClient, time.Now()); err != nil {
+		core.Error("%v", err)
+	}
+
+	core.Log("loaded %d client relay model cells", model.NumCells())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				currentTime := time.Now()
+				if err := model.Save(ctx, redisClient, currentTime); err != nil {
+					core.Error("%v", err)
+				}
+				if err := model.Load(ctx, redisClient, currentTime); err != nil {
+					core.Error("%v", err)
+				}
+			}
+		}
+	}()
+}
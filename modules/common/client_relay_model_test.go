@@ -0,0 +1,242 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/core"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func addClientRelaySamples(model *common.ClientRelayModel, cellKey uint64, relayId uint64, numSamples int, rtt float32, packetLoss float32, currentTime time.Time) {
+	for i := 0; i < numSamples; i++ {
+		model.AddSample(cellKey, relayId, rtt, 0, packetLoss, currentTime)
+	}
+}
+
+func TestClientRelayModel_CellKey(t *testing.T) {
+
+	t.Parallel()
+
+	model := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	// nearby clients on the same ISP share a cell
+
+	assert.Equal(t, model.CellKey("isp", "US", 40.1, -74.1), model.CellKey("isp", "US", 40.9, -74.9))
+
+	assert.NotEqual(t, model.CellKey("isp", "US", 40.1, -74.1), model.CellKey("other isp", "US", 40.1, -74.1))
+	assert.NotEqual(t, model.CellKey("isp", "US", 40.1, -74.1), model.CellKey("isp", "CA", 40.1, -74.1))
+	assert.NotEqual(t, model.CellKey("isp", "US", 40.1, -74.1), model.CellKey("isp", "US", 41.1, -74.1))
+}
+
+func TestClientRelayModel_BestRelays(t *testing.T) {
+
+	t.Parallel()
+
+	model := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	currentTime := time.Now()
+
+	cellKey := model.CellKey("isp", "US", 40, -74)
+
+	addClientRelaySamples(model, cellKey, 1, 10, 50, 0, currentTime)
+	addClientRelaySamples(model, cellKey, 2, 10, 20, 5, currentTime)
+	addClientRelaySamples(model, cellKey, 3, 5, 10, 0, currentTime)
+
+	// packet loss counts against a relay, and relays without enough samples are not used
+
+	assert.Equal(t, []uint64{1, 2}, model.GetBestRelays(cellKey, 10, currentTime))
+	assert.Equal(t, []uint64{1}, model.GetBestRelays(cellKey, 1, currentTime))
+
+	// other cells have learned nothing
+
+	assert.Equal(t, 0, len(model.GetBestRelays(model.CellKey("isp", "US", 10, 10), 10, currentTime)))
+
+	// the average moves towards recent samples
+
+	addClientRelaySamples(model, cellKey, 1, 100, 100, 0, currentTime)
+
+	assert.Equal(t, []uint64{2, 1}, model.GetBestRelays(cellKey, 10, currentTime))
+
+	// old samples are not used
+
+	assert.Equal(t, 0, len(model.GetBestRelays(cellKey, 10, currentTime.Add(25*time.Hour))))
+}
+
+func TestClientRelayModel_Limits(t *testing.T) {
+
+	t.Parallel()
+
+	model := common.CreateClientRelayModel(common.ClientRelayModelConfig{MinSamples: 1, MaxRelaysPerCell: 2, MaxCells: 2})
+
+	currentTime := time.Now()
+
+	// the relay updated least recently is removed from a full cell
+
+	model.AddSample(1, 100, 10, 0, 0, currentTime)
+	model.AddSample(1, 101, 20, 0, 0, currentTime.Add(time.Second))
+	model.AddSample(1, 102, 30, 0, 0, currentTime.Add(2*time.Second))
+
+	assert.Equal(t, []uint64{101, 102}, model.GetBestRelays(1, 10, currentTime.Add(2*time.Second)))
+
+	// the cell updated least recently is removed when there are too many cells
+
+	model.AddSample(2, 100, 10, 0, 0, currentTime)
+	model.AddSample(3, 100, 10, 0, 0, currentTime)
+
+	assert.Equal(t, 2, model.NumCells())
+	assert.Equal(t, 0, len(model.GetBestRelays(1, 10, currentTime)))
+}
+
+func TestClientRelayModel_GetClientRelays(t *testing.T) {
+
+	t.Parallel()
+
+	model := common.CreateClientRelayModel(common.ClientRelayModelConfig{ExploreRelays: 2})
+
+	currentTime := time.Now()
+
+	relayIds := []uint64{1, 2, 3, 4, 5, 6}
+	relayAddresses := make([]net.UDPAddr, len(relayIds))
+	for i := range relayAddresses {
+		relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+
+	geographyRelayIds := []uint64{1, 5, 2, 3}
+	geographyRelayAddresses := []net.UDPAddr{relayAddresses[0], relayAddresses[4], relayAddresses[1], relayAddresses[2]}
+
+	// cold start is geography only
+
+	clientRelayIds, clientRelayAddresses, numLearned := model.GetClientRelays(1, 4, currentTime, relayIds, relayAddresses, geographyRelayIds, geographyRelayAddresses)
+
+	assert.Equal(t, 0, numLearned)
+	assert.Equal(t, geographyRelayIds, clientRelayIds)
+	assert.Equal(t, geographyRelayAddresses, clientRelayAddresses)
+
+	// learned relays come first, leaving room for geography to explore. relays that are no longer in the route matrix are skipped
+
+	addClientRelaySamples(model, 1, 99, 10, 5, 0, currentTime)
+	addClientRelaySamples(model, 1, 6, 10, 10, 0, currentTime)
+	addClientRelaySamples(model, 1, 5, 10, 20, 0, currentTime)
+	addClientRelaySamples(model, 1, 4, 10, 30, 0, currentTime)
+
+	clientRelayIds, clientRelayAddresses, numLearned = model.GetClientRelays(1, 4, currentTime, relayIds, relayAddresses, geographyRelayIds, geographyRelayAddresses)
+
+	assert.Equal(t, 2, numLearned)
+	assert.Equal(t, []uint64{6, 5, 1, 2}, clientRelayIds)
+	assert.Equal(t, []net.UDPAddr{relayAddresses[5], relayAddresses[4], relayAddresses[0], relayAddresses[1]}, clientRelayAddresses)
+}
+
+func TestClientRelayModel_Redis(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	currentTime := time.Now()
+
+	a := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+	b := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	addClientRelaySamples(a, 1, 100, 10, 10, 0, currentTime)
+	addClientRelaySamples(a, 2, 200, 10, 10, 0, currentTime)
+
+	// what one server backend learns is picked up by another
+
+	assert.Nil(t, a.Save(ctx, redisClient, currentTime))
+	assert.Nil(t, b.Load(ctx, redisClient, currentTime))
+
+	assert.Equal(t, 2, b.NumCells())
+	assert.Equal(t, []uint64{100}, b.GetBestRelays(1, 10, currentTime))
+	assert.Equal(t, []uint64{200}, b.GetBestRelays(2, 10, currentTime))
+
+	// relays that have changed locally since the last save are not overwritten
+
+	addClientRelaySamples(b, 1, 101, 10, 5, 0, currentTime)
+
+	assert.Nil(t, b.Load(ctx, redisClient, currentTime))
+
+	assert.Equal(t, []uint64{101, 100}, b.GetBestRelays(1, 10, currentTime))
+
+	// server backends updating different relays in the same cell don't overwrite each other
+
+	addClientRelaySamples(a, 1, 102, 10, 1, 0, currentTime)
+
+	assert.Nil(t, b.Save(ctx, redisClient, currentTime))
+	assert.Nil(t, a.Save(ctx, redisClient, currentTime))
+
+	c := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	assert.Nil(t, c.Load(ctx, redisClient, currentTime))
+	assert.Equal(t, []uint64{102, 101, 100}, c.GetBestRelays(1, 10, currentTime))
+
+	// after the first load, only cells saved since the last load are loaded
+
+	d := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	addClientRelaySamples(d, 3, 300, 10, 10, 0, currentTime)
+
+	assert.Nil(t, d.Save(ctx, redisClient, currentTime.Add(-time.Hour)))
+
+	assert.Nil(t, c.Load(ctx, redisClient, currentTime.Add(time.Minute)))
+	assert.Equal(t, 0, len(c.GetBestRelays(3, 10, currentTime)))
+
+	c = common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	assert.Nil(t, c.Load(ctx, redisClient, currentTime.Add(time.Minute)))
+	assert.Equal(t, []uint64{300}, c.GetBestRelays(3, 10, currentTime))
+
+	// cells expire from redis
+
+	redisServer.FastForward(25 * time.Hour)
+
+	c = common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	assert.Nil(t, c.Load(ctx, redisClient, currentTime))
+	assert.Equal(t, 0, c.NumCells())
+}
+
+func TestClientRelayModel_RedisMaxRelays(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	currentTime := time.Now()
+
+	config := common.ClientRelayModelConfig{MinSamples: 1, MaxRelaysPerCell: 2}
+
+	a := common.CreateClientRelayModel(config)
+	b := common.CreateClientRelayModel(config)
+
+	a.AddSample(1, 100, 10, 0, 0, currentTime)
+	b.AddSample(1, 101, 20, 0, 0, currentTime.Add(time.Second))
+	b.AddSample(1, 102, 30, 0, 0, currentTime.Add(2*time.Second))
+
+	assert.Nil(t, a.Save(ctx, redisClient, currentTime))
+	assert.Nil(t, b.Save(ctx, redisClient, currentTime))
+
+	// the relay updated least recently is removed from the cell when loading, and from redis on the next save
+
+	assert.Nil(t, a.Load(ctx, redisClient, currentTime))
+	assert.Equal(t, []uint64{101, 102}, a.GetBestRelays(1, 10, currentTime.Add(2*time.Second)))
+
+	assert.Nil(t, a.Save(ctx, redisClient, currentTime))
+
+	relays, err := redisClient.HLen(ctx, fmt.Sprintf("client-relay-model-%d-%016x", common.ClientRelayModelVersion, 1)).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), relays)
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/networknext/next/modules/constants"
+)
+
+/*
+	A cost estimator reduces the RTT history for a relay pair to the RTT that goes into the cost matrix.
+
+	History is a ring buffer of samples, and newest is the index of the most recent sample.
+*/
+
+type CostEstimator interface {
+	Name() string
+	EstimateRTT(history []float32, newest int) float32
+}
+
+const (
+	CostEstimator_Max        = "max"
+	CostEstimator_Mean       = "mean"
+	CostEstimator_EWMA       = "ewma"
+	CostEstimator_Percentile = "p95"
+
+	// without relay history there is no estimator, and the latest sample goes straight into the cost matrix
+
+	CostEstimator_LatestSample = "latest"
+
+	DefaultEWMAAlpha    = 0.1
+	DefaultPercentile   = 0.95
+	DefaultTrendSamples = 10
+	DefaultTrendSlope   = 0.5
+)
+
+func CreateCostEstimator(name string) (CostEstimator, error) {
+	switch name {
+	case CostEstimator_Max:
+		return &MaxCostEstimator{}, nil
+	case CostEstimator_Mean:
+		return &MeanCostEstimator{}, nil
+	case CostEstimator_EWMA:
+		return &EWMACostEstimator{Alpha: DefaultEWMAAlpha}, nil
+	case CostEstimator_Percentile:
+		return &PercentileCostEstimator{Percentile: DefaultPercentile, TrendSamples: DefaultTrendSamples, TrendSlope: DefaultTrendSlope}, nil
+	}
+	return nil, fmt.Errorf("unknown cost estimator '%s'", name)
+}
+
+// ------------------------------------------------------------------
+
+// MaxCostEstimator takes the worst RTT seen across the whole history. This is conservative, but slow to recover after a spike.
+type MaxCostEstimator struct{}
+
+func (estimator *MaxCostEstimator) Name() string {
+	return CostEstimator_Max
+}
+
+func (estimator *MaxCostEstimator) EstimateRTT(history []float32, newest int) float32 {
+	return historyMax(history)
+}
+
+// ------------------------------------------------------------------
+
+// MeanCostEstimator takes the average RTT across the whole history.
+type MeanCostEstimator struct{}
+
+func (estimator *MeanCostEstimator) Name() string {
+	return CostEstimator_Mean
+}
+
+func (estimator *MeanCostEstimator) EstimateRTT(history []float32, newest int) float32 {
+	return historyMean(history)
+}
+
+// ------------------------------------------------------------------
+
+// EWMACostEstimator takes an exponentially weighted moving average of RTT, so recent samples count the most.
+type EWMACostEstimator struct {
+	Alpha float32
+}
+
+func (estimator *EWMACostEstimator) Name() string {
+	return CostEstimator_EWMA
+}
+
+func (estimator *EWMACostEstimator) EstimateRTT(history []float32, newest int) float32 {
+	size := len(history)
+	oldest := (newest + 1) % size
+	value := float64(history[oldest])
+	alpha := float64(estimator.Alpha)
+	for i := 1; i < size; i++ {
+		value = alpha*float64(history[(oldest+i)%size]) + (1.0-alpha)*value
+	}
+	return float32(value)
+}
+
+// ------------------------------------------------------------------
+
+/*
+	PercentileCostEstimator takes a percentile of RTT across the history, which ignores rare spikes.
+
+	It also fits a line to the most recent samples. If RTT is trending up faster than the trend slope (milliseconds per-sample),
+	the estimate is the RTT predicted for the next sample, when that is worse than the percentile.
+*/
+
+type PercentileCostEstimator struct {
+	Percentile   float32
+	TrendSamples int
+	TrendSlope   float32
+}
+
+func (estimator *PercentileCostEstimator) Name() string {
+	return CostEstimator_Percentile
+}
+
+func (estimator *PercentileCostEstimator) EstimateRTT(history []float32, newest int) float32 {
+
+	size := len(history)
+
+	index := int(float32(size-1) * estimator.Percentile)
+	if index < 0 {
+		index = 0
+	}
+	if index > size-1 {
+		index = size - 1
+	}
+
+	// IMPORTANT: this runs for every relay ping sample, so don't sort the whole history. keep only the largest samples down to the percentile
+
+	var largestData [constants.RelayHistorySize]float32
+
+	k := size - index
+	if k > len(largestData) {
+		k = len(largestData)
+	}
+
+	largest := largestData[:0]
+
+	for i := 0; i < size; i++ {
+		sample := history[i]
+		if len(largest) == k && sample <= largest[k-1] {
+			continue
+		}
+		if len(largest) < k {
+			largest = append(largest, sample)
+		} else {
+			largest[k-1] = sample
+		}
+		for j := len(largest) - 1; j > 0 && largest[j] > largest[j-1]; j-- {
+			largest[j], largest[j-1] = largest[j-1], largest[j]
+		}
+	}
+
+	value := largest[len(largest)-1]
+
+	// least squares fit over the most recent samples, oldest first
+
+	n := estimator.TrendSamples
+	if n > size {
+		n = size
+	}
+
+	if n < 2 {
+		return value
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for i := 0; i < n; i++ {
+		x := float64(i)
+		y := float64(history[(newest-(n-1)+i+size)%size])
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	slope := (float64(n)*sumXY - sumX*sumY) / (float64(n)*sumXX - sumX*sumX)
+	intercept := (sumY - slope*sumX) / float64(n)
+
+	if slope > float64(estimator.TrendSlope) {
+		predicted := float32(intercept + slope*float64(n))
+		if predicted > value {
+			value = predicted
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,247 @@
+package common_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateCostEstimator(t *testing.T) {
+
+	t.Parallel()
+
+	for _, name := range []string{common.CostEstimator_Max, common.CostEstimator_Mean, common.CostEstimator_EWMA, common.CostEstimator_Percentile} {
+		estimator, err := common.CreateCostEstimator(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, estimator.Name())
+	}
+
+	estimator, err := common.CreateCostEstimator("bogus")
+	assert.NotNil(t, err)
+	assert.Nil(t, estimator)
+}
+
+func TestRelayManager_CostEstimatorName(t *testing.T) {
+
+	t.Parallel()
+
+	// estimators only run with history, so without it the latest sample is what's used
+
+	relayManager := common.CreateRelayManager(false)
+	estimator, _ := common.CreateCostEstimator(common.CostEstimator_Mean)
+	relayManager.SetCostEstimator(estimator)
+
+	assert.Equal(t, common.CostEstimator_LatestSample, relayManager.CostEstimatorName())
+
+	relayManager = common.CreateRelayManager(true)
+	relayManager.SetCostEstimator(estimator)
+
+	assert.Equal(t, common.CostEstimator_Mean, relayManager.CostEstimatorName())
+}
+
+func TestCostEstimator_Steady(t *testing.T) {
+
+	t.Parallel()
+
+	// with steady RTT, every estimator agrees
+
+	history := make([]float32, 100)
+	for i := range history {
+		history[i] = 50
+	}
+
+	for _, name := range []string{common.CostEstimator_Max, common.CostEstimator_Mean, common.CostEstimator_EWMA, common.CostEstimator_Percentile} {
+		estimator, _ := common.CreateCostEstimator(name)
+		assert.InDelta(t, 50.0, estimator.EstimateRTT(history, 37), 0.001, name)
+	}
+}
+
+func TestCostEstimator_Spike(t *testing.T) {
+
+	t.Parallel()
+
+	// one old spike dominates max, but is mostly ignored by the others
+
+	history := make([]float32, 100)
+	for i := range history {
+		history[i] = 50
+	}
+	history[10] = 250
+
+	newest := 99
+
+	max := &common.MaxCostEstimator{}
+	mean := &common.MeanCostEstimator{}
+	ewma := &common.EWMACostEstimator{Alpha: 0.1}
+	percentile := &common.PercentileCostEstimator{Percentile: 0.95, TrendSamples: 10, TrendSlope: 0.5}
+
+	assert.Equal(t, float32(250), max.EstimateRTT(history, newest))
+	assert.InDelta(t, 52.0, mean.EstimateRTT(history, newest), 0.001)
+	assert.InDelta(t, 50.0, ewma.EstimateRTT(history, newest), 0.1)
+	assert.Equal(t, float32(50), percentile.EstimateRTT(history, newest))
+}
+
+func TestCostEstimator_EWMA_Recent(t *testing.T) {
+
+	t.Parallel()
+
+	// ewma follows the most recent samples, taking the ring buffer order into account
+
+	history := make([]float32, 100)
+	for i := range history {
+		history[i] = 50
+	}
+
+	newest := 20
+	for i := 0; i < 20; i++ {
+		history[newest-i] = 100
+	}
+
+	ewma := &common.EWMACostEstimator{Alpha: 0.1}
+
+	value := ewma.EstimateRTT(history, newest)
+
+	assert.True(t, value > 90)
+	assert.True(t, value < 100)
+
+	// the same samples are old when the newest sample is elsewhere in the ring buffer
+
+	value = ewma.EstimateRTT(history, 99)
+
+	assert.True(t, value < 60)
+}
+
+func TestCostEstimator_Percentile(t *testing.T) {
+
+	t.Parallel()
+
+	history := make([]float32, 100)
+	for i := range history {
+		history[i] = float32(i)
+	}
+
+	newest := 50
+
+	percentile := &common.PercentileCostEstimator{Percentile: 0.95, TrendSamples: 0}
+
+	assert.Equal(t, float32(94), percentile.EstimateRTT(history, newest))
+
+	percentile.Percentile = 0.5
+
+	assert.Equal(t, float32(49), percentile.EstimateRTT(history, newest))
+
+	percentile.Percentile = 1.0
+
+	assert.Equal(t, float32(99), percentile.EstimateRTT(history, newest))
+
+	percentile.Percentile = 0.0
+
+	assert.Equal(t, float32(0), percentile.EstimateRTT(history, newest))
+}
+
+func TestCostEstimator_Percentile_Trend(t *testing.T) {
+
+	t.Parallel()
+
+	// RTT has been steady, but is now climbing by 5ms per-sample
+
+	history := make([]float32, 100)
+	for i := range history {
+		history[i] = 50
+	}
+
+	newest := 60
+	for i := 0; i < 10; i++ {
+		history[newest-9+i] = float32(50 + 5*i)
+	}
+
+	percentile := &common.PercentileCostEstimator{Percentile: 0.95, TrendSamples: 10, TrendSlope: 0.5}
+
+	// the estimate is the predicted next sample, which is worse than p95
+
+	assert.InDelta(t, 100.0, percentile.EstimateRTT(history, newest), 0.01)
+
+	// when RTT is trending down, the estimate is just p95
+
+	for i := 0; i < 10; i++ {
+		history[newest-9+i] = float32(95 - 5*i)
+	}
+
+	assert.Equal(t, float32(70), percentile.EstimateRTT(history, newest))
+}
+
+func TestRelayManager_CostEstimator(t *testing.T) {
+
+	t.Parallel()
+
+	relayNames := []string{"A", "B"}
+
+	relayIds := make([]uint64, len(relayNames))
+
+	relayAddresses := make([]net.UDPAddr, len(relayNames))
+
+	for i := range relayIds {
+		relayIds[i] = common.RelayId(relayNames[i])
+		relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+
+	counters := [constants.NumRelayCounters]uint64{}
+
+	run := func(relayManager *common.RelayManager, numUpdates int) uint8 {
+
+		currentTime := time.Now().Unix()
+
+		// one spike at the start of the history, then steady RTT
+
+		for i := 0; i < numUpdates; i++ {
+			rtt := uint8(20)
+			if i == 0 {
+				rtt = 200
+			}
+			for j := range relayIds {
+				sampleRelayId := [1]uint64{relayIds[1-j]}
+				sampleRTT := [1]uint8{rtt}
+				sampleJitter := [1]uint8{0}
+				samplePacketLoss := [1]uint16{0}
+				relayManager.ProcessRelayUpdate(currentTime, relayIds[j], relayNames[j], relayAddresses[j], 0, "test", 0, 1, sampleRelayId[:], sampleRTT[:], sampleJitter[:], samplePacketLoss[:], counters[:])
+			}
+		}
+
+		costs := relayManager.GetCosts(currentTime, relayIds, 100, 100)
+
+		return costs[common.TriMatrixIndex(0, 1)]
+	}
+
+	// the default cost estimator is max
+
+	relayManager := common.CreateRelayManager(true)
+
+	assert.Equal(t, common.CostEstimator_Max, relayManager.GetCostEstimator().Name())
+
+	assert.Equal(t, uint8(200), run(relayManager, constants.RelayHistorySize))
+
+	// relay pairs are not routable until they have a full history, whatever the cost estimator
+
+	estimator, _ := common.CreateCostEstimator(common.CostEstimator_Percentile)
+
+	relayManager = common.CreateRelayManager(true)
+	relayManager.SetCostEstimator(estimator)
+
+	assert.Equal(t, uint8(255), run(relayManager, constants.RelayHistorySize-1))
+
+	// p95 ignores the spike
+
+	relayManager = common.CreateRelayManager(true)
+	relayManager.SetCostEstimator(estimator)
+
+	assert.Equal(t, common.CostEstimator_Percentile, relayManager.GetCostEstimator().Name())
+
+	assert.Equal(t, uint8(20), run(relayManager, constants.RelayHistorySize))
+}
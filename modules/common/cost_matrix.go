@@ -12,8 +12,8 @@ import (
 
 const (
 	CostMatrixVersion_Min   = 1 // the minimum version we can read
-	CostMatrixVersion_Max   = 2 // the maximum version we can read
-	CostMatrixVersion_Write = 2 // the version we write
+	CostMatrixVersion_Max   = 3 // the maximum version we can read
+	CostMatrixVersion_Write = 3 // the version we write
 )
 
 type CostMatrix struct {
@@ -27,12 +27,14 @@ type CostMatrix struct {
 	DestRelays         []bool
 	Costs              []uint8
 	RelayPrice         []uint8
+	DirectionalCosts   []uint8 // optional. square matrix indexed by core.SquareMatrixIndex, where i -> j is the cost measured by relay i
 }
 
 func (m *CostMatrix) GetMaxSize() int {
 	// IMPORTANT: This must be an upper bound *and* a multiple of 4
 	numRelays := len(m.RelayIds)
 	size := 256 + numRelays*(8+19+constants.MaxRelayNameLength+4+4+8+1) + core.TriMatrixLength(numRelays) + numRelays + 4
+	size += 4 + core.SquareMatrixLength(numRelays)
 	size += 4
 	size -= size % 4
 	return size
@@ -92,6 +94,17 @@ func (m *CostMatrix) Serialize(stream encoding.Stream) error {
 		stream.SerializeBool(&m.DestRelays[i])
 	}
 
+	if m.Version >= 3 {
+		hasDirectionalCosts := len(m.DirectionalCosts) > 0
+		stream.SerializeBool(&hasDirectionalCosts)
+		if hasDirectionalCosts {
+			if stream.IsReading() {
+				m.DirectionalCosts = make([]uint8, core.SquareMatrixLength(int(numRelays)))
+			}
+			stream.SerializeBytes(m.DirectionalCosts)
+		}
+	}
+
 	return stream.Error()
 }
 
@@ -149,5 +162,10 @@ func GenerateRandomCostMatrix(numRelays int) CostMatrix {
 		costMatrix.RelayPrice[i] = uint8(RandomInt(0, 255))
 	}
 
+	costMatrix.DirectionalCosts = make([]uint8, core.SquareMatrixLength(numRelays))
+	for i := range costMatrix.DirectionalCosts {
+		costMatrix.DirectionalCosts[i] = uint8(RandomInt(0, 255))
+	}
+
 	return costMatrix
 }
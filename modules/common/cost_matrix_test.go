@@ -25,3 +25,32 @@ func TestCostMatrixReadWrite(t *testing.T) {
 	readMessage := common.CostMatrix{}
 	CostMatrixReadWriteTest(&writeMessage, &readMessage, t)
 }
+
+func TestCostMatrixReadWrite_Version2(t *testing.T) {
+
+	t.Parallel()
+
+	// older cost matrices don't have directional costs
+
+	writeMessage := common.GenerateRandomCostMatrix(32)
+	writeMessage.Version = 2
+
+	buffer, err := writeMessage.Write()
+	assert.Nil(t, err)
+
+	readMessage := common.CostMatrix{}
+	err = readMessage.Read(buffer)
+	assert.Nil(t, err)
+
+	writeMessage.DirectionalCosts = nil
+
+	assert.Equal(t, writeMessage, readMessage)
+}
+
+func TestCostMatrixReadWrite_NoDirectionalCosts(t *testing.T) {
+	t.Parallel()
+	writeMessage := common.GenerateRandomCostMatrix(32)
+	writeMessage.DirectionalCosts = nil
+	readMessage := common.CostMatrix{}
+	CostMatrixReadWriteTest(&writeMessage, &readMessage, t)
+}
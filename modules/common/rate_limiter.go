@@ -0,0 +1,118 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Token bucket rate limiter keyed by an arbitrary uint64, eg. a buyer id or a hash of a source address.
+
+	Each key gets its own bucket that refills at PacketsPerSecond up to Burst tokens. Each packet takes
+	one token, and packets that arrive when the bucket is empty are dropped. Buckets that haven't been
+	used for a while are full anyway, so they are periodically removed.
+
+	Periodic cleanup alone doesn't bound memory when keys are cheap to make up, eg. source addresses
+	of spoofed packets, so the number of buckets can be capped. When all buckets are in use, packets
+	for new keys are dropped until stale buckets can be removed, while keys we already track carry on.
+	Looking for stale buckets is a scan of every bucket, so while full we only look once per second,
+	otherwise a flood of new keys would scan the whole map under the lock for every packet.
+*/
+
+const RateLimiterCleanupInterval = 60 * time.Second
+
+const RateLimiterFullCleanupInterval = time.Second
+
+type RateLimit struct {
+	PacketsPerSecond float64 // zero means no limit
+	Burst            float64 // packets. if zero, PacketsPerSecond is used
+}
+
+type rateLimiterBucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+type RateLimiter struct {
+	mutex           sync.Mutex
+	buckets         map[uint64]*rateLimiterBucket
+	maxBuckets      int
+	lastCleanup     time.Time
+	lastFullCleanup time.Time
+}
+
+// CreateRateLimiter creates a rate limiter that tracks at most maxBuckets keys at once. zero means no limit
+func CreateRateLimiter(maxBuckets int) *RateLimiter {
+	return &RateLimiter{buckets: make(map[uint64]*rateLimiterBucket), maxBuckets: maxBuckets}
+}
+
+// Allow takes a token from the bucket for key, and returns false if there are no tokens left and the packet should be dropped
+func (rateLimiter *RateLimiter) Allow(key uint64, currentTime time.Time, limit RateLimit) bool {
+
+	if limit.PacketsPerSecond <= 0 {
+		return true
+	}
+
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.PacketsPerSecond
+	}
+
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+
+	if currentTime.Sub(rateLimiter.lastCleanup) >= RateLimiterCleanupInterval {
+		rateLimiter.cleanup(currentTime)
+		rateLimiter.lastCleanup = currentTime
+	}
+
+	bucket, exists := rateLimiter.buckets[key]
+	if !exists {
+		if rateLimiter.maxBuckets > 0 && len(rateLimiter.buckets) >= rateLimiter.maxBuckets {
+			if currentTime.Sub(rateLimiter.lastFullCleanup) < RateLimiterFullCleanupInterval {
+				return false
+			}
+			rateLimiter.cleanup(currentTime)
+			rateLimiter.lastFullCleanup = currentTime
+			if len(rateLimiter.buckets) >= rateLimiter.maxBuckets {
+				return false
+			}
+		}
+		bucket = &rateLimiterBucket{tokens: burst, lastUpdate: currentTime}
+		rateLimiter.buckets[key] = bucket
+	}
+
+	elapsed := currentTime.Sub(bucket.lastUpdate).Seconds()
+	if elapsed > 0 {
+		bucket.tokens += elapsed * limit.PacketsPerSecond
+		bucket.lastUpdate = currentTime
+	}
+
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// NumBuckets returns the number of keys currently being tracked
+func (rateLimiter *RateLimiter) NumBuckets() int {
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+	return len(rateLimiter.buckets)
+}
+
+// cleanup must be called with the mutex held
+func (rateLimiter *RateLimiter) cleanup(currentTime time.Time) {
+	for key, bucket := range rateLimiter.buckets {
+		if currentTime.Sub(bucket.lastUpdate) >= RateLimiterCleanupInterval {
+			delete(rateLimiter.buckets, key)
+		}
+	}
+}
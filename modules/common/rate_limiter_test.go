@@ -0,0 +1,170 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Burst(t *testing.T) {
+
+	t.Parallel()
+
+	rateLimiter := common.CreateRateLimiter(0)
+
+	limit := common.RateLimit{PacketsPerSecond: 10, Burst: 5}
+
+	currentTime := time.Now()
+
+	// a full bucket lets the burst through, then drops
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, rateLimiter.Allow(1, currentTime, limit))
+	}
+
+	assert.False(t, rateLimiter.Allow(1, currentTime, limit))
+
+	// other keys have their own bucket
+
+	assert.True(t, rateLimiter.Allow(2, currentTime, limit))
+
+	// the bucket refills over time, but never past the burst
+
+	currentTime = currentTime.Add(100 * time.Millisecond)
+
+	assert.True(t, rateLimiter.Allow(1, currentTime, limit))
+	assert.False(t, rateLimiter.Allow(1, currentTime, limit))
+
+	currentTime = currentTime.Add(10 * time.Second)
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, rateLimiter.Allow(1, currentTime, limit))
+	}
+
+	assert.False(t, rateLimiter.Allow(1, currentTime, limit))
+}
+
+func TestRateLimiter_Rate(t *testing.T) {
+
+	t.Parallel()
+
+	rateLimiter := common.CreateRateLimiter(0)
+
+	// burst defaults to the rate
+
+	limit := common.RateLimit{PacketsPerSecond: 100}
+
+	currentTime := time.Now()
+
+	allowed := 0
+	for i := 0; i < 1000; i++ {
+		if rateLimiter.Allow(1, currentTime, limit) {
+			allowed++
+		}
+		currentTime = currentTime.Add(time.Millisecond)
+	}
+
+	// 100 packets in the initial burst, then 100 packets per-second for a second
+
+	assert.True(t, allowed >= 199 && allowed <= 201)
+
+	// no limit means no limit
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, rateLimiter.Allow(2, currentTime, common.RateLimit{}))
+	}
+}
+
+func TestRateLimiter_Cleanup(t *testing.T) {
+
+	t.Parallel()
+
+	rateLimiter := common.CreateRateLimiter(0)
+
+	limit := common.RateLimit{PacketsPerSecond: 1}
+
+	currentTime := time.Now()
+
+	for i := 0; i < 100; i++ {
+		rateLimiter.Allow(uint64(i), currentTime, limit)
+	}
+
+	assert.Equal(t, 100, rateLimiter.NumBuckets())
+
+	// buckets that haven't been used for a while are removed
+
+	currentTime = currentTime.Add(common.RateLimiterCleanupInterval)
+
+	rateLimiter.Allow(1000, currentTime, limit)
+
+	assert.Equal(t, 1, rateLimiter.NumBuckets())
+}
+
+func TestRateLimiter_MaxBuckets(t *testing.T) {
+
+	t.Parallel()
+
+	rateLimiter := common.CreateRateLimiter(10)
+
+	limit := common.RateLimit{PacketsPerSecond: 1}
+
+	currentTime := time.Now()
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, rateLimiter.Allow(uint64(i), currentTime, limit))
+	}
+
+	// once all buckets are in use, new keys are dropped but keys we already track are not
+
+	assert.False(t, rateLimiter.Allow(10, currentTime, limit))
+
+	currentTime = currentTime.Add(time.Second)
+
+	assert.True(t, rateLimiter.Allow(0, currentTime, limit))
+
+	assert.Equal(t, 10, rateLimiter.NumBuckets())
+
+	// stale buckets make room for new keys
+
+	rateLimiter.Allow(0, currentTime.Add(common.RateLimiterCleanupInterval/2), limit)
+
+	currentTime = currentTime.Add(common.RateLimiterCleanupInterval)
+
+	assert.True(t, rateLimiter.Allow(10, currentTime, limit))
+
+	assert.Equal(t, 2, rateLimiter.NumBuckets())
+}
+
+func TestRateLimiter_MaxBuckets_CleanupInterval(t *testing.T) {
+
+	t.Parallel()
+
+	rateLimiter := common.CreateRateLimiter(2)
+
+	limit := common.RateLimit{PacketsPerSecond: 1}
+
+	startTime := time.Now()
+
+	assert.True(t, rateLimiter.Allow(0, startTime, limit))
+	assert.True(t, rateLimiter.Allow(1, startTime, limit))
+
+	assert.True(t, rateLimiter.Allow(0, startTime.Add(time.Second), limit))
+	assert.True(t, rateLimiter.Allow(1, startTime.Add(30*time.Second), limit))
+
+	// full, and nothing is stale yet
+
+	assert.False(t, rateLimiter.Allow(2, startTime.Add(60500*time.Millisecond), limit))
+
+	// key 0 is stale now, but while full we only look for stale buckets once per-second
+
+	assert.False(t, rateLimiter.Allow(2, startTime.Add(61250*time.Millisecond), limit))
+
+	assert.True(t, rateLimiter.Allow(2, startTime.Add(61500*time.Millisecond), limit))
+
+	assert.False(t, rateLimiter.Allow(3, startTime.Add(61500*time.Millisecond), limit))
+
+	assert.Equal(t, 2, rateLimiter.NumBuckets())
+}
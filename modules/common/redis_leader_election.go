@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -30,15 +31,17 @@ type RedisLeaderElection struct {
 	instanceId       string
 	leaderInstanceId string
 
-	leaderMutex sync.RWMutex
-	isLeader    bool
-	isReady     bool
+	leaderMutex   sync.RWMutex
+	isLeader      bool
+	isReady       bool
+	convergedTime uint64
 }
 
 type InstanceEntry struct {
-	InstanceId string
-	StartTime  uint64
-	UpdateTime uint64
+	InstanceId    string
+	StartTime     uint64
+	UpdateTime    uint64
+	ConvergedTime uint64 // zero until the instance says it has converged. see SetConverged
 }
 
 func CreateRedisLeaderElection(redisClient redis.Cmdable, config RedisLeaderElectionConfig) (*RedisLeaderElection, error) {
@@ -130,6 +133,18 @@ func getInstanceEntries(ctx context.Context, redisClient redis.Cmdable, service
 
 	sort.SliceStable(instanceEntries, func(i, j int) bool { return instanceEntries[i].StartTime < instanceEntries[j].StartTime })
 
+	// handover: instances that have converged come first, in the order they converged, so leadership only moves to an
+	// instance that is ready to publish, and doesn't move again when other instances converge later
+
+	sort.SliceStable(instanceEntries, func(i, j int) bool {
+		a := instanceEntries[i].ConvergedTime
+		b := instanceEntries[j].ConvergedTime
+		if a == 0 || b == 0 {
+			return a != 0 && b == 0
+		}
+		return a < b
+	})
+
 	return instanceEntries
 }
 
@@ -145,6 +160,10 @@ func (leaderElection *RedisLeaderElection) Update(ctx context.Context) {
 	instanceEntry.StartTime = uint64(leaderElection.startTime.UnixNano())
 	instanceEntry.UpdateTime = uint64(seconds)
 
+	leaderElection.leaderMutex.RLock()
+	instanceEntry.ConvergedTime = leaderElection.convergedTime
+	leaderElection.leaderMutex.RUnlock()
+
 	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
 	err := encoder.Encode(instanceEntry)
@@ -218,6 +237,48 @@ func (leaderElection *RedisLeaderElection) Load(ctx context.Context, name string
 	}
 }
 
+// SetConverged marks this instance as ready to lead. Instances that have converged are preferred as leader over instances that
+// have not, so services that call this hand over leadership only once the new leader has data worth publishing.
+// Services that never call it keep electing the instance with the longest uptime.
+func (leaderElection *RedisLeaderElection) SetConverged() {
+	leaderElection.leaderMutex.Lock()
+	if leaderElection.convergedTime == 0 {
+		leaderElection.convergedTime = uint64(time.Now().UnixNano())
+		core.Log("we have converged")
+	}
+	leaderElection.leaderMutex.Unlock()
+}
+
+// NextEpoch returns a number that is larger than any previous epoch returned for this name, by any instance of the service,
+// and larger than minimum. Pass in the last epoch you have seen, so the counter picks up from there if redis lost the key.
+//
+// It also returns the generation of the epoch counter. A new random generation starts whenever redis loses the counter,
+// and epochs are only comparable within a generation.
+func (leaderElection *RedisLeaderElection) NextEpoch(ctx context.Context, name string, minimum uint64) (uint64, uint64, error) {
+	key := fmt.Sprintf("%s-epoch-%d-%s", leaderElection.config.ServiceName, RedisLeaderElectionVersion, name)
+	generationKey := fmt.Sprintf("%s-epoch-generation-%d-%s", leaderElection.config.ServiceName, RedisLeaderElectionVersion, name)
+	pipeline := leaderElection.redisClient.Pipeline()
+	incrCommand := pipeline.Incr(ctx, key)
+	pipeline.SetNX(ctx, generationKey, rand.Uint64()|1, 0)
+	generationCommand := pipeline.Get(ctx, generationKey)
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return 0, 0, fmt.Errorf("failed to get next %s epoch: %v", name, err)
+	}
+	epoch := uint64(incrCommand.Val())
+	generation, err := generationCommand.Uint64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get %s epoch generation: %v", name, err)
+	}
+	if epoch <= minimum {
+		epoch = minimum + 1
+		err = leaderElection.redisClient.Set(ctx, key, epoch, 0).Err()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to reset %s epoch: %v", name, err)
+		}
+	}
+	return epoch, generation, nil
+}
+
 func (leaderElection *RedisLeaderElection) IsLeader() bool {
 	leaderElection.leaderMutex.RLock()
 	value := leaderElection.isLeader
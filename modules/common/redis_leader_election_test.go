@@ -0,0 +1,222 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/networknext/next/modules/common"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestLeaderElection creates a leader election instance that can become leader straight away. instances created first have the longest uptime
+func createTestLeaderElection(t *testing.T, redisClient redis.Cmdable) *common.RedisLeaderElection {
+	leaderElection, err := common.CreateRedisLeaderElection(redisClient, common.RedisLeaderElectionConfig{ServiceName: "relay_backend", InitialDelay: -1})
+	assert.Nil(t, err)
+	return leaderElection
+}
+
+func TestRedisLeaderElection_Flip(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	a := createTestLeaderElection(t, redisClient)
+	b := createTestLeaderElection(t, redisClient)
+
+	// the instance with the longest uptime is leader
+
+	a.Update(ctx)
+	b.Update(ctx)
+	a.Update(ctx)
+
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+
+	a.Store(ctx, "route_matrix", []byte("a"))
+	b.Store(ctx, "route_matrix", []byte("b"))
+
+	assert.Equal(t, []byte("a"), b.Load(ctx, "route_matrix"))
+	assert.Equal(t, []byte("a"), common.LoadMasterServiceData(ctx, redisClient, "relay_backend", "route_matrix"))
+
+	// the leader goes away, so the other instance takes over
+
+	redisServer.FlushAll()
+
+	b.Update(ctx)
+	b.Store(ctx, "route_matrix", []byte("b"))
+
+	assert.True(t, b.IsLeader())
+	assert.Equal(t, []byte("b"), common.LoadMasterServiceData(ctx, redisClient, "relay_backend", "route_matrix"))
+}
+
+func TestRedisLeaderElection_Handover(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	a := createTestLeaderElection(t, redisClient)
+	b := createTestLeaderElection(t, redisClient)
+
+	update := func() {
+		a.Update(ctx)
+		b.Update(ctx)
+		a.Update(ctx)
+	}
+
+	// until any instance converges, the instance with the longest uptime is leader
+
+	update()
+
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+
+	// leadership only moves to an instance that has converged
+
+	b.SetConverged()
+
+	update()
+
+	assert.False(t, a.IsLeader())
+	assert.True(t, b.IsLeader())
+
+	// and doesn't move back when the older instance converges later
+
+	a.SetConverged()
+
+	update()
+
+	assert.False(t, a.IsLeader())
+	assert.True(t, b.IsLeader())
+}
+
+func TestRedisLeaderElection_Epoch(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	a := createTestLeaderElection(t, redisClient)
+	b := createTestLeaderElection(t, redisClient)
+
+	// epochs increase across all instances, within one generation
+
+	previous := uint64(0)
+	previousGeneration := uint64(0)
+	for i := 0; i < 10; i++ {
+		instance := a
+		if i%3 == 0 {
+			instance = b
+		}
+		epoch, generation, err := instance.NextEpoch(ctx, "route_matrix", 0)
+		assert.Nil(t, err)
+		assert.True(t, epoch > previous)
+		assert.NotEqual(t, uint64(0), generation)
+		if previousGeneration != 0 {
+			assert.Equal(t, previousGeneration, generation)
+		}
+		previous = epoch
+		previousGeneration = generation
+	}
+
+	// epochs with different names are independent
+
+	epoch, _, err := a.NextEpoch(ctx, "cost_matrix", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), epoch)
+
+	// if redis loses the epoch key, the epoch picks up from the last epoch we have seen, in a new generation
+
+	redisServer.FlushAll()
+
+	epoch, generation, err := a.NextEpoch(ctx, "route_matrix", previous)
+	assert.Nil(t, err)
+	assert.Equal(t, previous+1, epoch)
+	assert.NotEqual(t, previousGeneration, generation)
+
+	epoch, nextGeneration, err := b.NextEpoch(ctx, "route_matrix", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, previous+2, epoch)
+	assert.Equal(t, generation, nextGeneration)
+
+	// no redis, no epoch
+
+	redisServer.Close()
+
+	_, _, err = a.NextEpoch(ctx, "route_matrix", 0)
+	assert.NotNil(t, err)
+}
+
+func TestRouteMatrixEpoch_LeaderFlip(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	a := createTestLeaderElection(t, redisClient)
+	b := createTestLeaderElection(t, redisClient)
+
+	a.Update(ctx)
+	b.Update(ctx)
+	a.Update(ctx)
+
+	// each relay backend publishes a route matrix, b publishes first
+
+	publish := func(leaderElection *common.RedisLeaderElection) {
+		epoch, generation, err := leaderElection.NextEpoch(ctx, "route_matrix", 0)
+		assert.Nil(t, err)
+		routeMatrix := common.GenerateRandomRouteMatrix(4)
+		routeMatrix.Epoch = epoch
+		routeMatrix.EpochGeneration = generation
+		data, err := routeMatrix.Write()
+		assert.Nil(t, err)
+		leaderElection.Store(ctx, "route_matrix", data)
+	}
+
+	load := func() *common.RouteMatrix {
+		routeMatrix := &common.RouteMatrix{}
+		err := routeMatrix.Read(common.LoadMasterServiceData(ctx, redisClient, "relay_backend", "route_matrix"))
+		assert.Nil(t, err)
+		return routeMatrix
+	}
+
+	publish(b)
+	publish(a)
+
+	// the server backend has the leader's route matrix
+
+	current := load()
+
+	// the leader flips to b. b's route matrix was published before the one we have, so it is rejected
+
+	b.SetConverged()
+	a.Update(ctx)
+	b.Update(ctx)
+	assert.True(t, b.IsLeader())
+
+	next := load()
+	assert.True(t, next.IsOlderThan(current))
+
+	// once b publishes again, its route matrix is accepted
+
+	publish(b)
+
+	next = load()
+	assert.False(t, next.IsOlderThan(current))
+}
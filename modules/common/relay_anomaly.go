@@ -0,0 +1,273 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/networknext/next/modules/constants"
+)
+
+/*
+	The relay anomaly detector watches each relay for sudden shifts away from its own baseline.
+
+	A relay with a broken NIC or a noisy neighbour shows up as a jump in RTT or packet loss to most
+	other relays at once, or as pongs that stop coming back. Often its traffic suddenly drops off or
+	spikes at the same time.
+
+	A traffic shift never quarantines a relay on its own, no matter how large, because the backend moves
+	traffic around on purpose (relay headroom, relay pricing). A relay whose traffic drops to nothing but
+	whose RTT, packet loss and pongs look normal keeps getting routes. Traffic shifts are only reported
+	alongside an RTT, packet loss or pong ratio anomaly, as extra detail in the quarantine reason.
+
+	RTT and packet loss are baselined per-peer. When one relay breaks, each of its peers only sees one
+	of their peers shift, so only the broken relay is flagged.
+
+	When a relay is anomalous for several updates in a row it is quarantined: it is excluded from the
+	cost matrix and from dest relays, so no new routes are built through it. The relay is released once
+	it has gone a full cooldown without any anomalies.
+*/
+
+const (
+	relayCounter_RelayPingPacketSent     = 10
+	relayCounter_RelayPongPacketReceived = 16
+)
+
+type RelayAnomalyConfig struct {
+	WarmupUpdates    int     // number of updates used to build the baseline before we start looking for anomalies
+	BaselineAlpha    float32 // smoothing factor for the baseline, applied to non-anomalous updates only
+	RTTFactor        float32 // a peer has shifted if RTT exceeds baseline * RTTFactor + RTTMargin
+	RTTMargin        float32 // milliseconds
+	PacketLossDelta  float32 // a peer has shifted if packet loss exceeds baseline + PacketLossDelta (percent)
+	PeerFraction     float32 // anomalous if more than this fraction of peers have shifted
+	PongRatioDrop    float32 // anomalous if the fraction of relay pings answered drops by more than this below baseline
+	TrafficFactor    float32 // traffic has shifted if packets or bandwidth sent moves by more than this factor up or down from baseline. never quarantines on its own, only added to the reason of an rtt, packet loss or pong ratio anomaly
+	MinPacketsSent   float32 // traffic checks are skipped while baseline packets sent per-second is below this
+	MinBandwidthSent float32 // traffic checks are skipped while baseline bandwidth sent is below this (kbps)
+	AnomalyUpdates   int     // number of consecutive anomalous updates before the relay is quarantined
+	CooldownSeconds  int64   // a quarantined relay is released after this long without an anomaly
+}
+
+func DefaultRelayAnomalyConfig() RelayAnomalyConfig {
+	return RelayAnomalyConfig{
+		WarmupUpdates:    30,
+		BaselineAlpha:    0.05,
+		RTTFactor:        1.5,
+		RTTMargin:        10.0,
+		PacketLossDelta:  5.0,
+		PeerFraction:     0.5,
+		PongRatioDrop:    0.5,
+		TrafficFactor:    4.0,
+		MinPacketsSent:   100.0,
+		MinBandwidthSent: 100.0,
+		AnomalyUpdates:   3,
+		CooldownSeconds:  300,
+	}
+}
+
+type RelayAnomalyState struct {
+	NumUpdates           int
+	BaselinePeerRTT      map[uint64]float32
+	BaselinePeerLoss     map[uint64]float32
+	BaselinePongRatio    float32
+	BaselinePacketsSent  float32
+	BaselineBandwidth    float32
+	LastPingsSent        uint64
+	LastPongsReceived    uint64
+	ConsecutiveAnomalies int
+	LastAnomalyTime      int64
+	Quarantined          bool
+	QuarantineTime       int64
+	QuarantineReason     string
+}
+
+type RelayQuarantineEvent struct {
+	Timestamp   int64  `json:"timestamp"`
+	RelayId     uint64 `json:"relay_id,string"`
+	RelayName   string `json:"relay_name"`
+	Quarantined bool   `json:"quarantined"`
+	Reason      string `json:"reason"`
+}
+
+func baselineUpdate(baseline float32, value float32, alpha float32, first bool) float32 {
+	if first {
+		return value
+	}
+	return baseline + (value-baseline)*alpha
+}
+
+func (relayManager *RelayManager) SetAnomalyConfig(config *RelayAnomalyConfig) {
+	relayManager.mutex.Lock()
+	relayManager.anomalyConfig = config
+	relayManager.mutex.Unlock()
+}
+
+// DetectRelayAnomalies checks the most recent update for a relay against its baseline. Call it after ProcessRelayUpdate.
+// Returns an event when the relay is quarantined or released, otherwise nil. Does nothing if no anomaly config is set.
+func (relayManager *RelayManager) DetectRelayAnomalies(currentTime int64, relayId uint64, packetsSentPerSecond float32, bandwidthSentKbps float32) *RelayQuarantineEvent {
+
+	relayManager.mutex.Lock()
+	defer relayManager.mutex.Unlock()
+
+	config := relayManager.anomalyConfig
+	if config == nil {
+		return nil
+	}
+
+	sourceEntry, exists := relayManager.SourceEntries[relayId]
+	if !exists || sourceEntry.LastUpdateTime != currentTime {
+		return nil
+	}
+
+	state := &sourceEntry.Anomaly
+
+	if state.BaselinePeerRTT == nil {
+		state.BaselinePeerRTT = make(map[uint64]float32)
+		state.BaselinePeerLoss = make(map[uint64]float32)
+	}
+
+	// compare RTT and packet loss to each peer in this update against the baseline for that peer
+
+	numPeers := 0
+	shiftedPeers := make(map[uint64]bool)
+
+	for destRelayId, destEntry := range sourceEntry.DestEntries {
+		if destEntry.LastUpdateTime != currentTime {
+			continue
+		}
+		newest := (int(destEntry.HistoryIndex) + constants.RelayHistorySize - 1) % constants.RelayHistorySize
+		rtt := destEntry.HistoryRTT[newest]
+		packetLoss := destEntry.HistoryPacketLoss[newest]
+		baselineRTT, exists := state.BaselinePeerRTT[destRelayId]
+		if !exists {
+			state.BaselinePeerRTT[destRelayId] = rtt
+			state.BaselinePeerLoss[destRelayId] = packetLoss
+			continue
+		}
+		baselineLoss := state.BaselinePeerLoss[destRelayId]
+		numPeers++
+		if rtt > baselineRTT*config.RTTFactor+config.RTTMargin || packetLoss > baselineLoss+config.PacketLossDelta {
+			shiftedPeers[destRelayId] = true
+		}
+	}
+
+	// measure the fraction of relay pings that got a pong back since the last update
+
+	pingsSent := sourceEntry.Counters[relayCounter_RelayPingPacketSent]
+	pongsReceived := sourceEntry.Counters[relayCounter_RelayPongPacketReceived]
+
+	pongRatio := float32(-1)
+	if state.NumUpdates > 0 && pingsSent > state.LastPingsSent && pongsReceived >= state.LastPongsReceived {
+		pongRatio = float32(pongsReceived-state.LastPongsReceived) / float32(pingsSent-state.LastPingsSent)
+		if pongRatio > 1 {
+			pongRatio = 1
+		}
+	}
+
+	state.LastPingsSent = pingsSent
+	state.LastPongsReceived = pongsReceived
+
+	// compare against baseline
+
+	reasons := make([]string, 0)
+	trafficReasons := make([]string, 0)
+
+	if state.NumUpdates >= config.WarmupUpdates {
+
+		// IMPORTANT: with fewer than two peers we can't tell which side of the relay pair is broken
+
+		if numPeers >= 2 && float32(len(shiftedPeers)) > float32(numPeers)*config.PeerFraction {
+			reasons = append(reasons, fmt.Sprintf("rtt or packet loss shifted to %d/%d peers", len(shiftedPeers), numPeers))
+		}
+
+		if pongRatio >= 0 && pongRatio < state.BaselinePongRatio-config.PongRatioDrop {
+			reasons = append(reasons, fmt.Sprintf("pong ratio %.2f vs. baseline %.2f", pongRatio, state.BaselinePongRatio))
+		}
+
+		// IMPORTANT: traffic drops off when a relay is quarantined, so don't hold it against the relay while quarantined
+
+		if !state.Quarantined {
+			if state.BaselinePacketsSent >= config.MinPacketsSent && (packetsSentPerSecond > state.BaselinePacketsSent*config.TrafficFactor || packetsSentPerSecond < state.BaselinePacketsSent/config.TrafficFactor) {
+				trafficReasons = append(trafficReasons, fmt.Sprintf("packets sent %.0f/sec vs. baseline %.0f/sec", packetsSentPerSecond, state.BaselinePacketsSent))
+			}
+			if state.BaselineBandwidth >= config.MinBandwidthSent && (bandwidthSentKbps > state.BaselineBandwidth*config.TrafficFactor || bandwidthSentKbps < state.BaselineBandwidth/config.TrafficFactor) {
+				trafficReasons = append(trafficReasons, fmt.Sprintf("bandwidth sent %.0fkbps vs. baseline %.0fkbps", bandwidthSentKbps, state.BaselineBandwidth))
+			}
+		}
+	}
+
+	// IMPORTANT: traffic is deliberately steered away from and towards relays, so a traffic shift only counts when something else looks wrong too
+
+	anomalous := len(reasons) > 0
+	if anomalous {
+		reasons = append(reasons, trafficReasons...)
+	}
+
+	// only normal updates feed into the baseline, so a broken relay can't drag the baseline along with it
+
+	if !anomalous {
+		for destRelayId, destEntry := range sourceEntry.DestEntries {
+			if destEntry.LastUpdateTime != currentTime || shiftedPeers[destRelayId] {
+				continue
+			}
+			newest := (int(destEntry.HistoryIndex) + constants.RelayHistorySize - 1) % constants.RelayHistorySize
+			state.BaselinePeerRTT[destRelayId] = baselineUpdate(state.BaselinePeerRTT[destRelayId], destEntry.HistoryRTT[newest], config.BaselineAlpha, false)
+			state.BaselinePeerLoss[destRelayId] = baselineUpdate(state.BaselinePeerLoss[destRelayId], destEntry.HistoryPacketLoss[newest], config.BaselineAlpha, false)
+		}
+		if pongRatio >= 0 {
+			state.BaselinePongRatio = baselineUpdate(state.BaselinePongRatio, pongRatio, config.BaselineAlpha, state.BaselinePongRatio == 0)
+		}
+		if !state.Quarantined {
+			state.BaselinePacketsSent = baselineUpdate(state.BaselinePacketsSent, packetsSentPerSecond, config.BaselineAlpha, state.BaselinePacketsSent == 0)
+			state.BaselineBandwidth = baselineUpdate(state.BaselineBandwidth, bandwidthSentKbps, config.BaselineAlpha, state.BaselineBandwidth == 0)
+		}
+		state.NumUpdates++
+		state.ConsecutiveAnomalies = 0
+	} else {
+		state.ConsecutiveAnomalies++
+		state.LastAnomalyTime = currentTime
+	}
+
+	// quarantine or release the relay
+
+	if !state.Quarantined && state.ConsecutiveAnomalies >= config.AnomalyUpdates {
+		state.Quarantined = true
+		state.QuarantineTime = currentTime
+		state.QuarantineReason = strings.Join(reasons, ", ")
+		return &RelayQuarantineEvent{Timestamp: currentTime, RelayId: relayId, RelayName: sourceEntry.RelayName, Quarantined: true, Reason: state.QuarantineReason}
+	}
+
+	if state.Quarantined && currentTime-state.LastAnomalyTime >= config.CooldownSeconds {
+		state.Quarantined = false
+		state.QuarantineReason = ""
+		// traffic moves around while a relay is quarantined, so learn the traffic baseline again from scratch
+		state.BaselinePacketsSent = 0
+		state.BaselineBandwidth = 0
+		return &RelayQuarantineEvent{Timestamp: currentTime, RelayId: relayId, RelayName: sourceEntry.RelayName, Quarantined: false, Reason: "cooldown"}
+	}
+
+	return nil
+}
+
+// isQuarantined must be called with the relay manager mutex held
+func (relayManager *RelayManager) isQuarantined(relayId uint64) bool {
+	sourceEntry, exists := relayManager.SourceEntries[relayId]
+	return exists && sourceEntry.Anomaly.Quarantined
+}
+
+func (relayManager *RelayManager) IsQuarantined(relayId uint64) bool {
+	relayManager.mutex.RLock()
+	quarantined := relayManager.isQuarantined(relayId)
+	relayManager.mutex.RUnlock()
+	return quarantined
+}
+
+// GetDestRelays returns a copy of dest relays with quarantined relays removed
+func (relayManager *RelayManager) GetDestRelays(relayIds []uint64, destRelays []bool) []bool {
+	output := make([]bool, len(destRelays))
+	relayManager.mutex.RLock()
+	for i := range destRelays {
+		output[i] = destRelays[i] && !relayManager.isQuarantined(relayIds[i])
+	}
+	relayManager.mutex.RUnlock()
+	return output
+}
@@ -0,0 +1,288 @@
+package common_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type anomalyTestRelays struct {
+	relayManager   *common.RelayManager
+	relayNames     []string
+	relayIds       []uint64
+	relayAddresses []net.UDPAddr
+	counters       [][constants.NumRelayCounters]uint64
+}
+
+func createAnomalyTestRelays(config *common.RelayAnomalyConfig) *anomalyTestRelays {
+	relays := &anomalyTestRelays{}
+	relays.relayManager = common.CreateRelayManager(false)
+	relays.relayManager.SetAnomalyConfig(config)
+	relays.relayNames = []string{"A", "B", "C"}
+	relays.relayIds = make([]uint64, len(relays.relayNames))
+	relays.relayAddresses = make([]net.UDPAddr, len(relays.relayNames))
+	relays.counters = make([][constants.NumRelayCounters]uint64, len(relays.relayNames))
+	for i := range relays.relayIds {
+		relays.relayIds[i] = common.RelayId(relays.relayNames[i])
+		relays.relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+	return relays
+}
+
+// update sends one relay update from every relay. relay A sees the rtt and pong ratio passed in, all other relays are healthy
+func (relays *anomalyTestRelays) update(currentTime int64, rttA uint8, pongRatioA float32, packetsSentA float32) *common.RelayQuarantineEvent {
+	var event *common.RelayQuarantineEvent
+	for i := range relays.relayIds {
+		sampleRelayId := make([]uint64, 0)
+		sampleRTT := make([]uint8, 0)
+		sampleJitter := make([]uint8, 0)
+		samplePacketLoss := make([]uint16, 0)
+		for j := range relays.relayIds {
+			if i == j {
+				continue
+			}
+			rtt := uint8(20)
+			if i == 0 || j == 0 {
+				rtt = rttA
+			}
+			sampleRelayId = append(sampleRelayId, relays.relayIds[j])
+			sampleRTT = append(sampleRTT, rtt)
+			sampleJitter = append(sampleJitter, 0)
+			samplePacketLoss = append(samplePacketLoss, 0)
+		}
+		pongRatio := float32(1)
+		packetsSent := float32(1000)
+		if i == 0 {
+			pongRatio = pongRatioA
+			packetsSent = packetsSentA
+		}
+		relays.counters[i][10] += 100
+		relays.counters[i][16] += uint64(100 * pongRatio)
+		relays.relayManager.ProcessRelayUpdate(currentTime, relays.relayIds[i], relays.relayNames[i], relays.relayAddresses[i], 0, "test", 0, len(sampleRelayId), sampleRelayId, sampleRTT, sampleJitter, samplePacketLoss, relays.counters[i][:])
+		relayEvent := relays.relayManager.DetectRelayAnomalies(currentTime, relays.relayIds[i], packetsSent, 1000)
+		if relayEvent != nil {
+			event = relayEvent
+		}
+	}
+	return event
+}
+
+func TestRelayAnomaly_Disabled(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	currentTime := time.Now().Unix()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, relays.update(currentTime+int64(i), 20, 1, 1000))
+	}
+
+	assert.Nil(t, relays.update(currentTime+100, 200, 1, 1000))
+	assert.Nil(t, relays.update(currentTime+101, 200, 1, 1000))
+	assert.Nil(t, relays.update(currentTime+102, 200, 1, 1000))
+
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+}
+
+func TestRelayAnomaly_QuarantineRTT(t *testing.T) {
+
+	t.Parallel()
+
+	config := common.DefaultRelayAnomalyConfig()
+
+	relays := createAnomalyTestRelays(&config)
+
+	currentTime := time.Now().Unix()
+
+	// build up a baseline
+
+	for i := 0; i < config.WarmupUpdates*2; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 1000))
+		currentTime++
+	}
+
+	costs := relays.relayManager.GetCosts(currentTime-1, relays.relayIds, 100, 100)
+	assert.Equal(t, uint8(20), costs[common.TriMatrixIndex(0, 1)])
+
+	// a single bad update does not quarantine the relay
+
+	assert.Nil(t, relays.update(currentTime, 200, 1, 1000))
+	currentTime++
+	assert.Nil(t, relays.update(currentTime, 20, 1, 1000))
+	currentTime++
+
+	// but several in a row does
+
+	var event *common.RelayQuarantineEvent
+	for i := 0; i < config.AnomalyUpdates; i++ {
+		event = relays.update(currentTime, 200, 1, 1000)
+		currentTime++
+	}
+
+	assert.NotNil(t, event)
+	if event == nil {
+		return
+	}
+	assert.True(t, event.Quarantined)
+	assert.Equal(t, relays.relayIds[0], event.RelayId)
+	assert.Equal(t, "A", event.RelayName)
+
+	assert.True(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[1]))
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[2]))
+
+	// the quarantined relay is excluded from costs and dest relays, but is still active
+
+	costs = relays.relayManager.GetCosts(currentTime-1, relays.relayIds, 100, 100)
+	assert.Equal(t, uint8(255), costs[common.TriMatrixIndex(0, 1)])
+	assert.Equal(t, uint8(255), costs[common.TriMatrixIndex(0, 2)])
+	assert.Equal(t, uint8(20), costs[common.TriMatrixIndex(1, 2)])
+
+	destRelays := relays.relayManager.GetDestRelays(relays.relayIds, []bool{true, true, false})
+	assert.Equal(t, []bool{false, true, false}, destRelays)
+
+	activeRelays := relays.relayManager.GetActiveRelays(currentTime - 1)
+	assert.Equal(t, 3, len(activeRelays))
+	assert.True(t, activeRelays[0].Quarantined)
+	assert.False(t, activeRelays[1].Quarantined)
+
+	// the relay stays quarantined until it has gone a full cooldown without an anomaly
+
+	recoverTime := currentTime
+	for currentTime < recoverTime+config.CooldownSeconds-1 {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 1000))
+		currentTime++
+	}
+
+	assert.True(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+
+	event = relays.update(currentTime, 20, 1, 1000)
+
+	assert.NotNil(t, event)
+	if event == nil {
+		return
+	}
+	assert.False(t, event.Quarantined)
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+
+	costs = relays.relayManager.GetCosts(currentTime, relays.relayIds, 100, 100)
+	assert.Equal(t, uint8(20), costs[common.TriMatrixIndex(0, 1)])
+}
+
+func TestRelayAnomaly_QuarantinePongs(t *testing.T) {
+
+	t.Parallel()
+
+	config := common.DefaultRelayAnomalyConfig()
+
+	relays := createAnomalyTestRelays(&config)
+
+	currentTime := time.Now().Unix()
+
+	for i := 0; i < config.WarmupUpdates*2; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 1000))
+		currentTime++
+	}
+
+	// relay A stops getting pongs back, even though the samples it reports look fine
+
+	var event *common.RelayQuarantineEvent
+	for i := 0; i < config.AnomalyUpdates; i++ {
+		event = relays.update(currentTime, 20, 0.1, 1000)
+		currentTime++
+	}
+
+	assert.NotNil(t, event)
+	assert.True(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+}
+
+func TestRelayAnomaly_TrafficOnly(t *testing.T) {
+
+	t.Parallel()
+
+	config := common.DefaultRelayAnomalyConfig()
+
+	relays := createAnomalyTestRelays(&config)
+
+	currentTime := time.Now().Unix()
+
+	for i := 0; i < config.WarmupUpdates*2; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 1000))
+		currentTime++
+	}
+
+	// relay A suddenly sends much less traffic, eg. because sessions were moved off it, but is otherwise healthy
+
+	for i := 0; i < config.AnomalyUpdates*2; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 10))
+		currentTime++
+	}
+
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+
+	// and it learns the new traffic level
+
+	for i := 0; i < config.WarmupUpdates; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 10))
+		currentTime++
+	}
+
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+}
+
+func TestRelayAnomaly_QuarantineTraffic(t *testing.T) {
+
+	t.Parallel()
+
+	config := common.DefaultRelayAnomalyConfig()
+
+	relays := createAnomalyTestRelays(&config)
+
+	currentTime := time.Now().Unix()
+
+	for i := 0; i < config.WarmupUpdates*2; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 1000))
+		currentTime++
+	}
+
+	// relay A suddenly stops sending traffic and stops getting pongs back
+
+	var event *common.RelayQuarantineEvent
+	for i := 0; i < config.AnomalyUpdates; i++ {
+		event = relays.update(currentTime, 20, 0.1, 10)
+		currentTime++
+	}
+
+	assert.NotNil(t, event)
+	assert.Contains(t, event.Reason, "pong ratio")
+	assert.Contains(t, event.Reason, "packets sent")
+	assert.True(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+
+	// low traffic while quarantined does not hold the relay in quarantine
+
+	recoverTime := currentTime
+	for currentTime <= recoverTime+config.CooldownSeconds {
+		relays.update(currentTime, 20, 1, 10)
+		currentTime++
+	}
+
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+
+	// once released, the relay learns its new traffic level instead of going straight back into quarantine
+
+	for i := 0; i < config.WarmupUpdates; i++ {
+		assert.Nil(t, relays.update(currentTime, 20, 1, 10))
+		currentTime++
+	}
+
+	assert.False(t, relays.relayManager.IsQuarantined(relays.relayIds[0]))
+}
@@ -0,0 +1,243 @@
+package common
+
+import (
+	"math"
+
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+)
+
+/*
+	Relay health scores make it easy to find the worst relays in a large fleet.
+
+	Once per-minute each relay is given a score from 0 (broken) to 100 (perfectly healthy), made up of:
+
+		- uptime: the fraction of the last hour the relay has been sending relay updates
+		- reachability: the fraction of other online relays it can route to
+		- rtt: how far its mean and max RTT to peers are above the speed of light between them
+		- packet loss: its mean packet loss to peers
+		- anomalies: relays that are quarantined, or had an anomaly in the last hour, lose these points
+
+	The score is a weighted sum of these components, each scaled to [0,1]. When relay anomaly detection is
+	disabled the anomaly component is left out of the score entirely, instead of giving every relay full marks.
+*/
+
+const RelayHealthHistorySize = 60 // minutes of uptime history
+
+type RelayHealthConfig struct {
+	UptimeWeight       float32
+	ReachabilityWeight float32
+	RTTWeight          float32
+	PacketLossWeight   float32
+	AnomalyWeight      float32
+	RTTMargin          float32 // milliseconds added to both RTT and speed of light RTT, so nearby peers don't have huge ratios
+	GoodRTTRatio       float32 // mean RTT at or below this multiple of the speed of light RTT scores full points
+	BadRTTRatio        float32 // mean RTT at or above this multiple of the speed of light RTT scores zero
+	GoodMaxRTTRatio    float32 // same for the worst peer
+	BadMaxRTTRatio     float32
+	BadPacketLoss      float32 // mean packet loss at or above this percentage scores zero
+	AnomalyWindow      int64   // seconds. relays with an anomaly this recently only get half the anomaly points
+}
+
+func DefaultRelayHealthConfig() RelayHealthConfig {
+	return RelayHealthConfig{
+		UptimeWeight:       25,
+		ReachabilityWeight: 25,
+		RTTWeight:          20,
+		PacketLossWeight:   20,
+		AnomalyWeight:      10,
+		RTTMargin:          5,
+		GoodRTTRatio:       2,
+		BadRTTRatio:        6,
+		GoodMaxRTTRatio:    3,
+		BadMaxRTTRatio:     10,
+		BadPacketLoss:      5,
+		AnomalyWindow:      3600,
+	}
+}
+
+type RelayHealth struct {
+	RelayId      uint64  `json:"relay_id,string"`
+	RelayName    string  `json:"relay_name"`
+	Score        float32 `json:"score"`
+	Online       bool    `json:"online"`
+	Uptime       float32 `json:"uptime"`         // fraction of the last hour the relay was online [0,1]
+	Reachability float32 `json:"reachability"`   // fraction of other online relays this relay can route to [0,1]
+	NumPeers     int     `json:"num_peers"`      // number of other online relays
+	MeanRTTRatio float32 `json:"mean_rtt_ratio"` // mean RTT to reachable peers, as a multiple of the speed of light RTT
+	MaxRTTRatio  float32 `json:"max_rtt_ratio"`  // worst RTT to a reachable peer, as a multiple of the speed of light RTT
+	PacketLoss   float32 `json:"packet_loss"`    // mean packet loss to reachable peers (%)
+	Quarantined  bool    `json:"quarantined"`
+	Anomalous    bool    `json:"anomalous"` // had an anomaly within the anomaly window
+}
+
+// RelayHealthTracker remembers which relays were online each minute, so uptime can be included in the health score
+type RelayHealthTracker struct {
+	config      RelayHealthConfig
+	onlineIndex int
+	online      map[uint64]*[RelayHealthHistorySize]bool
+	numSamples  int
+}
+
+func CreateRelayHealthTracker(config RelayHealthConfig) *RelayHealthTracker {
+	return &RelayHealthTracker{config: config, online: make(map[uint64]*[RelayHealthHistorySize]bool)}
+}
+
+func relayHealthScale(value float32, good float32, bad float32) float32 {
+	if value <= good {
+		return 1
+	}
+	if value >= bad {
+		return 0
+	}
+	return (bad - value) / (bad - good)
+}
+
+// Update records which relays are online, and returns the health of each relay in the same order as relay ids. Call once per-minute.
+func (tracker *RelayHealthTracker) Update(currentTime int64, relayManager *RelayManager, relayIds []uint64, relayNames []string, relayLatitudes []float32, relayLongitudes []float32, maxJitter float32, maxPacketLoss float32) []RelayHealth {
+
+	numRelays := len(relayIds)
+
+	health := make([]RelayHealth, numRelays)
+
+	relayManager.mutex.RLock()
+
+	anomalyDetection := relayManager.anomalyConfig != nil
+
+	online := make([]bool, numRelays)
+	numOnline := 0
+	for i := range relayIds {
+		sourceEntry := relayManager.SourceEntries[relayIds[i]]
+		online[i] = sourceEntry != nil && currentTime-sourceEntry.LastUpdateTime <= constants.RelayTimeout && !sourceEntry.ShuttingDown
+		if online[i] {
+			numOnline++
+		}
+	}
+
+	for i := range relayIds {
+
+		relay := &health[i]
+
+		relay.RelayId = relayIds[i]
+		relay.RelayName = relayNames[i]
+		relay.Online = online[i]
+
+		if !online[i] {
+			continue
+		}
+
+		sourceEntry := relayManager.SourceEntries[relayIds[i]]
+
+		relay.Quarantined = sourceEntry.Anomaly.Quarantined
+		relay.Anomalous = sourceEntry.Anomaly.LastAnomalyTime != 0 && currentTime-sourceEntry.Anomaly.LastAnomalyTime < tracker.config.AnomalyWindow
+
+		relay.NumPeers = numOnline - 1
+
+		numReachable := 0
+		sumRTTRatio := float32(0)
+		sumPacketLoss := float32(0)
+
+		for j := range relayIds {
+
+			if i == j || !online[j] {
+				continue
+			}
+
+			rtt, jitter, packetLoss := relayManager.getSample(relayIds[i], relayIds[j])
+
+			if rtt >= 255 || jitter > maxJitter || packetLoss > maxPacketLoss {
+				continue
+			}
+
+			speedOfLightRTT := 2.0 * core.SpeedOfLightTimeMilliseconds_AB(float64(relayLatitudes[i]), float64(relayLongitudes[i]), float64(relayLatitudes[j]), float64(relayLongitudes[j]))
+
+			rttRatio := (rtt + tracker.config.RTTMargin) / (float32(speedOfLightRTT) + tracker.config.RTTMargin)
+
+			numReachable++
+			sumRTTRatio += rttRatio
+			sumPacketLoss += packetLoss
+			if rttRatio > relay.MaxRTTRatio {
+				relay.MaxRTTRatio = rttRatio
+			}
+		}
+
+		if relay.NumPeers > 0 {
+			relay.Reachability = float32(numReachable) / float32(relay.NumPeers)
+		}
+
+		if numReachable > 0 {
+			relay.MeanRTTRatio = sumRTTRatio / float32(numReachable)
+			relay.PacketLoss = sumPacketLoss / float32(numReachable)
+		}
+	}
+
+	relayManager.mutex.RUnlock()
+
+	// update uptime history. relays that are no longer in the database are forgotten
+
+	tracker.onlineIndex = (tracker.onlineIndex + 1) % RelayHealthHistorySize
+	if tracker.numSamples < RelayHealthHistorySize {
+		tracker.numSamples++
+	}
+
+	history := make(map[uint64]*[RelayHealthHistorySize]bool, numRelays)
+	for i := range relayIds {
+		relayHistory := tracker.online[relayIds[i]]
+		if relayHistory == nil {
+			relayHistory = &[RelayHealthHistorySize]bool{}
+		}
+		relayHistory[tracker.onlineIndex] = online[i]
+		history[relayIds[i]] = relayHistory
+	}
+	tracker.online = history
+
+	// score each relay
+
+	for i := range health {
+
+		relay := &health[i]
+
+		numOnlineSamples := 0
+		for _, value := range tracker.online[relay.RelayId] {
+			if value {
+				numOnlineSamples++
+			}
+		}
+		relay.Uptime = float32(numOnlineSamples) / float32(tracker.numSamples)
+
+		score := tracker.config.UptimeWeight * relay.Uptime
+
+		if relay.Online {
+
+			if relay.NumPeers == 0 {
+				relay.Reachability = 1
+			}
+
+			score += tracker.config.ReachabilityWeight * relay.Reachability
+
+			if relay.Reachability > 0 || relay.NumPeers == 0 {
+				rttScore := 0.5*relayHealthScale(relay.MeanRTTRatio, tracker.config.GoodRTTRatio, tracker.config.BadRTTRatio) + 0.5*relayHealthScale(relay.MaxRTTRatio, tracker.config.GoodMaxRTTRatio, tracker.config.BadMaxRTTRatio)
+				score += tracker.config.RTTWeight * rttScore
+				score += tracker.config.PacketLossWeight * relayHealthScale(relay.PacketLoss, 0, tracker.config.BadPacketLoss)
+			}
+
+			if anomalyDetection && !relay.Quarantined {
+				if relay.Anomalous {
+					score += 0.5 * tracker.config.AnomalyWeight
+				} else {
+					score += tracker.config.AnomalyWeight
+				}
+			}
+		}
+
+		totalWeight := tracker.config.UptimeWeight + tracker.config.ReachabilityWeight + tracker.config.RTTWeight + tracker.config.PacketLossWeight
+		if anomalyDetection {
+			totalWeight += tracker.config.AnomalyWeight
+		}
+		if totalWeight > 0 {
+			relay.Score = float32(math.Round(float64(100*score/totalWeight)*10) / 10)
+		}
+	}
+
+	return health
+}
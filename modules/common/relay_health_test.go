@@ -0,0 +1,164 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// relays A, B and C are roughly 1500km apart, relay D is in the database but never sends relay updates
+func relayHealthTestData(relays *anomalyTestRelays) ([]uint64, []string, []float32, []float32) {
+	relayIds := append(append([]uint64{}, relays.relayIds...), common.RelayId("D"))
+	relayNames := append(append([]string{}, relays.relayNames...), "D")
+	relayLatitudes := []float32{0, 0, 13.5, 0}
+	relayLongitudes := []float32{0, 13.5, 0, 0}
+	return relayIds, relayNames, relayLatitudes, relayLongitudes
+}
+
+func TestRelayHealth(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	relayIds, relayNames, relayLatitudes, relayLongitudes := relayHealthTestData(relays)
+
+	tracker := common.CreateRelayHealthTracker(common.DefaultRelayHealthConfig())
+
+	currentTime := time.Now().Unix()
+
+	var health []common.RelayHealth
+
+	for i := 0; i < 10; i++ {
+		relays.update(currentTime, 20, 1, 1000)
+		health = tracker.Update(currentTime, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+		currentTime += 60
+	}
+
+	assert.Equal(t, len(relayIds), len(health))
+
+	// healthy relays get full marks
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, relayIds[i], health[i].RelayId)
+		assert.Equal(t, relayNames[i], health[i].RelayName)
+		assert.True(t, health[i].Online)
+		assert.Equal(t, float32(1), health[i].Uptime)
+		assert.Equal(t, float32(1), health[i].Reachability)
+		assert.Equal(t, 2, health[i].NumPeers)
+		assert.Equal(t, float32(0), health[i].PacketLoss)
+		assert.Equal(t, float32(100), health[i].Score)
+	}
+
+	// relays that never send relay updates score zero
+
+	assert.False(t, health[3].Online)
+	assert.Equal(t, float32(0), health[3].Uptime)
+	assert.Equal(t, float32(0), health[3].Score)
+
+	// once relays stop sending updates they go offline, and their uptime drops
+
+	health = tracker.Update(currentTime+constants.RelayTimeout+1, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+
+	config := common.DefaultRelayHealthConfig()
+	uptimeShare := 100 * config.UptimeWeight / (config.UptimeWeight + config.ReachabilityWeight + config.RTTWeight + config.PacketLossWeight)
+
+	for i := 0; i < 3; i++ {
+		assert.False(t, health[i].Online)
+		assert.Equal(t, float32(10)/11, health[i].Uptime)
+		assert.True(t, health[i].Score < uptimeShare)
+	}
+}
+
+func TestRelayHealth_HighRTT(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	relayIds, relayNames, relayLatitudes, relayLongitudes := relayHealthTestData(relays)
+
+	tracker := common.CreateRelayHealthTracker(common.DefaultRelayHealthConfig())
+
+	currentTime := time.Now().Unix()
+
+	relays.update(currentTime, 100, 1, 1000)
+
+	health := tracker.Update(currentTime, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+
+	// relay A has high RTT to all of its peers, so it is the worst relay
+
+	assert.True(t, health[0].MeanRTTRatio > health[1].MeanRTTRatio)
+	assert.True(t, health[0].Score < 100)
+	assert.True(t, health[0].Score < health[1].Score)
+	assert.True(t, health[0].Score < health[2].Score)
+
+	// relays that can't reach their peers lose reachability, rtt and packet loss points
+
+	relays.update(currentTime, 255, 1, 1000)
+
+	health = tracker.Update(currentTime, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+
+	assert.Equal(t, float32(0), health[0].Reachability)
+	assert.Equal(t, float32(0.5), health[1].Reachability)
+	assert.True(t, health[0].Score < health[1].Score)
+}
+
+func TestRelayHealth_Anomalies(t *testing.T) {
+
+	t.Parallel()
+
+	config := common.DefaultRelayAnomalyConfig()
+
+	relays := createAnomalyTestRelays(&config)
+
+	relayIds, relayNames, relayLatitudes, relayLongitudes := relayHealthTestData(relays)
+
+	healthConfig := common.DefaultRelayHealthConfig()
+
+	tracker := common.CreateRelayHealthTracker(healthConfig)
+
+	currentTime := time.Now().Unix()
+
+	for i := 0; i < config.WarmupUpdates*2; i++ {
+		relays.update(currentTime, 20, 1, 1000)
+		currentTime++
+	}
+
+	health := tracker.Update(currentTime-1, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, float32(100), health[i].Score)
+	}
+
+	// relay A stops getting pongs back and is quarantined, so it loses the anomaly points
+
+	for i := 0; i < config.AnomalyUpdates; i++ {
+		relays.update(currentTime, 20, 0.1, 1000)
+		currentTime++
+	}
+
+	health = tracker.Update(currentTime-1, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+
+	assert.True(t, health[0].Quarantined)
+	assert.Equal(t, float32(100-healthConfig.AnomalyWeight), health[0].Score)
+	assert.Equal(t, float32(100), health[1].Score)
+
+	// without anomaly detection the anomaly points are left out, rather than given to every relay
+
+	relays.relayManager.SetAnomalyConfig(nil)
+	relays.relayManager.SourceEntries[relays.relayIds[0]].Anomaly = common.RelayAnomalyState{}
+
+	relays.update(currentTime, 100, 1, 1000)
+
+	health = tracker.Update(currentTime, relays.relayManager, relayIds, relayNames, relayLatitudes, relayLongitudes, 100, 100)
+
+	assert.True(t, health[0].Score < health[1].Score)
+
+	totalWeight := healthConfig.UptimeWeight + healthConfig.ReachabilityWeight + healthConfig.RTTWeight + healthConfig.PacketLossWeight
+	assert.True(t, health[0].Score < 100*(totalWeight-1)/totalWeight)
+}
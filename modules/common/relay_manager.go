@@ -38,9 +38,12 @@ func historyMean(history []float32) float32 {
 	for i := 0; i < len(history); i++ {
 		sum += float64(history[i])
 	}
-	return float32(sum / float64(constants.RelayHistorySize))
+	return float32(sum / float64(len(history)))
 }
 
+// history entries start out with this value, so relay pairs are not routable until they have a full history
+const historyEmpty = float32(1000000000.0)
+
 type RelayManagerDestEntry struct {
 	LastUpdateTime    int64
 	RTT               float32
@@ -53,15 +56,18 @@ type RelayManagerDestEntry struct {
 }
 
 type RelayManagerSourceEntry struct {
-	LastUpdateTime int64
-	RelayId        uint64
-	RelayName      string
-	RelayAddress   net.UDPAddr
-	Sessions       int
-	RelayVersion   string
-	ShuttingDown   bool
-	DestEntries    map[uint64]*RelayManagerDestEntry
-	Counters       [constants.NumRelayCounters]uint64
+	LastUpdateTime   int64
+	RelayId          uint64
+	RelayName        string
+	RelayAddress     net.UDPAddr
+	Sessions         int
+	BandwidthKbps    int
+	RelayVersion     string
+	ShuttingDown     bool
+	DestEntries      map[uint64]*RelayManagerDestEntry
+	Counters         [constants.NumRelayCounters]uint64
+	Anomaly          RelayAnomalyState
+	SampleViolations RelaySampleViolations
 }
 
 type RelayManager struct {
@@ -69,15 +75,60 @@ type RelayManager struct {
 	EnableHistory bool
 	SourceEntries map[uint64]*RelayManagerSourceEntry
 	TotalCounters [constants.NumRelayCounters]uint64
+	costEstimator CostEstimator
+	anomalyConfig *RelayAnomalyConfig
+
+	sampleValidationConfig *RelaySampleValidationConfig
+	invalidSamples         map[relayPair]uint8
 }
 
 func CreateRelayManager(enableHistory bool) *RelayManager {
 	relayManager := &RelayManager{}
 	relayManager.EnableHistory = enableHistory
 	relayManager.SourceEntries = make(map[uint64]*RelayManagerSourceEntry)
+	relayManager.costEstimator = &MaxCostEstimator{}
 	return relayManager
 }
 
+func (relayManager *RelayManager) SetCostEstimator(costEstimator CostEstimator) {
+	relayManager.mutex.Lock()
+	relayManager.costEstimator = costEstimator
+	relayManager.mutex.Unlock()
+}
+
+func (relayManager *RelayManager) GetCostEstimator() CostEstimator {
+	relayManager.mutex.RLock()
+	costEstimator := relayManager.costEstimator
+	relayManager.mutex.RUnlock()
+	if costEstimator == nil {
+		return &MaxCostEstimator{}
+	}
+	return costEstimator
+}
+
+// CostEstimatorName is the name of the estimator actually used for the cost matrix. estimators only run when history is enabled
+func (relayManager *RelayManager) CostEstimatorName() string {
+	if !relayManager.EnableHistory {
+		return CostEstimator_LatestSample
+	}
+	return relayManager.GetCostEstimator().Name()
+}
+
+func (relayManager *RelayManager) estimateRTT(history []float32, newest int) float32 {
+
+	// relay pairs are not routable until they have a full history
+
+	if history[(newest+1)%len(history)] >= historyEmpty {
+		return historyEmpty
+	}
+
+	if relayManager.costEstimator == nil {
+		return historyMax(history)
+	}
+
+	return relayManager.costEstimator.EstimateRTT(history, newest)
+}
+
 func (relayManager *RelayManager) ProcessRelayUpdate(currentTime int64, relayId uint64, relayName string, relayAddress net.UDPAddr, sessions int, relayVersion string, relayFlags uint64, numSamples int, sampleRelayId []uint64, sampleRTT []uint8, sampleJitter []uint8, samplePacketLoss []uint16, counters []uint64) {
 
 	// look up the entry corresponding to the source relay, or create it if it doesn't exist
@@ -86,8 +137,13 @@ func (relayManager *RelayManager) ProcessRelayUpdate(currentTime int64, relayId
 
 	sourceEntry, exists := relayManager.SourceEntries[relayId]
 	if !exists || sourceEntry.LastUpdateTime < currentTime-constants.RelayTimeout {
+		previousEntry := sourceEntry
 		sourceEntry = &RelayManagerSourceEntry{}
 		sourceEntry.DestEntries = make(map[uint64]*RelayManagerDestEntry)
+		if previousEntry != nil && previousEntry.Anomaly.Quarantined {
+			// IMPORTANT: a relay must not escape quarantine by going offline and coming back
+			sourceEntry.Anomaly = previousEntry.Anomaly
+		}
 		relayManager.SourceEntries[relayId] = sourceEntry
 	}
 
@@ -122,9 +178,9 @@ func (relayManager *RelayManager) ProcessRelayUpdate(currentTime int64, relayId
 			destEntry = &RelayManagerDestEntry{}
 			sourceEntry.DestEntries[destRelayId] = destEntry
 			for j := 0; j < constants.RelayHistorySize; j++ {
-				destEntry.HistoryRTT[j] = 1000000000.0
-				destEntry.HistoryJitter[j] = 1000000000.0
-				destEntry.HistoryPacketLoss[j] = 1000000000.0
+				destEntry.HistoryRTT[j] = historyEmpty
+				destEntry.HistoryJitter[j] = historyEmpty
+				destEntry.HistoryPacketLoss[j] = historyEmpty
 			}
 		}
 
@@ -137,7 +193,7 @@ func (relayManager *RelayManager) ProcessRelayUpdate(currentTime int64, relayId
 		destEntry.HistoryPacketLoss[destEntry.HistoryIndex] = packetLoss
 
 		if relayManager.EnableHistory {
-			destEntry.RTT = historyMax(destEntry.HistoryRTT[:])
+			destEntry.RTT = relayManager.estimateRTT(destEntry.HistoryRTT[:], int(destEntry.HistoryIndex))
 			destEntry.Jitter = historyMean(destEntry.HistoryJitter[:])
 			destEntry.PacketLoss = historyMean(destEntry.HistoryPacketLoss[:])
 		} else {
@@ -237,10 +293,19 @@ func (relayManager *RelayManager) GetHistory(sourceRelayId uint64, destRelayId u
 }
 
 func (relayManager *RelayManager) GetCosts(currentTime int64, relayIds []uint64, maxJitter float32, maxPacketLoss float32) []uint8 {
+	costs, _, _ := relayManager.GetCostsWithQuality(currentTime, relayIds, maxJitter, maxPacketLoss)
+	return costs
+}
+
+// GetCostsWithQuality returns the cost matrix along with matching jitter (milliseconds) and packet loss (tenths of a percent) matrices.
+// Jitter and packet loss are clamped to 255, and are zero for relay pairs that are not routable.
+func (relayManager *RelayManager) GetCostsWithQuality(currentTime int64, relayIds []uint64, maxJitter float32, maxPacketLoss float32) ([]uint8, []uint8, []uint8) {
 
 	numRelays := len(relayIds)
 
 	costs := make([]uint8, TriMatrixLength(numRelays))
+	jitters := make([]uint8, TriMatrixLength(numRelays))
+	packetLosses := make([]uint8, TriMatrixLength(numRelays))
 
 	for i := range costs {
 		costs[i] = 255
@@ -253,11 +318,11 @@ func (relayManager *RelayManager) GetCosts(currentTime int64, relayIds []uint64,
 	for i := 0; i < numRelays; i++ {
 		sourceRelayId := uint64(relayIds[i])
 		_, sourceActive := activeRelayMap[sourceRelayId]
-		if sourceActive {
+		if sourceActive && !relayManager.isQuarantined(sourceRelayId) {
 			for j := 0; j < i; j++ {
 				destRelayId := uint64(relayIds[j])
 				_, destActive := activeRelayMap[destRelayId]
-				if destActive {
+				if destActive && !relayManager.isQuarantined(destRelayId) && !relayManager.isInvalidSample(sourceRelayId, destRelayId) {
 					rtt, jitter, packetLoss := relayManager.getSample(sourceRelayId, destRelayId)
 					if rtt < 255 && jitter <= maxJitter && packetLoss <= maxPacketLoss {
 						index := TriMatrixIndex(i, j)
@@ -265,6 +330,8 @@ func (relayManager *RelayManager) GetCosts(currentTime int64, relayIds []uint64,
 						if costs[index] == 0 {
 							costs[index] = 255
 						}
+						jitters[index] = uint8(math.Min(math.Ceil(float64(jitter)), 255))
+						packetLosses[index] = uint8(math.Min(math.Ceil(float64(packetLoss)*10), 255))
 					}
 				}
 			}
@@ -273,18 +340,77 @@ func (relayManager *RelayManager) GetCosts(currentTime int64, relayIds []uint64,
 
 	relayManager.mutex.RUnlock()
 
+	return costs, jitters, packetLosses
+}
+
+// GetDirectionalCosts returns a square cost matrix where the cost i -> j comes from the samples relay i reports for relay j,
+// instead of taking the maximum of both directions. Index it with core.SquareMatrixIndex. The diagonal is always 255.
+//
+// IMPORTANT: relays only measure round trip time, so both directions are RTT samples of the same round trip, measured from
+// each end. Any difference between i -> j and j -> i is measurement noise, not path asymmetry. Keep directional costs off
+// until relays measure one-way latency.
+func (relayManager *RelayManager) GetDirectionalCosts(currentTime int64, relayIds []uint64, maxJitter float32, maxPacketLoss float32) []uint8 {
+
+	numRelays := len(relayIds)
+
+	costs := make([]uint8, numRelays*numRelays)
+
+	for i := range costs {
+		costs[i] = 255
+	}
+
+	activeRelayMap := relayManager.GetActiveRelayMap(currentTime)
+
+	relayManager.mutex.RLock()
+
+	for i := 0; i < numRelays; i++ {
+		sourceRelayId := uint64(relayIds[i])
+		_, sourceActive := activeRelayMap[sourceRelayId]
+		if !sourceActive || relayManager.isQuarantined(sourceRelayId) {
+			continue
+		}
+		sourceEntry := relayManager.SourceEntries[sourceRelayId]
+		if sourceEntry == nil {
+			continue
+		}
+		for j := 0; j < numRelays; j++ {
+			if i == j {
+				continue
+			}
+			destRelayId := uint64(relayIds[j])
+			_, destActive := activeRelayMap[destRelayId]
+			if !destActive || relayManager.isQuarantined(destRelayId) || relayManager.isInvalidSample(sourceRelayId, destRelayId) {
+				continue
+			}
+			destEntry := sourceEntry.DestEntries[destRelayId]
+			if destEntry == nil {
+				continue
+			}
+			if destEntry.RTT < 255 && destEntry.Jitter <= maxJitter && destEntry.PacketLoss <= maxPacketLoss {
+				cost := uint8(math.Ceil(float64(destEntry.RTT)))
+				if cost == 0 {
+					cost = 255
+				}
+				costs[i*numRelays+j] = cost
+			}
+		}
+	}
+
+	relayManager.mutex.RUnlock()
+
 	return costs
 }
 
 var RelayStatusStrings = [3]string{"offline", "online", "shutting down"}
 
 type Relay struct {
-	Id       uint64
-	Name     string
-	Address  net.UDPAddr
-	Status   int
-	Sessions int
-	Version  string
+	Id          uint64
+	Name        string
+	Address     net.UDPAddr
+	Status      int
+	Sessions    int
+	Version     string
+	Quarantined bool
 }
 
 func (relayManager *RelayManager) GetRelays(currentTime int64, relayIds []uint64, relayNames []string, relayAddresses []net.UDPAddr) []Relay {
@@ -314,6 +440,7 @@ func (relayManager *RelayManager) GetRelays(currentTime int64, relayIds []uint64
 		relay.Name = sourceEntry.RelayName
 		relay.Address = sourceEntry.RelayAddress
 		relay.Sessions = sourceEntry.Sessions
+		relay.Quarantined = sourceEntry.Anomaly.Quarantined
 
 		relay.Status = constants.RelayStatus_Online
 
@@ -396,6 +523,7 @@ func (relayManager *RelayManager) GetActiveRelays(currentTime int64) []Relay {
 		activeRelay.Id = sourceEntry.RelayId
 		activeRelay.Sessions = sourceEntry.Sessions
 		activeRelay.Version = sourceEntry.RelayVersion
+		activeRelay.Quarantined = sourceEntry.Anomaly.Quarantined
 
 		expired := currentTime-sourceEntry.LastUpdateTime > constants.RelayTimeout
 
@@ -415,6 +543,74 @@ func (relayManager *RelayManager) GetActiveRelays(currentTime int64) []Relay {
 	return activeRelays
 }
 
+func (relayManager *RelayManager) GetRelaySessions(currentTime int64, relayIds []uint64) []int {
+
+	// sessions for each relay, in the same order as relay ids. relays that are offline or shutting down have zero sessions
+
+	relaySessions := make([]int, len(relayIds))
+
+	relayManager.mutex.RLock()
+
+	for i := range relayIds {
+
+		sourceEntry, ok := relayManager.SourceEntries[relayIds[i]]
+		if !ok {
+			continue
+		}
+
+		expired := currentTime-sourceEntry.LastUpdateTime > constants.RelayTimeout
+
+		if expired || sourceEntry.ShuttingDown {
+			continue
+		}
+
+		relaySessions[i] = sourceEntry.Sessions
+	}
+
+	relayManager.mutex.RUnlock()
+
+	return relaySessions
+}
+
+// SetRelayBandwidth records the bandwidth a relay is using, so we can work out how close it is to its port speed
+func (relayManager *RelayManager) SetRelayBandwidth(relayId uint64, bandwidthKbps int) {
+	relayManager.mutex.Lock()
+	sourceEntry, ok := relayManager.SourceEntries[relayId]
+	if ok {
+		sourceEntry.BandwidthKbps = bandwidthKbps
+	}
+	relayManager.mutex.Unlock()
+}
+
+func (relayManager *RelayManager) GetRelayBandwidth(currentTime int64, relayIds []uint64) []int {
+
+	// bandwidth for each relay in kbps, in the same order as relay ids. relays that are offline or shutting down use no bandwidth
+
+	relayBandwidth := make([]int, len(relayIds))
+
+	relayManager.mutex.RLock()
+
+	for i := range relayIds {
+
+		sourceEntry, ok := relayManager.SourceEntries[relayIds[i]]
+		if !ok {
+			continue
+		}
+
+		expired := currentTime-sourceEntry.LastUpdateTime > constants.RelayTimeout
+
+		if expired || sourceEntry.ShuttingDown {
+			continue
+		}
+
+		relayBandwidth[i] = sourceEntry.BandwidthKbps
+	}
+
+	relayManager.mutex.RUnlock()
+
+	return relayBandwidth
+}
+
 func (relayManager *RelayManager) GetActiveRelayMap(currentTime int64) map[uint64]Relay {
 
 	activeRelays := relayManager.GetActiveRelays(currentTime)
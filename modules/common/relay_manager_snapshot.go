@@ -0,0 +1,232 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/encoding"
+)
+
+/*
+	Relay manager snapshots let a relay backend restart without waiting for relay histories to build up again.
+
+	A snapshot is a version and the time the snapshot was taken, followed by the gzipped, gob encoded relay manager
+	state: source entries with counters and anomaly state, and the current RTT, jitter and packet loss estimate for
+	each dest entry. Histories are not part of the snapshot, because with thousands of relays they add up to several
+	GB. Instead, restored histories are filled with the current estimates, so relay pairs stay routable at the same cost.
+
+	Timestamps are restored as they were, so a snapshot is only useful when the relay backend restarts in less than
+	the relay timeout. Relays that are still online keep their entries when their next relay update comes in.
+
+	The cost estimator and anomaly config are not part of the snapshot, they come from the relay backend that restores it.
+*/
+
+const (
+	RelayManagerSnapshotVersion_Min   = 2 // the minimum version we can read
+	RelayManagerSnapshotVersion_Max   = 2 // the maximum version we can read
+	RelayManagerSnapshotVersion_Write = 2 // the version we write
+
+	relayManagerSnapshotHeaderBytes = 4 + 8
+)
+
+type relayManagerSnapshotDestEntry struct {
+	RelayId        uint64
+	LastUpdateTime int64
+	RTT            float32
+	Jitter         float32
+	PacketLoss     float32
+}
+
+type relayManagerSnapshotSourceEntry struct {
+	LastUpdateTime   int64
+	RelayId          uint64
+	RelayName        string
+	RelayAddress     net.UDPAddr
+	Sessions         int
+	BandwidthKbps    int
+	RelayVersion     string
+	ShuttingDown     bool
+	DestEntries      []relayManagerSnapshotDestEntry
+	Counters         [constants.NumRelayCounters]uint64
+	Anomaly          RelayAnomalyState
+	SampleViolations RelaySampleViolations
+}
+
+type relayManagerSnapshotData struct {
+	SourceEntries []relayManagerSnapshotSourceEntry
+	TotalCounters [constants.NumRelayCounters]uint64
+}
+
+func copyFloatMap(input map[uint64]float32) map[uint64]float32 {
+	if input == nil {
+		return nil
+	}
+	output := make(map[uint64]float32, len(input))
+	for k, v := range input {
+		output[k] = v
+	}
+	return output
+}
+
+// Snapshot returns the relay manager state, tagged with the current time.
+// Only the current estimates are copied while holding the read lock. Encoding and compression happen after it is released.
+func (relayManager *RelayManager) Snapshot(currentTime int64) ([]byte, error) {
+
+	data := relayManagerSnapshotData{}
+
+	relayManager.mutex.RLock()
+
+	data.SourceEntries = make([]relayManagerSnapshotSourceEntry, 0, len(relayManager.SourceEntries))
+	data.TotalCounters = relayManager.TotalCounters
+
+	for _, sourceEntry := range relayManager.SourceEntries {
+		entry := relayManagerSnapshotSourceEntry{
+			LastUpdateTime:   sourceEntry.LastUpdateTime,
+			RelayId:          sourceEntry.RelayId,
+			RelayName:        sourceEntry.RelayName,
+			RelayAddress:     sourceEntry.RelayAddress,
+			Sessions:         sourceEntry.Sessions,
+			BandwidthKbps:    sourceEntry.BandwidthKbps,
+			RelayVersion:     sourceEntry.RelayVersion,
+			ShuttingDown:     sourceEntry.ShuttingDown,
+			DestEntries:      make([]relayManagerSnapshotDestEntry, 0, len(sourceEntry.DestEntries)),
+			Counters:         sourceEntry.Counters,
+			Anomaly:          sourceEntry.Anomaly,
+			SampleViolations: sourceEntry.SampleViolations,
+		}
+		entry.Anomaly.BaselinePeerRTT = copyFloatMap(sourceEntry.Anomaly.BaselinePeerRTT)
+		entry.Anomaly.BaselinePeerLoss = copyFloatMap(sourceEntry.Anomaly.BaselinePeerLoss)
+		for destRelayId, destEntry := range sourceEntry.DestEntries {
+			entry.DestEntries = append(entry.DestEntries, relayManagerSnapshotDestEntry{
+				RelayId:        destRelayId,
+				LastUpdateTime: destEntry.LastUpdateTime,
+				RTT:            destEntry.RTT,
+				Jitter:         destEntry.Jitter,
+				PacketLoss:     destEntry.PacketLoss,
+			})
+		}
+		data.SourceEntries = append(data.SourceEntries, entry)
+	}
+
+	relayManager.mutex.RUnlock()
+
+	var buffer bytes.Buffer
+
+	var header [relayManagerSnapshotHeaderBytes]byte
+	index := 0
+	encoding.WriteUint32(header[:], &index, RelayManagerSnapshotVersion_Write)
+	encoding.WriteUint64(header[:], &index, uint64(currentTime))
+	buffer.Write(header[:])
+
+	gz := gzip.NewWriter(&buffer)
+
+	err := gob.NewEncoder(gz).Encode(&data)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode relay manager snapshot: %v", err)
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not compress relay manager snapshot: %v", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ReadRelayManagerSnapshotTime returns the time a snapshot was taken without decoding the whole snapshot
+func ReadRelayManagerSnapshotTime(snapshot []byte) (int64, error) {
+	index := 0
+	var version uint32
+	var snapshotTime uint64
+	if !encoding.ReadUint32(snapshot, &index, &version) || !encoding.ReadUint64(snapshot, &index, &snapshotTime) {
+		return 0, fmt.Errorf("relay manager snapshot is too small")
+	}
+	if version < RelayManagerSnapshotVersion_Min || version > RelayManagerSnapshotVersion_Max {
+		return 0, fmt.Errorf("invalid relay manager snapshot version: %d", version)
+	}
+	return int64(snapshotTime), nil
+}
+
+// Restore replaces the relay manager state with a snapshot, as long as the snapshot is no older than maxAge seconds.
+// Timestamps are kept as they were in the snapshot, and each history is filled with the estimates it had when the snapshot was taken.
+func (relayManager *RelayManager) Restore(snapshot []byte, currentTime int64, maxAge int64) error {
+
+	snapshotTime, err := ReadRelayManagerSnapshotTime(snapshot)
+	if err != nil {
+		return err
+	}
+
+	age := currentTime - snapshotTime
+	if age > maxAge {
+		return fmt.Errorf("relay manager snapshot is too old (%d seconds)", age)
+	}
+	if age < 0 {
+		return fmt.Errorf("relay manager snapshot is in the future (%d seconds)", -age)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(snapshot[relayManagerSnapshotHeaderBytes:]))
+	if err != nil {
+		return fmt.Errorf("could not decompress relay manager snapshot: %v", err)
+	}
+
+	// IMPORTANT: read all the way to the end, so the gzip checksum catches truncated snapshots
+
+	decompressed, err := io.ReadAll(gz)
+	if err != nil {
+		return fmt.Errorf("could not decompress relay manager snapshot: %v", err)
+	}
+
+	data := relayManagerSnapshotData{}
+
+	err = gob.NewDecoder(bytes.NewReader(decompressed)).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("could not decode relay manager snapshot: %v", err)
+	}
+
+	sourceEntries := make(map[uint64]*RelayManagerSourceEntry, len(data.SourceEntries))
+
+	for i := range data.SourceEntries {
+		entry := &data.SourceEntries[i]
+		sourceEntry := &RelayManagerSourceEntry{
+			LastUpdateTime:   entry.LastUpdateTime,
+			RelayId:          entry.RelayId,
+			RelayName:        entry.RelayName,
+			RelayAddress:     entry.RelayAddress,
+			Sessions:         entry.Sessions,
+			BandwidthKbps:    entry.BandwidthKbps,
+			RelayVersion:     entry.RelayVersion,
+			ShuttingDown:     entry.ShuttingDown,
+			DestEntries:      make(map[uint64]*RelayManagerDestEntry, len(entry.DestEntries)),
+			Counters:         entry.Counters,
+			Anomaly:          entry.Anomaly,
+			SampleViolations: entry.SampleViolations,
+		}
+		for j := range entry.DestEntries {
+			destEntry := &RelayManagerDestEntry{
+				LastUpdateTime: entry.DestEntries[j].LastUpdateTime,
+				RTT:            entry.DestEntries[j].RTT,
+				Jitter:         entry.DestEntries[j].Jitter,
+				PacketLoss:     entry.DestEntries[j].PacketLoss,
+			}
+			for k := 0; k < constants.RelayHistorySize; k++ {
+				destEntry.HistoryRTT[k] = destEntry.RTT
+				destEntry.HistoryJitter[k] = destEntry.Jitter
+				destEntry.HistoryPacketLoss[k] = destEntry.PacketLoss
+			}
+			sourceEntry.DestEntries[entry.DestEntries[j].RelayId] = destEntry
+		}
+		sourceEntries[entry.RelayId] = sourceEntry
+	}
+
+	relayManager.mutex.Lock()
+	relayManager.SourceEntries = sourceEntries
+	relayManager.TotalCounters = data.TotalCounters
+	relayManager.mutex.Unlock()
+
+	return nil
+}
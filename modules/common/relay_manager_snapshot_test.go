@@ -0,0 +1,121 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayManagerSnapshot(t *testing.T) {
+
+	t.Parallel()
+
+	config := common.DefaultRelayAnomalyConfig()
+
+	relays := createAnomalyTestRelays(&config)
+
+	currentTime := time.Now().Unix()
+
+	for i := 0; i < 10; i++ {
+		relays.update(currentTime, 20, 1, 1000)
+		currentTime++
+	}
+
+	snapshotTime := currentTime - 1
+
+	snapshot, err := relays.relayManager.Snapshot(snapshotTime)
+	assert.Nil(t, err)
+
+	readTime, err := common.ReadRelayManagerSnapshotTime(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshotTime, readTime)
+
+	// restoring at the time the snapshot was taken gives back the same relays, costs and counters
+
+	restored := common.CreateRelayManager(false)
+
+	err = restored.Restore(snapshot, snapshotTime, 60)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(relays.relayManager.SourceEntries), len(restored.SourceEntries))
+	for relayId, sourceEntry := range relays.relayManager.SourceEntries {
+		restoredEntry := restored.SourceEntries[relayId]
+		assert.NotNil(t, restoredEntry)
+		assert.Equal(t, sourceEntry.LastUpdateTime, restoredEntry.LastUpdateTime)
+		assert.Equal(t, sourceEntry.RelayName, restoredEntry.RelayName)
+		assert.Equal(t, sourceEntry.Counters, restoredEntry.Counters)
+		assert.Equal(t, sourceEntry.Anomaly, restoredEntry.Anomaly)
+		assert.Equal(t, len(sourceEntry.DestEntries), len(restoredEntry.DestEntries))
+	}
+	assert.Equal(t, relays.relayManager.TotalCounters, restored.TotalCounters)
+	assert.Equal(t, relays.relayManager.GetCosts(snapshotTime, relays.relayIds, 100, 100), restored.GetCosts(snapshotTime, relays.relayIds, 100, 100))
+	assert.Equal(t, relays.relayManager.GetRelayCounters(relays.relayIds[0]), restored.GetRelayCounters(relays.relayIds[0]))
+
+	// histories are not in the snapshot, they are filled with the estimates so relay pairs stay routable
+
+	history, _, _ := restored.GetHistory(relays.relayIds[0], relays.relayIds[1])
+	for i := range history {
+		assert.Equal(t, float32(20), history[i])
+	}
+
+	// restoring later keeps the original timestamps, so relays that stopped updating still time out
+
+	restoreTime := snapshotTime + 20
+
+	restored = common.CreateRelayManager(false)
+
+	err = restored.Restore(snapshot, restoreTime, 60)
+	assert.Nil(t, err)
+
+	assert.Equal(t, snapshotTime, restored.SourceEntries[relays.relayIds[0]].LastUpdateTime)
+	assert.Equal(t, 3, len(restored.GetActiveRelays(restoreTime)))
+	assert.Equal(t, 0, len(restored.GetActiveRelays(snapshotTime+60)))
+
+	// and relays that are still online keep their entries with their next relay update
+
+	relays.relayManager = restored
+	relays.update(restoreTime, 20, 1, 1000)
+
+	assert.Equal(t, 3, len(restored.GetActiveRelays(restoreTime)))
+	assert.Equal(t, uint8(20), restored.GetCosts(restoreTime, relays.relayIds, 100, 100)[common.TriMatrixIndex(0, 1)])
+}
+
+func TestRelayManagerSnapshot_Invalid(t *testing.T) {
+
+	t.Parallel()
+
+	relayManager := common.CreateRelayManager(false)
+
+	currentTime := time.Now().Unix()
+
+	snapshot, err := relayManager.Snapshot(currentTime)
+	assert.Nil(t, err)
+
+	// too old
+
+	assert.NotNil(t, relayManager.Restore(snapshot, currentTime+61, 60))
+
+	// from the future
+
+	assert.NotNil(t, relayManager.Restore(snapshot, currentTime-1, 60))
+
+	// too small, or an unknown version
+
+	assert.NotNil(t, relayManager.Restore(snapshot[:4], currentTime, 60))
+
+	badVersion := append([]byte{}, snapshot...)
+	badVersion[0] = common.RelayManagerSnapshotVersion_Max + 1
+	assert.NotNil(t, relayManager.Restore(badVersion, currentTime, 60))
+
+	// corrupt
+
+	assert.NotNil(t, relayManager.Restore(snapshot[:len(snapshot)-4], currentTime, 60))
+
+	// an empty relay manager round trips
+
+	assert.Nil(t, relayManager.Restore(snapshot, currentTime, 60))
+	assert.Equal(t, 0, len(relayManager.SourceEntries))
+}
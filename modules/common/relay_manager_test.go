@@ -392,3 +392,219 @@ func TestRelayManager_Real(t *testing.T) {
 		assert.Equal(t, numActive, 2)
 	}
 }
+
+func TestRelayManager_Quality(t *testing.T) {
+
+	t.Parallel()
+
+	relayManager := common.CreateRelayManager(false)
+
+	relayNames := []string{"A", "B", "C"}
+
+	numRelays := len(relayNames)
+
+	relayIds := make([]uint64, numRelays)
+
+	relayAddresses := make([]net.UDPAddr, numRelays)
+
+	for i := range relayIds {
+		relayIds[i] = common.RelayId(relayNames[i])
+		relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+
+	counters := [constants.NumRelayCounters]uint64{}
+
+	currentTime := time.Now().Unix()
+
+	// relay A -> B has 3ms jitter and ~1% packet loss
+
+	{
+		sampleRelayId := [1]uint64{relayIds[1]}
+		sampleRTT := [1]uint8{10}
+		sampleJitter := [1]uint8{3}
+		samplePacketLoss := [1]uint16{655}
+		relayManager.ProcessRelayUpdate(currentTime, relayIds[0], relayNames[0], relayAddresses[0], 0, "test", 0, 1, sampleRelayId[:], sampleRTT[:], sampleJitter[:], samplePacketLoss[:], counters[:])
+	}
+
+	// relay B -> A has 5ms jitter and no packet loss
+
+	{
+		sampleRelayId := [1]uint64{relayIds[0]}
+		sampleRTT := [1]uint8{10}
+		sampleJitter := [1]uint8{5}
+		samplePacketLoss := [1]uint16{0}
+		relayManager.ProcessRelayUpdate(currentTime, relayIds[1], relayNames[1], relayAddresses[1], 0, "test", 0, 1, sampleRelayId[:], sampleRTT[:], sampleJitter[:], samplePacketLoss[:], counters[:])
+	}
+
+	costs, jitter, packetLoss := relayManager.GetCostsWithQuality(currentTime, relayIds, 100, 100)
+
+	assert.Equal(t, int(common.TriMatrixLength(numRelays)), len(costs))
+	assert.Equal(t, len(costs), len(jitter))
+	assert.Equal(t, len(costs), len(packetLoss))
+
+	// jitter and packet loss take the worst of both directions. packet loss is in tenths of a percent
+
+	index := common.TriMatrixIndex(0, 1)
+
+	assert.Equal(t, uint8(10), costs[index])
+	assert.Equal(t, uint8(5), jitter[index])
+	assert.Equal(t, uint8(10), packetLoss[index])
+
+	// unroutable entries have no jitter or packet loss
+
+	index = common.TriMatrixIndex(0, 2)
+
+	assert.Equal(t, uint8(255), costs[index])
+	assert.Equal(t, uint8(0), jitter[index])
+	assert.Equal(t, uint8(0), packetLoss[index])
+
+	// the cost matrix is the same as GetCosts
+
+	assert.Equal(t, relayManager.GetCosts(currentTime, relayIds, 100, 100), costs)
+}
+
+func TestRelayManager_DirectionalCosts(t *testing.T) {
+
+	t.Parallel()
+
+	relayManager := common.CreateRelayManager(false)
+
+	relayNames := []string{"A", "B", "C"}
+
+	numRelays := len(relayNames)
+
+	relayIds := make([]uint64, numRelays)
+
+	relayAddresses := make([]net.UDPAddr, numRelays)
+
+	for i := range relayIds {
+		relayIds[i] = common.RelayId(relayNames[i])
+		relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+
+	counters := [constants.NumRelayCounters]uint64{}
+
+	currentTime := time.Now().Unix()
+
+	// relay A sees 10ms to B, relay B sees 30ms to A
+
+	{
+		sampleRelayId := [1]uint64{relayIds[1]}
+		sampleRTT := [1]uint8{10}
+		sampleJitter := [1]uint8{0}
+		samplePacketLoss := [1]uint16{0}
+		relayManager.ProcessRelayUpdate(currentTime, relayIds[0], relayNames[0], relayAddresses[0], 0, "test", 0, 1, sampleRelayId[:], sampleRTT[:], sampleJitter[:], samplePacketLoss[:], counters[:])
+	}
+
+	{
+		sampleRelayId := [1]uint64{relayIds[0]}
+		sampleRTT := [1]uint8{30}
+		sampleJitter := [1]uint8{0}
+		samplePacketLoss := [1]uint16{0}
+		relayManager.ProcessRelayUpdate(currentTime, relayIds[1], relayNames[1], relayAddresses[1], 0, "test", 0, 1, sampleRelayId[:], sampleRTT[:], sampleJitter[:], samplePacketLoss[:], counters[:])
+	}
+
+	costs := relayManager.GetDirectionalCosts(currentTime, relayIds, 100, 100)
+
+	assert.Equal(t, core.SquareMatrixLength(numRelays), len(costs))
+
+	assert.Equal(t, uint8(10), costs[core.SquareMatrixIndex(numRelays, 0, 1)])
+	assert.Equal(t, uint8(30), costs[core.SquareMatrixIndex(numRelays, 1, 0)])
+
+	// relay C is not active, and relays never route to themselves
+
+	for i := 0; i < numRelays; i++ {
+		assert.Equal(t, uint8(255), costs[core.SquareMatrixIndex(numRelays, i, i)])
+		assert.Equal(t, uint8(255), costs[core.SquareMatrixIndex(numRelays, i, 2)])
+		assert.Equal(t, uint8(255), costs[core.SquareMatrixIndex(numRelays, 2, i)])
+	}
+
+	// the triangular cost matrix takes the worst of both directions
+
+	assert.Equal(t, uint8(30), relayManager.GetCosts(currentTime, relayIds, 100, 100)[common.TriMatrixIndex(0, 1)])
+}
+
+func TestRelayManager_GetRelaySessions(t *testing.T) {
+
+	t.Parallel()
+
+	relayManager := common.CreateRelayManager(false)
+
+	relayNames := []string{"A", "B", "C"}
+
+	numRelays := len(relayNames)
+
+	relayIds := make([]uint64, numRelays)
+
+	relayAddresses := make([]net.UDPAddr, numRelays)
+
+	for i := range relayIds {
+		relayIds[i] = common.RelayId(relayNames[i])
+		relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+
+	counters := [constants.NumRelayCounters]uint64{}
+
+	currentTime := time.Now().Unix()
+
+	// relay A has 100 sessions and relay B has 200 sessions. relay C never sends an update
+
+	relayManager.ProcessRelayUpdate(currentTime, relayIds[0], relayNames[0], relayAddresses[0], 100, "test", 0, 0, nil, nil, nil, nil, counters[:])
+	relayManager.ProcessRelayUpdate(currentTime, relayIds[1], relayNames[1], relayAddresses[1], 200, "test", 0, 0, nil, nil, nil, nil, counters[:])
+
+	assert.Equal(t, []int{100, 200, 0}, relayManager.GetRelaySessions(currentTime, relayIds))
+
+	// relays that are shutting down have no sessions
+
+	relayManager.ProcessRelayUpdate(currentTime, relayIds[1], relayNames[1], relayAddresses[1], 200, "test", constants.RelayFlags_ShuttingDown, 0, nil, nil, nil, nil, counters[:])
+
+	assert.Equal(t, []int{100, 0, 0}, relayManager.GetRelaySessions(currentTime, relayIds))
+
+	// relays that have timed out have no sessions
+
+	assert.Equal(t, []int{0, 0, 0}, relayManager.GetRelaySessions(currentTime+constants.RelayTimeout+1, relayIds))
+}
+
+func TestRelayManager_GetRelayBandwidth(t *testing.T) {
+
+	t.Parallel()
+
+	relayManager := common.CreateRelayManager(false)
+
+	relayNames := []string{"A", "B", "C"}
+
+	numRelays := len(relayNames)
+
+	relayIds := make([]uint64, numRelays)
+
+	relayAddresses := make([]net.UDPAddr, numRelays)
+
+	for i := range relayIds {
+		relayIds[i] = common.RelayId(relayNames[i])
+		relayAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 2000+i))
+	}
+
+	counters := [constants.NumRelayCounters]uint64{}
+
+	currentTime := time.Now().Unix()
+
+	// bandwidth is only recorded for relays that have sent an update
+
+	relayManager.SetRelayBandwidth(relayIds[2], 1000)
+
+	relayManager.ProcessRelayUpdate(currentTime, relayIds[0], relayNames[0], relayAddresses[0], 100, "test", 0, 0, nil, nil, nil, nil, counters[:])
+	relayManager.ProcessRelayUpdate(currentTime, relayIds[1], relayNames[1], relayAddresses[1], 200, "test", 0, 0, nil, nil, nil, nil, counters[:])
+
+	relayManager.SetRelayBandwidth(relayIds[0], 50000)
+	relayManager.SetRelayBandwidth(relayIds[1], 75000)
+
+	assert.Equal(t, []int{50000, 75000, 0}, relayManager.GetRelayBandwidth(currentTime, relayIds))
+
+	// relays that are shutting down or have timed out use no bandwidth
+
+	relayManager.ProcessRelayUpdate(currentTime, relayIds[1], relayNames[1], relayAddresses[1], 200, "test", constants.RelayFlags_ShuttingDown, 0, nil, nil, nil, nil, counters[:])
+
+	assert.Equal(t, []int{50000, 0, 0}, relayManager.GetRelayBandwidth(currentTime, relayIds))
+
+	assert.Equal(t, []int{0, 0, 0}, relayManager.GetRelayBandwidth(currentTime+constants.RelayTimeout+1, relayIds))
+}
@@ -0,0 +1,360 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/networknext/next/modules/core"
+)
+
+/*
+	Relay streams carry relay updates over a persistent TCP connection, instead of one HTTP POST per-update.
+
+	Each connection starts with a header of 4 magic bytes and a version byte, followed by a sequence of frames.
+	Each frame is a 4 byte little endian length followed by that many bytes of data.
+
+	Relay -> relay gateway frames contain the same encrypted relay update packet that the relay would POST
+	to the relay gateway /relay_update endpoint. Each frame is answered with a frame containing the relay update
+	response packet, encrypted with crypto box from the relay backend key pair to the relay public key and followed
+	by the nonce, because unlike the http response it is not protected by TLS. An empty response frame means the
+	relay update was rejected.
+
+	Relay gateway -> relay backend frames contain the same decrypted relay update that the relay gateway would
+	POST to the relay backend /relay_update endpoint. These frames are not answered. Because they are not
+	encrypted, relay backends only accept relay streams from clients that know the shared stream key: after the
+	header the server sends a random challenge, and the client must answer with HMAC-SHA256(key, challenge).
+*/
+
+const (
+	RelayStreamVersion       = 1
+	RelayStreamMaxFrameSize  = 256 * 1024
+	RelayStreamHeaderBytes   = 5
+	RelayStreamFrameOverhead = 4
+	RelayStreamChallengeSize = 32
+)
+
+var relayStreamMagic = [4]byte{'N', 'N', 'R', 'S'}
+
+func WriteRelayStreamHeader(writer io.Writer) error {
+	header := [RelayStreamHeaderBytes]byte{relayStreamMagic[0], relayStreamMagic[1], relayStreamMagic[2], relayStreamMagic[3], RelayStreamVersion}
+	_, err := writer.Write(header[:])
+	return err
+}
+
+func ReadRelayStreamHeader(reader io.Reader) error {
+	var header [RelayStreamHeaderBytes]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return fmt.Errorf("could not read relay stream header: %v", err)
+	}
+	if header[0] != relayStreamMagic[0] || header[1] != relayStreamMagic[1] || header[2] != relayStreamMagic[2] || header[3] != relayStreamMagic[3] {
+		return fmt.Errorf("not a relay stream")
+	}
+	if header[4] != RelayStreamVersion {
+		return fmt.Errorf("unsupported relay stream version: %d", header[4])
+	}
+	return nil
+}
+
+// WriteRelayStreamFrame writes the frame with a single write, so frames from different goroutines don't interleave as long as each write is serialized
+func WriteRelayStreamFrame(writer io.Writer, data []byte) error {
+	if len(data) > RelayStreamMaxFrameSize {
+		return fmt.Errorf("relay stream frame is too large: %d bytes", len(data))
+	}
+	frame := make([]byte, RelayStreamFrameOverhead+len(data))
+	binary.LittleEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[RelayStreamFrameOverhead:], data)
+	_, err := writer.Write(frame)
+	return err
+}
+
+// ReadRelayStreamFrame reads the next frame into buffer and returns the frame data, which is only valid until the next read
+func ReadRelayStreamFrame(reader io.Reader, buffer []byte) ([]byte, error) {
+	var length [RelayStreamFrameOverhead]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	frameBytes := int(binary.LittleEndian.Uint32(length[:]))
+	if frameBytes > len(buffer) {
+		return nil, fmt.Errorf("relay stream frame is too large: %d bytes", frameBytes)
+	}
+	if _, err := io.ReadFull(reader, buffer[:frameBytes]); err != nil {
+		return nil, err
+	}
+	return buffer[:frameBytes], nil
+}
+
+func relayStreamChallengeResponse(key []byte, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// ---------------------------------------------------
+
+type RelayStreamServerConfig struct {
+	Address         string
+	ReadTimeout     time.Duration // connections that don't send a frame for this long are closed
+	Reply           bool          // answer each frame with the frame returned by the frame handler
+	Key             []byte        // if set, clients must prove they know this key before any frames are accepted
+	MaxConnections  int           // new connections are closed straight away while this many are open. zero means no limit
+	AcceptedTimeout time.Duration // reply servers only. connections are closed unless the frame handler accepts a frame (returns a non-empty response) within this long of connecting
+}
+
+type RelayStreamServer struct {
+	config   RelayStreamServerConfig
+	listener net.Listener
+
+	mutex          sync.Mutex
+	numConnections int
+}
+
+// CreateRelayStreamServer listens for relay streams and calls the frame handler for each frame received. Each connection is handled on its own goroutine.
+func CreateRelayStreamServer(ctx context.Context, config RelayStreamServerConfig, frameHandler func(remoteAddress string, frame []byte) []byte) (*RelayStreamServer, error) {
+
+	lc := net.ListenConfig{}
+
+	listener, err := lc.Listen(ctx, "tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for relay streams on %s: %v", config.Address, err)
+	}
+
+	core.Log("started relay stream server on %s", listener.Addr().String())
+
+	server := &RelayStreamServer{config: config, listener: listener}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					core.Error("relay stream server failed to accept connection: %v", err)
+				}
+				return
+			}
+			server.mutex.Lock()
+			if server.config.MaxConnections > 0 && server.numConnections >= server.config.MaxConnections {
+				server.mutex.Unlock()
+				core.Warn("[%s] too many relay stream connections", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+			server.numConnections++
+			server.mutex.Unlock()
+			go server.handleConnection(conn, frameHandler)
+		}
+	}()
+
+	return server, nil
+}
+
+func (server *RelayStreamServer) Address() net.Addr {
+	return server.listener.Addr()
+}
+
+func (server *RelayStreamServer) NumConnections() int {
+	server.mutex.Lock()
+	numConnections := server.numConnections
+	server.mutex.Unlock()
+	return numConnections
+}
+
+func (server *RelayStreamServer) handleConnection(conn net.Conn, frameHandler func(remoteAddress string, frame []byte) []byte) {
+
+	remoteAddress := conn.RemoteAddr().String()
+
+	defer func() {
+		conn.Close()
+		server.mutex.Lock()
+		server.numConnections--
+		server.mutex.Unlock()
+	}()
+
+	// until a frame is accepted, the connection must not outlive the accepted timeout
+
+	accepted := !server.config.Reply || server.config.AcceptedTimeout <= 0
+	acceptedDeadline := time.Now().Add(server.config.AcceptedTimeout)
+
+	setReadDeadline := func() {
+		deadline := time.Time{}
+		if server.config.ReadTimeout > 0 {
+			deadline = time.Now().Add(server.config.ReadTimeout)
+		}
+		if !accepted && (deadline.IsZero() || acceptedDeadline.Before(deadline)) {
+			deadline = acceptedDeadline
+		}
+		conn.SetReadDeadline(deadline)
+	}
+
+	setReadDeadline()
+
+	if err := ReadRelayStreamHeader(conn); err != nil {
+		core.Error("[%s] %v", remoteAddress, err)
+		return
+	}
+
+	if len(server.config.Key) > 0 {
+		challenge := make([]byte, RelayStreamChallengeSize)
+		if _, err := rand.Read(challenge); err != nil {
+			core.Error("[%s] could not generate relay stream challenge: %v", remoteAddress, err)
+			return
+		}
+		if _, err := conn.Write(challenge); err != nil {
+			core.Debug("[%s] could not write relay stream challenge: %v", remoteAddress, err)
+			return
+		}
+		response := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			core.Debug("[%s] could not read relay stream challenge response: %v", remoteAddress, err)
+			return
+		}
+		if !hmac.Equal(response, relayStreamChallengeResponse(server.config.Key, challenge)) {
+			core.Error("[%s] relay stream failed authentication", remoteAddress)
+			return
+		}
+	}
+
+	core.Debug("[%s] relay stream connected", remoteAddress)
+
+	buffer := make([]byte, RelayStreamMaxFrameSize)
+
+	for {
+
+		setReadDeadline()
+
+		frame, err := ReadRelayStreamFrame(conn, buffer)
+		if err != nil {
+			if err != io.EOF {
+				core.Debug("[%s] relay stream closed: %v", remoteAddress, err)
+			}
+			return
+		}
+
+		response := frameHandler(remoteAddress, frame)
+
+		if server.config.Reply {
+			if err := WriteRelayStreamFrame(conn, response); err != nil {
+				core.Debug("[%s] could not write relay stream response: %v", remoteAddress, err)
+				return
+			}
+		}
+
+		if !accepted {
+			if len(response) > 0 {
+				accepted = true
+			} else if time.Now().After(acceptedDeadline) {
+				core.Debug("[%s] relay stream did not send an accepted frame in time", remoteAddress)
+				return
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------
+
+// RelayStreamClient keeps a relay stream open to a single address. It connects on first use, and reconnects on the next call after any error.
+type RelayStreamClient struct {
+	address string
+	key     []byte
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	buffer []byte
+}
+
+// CreateRelayStreamClient creates a client for the relay stream server at address. Pass the key if the server requires one, otherwise nil.
+func CreateRelayStreamClient(address string, key []byte, timeout time.Duration) *RelayStreamClient {
+	return &RelayStreamClient{address: address, key: key, timeout: timeout}
+}
+
+func (client *RelayStreamClient) connect() error {
+	if client.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", client.address, client.timeout)
+	if err != nil {
+		return fmt.Errorf("could not connect relay stream to %s: %v", client.address, err)
+	}
+	conn.SetDeadline(time.Now().Add(client.timeout))
+	if err := WriteRelayStreamHeader(conn); err != nil {
+		conn.Close()
+		return fmt.Errorf("could not write relay stream header to %s: %v", client.address, err)
+	}
+	if len(client.key) > 0 {
+		challenge := make([]byte, RelayStreamChallengeSize)
+		if _, err := io.ReadFull(conn, challenge); err != nil {
+			conn.Close()
+			return fmt.Errorf("could not read relay stream challenge from %s: %v", client.address, err)
+		}
+		if _, err := conn.Write(relayStreamChallengeResponse(client.key, challenge)); err != nil {
+			conn.Close()
+			return fmt.Errorf("could not write relay stream challenge response to %s: %v", client.address, err)
+		}
+	}
+	client.conn = conn
+	return nil
+}
+
+func (client *RelayStreamClient) disconnect() {
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+}
+
+// Send writes a frame that is not answered
+func (client *RelayStreamClient) Send(data []byte) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.connect(); err != nil {
+		return err
+	}
+	client.conn.SetWriteDeadline(time.Now().Add(client.timeout))
+	if err := WriteRelayStreamFrame(client.conn, data); err != nil {
+		client.disconnect()
+		return err
+	}
+	return nil
+}
+
+// Request writes a frame and waits for the response frame. The response is only valid until the next call.
+func (client *RelayStreamClient) Request(data []byte) ([]byte, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.connect(); err != nil {
+		return nil, err
+	}
+	client.conn.SetDeadline(time.Now().Add(client.timeout))
+	if err := WriteRelayStreamFrame(client.conn, data); err != nil {
+		client.disconnect()
+		return nil, err
+	}
+	if client.buffer == nil {
+		client.buffer = make([]byte, RelayStreamMaxFrameSize)
+	}
+	response, err := ReadRelayStreamFrame(client.conn, client.buffer)
+	if err != nil {
+		client.disconnect()
+		return nil, err
+	}
+	return response, nil
+}
+
+func (client *RelayStreamClient) Close() {
+	client.mutex.Lock()
+	client.disconnect()
+	client.mutex.Unlock()
+}
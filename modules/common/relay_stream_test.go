@@ -0,0 +1,285 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayStreamFrames(t *testing.T) {
+
+	t.Parallel()
+
+	var stream bytes.Buffer
+
+	assert.Nil(t, common.WriteRelayStreamHeader(&stream))
+	assert.Nil(t, common.WriteRelayStreamFrame(&stream, []byte("hello")))
+	assert.Nil(t, common.WriteRelayStreamFrame(&stream, []byte{}))
+	assert.Nil(t, common.WriteRelayStreamFrame(&stream, []byte("world")))
+
+	assert.Nil(t, common.ReadRelayStreamHeader(&stream))
+
+	buffer := make([]byte, 16)
+
+	frame, err := common.ReadRelayStreamFrame(&stream, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), frame)
+
+	frame, err = common.ReadRelayStreamFrame(&stream, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(frame))
+
+	frame, err = common.ReadRelayStreamFrame(&stream, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), frame)
+
+	// frames larger than the read buffer are rejected
+
+	assert.Nil(t, common.WriteRelayStreamFrame(&stream, make([]byte, 17)))
+	_, err = common.ReadRelayStreamFrame(&stream, buffer)
+	assert.NotNil(t, err)
+
+	// so are frames larger than the max frame size
+
+	assert.NotNil(t, common.WriteRelayStreamFrame(&stream, make([]byte, common.RelayStreamMaxFrameSize+1)))
+
+	// and streams that don't start with the header
+
+	assert.NotNil(t, common.ReadRelayStreamHeader(bytes.NewBufferString("GET / HTTP/1.1\r\n")))
+}
+
+func TestRelayStreamServer(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 16)
+
+	config := common.RelayStreamServerConfig{Address: "127.0.0.1:0", ReadTimeout: 10 * time.Second, Reply: true}
+
+	server, err := common.CreateRelayStreamServer(ctx, config, func(remoteAddress string, frame []byte) []byte {
+		received <- string(frame)
+		if string(frame) == "reject" {
+			return []byte{}
+		}
+		return append([]byte("re: "), frame...)
+	})
+	assert.Nil(t, err)
+
+	client := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer client.Close()
+
+	// many requests share the same connection
+
+	for i := 0; i < 10; i++ {
+		response, err := client.Request([]byte("update"))
+		assert.Nil(t, err)
+		assert.Equal(t, "re: update", string(response))
+		assert.Equal(t, "update", <-received)
+	}
+
+	assert.Equal(t, 1, server.NumConnections())
+
+	response, err := client.Request([]byte("reject"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(response))
+	<-received
+
+	// the client reconnects after the connection is lost
+
+	client.Close()
+
+	response, err = client.Request([]byte("again"))
+	assert.Nil(t, err)
+	assert.Equal(t, "re: again", string(response))
+}
+
+func TestRelayStreamServer_NoReply(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 16)
+
+	config := common.RelayStreamServerConfig{Address: "127.0.0.1:0", ReadTimeout: 10 * time.Second}
+
+	server, err := common.CreateRelayStreamServer(ctx, config, func(remoteAddress string, frame []byte) []byte {
+		received <- string(frame)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	client := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer client.Close()
+
+	assert.Nil(t, client.Send([]byte("a")))
+	assert.Nil(t, client.Send([]byte("b")))
+
+	assert.Equal(t, "a", <-received)
+	assert.Equal(t, "b", <-received)
+
+	// connections that don't speak the relay stream protocol are dropped
+
+	conn, err := net.Dial("tcp", server.Address().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestRelayStreamServer_Key(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 16)
+
+	key := []byte("relay stream key")
+
+	config := common.RelayStreamServerConfig{Address: "127.0.0.1:0", ReadTimeout: 10 * time.Second, Key: key}
+
+	server, err := common.CreateRelayStreamServer(ctx, config, func(remoteAddress string, frame []byte) []byte {
+		received <- string(frame)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// clients that know the key can send frames
+
+	client := common.CreateRelayStreamClient(server.Address().String(), key, 5*time.Second)
+	defer client.Close()
+
+	assert.Nil(t, client.Send([]byte("a")))
+	assert.Equal(t, "a", <-received)
+
+	// clients with the wrong key, or no key at all, are dropped before any frames are accepted
+
+	wrongKeyClient := common.CreateRelayStreamClient(server.Address().String(), []byte("wrong key"), 5*time.Second)
+	defer wrongKeyClient.Close()
+
+	noKeyClient := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer noKeyClient.Close()
+
+	wrongKeyClient.Send([]byte("b"))
+	noKeyClient.Send(make([]byte, 64))
+
+	assert.Nil(t, client.Send([]byte("c")))
+	assert.Equal(t, "c", <-received)
+
+	select {
+	case frame := <-received:
+		t.Fatalf("unexpected frame %q", frame)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRelayStreamServer_MaxConnections(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := common.RelayStreamServerConfig{Address: "127.0.0.1:0", ReadTimeout: 10 * time.Second, Reply: true, MaxConnections: 1}
+
+	server, err := common.CreateRelayStreamServer(ctx, config, func(remoteAddress string, frame []byte) []byte {
+		return frame
+	})
+	assert.Nil(t, err)
+
+	client := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer client.Close()
+
+	_, err = client.Request([]byte("a"))
+	assert.Nil(t, err)
+
+	// connections over the limit are closed
+
+	otherClient := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer otherClient.Close()
+
+	_, err = otherClient.Request([]byte("b"))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 1, server.NumConnections())
+
+	// once a connection closes, there is room for another
+
+	client.Close()
+
+	for i := 0; i < 100 && server.NumConnections() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = otherClient.Request([]byte("b"))
+	assert.Nil(t, err)
+}
+
+func TestRelayStreamServer_AcceptedTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := common.RelayStreamServerConfig{Address: "127.0.0.1:0", ReadTimeout: 10 * time.Second, Reply: true, AcceptedTimeout: 100 * time.Millisecond}
+
+	server, err := common.CreateRelayStreamServer(ctx, config, func(remoteAddress string, frame []byte) []byte {
+		if string(frame) == "reject" {
+			return []byte{}
+		}
+		return frame
+	})
+	assert.Nil(t, err)
+
+	// connections that don't send anything are closed
+
+	conn, err := net.Dial("tcp", server.Address().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, common.WriteRelayStreamHeader(conn))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// connections that only send rejected frames are closed
+
+	rejectedClient := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer rejectedClient.Close()
+
+	_, err = rejectedClient.Request([]byte("reject"))
+	assert.Nil(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = rejectedClient.Request([]byte("reject"))
+	assert.NotNil(t, err)
+
+	// connections with an accepted frame stay open past the timeout
+
+	client := common.CreateRelayStreamClient(server.Address().String(), nil, 5*time.Second)
+	defer client.Close()
+
+	_, err = client.Request([]byte("update"))
+	assert.Nil(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	response, err := client.Request([]byte("update"))
+	assert.Nil(t, err)
+	assert.Equal(t, "update", string(response))
+}
@@ -0,0 +1,327 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/networknext/next/modules/encoding"
+	"github.com/networknext/next/modules/messages"
+)
+
+/*
+	Relay update recordings let us reproduce relay backend bugs locally.
+
+	The relay gateway or relay backend can optionally record every decrypted relay update it receives to
+	rotating files in a local directory. The relay backend also records the stats for each route matrix it
+	builds, so a replay of the recording can be checked against what production actually did.
+
+	Each file starts with a version, followed by records of:
+
+		[uint8 record type][uint64 timestamp (microseconds)][uint32 data bytes][data]
+
+	Relay update records hold the relay update request packet, exactly as read by the relay backend.
+	Route matrix update records hold the analytics route matrix update message, encoded as json.
+*/
+
+const (
+	RelayUpdateRecordingVersion = 1
+
+	RelayUpdateRecordType_RelayUpdate       = 0
+	RelayUpdateRecordType_RouteMatrixUpdate = 1
+
+	RelayUpdateRecordingFilePrefix = "relay_updates_"
+	RelayUpdateRecordingFileSuffix = ".bin"
+
+	relayUpdateRecordHeaderBytes = 1 + 8 + 4
+	relayUpdateRecordMaxBytes    = 16 * 1024 * 1024
+)
+
+type RelayUpdateRecorderConfig struct {
+	Directory    string
+	MaxFileBytes int // start a new file once the current file is this big
+	MaxFiles     int // delete the oldest files once there are more than this. zero keeps all files
+}
+
+type RelayUpdateRecorder struct {
+	config    RelayUpdateRecorderConfig
+	mutex     sync.Mutex
+	file      *os.File
+	fileBytes int
+	fileTime  int64
+}
+
+type RelayUpdateRecord struct {
+	Type      uint8
+	Timestamp int64 // microseconds
+	Data      []byte
+}
+
+func CreateRelayUpdateRecorder(config RelayUpdateRecorderConfig) (*RelayUpdateRecorder, error) {
+	err := os.MkdirAll(config.Directory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create relay update recording directory: %v", err)
+	}
+	recorder := &RelayUpdateRecorder{config: config}
+	return recorder, nil
+}
+
+// ListRelayUpdateRecordingFiles returns the recording files in a directory, oldest first
+func ListRelayUpdateRecordingFiles(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for i := range entries {
+		name := entries[i].Name()
+		if !entries[i].IsDir() && strings.HasPrefix(name, RelayUpdateRecordingFilePrefix) && strings.HasSuffix(name, RelayUpdateRecordingFileSuffix) {
+			files = append(files, filepath.Join(directory, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (recorder *RelayUpdateRecorder) rotate(timestamp int64) error {
+
+	if recorder.file != nil {
+		recorder.file.Close()
+		recorder.file = nil
+	}
+
+	// IMPORTANT: file names sort by time, and must be unique even if we rotate more than once per-microsecond
+
+	if timestamp <= recorder.fileTime {
+		timestamp = recorder.fileTime + 1
+	}
+	recorder.fileTime = timestamp
+
+	filename := filepath.Join(recorder.config.Directory, fmt.Sprintf("%s%020d%s", RelayUpdateRecordingFilePrefix, timestamp, RelayUpdateRecordingFileSuffix))
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create relay update recording file: %v", err)
+	}
+
+	var header [4]byte
+	index := 0
+	encoding.WriteUint32(header[:], &index, RelayUpdateRecordingVersion)
+	_, err = file.Write(header[:])
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not write relay update recording header: %v", err)
+	}
+
+	recorder.file = file
+	recorder.fileBytes = len(header)
+
+	// delete the oldest files, so recordings don't fill up the disk
+
+	if recorder.config.MaxFiles > 0 {
+		files, err := ListRelayUpdateRecordingFiles(recorder.config.Directory)
+		if err == nil && len(files) > recorder.config.MaxFiles {
+			for i := 0; i < len(files)-recorder.config.MaxFiles; i++ {
+				os.Remove(files[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// Record appends a record to the current recording file, starting a new file when the current one is full. Safe to call from multiple goroutines
+func (recorder *RelayUpdateRecorder) Record(recordType uint8, timestamp int64, data []byte) error {
+
+	if len(data) > relayUpdateRecordMaxBytes {
+		return fmt.Errorf("relay update record is too large (%d bytes)", len(data))
+	}
+
+	record := make([]byte, relayUpdateRecordHeaderBytes+len(data))
+	index := 0
+	encoding.WriteUint8(record, &index, recordType)
+	encoding.WriteUint64(record, &index, uint64(timestamp))
+	encoding.WriteUint32(record, &index, uint32(len(data)))
+	copy(record[index:], data)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.file == nil || (recorder.config.MaxFileBytes > 0 && recorder.fileBytes+len(record) > recorder.config.MaxFileBytes) {
+		err := recorder.rotate(timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := recorder.file.Write(record)
+	if err != nil {
+		return fmt.Errorf("could not write relay update record: %v", err)
+	}
+
+	recorder.fileBytes += len(record)
+
+	return nil
+}
+
+// RecordRelayUpdate records a relay update request packet, as it was received
+func (recorder *RelayUpdateRecorder) RecordRelayUpdate(data []byte) error {
+	return recorder.Record(RelayUpdateRecordType_RelayUpdate, time.Now().UnixNano()/1000, data)
+}
+
+// RecordRouteMatrixUpdate records the stats for a route matrix, at the time in the message
+func (recorder *RelayUpdateRecorder) RecordRouteMatrixUpdate(message *messages.AnalyticsRouteMatrixUpdateMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("could not encode route matrix update: %v", err)
+	}
+	return recorder.Record(RelayUpdateRecordType_RouteMatrixUpdate, message.Timestamp, data)
+}
+
+func (recorder *RelayUpdateRecorder) Close() {
+	recorder.mutex.Lock()
+	if recorder.file != nil {
+		recorder.file.Close()
+		recorder.file = nil
+	}
+	recorder.mutex.Unlock()
+}
+
+// RouteMatrixUpdate decodes the stats in a route matrix update record
+func (record *RelayUpdateRecord) RouteMatrixUpdate() (*messages.AnalyticsRouteMatrixUpdateMessage, error) {
+	if record.Type != RelayUpdateRecordType_RouteMatrixUpdate {
+		return nil, fmt.Errorf("not a route matrix update record")
+	}
+	message := messages.AnalyticsRouteMatrixUpdateMessage{}
+	err := json.Unmarshal(record.Data, &message)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode route matrix update: %v", err)
+	}
+	return &message, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+type RelayUpdateRecordingReader struct {
+	files     []string
+	fileIndex int
+	file      *os.File
+	reader    *bufio.Reader
+}
+
+// OpenRelayUpdateRecording reads a single recording file, or all recording files in a directory, oldest first
+func OpenRelayUpdateRecording(path string) (*RelayUpdateRecordingReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files, err = ListRelayUpdateRecordingFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no relay update recordings in %s", path)
+		}
+	}
+	return &RelayUpdateRecordingReader{files: files, fileIndex: -1}, nil
+}
+
+func (reader *RelayUpdateRecordingReader) nextFile() error {
+
+	if reader.file != nil {
+		reader.file.Close()
+		reader.file = nil
+	}
+
+	reader.fileIndex++
+	if reader.fileIndex >= len(reader.files) {
+		return io.EOF
+	}
+
+	file, err := os.Open(reader.files[reader.fileIndex])
+	if err != nil {
+		return err
+	}
+
+	reader.file = file
+	reader.reader = bufio.NewReader(file)
+
+	var header [4]byte
+	_, err = io.ReadFull(reader.reader, header[:])
+	if err != nil {
+		return fmt.Errorf("could not read relay update recording header: %s", reader.files[reader.fileIndex])
+	}
+
+	index := 0
+	var version uint32
+	encoding.ReadUint32(header[:], &index, &version)
+	if version != RelayUpdateRecordingVersion {
+		return fmt.Errorf("unknown relay update recording version %d: %s", version, reader.files[reader.fileIndex])
+	}
+
+	return nil
+}
+
+// Next returns the next record, or io.EOF once all files have been read.
+// A partially written record at the end of a file (eg. the recorder was killed) ends that file.
+func (reader *RelayUpdateRecordingReader) Next() (*RelayUpdateRecord, error) {
+
+	for {
+
+		if reader.file == nil {
+			err := reader.nextFile()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var header [relayUpdateRecordHeaderBytes]byte
+		_, err := io.ReadFull(reader.reader, header[:])
+		if err != nil {
+			reader.file.Close()
+			reader.file = nil
+			continue
+		}
+
+		record := &RelayUpdateRecord{}
+
+		index := 0
+		var timestamp uint64
+		var numBytes uint32
+		encoding.ReadUint8(header[:], &index, &record.Type)
+		encoding.ReadUint64(header[:], &index, &timestamp)
+		encoding.ReadUint32(header[:], &index, &numBytes)
+
+		if numBytes > relayUpdateRecordMaxBytes {
+			return nil, fmt.Errorf("corrupt relay update record in %s", reader.files[reader.fileIndex])
+		}
+
+		record.Timestamp = int64(timestamp)
+		record.Data = make([]byte, numBytes)
+
+		_, err = io.ReadFull(reader.reader, record.Data)
+		if err != nil {
+			reader.file.Close()
+			reader.file = nil
+			continue
+		}
+
+		return record, nil
+	}
+}
+
+func (reader *RelayUpdateRecordingReader) Close() {
+	if reader.file != nil {
+		reader.file.Close()
+		reader.file = nil
+	}
+}
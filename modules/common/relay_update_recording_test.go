@@ -0,0 +1,154 @@
+package common_test
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRelayUpdateRecording(t *testing.T, config common.RelayUpdateRecorderConfig, numRecords int) []common.RelayUpdateRecord {
+
+	recorder, err := common.CreateRelayUpdateRecorder(config)
+	assert.Nil(t, err)
+
+	records := make([]common.RelayUpdateRecord, numRecords)
+
+	for i := range records {
+		if i%10 == 9 {
+			message := messages.AnalyticsRouteMatrixUpdateMessage{Timestamp: int64(1000 + i), NumRelays: int32(i), AverageNumRoutes: 1.5, CostEstimator: "test"}
+			assert.Nil(t, recorder.RecordRouteMatrixUpdate(&message))
+			records[i] = common.RelayUpdateRecord{Type: common.RelayUpdateRecordType_RouteMatrixUpdate, Timestamp: message.Timestamp}
+		} else {
+			data := make([]byte, 1+rand.Intn(200))
+			rand.Read(data)
+			assert.Nil(t, recorder.Record(common.RelayUpdateRecordType_RelayUpdate, int64(1000+i), data))
+			records[i] = common.RelayUpdateRecord{Type: common.RelayUpdateRecordType_RelayUpdate, Timestamp: int64(1000 + i), Data: data}
+		}
+	}
+
+	recorder.Close()
+
+	return records
+}
+
+func readRelayUpdateRecording(t *testing.T, path string) []*common.RelayUpdateRecord {
+	reader, err := common.OpenRelayUpdateRecording(path)
+	assert.Nil(t, err)
+	defer reader.Close()
+	records := []*common.RelayUpdateRecord{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		records = append(records, record)
+	}
+	return records
+}
+
+func checkRelayUpdateRecords(t *testing.T, expected []common.RelayUpdateRecord, actual []*common.RelayUpdateRecord) {
+	assert.Equal(t, len(expected), len(actual))
+	for i := range actual {
+		assert.Equal(t, expected[i].Type, actual[i].Type)
+		assert.Equal(t, expected[i].Timestamp, actual[i].Timestamp)
+		if actual[i].Type == common.RelayUpdateRecordType_RouteMatrixUpdate {
+			message, err := actual[i].RouteMatrixUpdate()
+			assert.Nil(t, err)
+			assert.Equal(t, expected[i].Timestamp, message.Timestamp)
+			assert.Equal(t, "test", message.CostEstimator)
+		} else {
+			assert.Equal(t, expected[i].Data, actual[i].Data)
+			_, err := actual[i].RouteMatrixUpdate()
+			assert.NotNil(t, err)
+		}
+	}
+}
+
+func TestRelayUpdateRecording(t *testing.T) {
+
+	t.Parallel()
+
+	directory := t.TempDir()
+
+	expected := writeRelayUpdateRecording(t, common.RelayUpdateRecorderConfig{Directory: directory, MaxFileBytes: 1000}, 100)
+
+	files, err := common.ListRelayUpdateRecordingFiles(directory)
+	assert.Nil(t, err)
+	assert.True(t, len(files) > 1)
+
+	// reading the directory gives back every record, in order
+
+	checkRelayUpdateRecords(t, expected, readRelayUpdateRecording(t, directory))
+
+	// reading a single file gives back just the records in that file
+
+	firstFile := readRelayUpdateRecording(t, files[0])
+	assert.True(t, len(firstFile) > 0)
+	checkRelayUpdateRecords(t, expected[:len(firstFile)], firstFile)
+}
+
+func TestRelayUpdateRecording_MaxFiles(t *testing.T) {
+
+	t.Parallel()
+
+	directory := t.TempDir()
+
+	expected := writeRelayUpdateRecording(t, common.RelayUpdateRecorderConfig{Directory: directory, MaxFileBytes: 1000, MaxFiles: 3}, 100)
+
+	files, err := common.ListRelayUpdateRecordingFiles(directory)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(files))
+
+	// only the most recent records are kept
+
+	records := readRelayUpdateRecording(t, directory)
+	assert.True(t, len(records) > 0)
+	assert.True(t, len(records) < len(expected))
+	checkRelayUpdateRecords(t, expected[len(expected)-len(records):], records)
+}
+
+func TestRelayUpdateRecording_Truncated(t *testing.T) {
+
+	t.Parallel()
+
+	directory := t.TempDir()
+
+	expected := writeRelayUpdateRecording(t, common.RelayUpdateRecorderConfig{Directory: directory}, 20)
+
+	files, err := common.ListRelayUpdateRecordingFiles(directory)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	// a partially written record at the end of the file is ignored
+
+	info, err := os.Stat(files[0])
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(files[0], info.Size()-1))
+
+	checkRelayUpdateRecords(t, expected[:len(expected)-1], readRelayUpdateRecording(t, directory))
+
+	// unknown versions are rejected
+
+	data, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	data[0] = 0xFF
+	assert.Nil(t, os.WriteFile(files[0], data, 0644))
+
+	reader, err := common.OpenRelayUpdateRecording(files[0])
+	assert.Nil(t, err)
+	_, err = reader.Next()
+	assert.NotNil(t, err)
+	reader.Close()
+
+	// empty directories can't be opened
+
+	_, err = common.OpenRelayUpdateRecording(t.TempDir())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,245 @@
+package common
+
+import (
+	"sync/atomic"
+
+	"github.com/networknext/next/modules/core"
+)
+
+/*
+	Relay sample validation catches relay to relay samples that can't be real.
+
+	Relays with bad clocks, or pings that are answered by a NAT instead of the other relay, can report RTTs
+	between datacenters that are faster than light could make the round trip. Other broken samples are so
+	much slower than going through a third relay that they wildly violate the triangle inequality.
+
+	Each route matrix interval every relay pair is checked against the round trip speed of light between
+	their datacenters, and against every two hop path through another relay. Violations are counted
+	per-relay and in the route matrix, and the offending relay pairs can optionally be left out of the
+	cost matrix.
+*/
+
+const (
+	relaySampleFlag_BelowSpeedOfLight = 1
+	relaySampleFlag_Triangle          = 2
+)
+
+type RelaySampleValidationConfig struct {
+	SpeedOfLightMargin        float32 // milliseconds. a relay pair is below the speed of light if RTT < round trip speed of light - SpeedOfLightMargin
+	TriangleFactor            float32 // a relay pair violates the triangle inequality if RTT > (RTT via another relay) * TriangleFactor + TriangleMargin
+	TriangleMargin            float32 // milliseconds
+	DiscardBelowSpeedOfLight  bool    // exclude relay pairs below the speed of light from the cost matrix
+	DiscardTriangleViolations bool    // exclude relay pairs that violate the triangle inequality from the cost matrix
+}
+
+func DefaultRelaySampleValidationConfig() RelaySampleValidationConfig {
+	return RelaySampleValidationConfig{
+		SpeedOfLightMargin:        1.0,
+		TriangleFactor:            3.0,
+		TriangleMargin:            10.0,
+		DiscardBelowSpeedOfLight:  true,
+		DiscardTriangleViolations: false,
+	}
+}
+
+type RelaySampleViolations struct {
+	BelowSpeedOfLight       int    `json:"below_speed_of_light"`       // relay pairs with this relay that were below the speed of light in the most recent validation
+	TriangleViolations      int    `json:"triangle_violations"`        // relay pairs with this relay that violated the triangle inequality in the most recent validation
+	TotalBelowSpeedOfLight  uint64 `json:"total_below_speed_of_light"` // since the relay came online
+	TotalTriangleViolations uint64 `json:"total_triangle_violations"`  // since the relay came online
+}
+
+type RelaySampleValidation struct {
+	NumRelayPairs      int // relay pairs with a sample that were checked
+	BelowSpeedOfLight  int // relay pairs below the speed of light
+	TriangleViolations int // relay pairs that violate the triangle inequality
+}
+
+type relayPair struct {
+	a uint64
+	b uint64
+}
+
+func makeRelayPair(a uint64, b uint64) relayPair {
+	if a > b {
+		a, b = b, a
+	}
+	return relayPair{a: a, b: b}
+}
+
+func (relayManager *RelayManager) SetSampleValidationConfig(config *RelaySampleValidationConfig) {
+	relayManager.mutex.Lock()
+	relayManager.sampleValidationConfig = config
+	relayManager.invalidSamples = nil
+	relayManager.mutex.Unlock()
+}
+
+// ValidateSamples checks the current sample for each pair of active relays against the speed of light and the triangle inequality.
+// Call it before GetCosts, so invalid relay pairs are discarded from this cost matrix. Does nothing if no sample validation config is set.
+// The triangle check is O(n^3), so it is split across numSegments goroutines, the same as the optimizer.
+func (relayManager *RelayManager) ValidateSamples(currentTime int64, numSegments int, relayIds []uint64, relayLatitudes []float32, relayLongitudes []float32) RelaySampleValidation {
+
+	result := RelaySampleValidation{}
+
+	numRelays := len(relayIds)
+
+	activeRelayMap := relayManager.GetActiveRelayMap(currentTime)
+
+	// grab the rtt for each relay pair, so we can do the O(n^3) triangle check without holding the lock
+
+	rtt := make([]float32, numRelays*numRelays)
+	for i := range rtt {
+		rtt[i] = -1
+	}
+
+	relayManager.mutex.RLock()
+
+	config := relayManager.sampleValidationConfig
+	if config == nil {
+		relayManager.mutex.RUnlock()
+		return result
+	}
+
+	for i := 0; i < numRelays; i++ {
+		if _, active := activeRelayMap[relayIds[i]]; !active {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if _, active := activeRelayMap[relayIds[j]]; !active {
+				continue
+			}
+			sample, _, _ := relayManager.getSample(relayIds[i], relayIds[j])
+			if sample < 255 {
+				rtt[i*numRelays+j] = sample
+				rtt[j*numRelays+i] = sample
+			}
+		}
+	}
+
+	relayManager.mutex.RUnlock()
+
+	// check each relay pair. each segment only writes flags for its own rows
+
+	flags := make([]uint8, numRelays*numRelays)
+
+	if numSegments < 1 {
+		numSegments = 1
+	}
+
+	var numRelayPairs, belowSpeedOfLight, triangleViolations int64
+
+	core.OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+
+		var segmentRelayPairs, segmentBelowSpeedOfLight, segmentTriangleViolations int64
+
+		for i := startIndex; i <= endIndex; i++ {
+
+			rowI := rtt[i*numRelays : (i+1)*numRelays]
+
+			for j := 0; j < i; j++ {
+
+				ij := rowI[j]
+				if ij < 0 {
+					continue
+				}
+
+				segmentRelayPairs++
+
+				speedOfLight := 2.0 * core.SpeedOfLightTimeMilliseconds_AB(float64(relayLatitudes[i]), float64(relayLongitudes[i]), float64(relayLatitudes[j]), float64(relayLongitudes[j]))
+				if float64(ij) < speedOfLight-float64(config.SpeedOfLightMargin) {
+					flags[i*numRelays+j] |= relaySampleFlag_BelowSpeedOfLight
+					segmentBelowSpeedOfLight++
+				}
+
+				// rtt is symmetric, so walk row j instead of column j to stay in cache
+
+				rowJ := rtt[j*numRelays : (j+1)*numRelays]
+
+				threshold := (ij - config.TriangleMargin) / config.TriangleFactor
+				for k := 0; k < numRelays; k++ {
+					ik := rowI[k]
+					kj := rowJ[k]
+					if k == i || k == j || ik < 0 || kj < 0 {
+						continue
+					}
+					if ik+kj < threshold {
+						flags[i*numRelays+j] |= relaySampleFlag_Triangle
+						segmentTriangleViolations++
+						break
+					}
+				}
+			}
+		}
+
+		atomic.AddInt64(&numRelayPairs, segmentRelayPairs)
+		atomic.AddInt64(&belowSpeedOfLight, segmentBelowSpeedOfLight)
+		atomic.AddInt64(&triangleViolations, segmentTriangleViolations)
+	})
+
+	result.NumRelayPairs = int(numRelayPairs)
+	result.BelowSpeedOfLight = int(belowSpeedOfLight)
+	result.TriangleViolations = int(triangleViolations)
+
+	// store invalid relay pairs and update per-relay counters
+
+	relayManager.mutex.Lock()
+
+	relayManager.invalidSamples = make(map[relayPair]uint8)
+
+	for _, sourceEntry := range relayManager.SourceEntries {
+		sourceEntry.SampleViolations.BelowSpeedOfLight = 0
+		sourceEntry.SampleViolations.TriangleViolations = 0
+	}
+
+	for i := 0; i < numRelays; i++ {
+		for j := 0; j < i; j++ {
+			flag := flags[i*numRelays+j]
+			if flag == 0 {
+				continue
+			}
+			relayManager.invalidSamples[makeRelayPair(relayIds[i], relayIds[j])] = flag
+			for _, relayId := range []uint64{relayIds[i], relayIds[j]} {
+				sourceEntry, exists := relayManager.SourceEntries[relayId]
+				if !exists {
+					continue
+				}
+				if (flag & relaySampleFlag_BelowSpeedOfLight) != 0 {
+					sourceEntry.SampleViolations.BelowSpeedOfLight++
+					sourceEntry.SampleViolations.TotalBelowSpeedOfLight++
+				}
+				if (flag & relaySampleFlag_Triangle) != 0 {
+					sourceEntry.SampleViolations.TriangleViolations++
+					sourceEntry.SampleViolations.TotalTriangleViolations++
+				}
+			}
+		}
+	}
+
+	relayManager.mutex.Unlock()
+
+	return result
+}
+
+// isInvalidSample must be called with the relay manager mutex held. Returns true if the relay pair should be left out of the cost matrix
+func (relayManager *RelayManager) isInvalidSample(sourceRelayId uint64, destRelayId uint64) bool {
+	config := relayManager.sampleValidationConfig
+	if config == nil || len(relayManager.invalidSamples) == 0 {
+		return false
+	}
+	flag := relayManager.invalidSamples[makeRelayPair(sourceRelayId, destRelayId)]
+	return (config.DiscardBelowSpeedOfLight && (flag&relaySampleFlag_BelowSpeedOfLight) != 0) || (config.DiscardTriangleViolations && (flag&relaySampleFlag_Triangle) != 0)
+}
+
+// GetRelaySampleViolations returns the sample violation counters for each relay. Relays that are not online have zero counters
+func (relayManager *RelayManager) GetRelaySampleViolations(relayIds []uint64) []RelaySampleViolations {
+	output := make([]RelaySampleViolations, len(relayIds))
+	relayManager.mutex.RLock()
+	for i := range relayIds {
+		sourceEntry, exists := relayManager.SourceEntries[relayIds[i]]
+		if exists {
+			output[i] = sourceEntry.SampleViolations
+		}
+	}
+	relayManager.mutex.RUnlock()
+	return output
+}
@@ -0,0 +1,178 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// relays A, B and C are roughly 1500km apart, so the round trip speed of light between A and the others is about 10ms
+var validationTestLatitudes = []float32{0, 0, 13.5}
+var validationTestLongitudes = []float32{0, 13.5, 0}
+
+// sendValidationTestSamples sends one relay update from every relay, with the rtt between each pair of relays taken from the matrix
+func sendValidationTestSamples(relays *anomalyTestRelays, currentTime int64, rtt [3][3]uint8) {
+	for i := range relays.relayIds {
+		sampleRelayId := make([]uint64, 0)
+		sampleRTT := make([]uint8, 0)
+		sampleJitter := make([]uint8, 0)
+		samplePacketLoss := make([]uint16, 0)
+		for j := range relays.relayIds {
+			if i == j {
+				continue
+			}
+			sampleRelayId = append(sampleRelayId, relays.relayIds[j])
+			sampleRTT = append(sampleRTT, rtt[i][j])
+			sampleJitter = append(sampleJitter, 0)
+			samplePacketLoss = append(samplePacketLoss, 0)
+		}
+		var counters [constants.NumRelayCounters]uint64
+		relays.relayManager.ProcessRelayUpdate(currentTime, relays.relayIds[i], relays.relayNames[i], relays.relayAddresses[i], 0, "test", 0, len(sampleRelayId), sampleRelayId, sampleRTT, sampleJitter, samplePacketLoss, counters[:])
+	}
+}
+
+func TestRelaySampleValidation_Disabled(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	currentTime := time.Now().Unix()
+
+	sendValidationTestSamples(relays, currentTime, [3][3]uint8{{0, 1, 1}, {1, 0, 20}, {1, 20, 0}})
+
+	validation := relays.relayManager.ValidateSamples(currentTime, 4, relays.relayIds, validationTestLatitudes, validationTestLongitudes)
+
+	assert.Equal(t, common.RelaySampleValidation{}, validation)
+
+	costs := relays.relayManager.GetCosts(currentTime, relays.relayIds, 100, 100)
+
+	assert.Equal(t, uint8(1), costs[core.TriMatrixIndex(1, 0)])
+	assert.Equal(t, uint8(1), costs[core.TriMatrixIndex(2, 0)])
+}
+
+func TestRelaySampleValidation_SpeedOfLight(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	config := common.DefaultRelaySampleValidationConfig()
+	relays.relayManager.SetSampleValidationConfig(&config)
+
+	currentTime := time.Now().Unix()
+
+	// plausible samples are left alone
+
+	sendValidationTestSamples(relays, currentTime, [3][3]uint8{{0, 20, 20}, {20, 0, 20}, {20, 20, 0}})
+
+	validation := relays.relayManager.ValidateSamples(currentTime, 4, relays.relayIds, validationTestLatitudes, validationTestLongitudes)
+
+	assert.Equal(t, 3, validation.NumRelayPairs)
+	assert.Equal(t, 0, validation.BelowSpeedOfLight)
+	assert.Equal(t, 0, validation.TriangleViolations)
+
+	// relay A reports 5ms to B and C, which is faster than light
+
+	currentTime++
+
+	sendValidationTestSamples(relays, currentTime, [3][3]uint8{{0, 5, 5}, {5, 0, 20}, {5, 20, 0}})
+
+	validation = relays.relayManager.ValidateSamples(currentTime, 4, relays.relayIds, validationTestLatitudes, validationTestLongitudes)
+
+	assert.Equal(t, 3, validation.NumRelayPairs)
+	assert.Equal(t, 2, validation.BelowSpeedOfLight)
+	assert.Equal(t, 0, validation.TriangleViolations)
+
+	violations := relays.relayManager.GetRelaySampleViolations(relays.relayIds)
+
+	assert.Equal(t, 2, violations[0].BelowSpeedOfLight)
+	assert.Equal(t, 1, violations[1].BelowSpeedOfLight)
+	assert.Equal(t, 1, violations[2].BelowSpeedOfLight)
+	assert.Equal(t, uint64(2), violations[0].TotalBelowSpeedOfLight)
+
+	// samples below the speed of light are discarded from costs
+
+	costs := relays.relayManager.GetCosts(currentTime, relays.relayIds, 100, 100)
+
+	assert.Equal(t, uint8(255), costs[core.TriMatrixIndex(1, 0)])
+	assert.Equal(t, uint8(255), costs[core.TriMatrixIndex(2, 0)])
+	assert.Equal(t, uint8(20), costs[core.TriMatrixIndex(2, 1)])
+
+	directionalCosts := relays.relayManager.GetDirectionalCosts(currentTime, relays.relayIds, 100, 100)
+
+	assert.Equal(t, uint8(255), directionalCosts[core.SquareMatrixIndex(3, 0, 1)])
+	assert.Equal(t, uint8(255), directionalCosts[core.SquareMatrixIndex(3, 1, 0)])
+	assert.Equal(t, uint8(20), directionalCosts[core.SquareMatrixIndex(3, 1, 2)])
+
+	// once the samples are plausible again, the relay pairs come back. total counters are kept
+
+	currentTime++
+
+	sendValidationTestSamples(relays, currentTime, [3][3]uint8{{0, 20, 20}, {20, 0, 20}, {20, 20, 0}})
+
+	validation = relays.relayManager.ValidateSamples(currentTime, 4, relays.relayIds, validationTestLatitudes, validationTestLongitudes)
+
+	assert.Equal(t, 0, validation.BelowSpeedOfLight)
+
+	violations = relays.relayManager.GetRelaySampleViolations(relays.relayIds)
+
+	assert.Equal(t, 0, violations[0].BelowSpeedOfLight)
+	assert.Equal(t, uint64(2), violations[0].TotalBelowSpeedOfLight)
+
+	costs = relays.relayManager.GetCosts(currentTime, relays.relayIds, 100, 100)
+
+	assert.Equal(t, uint8(20), costs[core.TriMatrixIndex(1, 0)])
+	assert.Equal(t, uint8(20), costs[core.TriMatrixIndex(2, 0)])
+}
+
+func TestRelaySampleValidation_Triangle(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	config := common.DefaultRelaySampleValidationConfig()
+	relays.relayManager.SetSampleValidationConfig(&config)
+
+	currentTime := time.Now().Unix()
+
+	// A -> B is 200ms, but A -> C -> B is only 40ms
+
+	sendValidationTestSamples(relays, currentTime, [3][3]uint8{{0, 200, 20}, {200, 0, 20}, {20, 20, 0}})
+
+	validation := relays.relayManager.ValidateSamples(currentTime, 4, relays.relayIds, validationTestLatitudes, validationTestLongitudes)
+
+	assert.Equal(t, 0, validation.BelowSpeedOfLight)
+	assert.Equal(t, 1, validation.TriangleViolations)
+
+	violations := relays.relayManager.GetRelaySampleViolations(relays.relayIds)
+
+	assert.Equal(t, 1, violations[0].TriangleViolations)
+	assert.Equal(t, 1, violations[1].TriangleViolations)
+	assert.Equal(t, 0, violations[2].TriangleViolations)
+
+	// triangle violations are only flagged by default
+
+	costs := relays.relayManager.GetCosts(currentTime, relays.relayIds, 100, 100)
+
+	assert.Equal(t, uint8(200), costs[core.TriMatrixIndex(1, 0)])
+
+	// but they can be discarded too
+
+	config.DiscardTriangleViolations = true
+	relays.relayManager.SetSampleValidationConfig(&config)
+
+	relays.relayManager.ValidateSamples(currentTime, 4, relays.relayIds, validationTestLatitudes, validationTestLongitudes)
+
+	costs = relays.relayManager.GetCosts(currentTime, relays.relayIds, 100, 100)
+
+	assert.Equal(t, uint8(255), costs[core.TriMatrixIndex(1, 0)])
+	assert.Equal(t, uint8(20), costs[core.TriMatrixIndex(2, 0)])
+	assert.Equal(t, uint8(20), costs[core.TriMatrixIndex(2, 1)])
+}
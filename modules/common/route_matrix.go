@@ -13,8 +13,8 @@ import (
 
 const (
 	RouteMatrixVersion_Min   = 3
-	RouteMatrixVersion_Max   = 4
-	RouteMatrixVersion_Write = 4
+	RouteMatrixVersion_Max   = 9
+	RouteMatrixVersion_Write = 9
 )
 
 type RouteMatrix struct {
@@ -40,6 +40,17 @@ type RouteMatrix struct {
 	Costs []byte
 
 	RelayPrice []byte
+
+	DirectionalCosts []byte  // optional. square matrix indexed by core.SquareMatrixIndex, where i -> j is the cost measured by relay i
+	DownstreamWeight float32 // how heavily the server -> client direction was weighted when optimizing directional costs
+
+	RelayHeadroom []byte // percentage of each relay's capacity that is still free [0,100]. nil for route matrices older than version 7
+
+	SpeedOfLightViolations uint32 // relay pairs with samples below the speed of light. zero for route matrices older than version 8
+	TriangleViolations     uint32 // relay pairs with samples that violate the triangle inequality. zero for route matrices older than version 8
+
+	Epoch           uint64 // increases with each route matrix published by any relay backend. zero for route matrices older than version 9
+	EpochGeneration uint64 // changes when the epoch counter is reset. epochs are only comparable within a generation
 }
 
 func (m *RouteMatrix) GetCostMatrix() *CostMatrix {
@@ -53,6 +64,7 @@ func (m *RouteMatrix) GetCostMatrix() *CostMatrix {
 	costMatrix.RelayDatacenterIds = m.RelayDatacenterIds
 	costMatrix.DestRelays = m.DestRelays
 	costMatrix.Costs = m.Costs
+	costMatrix.DirectionalCosts = m.DirectionalCosts
 	return costMatrix
 }
 
@@ -61,10 +73,14 @@ func (m *RouteMatrix) GetMaxSize() int {
 	numRelays := len(m.RelayIds)
 	size := 1024
 	size += numRelays * (8 + 19 + constants.MaxRelayNameLength + 4 + 4 + 8)
-	size += core.TriMatrixLength(numRelays) * (4 + 4 + 12*constants.MaxRoutesPerEntry + 4*constants.MaxRoutesPerEntry*constants.MaxRouteRelays)
+	size += core.TriMatrixLength(numRelays) * (4 + 4 + 14*constants.MaxRoutesPerEntry + 4*constants.MaxRoutesPerEntry*constants.MaxRouteRelays)
 	size += int(m.BinFileBytes)
 	size += core.TriMatrixLength(numRelays)
 	size += 4 + numRelays
+	size += 8 + core.SquareMatrixLength(numRelays)
+	size += numRelays
+	size += 8
+	size += 8
 	size -= size % 4
 	return size
 }
@@ -134,19 +150,7 @@ func (m *RouteMatrix) Serialize(stream encoding.Stream) error {
 	}
 
 	for i := uint32(0); i < numEntries; i++ {
-		entry := &m.RouteEntries[i]
-
-		stream.SerializeInteger(&entry.DirectCost, 0, constants.MaxRouteCost)
-		stream.SerializeInteger(&entry.NumRoutes, 0, constants.MaxRoutesPerEntry)
-
-		for i := 0; i < int(entry.NumRoutes); i++ {
-			stream.SerializeInteger(&entry.RouteCost[i], -1, constants.MaxRouteCost)
-			stream.SerializeInteger(&entry.RouteNumRelays[i], 0, constants.MaxRouteRelays)
-			stream.SerializeUint32(&entry.RouteHash[i])
-			for j := 0; j < int(entry.RouteNumRelays[i]); j++ {
-				stream.SerializeInteger(&entry.RouteRelays[i][j], 0, math.MaxInt32)
-			}
-		}
+		serializeRouteEntry(stream, &m.RouteEntries[i], m.Version)
 	}
 
 	if m.Version >= 2 {
@@ -168,9 +172,71 @@ func (m *RouteMatrix) Serialize(stream encoding.Stream) error {
 		stream.SerializeBytes(m.RelayPrice)
 	}
 
+	if m.Version >= 6 {
+		hasDirectionalCosts := len(m.DirectionalCosts) > 0
+		stream.SerializeBool(&hasDirectionalCosts)
+		if hasDirectionalCosts {
+			stream.SerializeFloat32(&m.DownstreamWeight)
+			if stream.IsReading() {
+				m.DirectionalCosts = make([]byte, core.SquareMatrixLength(int(numRelays)))
+			}
+			stream.SerializeBytes(m.DirectionalCosts)
+		}
+	}
+
+	if m.Version >= 7 {
+		if stream.IsReading() {
+			m.RelayHeadroom = make([]byte, numRelays)
+		}
+		if numRelays > 0 {
+			stream.SerializeBytes(m.RelayHeadroom)
+		}
+	}
+
+	if m.Version >= 8 {
+		stream.SerializeUint32(&m.SpeedOfLightViolations)
+		stream.SerializeUint32(&m.TriangleViolations)
+	}
+
+	if m.Version >= 9 {
+		stream.SerializeUint64(&m.Epoch)
+		stream.SerializeUint64(&m.EpochGeneration)
+	}
+
 	return stream.Error()
 }
 
+func serializeRouteEntry(stream encoding.Stream, entry *core.RouteEntry, version uint32) {
+
+	stream.SerializeInteger(&entry.DirectCost, 0, constants.MaxRouteCost)
+	stream.SerializeInteger(&entry.NumRoutes, 0, constants.MaxRoutesPerEntry)
+
+	for i := 0; i < int(entry.NumRoutes); i++ {
+		stream.SerializeInteger(&entry.RouteCost[i], -1, constants.MaxRouteCost)
+		stream.SerializeInteger(&entry.RouteNumRelays[i], 0, constants.MaxRouteRelays)
+		stream.SerializeUint32(&entry.RouteHash[i])
+		for j := 0; j < int(entry.RouteNumRelays[i]); j++ {
+			stream.SerializeInteger(&entry.RouteRelays[i][j], 0, math.MaxInt32)
+		}
+		if version >= 5 {
+			stream.SerializeInteger(&entry.RouteJitter[i], 0, constants.MaxRouteJitter)
+			stream.SerializeInteger(&entry.RoutePacketLoss[i], 0, constants.MaxRoutePacketLoss)
+		}
+	}
+}
+
+// IsOlderThan returns true if this route matrix was published before the other route matrix, so it must not replace it.
+// Route matrices without an epoch are never older, so we can still read route matrices from older relay backends.
+// Epochs from different generations can't be compared, so after the epoch counter is reset we accept the new generation.
+func (m *RouteMatrix) IsOlderThan(other *RouteMatrix) bool {
+	return other != nil && m.Epoch != 0 && !m.IsEpochReset(other) && m.Epoch < other.Epoch
+}
+
+// IsEpochReset returns true if this route matrix has an epoch from a different generation than the other route matrix
+func (m *RouteMatrix) IsEpochReset(other *RouteMatrix) bool {
+	return other != nil && m.Epoch != 0 && other.Epoch != 0 && m.EpochGeneration != other.EpochGeneration
+}
+
 func (m *RouteMatrix) Write() ([]byte, error) {
 	buffer := make([]byte, m.GetMaxSize())
 	ws := encoding.CreateWriteStream(buffer)
@@ -205,12 +271,17 @@ type RouteMatrixAnalysis struct {
 	RTTBucket_40_45ms       float32
 	RTTBucket_45_50ms       float32
 	RTTBucket_50ms_Plus     float32
+	SpeedOfLightViolations  int
+	TriangleViolations      int
 }
 
 func (m *RouteMatrix) Analyze() RouteMatrixAnalysis {
 
 	analysis := RouteMatrixAnalysis{}
 
+	analysis.SpeedOfLightViolations = int(m.SpeedOfLightViolations)
+	analysis.TriangleViolations = int(m.TriangleViolations)
+
 	src := m.RelayIds
 	dest := m.RelayIds
 
@@ -398,6 +469,8 @@ func GenerateRandomRouteMatrix(numRelays int) RouteMatrix {
 		for j := 0; j < int(routeMatrix.RouteEntries[i].NumRoutes); j++ {
 			routeMatrix.RouteEntries[i].RouteCost[j] = int32(RandomInt(0, constants.MaxRouteCost))
 			routeMatrix.RouteEntries[i].RouteNumRelays[j] = int32(RandomInt(1, constants.MaxRouteRelays))
+			routeMatrix.RouteEntries[i].RouteJitter[j] = int32(RandomInt(0, constants.MaxRouteJitter))
+			routeMatrix.RouteEntries[i].RoutePacketLoss[j] = int32(RandomInt(0, constants.MaxRoutePacketLoss))
 			for k := 0; k < int(routeMatrix.RouteEntries[i].RouteNumRelays[j]); k++ {
 				routeMatrix.RouteEntries[i].RouteRelays[j][k] = int32(k)
 			}
@@ -409,5 +482,20 @@ func GenerateRandomRouteMatrix(numRelays int) RouteMatrix {
 
 	routeMatrix.RelayPrice = make([]byte, numRelays)
 
+	routeMatrix.DirectionalCosts = make([]byte, core.SquareMatrixLength(numRelays))
+	RandomBytes(routeMatrix.DirectionalCosts)
+	routeMatrix.DownstreamWeight = rand.Float32()
+
+	routeMatrix.RelayHeadroom = make([]byte, numRelays)
+	for i := range routeMatrix.RelayHeadroom {
+		routeMatrix.RelayHeadroom[i] = byte(RandomInt(0, 100))
+	}
+
+	routeMatrix.SpeedOfLightViolations = uint32(RandomInt(0, 1000))
+	routeMatrix.TriangleViolations = uint32(RandomInt(0, 1000))
+
+	routeMatrix.Epoch = rand.Uint64()
+	routeMatrix.EpochGeneration = rand.Uint64()
+
 	return routeMatrix
 }
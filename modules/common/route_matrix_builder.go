@@ -0,0 +1,288 @@
+package common
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/networknext/next/modules/core"
+	"github.com/networknext/next/modules/messages"
+)
+
+/*
+	The route matrix builder turns the current relay manager state into a cost matrix and a route matrix.
+
+	It is used by the relay backend each route matrix interval, and by the relay update replay tool,
+	so a recording of relay updates can be turned into exactly the same route matrices offline.
+
+	The builder also tracks whether the relay manager has converged: once the number of active relays and
+	routable relay pairs has been stable for several route matrices in a row, the relay manager has heard
+	from every relay and the route matrix is worth publishing. Relay backends use this to hand over leadership.
+*/
+
+type RouteMatrixBuilderConfig struct {
+	MaxJitter                   float32
+	MaxPacketLoss               float32
+	EnableIncrementalOptimize   bool
+	EnableDirectionalCosts      bool // relays only measure RTT, so directional costs are noise until relays measure one-way latency. leave off
+	DirectionalDownstreamWeight float32
+	ConvergeRouteMatrices       int     // converged once this many route matrices in a row are stable. zero disables convergence tracking
+	ConvergeTolerance           float32 // stable while active relays and routable relay pairs stay within this fraction of their recent maximum
+}
+
+type RouteMatrixBuilder struct {
+	config    RouteMatrixBuilderConfig
+	optimizer core.Optimizer
+
+	convergeActiveRelays  []int
+	convergeRoutablePairs []int
+	converged             bool
+}
+
+type RouteMatrixUpdate struct {
+	RelaysCSVData    []byte
+	ActiveRelays     []Relay
+	CostMatrix       *CostMatrix
+	CostMatrixData   []byte
+	RouteMatrix      *RouteMatrix
+	RouteMatrixData  []byte
+	OptimizeDuration time.Duration
+	SampleValidation RelaySampleValidation
+}
+
+func CreateRouteMatrixBuilder(config RouteMatrixBuilderConfig) *RouteMatrixBuilder {
+	return &RouteMatrixBuilder{config: config}
+}
+
+// Optimizer gives access to the incremental optimizer, so callers can log how much work it did
+func (builder *RouteMatrixBuilder) Optimizer() *core.Optimizer {
+	return &builder.optimizer
+}
+
+// Converged returns true once the relay manager has converged. It stays true after that
+func (builder *RouteMatrixBuilder) Converged() bool {
+	return builder.converged
+}
+
+func withinTolerance(values []int, tolerance float32) bool {
+	minValue := values[0]
+	maxValue := values[0]
+	for i := range values {
+		if values[i] < minValue {
+			minValue = values[i]
+		}
+		if values[i] > maxValue {
+			maxValue = values[i]
+		}
+	}
+	return maxValue > 0 && float32(minValue) >= float32(maxValue)*(1.0-tolerance)
+}
+
+func (builder *RouteMatrixBuilder) updateConvergence(numActiveRelays int, costs []uint8) {
+
+	if builder.converged || builder.config.ConvergeRouteMatrices <= 0 {
+		return
+	}
+
+	numRoutablePairs := 0
+	for i := range costs {
+		if costs[i] != 255 {
+			numRoutablePairs++
+		}
+	}
+
+	builder.convergeActiveRelays = append(builder.convergeActiveRelays, numActiveRelays)
+	builder.convergeRoutablePairs = append(builder.convergeRoutablePairs, numRoutablePairs)
+
+	if len(builder.convergeActiveRelays) > builder.config.ConvergeRouteMatrices {
+		builder.convergeActiveRelays = builder.convergeActiveRelays[1:]
+		builder.convergeRoutablePairs = builder.convergeRoutablePairs[1:]
+	}
+
+	if len(builder.convergeActiveRelays) < builder.config.ConvergeRouteMatrices {
+		return
+	}
+
+	builder.converged = withinTolerance(builder.convergeActiveRelays, builder.config.ConvergeTolerance) && withinTolerance(builder.convergeRoutablePairs, builder.config.ConvergeTolerance)
+}
+
+// Build creates the cost matrix and route matrix for the relays in the database at the current time.
+// The epoch goes in the route matrix, so server backends never replace a route matrix with one published before it.
+func (builder *RouteMatrixBuilder) Build(currentTime int64, epoch uint64, epochGeneration uint64, relayData *RelayData, relayManager *RelayManager) (*RouteMatrixUpdate, error) {
+
+	timeStart := time.Now()
+
+	update := &RouteMatrixUpdate{}
+
+	// build relays csv
+
+	update.RelaysCSVData = relayManager.GetRelaysCSV(currentTime, relayData.RelayIds, relayData.RelayNames, relayData.RelayAddresses)
+
+	// build the cost matrix
+
+	update.ActiveRelays = relayManager.GetActiveRelays(currentTime)
+
+	// check samples against the speed of light and the triangle inequality first, so impossible samples can be discarded from costs
+
+	// the triangle check and the optimizer are both O(n^3), so they split relays into segments across goroutines
+
+	numCPUs := runtime.NumCPU()
+
+	numSegments := relayData.NumRelays
+	if numCPUs < relayData.NumRelays {
+		numSegments = relayData.NumRelays / 5
+		if numSegments == 0 {
+			numSegments = 1
+		}
+	}
+
+	update.SampleValidation = relayManager.ValidateSamples(currentTime, numSegments, relayData.RelayIds, relayData.RelayLatitudes, relayData.RelayLongitudes)
+
+	costs, jitter, packetLoss := relayManager.GetCostsWithQuality(currentTime, relayData.RelayIds, builder.config.MaxJitter, builder.config.MaxPacketLoss)
+
+	builder.updateConvergence(len(update.ActiveRelays), costs)
+
+	// relay price varies by seller peak hours and relay load, so the optimizer steers away from expensive relays
+
+	relaySessions := relayManager.GetRelaySessions(currentTime, relayData.RelayIds)
+
+	relayPrice := relayData.GetEffectiveRelayPrice(time.Unix(currentTime, 0).UTC().Hour(), relaySessions)
+
+	// relay headroom goes in the route matrix, so server backends can keep new sessions off relays that are nearly full
+
+	relayHeadroom := relayData.GetRelayHeadroom(relaySessions, relayManager.GetRelayBandwidth(currentTime, relayData.RelayIds))
+
+	// quarantined relays are already excluded from costs, but they must not be dest relays either
+
+	destRelays := relayManager.GetDestRelays(relayData.RelayIds, relayData.DestRelays)
+
+	// internet paths are often asymmetric, so optionally keep costs in each direction. both directions are RTT samples for now
+
+	var directionalCosts []uint8
+	if builder.config.EnableDirectionalCosts {
+		directionalCosts = relayManager.GetDirectionalCosts(currentTime, relayData.RelayIds, builder.config.MaxJitter, builder.config.MaxPacketLoss)
+	}
+
+	update.CostMatrix = &CostMatrix{
+		Version:            CostMatrixVersion_Write,
+		RelayIds:           relayData.RelayIds,
+		RelayAddresses:     relayData.RelayAddresses,
+		RelayNames:         relayData.RelayNames,
+		RelayLatitudes:     relayData.RelayLatitudes,
+		RelayLongitudes:    relayData.RelayLongitudes,
+		RelayDatacenterIds: relayData.RelayDatacenterIds,
+		DestRelays:         destRelays,
+		Costs:              costs,
+		RelayPrice:         relayPrice,
+		DirectionalCosts:   directionalCosts,
+	}
+
+	// write cost matrix data
+
+	var err error
+	update.CostMatrixData, err = update.CostMatrix.Write()
+	if err != nil {
+		return nil, fmt.Errorf("could not write cost matrix: %v", err)
+	}
+
+	// optimize
+
+	var routeEntries []core.RouteEntry
+	if builder.config.EnableDirectionalCosts {
+		routeEntries = core.OptimizeDirectional(relayData.NumRelays, numSegments, directionalCosts, jitter, packetLoss, relayPrice, relayData.RelayDatacenterIds, destRelays, builder.config.DirectionalDownstreamWeight)
+	} else if builder.config.EnableIncrementalOptimize {
+		routeEntries = builder.optimizer.Optimize(relayData.NumRelays, numSegments, costs, jitter, packetLoss, relayPrice, relayData.RelayDatacenterIds, destRelays)
+	} else {
+		routeEntries = core.Optimize3(relayData.NumRelays, numSegments, costs, jitter, packetLoss, relayPrice, relayData.RelayDatacenterIds, destRelays)
+	}
+
+	update.OptimizeDuration = time.Since(timeStart)
+
+	// create new route matrix
+
+	update.RouteMatrix = &RouteMatrix{
+		CreatedAt:          uint64(currentTime),
+		Version:            RouteMatrixVersion_Write,
+		RelayIds:           update.CostMatrix.RelayIds,
+		RelayAddresses:     update.CostMatrix.RelayAddresses,
+		RelayNames:         update.CostMatrix.RelayNames,
+		RelayLatitudes:     update.CostMatrix.RelayLatitudes,
+		RelayLongitudes:    update.CostMatrix.RelayLongitudes,
+		RelayDatacenterIds: update.CostMatrix.RelayDatacenterIds,
+		DestRelays:         update.CostMatrix.DestRelays,
+		RouteEntries:       routeEntries,
+		BinFileBytes:       int32(len(relayData.DatabaseBinFile)),
+		BinFileData:        relayData.DatabaseBinFile,
+		CostMatrixSize:     uint32(len(update.CostMatrixData)),
+		OptimizeTime:       uint32(update.OptimizeDuration.Milliseconds()),
+		Costs:              costs,
+		RelayPrice:         relayPrice,
+		RelayHeadroom:      relayHeadroom,
+
+		SpeedOfLightViolations: uint32(update.SampleValidation.BelowSpeedOfLight),
+		TriangleViolations:     uint32(update.SampleValidation.TriangleViolations),
+
+		Epoch:           epoch,
+		EpochGeneration: epochGeneration,
+	}
+
+	if builder.config.EnableDirectionalCosts {
+		update.RouteMatrix.DirectionalCosts = directionalCosts
+		update.RouteMatrix.DownstreamWeight = builder.config.DirectionalDownstreamWeight
+	}
+
+	// write route matrix data
+
+	update.RouteMatrixData, err = update.RouteMatrix.Write()
+	if err != nil {
+		return nil, fmt.Errorf("could not write route matrix: %v", err)
+	}
+
+	return update, nil
+}
+
+// AnalyticsMessage summarizes a route matrix update for analytics. timestamp is in microseconds
+func (update *RouteMatrixUpdate) AnalyticsMessage(timestamp int64, costEstimator string) *messages.AnalyticsRouteMatrixUpdateMessage {
+
+	analysis := update.RouteMatrix.Analyze()
+
+	numDestRelays := 0
+	for i := range update.RouteMatrix.DestRelays {
+		if update.RouteMatrix.DestRelays[i] {
+			numDestRelays++
+		}
+	}
+
+	message := messages.AnalyticsRouteMatrixUpdateMessage{}
+
+	message.Timestamp = timestamp
+	message.NumRelays = int32(len(update.RouteMatrix.RelayIds))
+	message.NumActiveRelays = int32(len(update.ActiveRelays))
+	message.NumDestRelays = int32(numDestRelays)
+	message.NumDatacenters = int32(len(update.RouteMatrix.RelayDatacenterIds))
+	message.TotalRoutes = int32(analysis.TotalRoutes)
+	message.AverageNumRoutes = analysis.AverageNumRoutes
+	message.AverageRouteLength = analysis.AverageRouteLength
+	message.NoRoutePercent = analysis.NoRoutePercent
+	message.OneRoutePercent = analysis.OneRoutePercent
+	message.NoDirectRoutePercent = analysis.NoDirectRoutePercent
+	message.RTTBucket_NoImprovement = analysis.RTTBucket_NoImprovement
+	message.RTTBucket_0_5ms = analysis.RTTBucket_0_5ms
+	message.RTTBucket_5_10ms = analysis.RTTBucket_5_10ms
+	message.RTTBucket_10_15ms = analysis.RTTBucket_10_15ms
+	message.RTTBucket_15_20ms = analysis.RTTBucket_15_20ms
+	message.RTTBucket_20_25ms = analysis.RTTBucket_20_25ms
+	message.RTTBucket_25_30ms = analysis.RTTBucket_25_30ms
+	message.RTTBucket_30_35ms = analysis.RTTBucket_30_35ms
+	message.RTTBucket_35_40ms = analysis.RTTBucket_35_40ms
+	message.RTTBucket_40_45ms = analysis.RTTBucket_40_45ms
+	message.RTTBucket_45_50ms = analysis.RTTBucket_45_50ms
+	message.RTTBucket_50ms_Plus = analysis.RTTBucket_50ms_Plus
+	message.CostMatrixSize = int32(len(update.CostMatrixData))
+	message.RouteMatrixSize = int32(len(update.RouteMatrixData))
+	message.DatabaseSize = update.RouteMatrix.BinFileBytes
+	message.OptimizeTime = int32(update.OptimizeDuration.Milliseconds())
+	message.CostEstimator = costEstimator
+
+	return &message
+}
@@ -0,0 +1,90 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	db "github.com/networknext/next/modules/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// builderTestRelayData creates relay data with relays A, B and C in the same places as the relay sample validation tests
+func builderTestRelayData(relays *anomalyTestRelays) *common.RelayData {
+	database := db.CreateDatabase()
+	seller := &db.Seller{Id: 1, Name: "seller", Code: "seller"}
+	for i := range relays.relayIds {
+		datacenter := &db.Datacenter{Id: uint64(i + 1), Name: relays.relayNames[i], Latitude: validationTestLatitudes[i], Longitude: validationTestLongitudes[i], SellerId: seller.Id}
+		database.DatacenterMap[datacenter.Id] = datacenter
+		database.Relays = append(database.Relays, db.Relay{Id: relays.relayIds[i], Name: relays.relayNames[i], DatacenterId: datacenter.Id, PublicAddress: relays.relayAddresses[i], MaxSessions: 1000, Seller: seller, Datacenter: datacenter})
+	}
+	database.SellerMap[seller.Id] = seller
+	return common.CreateRelayData(database)
+}
+
+func TestRouteMatrixBuilder_Converge(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	relayData := builderTestRelayData(relays)
+
+	builder := common.CreateRouteMatrixBuilder(common.RouteMatrixBuilderConfig{MaxJitter: 100, MaxPacketLoss: 100, ConvergeRouteMatrices: 3, ConvergeTolerance: 0.05})
+
+	currentTime := time.Now().Unix()
+
+	// no relays are online yet, so we can't have converged
+
+	for i := 0; i < 5; i++ {
+		update, err := builder.Build(currentTime, uint64(i+1), 1, relayData, relays.relayManager)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), update.RouteMatrix.Epoch)
+		assert.False(t, builder.Converged())
+	}
+
+	// once relays are online, we converge after enough stable route matrices
+
+	for i := 0; i < 3; i++ {
+		assert.False(t, builder.Converged())
+		relays.update(currentTime, 20, 1, 1000)
+		_, err := builder.Build(currentTime, uint64(10+i), 1, relayData, relays.relayManager)
+		assert.Nil(t, err)
+		currentTime++
+	}
+
+	assert.True(t, builder.Converged())
+}
+
+func TestRouteMatrixBuilder_SampleValidation(t *testing.T) {
+
+	t.Parallel()
+
+	relays := createAnomalyTestRelays(nil)
+
+	config := common.DefaultRelaySampleValidationConfig()
+	relays.relayManager.SetSampleValidationConfig(&config)
+
+	relayData := builderTestRelayData(relays)
+
+	builder := common.CreateRouteMatrixBuilder(common.RouteMatrixBuilderConfig{MaxJitter: 100, MaxPacketLoss: 100})
+
+	currentTime := time.Now().Unix()
+
+	// relay A reports 5ms to B and C, which is faster than light. the violations end up in the route matrix
+
+	sendValidationTestSamples(relays, currentTime, [3][3]uint8{{0, 5, 5}, {5, 0, 20}, {5, 20, 0}})
+
+	update, err := builder.Build(currentTime, 1, 1, relayData, relays.relayManager)
+	assert.Nil(t, err)
+
+	routeMatrix := common.RouteMatrix{}
+	assert.Nil(t, routeMatrix.Read(update.RouteMatrixData))
+
+	analysis := routeMatrix.Analyze()
+
+	assert.Equal(t, 2, analysis.SpeedOfLightViolations)
+	assert.Equal(t, 0, analysis.TriangleViolations)
+	assert.False(t, builder.Converged())
+}
@@ -0,0 +1,518 @@
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+	"github.com/networknext/next/modules/encoding"
+)
+
+/*
+	Route matrix deltas let server backends update their route matrix without downloading the whole thing each time.
+
+	Each route matrix is identified by the hash of its serialized data. A delta takes a server backend from the
+	route matrix with the base hash to the route matrix with the target hash. It contains the changed relays,
+	route entries, costs and relay prices, and the database bin file only if it has changed.
+
+	Deltas can only be made between route matrices with the same number of relays. When the relays change,
+	or the server backend has a route matrix the relay backend no longer knows about, the server backend
+	falls back to downloading the full route matrix.
+*/
+
+const (
+	RouteMatrixDeltaVersion_Min   = 1 // the minimum version we can read
+	RouteMatrixDeltaVersion_Max   = 1 // the maximum version we can read
+	RouteMatrixDeltaVersion_Write = 1 // the version we write
+)
+
+func RouteMatrixHash(routeMatrixData []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(routeMatrixData)
+	return hash.Sum64()
+}
+
+type RouteMatrixRelayDelta struct {
+	Index        uint32
+	RelayId      uint64
+	Address      net.UDPAddr
+	Name         string
+	Latitude     float32
+	Longitude    float32
+	DatacenterId uint64
+	DestRelay    bool
+}
+
+type RouteMatrixByteDelta struct {
+	Index uint32
+	Value uint8
+}
+
+type RouteMatrixDelta struct {
+	Version    uint32
+	BaseHash   uint64
+	TargetHash uint64
+
+	RouteMatrixVersion uint32
+	CreatedAt          uint64
+	CostMatrixSize     uint32
+	OptimizeTime       uint32
+	NumRelays          uint32
+
+	BinFileChanged bool
+	BinFileBytes   int32
+	BinFileData    []byte
+
+	Relays []RouteMatrixRelayDelta
+
+	RouteEntryIndex []uint32
+	RouteEntries    []core.RouteEntry
+
+	Costs      []RouteMatrixByteDelta
+	RelayPrice []RouteMatrixByteDelta
+
+	HasDirectionalCosts bool
+	DownstreamWeight    float32
+	DirectionalCosts    []RouteMatrixByteDelta
+
+	RelayHeadroom []RouteMatrixByteDelta // only for route matrix version 7 and later
+
+	SpeedOfLightViolations uint32 // only for route matrix version 8 and later
+	TriangleViolations     uint32 // only for route matrix version 8 and later
+
+	Epoch           uint64 // only for route matrix version 9 and later
+	EpochGeneration uint64 // only for route matrix version 9 and later
+}
+
+func diffBytes(base []byte, target []byte) []RouteMatrixByteDelta {
+	changes := make([]RouteMatrixByteDelta, 0)
+	for i := range target {
+		if i >= len(base) || base[i] != target[i] {
+			changes = append(changes, RouteMatrixByteDelta{Index: uint32(i), Value: target[i]})
+		}
+	}
+	return changes
+}
+
+func applyBytes(base []byte, size int, changes []RouteMatrixByteDelta) ([]byte, error) {
+	output := make([]byte, size)
+	copy(output, base)
+	for i := range changes {
+		if int(changes[i].Index) >= size {
+			return nil, fmt.Errorf("route matrix delta byte index out of range: %d", changes[i].Index)
+		}
+		output[changes[i].Index] = changes[i].Value
+	}
+	return output, nil
+}
+
+// CreateRouteMatrixDelta returns the delta that takes the base route matrix to the target route matrix. Both must have been read from their serialized data, with the hashes of that data.
+func CreateRouteMatrixDelta(base *RouteMatrix, baseHash uint64, target *RouteMatrix, targetHash uint64) (*RouteMatrixDelta, error) {
+
+	numRelays := len(target.RelayIds)
+
+	if len(base.RelayIds) != numRelays {
+		return nil, fmt.Errorf("can't create route matrix delta when the number of relays changes (%d -> %d)", len(base.RelayIds), numRelays)
+	}
+
+	if len(base.RouteEntries) != len(target.RouteEntries) {
+		return nil, fmt.Errorf("can't create route matrix delta when the number of route entries changes (%d -> %d)", len(base.RouteEntries), len(target.RouteEntries))
+	}
+
+	delta := &RouteMatrixDelta{
+		Version:            RouteMatrixDeltaVersion_Write,
+		BaseHash:           baseHash,
+		TargetHash:         targetHash,
+		RouteMatrixVersion: target.Version,
+		CreatedAt:          target.CreatedAt,
+		CostMatrixSize:     target.CostMatrixSize,
+		OptimizeTime:       target.OptimizeTime,
+		NumRelays:          uint32(numRelays),
+
+		SpeedOfLightViolations: target.SpeedOfLightViolations,
+		TriangleViolations:     target.TriangleViolations,
+
+		Epoch:           target.Epoch,
+		EpochGeneration: target.EpochGeneration,
+	}
+
+	// the database bin file only changes when the database is updated, so only send it when it changes
+
+	if base.BinFileBytes != target.BinFileBytes || string(base.BinFileData[:base.BinFileBytes]) != string(target.BinFileData[:target.BinFileBytes]) {
+		delta.BinFileChanged = true
+		delta.BinFileBytes = target.BinFileBytes
+		delta.BinFileData = target.BinFileData[:target.BinFileBytes]
+	}
+
+	// changed relays
+
+	delta.Relays = make([]RouteMatrixRelayDelta, 0)
+
+	for i := 0; i < numRelays; i++ {
+		if base.RelayIds[i] != target.RelayIds[i] ||
+			base.RelayAddresses[i].String() != target.RelayAddresses[i].String() ||
+			base.RelayNames[i] != target.RelayNames[i] ||
+			base.RelayLatitudes[i] != target.RelayLatitudes[i] ||
+			base.RelayLongitudes[i] != target.RelayLongitudes[i] ||
+			base.RelayDatacenterIds[i] != target.RelayDatacenterIds[i] ||
+			base.DestRelays[i] != target.DestRelays[i] {
+			delta.Relays = append(delta.Relays, RouteMatrixRelayDelta{
+				Index:        uint32(i),
+				RelayId:      target.RelayIds[i],
+				Address:      target.RelayAddresses[i],
+				Name:         target.RelayNames[i],
+				Latitude:     target.RelayLatitudes[i],
+				Longitude:    target.RelayLongitudes[i],
+				DatacenterId: target.RelayDatacenterIds[i],
+				DestRelay:    target.DestRelays[i],
+			})
+		}
+	}
+
+	// changed route entries
+
+	delta.RouteEntryIndex = make([]uint32, 0)
+	delta.RouteEntries = make([]core.RouteEntry, 0)
+
+	for i := range target.RouteEntries {
+		if base.RouteEntries[i] != target.RouteEntries[i] {
+			delta.RouteEntryIndex = append(delta.RouteEntryIndex, uint32(i))
+			delta.RouteEntries = append(delta.RouteEntries, target.RouteEntries[i])
+		}
+	}
+
+	// changed costs and relay prices
+
+	delta.Costs = diffBytes(base.Costs, target.Costs)
+	delta.RelayPrice = diffBytes(base.RelayPrice, target.RelayPrice)
+
+	delta.DirectionalCosts = make([]RouteMatrixByteDelta, 0)
+	if len(target.DirectionalCosts) > 0 {
+		delta.HasDirectionalCosts = true
+		delta.DownstreamWeight = target.DownstreamWeight
+		delta.DirectionalCosts = diffBytes(base.DirectionalCosts, target.DirectionalCosts)
+	}
+
+	delta.RelayHeadroom = diffBytes(base.RelayHeadroom, target.RelayHeadroom)
+
+	return delta, nil
+}
+
+// Apply returns a new route matrix with the delta applied to the base route matrix. The base route matrix is not modified.
+// Fails if the result does not hash to the target hash, so callers can fall back to the full route matrix.
+func (delta *RouteMatrixDelta) Apply(base *RouteMatrix, baseHash uint64) (*RouteMatrix, error) {
+
+	if baseHash != delta.BaseHash {
+		return nil, fmt.Errorf("route matrix delta is for base %016x, but we have %016x", delta.BaseHash, baseHash)
+	}
+
+	numRelays := int(delta.NumRelays)
+
+	if len(base.RelayIds) != numRelays {
+		return nil, fmt.Errorf("route matrix delta is for %d relays, but we have %d", numRelays, len(base.RelayIds))
+	}
+
+	numEntries := core.TriMatrixLength(numRelays)
+
+	if len(base.RouteEntries) != numEntries {
+		return nil, fmt.Errorf("route matrix delta is for %d route entries, but we have %d", numEntries, len(base.RouteEntries))
+	}
+
+	routeMatrix := &RouteMatrix{
+		Version:        delta.RouteMatrixVersion,
+		CreatedAt:      delta.CreatedAt,
+		BinFileBytes:   base.BinFileBytes,
+		BinFileData:    base.BinFileData,
+		CostMatrixSize: delta.CostMatrixSize,
+		OptimizeTime:   delta.OptimizeTime,
+
+		SpeedOfLightViolations: delta.SpeedOfLightViolations,
+		TriangleViolations:     delta.TriangleViolations,
+
+		Epoch:           delta.Epoch,
+		EpochGeneration: delta.EpochGeneration,
+	}
+
+	if delta.BinFileChanged {
+		routeMatrix.BinFileBytes = delta.BinFileBytes
+		routeMatrix.BinFileData = delta.BinFileData
+	}
+
+	// relays
+
+	routeMatrix.RelayIds = append([]uint64{}, base.RelayIds...)
+	routeMatrix.RelayAddresses = append([]net.UDPAddr{}, base.RelayAddresses...)
+	routeMatrix.RelayNames = append([]string{}, base.RelayNames...)
+	routeMatrix.RelayLatitudes = append([]float32{}, base.RelayLatitudes...)
+	routeMatrix.RelayLongitudes = append([]float32{}, base.RelayLongitudes...)
+	routeMatrix.RelayDatacenterIds = append([]uint64{}, base.RelayDatacenterIds...)
+	routeMatrix.DestRelays = append([]bool{}, base.DestRelays...)
+
+	for i := range delta.Relays {
+		relay := &delta.Relays[i]
+		index := int(relay.Index)
+		if index >= numRelays {
+			return nil, fmt.Errorf("route matrix delta relay index out of range: %d", index)
+		}
+		routeMatrix.RelayIds[index] = relay.RelayId
+		routeMatrix.RelayAddresses[index] = relay.Address
+		routeMatrix.RelayNames[index] = relay.Name
+		routeMatrix.RelayLatitudes[index] = relay.Latitude
+		routeMatrix.RelayLongitudes[index] = relay.Longitude
+		routeMatrix.RelayDatacenterIds[index] = relay.DatacenterId
+		routeMatrix.DestRelays[index] = relay.DestRelay
+	}
+
+	routeMatrix.RelayIdToIndex = make(map[uint64]int32, numRelays)
+	for i := range routeMatrix.RelayIds {
+		routeMatrix.RelayIdToIndex[routeMatrix.RelayIds[i]] = int32(i)
+	}
+
+	// route entries
+
+	if len(delta.RouteEntryIndex) != len(delta.RouteEntries) {
+		return nil, fmt.Errorf("route matrix delta has %d route entry indices, but %d route entries", len(delta.RouteEntryIndex), len(delta.RouteEntries))
+	}
+
+	routeMatrix.RouteEntries = make([]core.RouteEntry, numEntries)
+	copy(routeMatrix.RouteEntries, base.RouteEntries)
+
+	for i := range delta.RouteEntryIndex {
+		index := int(delta.RouteEntryIndex[i])
+		if index >= numEntries {
+			return nil, fmt.Errorf("route matrix delta route entry index out of range: %d", index)
+		}
+		routeMatrix.RouteEntries[index] = delta.RouteEntries[i]
+	}
+
+	// costs and relay prices
+
+	var err error
+
+	routeMatrix.Costs, err = applyBytes(base.Costs, numEntries, delta.Costs)
+	if err != nil {
+		return nil, err
+	}
+
+	routeMatrix.RelayPrice, err = applyBytes(base.RelayPrice, numRelays, delta.RelayPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	if delta.HasDirectionalCosts {
+		routeMatrix.DownstreamWeight = delta.DownstreamWeight
+		routeMatrix.DirectionalCosts, err = applyBytes(base.DirectionalCosts, core.SquareMatrixLength(numRelays), delta.DirectionalCosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if delta.RouteMatrixVersion >= 7 {
+		routeMatrix.RelayHeadroom, err = applyBytes(base.RelayHeadroom, numRelays, delta.RelayHeadroom)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// IMPORTANT: don't trust the target hash in the delta. hash the route matrix we ended up with, the same way full route matrices are hashed
+
+	routeMatrixData, err := routeMatrix.Write()
+	if err != nil {
+		return nil, err
+	}
+
+	if hash := RouteMatrixHash(routeMatrixData); hash != delta.TargetHash {
+		return nil, fmt.Errorf("route matrix delta result has hash %016x, but the delta target is %016x", hash, delta.TargetHash)
+	}
+
+	return routeMatrix, nil
+}
+
+func (delta *RouteMatrixDelta) GetMaxSize() int {
+	// IMPORTANT: This must be an upper bound *and* a multiple of 4
+	size := 1024
+	size += int(delta.BinFileBytes)
+	size += len(delta.Relays) * (4 + 8 + 19 + constants.MaxRelayNameLength + 4 + 4 + 8 + 1)
+	size += len(delta.RouteEntries) * (4 + 4 + 4 + 14*constants.MaxRoutesPerEntry + 4*constants.MaxRoutesPerEntry*constants.MaxRouteRelays)
+	size += (len(delta.Costs) + len(delta.RelayPrice) + len(delta.DirectionalCosts) + len(delta.RelayHeadroom)) * (4 + 1)
+	size -= size % 4
+	return size
+}
+
+func serializeByteDeltas(stream encoding.Stream, changes *[]RouteMatrixByteDelta, maxChanges int) error {
+	numChanges := uint32(len(*changes))
+	stream.SerializeUint32(&numChanges)
+	if stream.IsReading() {
+		if int(numChanges) > maxChanges || stream.Error() != nil {
+			return fmt.Errorf("invalid number of byte changes in route matrix delta: %d", numChanges)
+		}
+		*changes = make([]RouteMatrixByteDelta, 0)
+	}
+	for i := 0; i < int(numChanges) && stream.Error() == nil; i++ {
+		change := RouteMatrixByteDelta{}
+		if stream.IsWriting() {
+			change = (*changes)[i]
+		}
+		value := uint32(change.Value)
+		stream.SerializeUint32(&change.Index)
+		stream.SerializeBits(&value, 8)
+		if stream.IsReading() {
+			change.Value = uint8(value)
+			*changes = append(*changes, change)
+		}
+	}
+	return nil
+}
+
+func (delta *RouteMatrixDelta) Serialize(stream encoding.Stream) error {
+
+	if stream.IsWriting() && (delta.Version < RouteMatrixDeltaVersion_Min || delta.Version > RouteMatrixDeltaVersion_Max) {
+		panic(fmt.Errorf("invalid route matrix delta version: %d", delta.Version))
+	}
+
+	stream.SerializeUint32(&delta.Version)
+
+	if stream.IsReading() && (delta.Version < RouteMatrixDeltaVersion_Min || delta.Version > RouteMatrixDeltaVersion_Max) {
+		return fmt.Errorf("invalid route matrix delta version: %d", delta.Version)
+	}
+
+	stream.SerializeUint64(&delta.BaseHash)
+	stream.SerializeUint64(&delta.TargetHash)
+
+	stream.SerializeUint32(&delta.RouteMatrixVersion)
+	stream.SerializeUint64(&delta.CreatedAt)
+	stream.SerializeUint32(&delta.CostMatrixSize)
+	stream.SerializeUint32(&delta.OptimizeTime)
+	stream.SerializeUint32(&delta.NumRelays)
+
+	if stream.IsReading() && (delta.RouteMatrixVersion < RouteMatrixVersion_Min || delta.RouteMatrixVersion > RouteMatrixVersion_Max) {
+		return fmt.Errorf("invalid route matrix version in delta: %d", delta.RouteMatrixVersion)
+	}
+
+	if stream.IsReading() && delta.NumRelays > constants.MaxRelays {
+		return fmt.Errorf("too many relays in route matrix delta: %d", delta.NumRelays)
+	}
+
+	numRelays := int(delta.NumRelays)
+	numEntries := core.TriMatrixLength(numRelays)
+
+	// database bin file
+
+	stream.SerializeBool(&delta.BinFileChanged)
+	if delta.BinFileChanged {
+		stream.SerializeInteger(&delta.BinFileBytes, 0, constants.MaxDatabaseSize)
+		if stream.IsReading() {
+			if stream.Error() != nil {
+				return stream.Error()
+			}
+			delta.BinFileData = make([]byte, delta.BinFileBytes)
+		}
+		stream.SerializeBytes(delta.BinFileData[:delta.BinFileBytes])
+	}
+
+	// relays
+
+	numRelayChanges := uint32(len(delta.Relays))
+	stream.SerializeUint32(&numRelayChanges)
+	if stream.IsReading() {
+		if int(numRelayChanges) > numRelays || stream.Error() != nil {
+			return fmt.Errorf("invalid number of relay changes in route matrix delta: %d", numRelayChanges)
+		}
+		delta.Relays = make([]RouteMatrixRelayDelta, 0)
+	}
+
+	// when reading, changes are appended as they are read, so a corrupt count can't make us allocate more than the data we have
+
+	for i := 0; i < int(numRelayChanges) && stream.Error() == nil; i++ {
+		relay := &RouteMatrixRelayDelta{}
+		if stream.IsWriting() {
+			relay = &delta.Relays[i]
+		}
+		stream.SerializeUint32(&relay.Index)
+		stream.SerializeUint64(&relay.RelayId)
+		stream.SerializeAddress(&relay.Address)
+		stream.SerializeString(&relay.Name, constants.MaxRelayNameLength)
+		stream.SerializeFloat32(&relay.Latitude)
+		stream.SerializeFloat32(&relay.Longitude)
+		stream.SerializeUint64(&relay.DatacenterId)
+		stream.SerializeBool(&relay.DestRelay)
+		if stream.IsReading() {
+			delta.Relays = append(delta.Relays, *relay)
+		}
+	}
+
+	// route entries
+
+	numEntryChanges := uint32(len(delta.RouteEntries))
+	stream.SerializeUint32(&numEntryChanges)
+	if stream.IsReading() {
+		if int(numEntryChanges) > numEntries || stream.Error() != nil {
+			return fmt.Errorf("invalid number of route entry changes in route matrix delta: %d", numEntryChanges)
+		}
+		delta.RouteEntryIndex = make([]uint32, 0)
+		delta.RouteEntries = make([]core.RouteEntry, 0)
+	}
+
+	for i := 0; i < int(numEntryChanges) && stream.Error() == nil; i++ {
+		if stream.IsReading() {
+			delta.RouteEntryIndex = append(delta.RouteEntryIndex, 0)
+			delta.RouteEntries = append(delta.RouteEntries, core.RouteEntry{})
+		}
+		stream.SerializeUint32(&delta.RouteEntryIndex[i])
+		serializeRouteEntry(stream, &delta.RouteEntries[i], delta.RouteMatrixVersion)
+	}
+
+	// costs and relay prices
+
+	if err := serializeByteDeltas(stream, &delta.Costs, numEntries); err != nil {
+		return err
+	}
+
+	if err := serializeByteDeltas(stream, &delta.RelayPrice, numRelays); err != nil {
+		return err
+	}
+
+	stream.SerializeBool(&delta.HasDirectionalCosts)
+	if delta.HasDirectionalCosts {
+		stream.SerializeFloat32(&delta.DownstreamWeight)
+	}
+
+	if err := serializeByteDeltas(stream, &delta.DirectionalCosts, core.SquareMatrixLength(numRelays)); err != nil {
+		return err
+	}
+
+	if delta.RouteMatrixVersion >= 7 {
+		if err := serializeByteDeltas(stream, &delta.RelayHeadroom, numRelays); err != nil {
+			return err
+		}
+	}
+
+	if delta.RouteMatrixVersion >= 8 {
+		stream.SerializeUint32(&delta.SpeedOfLightViolations)
+		stream.SerializeUint32(&delta.TriangleViolations)
+	}
+
+	if delta.RouteMatrixVersion >= 9 {
+		stream.SerializeUint64(&delta.Epoch)
+		stream.SerializeUint64(&delta.EpochGeneration)
+	}
+
+	return stream.Error()
+}
+
+func (delta *RouteMatrixDelta) Write() ([]byte, error) {
+	buffer := make([]byte, delta.GetMaxSize())
+	ws := encoding.CreateWriteStream(buffer)
+	if err := delta.Serialize(ws); err != nil {
+		return nil, fmt.Errorf("failed to serialize route matrix delta: %v", err)
+	}
+	ws.Flush()
+	return buffer[:ws.GetBytesProcessed()], nil
+}
+
+func (delta *RouteMatrixDelta) Read(buffer []byte) error {
+	readStream := encoding.CreateReadStream(buffer)
+	return delta.Serialize(readStream)
+}
@@ -0,0 +1,218 @@
+package common_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mutateRouteMatrix returns a copy of the route matrix with some relays, route entries and costs changed
+func mutateRouteMatrix(r *rand.Rand, base *common.RouteMatrix, changeBinFile bool) common.RouteMatrix {
+
+	target := *base
+
+	target.CreatedAt = r.Uint64()
+	target.OptimizeTime = r.Uint32()
+
+	target.RelayIds = append([]uint64{}, base.RelayIds...)
+	target.RelayAddresses = append(target.RelayAddresses[:0:0], base.RelayAddresses...)
+	target.RelayNames = append([]string{}, base.RelayNames...)
+	target.RelayLatitudes = append([]float32{}, base.RelayLatitudes...)
+	target.RelayLongitudes = append([]float32{}, base.RelayLongitudes...)
+	target.RelayDatacenterIds = append([]uint64{}, base.RelayDatacenterIds...)
+	target.DestRelays = append([]bool{}, base.DestRelays...)
+	target.RouteEntries = append(target.RouteEntries[:0:0], base.RouteEntries...)
+	target.Costs = append([]byte{}, base.Costs...)
+	target.RelayPrice = append([]byte{}, base.RelayPrice...)
+	target.DirectionalCosts = append([]byte{}, base.DirectionalCosts...)
+	target.RelayHeadroom = append([]byte{}, base.RelayHeadroom...)
+
+	numRelays := len(target.RelayIds)
+
+	for i := 0; i < r.Intn(3); i++ {
+		index := r.Intn(numRelays)
+		target.RelayNames[index] = common.RandomString(constants.MaxRelayNameLength)
+		target.RelayLatitudes[index] = r.Float32()
+		target.DestRelays[index] = !target.DestRelays[index]
+	}
+
+	target.RelayIdToIndex = make(map[uint64]int32)
+	for i := range target.RelayIds {
+		target.RelayIdToIndex[target.RelayIds[i]] = int32(i)
+	}
+
+	for i := 0; i < r.Intn(len(target.RouteEntries)+1); i++ {
+		index := r.Intn(len(target.RouteEntries))
+		target.RouteEntries[index].DirectCost = int32(r.Intn(constants.MaxRouteCost))
+		if target.RouteEntries[index].NumRoutes > 0 {
+			target.RouteEntries[index].RouteCost[0] = int32(r.Intn(constants.MaxRouteCost))
+			target.RouteEntries[index].RouteJitter[0] = int32(r.Intn(constants.MaxRouteJitter))
+		}
+	}
+
+	for i := 0; i < r.Intn(len(target.Costs)+1); i++ {
+		target.Costs[r.Intn(len(target.Costs))] = byte(r.Intn(256))
+	}
+
+	target.RelayPrice[r.Intn(numRelays)] = byte(r.Intn(256))
+	target.RelayHeadroom[r.Intn(numRelays)] = byte(r.Intn(101))
+	target.SpeedOfLightViolations = uint32(r.Intn(100))
+	target.TriangleViolations = uint32(r.Intn(100))
+	target.Epoch = base.Epoch + 1
+
+	for i := 0; i < r.Intn(len(target.DirectionalCosts)+1); i++ {
+		target.DirectionalCosts[r.Intn(len(target.DirectionalCosts))] = byte(r.Intn(256))
+	}
+
+	if changeBinFile {
+		target.BinFileBytes = int32(100 + r.Intn(1000))
+		target.BinFileData = make([]byte, target.BinFileBytes)
+		r.Read(target.BinFileData)
+	}
+
+	return target
+}
+
+func readRouteMatrix(t testing.TB, routeMatrix *common.RouteMatrix) (*common.RouteMatrix, []byte, uint64) {
+	data, err := routeMatrix.Write()
+	assert.Nil(t, err)
+	parsed := common.RouteMatrix{}
+	err = parsed.Read(data)
+	assert.Nil(t, err)
+	return &parsed, data, common.RouteMatrixHash(data)
+}
+
+func routeMatrixDeltaTest(t testing.TB, seed int64, numRelays int, changeBinFile bool) {
+
+	r := rand.New(rand.NewSource(seed))
+
+	generated := common.GenerateRandomRouteMatrix(numRelays)
+
+	base, _, baseHash := readRouteMatrix(t, &generated)
+
+	mutated := mutateRouteMatrix(r, base, changeBinFile)
+
+	target, targetData, targetHash := readRouteMatrix(t, &mutated)
+
+	delta, err := common.CreateRouteMatrixDelta(base, baseHash, target, targetHash)
+	assert.Nil(t, err)
+	assert.Equal(t, changeBinFile, delta.BinFileChanged)
+
+	deltaData, err := delta.Write()
+	assert.Nil(t, err)
+	assert.True(t, len(deltaData) <= delta.GetMaxSize())
+
+	readDelta := common.RouteMatrixDelta{}
+	err = readDelta.Read(deltaData)
+	assert.Nil(t, err)
+
+	// applying the delta to the base gives exactly the full target route matrix
+
+	result, err := readDelta.Apply(base, baseHash)
+	assert.Nil(t, err)
+	assert.Equal(t, target, result)
+
+	resultData, err := result.Write()
+	assert.Nil(t, err)
+	assert.Equal(t, targetData, resultData)
+	assert.Equal(t, targetHash, common.RouteMatrixHash(resultData))
+
+	// the base is not modified
+
+	_, _, hash := readRouteMatrix(t, base)
+	assert.Equal(t, baseHash, hash)
+
+	// truncated deltas fail to read, and don't panic
+
+	truncatedDelta := common.RouteMatrixDelta{}
+	assert.NotNil(t, truncatedDelta.Read(deltaData[:r.Intn(len(deltaData)-4)]))
+}
+
+func TestRouteMatrixDelta(t *testing.T) {
+
+	t.Parallel()
+
+	for i := 0; i < 100; i++ {
+		routeMatrixDeltaTest(t, int64(i), 2+i%30, i%4 == 0)
+	}
+}
+
+func TestRouteMatrixDelta_Mismatch(t *testing.T) {
+
+	t.Parallel()
+
+	generated := common.GenerateRandomRouteMatrix(10)
+	base, _, baseHash := readRouteMatrix(t, &generated)
+
+	generated = common.GenerateRandomRouteMatrix(11)
+	target, _, targetHash := readRouteMatrix(t, &generated)
+
+	// deltas can't be made when the number of relays changes
+
+	_, err := common.CreateRouteMatrixDelta(base, baseHash, target, targetHash)
+	assert.NotNil(t, err)
+
+	// deltas can only be applied to the base they were made from
+
+	mutated := mutateRouteMatrix(rand.New(rand.NewSource(0)), base, false)
+	target, _, targetHash = readRouteMatrix(t, &mutated)
+
+	delta, err := common.CreateRouteMatrixDelta(base, baseHash, target, targetHash)
+	assert.Nil(t, err)
+
+	_, err = delta.Apply(target, targetHash)
+	assert.NotNil(t, err)
+
+	// deltas that don't produce their target route matrix are rejected
+
+	badDelta := *delta
+	badDelta.TargetHash++
+	_, err = badDelta.Apply(base, baseHash)
+	assert.NotNil(t, err)
+
+	badDelta = *delta
+	badDelta.OptimizeTime++
+	_, err = badDelta.Apply(base, baseHash)
+	assert.NotNil(t, err)
+
+	_, err = delta.Apply(base, baseHash)
+	assert.Nil(t, err)
+
+	// unknown versions are rejected
+
+	deltaData, err := delta.Write()
+	assert.Nil(t, err)
+
+	deltaData[0] = common.RouteMatrixDeltaVersion_Max + 1
+	readDelta := common.RouteMatrixDelta{}
+	assert.NotNil(t, readDelta.Read(deltaData))
+}
+
+func FuzzRouteMatrixDelta(f *testing.F) {
+	f.Add(int64(0), uint8(2), false)
+	f.Add(int64(1), uint8(10), true)
+	f.Add(int64(2), uint8(64), false)
+	f.Fuzz(func(t *testing.T, seed int64, numRelays uint8, changeBinFile bool) {
+		routeMatrixDeltaTest(t, seed, 2+int(numRelays)%64, changeBinFile)
+	})
+}
+
+func FuzzRouteMatrixDeltaRead(f *testing.F) {
+	generated := common.GenerateRandomRouteMatrix(4)
+	base, _, baseHash := readRouteMatrix(f, &generated)
+	mutated := mutateRouteMatrix(rand.New(rand.NewSource(0)), base, true)
+	target, _, targetHash := readRouteMatrix(f, &mutated)
+	delta, _ := common.CreateRouteMatrixDelta(base, baseHash, target, targetHash)
+	deltaData, _ := delta.Write()
+	f.Add(deltaData)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readDelta := common.RouteMatrixDelta{}
+		if readDelta.Read(data) == nil {
+			readDelta.Apply(base, readDelta.BaseHash)
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,3 +26,175 @@ func TestRouteMatrixReadWrite(t *testing.T) {
 	readMessage := common.RouteMatrix{}
 	RouteMatrixReadWriteTest(&writeMessage, &readMessage, t)
 }
+
+func TestRouteMatrixReadWrite_Version4(t *testing.T) {
+
+	t.Parallel()
+
+	// older route matrices don't have route jitter and packet loss, so they read back as zero
+
+	writeMessage := common.GenerateRandomRouteMatrix(32)
+	writeMessage.Version = 4
+
+	buffer, err := writeMessage.Write()
+	assert.Nil(t, err)
+
+	readMessage := common.RouteMatrix{}
+	err = readMessage.Read(buffer)
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint32(4), readMessage.Version)
+
+	for i := range writeMessage.RouteEntries {
+		writeMessage.RouteEntries[i].RouteJitter = [constants.MaxRoutesPerEntry]int32{}
+		writeMessage.RouteEntries[i].RoutePacketLoss = [constants.MaxRoutesPerEntry]int32{}
+	}
+
+	writeMessage.DirectionalCosts = nil
+	writeMessage.DownstreamWeight = 0
+	writeMessage.RelayHeadroom = nil
+	writeMessage.SpeedOfLightViolations = 0
+	writeMessage.TriangleViolations = 0
+	writeMessage.Epoch = 0
+	writeMessage.EpochGeneration = 0
+
+	assert.Equal(t, writeMessage, readMessage)
+}
+
+func TestRouteMatrixReadWrite_Version5(t *testing.T) {
+
+	t.Parallel()
+
+	// older route matrices don't have directional costs
+
+	writeMessage := common.GenerateRandomRouteMatrix(32)
+	writeMessage.Version = 5
+
+	buffer, err := writeMessage.Write()
+	assert.Nil(t, err)
+
+	readMessage := common.RouteMatrix{}
+	err = readMessage.Read(buffer)
+	assert.Nil(t, err)
+
+	writeMessage.DirectionalCosts = nil
+	writeMessage.DownstreamWeight = 0
+	writeMessage.RelayHeadroom = nil
+	writeMessage.SpeedOfLightViolations = 0
+	writeMessage.TriangleViolations = 0
+	writeMessage.Epoch = 0
+	writeMessage.EpochGeneration = 0
+
+	assert.Equal(t, writeMessage, readMessage)
+}
+
+func TestRouteMatrixReadWrite_Version6(t *testing.T) {
+
+	t.Parallel()
+
+	// older route matrices don't have relay headroom
+
+	writeMessage := common.GenerateRandomRouteMatrix(32)
+	writeMessage.Version = 6
+
+	buffer, err := writeMessage.Write()
+	assert.Nil(t, err)
+
+	readMessage := common.RouteMatrix{}
+	err = readMessage.Read(buffer)
+	assert.Nil(t, err)
+
+	writeMessage.RelayHeadroom = nil
+	writeMessage.SpeedOfLightViolations = 0
+	writeMessage.TriangleViolations = 0
+	writeMessage.Epoch = 0
+	writeMessage.EpochGeneration = 0
+
+	assert.Equal(t, writeMessage, readMessage)
+}
+
+func TestRouteMatrixReadWrite_Version7(t *testing.T) {
+
+	t.Parallel()
+
+	// older route matrices don't have relay sample violations
+
+	writeMessage := common.GenerateRandomRouteMatrix(32)
+	writeMessage.Version = 7
+
+	buffer, err := writeMessage.Write()
+	assert.Nil(t, err)
+
+	readMessage := common.RouteMatrix{}
+	err = readMessage.Read(buffer)
+	assert.Nil(t, err)
+
+	writeMessage.SpeedOfLightViolations = 0
+	writeMessage.TriangleViolations = 0
+	writeMessage.Epoch = 0
+	writeMessage.EpochGeneration = 0
+
+	assert.Equal(t, writeMessage, readMessage)
+}
+
+func TestRouteMatrixReadWrite_Version8(t *testing.T) {
+
+	t.Parallel()
+
+	// older route matrices don't have an epoch
+
+	writeMessage := common.GenerateRandomRouteMatrix(32)
+	writeMessage.Version = 8
+
+	buffer, err := writeMessage.Write()
+	assert.Nil(t, err)
+
+	readMessage := common.RouteMatrix{}
+	err = readMessage.Read(buffer)
+	assert.Nil(t, err)
+
+	writeMessage.Epoch = 0
+	writeMessage.EpochGeneration = 0
+
+	assert.Equal(t, writeMessage, readMessage)
+}
+
+func TestRouteMatrixEpoch(t *testing.T) {
+
+	t.Parallel()
+
+	current := common.RouteMatrix{Epoch: 10}
+
+	assert.False(t, (&common.RouteMatrix{Epoch: 11}).IsOlderThan(&current))
+	assert.False(t, (&common.RouteMatrix{Epoch: 10}).IsOlderThan(&current))
+	assert.True(t, (&common.RouteMatrix{Epoch: 9}).IsOlderThan(&current))
+
+	// route matrices without an epoch are always accepted
+
+	assert.False(t, (&common.RouteMatrix{}).IsOlderThan(&current))
+
+	// anything is newer than no route matrix
+
+	assert.False(t, (&common.RouteMatrix{Epoch: 1}).IsOlderThan(nil))
+
+	// a new epoch generation is always accepted, no matter how far the epoch went backwards. stale epochs from the same generation are not
+
+	current = common.RouteMatrix{Epoch: 1000, EpochGeneration: 1}
+
+	assert.True(t, (&common.RouteMatrix{Epoch: 1, EpochGeneration: 1}).IsOlderThan(&current))
+	assert.False(t, (&common.RouteMatrix{Epoch: 1, EpochGeneration: 1}).IsEpochReset(&current))
+	assert.False(t, (&common.RouteMatrix{Epoch: 1, EpochGeneration: 2}).IsOlderThan(&current))
+	assert.True(t, (&common.RouteMatrix{Epoch: 1, EpochGeneration: 2}).IsEpochReset(&current))
+}
+
+func TestRouteMatrixReadWrite_NoDirectionalCosts(t *testing.T) {
+
+	t.Parallel()
+
+	writeMessage := common.GenerateRandomRouteMatrix(32)
+	writeMessage.DirectionalCosts = nil
+	writeMessage.DownstreamWeight = 0
+
+	readMessage := common.RouteMatrix{}
+	RouteMatrixReadWriteTest(&writeMessage, &readMessage, t)
+}
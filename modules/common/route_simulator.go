@@ -0,0 +1,423 @@
+package common
+
+import (
+	"math"
+	"sort"
+
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+	db "github.com/networknext/next/modules/database"
+	"github.com/networknext/next/modules/messages"
+)
+
+/*
+	Route simulator.
+
+	Replays recorded analytics messages for each session against a route matrix and a candidate route shader,
+	so we can see what a route shader change would do to players before we deploy it, and compares that with
+	the route decisions that were actually made.
+
+	Client relay pings are recorded for each session update where they changed, and server relay pings for each
+	server where they changed, so each slice uses the latest set of pings recorded at or before that slice.
+
+	A simulated route may never have been taken, so we can't measure it. Latency reduction is the reduction
+	predicted by the route matrix for both the recorded and the simulated routes, so they can be compared.
+	The measured latency reduction of the recorded routes is reported separately.
+*/
+
+type SimulatedSession struct {
+	SessionId        uint64
+	BuyerId          uint64 // zero if we don't know the buyer
+	DatacenterId     uint64 // zero if we don't know the datacenter
+	UserHash         uint64
+	Updates          []messages.AnalyticsSessionUpdateMessage
+	ClientRelayPings []messages.AnalyticsClientRelayPingMessage
+	ServerRelayPings []messages.AnalyticsServerRelayPingMessage
+}
+
+type SimulationResults struct {
+	Sessions                     int
+	AcceleratedSessions          int
+	Slices                       int
+	NextSlices                   int
+	PredictedLatencyReductionSum float64
+	MeasuredLatencyReductionSum  float64 // recorded routes only
+	RouteChanges                 int
+	LeftNext                     int
+	BandwidthCost                float64 // relay price x GB
+}
+
+// GroupSimulatedSessions groups recorded messages by session. Server relay pings are per-server, and are matched to sessions by the server id in
+// their session updates. The buyer of a session comes from its session summary, or failing that, its relay pings. If buyerId is non-zero, only
+// sessions for that buyer are returned, and the number of sessions that were skipped because we don't know their buyer is returned too
+func GroupSimulatedSessions(buyerId uint64, sessionUpdates []messages.AnalyticsSessionUpdateMessage, sessionSummaries []messages.AnalyticsSessionSummaryMessage, clientRelayPings []messages.AnalyticsClientRelayPingMessage, serverRelayPings []messages.AnalyticsServerRelayPingMessage) ([]*SimulatedSession, int) {
+
+	sessionMap := make(map[uint64]*SimulatedSession)
+
+	for i := range sessionUpdates {
+		sessionId := uint64(sessionUpdates[i].SessionId)
+		session, ok := sessionMap[sessionId]
+		if !ok {
+			session = &SimulatedSession{SessionId: sessionId, UserHash: sessionId}
+			sessionMap[sessionId] = session
+		}
+		session.Updates = append(session.Updates, sessionUpdates[i])
+	}
+
+	for i := range sessionSummaries {
+		session, ok := sessionMap[uint64(sessionSummaries[i].SessionId)]
+		if !ok {
+			continue
+		}
+		session.BuyerId = uint64(sessionSummaries[i].BuyerId)
+		session.DatacenterId = uint64(sessionSummaries[i].DatacenterId)
+		session.UserHash = uint64(sessionSummaries[i].UserHash)
+	}
+
+	for i := range clientRelayPings {
+		session, ok := sessionMap[uint64(clientRelayPings[i].SessionId)]
+		if !ok {
+			continue
+		}
+		if session.BuyerId == 0 {
+			session.BuyerId = uint64(clientRelayPings[i].BuyerId)
+		}
+		session.UserHash = uint64(clientRelayPings[i].UserHash)
+		session.ClientRelayPings = append(session.ClientRelayPings, clientRelayPings[i])
+	}
+
+	serverRelayPingMap := make(map[uint64][]messages.AnalyticsServerRelayPingMessage)
+	for i := range serverRelayPings {
+		serverId := HashString(serverRelayPings[i].ServerAddress)
+		serverRelayPingMap[serverId] = append(serverRelayPingMap[serverId], serverRelayPings[i])
+	}
+
+	sessions := make([]*SimulatedSession, 0, len(sessionMap))
+
+	unknownBuyer := 0
+
+	for _, session := range sessionMap {
+
+		sort.SliceStable(session.Updates, func(i, j int) bool { return session.Updates[i].SliceNumber < session.Updates[j].SliceNumber })
+		sort.SliceStable(session.ClientRelayPings, func(i, j int) bool {
+			return session.ClientRelayPings[i].Timestamp < session.ClientRelayPings[j].Timestamp
+		})
+
+		session.ServerRelayPings = serverRelayPingMap[uint64(session.Updates[0].ServerId)]
+		sort.SliceStable(session.ServerRelayPings, func(i, j int) bool {
+			return session.ServerRelayPings[i].Timestamp < session.ServerRelayPings[j].Timestamp
+		})
+
+		if session.BuyerId == 0 && len(session.ServerRelayPings) > 0 {
+			session.BuyerId = uint64(session.ServerRelayPings[0].BuyerId)
+		}
+
+		if buyerId != 0 && session.BuyerId != buyerId {
+			if session.BuyerId == 0 {
+				unknownBuyer++
+			}
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SessionId < sessions[j].SessionId })
+
+	return sessions, unknownBuyer
+}
+
+// latestPingSet returns the pings with the latest timestamp at or before the given timestamp. Pings must be sorted by timestamp
+func latestPingSet[T any](pings []T, pingTimestamp func(*T) int64, timestamp int64) []T {
+	end := sort.Search(len(pings), func(i int) bool { return pingTimestamp(&pings[i]) > timestamp })
+	if end == 0 {
+		return nil
+	}
+	begin := end - 1
+	for begin > 0 && pingTimestamp(&pings[begin-1]) == pingTimestamp(&pings[end-1]) {
+		begin--
+	}
+	return pings[begin:end]
+}
+
+type RouteSimulator struct {
+	Verbose bool
+
+	sliceSeconds   float64
+	routeMatrix    *RouteMatrix
+	routeShader    *core.RouteShader
+	excludedRelays []bool
+}
+
+// CreateRouteSimulator creates a route simulator. Slice seconds is the length of each session update slice in the SDK, for bandwidth cost
+func CreateRouteSimulator(routeMatrix *RouteMatrix, database *db.Database, routeShader *core.RouteShader, sliceSeconds float64) *RouteSimulator {
+
+	simulator := &RouteSimulator{sliceSeconds: sliceSeconds, routeMatrix: routeMatrix, routeShader: routeShader}
+
+	if routeShader.HasRelayPolicy() {
+
+		numRelays := len(routeMatrix.RelayIds)
+
+		simulator.excludedRelays = make([]bool, numRelays)
+
+		for i := 0; i < numRelays; i++ {
+
+			relayId := routeMatrix.RelayIds[i]
+
+			sellerId := uint64(0)
+			relay := database.GetRelay(relayId)
+			if relay != nil && relay.Seller != nil {
+				sellerId = relay.Seller.Id
+			}
+
+			simulator.excludedRelays[i] = !routeShader.RelayAllowed(relayId, sellerId, routeMatrix.RelayDatacenterIds[i])
+		}
+	}
+
+	return simulator
+}
+
+func (simulator *RouteSimulator) routePrice(routeRelays []int32) float64 {
+	price := 0.0
+	for _, relayIndex := range routeRelays {
+		if int(relayIndex) < len(simulator.routeMatrix.RelayPrice) {
+			price += float64(simulator.routeMatrix.RelayPrice[relayIndex])
+		}
+	}
+	return price
+}
+
+func (simulator *RouteSimulator) sliceGigabytes(update *messages.AnalyticsSessionUpdateMessage) float64 {
+	return float64(update.BandwidthKbpsUp+update.BandwidthKbpsDown) * 1000 * simulator.sliceSeconds / 8 / 1000000000
+}
+
+func routesEqual(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Record adds up what actually happened to a session
+func (simulator *RouteSimulator) Record(session *SimulatedSession, results *SimulationResults) {
+
+	results.Sessions++
+
+	accelerated := false
+	previousNext := false
+	previousRoute := []int64{}
+
+	for i := range session.Updates {
+
+		update := &session.Updates[i]
+
+		results.Slices++
+
+		if !update.Next {
+			if previousNext {
+				results.LeftNext++
+			}
+			previousNext = false
+			continue
+		}
+
+		accelerated = true
+
+		results.NextSlices++
+		results.PredictedLatencyReductionSum += float64(update.DirectRTT - update.NextPredictedRTT)
+		results.MeasuredLatencyReductionSum += float64(update.DirectRTT - update.NextRTT)
+
+		if previousNext && !routesEqual(previousRoute, update.NextRouteRelays) {
+			results.RouteChanges++
+		}
+
+		routeRelays := make([]int32, 0, len(update.NextRouteRelays))
+		for _, relayId := range update.NextRouteRelays {
+			if relayIndex, ok := simulator.routeMatrix.RelayIdToIndex[uint64(relayId)]; ok {
+				routeRelays = append(routeRelays, relayIndex)
+			}
+		}
+
+		results.BandwidthCost += simulator.sliceGigabytes(update) * simulator.routePrice(routeRelays)
+
+		previousNext = true
+		previousRoute = update.NextRouteRelays
+	}
+
+	if accelerated {
+		results.AcceleratedSessions++
+	}
+}
+
+func (simulator *RouteSimulator) getSourceRelays(session *SimulatedSession, update *messages.AnalyticsSessionUpdateMessage) ([]int32, []int32) {
+
+	pings := latestPingSet(session.ClientRelayPings, func(ping *messages.AnalyticsClientRelayPingMessage) int64 { return ping.Timestamp }, update.Timestamp)
+
+	sourceRelayIds := make([]uint64, len(pings))
+	sourceRelayLatency := make([]int32, len(pings))
+	sourceRelayJitter := make([]int32, len(pings))
+	sourceRelayPacketLoss := make([]float32, len(pings))
+
+	for i := range pings {
+		sourceRelayIds[i] = uint64(pings[i].ClientRelayId)
+		sourceRelayLatency[i] = pings[i].ClientRelayRTT
+		sourceRelayJitter[i] = pings[i].ClientRelayJitter
+		sourceRelayPacketLoss[i] = pings[i].ClientRelayPacketLoss
+	}
+
+	excludeSourceRelay := make([]bool, len(sourceRelayIds))
+
+	directLatency := int32(math.Ceil(float64(update.DirectRTT)))
+	directJitter := int32(math.Ceil(float64(update.DirectJitter)))
+
+	core.FilterSourceRelays(directLatency, directJitter, update.DirectPacketLoss, sourceRelayIds, sourceRelayLatency, sourceRelayJitter, sourceRelayPacketLoss, excludeSourceRelay)
+
+	sourceRelays := make([]int32, len(sourceRelayIds))
+	sourceRelayCost := make([]int32, len(sourceRelayIds))
+
+	core.ReframeSourceRelays(simulator.routeMatrix.RelayIdToIndex, sourceRelayIds, sourceRelayLatency, excludeSourceRelay, sourceRelays, sourceRelayCost)
+
+	return sourceRelays, sourceRelayCost
+}
+
+func (simulator *RouteSimulator) getDestRelays(session *SimulatedSession, update *messages.AnalyticsSessionUpdateMessage) []int32 {
+
+	routeMatrix := simulator.routeMatrix
+
+	// prefer the recorded server relay pings. otherwise, use all dest relays in the session's datacenter
+
+	pings := latestPingSet(session.ServerRelayPings, func(ping *messages.AnalyticsServerRelayPingMessage) int64 { return ping.Timestamp }, update.Timestamp)
+
+	if len(pings) > 0 {
+
+		destRelayIds := make([]uint64, len(pings))
+		destRelayLatency := make([]int32, len(pings))
+		destRelayJitter := make([]int32, len(pings))
+		destRelayPacketLoss := make([]float32, len(pings))
+
+		for i := range pings {
+			destRelayIds[i] = uint64(pings[i].ServerRelayId)
+			destRelayLatency[i] = pings[i].ServerRelayRTT
+			destRelayJitter[i] = pings[i].ServerRelayJitter
+			destRelayPacketLoss[i] = pings[i].ServerRelayPacketLoss
+		}
+
+		excludeDestRelay := make([]bool, len(destRelayIds))
+
+		core.FilterDestRelays(destRelayIds, destRelayLatency, destRelayJitter, destRelayPacketLoss, excludeDestRelay)
+
+		destRelays := make([]int32, 0, len(destRelayIds))
+
+		core.ReframeDestRelays(routeMatrix.RelayIdToIndex, destRelayIds, excludeDestRelay, &destRelays)
+
+		return destRelays
+	}
+
+	// if we don't have a session summary, the datacenter is the datacenter of the last relay in a recorded route
+
+	datacenterId := session.DatacenterId
+	for i := range session.Updates {
+		if datacenterId != 0 {
+			break
+		}
+		numRouteRelays := len(session.Updates[i].NextRouteRelays)
+		if numRouteRelays == 0 {
+			continue
+		}
+		if relayIndex, ok := routeMatrix.RelayIdToIndex[uint64(session.Updates[i].NextRouteRelays[numRouteRelays-1])]; ok {
+			datacenterId = routeMatrix.RelayDatacenterIds[relayIndex]
+		}
+	}
+
+	destRelays := []int32{}
+
+	if datacenterId == 0 {
+		return destRelays
+	}
+
+	for i := range routeMatrix.RelayIds {
+		if routeMatrix.RelayDatacenterIds[i] == datacenterId && i < len(routeMatrix.DestRelays) && routeMatrix.DestRelays[i] {
+			destRelays = append(destRelays, int32(i))
+		}
+	}
+
+	return destRelays
+}
+
+// Simulate replays a session against the candidate route shader, and adds up what would have happened
+func (simulator *RouteSimulator) Simulate(session *SimulatedSession, results *SimulationResults) {
+
+	results.Sessions++
+
+	routeMatrix := simulator.routeMatrix
+
+	routeState := core.RouteState{}
+
+	accelerated := false
+
+	routeCost := int32(0)
+	routeNumRelays := int32(0)
+	routeRelays := [constants.MaxRouteRelays]int32{}
+
+	for i := range session.Updates {
+
+		update := &session.Updates[i]
+
+		results.Slices++
+
+		sourceRelays, sourceRelayCost := simulator.getSourceRelays(session, update)
+
+		destRelays := simulator.getDestRelays(session, update)
+
+		directLatency := int32(update.DirectRTT)
+
+		if !routeState.Next {
+
+			if core.MakeRouteDecision_TakeNetworkNext(session.UserHash, routeMatrix.RouteEntries, simulator.routeShader, &routeState, directLatency, update.RealPacketLoss, sourceRelays, sourceRelayCost, destRelays, simulator.excludedRelays, &routeCost, &routeNumRelays, routeRelays[:], nil, update.SliceNumber, nil) {
+				if simulator.Verbose {
+					core.Log("session %016x slice %d: take network next (%d)", session.SessionId, update.SliceNumber, routeCost)
+				}
+			}
+
+		} else {
+
+			// we can't measure a route that was never taken, so its next latency is the latency predicted by the route matrix
+
+			currentRouteNumRelays := routeNumRelays
+			currentRouteRelays := routeRelays
+
+			stayOnNext, routeChanged := core.MakeRouteDecision_StayOnNetworkNext(session.UserHash, routeMatrix.RouteEntries, routeMatrix.RelayNames, simulator.routeShader, &routeState, directLatency, routeCost, routeCost, update.RealPacketLoss, 0, currentRouteNumRelays, currentRouteRelays, sourceRelays, sourceRelayCost, destRelays, simulator.excludedRelays, &routeCost, &routeNumRelays, routeRelays[:], nil, nil)
+
+			if !stayOnNext {
+				results.LeftNext++
+				if simulator.Verbose {
+					core.Log("session %016x slice %d: leave network next", session.SessionId, update.SliceNumber)
+				}
+			} else if routeChanged {
+				results.RouteChanges++
+				if simulator.Verbose {
+					core.Log("session %016x slice %d: route changed (%d)", session.SessionId, update.SliceNumber, routeCost)
+				}
+			}
+		}
+
+		if !routeState.Next {
+			continue
+		}
+
+		accelerated = true
+
+		results.NextSlices++
+		results.PredictedLatencyReductionSum += float64(update.DirectRTT) - float64(routeCost)
+		results.BandwidthCost += simulator.sliceGigabytes(update) * simulator.routePrice(routeRelays[:routeNumRelays])
+	}
+
+	if accelerated {
+		results.AcceleratedSessions++
+	}
+}
@@ -0,0 +1,207 @@
+package common_test
+
+import (
+	"testing"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/core"
+	db "github.com/networknext/next/modules/database"
+	"github.com/networknext/next/modules/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const simulatedServerAddress = "127.0.0.1:50000"
+
+// two relays 10ms apart. relay 2 is the dest relay in the server's datacenter
+
+func createSimulatorRouteMatrix() *common.RouteMatrix {
+
+	relayIds := []uint64{1, 2}
+	relayDatacenterIds := []uint64{100, 200}
+	relayPrice := []uint8{1, 2}
+
+	costs := make([]uint8, core.TriMatrixLength(len(relayIds)))
+	costs[core.TriMatrixIndex(0, 1)] = 10
+
+	return &common.RouteMatrix{
+		RelayIds:           relayIds,
+		RelayIdToIndex:     map[uint64]int32{1: 0, 2: 1},
+		RelayNames:         []string{"a", "b"},
+		RelayDatacenterIds: relayDatacenterIds,
+		DestRelays:         []bool{false, true},
+		RelayPrice:         relayPrice,
+		RouteEntries:       core.Optimize(len(relayIds), 1, costs, relayPrice, relayDatacenterIds),
+	}
+}
+
+func simulatedSessionUpdate(sliceNumber int32, timestamp int64) messages.AnalyticsSessionUpdateMessage {
+	return messages.AnalyticsSessionUpdateMessage{
+		Timestamp:         timestamp,
+		SessionId:         0x12345,
+		ServerId:          int64(common.HashString(simulatedServerAddress)),
+		SliceNumber:       sliceNumber,
+		DirectRTT:         100,
+		BandwidthKbpsUp:   256,
+		BandwidthKbpsDown: 256,
+	}
+}
+
+func simulatedClientRelayPing(timestamp int64, relayId int64, rtt int32) messages.AnalyticsClientRelayPingMessage {
+	return messages.AnalyticsClientRelayPingMessage{Timestamp: timestamp, BuyerId: 1, SessionId: 0x12345, ClientRelayId: relayId, ClientRelayRTT: rtt}
+}
+
+func simulatedServerRelayPing(timestamp int64) messages.AnalyticsServerRelayPingMessage {
+	return messages.AnalyticsServerRelayPingMessage{Timestamp: timestamp, BuyerId: 1, ServerAddress: simulatedServerAddress, ServerRelayId: 2, ServerRelayRTT: 1}
+}
+
+func TestRouteSimulator_LatestPings(t *testing.T) {
+
+	t.Parallel()
+
+	routeMatrix := createSimulatorRouteMatrix()
+
+	routeShader := core.NewRouteShader()
+
+	sessionUpdates := []messages.AnalyticsSessionUpdateMessage{
+		simulatedSessionUpdate(0, 1000),
+		simulatedSessionUpdate(1, 2000),
+		simulatedSessionUpdate(2, 3000),
+	}
+
+	// the client is far from relay 1, then close to it, then only pings a relay that isn't in the route matrix.
+	// each slice only uses the latest pings, not every ping recorded so far
+
+	clientRelayPings := []messages.AnalyticsClientRelayPingMessage{
+		simulatedClientRelayPing(3000, 3, 10),
+		simulatedClientRelayPing(1000, 1, 200),
+		simulatedClientRelayPing(2000, 1, 10),
+	}
+
+	serverRelayPings := []messages.AnalyticsServerRelayPingMessage{simulatedServerRelayPing(500)}
+
+	sessions, _ := common.GroupSimulatedSessions(0, sessionUpdates, nil, clientRelayPings, serverRelayPings)
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, 1, len(sessions[0].ServerRelayPings))
+
+	simulator := common.CreateRouteSimulator(routeMatrix, db.CreateDatabase(), &routeShader, 10)
+
+	results := common.SimulationResults{}
+
+	simulator.Simulate(sessions[0], &results)
+
+	assert.Equal(t, 1, results.Sessions)
+	assert.Equal(t, 1, results.AcceleratedSessions)
+	assert.Equal(t, 3, results.Slices)
+	assert.Equal(t, 1, results.NextSlices)
+	assert.Equal(t, 1, results.LeftNext)
+	assert.True(t, results.PredictedLatencyReductionSum > 0.0)
+	assert.True(t, results.BandwidthCost > 0.0)
+
+	// without server relay pings, the dest relays are the dest relays in the session's datacenter
+
+	sessions, _ = common.GroupSimulatedSessions(0, sessionUpdates, nil, clientRelayPings, nil)
+	sessions[0].DatacenterId = 200
+
+	results = common.SimulationResults{}
+
+	simulator.Simulate(sessions[0], &results)
+
+	assert.Equal(t, 1, results.NextSlices)
+}
+
+func TestRouteSimulator_Record(t *testing.T) {
+
+	t.Parallel()
+
+	routeMatrix := createSimulatorRouteMatrix()
+
+	routeShader := core.NewRouteShader()
+
+	sessionUpdates := []messages.AnalyticsSessionUpdateMessage{
+		simulatedSessionUpdate(0, 1000),
+		simulatedSessionUpdate(1, 2000),
+		simulatedSessionUpdate(2, 3000),
+		simulatedSessionUpdate(3, 4000),
+	}
+
+	for i := 1; i <= 2; i++ {
+		sessionUpdates[i].Next = true
+		sessionUpdates[i].NextRTT = 40
+		sessionUpdates[i].NextPredictedRTT = 30
+	}
+	sessionUpdates[1].NextRouteRelays = []int64{1, 2}
+	sessionUpdates[2].NextRouteRelays = []int64{2}
+
+	sessions, _ := common.GroupSimulatedSessions(0, sessionUpdates, nil, nil, nil)
+
+	simulator := common.CreateRouteSimulator(routeMatrix, db.CreateDatabase(), &routeShader, 10)
+
+	results := common.SimulationResults{}
+
+	simulator.Record(sessions[0], &results)
+
+	assert.Equal(t, 1, results.AcceleratedSessions)
+	assert.Equal(t, 4, results.Slices)
+	assert.Equal(t, 2, results.NextSlices)
+	assert.Equal(t, 1, results.RouteChanges)
+	assert.Equal(t, 1, results.LeftNext)
+
+	// predicted and measured latency reduction are added up separately, so the predicted latency reduction can be compared with a simulation
+
+	assert.Equal(t, 140.0, results.PredictedLatencyReductionSum)
+	assert.Equal(t, 120.0, results.MeasuredLatencyReductionSum)
+
+	// 512kbps for 10 seconds over relays priced 1 + 2, then 2
+
+	assert.InDelta(t, 0.00064*3+0.00064*2, results.BandwidthCost, 0.000001)
+}
+
+func TestGroupSimulatedSessions_BuyerId(t *testing.T) {
+
+	t.Parallel()
+
+	sessionUpdates := []messages.AnalyticsSessionUpdateMessage{}
+	for sessionId := int64(1); sessionId <= 5; sessionId++ {
+		update := simulatedSessionUpdate(0, 1000)
+		update.SessionId = sessionId
+		update.ServerId = sessionId
+		sessionUpdates = append(sessionUpdates, update)
+	}
+
+	// session 1 has a session summary but no pings
+
+	sessionSummaries := []messages.AnalyticsSessionSummaryMessage{
+		{SessionId: 1, BuyerId: 1000},
+		{SessionId: 5, BuyerId: 2000},
+	}
+
+	// session 2 has client relay pings
+
+	clientRelayPings := []messages.AnalyticsClientRelayPingMessage{
+		{SessionId: 2, BuyerId: 1000, ClientRelayId: 1},
+	}
+
+	// session 3 only has server relay pings for its server
+
+	sessionUpdates[2].ServerId = int64(common.HashString(simulatedServerAddress))
+
+	serverRelayPings := []messages.AnalyticsServerRelayPingMessage{
+		{BuyerId: 1000, ServerAddress: simulatedServerAddress, ServerRelayId: 2},
+	}
+
+	// we know nothing about session 4, and session 5 is for another buyer
+
+	sessions, unknownBuyer := common.GroupSimulatedSessions(1000, sessionUpdates, sessionSummaries, clientRelayPings, serverRelayPings)
+
+	assert.Equal(t, 3, len(sessions))
+	assert.Equal(t, uint64(1), sessions[0].SessionId)
+	assert.Equal(t, uint64(2), sessions[1].SessionId)
+	assert.Equal(t, uint64(3), sessions[2].SessionId)
+	assert.Equal(t, 1, unknownBuyer)
+
+	sessions, unknownBuyer = common.GroupSimulatedSessions(0, sessionUpdates, sessionSummaries, clientRelayPings, serverRelayPings)
+
+	assert.Equal(t, 5, len(sessions))
+	assert.Equal(t, 0, unknownBuyer)
+}
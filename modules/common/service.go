@@ -106,6 +106,7 @@ type Service struct {
 
 	routeMatrixMutex    sync.RWMutex
 	routeMatrix         *RouteMatrix
+	routeMatrixHash     uint64
 	routeMatrixDatabase *db.Database
 
 	ip2location_mutex   sync.RWMutex
@@ -219,7 +220,7 @@ func (service *Service) LoadDatabase(relayBackendPublicKey []byte, relayBackendP
 		service.database.GenerateRelaySecretKeys(relayBackendPublicKey, relayBackendPrivateKey)
 	}
 
-	service.databaseRelayData = generateRelayData(service.database)
+	service.databaseRelayData = CreateRelayData(service.database)
 	if service.databaseRelayData == nil {
 		core.Error("generate relay data failed")
 		os.Exit(1)
@@ -521,14 +522,46 @@ func (service *Service) Load(name string) []byte {
 	return data
 }
 
+func (service *Service) SetConverged() {
+	if service.leaderElection == nil {
+		panic("leader election must be enabled to call set converged")
+	}
+	service.leaderElection.SetConverged()
+}
+
+func (service *Service) NextEpoch(name string, minimum uint64) (uint64, uint64, error) {
+	if service.leaderElection == nil {
+		panic("leader election must be enabled to call next epoch")
+	}
+	return service.leaderElection.NextEpoch(service.Context, name, minimum)
+}
+
 func (service *Service) UpdateRouteMatrix(relayBackendPublicKey []byte, relayBackendPrivateKey []byte) {
 
 	routeMatrixURL := envvar.GetString("ROUTE_MATRIX_URL", "http://127.0.0.1:30001/route_matrix")
 	routeMatrixInterval := envvar.GetDuration("ROUTE_MATRIX_INTERVAL", time.Second)
+	enableRouteMatrixDelta := envvar.GetBool("ENABLE_ROUTE_MATRIX_DELTA", false)
+	routeMatrixDeltaURL := envvar.GetString("ROUTE_MATRIX_DELTA_URL", "http://127.0.0.1:30001/route_matrix_delta")
 
 	core.Log("route matrix url: %s", routeMatrixURL)
 	core.Log("route matrix interval: %s", routeMatrixInterval.String())
 
+	if enableRouteMatrixDelta {
+		core.Log("route matrix delta url: %s", routeMatrixDeltaURL)
+	}
+
+	loadDatabase := func(binFileData []byte) (*db.Database, error) {
+		var newDatabase db.Database
+		err := newDatabase.LoadBinary(binFileData)
+		if err != nil {
+			return nil, err
+		}
+		if relayBackendPublicKey != nil && relayBackendPrivateKey != nil {
+			newDatabase.GenerateRelaySecretKeys(relayBackendPublicKey, relayBackendPrivateKey)
+		}
+		return &newDatabase, nil
+	}
+
 	httpClient := &http.Client{
 		Timeout: routeMatrixInterval,
 	}
@@ -548,13 +581,62 @@ func (service *Service) UpdateRouteMatrix(relayBackendPublicKey []byte, relayBac
 
 				service.routeMatrixMutex.RLock()
 				currentRouteMatrix := service.routeMatrix
+				currentRouteMatrixHash := service.routeMatrixHash
+				currentDatabase := service.routeMatrixDatabase
 				service.routeMatrixMutex.RUnlock()
 
 				if currentRouteMatrix != nil && time.Now().Unix()-int64(currentRouteMatrix.CreatedAt) > 30 {
 					core.Error("route matrix is stale: created at %d, current time is %d (%d seconds old)", int64(currentRouteMatrix.CreatedAt), time.Now().Unix(), time.Now().Unix()-int64(currentRouteMatrix.CreatedAt))
 					service.routeMatrixMutex.Lock()
 					service.routeMatrix = nil
+					service.routeMatrixHash = 0
 					service.routeMatrixMutex.Unlock()
+					currentRouteMatrix = nil
+				}
+
+				// if we have a route matrix, try to update it with a delta first, and fall back to the full route matrix if that fails
+
+				if enableRouteMatrixDelta && currentRouteMatrix != nil {
+
+					delta, newRouteMatrix, err := fetchRouteMatrixDelta(httpClient, routeMatrixDeltaURL, currentRouteMatrix, currentRouteMatrixHash)
+
+					if err == nil && newRouteMatrix == nil {
+						core.Debug("route matrix has not changed")
+						continue
+					}
+
+					// IMPORTANT: never go back to a route matrix published before the one we have, eg. right after the relay backend leader changes
+
+					if err == nil && newRouteMatrix.IsEpochReset(currentRouteMatrix) {
+						core.Warn("route matrix epoch generation changed from %016x to %016x", currentRouteMatrix.EpochGeneration, newRouteMatrix.EpochGeneration)
+					}
+
+					if err == nil && newRouteMatrix.IsOlderThan(currentRouteMatrix) {
+						core.Warn("rejected route matrix delta with epoch %d, older than current epoch %d", newRouteMatrix.Epoch, currentRouteMatrix.Epoch)
+						continue
+					}
+
+					if err == nil && delta.BinFileChanged {
+						currentDatabase, err = loadDatabase(newRouteMatrix.BinFileData)
+						if err != nil {
+							err = fmt.Errorf("failed to read database: %v", err)
+						}
+					}
+
+					if err == nil {
+
+						service.routeMatrixMutex.Lock()
+						service.routeMatrix = newRouteMatrix
+						service.routeMatrixHash = delta.TargetHash // Apply checked that the new route matrix hashes to this
+						service.routeMatrixDatabase = currentDatabase
+						service.routeMatrixMutex.Unlock()
+
+						core.Debug("updated route matrix from delta: %d relays, %d route entries changed, fetched in %dms", len(newRouteMatrix.RelayIds), len(delta.RouteEntries), time.Since(start).Milliseconds())
+
+						continue
+					}
+
+					core.Debug("could not update route matrix from delta, getting full route matrix: %v", err)
 				}
 
 				response, err := httpClient.Get(routeMatrixURL)
@@ -589,21 +671,25 @@ func (service *Service) UpdateRouteMatrix(relayBackendPublicKey []byte, relayBac
 					continue
 				}
 
-				var newDatabase db.Database
+				if newRouteMatrix.IsEpochReset(currentRouteMatrix) {
+					core.Warn("route matrix epoch generation changed from %016x to %016x", currentRouteMatrix.EpochGeneration, newRouteMatrix.EpochGeneration)
+				}
 
-				err = newDatabase.LoadBinary(newRouteMatrix.BinFileData)
-				if err != nil {
-					core.Error("failed to read database: %v", err)
+				if newRouteMatrix.IsOlderThan(currentRouteMatrix) {
+					core.Warn("rejected route matrix with epoch %d, older than current epoch %d", newRouteMatrix.Epoch, currentRouteMatrix.Epoch)
 					continue
 				}
 
-				if relayBackendPublicKey != nil && relayBackendPrivateKey != nil {
-					newDatabase.GenerateRelaySecretKeys(relayBackendPublicKey, relayBackendPrivateKey)
+				newDatabase, err := loadDatabase(newRouteMatrix.BinFileData)
+				if err != nil {
+					core.Error("failed to read database: %v", err)
+					continue
 				}
 
 				service.routeMatrixMutex.Lock()
 				service.routeMatrix = &newRouteMatrix
-				service.routeMatrixDatabase = &newDatabase
+				service.routeMatrixHash = RouteMatrixHash(buffer)
+				service.routeMatrixDatabase = newDatabase
 				service.routeMatrixMutex.Unlock()
 
 				duration := time.Since(start).Milliseconds()
@@ -618,6 +704,42 @@ func (service *Service) UpdateRouteMatrix(relayBackendPublicKey []byte, relayBac
 	}()
 }
 
+// fetchRouteMatrixDelta gets the delta from our current route matrix to the latest route matrix and applies it. Returns a nil route matrix if the route matrix has not changed.
+func fetchRouteMatrixDelta(httpClient *http.Client, routeMatrixDeltaURL string, routeMatrix *RouteMatrix, routeMatrixHash uint64) (*RouteMatrixDelta, *RouteMatrix, error) {
+
+	response, err := httpClient.Get(fmt.Sprintf("%s?since=%016x", routeMatrixDeltaURL, routeMatrixHash))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to http get route matrix delta: %v", err)
+	}
+
+	buffer, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read route matrix delta response body: %v", err)
+	}
+
+	if response.StatusCode == http.StatusNoContent {
+		return nil, nil, nil
+	}
+
+	if response.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("http response %d when getting route matrix delta", response.StatusCode)
+	}
+
+	delta := RouteMatrixDelta{}
+	err = delta.Read(buffer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read route matrix delta: %v", err)
+	}
+
+	newRouteMatrix, err := delta.Apply(routeMatrix, routeMatrixHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to apply route matrix delta: %v", err)
+	}
+
+	return &delta, newRouteMatrix, nil
+}
+
 func (service *Service) RouteMatrixAndDatabase() (*RouteMatrix, *db.Database) {
 	service.routeMatrixMutex.RLock()
 	routeMatrix := service.routeMatrix
@@ -669,7 +791,8 @@ func (service *Service) WaitForShutdown() {
 
 // -----------------------------------------------------------------------
 
-func generateRelayData(database *db.Database) *RelayData {
+// CreateRelayData builds the relay data the relay backend and relay gateway work with from the database
+func CreateRelayData(database *db.Database) *RelayData {
 
 	relayData := &RelayData{}
 
@@ -751,6 +874,62 @@ func generateRelayData(database *db.Database) *RelayData {
 	return relayData
 }
 
+func (relayData *RelayData) GetEffectiveRelayPrice(hour int, relaySessions []int) []byte {
+
+	// the effective price of each relay depends on the seller's peak hours and how loaded the relay is
+
+	relayPrice := make([]byte, relayData.NumRelays)
+
+	for i := 0; i < relayData.NumRelays; i++ {
+
+		relay := &relayData.RelayArray[i]
+
+		peakStartHour := 0
+		peakEndHour := 0
+		peakPriceMultiplier := float32(1.0)
+		if relay.Seller != nil {
+			peakStartHour = relay.Seller.PeakStartHour
+			peakEndHour = relay.Seller.PeakEndHour
+			peakPriceMultiplier = relay.Seller.PeakPriceMultiplier
+		}
+
+		sessions := 0
+		if i < len(relaySessions) {
+			sessions = relaySessions[i]
+		}
+
+		relayPrice[i] = core.EffectiveRelayPrice(relay.BandwidthPrice, hour, peakStartHour, peakEndHour, peakPriceMultiplier, sessions, relay.MaxSessions)
+	}
+
+	return relayPrice
+}
+
+func (relayData *RelayData) GetRelayHeadroom(relaySessions []int, relayBandwidthKbps []int) []byte {
+
+	// the headroom of each relay is how much of its max sessions and port speed is still free
+
+	relayHeadroom := make([]byte, relayData.NumRelays)
+
+	for i := 0; i < relayData.NumRelays; i++ {
+
+		relay := &relayData.RelayArray[i]
+
+		sessions := 0
+		if i < len(relaySessions) {
+			sessions = relaySessions[i]
+		}
+
+		bandwidthKbps := 0
+		if i < len(relayBandwidthKbps) {
+			bandwidthKbps = relayBandwidthKbps[i]
+		}
+
+		relayHeadroom[i] = core.RelayHeadroom(sessions, relay.MaxSessions, bandwidthKbps, relay.PortSpeed)
+	}
+
+	return relayHeadroom
+}
+
 func (service *Service) watchDatabase(ctx context.Context, databasePath string, relayBackendPublicKey []byte, relayBackendPrivateKey []byte) {
 
 	databaseURL := envvar.GetString("DATABASE_URL", "")
@@ -803,7 +982,7 @@ func (service *Service) watchDatabase(ctx context.Context, databasePath string,
 						break
 					}
 
-					newRelayData := generateRelayData(service.database)
+					newRelayData := CreateRelayData(service.database)
 					if newRelayData == nil {
 						core.Warn("new database failed to generate relay data")
 						break
@@ -843,7 +1022,7 @@ func (service *Service) watchDatabase(ctx context.Context, databasePath string,
 						break
 					}
 
-					newRelayData := generateRelayData(service.database)
+					newRelayData := CreateRelayData(service.database)
 					if newRelayData == nil {
 						core.Warn("new database failed to generate relay data")
 						break
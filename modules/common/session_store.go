@@ -0,0 +1,265 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/networknext/next/modules/core"
+	"github.com/networknext/next/modules/encoding"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+	Server side session store.
+
+	Session data normally lives in the signed blob that the SDK echoes back to the server backend each slice.
+	The session store keeps server side session data, see packets.ServerSessionData, so session state is not
+	limited by what fits in the SDK packet, and new state can be added without an SDK update.
+
+	Only the latest session data for each session is kept, keyed by session id and the version of the data,
+	so server backends that write a different version don't read each other's data. Each entry remembers the
+	slice number it is for, and Get only returns session data for the slice being processed.
+
+	Recent session data is kept in an in-memory LRU, and written behind to redis in batches, so another server
+	backend instance can pick up the session. If the in-memory session data is for a different slice, eg. the
+	session went to another server backend instance and came back, Get looks in redis for newer session data.
+
+	IMPORTANT: Get is called from the packet handler. When the in-memory LRU doesn't have session data for the
+	slice, it waits for redis, for up to RedisTimeout, and the UDP handler processing that packet is blocked for
+	that long. This only happens when a session moves between server backend instances, but keep RedisTimeout
+	well below the session update timeout in the SDK.
+*/
+
+const SessionStoreVersion = 2 // IMPORTANT: bump this anytime you change the redis data structures!
+
+type SessionStoreConfig struct {
+	MaxEntries         int           // in-memory LRU capacity
+	Expire             time.Duration // how long session data is kept in redis
+	RedisTimeout       time.Duration // how long to wait for redis on a miss in the in-memory LRU
+	BatchSize          int
+	BatchDuration      time.Duration
+	MessageChannelSize int
+}
+
+type SessionStoreStats struct {
+	Hits          uint64
+	RedisHits     uint64
+	Misses        uint64
+	Writes        uint64
+	DroppedWrites uint64
+}
+
+type sessionStoreKey struct {
+	sessionId uint64
+	version   uint32
+}
+
+type sessionStoreEntry struct {
+	key         sessionStoreKey
+	sliceNumber uint32
+	data        []byte
+}
+
+type SessionStore struct {
+	config      SessionStoreConfig
+	redisClient redis.Cmdable
+
+	mutex   sync.Mutex
+	entries map[sessionStoreKey]*list.Element
+	lru     *list.List
+	stats   SessionStoreStats
+
+	writeChannel chan sessionStoreEntry
+}
+
+// CreateSessionStore creates a session store. If redisClient is nil, session data is only kept in memory
+func CreateSessionStore(ctx context.Context, redisClient redis.Cmdable, config SessionStoreConfig) *SessionStore {
+
+	if config.MaxEntries == 0 {
+		config.MaxEntries = 100000
+	}
+
+	if config.Expire == 0 {
+		config.Expire = 5 * time.Minute
+	}
+
+	if config.RedisTimeout == 0 {
+		config.RedisTimeout = 50 * time.Millisecond
+	}
+
+	if config.BatchSize == 0 {
+		config.BatchSize = 1000
+	}
+
+	if config.BatchDuration == 0 {
+		config.BatchDuration = 100 * time.Millisecond
+	}
+
+	if config.MessageChannelSize == 0 {
+		config.MessageChannelSize = 1024 * 1024
+	}
+
+	store := &SessionStore{}
+	store.config = config
+	store.redisClient = redisClient
+	store.entries = make(map[sessionStoreKey]*list.Element)
+	store.lru = list.New()
+
+	if redisClient != nil {
+		store.writeChannel = make(chan sessionStoreEntry, config.MessageChannelSize)
+		go store.updateWriteChannel(ctx)
+	}
+
+	return store
+}
+
+func sessionStoreRedisKey(key sessionStoreKey) string {
+	return fmt.Sprintf("session-data-%d-%016x-%d", SessionStoreVersion, key.sessionId, key.version)
+}
+
+// Put stores session data with the given version for the session update with the given slice number, replacing any
+// previous session data with that version. The data is copied
+func (store *SessionStore) Put(sessionId uint64, version uint32, sliceNumber uint32, data []byte) {
+
+	entry := sessionStoreEntry{key: sessionStoreKey{sessionId: sessionId, version: version}, sliceNumber: sliceNumber, data: make([]byte, len(data))}
+	copy(entry.data, data)
+
+	store.mutex.Lock()
+	store.insert(entry)
+	store.stats.Writes++
+	store.mutex.Unlock()
+
+	if store.writeChannel != nil {
+		select {
+		case store.writeChannel <- entry:
+		default:
+			store.mutex.Lock()
+			store.stats.DroppedWrites++
+			store.mutex.Unlock()
+		}
+	}
+}
+
+// Get returns the session data with the given version for the session update with the given slice number.
+// If we don't have it in memory, this blocks for up to RedisTimeout while we look in redis
+func (store *SessionStore) Get(ctx context.Context, sessionId uint64, version uint32, sliceNumber uint32) ([]byte, bool) {
+
+	key := sessionStoreKey{sessionId: sessionId, version: version}
+
+	store.mutex.Lock()
+	element, exists := store.entries[key]
+	if exists && element.Value.(*sessionStoreEntry).sliceNumber == sliceNumber {
+		store.lru.MoveToFront(element)
+		store.stats.Hits++
+		data := element.Value.(*sessionStoreEntry).data
+		store.mutex.Unlock()
+		return data, true
+	}
+	store.mutex.Unlock()
+
+	if store.redisClient == nil {
+		store.mutex.Lock()
+		store.stats.Misses++
+		store.mutex.Unlock()
+		return nil, false
+	}
+
+	timeoutContext, cancel := context.WithTimeout(ctx, store.config.RedisTimeout)
+	defer cancel()
+
+	value, err := store.redisClient.Get(timeoutContext, sessionStoreRedisKey(key)).Bytes()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err != nil {
+		if err != redis.Nil {
+			core.Debug("could not get session data from redis: %v", err)
+		}
+		store.stats.Misses++
+		return nil, false
+	}
+
+	// the session data in redis starts with the slice number it is for
+
+	var redisSliceNumber uint32
+	index := 0
+	if !encoding.ReadUint32(value, &index, &redisSliceNumber) || redisSliceNumber != sliceNumber {
+		store.stats.Misses++
+		return nil, false
+	}
+
+	data := value[index:]
+
+	store.insert(sessionStoreEntry{key: key, sliceNumber: sliceNumber, data: data})
+	store.stats.RedisHits++
+
+	return data, true
+}
+
+func (store *SessionStore) GetStats() SessionStoreStats {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.stats
+}
+
+// insert must be called with the mutex held
+func (store *SessionStore) insert(entry sessionStoreEntry) {
+	if element, exists := store.entries[entry.key]; exists {
+		*element.Value.(*sessionStoreEntry) = entry
+		store.lru.MoveToFront(element)
+		return
+	}
+	store.entries[entry.key] = store.lru.PushFront(&entry)
+	for store.lru.Len() > store.config.MaxEntries {
+		oldest := store.lru.Back()
+		store.lru.Remove(oldest)
+		delete(store.entries, oldest.Value.(*sessionStoreEntry).key)
+	}
+}
+
+func (store *SessionStore) updateWriteChannel(ctx context.Context) {
+
+	ticker := time.NewTicker(store.config.BatchDuration)
+
+	batch := make([]sessionStoreEntry, 0, store.config.BatchSize)
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				store.writeBatch(ctx, batch)
+				batch = batch[:0]
+			}
+
+		case entry := <-store.writeChannel:
+			batch = append(batch, entry)
+			if len(batch) >= store.config.BatchSize {
+				store.writeBatch(ctx, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (store *SessionStore) writeBatch(ctx context.Context, batch []sessionStoreEntry) {
+	pipeline := store.redisClient.Pipeline()
+	for i := range batch {
+		value := make([]byte, 4+len(batch[i].data))
+		index := 0
+		encoding.WriteUint32(value, &index, batch[i].sliceNumber)
+		copy(value[index:], batch[i].data)
+		pipeline.Set(ctx, sessionStoreRedisKey(batch[i].key), value, store.config.Expire)
+	}
+	if _, err := pipeline.Exec(ctx); err != nil {
+		core.Warn("could not write %d session data entries to redis: %v", len(batch), err)
+	}
+}
@@ -0,0 +1,151 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore_Memory(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store := common.CreateSessionStore(ctx, nil, common.SessionStoreConfig{MaxEntries: 3})
+
+	store.Put(1, 1, 10, []byte("a"))
+	store.Put(1, 1, 11, []byte("b"))
+
+	// only the latest session data is kept, keyed by session id and version
+
+	data, found := store.Get(ctx, 1, 1, 11)
+	assert.True(t, found)
+	assert.Equal(t, []byte("b"), data)
+
+	_, found = store.Get(ctx, 1, 2, 11)
+	assert.False(t, found)
+
+	_, found = store.Get(ctx, 2, 1, 11)
+	assert.False(t, found)
+
+	// session data for a different slice is not returned
+
+	_, found = store.Get(ctx, 1, 1, 10)
+	assert.False(t, found)
+
+	// the least recently used session data is evicted
+
+	store.Put(2, 1, 0, []byte("c"))
+	store.Put(3, 1, 0, []byte("d"))
+
+	store.Get(ctx, 1, 1, 11)
+
+	store.Put(4, 1, 0, []byte("e"))
+
+	_, found = store.Get(ctx, 2, 1, 0)
+	assert.False(t, found)
+
+	data, found = store.Get(ctx, 1, 1, 11)
+	assert.True(t, found)
+	assert.Equal(t, []byte("b"), data)
+
+	stats := store.GetStats()
+	assert.Equal(t, uint64(5), stats.Writes)
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(4), stats.Misses)
+}
+
+func TestSessionStore_Redis(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	config := common.SessionStoreConfig{BatchDuration: time.Millisecond}
+
+	a := common.CreateSessionStore(ctx, redisClient, config)
+	b := common.CreateSessionStore(ctx, redisClient, config)
+
+	a.Put(1, 1, 10, []byte("a"))
+
+	// session data written by one server backend is picked up by another once it has been written behind to redis
+
+	assert.Eventually(t, func() bool {
+		data, found := b.Get(ctx, 1, 1, 10)
+		return found && string(data) == "a"
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, uint64(1), b.GetStats().RedisHits)
+
+	// and then it's in memory
+
+	data, found := b.Get(ctx, 1, 1, 10)
+	assert.True(t, found)
+	assert.Equal(t, []byte("a"), data)
+	assert.Equal(t, uint64(1), b.GetStats().Hits)
+
+	// session data in redis for a different slice is not returned
+
+	_, found = common.CreateSessionStore(ctx, redisClient, config).Get(ctx, 1, 1, 11)
+	assert.False(t, found)
+
+	// session data expires from redis
+
+	redisServer.FastForward(10 * time.Minute)
+
+	_, found = common.CreateSessionStore(ctx, redisClient, config).Get(ctx, 1, 1, 10)
+	assert.False(t, found)
+}
+
+func TestSessionStore_Bounce(t *testing.T) {
+
+	t.Parallel()
+
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	config := common.SessionStoreConfig{BatchDuration: time.Millisecond}
+
+	a := common.CreateSessionStore(ctx, redisClient, config)
+	b := common.CreateSessionStore(ctx, redisClient, config)
+
+	// the session starts on server backend a
+
+	a.Put(1, 1, 11, []byte("a"))
+
+	// then goes to server backend b, which picks up the session data from redis and writes the next slice
+
+	assert.Eventually(t, func() bool {
+		data, found := b.Get(ctx, 1, 1, 11)
+		return found && string(data) == "a"
+	}, time.Second, time.Millisecond)
+
+	b.Put(1, 1, 12, []byte("b"))
+
+	// then comes back to server backend a. the session data a has in memory is stale, so it reads the newer session data written by b from redis
+
+	assert.Eventually(t, func() bool {
+		data, found := a.Get(ctx, 1, 1, 12)
+		return found && string(data) == "b"
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, uint64(1), a.GetStats().RedisHits)
+
+	// and then it's in memory on a
+
+	data, found := a.Get(ctx, 1, 1, 12)
+	assert.True(t, found)
+	assert.Equal(t, []byte("b"), data)
+}
@@ -35,6 +35,20 @@ const (
 
 	MaxRouteCost = 255
 
+	MaxRouteJitter     = 255
+	MaxRoutePacketLoss = 255
+
+	OptimizeJitterWeight     = 1.0 // the optimizer ranks routes by cost plus the route penalty with these weights. route shaders weigh routes again at route selection
+	OptimizePacketLossWeight = 1.0
+
+	MaxRelayPrice           = 255
+	RelayLoadPriceThreshold = 0.5
+	RelayLoadPriceSteps     = 20 // load is rounded to 5% steps before pricing, so small changes in load don't change relay prices every update
+
+	MaxFlapCount       = 15
+	MaxFlapHoldSlices  = 255
+	MaxFlapQuietSlices = 255
+
 	NextMaxNodes = MaxRouteRelays + 2
 
 	NextAddressBytes      = 19
@@ -64,6 +78,38 @@ const (
 	SessionError_FailedToWriteResponsePacket     = (1 << 15)
 	SessionError_FailedToWriteSessionData        = (1 << 16)
 
+	RouteStateFlags_Next             = (1 << 0)
+	RouteStateFlags_Veto             = (1 << 1)
+	RouteStateFlags_Disabled         = (1 << 2)
+	RouteStateFlags_NotSelected      = (1 << 3)
+	RouteStateFlags_ABTest           = (1 << 4)
+	RouteStateFlags_A                = (1 << 5)
+	RouteStateFlags_B                = (1 << 6)
+	RouteStateFlags_ForcedNext       = (1 << 7)
+	RouteStateFlags_ReduceLatency    = (1 << 8)
+	RouteStateFlags_ReducePacketLoss = (1 << 9)
+	RouteStateFlags_RouteLost        = (1 << 10)
+	RouteStateFlags_NoRoute          = (1 << 11)
+	RouteStateFlags_FlapDamping      = (1 << 12)
+
+	RouteDecision_None                  = 0
+	RouteDecision_NoRouteRelays         = 1
+	RouteDecision_Aborted               = 2
+	RouteDecision_Disabled              = 3
+	RouteDecision_Veto                  = 4
+	RouteDecision_NotSelected           = 5
+	RouteDecision_ABTestB               = 6
+	RouteDecision_LatencyAcceptable     = 7
+	RouteDecision_NoRoute               = 8
+	RouteDecision_TakeNetworkNext       = 9
+	RouteDecision_ForceNext             = 10
+	RouteDecision_RouteContinued        = 11
+	RouteDecision_RouteChanged          = 12
+	RouteDecision_RouteNoLongerSuitable = 13
+	NumRouteDecisions                   = 14
+
+	MaxDecisionCandidateRoutes = 8
+
 	RelayFlags_ShuttingDown = uint64(1)
 
 	RelayStatus_Offline      = 0
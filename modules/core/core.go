@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	crypto_rand "crypto/rand"
 	math_rand "math/rand"
@@ -96,6 +97,14 @@ func TriMatrixIndex(i, j int) int {
 	}
 }
 
+func SquareMatrixLength(size int) int {
+	return size * size
+}
+
+func SquareMatrixIndex(size int, i int, j int) int {
+	return i*size + j
+}
+
 func RandomBytes(buffer []byte) {
 	crypto_rand.Read(buffer)
 }
@@ -173,7 +182,11 @@ func AnonymizeAddress(address net.UDPAddr) net.UDPAddr {
 	ipv4 := address.IP.To4()
 	if ipv4 != nil {
 		return net.UDPAddr{IP: net.IPv4(ipv4[0], ipv4[1], ipv4[2], 0), Port: 0}
+	} else if len(address.IP) != net.IPv6len {
+		return net.UDPAddr{}
 	} else {
+		// IMPORTANT: copy the IP, so we don't modify the address passed in
+		address.IP = append(net.IP{}, address.IP...)
 		address.Port = 0
 		address.IP[6] = 0
 		address.IP[7] = 0
@@ -191,6 +204,15 @@ func AnonymizeAddress(address net.UDPAddr) net.UDPAddr {
 
 // ---------------------------------------------------
 
+/*
+	RouteManager keeps the best routes for a relay pair while the optimizer adds candidate routes.
+
+	When jitter and packet loss matrices are set, each route is ranked by its loss-adjusted cost: its cost plus
+	the route penalty for the jitter and packet loss summed across its hops, using the optimizer weights in
+	constants. Otherwise routes are ranked by cost. Routes are kept in rank order, and once the route set is
+	full the worst ranked route is dropped, so a lossless route isn't pushed out by slightly faster lossy ones.
+*/
+
 type RouteManager struct {
 	NumRoutes       int
 	RouteCost       [constants.MaxRoutesPerEntry]int32
@@ -198,7 +220,12 @@ type RouteManager struct {
 	RouteHash       [constants.MaxRoutesPerEntry]uint32
 	RouteNumRelays  [constants.MaxRoutesPerEntry]int32
 	RouteRelays     [constants.MaxRoutesPerEntry][constants.MaxRouteRelays]int32
+	RouteJitter     [constants.MaxRoutesPerEntry]int32
+	RoutePacketLoss [constants.MaxRoutesPerEntry]int32
+	RouteRank       [constants.MaxRoutesPerEntry]int32
 	RelayDatacenter []uint64
+	Jitter          []uint8 // optional triangular matrix. milliseconds
+	PacketLoss      []uint8 // optional triangular matrix. tenths of a percent
 }
 
 func (manager *RouteManager) AddRoute(cost int32, price int32, relays ...int32) {
@@ -217,22 +244,37 @@ func (manager *RouteManager) AddRoute(cost int32, price int32, relays ...int32)
 		loopCheck[relays[i]] = 1
 	}
 
+	// estimate jitter and packet loss for the route by summing across its hops, and rank by loss-adjusted cost
+
+	routeJitter := int32(0)
+	routePacketLoss := int32(0)
+
+	if manager.Jitter != nil && manager.PacketLoss != nil {
+		for i := 0; i < len(relays)-1; i++ {
+			hopIndex := TriMatrixIndex(int(relays[i]), int(relays[i+1]))
+			routeJitter += int32(manager.Jitter[hopIndex])
+			routePacketLoss += int32(manager.PacketLoss[hopIndex])
+		}
+		if routeJitter > constants.MaxRouteJitter {
+			routeJitter = constants.MaxRouteJitter
+		}
+		if routePacketLoss > constants.MaxRoutePacketLoss {
+			routePacketLoss = constants.MaxRoutePacketLoss
+		}
+	}
+
+	rank := cost + RoutePenalty(routeJitter, routePacketLoss, constants.OptimizeJitterWeight, constants.OptimizePacketLossWeight)
+
 	if manager.NumRoutes == 0 {
 
 		// no routes yet. add the route
 
 		manager.NumRoutes = 1
-		manager.RouteCost[0] = cost
-		manager.RoutePrice[0] = price
-		manager.RouteHash[0] = RouteHash(relays...)
-		manager.RouteNumRelays[0] = int32(len(relays))
-		for i := range relays {
-			manager.RouteRelays[0][i] = relays[i]
-		}
+		manager.setRoute(0, cost, price, RouteHash(relays...), routeJitter, routePacketLoss, rank, relays)
 
 	} else if manager.NumRoutes < constants.MaxRoutesPerEntry {
 
-		// not at max routes yet. insert according cost sort order
+		// not at max routes yet. insert according to rank sort order
 
 		hash := RouteHash(relays...)
 		for i := 0; i < manager.NumRoutes; i++ {
@@ -241,55 +283,37 @@ func (manager *RouteManager) AddRoute(cost int32, price int32, relays ...int32)
 			}
 		}
 
-		if cost >= manager.RouteCost[manager.NumRoutes-1] {
+		if rank >= manager.RouteRank[manager.NumRoutes-1] {
 
-			// cost is greater than existing entries. append.
+			// rank is worse than existing entries. append.
 
-			manager.RouteCost[manager.NumRoutes] = cost
-			manager.RoutePrice[manager.NumRoutes] = price
-			manager.RouteHash[manager.NumRoutes] = hash
-			manager.RouteNumRelays[manager.NumRoutes] = int32(len(relays))
-			for i := range relays {
-				manager.RouteRelays[manager.NumRoutes][i] = relays[i]
-			}
+			manager.setRoute(manager.NumRoutes, cost, price, hash, routeJitter, routePacketLoss, rank, relays)
 			manager.NumRoutes++
 
 		} else {
 
-			// cost is lower than at least one entry. insert.
+			// rank is better than at least one entry. insert.
 
 			insertIndex := manager.NumRoutes - 1
 			for {
-				if insertIndex == 0 || cost > manager.RouteCost[insertIndex-1] {
+				if insertIndex == 0 || rank > manager.RouteRank[insertIndex-1] {
 					break
 				}
 				insertIndex--
 			}
 			manager.NumRoutes++
 			for i := manager.NumRoutes - 1; i > insertIndex; i-- {
-				manager.RouteCost[i] = manager.RouteCost[i-1]
-				manager.RoutePrice[i] = manager.RoutePrice[i-1]
-				manager.RouteHash[i] = manager.RouteHash[i-1]
-				manager.RouteNumRelays[i] = manager.RouteNumRelays[i-1]
-				for j := 0; j < int(manager.RouteNumRelays[i]); j++ {
-					manager.RouteRelays[i][j] = manager.RouteRelays[i-1][j]
-				}
-			}
-			manager.RouteCost[insertIndex] = cost
-			manager.RoutePrice[insertIndex] = price
-			manager.RouteHash[insertIndex] = hash
-			manager.RouteNumRelays[insertIndex] = int32(len(relays))
-			for i := range relays {
-				manager.RouteRelays[insertIndex][i] = relays[i]
+				manager.moveRoute(i, i-1)
 			}
+			manager.setRoute(insertIndex, cost, price, hash, routeJitter, routePacketLoss, rank, relays)
 
 		}
 
 	} else {
 
-		// route set is full. only insert if lower cost than at least one current route.
+		// route set is full. only insert if better rank than at least one current route.
 
-		if cost >= manager.RouteCost[manager.NumRoutes-1] {
+		if rank >= manager.RouteRank[manager.NumRoutes-1] {
 			return
 		}
 
@@ -302,30 +326,43 @@ func (manager *RouteManager) AddRoute(cost int32, price int32, relays ...int32)
 
 		insertIndex := manager.NumRoutes - 1
 		for {
-			if insertIndex == 0 || cost > manager.RouteCost[insertIndex-1] {
+			if insertIndex == 0 || rank > manager.RouteRank[insertIndex-1] {
 				break
 			}
 			insertIndex--
 		}
 
 		for i := manager.NumRoutes - 1; i > insertIndex; i-- {
-			manager.RouteCost[i] = manager.RouteCost[i-1]
-			manager.RoutePrice[i] = manager.RoutePrice[i-1]
-			manager.RouteHash[i] = manager.RouteHash[i-1]
-			manager.RouteNumRelays[i] = manager.RouteNumRelays[i-1]
-			for j := 0; j < int(manager.RouteNumRelays[i]); j++ {
-				manager.RouteRelays[i][j] = manager.RouteRelays[i-1][j]
-			}
+			manager.moveRoute(i, i-1)
 		}
 
-		manager.RouteCost[insertIndex] = cost
-		manager.RoutePrice[insertIndex] = price
-		manager.RouteHash[insertIndex] = hash
-		manager.RouteNumRelays[insertIndex] = int32(len(relays))
+		manager.setRoute(insertIndex, cost, price, hash, routeJitter, routePacketLoss, rank, relays)
+	}
+}
 
-		for i := range relays {
-			manager.RouteRelays[insertIndex][i] = relays[i]
-		}
+func (manager *RouteManager) setRoute(index int, cost int32, price int32, hash uint32, routeJitter int32, routePacketLoss int32, rank int32, relays []int32) {
+	manager.RouteCost[index] = cost
+	manager.RoutePrice[index] = price
+	manager.RouteHash[index] = hash
+	manager.RouteJitter[index] = routeJitter
+	manager.RoutePacketLoss[index] = routePacketLoss
+	manager.RouteRank[index] = rank
+	manager.RouteNumRelays[index] = int32(len(relays))
+	for i := range relays {
+		manager.RouteRelays[index][i] = relays[i]
+	}
+}
+
+func (manager *RouteManager) moveRoute(to int, from int) {
+	manager.RouteCost[to] = manager.RouteCost[from]
+	manager.RoutePrice[to] = manager.RoutePrice[from]
+	manager.RouteHash[to] = manager.RouteHash[from]
+	manager.RouteJitter[to] = manager.RouteJitter[from]
+	manager.RoutePacketLoss[to] = manager.RoutePacketLoss[from]
+	manager.RouteRank[to] = manager.RouteRank[from]
+	manager.RouteNumRelays[to] = manager.RouteNumRelays[from]
+	for j := 0; j < int(manager.RouteNumRelays[to]); j++ {
+		manager.RouteRelays[to][j] = manager.RouteRelays[from][j]
 	}
 }
 
@@ -347,13 +384,15 @@ func RouteHash(relays ...int32) uint32 {
 }
 
 type RouteEntry struct {
-	DirectCost     int32
-	NumRoutes      int32
-	RouteCost      [constants.MaxRoutesPerEntry]int32
-	RoutePrice     [constants.MaxRoutesPerEntry]int32
-	RouteHash      [constants.MaxRoutesPerEntry]uint32
-	RouteNumRelays [constants.MaxRoutesPerEntry]int32
-	RouteRelays    [constants.MaxRoutesPerEntry][constants.MaxRouteRelays]int32
+	DirectCost      int32
+	NumRoutes       int32
+	RouteCost       [constants.MaxRoutesPerEntry]int32
+	RoutePrice      [constants.MaxRoutesPerEntry]int32
+	RouteHash       [constants.MaxRoutesPerEntry]uint32
+	RouteNumRelays  [constants.MaxRoutesPerEntry]int32
+	RouteRelays     [constants.MaxRoutesPerEntry][constants.MaxRouteRelays]int32
+	RouteJitter     [constants.MaxRoutesPerEntry]int32 // milliseconds, summed across each hop in the route
+	RoutePacketLoss [constants.MaxRoutesPerEntry]int32 // tenths of a percent, summed across each hop in the route
 }
 
 func Optimize(numRelays int, numSegments int, cost []uint8, relayPrice []uint8, relayDatacenter []uint64) []RouteEntry {
@@ -556,18 +595,151 @@ func Optimize(numRelays int, numSegments int, cost []uint8, relayPrice []uint8,
 	return routes
 }
 
-func Optimize2(numRelays int, numSegments int, cost []uint8, relayPrice []uint8, relayDatacenter []uint64, destinationRelay []bool) []RouteEntry {
+type indirectRoute struct {
+	relay int32
+	cost  uint32
+}
 
-	// Same as "Optimize", but it only optimizes to relays marked as destination relays.
+func optimizeIndirect(i int, j int, numRelays int, cost []uint8, working []indirectRoute) []indirectRoute {
 
-	// build a matrix of indirect routes from relays i -> j that have lower cost than direct, eg. i -> (x) -> j, where x is every other relay
+	// find indirect routes from relays i -> j that have lower cost than direct, eg. i -> (x) -> j, where x is every other relay
 
-	type Indirect struct {
-		relay int32
-		cost  uint32
+	ijIndex := TriMatrixIndex(i, j)
+
+	numRoutes := 0
+	costDirect := uint32(cost[ijIndex])
+
+	for x := 0; x < numRelays; x++ {
+		if x == i || x == j {
+			continue
+		}
+		ixIndex := TriMatrixIndex(i, x)
+		ixCost := uint32(cost[ixIndex])
+		xjIndex := TriMatrixIndex(x, j)
+		xjCost := uint32(cost[xjIndex])
+		indirectCost := uint32(ixCost) + uint32(xjCost)
+		if indirectCost >= costDirect {
+			continue
+		}
+		working[numRoutes].relay = int32(x)
+		working[numRoutes].cost = indirectCost
+		numRoutes++
 	}
 
-	indirect := make([][][]Indirect, numRelays)
+	var indirect []indirectRoute
+
+	if numRoutes > constants.MaxIndirects {
+		sort.SliceStable(working, func(i, j int) bool { return working[i].cost < working[j].cost })
+		copy(indirect, working[:constants.MaxIndirects])
+	} else if numRoutes > 0 {
+		indirect = make([]indirectRoute, numRoutes)
+		copy(indirect, working)
+	}
+
+	return indirect
+}
+
+func optimizeRouteEntry(i int, j int, cost []uint8, jitter []uint8, packetLoss []uint8, relayPrice []uint8, relayDatacenter []uint64, destinationRelay []bool, indirect [][][]indirectRoute, entry *RouteEntry) {
+
+	var routeManager RouteManager
+
+	routeManager.RelayDatacenter = relayDatacenter
+	routeManager.Jitter = jitter
+	routeManager.PacketLoss = packetLoss
+
+	// add the direct route
+
+	index := TriMatrixIndex(i, j)
+
+	directCost := int32(cost[index])
+
+	if directCost < 255 {
+		routeManager.AddRoute(directCost, int32(relayPrice[i])+int32(relayPrice[j]), int32(i), int32(j))
+	}
+
+	if destinationRelay[i] || destinationRelay[j] {
+
+		// add subdivided routes
+
+		for k_index := range indirect[i][j] {
+
+			k := int(indirect[i][j][k_index].relay)
+
+			ik_cost := cost[TriMatrixIndex(i, k)]
+			kj_cost := cost[TriMatrixIndex(k, j)]
+
+			// i -> (k) -> j
+			{
+				cost := int32(indirect[i][j][k_index].cost)
+				if cost < directCost {
+					routeManager.AddRoute(int32(cost), int32(relayPrice[i])+int32(relayPrice[k])+int32(relayPrice[j]), int32(i), int32(k), int32(j))
+				}
+			}
+
+			// i -> (x) -> k    ->     j
+
+			for x_index := range indirect[i][k] {
+
+				x := indirect[i][k][x_index].relay
+				cost := int32(indirect[i][k][x_index].cost)
+				if cost < directCost {
+					routeManager.AddRoute(int32(cost)+int32(kj_cost), int32(relayPrice[i])+int32(relayPrice[x])+int32(relayPrice[k])+int32(relayPrice[j]), int32(i), int32(x), int32(k), int32(j))
+				}
+			}
+
+			// i        -> k -> (y) -> j
+
+			for y_index := range indirect[k][j] {
+				kyj_cost := indirect[k][j][y_index].cost
+				y := indirect[k][j][y_index].relay
+				cost := int32(ik_cost) + int32(kyj_cost)
+				if cost < directCost {
+					routeManager.AddRoute(cost, int32(relayPrice[i])+int32(relayPrice[k])+int32(relayPrice[y])+int32(relayPrice[j]), int32(i), int32(k), int32(y), int32(j))
+				}
+			}
+
+			// i -> (x) -> k -> (y) -> j
+
+			for x_index := range indirect[i][k] {
+				ixk_cost := indirect[i][k][x_index].cost
+				x := int(indirect[i][k][x_index].relay)
+				for y_index := range indirect[k][j] {
+					kyj_cost := indirect[k][j][y_index].cost
+					y := int(indirect[k][j][y_index].relay)
+					cost := int32(ixk_cost) + int32(kyj_cost)
+					if cost < directCost {
+						routeManager.AddRoute(cost, int32(relayPrice[i])+int32(relayPrice[x])+int32(relayPrice[k])+int32(relayPrice[y])+int32(relayPrice[j]), int32(i), int32(x), int32(k), int32(y), int32(j))
+					}
+				}
+			}
+		}
+	}
+
+	// store the best routes in order of lowest to highest loss-adjusted cost, with the jitter and packet loss estimated for each
+
+	numRoutes := int(routeManager.NumRoutes)
+
+	*entry = RouteEntry{}
+
+	entry.DirectCost = int32(cost[index])
+	entry.NumRoutes = int32(numRoutes)
+
+	for u := 0; u < numRoutes; u++ {
+		entry.RouteCost[u] = routeManager.RouteCost[u]
+		entry.RoutePrice[u] = routeManager.RoutePrice[u]
+		entry.RouteNumRelays[u] = routeManager.RouteNumRelays[u]
+		numRelays := int(entry.RouteNumRelays[u])
+		for v := 0; v < numRelays; v++ {
+			entry.RouteRelays[u][v] = routeManager.RouteRelays[u][v]
+		}
+		entry.RouteHash[u] = routeManager.RouteHash[u]
+		entry.RouteJitter[u] = routeManager.RouteJitter[u]
+		entry.RoutePacketLoss[u] = routeManager.RoutePacketLoss[u]
+	}
+}
+
+// OptimizeSegments splits relays [0,numRelays) into numSegments ranges and calls segmentFunc for each range on its own goroutine
+func OptimizeSegments(numRelays int, numSegments int, segmentFunc func(startIndex int, endIndex int)) {
 
 	var wg sync.WaitGroup
 
@@ -582,17 +754,198 @@ func Optimize2(numRelays int, numSegments int, cost []uint8, relayPrice []uint8,
 		}
 
 		go func(startIndex int, endIndex int) {
-
 			defer wg.Done()
+			segmentFunc(startIndex, endIndex)
+		}(startIndex, endIndex)
+	}
 
-			working := make([]Indirect, numRelays)
+	wg.Wait()
+}
 
-			for i := startIndex; i <= endIndex; i++ {
+func Optimize2(numRelays int, numSegments int, cost []uint8, relayPrice []uint8, relayDatacenter []uint64, destinationRelay []bool) []RouteEntry {
 
-				indirect[i] = make([][]Indirect, numRelays)
+	// Same as "Optimize", but it only optimizes to relays marked as destination relays.
+
+	return Optimize3(numRelays, numSegments, cost, nil, nil, relayPrice, relayDatacenter, destinationRelay)
+}
+
+func Optimize3(numRelays int, numSegments int, cost []uint8, jitter []uint8, packetLoss []uint8, relayPrice []uint8, relayDatacenter []uint64, destinationRelay []bool) []RouteEntry {
+
+	// Same as "Optimize2", but it also estimates jitter and packet loss for each route. Routes are still ranked by cost.
+
+	// Jitter is in milliseconds and packet loss is in tenths of a percent. Pass in nil for each to skip estimation.
+
+	// build a matrix of indirect routes from relays i -> j that have lower cost than direct, eg. i -> (x) -> j, where x is every other relay
+
+	indirect := make([][][]indirectRoute, numRelays)
+
+	OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+
+		working := make([]indirectRoute, numRelays)
+
+		for i := startIndex; i <= endIndex; i++ {
+
+			indirect[i] = make([][]indirectRoute, numRelays)
+
+			for j := 0; j < numRelays; j++ {
+
+				// can't route to self
+				if i == j {
+					continue
+				}
+
+				if !destinationRelay[i] && !destinationRelay[j] {
+					continue
+				}
+
+				indirect[i][j] = optimizeIndirect(i, j, numRelays, cost, working)
+			}
+		}
+	})
+
+	// use the indirect matrix to subdivide routes
+
+	entryCount := TriMatrixLength(numRelays)
+
+	routes := make([]RouteEntry, entryCount)
+
+	OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+		for i := startIndex; i <= endIndex; i++ {
+			for j := 0; j < i; j++ {
+				optimizeRouteEntry(i, j, cost, jitter, packetLoss, relayPrice, relayDatacenter, destinationRelay, indirect, &routes[TriMatrixIndex(i, j)])
+			}
+		}
+	})
+
+	return routes
+}
+
+// ---------------------------------------------------
+
+/*
+	Optimizer is an incremental version of "Optimize3".
+
+	It keeps the inputs, indirect matrix and route entries from the previous call, and only
+	recomputes route entries that can be affected by changed costs, jitter, packet loss, relay prices or destination relays.
+
+	The results are identical to calling "Optimize3" with the same inputs.
+
+	If the number of relays or their datacenters change (eg. the database changed and relay indices
+	have moved), the optimizer falls back to a full optimize.
+*/
+
+type Optimizer struct {
+	NumRelays        int
+	Cost             []uint8
+	Jitter           []uint8
+	PacketLoss       []uint8
+	RelayPrice       []uint8
+	RelayDatacenter  []uint64
+	DestinationRelay []bool
+	Routes           []RouteEntry
+
+	NumDirtyRelays  int
+	NumDirtyEntries int
+	FullOptimize    bool
+
+	indirect [][][]indirectRoute
+}
+
+func (optimizer *Optimizer) Reset() {
+	*optimizer = Optimizer{}
+}
+
+func (optimizer *Optimizer) Optimize(numRelays int, numSegments int, cost []uint8, jitter []uint8, packetLoss []uint8, relayPrice []uint8, relayDatacenter []uint64, destinationRelay []bool) []RouteEntry {
+
+	// full optimize when we have no previous state, or when the relay set has changed
+
+	fullOptimize := optimizer.Routes == nil || optimizer.NumRelays != numRelays || len(optimizer.Cost) != len(cost)
+
+	// full optimize when we start or stop estimating jitter and packet loss
+
+	if (jitter == nil) != (optimizer.Jitter == nil) || (packetLoss == nil) != (optimizer.PacketLoss == nil) {
+		fullOptimize = true
+	}
+
+	if !fullOptimize {
+		for i := range relayDatacenter {
+			if relayDatacenter[i] != optimizer.RelayDatacenter[i] {
+				fullOptimize = true
+				break
+			}
+		}
+	}
+
+	// find relays with changed costs or destination flags. any indirect route touching these relays must be rebuilt.
+
+	dirtyRelay := make([]bool, numRelays)
+
+	// find relays with changed prices. any route entry that includes these relays must be rebuilt.
+
+	dirtyPrice := make([]bool, numRelays)
+
+	if fullOptimize {
+
+		optimizer.indirect = make([][][]indirectRoute, numRelays)
+		for i := 0; i < numRelays; i++ {
+			optimizer.indirect[i] = make([][]indirectRoute, numRelays)
+			dirtyRelay[i] = true
+		}
+
+	} else {
+
+		for i := 0; i < numRelays; i++ {
+			for j := 0; j < i; j++ {
+				index := TriMatrixIndex(i, j)
+				if cost[index] != optimizer.Cost[index] {
+					dirtyRelay[i] = true
+					dirtyRelay[j] = true
+				}
+				if jitter != nil && jitter[index] != optimizer.Jitter[index] {
+					dirtyRelay[i] = true
+					dirtyRelay[j] = true
+				}
+				if packetLoss != nil && packetLoss[index] != optimizer.PacketLoss[index] {
+					dirtyRelay[i] = true
+					dirtyRelay[j] = true
+				}
+			}
+			if destinationRelay[i] != optimizer.DestinationRelay[i] {
+				dirtyRelay[i] = true
+			}
+			if relayPrice[i] != optimizer.RelayPrice[i] {
+				dirtyPrice[i] = true
+			}
+		}
+	}
+
+	numDirtyRelays := 0
+	for i := range dirtyRelay {
+		if dirtyRelay[i] {
+			numDirtyRelays++
+		}
+	}
+
+	// rebuild dirty entries in the indirect matrix
+
+	indirect := optimizer.indirect
+
+	if numDirtyRelays > 0 {
+
+		OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+
+			working := make([]indirectRoute, numRelays)
+
+			for i := startIndex; i <= endIndex; i++ {
 
 				for j := 0; j < numRelays; j++ {
 
+					if !dirtyRelay[i] && !dirtyRelay[j] {
+						continue
+					}
+
+					indirect[i][j] = nil
+
 					// can't route to self
 					if i == j {
 						continue
@@ -602,163 +955,341 @@ func Optimize2(numRelays int, numSegments int, cost []uint8, relayPrice []uint8,
 						continue
 					}
 
-					ijIndex := TriMatrixIndex(i, j)
+					indirect[i][j] = optimizeIndirect(i, j, numRelays, cost, working)
+				}
+			}
+		})
+	}
 
-					numRoutes := 0
-					costDirect := uint32(cost[ijIndex])
+	// rebuild route entries that depend on dirty relays or prices, and copy across the rest
 
-					for x := 0; x < numRelays; x++ {
-						if x == i || x == j {
-							continue
-						}
-						ixIndex := TriMatrixIndex(i, x)
-						ixCost := uint32(cost[ixIndex])
-						xjIndex := TriMatrixIndex(x, j)
-						xjCost := uint32(cost[xjIndex])
-						indirectCost := uint32(ixCost) + uint32(xjCost)
-						if indirectCost >= costDirect {
-							continue
-						}
-						working[numRoutes].relay = int32(x)
-						working[numRoutes].cost = indirectCost
-						numRoutes++
-					}
+	entryCount := TriMatrixLength(numRelays)
 
-					if numRoutes > constants.MaxIndirects {
-						sort.SliceStable(working, func(i, j int) bool { return working[i].cost < working[j].cost })
-						copy(indirect[i][j], working[:constants.MaxIndirects])
-					} else if numRoutes > 0 {
-						indirect[i][j] = make([]Indirect, numRoutes)
-						copy(indirect[i][j], working)
-					}
+	routes := make([]RouteEntry, entryCount)
+
+	entryIsDirty := func(i int, j int) bool {
+		if dirtyRelay[i] || dirtyRelay[j] || dirtyPrice[i] || dirtyPrice[j] {
+			return true
+		}
+		for k_index := range indirect[i][j] {
+			k := indirect[i][j][k_index].relay
+			if dirtyRelay[k] || dirtyPrice[k] {
+				return true
+			}
+			for x_index := range indirect[i][k] {
+				if dirtyPrice[indirect[i][k][x_index].relay] {
+					return true
 				}
 			}
+			for y_index := range indirect[k][j] {
+				if dirtyPrice[indirect[k][j][y_index].relay] {
+					return true
+				}
+			}
+		}
+		return false
+	}
 
-		}(startIndex, endIndex)
+	var numDirtyEntries uint64
+
+	OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+		numDirty := 0
+		for i := startIndex; i <= endIndex; i++ {
+			for j := 0; j < i; j++ {
+				index := TriMatrixIndex(i, j)
+				if fullOptimize || entryIsDirty(i, j) {
+					optimizeRouteEntry(i, j, cost, jitter, packetLoss, relayPrice, relayDatacenter, destinationRelay, indirect, &routes[index])
+					numDirty++
+				} else {
+					routes[index] = optimizer.Routes[index]
+				}
+			}
+		}
+		atomic.AddUint64(&numDirtyEntries, uint64(numDirty))
+	})
+
+	// store the inputs and results so we can optimize incrementally next time
+
+	optimizer.NumRelays = numRelays
+	optimizer.Cost = append(optimizer.Cost[:0], cost...)
+	optimizer.Jitter = nil
+	if jitter != nil {
+		optimizer.Jitter = append([]uint8{}, jitter...)
+	}
+	optimizer.PacketLoss = nil
+	if packetLoss != nil {
+		optimizer.PacketLoss = append([]uint8{}, packetLoss...)
 	}
+	optimizer.RelayPrice = append(optimizer.RelayPrice[:0], relayPrice...)
+	optimizer.RelayDatacenter = append(optimizer.RelayDatacenter[:0], relayDatacenter...)
+	optimizer.DestinationRelay = append(optimizer.DestinationRelay[:0], destinationRelay...)
+	optimizer.Routes = routes
+	optimizer.NumDirtyRelays = numDirtyRelays
+	optimizer.NumDirtyEntries = int(numDirtyEntries)
+	optimizer.FullOptimize = fullOptimize
 
-	wg.Wait()
+	return routes
+}
 
-	// use the indirect matrix to subdivide routes
+// ---------------------------------------------------
 
-	entryCount := TriMatrixLength(numRelays)
+/*
+	OptimizeDirectional is a variant of "Optimize3" for directional cost matrices.
 
-	routes := make([]RouteEntry, entryCount)
+	The directional cost matrix is a square matrix where cost[SquareMatrixIndex(numRelays,i,j)] is the
+	cost measured by relay i to relay j. Internet paths are often asymmetric, and so is game traffic,
+	with most bandwidth going server -> client.
 
-	wg.Add(numSegments)
+	This only helps if cost(i->j) is a one-way measurement. Relays currently only measure round trip
+	time, so the two directions differ by noise alone.
 
-	for segment := 0; segment < numSegments; segment++ {
+	Each hop along a route from client to server is weighted as:
 
-		startIndex := segment * numRelays / numSegments
-		endIndex := (segment+1)*numRelays/numSegments - 1
-		if segment == numSegments-1 {
-			endIndex = numRelays - 1
+		(1-downstreamWeight) * cost(u->v) + downstreamWeight * cost(v->u)
+
+	where u -> v is the client -> server direction of the hop. A downstream weight of 0.5 weighs
+	both directions equally.
+
+	The server side of each route entry is the destination relay. When both or neither relays in the
+	entry are destination relays, the direction is ambiguous and both directions are weighed equally.
+
+	Route entries are triangular with routes starting at relay i for entry (i,j) where i > j, as with
+	"Optimize3", so the route matrix can be used without any changes to route selection.
+
+	Jitter and packet loss are triangular matrices, and are used to estimate route quality only.
+*/
+
+func DirectionalHopCost(numRelays int, directionalCost []uint8, downstreamWeight float32) []uint8 {
+
+	// hop[SquareMatrixIndex(numRelays,u,v)] is the weighted cost of going u -> v on the way from client to server
+
+	hop := make([]uint8, SquareMatrixLength(numRelays))
+
+	for u := 0; u < numRelays; u++ {
+		for v := 0; v < numRelays; v++ {
+			index := SquareMatrixIndex(numRelays, u, v)
+			if u == v {
+				hop[index] = 255
+				continue
+			}
+			upstreamCost := directionalCost[index]
+			downstreamCost := directionalCost[SquareMatrixIndex(numRelays, v, u)]
+			if upstreamCost == 255 || downstreamCost == 255 {
+				hop[index] = 255
+				continue
+			}
+			cost := math.Ceil(float64((1.0-downstreamWeight)*float32(upstreamCost) + downstreamWeight*float32(downstreamCost)))
+			if cost >= 255 {
+				hop[index] = 255
+			} else {
+				hop[index] = uint8(cost)
+			}
 		}
+	}
 
-		go func(startIndex int, endIndex int) {
+	return hop
+}
 
-			defer wg.Done()
+func optimizeIndirectDirectional(i int, j int, numRelays int, hop []uint8, working []indirectRoute) []indirectRoute {
 
-			for i := startIndex; i <= endIndex; i++ {
+	// find indirect routes i -> (x) -> j that have lower cost than i -> j direct, in that direction only
 
-				for j := 0; j < i; j++ {
+	numRoutes := 0
+	costDirect := uint32(hop[SquareMatrixIndex(numRelays, i, j)])
 
-					var routeManager RouteManager
+	for x := 0; x < numRelays; x++ {
+		if x == i || x == j {
+			continue
+		}
+		indirectCost := uint32(hop[SquareMatrixIndex(numRelays, i, x)]) + uint32(hop[SquareMatrixIndex(numRelays, x, j)])
+		if indirectCost >= costDirect {
+			continue
+		}
+		working[numRoutes].relay = int32(x)
+		working[numRoutes].cost = indirectCost
+		numRoutes++
+	}
 
-					routeManager.RelayDatacenter = relayDatacenter
+	if numRoutes == 0 {
+		return nil
+	}
 
-					// add the direct route
+	if numRoutes > constants.MaxIndirects {
+		sort.SliceStable(working[:numRoutes], func(a, b int) bool { return working[a].cost < working[b].cost })
+		numRoutes = constants.MaxIndirects
+	}
 
-					index := TriMatrixIndex(i, j)
+	indirect := make([]indirectRoute, numRoutes)
+	copy(indirect, working[:numRoutes])
 
-					directCost := int32(cost[index])
+	return indirect
+}
 
-					if directCost < 255 {
-						routeManager.AddRoute(directCost, int32(relayPrice[i])+int32(relayPrice[j]), int32(i), int32(j))
-					}
+func optimizeRouteEntryDirectional(client int, server int, numRelays int, hop []uint8, relayPrice []uint8, relayDatacenter []uint64, indirect [][][]indirectRoute, routeManager *RouteManager) {
 
-					if destinationRelay[i] || destinationRelay[j] {
+	// same as "optimizeRouteEntry", but routes go from client -> server and hop costs are directional
 
-						// add subdivided routes
+	routeManager.RelayDatacenter = relayDatacenter
 
-						for k_index := range indirect[i][j] {
+	hopCost := func(u int, v int) int32 {
+		return int32(hop[SquareMatrixIndex(numRelays, u, v)])
+	}
 
-							k := int(indirect[i][j][k_index].relay)
+	directCost := hopCost(client, server)
 
-							ik_cost := cost[TriMatrixIndex(i, k)]
-							kj_cost := cost[TriMatrixIndex(k, j)]
+	if directCost < 255 {
+		routeManager.AddRoute(directCost, int32(relayPrice[client])+int32(relayPrice[server]), int32(client), int32(server))
+	}
 
-							// i -> (k) -> j
-							{
-								cost := int32(indirect[i][j][k_index].cost)
-								if cost < directCost {
-									routeManager.AddRoute(int32(cost), int32(relayPrice[i])+int32(relayPrice[k])+int32(relayPrice[j]), int32(i), int32(k), int32(j))
-								}
-							}
+	for k_index := range indirect[client][server] {
 
-							// i -> (x) -> k    ->     j
+		k := int(indirect[client][server][k_index].relay)
+
+		// client -> (k) -> server
+		{
+			cost := int32(indirect[client][server][k_index].cost)
+			if cost < directCost {
+				routeManager.AddRoute(cost, int32(relayPrice[client])+int32(relayPrice[k])+int32(relayPrice[server]), int32(client), int32(k), int32(server))
+			}
+		}
 
-							for x_index := range indirect[i][k] {
+		// client -> (x) -> k    ->     server
 
-								x := indirect[i][k][x_index].relay
-								cost := int32(indirect[i][k][x_index].cost)
-								if cost < directCost {
-									routeManager.AddRoute(int32(cost)+int32(kj_cost), int32(relayPrice[i])+int32(relayPrice[x])+int32(relayPrice[k])+int32(relayPrice[j]), int32(i), int32(x), int32(k), int32(j))
-								}
-							}
+		for x_index := range indirect[client][k] {
+			x := int(indirect[client][k][x_index].relay)
+			cost := int32(indirect[client][k][x_index].cost) + hopCost(k, server)
+			if cost < directCost {
+				routeManager.AddRoute(cost, int32(relayPrice[client])+int32(relayPrice[x])+int32(relayPrice[k])+int32(relayPrice[server]), int32(client), int32(x), int32(k), int32(server))
+			}
+		}
+
+		// client        -> k -> (y) -> server
+
+		for y_index := range indirect[k][server] {
+			y := int(indirect[k][server][y_index].relay)
+			cost := hopCost(client, k) + int32(indirect[k][server][y_index].cost)
+			if cost < directCost {
+				routeManager.AddRoute(cost, int32(relayPrice[client])+int32(relayPrice[k])+int32(relayPrice[y])+int32(relayPrice[server]), int32(client), int32(k), int32(y), int32(server))
+			}
+		}
+
+		// client -> (x) -> k -> (y) -> server
+
+		for x_index := range indirect[client][k] {
+			x := int(indirect[client][k][x_index].relay)
+			for y_index := range indirect[k][server] {
+				y := int(indirect[k][server][y_index].relay)
+				cost := int32(indirect[client][k][x_index].cost) + int32(indirect[k][server][y_index].cost)
+				if cost < directCost {
+					routeManager.AddRoute(cost, int32(relayPrice[client])+int32(relayPrice[x])+int32(relayPrice[k])+int32(relayPrice[y])+int32(relayPrice[server]), int32(client), int32(x), int32(k), int32(y), int32(server))
+				}
+			}
+		}
+	}
+}
+
+func OptimizeDirectional(numRelays int, numSegments int, directionalCost []uint8, jitter []uint8, packetLoss []uint8, relayPrice []uint8, relayDatacenter []uint64, destinationRelay []bool, downstreamWeight float32) []RouteEntry {
+
+	// weighted hop costs when we know which end is the server, and symmetric hop costs when we don't
+
+	weightedHop := DirectionalHopCost(numRelays, directionalCost, downstreamWeight)
+	symmetricHop := DirectionalHopCost(numRelays, directionalCost, 0.5)
+
+	// build indirect matrices for both
+
+	weightedIndirect := make([][][]indirectRoute, numRelays)
+	symmetricIndirect := make([][][]indirectRoute, numRelays)
+
+	OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+
+		working := make([]indirectRoute, numRelays)
+
+		for i := startIndex; i <= endIndex; i++ {
+
+			weightedIndirect[i] = make([][]indirectRoute, numRelays)
+			symmetricIndirect[i] = make([][]indirectRoute, numRelays)
+
+			for j := 0; j < numRelays; j++ {
+
+				// can't route to self
+				if i == j {
+					continue
+				}
+
+				if !destinationRelay[i] && !destinationRelay[j] {
+					continue
+				}
+
+				weightedIndirect[i][j] = optimizeIndirectDirectional(i, j, numRelays, weightedHop, working)
+				symmetricIndirect[i][j] = optimizeIndirectDirectional(i, j, numRelays, symmetricHop, working)
+			}
+		}
+	})
+
+	// build route entries
+
+	entryCount := TriMatrixLength(numRelays)
+
+	routes := make([]RouteEntry, entryCount)
+
+	OptimizeSegments(numRelays, numSegments, func(startIndex int, endIndex int) {
+
+		for i := startIndex; i <= endIndex; i++ {
+
+			for j := 0; j < i; j++ {
+
+				entry := &routes[TriMatrixIndex(i, j)]
+
+				*entry = RouteEntry{}
+
+				// work out which end is the server. when it's ambiguous, route i -> j with symmetric costs
+
+				client, server := i, j
+				hop := symmetricHop
+				indirect := symmetricIndirect
+
+				if destinationRelay[j] && !destinationRelay[i] {
+					hop = weightedHop
+					indirect = weightedIndirect
+				} else if destinationRelay[i] && !destinationRelay[j] {
+					client, server = j, i
+					hop = weightedHop
+					indirect = weightedIndirect
+				}
 
-							// i        -> k -> (y) -> j
+				entry.DirectCost = int32(hop[SquareMatrixIndex(numRelays, client, server)])
 
-							for y_index := range indirect[k][j] {
-								kyj_cost := indirect[k][j][y_index].cost
-								y := indirect[k][j][y_index].relay
-								cost := int32(ik_cost) + int32(kyj_cost)
-								if cost < directCost {
-									routeManager.AddRoute(cost, int32(relayPrice[i])+int32(relayPrice[k])+int32(relayPrice[y])+int32(relayPrice[j]), int32(i), int32(k), int32(y), int32(j))
-								}
-							}
+				var routeManager RouteManager
 
-							// i -> (x) -> k -> (y) -> j
-
-							for x_index := range indirect[i][k] {
-								ixk_cost := indirect[i][k][x_index].cost
-								x := int(indirect[i][k][x_index].relay)
-								for y_index := range indirect[k][j] {
-									kyj_cost := indirect[k][j][y_index].cost
-									y := int(indirect[k][j][y_index].relay)
-									cost := int32(ixk_cost) + int32(kyj_cost)
-									if cost < directCost {
-										routeManager.AddRoute(cost, int32(relayPrice[i])+int32(relayPrice[x])+int32(relayPrice[k])+int32(relayPrice[y])+int32(relayPrice[j]), int32(i), int32(x), int32(k), int32(y), int32(j))
-									}
-								}
-							}
-						}
-					}
+				routeManager.Jitter = jitter
+				routeManager.PacketLoss = packetLoss
 
-					// store the best routes in order of lowest to highest cost
+				optimizeRouteEntryDirectional(client, server, numRelays, hop, relayPrice, relayDatacenter, indirect, &routeManager)
 
-					numRoutes := int(routeManager.NumRoutes)
+				// store the best routes in order of lowest to highest loss-adjusted cost. routes in entry (i,j) always start at relay i
 
-					routes[index].DirectCost = int32(cost[index])
-					routes[index].NumRoutes = int32(numRoutes)
+				numRoutes := routeManager.NumRoutes
 
-					for u := 0; u < numRoutes; u++ {
-						routes[index].RouteCost[u] = routeManager.RouteCost[u]
-						routes[index].RoutePrice[u] = routeManager.RoutePrice[u]
-						routes[index].RouteNumRelays[u] = routeManager.RouteNumRelays[u]
-						numRelays := int(routes[index].RouteNumRelays[u])
-						for v := 0; v < numRelays; v++ {
-							routes[index].RouteRelays[u][v] = routeManager.RouteRelays[u][v]
-						}
-						routes[index].RouteHash[u] = routeManager.RouteHash[u]
+				entry.NumRoutes = int32(numRoutes)
+
+				for u := 0; u < numRoutes; u++ {
+					entry.RouteCost[u] = routeManager.RouteCost[u]
+					entry.RoutePrice[u] = routeManager.RoutePrice[u]
+					entry.RouteNumRelays[u] = routeManager.RouteNumRelays[u]
+					routeNumRelays := int(entry.RouteNumRelays[u])
+					for v := 0; v < routeNumRelays; v++ {
+						entry.RouteRelays[u][v] = routeManager.RouteRelays[u][v]
 					}
+					if client != i {
+						ReverseRoute(entry.RouteRelays[u][:routeNumRelays])
+					}
+					entry.RouteHash[u] = RouteHash(entry.RouteRelays[u][:routeNumRelays]...)
+					entry.RouteJitter[u] = routeManager.RouteJitter[u]
+					entry.RoutePacketLoss[u] = routeManager.RoutePacketLoss[u]
 				}
 			}
-
-		}(startIndex, endIndex)
-	}
-
-	wg.Wait()
+		}
+	})
 
 	return routes
 }
@@ -1032,7 +1563,106 @@ func WriteContinueTokens(tokenData []byte, expireTimestamp uint64, sessionId uin
 
 // -----------------------------------------------------------------------------
 
-func GetBestRouteCost(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32) int32 {
+// RelayPeakHour and EffectiveRelayPrice take the hour of day in UTC. Seller peak hours are in UTC too.
+
+func RelayPeakHour(hour int, peakStartHour int, peakEndHour int) bool {
+	if peakStartHour == peakEndHour {
+		return false
+	}
+	if peakStartHour < peakEndHour {
+		return hour >= peakStartHour && hour < peakEndHour
+	}
+	// peak hours wrap around midnight
+	return hour >= peakStartHour || hour < peakEndHour
+}
+
+func EffectiveRelayPrice(bandwidthPrice int, hour int, peakStartHour int, peakEndHour int, peakPriceMultiplier float32, sessions int, maxSessions int) uint8 {
+
+	price := float64(bandwidthPrice)
+
+	// sellers can charge more for bandwidth during peak hours
+
+	if peakPriceMultiplier > 0 && RelayPeakHour(hour, peakStartHour, peakEndHour) {
+		price *= float64(peakPriceMultiplier)
+	}
+
+	if price > constants.MaxRelayPrice {
+		price = constants.MaxRelayPrice
+	}
+
+	// once a relay is past the load threshold, ramp its price up to max price at max sessions, so traffic moves to other relays
+
+	if maxSessions > 0 && sessions > 0 {
+		load := float64(sessions) / float64(maxSessions)
+		if load > 1.0 {
+			load = 1.0
+		}
+		load = math.Round(load*constants.RelayLoadPriceSteps) / constants.RelayLoadPriceSteps
+		if load > constants.RelayLoadPriceThreshold {
+			price += (constants.MaxRelayPrice - price) * (load - constants.RelayLoadPriceThreshold) / (1.0 - constants.RelayLoadPriceThreshold)
+		}
+	}
+
+	if price < 0 {
+		return 0
+	}
+
+	return uint8(math.Ceil(price))
+}
+
+// RelayHeadroom returns the percentage of a relay's capacity that is still free, [0,100], where 0 means the relay is full.
+// A relay is limited by both its max sessions and its port speed (mbps), whichever is closer to being used up. Limits of zero are unlimited.
+func RelayHeadroom(sessions int, maxSessions int, bandwidthKbps int, portSpeed int) uint8 {
+
+	utilization := 0.0
+
+	if maxSessions > 0 {
+		utilization = math.Max(utilization, float64(sessions)/float64(maxSessions))
+	}
+
+	if portSpeed > 0 {
+		utilization = math.Max(utilization, float64(bandwidthKbps)/float64(portSpeed*1000))
+	}
+
+	if utilization >= 1.0 {
+		return 0
+	}
+
+	return uint8(math.Round(100.0 * (1.0 - utilization)))
+}
+
+// -----------------------------------------------------------------------------
+
+func RoutePenalty(routeJitter int32, routePacketLoss int32, jitterWeight float32, packetLossWeight float32) int32 {
+
+	// convert route jitter (ms) and packet loss (tenths of a percent) into an equivalent cost in milliseconds of RTT
+
+	if jitterWeight <= 0 && packetLossWeight <= 0 {
+		return 0
+	}
+
+	penalty := float64(jitterWeight)*float64(routeJitter) + float64(packetLossWeight)*float64(routePacketLoss)/10.0
+	if penalty <= 0 {
+		return 0
+	}
+
+	return int32(math.Ceil(penalty))
+}
+
+func RouteHasExcludedRelay(excludedRelays []bool, routeNumRelays int32, routeRelays *[constants.MaxRouteRelays]int32) bool {
+	if excludedRelays == nil {
+		return false
+	}
+	for i := 0; i < int(routeNumRelays); i++ {
+		relayIndex := routeRelays[i]
+		if relayIndex >= 0 && int(relayIndex) < len(excludedRelays) && excludedRelays[relayIndex] {
+			return true
+		}
+	}
+	return false
+}
+
+func GetBestRouteCost(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, jitterWeight float32, packetLossWeight float32) int32 {
 
 	bestRouteCost := int32(math.MaxInt32)
 
@@ -1060,8 +1690,14 @@ func GetBestRouteCost(routeMatrix []RouteEntry, sourceRelays []int32, sourceRela
 
 			entry := &routeMatrix[index]
 
-			if entry.NumRoutes > 0 {
-				cost := sourceRelayCost[i] + entry.RouteCost[0] // first entry is always lowest cost
+			for k := 0; k < int(entry.NumRoutes); k++ {
+
+				if RouteHasExcludedRelay(excludedRelays, entry.RouteNumRelays[k], &entry.RouteRelays[k]) {
+					continue
+				}
+
+				// IMPORTANT: routes are sorted by loss-adjusted cost, so a route further down can have the lowest cost or weighted cost
+				cost := sourceRelayCost[i] + entry.RouteCost[k] + RoutePenalty(entry.RouteJitter[k], entry.RoutePacketLoss[k], jitterWeight, packetLossWeight)
 				if cost < bestRouteCost {
 					bestRouteCost = cost
 				}
@@ -1110,7 +1746,7 @@ func RouteExists(routeMatrix []RouteEntry, routeNumRelays int32, routeRelays [co
 	return false
 }
 
-func GetCurrentRouteCost(routeMatrix []RouteEntry, routeNumRelays int32, routeRelays [constants.MaxRouteRelays]int32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, debug *string) int32 {
+func GetCurrentRouteCost(routeMatrix []RouteEntry, routeNumRelays int32, routeRelays [constants.MaxRouteRelays]int32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, debug *string) int32 {
 
 	// IMPORTANT: This shouldn't happen. Triaging...
 	if len(routeRelays) == 0 {
@@ -1172,6 +1808,12 @@ func GetCurrentRouteCost(routeMatrix []RouteEntry, routeNumRelays int32, routeRe
 		if entry.RouteNumRelays[i] != routeNumRelays {
 			continue
 		}
+		if RouteHasExcludedRelay(excludedRelays, entry.RouteNumRelays[i], &entry.RouteRelays[i]) {
+			if debug != nil {
+				*debug += "route contains an excluded relay\n"
+			}
+			return -1
+		}
 		return sourceCost + entry.RouteCost[i] + constants.CostBias
 	}
 
@@ -1182,15 +1824,56 @@ func GetCurrentRouteCost(routeMatrix []RouteEntry, routeNumRelays int32, routeRe
 	return -1
 }
 
+func GetCurrentRoutePenalty(routeMatrix []RouteEntry, routeNumRelays int32, routeRelays [constants.MaxRouteRelays]int32, jitterWeight float32, packetLossWeight float32) int32 {
+
+	if jitterWeight <= 0 && packetLossWeight <= 0 {
+		return 0
+	}
+
+	if len(routeMatrix) == 0 || routeNumRelays <= 0 {
+		return 0
+	}
+
+	if routeRelays[0] < routeRelays[routeNumRelays-1] {
+		ReverseRoute(routeRelays[:routeNumRelays])
+	}
+
+	sourceRelayIndex := routeRelays[0]
+	destRelayIndex := routeRelays[routeNumRelays-1]
+	if sourceRelayIndex == destRelayIndex {
+		return 0
+	}
+
+	routeHash := RouteHash(routeRelays[:routeNumRelays]...)
+	index := TriMatrixIndex(int(sourceRelayIndex), int(destRelayIndex))
+	entry := &routeMatrix[index]
+	for i := 0; i < int(entry.NumRoutes); i++ {
+		if entry.RouteHash[i] != routeHash || entry.RouteNumRelays[i] != routeNumRelays {
+			continue
+		}
+		return RoutePenalty(entry.RouteJitter[i], entry.RoutePacketLoss[i], jitterWeight, packetLossWeight)
+	}
+
+	return 0
+}
+
 type BestRoute struct {
 	Cost          int32
+	WeightedCost  int32
 	Price         int32
+	Jitter        int32
+	PacketLoss    int32
 	NumRelays     int32
 	Relays        [constants.MaxRouteRelays]int32
 	NeedToReverse bool
 }
 
-func GetBestRoutes(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, maxCost int32, bestRoutes []BestRoute, numBestRoutes *int) {
+// RouteCandidates holds the routes found while making a route decision, so they can be recorded without searching the route matrix again
+type RouteCandidates struct {
+	Routes []BestRoute
+}
+
+func GetBestRoutes(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, maxCost int32, jitterWeight float32, packetLossWeight float32, bestRoutes []BestRoute, numBestRoutes *int) {
 
 	if len(routeMatrix) == 0 {
 		*numBestRoutes = 0
@@ -1226,14 +1909,27 @@ func GetBestRoutes(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCo
 
 			for k := 0; k < int(entry.NumRoutes); k++ {
 
+				// IMPORTANT: routes are sorted by loss-adjusted cost, not cost, so we can't break here
 				cost := entry.RouteCost[k] + sourceRelayCost[i]
 
 				if cost > maxCost {
-					break
+					continue
+				}
+
+				if RouteHasExcludedRelay(excludedRelays, entry.RouteNumRelays[k], &entry.RouteRelays[k]) {
+					continue
+				}
+
+				weightedCost := cost + RoutePenalty(entry.RouteJitter[k], entry.RoutePacketLoss[k], jitterWeight, packetLossWeight)
+				if weightedCost > maxCost {
+					continue
 				}
 
 				bestRoutes[numRoutes].Cost = cost
+				bestRoutes[numRoutes].WeightedCost = weightedCost
 				bestRoutes[numRoutes].Price = entry.RoutePrice[k]
+				bestRoutes[numRoutes].Jitter = entry.RouteJitter[k]
+				bestRoutes[numRoutes].PacketLoss = entry.RoutePacketLoss[k]
 				bestRoutes[numRoutes].NumRelays = entry.RouteNumRelays[k]
 
 				for l := 0; l < len(entry.RouteRelays[0]); l++ {
@@ -1259,6 +1955,103 @@ func GetBestRoutes(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCo
 	*numBestRoutes = numRoutes
 }
 
+func RoutesAreRelayDisjoint(routeNumRelaysA int32, routeRelaysA []int32, routeNumRelaysB int32, routeRelaysB []int32) bool {
+	for i := 0; i < int(routeNumRelaysA); i++ {
+		for j := 0; j < int(routeNumRelaysB); j++ {
+			if routeRelaysA[i] == routeRelaysB[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func GetBestDisjointRoute(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, maxCost int32, jitterWeight float32, packetLossWeight float32, routeNumRelays int32, routeRelays []int32, out_disjointRouteCost *int32, out_disjointRouteNumRelays *int32, out_disjointRouteRelays *[constants.MaxRouteRelays]int32, debug *string) bool {
+
+	// find the lowest weighted cost route that shares no relays with the route passed in
+
+	if len(routeMatrix) == 0 || routeNumRelays == 0 {
+		return false
+	}
+
+	found := false
+	bestWeightedCost := int32(math.MaxInt32)
+	bestRoute := BestRoute{}
+
+	for i := range sourceRelays {
+
+		// IMPORTANT: RTT = 255 signals the source relay is unroutable
+		if sourceRelayCost[i] >= 255 {
+			continue
+		}
+
+		sourceRelayIndex := sourceRelays[i]
+
+		for j := range destRelays {
+
+			destRelayIndex := destRelays[j]
+
+			if sourceRelayIndex == destRelayIndex {
+				continue
+			}
+
+			index := TriMatrixIndex(int(sourceRelayIndex), int(destRelayIndex))
+
+			entry := &routeMatrix[index]
+
+			for k := 0; k < int(entry.NumRoutes); k++ {
+
+				// IMPORTANT: routes are sorted by loss-adjusted cost, not cost, so we can't break here
+				cost := entry.RouteCost[k] + sourceRelayCost[i]
+
+				if cost > maxCost {
+					continue
+				}
+
+				if RouteHasExcludedRelay(excludedRelays, entry.RouteNumRelays[k], &entry.RouteRelays[k]) {
+					continue
+				}
+
+				if !RoutesAreRelayDisjoint(routeNumRelays, routeRelays, entry.RouteNumRelays[k], entry.RouteRelays[k][:]) {
+					continue
+				}
+
+				weightedCost := cost + RoutePenalty(entry.RouteJitter[k], entry.RoutePacketLoss[k], jitterWeight, packetLossWeight)
+				if weightedCost > maxCost || weightedCost >= bestWeightedCost {
+					continue
+				}
+
+				found = true
+				bestWeightedCost = weightedCost
+				bestRoute.Cost = cost
+				bestRoute.NumRelays = entry.RouteNumRelays[k]
+				bestRoute.Relays = entry.RouteRelays[k]
+				bestRoute.NeedToReverse = sourceRelayIndex < destRelayIndex
+			}
+		}
+	}
+
+	if !found {
+		if debug != nil {
+			*debug += fmt.Sprintf("could not find a relay disjoint route <= max cost %d\n", maxCost)
+		}
+		return false
+	}
+
+	*out_disjointRouteCost = bestRoute.Cost + constants.CostBias
+	*out_disjointRouteNumRelays = bestRoute.NumRelays
+
+	if !bestRoute.NeedToReverse {
+		copy(out_disjointRouteRelays[:], bestRoute.Relays[:bestRoute.NumRelays])
+	} else {
+		for i := int32(0); i < bestRoute.NumRelays; i++ {
+			out_disjointRouteRelays[bestRoute.NumRelays-1-i] = bestRoute.Relays[i]
+		}
+	}
+
+	return true
+}
+
 // -------------------------------------------
 
 func ReframeRoute(relayIdToIndex map[uint64]int32, routeRelayIds []uint64, out_routeRelays *[constants.MaxRouteRelays]int32) bool {
@@ -1413,13 +2206,13 @@ func ReframeDestRelays(relayIdToIndex map[uint64]int32, destRelayId []uint64, ex
 
 // ----------------------------------------------
 
-func GetRandomBestRoute(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, maxCost int32, threshold int32, out_bestRouteCost *int32, out_bestRouteNumRelays *int32, out_bestRouteRelays *[constants.MaxRouteRelays]int32, debug *string) bool {
+func GetRandomBestRoute(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, maxCost int32, threshold int32, jitterWeight float32, packetLossWeight float32, out_bestRouteCost *int32, out_bestRouteNumRelays *int32, out_bestRouteRelays *[constants.MaxRouteRelays]int32, debug *string, candidates *RouteCandidates) bool {
 
 	if maxCost == -1 {
 		return false
 	}
 
-	bestRouteCost := GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays)
+	bestRouteCost := GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, jitterWeight, packetLossWeight)
 	if debug != nil {
 		*debug += fmt.Sprintf("best route cost is %d\n", bestRouteCost)
 	}
@@ -1434,7 +2227,11 @@ func GetRandomBestRoute(routeMatrix []RouteEntry, sourceRelays []int32, sourceRe
 
 	numBestRoutes := 0
 	bestRoutes := make([]BestRoute, 1024)
-	GetBestRoutes(routeMatrix, sourceRelays, sourceRelayCost, destRelays, bestRouteCost+threshold, bestRoutes, &numBestRoutes)
+	GetBestRoutes(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, bestRouteCost+threshold, jitterWeight, packetLossWeight, bestRoutes, &numBestRoutes)
+	if candidates != nil {
+		candidates.Routes = bestRoutes[:numBestRoutes]
+	}
+
 	if numBestRoutes == 0 {
 		if debug != nil {
 			*debug += "could not find any next routes\n"
@@ -1469,13 +2266,13 @@ func GetRandomBestRoute(routeMatrix []RouteEntry, sourceRelays []int32, sourceRe
 	return true
 }
 
-func GetRandomBestRoute_LowestPrice(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, maxCost int32, threshold int32, out_bestRouteCost *int32, out_bestRouteNumRelays *int32, out_bestRouteRelays *[constants.MaxRouteRelays]int32, debug *string) bool {
+func GetRandomBestRoute_LowestPrice(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, maxCost int32, threshold int32, jitterWeight float32, packetLossWeight float32, out_bestRouteCost *int32, out_bestRouteNumRelays *int32, out_bestRouteRelays *[constants.MaxRouteRelays]int32, debug *string, candidates *RouteCandidates) bool {
 
 	if maxCost == -1 {
 		return false
 	}
 
-	bestRouteCost := GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays)
+	bestRouteCost := GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, jitterWeight, packetLossWeight)
 	if debug != nil {
 		*debug += fmt.Sprintf("best route cost is %d\n", bestRouteCost)
 	}
@@ -1490,7 +2287,11 @@ func GetRandomBestRoute_LowestPrice(routeMatrix []RouteEntry, sourceRelays []int
 
 	numBestRoutes := 0
 	bestRoutes := make([]BestRoute, 1024)
-	GetBestRoutes(routeMatrix, sourceRelays, sourceRelayCost, destRelays, bestRouteCost+threshold, bestRoutes, &numBestRoutes)
+	GetBestRoutes(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, bestRouteCost+threshold, jitterWeight, packetLossWeight, bestRoutes, &numBestRoutes)
+	if candidates != nil {
+		candidates.Routes = bestRoutes[:numBestRoutes]
+	}
+
 	if numBestRoutes == 0 {
 		if debug != nil {
 			*debug += "could not find any next routes\n"
@@ -1556,22 +2357,22 @@ func GetRandomBestRoute_LowestPrice(routeMatrix []RouteEntry, sourceRelays []int
 
 // --------------------------------------------------------------------------------------------------------------------
 
-func GetBestRoute_Initial(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, maxCost int32, selectThreshold int32, out_bestRouteCost *int32, out_bestRouteNumRelays *int32, out_bestRouteRelays *[constants.MaxRouteRelays]int32, debug *string) bool {
+func GetBestRoute_Initial(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, maxCost int32, selectThreshold int32, jitterWeight float32, packetLossWeight float32, out_bestRouteCost *int32, out_bestRouteNumRelays *int32, out_bestRouteRelays *[constants.MaxRouteRelays]int32, debug *string, candidates *RouteCandidates) bool {
 
-	return GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelays, sourceRelayCost, destRelays, maxCost, selectThreshold, out_bestRouteCost, out_bestRouteNumRelays, out_bestRouteRelays, debug)
+	return GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, maxCost, selectThreshold, jitterWeight, packetLossWeight, out_bestRouteCost, out_bestRouteNumRelays, out_bestRouteRelays, debug, candidates)
 }
 
-func GetBestRoute_Update(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, maxCost int32, selectThreshold int32, switchThreshold int32, currentRouteNumRelays int32, currentRouteRelays [constants.MaxRouteRelays]int32, out_updatedRouteCost *int32, out_updatedRouteNumRelays *int32, out_updatedRouteRelays *[constants.MaxRouteRelays]int32, debug *string) (routeChanged bool, routeLost bool) {
+func GetBestRoute_Update(routeMatrix []RouteEntry, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, maxCost int32, selectThreshold int32, switchThreshold int32, jitterWeight float32, packetLossWeight float32, currentRouteNumRelays int32, currentRouteRelays [constants.MaxRouteRelays]int32, out_updatedRouteCost *int32, out_updatedRouteNumRelays *int32, out_updatedRouteRelays *[constants.MaxRouteRelays]int32, debug *string, candidates *RouteCandidates) (routeChanged bool, routeLost bool) {
 
 	// if the current route no longer exists, pick a new route
 
-	currentRouteCost := GetCurrentRouteCost(routeMatrix, currentRouteNumRelays, currentRouteRelays, sourceRelays, sourceRelayCost, destRelays, debug)
+	currentRouteCost := GetCurrentRouteCost(routeMatrix, currentRouteNumRelays, currentRouteRelays, sourceRelays, sourceRelayCost, destRelays, excludedRelays, debug)
 
 	if currentRouteCost < 0 {
 		if debug != nil {
 			*debug += "current route no longer exists. picking a new random route\n"
 		}
-		GetRandomBestRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, maxCost, selectThreshold, out_updatedRouteCost, out_updatedRouteNumRelays, out_updatedRouteRelays, debug)
+		GetRandomBestRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, maxCost, selectThreshold, jitterWeight, packetLossWeight, out_updatedRouteCost, out_updatedRouteNumRelays, out_updatedRouteRelays, debug, candidates)
 		routeChanged = true
 		routeLost = true
 		return
@@ -1579,13 +2380,15 @@ func GetBestRoute_Update(routeMatrix []RouteEntry, sourceRelays []int32, sourceR
 
 	// if the current route is no longer within threshold of the best route, pick a new the route
 
-	bestRouteCost := GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays)
+	bestRouteCost := GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, jitterWeight, packetLossWeight)
+
+	currentRouteWeightedCost := currentRouteCost + GetCurrentRoutePenalty(routeMatrix, currentRouteNumRelays, currentRouteRelays, jitterWeight, packetLossWeight)
 
-	if int64(currentRouteCost) > int64(bestRouteCost)+int64(switchThreshold) {
+	if int64(currentRouteWeightedCost) > int64(bestRouteCost)+int64(switchThreshold) {
 		if debug != nil {
-			*debug += fmt.Sprintf("current route no longer within switch threshold of best route. picking a new random route.\ncurrent route cost = %d, best route cost = %d, route switch threshold = %d\n", currentRouteCost, bestRouteCost, switchThreshold)
+			*debug += fmt.Sprintf("current route no longer within switch threshold of best route. picking a new random route.\ncurrent route cost = %d, best route cost = %d, route switch threshold = %d\n", currentRouteWeightedCost, bestRouteCost, switchThreshold)
 		}
-		GetRandomBestRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, bestRouteCost, selectThreshold, out_updatedRouteCost, out_updatedRouteNumRelays, out_updatedRouteRelays, debug)
+		GetRandomBestRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, bestRouteCost, selectThreshold, jitterWeight, packetLossWeight, out_updatedRouteCost, out_updatedRouteNumRelays, out_updatedRouteRelays, debug, candidates)
 		routeChanged = true
 		return
 	}
@@ -1611,6 +2414,76 @@ type RouteShader struct {
 	RouteSwitchThreshold          int32   `json:"route_switch_threshold"`
 	MaxLatencyTradeOff            int32   `json:"max_latency_trade_off"`
 	ForceNext                     bool    `json:"force_next"`
+	JitterWeight                  float32 `json:"jitter_weight"`
+	PacketLossWeight              float32 `json:"packet_loss_weight"`
+	RedundantRoute                bool    `json:"redundant_route"` // pick a second relay-disjoint route for analytics. not sent to the SDK yet
+
+	// flap damping. after each route switch, hold the route for flap hold slices, doubling with each recent switch up to flap max hold slices.
+	// one recent switch is forgotten after each flap decay slices without a switch. flap hold slices of zero disables flap damping.
+
+	FlapHoldSlices    int32 `json:"flap_hold_slices"`
+	FlapMaxHoldSlices int32 `json:"flap_max_hold_slices"`
+	FlapDecaySlices   int32 `json:"flap_decay_slices"`
+
+	// relay policy. if an allow list is non-empty, only relays matching it may be used. relays matching any deny list are never used.
+	// deny all is set when an allow list was configured but none of its entries could be resolved, so the policy fails closed.
+
+	AllowedSellers     []uint64 `json:"allowed_sellers"`
+	DeniedSellers      []uint64 `json:"denied_sellers"`
+	AllowedDatacenters []uint64 `json:"allowed_datacenters"`
+	DeniedDatacenters  []uint64 `json:"denied_datacenters"`
+	AllowedRelays      []uint64 `json:"allowed_relays"`
+	DeniedRelays       []uint64 `json:"denied_relays"`
+	RelayPolicyDenyAll bool     `json:"relay_policy_deny_all"`
+}
+
+func (routeShader *RouteShader) HasRelayPolicy() bool {
+	return routeShader.RelayPolicyDenyAll ||
+		len(routeShader.AllowedSellers) > 0 || len(routeShader.DeniedSellers) > 0 ||
+		len(routeShader.AllowedDatacenters) > 0 || len(routeShader.DeniedDatacenters) > 0 ||
+		len(routeShader.AllowedRelays) > 0 || len(routeShader.DeniedRelays) > 0
+}
+
+// InheritRelayPolicy copies the relay policy from another route shader, unless this route shader has a relay policy of its own
+func (routeShader *RouteShader) InheritRelayPolicy(other *RouteShader) {
+	if routeShader.HasRelayPolicy() {
+		return
+	}
+	routeShader.AllowedSellers = other.AllowedSellers
+	routeShader.DeniedSellers = other.DeniedSellers
+	routeShader.AllowedDatacenters = other.AllowedDatacenters
+	routeShader.DeniedDatacenters = other.DeniedDatacenters
+	routeShader.AllowedRelays = other.AllowedRelays
+	routeShader.DeniedRelays = other.DeniedRelays
+	routeShader.RelayPolicyDenyAll = other.RelayPolicyDenyAll
+}
+
+func relayPolicyContains(list []uint64, id uint64) bool {
+	for i := range list {
+		if list[i] == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (routeShader *RouteShader) RelayAllowed(relayId uint64, sellerId uint64, datacenterId uint64) bool {
+	if routeShader.RelayPolicyDenyAll {
+		return false
+	}
+	if len(routeShader.AllowedSellers) > 0 && !relayPolicyContains(routeShader.AllowedSellers, sellerId) {
+		return false
+	}
+	if len(routeShader.AllowedDatacenters) > 0 && !relayPolicyContains(routeShader.AllowedDatacenters, datacenterId) {
+		return false
+	}
+	if len(routeShader.AllowedRelays) > 0 && !relayPolicyContains(routeShader.AllowedRelays, relayId) {
+		return false
+	}
+	if relayPolicyContains(routeShader.DeniedSellers, sellerId) || relayPolicyContains(routeShader.DeniedDatacenters, datacenterId) || relayPolicyContains(routeShader.DeniedRelays, relayId) {
+		return false
+	}
+	return true
 }
 
 func NewRouteShader() RouteShader {
@@ -1627,6 +2500,12 @@ func NewRouteShader() RouteShader {
 		RouteSwitchThreshold:          10,
 		MaxLatencyTradeOff:            20,
 		ForceNext:                     false,
+		JitterWeight:                  0.0,
+		PacketLossWeight:              0.0,
+		RedundantRoute:                false,
+		FlapHoldSlices:                0,
+		FlapMaxHoldSlices:             0,
+		FlapDecaySlices:               0,
 	}
 }
 
@@ -1643,6 +2522,85 @@ type RouteState struct {
 	ReducePacketLoss    bool
 	RouteLost           bool
 	NoRoute             bool
+	FlapCount           uint32
+	FlapHoldSlices      uint32
+	FlapQuietSlices     uint32
+}
+
+// Flags packs the route state into constants.RouteStateFlags_* bits, so it can be recorded with each route decision
+func (routeState *RouteState) Flags() uint32 {
+	flags := uint32(0)
+	set := func(condition bool, flag uint32) {
+		if condition {
+			flags |= flag
+		}
+	}
+	set(routeState.Next, constants.RouteStateFlags_Next)
+	set(routeState.Veto, constants.RouteStateFlags_Veto)
+	set(routeState.Disabled, constants.RouteStateFlags_Disabled)
+	set(routeState.NotSelected, constants.RouteStateFlags_NotSelected)
+	set(routeState.ABTest, constants.RouteStateFlags_ABTest)
+	set(routeState.A, constants.RouteStateFlags_A)
+	set(routeState.B, constants.RouteStateFlags_B)
+	set(routeState.ForcedNext, constants.RouteStateFlags_ForcedNext)
+	set(routeState.ReduceLatency, constants.RouteStateFlags_ReduceLatency)
+	set(routeState.ReducePacketLoss, constants.RouteStateFlags_ReducePacketLoss)
+	set(routeState.RouteLost, constants.RouteStateFlags_RouteLost)
+	set(routeState.NoRoute, constants.RouteStateFlags_NoRoute)
+	set(routeState.FlapHoldSlices > 0, constants.RouteStateFlags_FlapDamping)
+	return flags
+}
+
+func FlapDampingHold(routeShader *RouteShader, routeState *RouteState) bool {
+	return routeShader.FlapHoldSlices > 0 && routeState.FlapHoldSlices > 0
+}
+
+func UpdateFlapDamping(routeShader *RouteShader, routeState *RouteState, routeSwitched bool) {
+
+	if routeShader.FlapHoldSlices <= 0 {
+		routeState.FlapCount = 0
+		routeState.FlapHoldSlices = 0
+		routeState.FlapQuietSlices = 0
+		return
+	}
+
+	// each switch doubles how long we hold the new route before we allow another switch, or a return to direct
+
+	if routeSwitched {
+
+		if routeState.FlapCount < constants.MaxFlapCount {
+			routeState.FlapCount++
+		}
+
+		maxHoldSlices := int64(routeShader.FlapMaxHoldSlices)
+		if maxHoldSlices <= 0 || maxHoldSlices > constants.MaxFlapHoldSlices {
+			maxHoldSlices = constants.MaxFlapHoldSlices
+		}
+
+		holdSlices := int64(routeShader.FlapHoldSlices) << (routeState.FlapCount - 1)
+		if holdSlices > maxHoldSlices {
+			holdSlices = maxHoldSlices
+		}
+
+		routeState.FlapHoldSlices = uint32(holdSlices)
+		routeState.FlapQuietSlices = 0
+		return
+	}
+
+	if routeState.FlapHoldSlices > 0 {
+		routeState.FlapHoldSlices--
+	}
+
+	// forget one recent switch each time the session goes flap decay slices without switching
+
+	if routeState.FlapQuietSlices < constants.MaxFlapQuietSlices {
+		routeState.FlapQuietSlices++
+	}
+
+	if routeShader.FlapDecaySlices > 0 && routeState.FlapCount > 0 && int32(routeState.FlapQuietSlices) >= routeShader.FlapDecaySlices {
+		routeState.FlapCount--
+		routeState.FlapQuietSlices = 0
+	}
 }
 
 func EarlyOutDirect(userId uint64, routeShader *RouteShader, routeState *RouteState, debug *string) bool {
@@ -1719,7 +2677,7 @@ func EarlyOutDirect(userId uint64, routeShader *RouteShader, routeState *RouteSt
 	return false
 }
 
-func MakeRouteDecision_TakeNetworkNext(userId uint64, routeMatrix []RouteEntry, routeShader *RouteShader, routeState *RouteState, directLatency int32, directPacketLoss float32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, out_routeCost *int32, out_routeNumRelays *int32, out_routeRelays []int32, debug *string, sliceNumber int32) bool {
+func MakeRouteDecision_TakeNetworkNext(userId uint64, routeMatrix []RouteEntry, routeShader *RouteShader, routeState *RouteState, directLatency int32, directPacketLoss float32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, out_routeCost *int32, out_routeNumRelays *int32, out_routeRelays []int32, debug *string, sliceNumber int32, candidates *RouteCandidates) bool {
 
 	if EarlyOutDirect(userId, routeShader, routeState, debug) {
 		if debug != nil {
@@ -1814,7 +2772,7 @@ func MakeRouteDecision_TakeNetworkNext(userId uint64, routeMatrix []RouteEntry,
 
 	selectThreshold := routeShader.RouteSelectThreshold
 
-	hasRoute := GetBestRoute_Initial(routeMatrix, sourceRelays, sourceRelayCost, destRelays, maxCost, selectThreshold, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, debug)
+	hasRoute := GetBestRoute_Initial(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, maxCost, selectThreshold, routeShader.JitterWeight, routeShader.PacketLossWeight, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, debug, candidates)
 
 	*out_routeCost = bestRouteCost
 	*out_routeNumRelays = bestRouteNumRelays
@@ -1835,10 +2793,14 @@ func MakeRouteDecision_TakeNetworkNext(userId uint64, routeMatrix []RouteEntry,
 	routeState.ReduceLatency = routeState.ReduceLatency || reduceLatency
 	routeState.ReducePacketLoss = routeState.ReducePacketLoss || reducePacketLoss
 
+	// taking network next counts as a switch, so we don't go straight back to direct
+
+	UpdateFlapDamping(routeShader, routeState, true)
+
 	return true
 }
 
-func MakeRouteDecision_StayOnNetworkNext_Internal(userId uint64, routeMatrix []RouteEntry, relayNames []string, routeShader *RouteShader, routeState *RouteState, directLatency int32, nextLatency int32, predictedLatency int32, directPacketLoss float32, nextPacketLoss float32, currentRouteNumRelays int32, currentRouteRelays [constants.MaxRouteRelays]int32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, out_updatedRouteCost *int32, out_updatedRouteNumRelays *int32, out_updatedRouteRelays []int32, debug *string) (bool, bool) {
+func MakeRouteDecision_StayOnNetworkNext_Internal(userId uint64, routeMatrix []RouteEntry, relayNames []string, routeShader *RouteShader, routeState *RouteState, directLatency int32, nextLatency int32, predictedLatency int32, directPacketLoss float32, nextPacketLoss float32, currentRouteNumRelays int32, currentRouteRelays [constants.MaxRouteRelays]int32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, out_updatedRouteCost *int32, out_updatedRouteNumRelays *int32, out_updatedRouteRelays []int32, debug *string, candidates *RouteCandidates) (bool, bool) {
 
 	Debug("direct latency = %d", directLatency)
 	Debug("next latency = %d", nextLatency)
@@ -1889,13 +2851,29 @@ func MakeRouteDecision_StayOnNetworkNext_Internal(userId uint64, routeMatrix []R
 		}
 	}
 
+	// if we switched recently, don't switch to a better route. the current route is kept while it exists regardless
+	// of max cost, so the relaxed max cost only applies if the current route is lost: then we take any replacement
+	// route that is better than direct, instead of going back to direct because no route clears the latency threshold
+
+	switchThreshold := routeShader.RouteSwitchThreshold
+
+	if FlapDampingHold(routeShader, routeState) {
+		if debug != nil {
+			*debug += fmt.Sprintf("flap damping. holding route for %d more slices\n", routeState.FlapHoldSlices)
+		}
+		switchThreshold = math.MaxInt32
+		if !routeShader.ForceNext {
+			maxCost += routeShader.LatencyReductionThreshold
+		}
+	}
+
 	// update the current best route
 
 	bestRouteCost := int32(0)
 	bestRouteNumRelays := int32(0)
 	bestRouteRelays := [constants.MaxRouteRelays]int32{}
 
-	routeSwitched, routeLost := GetBestRoute_Update(routeMatrix, sourceRelays, sourceRelayCost, destRelays, maxCost, routeShader.RouteSelectThreshold, routeShader.RouteSwitchThreshold, currentRouteNumRelays, currentRouteRelays, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, debug)
+	routeSwitched, routeLost := GetBestRoute_Update(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, maxCost, routeShader.RouteSelectThreshold, switchThreshold, routeShader.JitterWeight, routeShader.PacketLossWeight, currentRouteNumRelays, currentRouteRelays, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, debug, candidates)
 
 	routeState.RouteLost = routeLost
 
@@ -1911,6 +2889,8 @@ func MakeRouteDecision_StayOnNetworkNext_Internal(userId uint64, routeMatrix []R
 
 	// stay on network next
 
+	UpdateFlapDamping(routeShader, routeState, routeSwitched)
+
 	*out_updatedRouteCost = bestRouteCost
 	*out_updatedRouteNumRelays = bestRouteNumRelays
 	copy(out_updatedRouteRelays, bestRouteRelays[:bestRouteNumRelays])
@@ -1930,9 +2910,9 @@ func MakeRouteDecision_StayOnNetworkNext_Internal(userId uint64, routeMatrix []R
 	return true, routeSwitched
 }
 
-func MakeRouteDecision_StayOnNetworkNext(userId uint64, routeMatrix []RouteEntry, relayNames []string, routeShader *RouteShader, routeState *RouteState, directLatency int32, nextLatency int32, predictedLatency int32, directPacketLoss float32, nextPacketLoss float32, currentRouteNumRelays int32, currentRouteRelays [constants.MaxRouteRelays]int32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, out_updatedRouteCost *int32, out_updatedRouteNumRelays *int32, out_updatedRouteRelays []int32, debug *string) (bool, bool) {
+func MakeRouteDecision_StayOnNetworkNext(userId uint64, routeMatrix []RouteEntry, relayNames []string, routeShader *RouteShader, routeState *RouteState, directLatency int32, nextLatency int32, predictedLatency int32, directPacketLoss float32, nextPacketLoss float32, currentRouteNumRelays int32, currentRouteRelays [constants.MaxRouteRelays]int32, sourceRelays []int32, sourceRelayCost []int32, destRelays []int32, excludedRelays []bool, out_updatedRouteCost *int32, out_updatedRouteNumRelays *int32, out_updatedRouteRelays []int32, debug *string, candidates *RouteCandidates) (bool, bool) {
 
-	stayOnNetworkNext, nextRouteSwitched := MakeRouteDecision_StayOnNetworkNext_Internal(userId, routeMatrix, relayNames, routeShader, routeState, directLatency, nextLatency, predictedLatency, directPacketLoss, nextPacketLoss, currentRouteNumRelays, currentRouteRelays, sourceRelays, sourceRelayCost, destRelays, out_updatedRouteCost, out_updatedRouteNumRelays, out_updatedRouteRelays, debug)
+	stayOnNetworkNext, nextRouteSwitched := MakeRouteDecision_StayOnNetworkNext_Internal(userId, routeMatrix, relayNames, routeShader, routeState, directLatency, nextLatency, predictedLatency, directPacketLoss, nextPacketLoss, currentRouteNumRelays, currentRouteRelays, sourceRelays, sourceRelayCost, destRelays, excludedRelays, out_updatedRouteCost, out_updatedRouteNumRelays, out_updatedRouteRelays, debug, candidates)
 
 	if routeState.Next && !stayOnNetworkNext {
 		routeState.Next = false
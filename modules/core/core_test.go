@@ -123,6 +123,12 @@ func TestAnonymizeAddress_IPv6(t *testing.T) {
 	ipv6 := core.ParseAddress("[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:49999")
 	anonymized := core.AnonymizeAddress(ipv6)
 	assert.Equal(t, anonymized.String(), "[2001:db8:85a3::]:0")
+	assert.Equal(t, ipv6.String(), "[2001:db8:85a3::8a2e:370:7334]:49999")
+}
+
+func TestAnonymizeAddress_Empty(t *testing.T) {
+	anonymized := core.AnonymizeAddress(net.UDPAddr{})
+	assert.Equal(t, net.UDPAddr{}, anonymized)
 }
 
 func TestRouteManager(t *testing.T) {
@@ -307,6 +313,45 @@ func TestRouteManager(t *testing.T) {
 	assert.Equal(t, core.RouteHash(4, 5, 6), routeManager.RouteHash[8])
 }
 
+func TestRouteManager_RouteQuality(t *testing.T) {
+
+	t.Parallel()
+
+	const numRelays = 20
+
+	routeManager := core.RouteManager{}
+	routeManager.RelayDatacenter = make([]uint64, numRelays)
+	for i := range routeManager.RelayDatacenter {
+		routeManager.RelayDatacenter[i] = uint64(i)
+	}
+	routeManager.Jitter = make([]uint8, core.TriMatrixLength(numRelays))
+	routeManager.PacketLoss = make([]uint8, core.TriMatrixLength(numRelays))
+
+	// a lossless route 0 -> 19 -> 1, then more lossy routes 0 -> k -> 1 with lower cost than fit in the route set
+
+	routeManager.AddRoute(22, 0, 0, 19, 1)
+
+	for k := 2; k < 19; k++ {
+		routeManager.PacketLoss[core.TriMatrixIndex(0, k)] = 50
+		routeManager.AddRoute(20, 0, 0, int32(k), 1)
+	}
+
+	// routes are ranked by loss-adjusted cost, so the lossless route is kept, and ranked first
+
+	assert.Equal(t, constants.MaxRoutesPerEntry, routeManager.NumRoutes)
+
+	assert.Equal(t, int32(22), routeManager.RouteCost[0])
+	assert.Equal(t, int32(0), routeManager.RoutePacketLoss[0])
+	assert.Equal(t, int32(3), routeManager.RouteNumRelays[0])
+	assert.Equal(t, int32(19), routeManager.RouteRelays[0][1])
+
+	for i := 1; i < routeManager.NumRoutes; i++ {
+		assert.Equal(t, int32(20), routeManager.RouteCost[i])
+		assert.Equal(t, int32(50), routeManager.RoutePacketLoss[i])
+		assert.True(t, routeManager.RouteRank[i] >= routeManager.RouteRank[i-1])
+	}
+}
+
 func TestRouteManagerWithPrice(t *testing.T) {
 
 	t.Parallel()
@@ -540,6 +585,8 @@ type TestEnvironment struct {
 	relayArray []*TestRelayData
 	relays     map[string]*TestRelayData
 	cost       [][]uint8
+	jitter     [][]uint8
+	packetLoss [][]uint8
 	price      []uint8
 }
 
@@ -552,9 +599,13 @@ func NewTestEnvironment() *TestEnvironment {
 func (env *TestEnvironment) Clear() {
 	numRelays := len(env.relays)
 	env.cost = make([][]uint8, numRelays)
+	env.jitter = make([][]uint8, numRelays)
+	env.packetLoss = make([][]uint8, numRelays)
 	env.price = make([]uint8, numRelays)
 	for i := 0; i < numRelays; i++ {
 		env.cost[i] = make([]uint8, numRelays)
+		env.jitter[i] = make([]uint8, numRelays)
+		env.packetLoss[i] = make([]uint8, numRelays)
 		for j := 0; j < numRelays; j++ {
 			env.cost[i][j] = 255
 		}
@@ -623,6 +674,24 @@ func (env *TestEnvironment) SetCost(sourceRelayName string, destRelayName string
 	env.cost[i][j] = cost
 }
 
+func (env *TestEnvironment) SetJitter(sourceRelayName string, destRelayName string, jitter uint8) {
+	i := env.relays[sourceRelayName].index
+	j := env.relays[destRelayName].index
+	if j > i {
+		i, j = j, i
+	}
+	env.jitter[i][j] = jitter
+}
+
+func (env *TestEnvironment) SetPacketLoss(sourceRelayName string, destRelayName string, packetLoss uint8) {
+	i := env.relays[sourceRelayName].index
+	j := env.relays[destRelayName].index
+	if j > i {
+		i, j = j, i
+	}
+	env.packetLoss[i][j] = packetLoss
+}
+
 func (env *TestEnvironment) SetPrice(relayName string, price uint8) {
 	i := env.relays[relayName].index
 	env.price[i] = price
@@ -653,9 +722,34 @@ func (env *TestEnvironment) GetCostMatrix() ([]uint8, int) {
 	return costMatrix, numRelays
 }
 
+func (env *TestEnvironment) GetJitterAndPacketLossMatrix() ([]uint8, []uint8) {
+	numRelays := len(env.relays)
+	entryCount := core.TriMatrixLength(numRelays)
+	jitterMatrix := make([]uint8, entryCount)
+	packetLossMatrix := make([]uint8, entryCount)
+	for i := 0; i < numRelays; i++ {
+		for j := 0; j < i; j++ {
+			index := core.TriMatrixIndex(i, j)
+			jitterMatrix[index] = env.jitter[i][j]
+			packetLossMatrix[index] = env.packetLoss[i][j]
+		}
+	}
+	return jitterMatrix, packetLossMatrix
+}
+
+func (env *TestEnvironment) GetDestRelays() []bool {
+	destRelays := make([]bool, len(env.relays))
+	for i := range destRelays {
+		destRelays[i] = true
+	}
+	return destRelays
+}
+
 type TestRouteData struct {
-	cost   int32
-	relays []string
+	cost       int32
+	jitter     int32
+	packetLoss int32
+	relays     []string
 }
 
 func (env *TestEnvironment) GetRoutes(routeMatrix []core.RouteEntry, sourceRelayName string, destRelayName string) []TestRouteData {
@@ -671,6 +765,8 @@ func (env *TestEnvironment) GetRoutes(routeMatrix []core.RouteEntry, sourceRelay
 	testRouteData := make([]TestRouteData, entry.NumRoutes)
 	for k := 0; k < int(entry.NumRoutes); k++ {
 		testRouteData[k].cost = entry.RouteCost[k]
+		testRouteData[k].jitter = entry.RouteJitter[k]
+		testRouteData[k].packetLoss = entry.RoutePacketLoss[k]
 		testRouteData[k].relays = make([]string, entry.RouteNumRelays[k])
 		if j < i {
 			for l := 0; l < int(entry.RouteNumRelays[k]); l++ {
@@ -702,7 +798,7 @@ func (env *TestEnvironment) GetBestRouteCost(routeMatrix []core.RouteEntry, sour
 			panic("bad dest relay name")
 		}
 	}
-	return core.GetBestRouteCost(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex)
+	return core.GetBestRouteCost(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, nil, 0, 0)
 }
 
 func (env *TestEnvironment) RouteExists(routeMatrix []core.RouteEntry, routeRelays []string) bool {
@@ -740,7 +836,7 @@ func (env *TestEnvironment) GetCurrentRouteCost(routeMatrix []core.RouteEntry, r
 		}
 	}
 	debug := ""
-	return core.GetCurrentRouteCost(routeMatrix, int32(len(routeRelays)), routeRelayIndex, sourceRelayIndex, sourceRelayCost, destRelayIndex, &debug)
+	return core.GetCurrentRouteCost(routeMatrix, int32(len(routeRelays)), routeRelayIndex, sourceRelayIndex, sourceRelayCost, destRelayIndex, nil, &debug)
 }
 
 func (env *TestEnvironment) GetBestRoutes(routeMatrix []core.RouteEntry, sourceRelays []string, sourceRelayCost []int32, destRelays []string, maxCost int32) []TestRouteData {
@@ -760,7 +856,7 @@ func (env *TestEnvironment) GetBestRoutes(routeMatrix []core.RouteEntry, sourceR
 	}
 	numBestRoutes := 0
 	bestRoutes := make([]core.BestRoute, 1024)
-	core.GetBestRoutes(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, maxCost, bestRoutes, &numBestRoutes)
+	core.GetBestRoutes(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, nil, maxCost, 0, 0, bestRoutes, &numBestRoutes)
 	routes := make([]TestRouteData, numBestRoutes)
 	for i := 0; i < numBestRoutes; i++ {
 		routes[i].cost = bestRoutes[i].Cost
@@ -800,7 +896,7 @@ func (env *TestEnvironment) GetRandomBestRoute(routeMatrix []core.RouteEntry, so
 	var bestRouteRelays [constants.MaxRouteRelays]int32
 	debug := ""
 	selectThreshold := int32(2)
-	core.GetRandomBestRoute(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, maxCost, selectThreshold, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug)
+	core.GetRandomBestRoute(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, nil, maxCost, selectThreshold, 0, 0, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug, nil)
 	if bestRouteNumRelays == 0 {
 		return nil
 	}
@@ -834,7 +930,7 @@ func (env *TestEnvironment) GetRandomBestRoute_LowestPrice(routeMatrix []core.Ro
 	var bestRouteRelays [constants.MaxRouteRelays]int32
 	debug := ""
 	selectThreshold := int32(2)
-	core.GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, maxCost, selectThreshold, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug)
+	core.GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelayIndex, sourceRelayCost, destRelayIndex, nil, maxCost, selectThreshold, 0, 0, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug, nil)
 	if bestRouteNumRelays == 0 {
 		return nil
 	}
@@ -899,7 +995,7 @@ func (env *TestEnvironment) GetBestRoute_Initial(routeMatrix []core.RouteEntry,
 
 	debug := ""
 	selectThreshold := int32(2)
-	hasRoute := core.GetBestRoute_Initial(routeMatrix, sourceRelays, sourceRelayCost, destRelays, maxCost, selectThreshold, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug)
+	hasRoute := core.GetBestRoute_Initial(routeMatrix, sourceRelays, sourceRelayCost, destRelays, nil, maxCost, selectThreshold, 0, 0, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug, nil)
 	if !hasRoute {
 		return 0, []string{}
 	}
@@ -928,7 +1024,7 @@ func (env *TestEnvironment) GetBestRoute_Update(routeMatrix []core.RouteEntry, s
 	bestRouteRelays := [constants.MaxRouteRelays]int32{}
 
 	debug := ""
-	core.GetBestRoute_Update(routeMatrix, sourceRelays, sourceRelayCost, destRelays, maxCost, selectThreshold, switchThreshold, currentRouteNumRelays, currentRouteRelays, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug)
+	core.GetBestRoute_Update(routeMatrix, sourceRelays, sourceRelayCost, destRelays, nil, maxCost, selectThreshold, switchThreshold, 0, 0, currentRouteNumRelays, currentRouteRelays, &bestRouteCost, &bestRouteNumRelays, &bestRouteRelays, &debug, nil)
 
 	if bestRouteNumRelays == 0 {
 		return 0, []string{}
@@ -1249,6 +1345,614 @@ func TestSlowerRoute(t *testing.T) {
 	}
 }
 
+func randomOptimizeInputs(numRelays int) ([]uint8, []uint8, []uint8, []uint8, []uint64, []bool) {
+	cost := make([]uint8, core.TriMatrixLength(numRelays))
+	jitter := make([]uint8, core.TriMatrixLength(numRelays))
+	packetLoss := make([]uint8, core.TriMatrixLength(numRelays))
+	for i := range cost {
+		if rand.Intn(10) == 0 {
+			cost[i] = 255
+		} else {
+			cost[i] = uint8(5 + rand.Intn(200))
+		}
+		jitter[i] = uint8(rand.Intn(20))
+		packetLoss[i] = uint8(rand.Intn(20))
+	}
+	relayPrice := make([]uint8, numRelays)
+	relayDatacenter := make([]uint64, numRelays)
+	destRelays := make([]bool, numRelays)
+	for i := 0; i < numRelays; i++ {
+		relayPrice[i] = uint8(rand.Intn(10))
+		relayDatacenter[i] = uint64(i)
+		destRelays[i] = rand.Intn(2) == 0
+	}
+	return cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays
+}
+
+func TestOptimizer_MatchesOptimize3(t *testing.T) {
+
+	t.Parallel()
+
+	numRelays := 32
+	numSegments := 4
+
+	cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays := randomOptimizeInputs(numRelays)
+
+	optimizer := core.Optimizer{}
+
+	for iteration := 0; iteration < 100; iteration++ {
+
+		// perturb a few costs each iteration, and occasionally relay prices and destination relays
+
+		numChanges := rand.Intn(4)
+		for i := 0; i < numChanges; i++ {
+			index := rand.Intn(len(cost))
+			if rand.Intn(5) == 0 {
+				cost[index] = 255
+			} else {
+				cost[index] = uint8(5 + rand.Intn(200))
+			}
+		}
+
+		if rand.Intn(4) == 0 {
+			jitter[rand.Intn(len(jitter))] = uint8(rand.Intn(20))
+		}
+
+		if rand.Intn(4) == 0 {
+			packetLoss[rand.Intn(len(packetLoss))] = uint8(rand.Intn(20))
+		}
+
+		if rand.Intn(4) == 0 {
+			relayPrice[rand.Intn(numRelays)] = uint8(rand.Intn(10))
+		}
+
+		if rand.Intn(8) == 0 {
+			index := rand.Intn(numRelays)
+			destRelays[index] = !destRelays[index]
+		}
+
+		// occasionally relays are added or removed, which changes relay indices
+
+		if rand.Intn(20) == 0 {
+			numRelays = 24 + rand.Intn(16)
+			cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays = randomOptimizeInputs(numRelays)
+		}
+
+		expected := core.Optimize3(numRelays, numSegments, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+		actual := optimizer.Optimize(numRelays, numSegments, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+		assert.Equal(t, len(expected), len(actual))
+		for i := range expected {
+			if expected[i] != actual[i] {
+				t.Fatalf("route entry %d does not match on iteration %d", i, iteration)
+			}
+		}
+	}
+}
+
+func TestOptimizer_Incremental(t *testing.T) {
+
+	t.Parallel()
+
+	numRelays := 32
+	numSegments := 4
+
+	cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays := randomOptimizeInputs(numRelays)
+
+	optimizer := core.Optimizer{}
+
+	optimizer.Optimize(numRelays, numSegments, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+	assert.True(t, optimizer.FullOptimize)
+	assert.Equal(t, numRelays, optimizer.NumDirtyRelays)
+	assert.Equal(t, core.TriMatrixLength(numRelays), optimizer.NumDirtyEntries)
+
+	// nothing changed, so nothing should be recomputed
+
+	optimizer.Optimize(numRelays, numSegments, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+	assert.False(t, optimizer.FullOptimize)
+	assert.Equal(t, 0, optimizer.NumDirtyRelays)
+	assert.Equal(t, 0, optimizer.NumDirtyEntries)
+
+	// change one cost. only the two relays involved are dirty
+
+	index := core.TriMatrixIndex(1, 0)
+	cost[index] = 255 - cost[index]
+
+	optimizer.Optimize(numRelays, numSegments, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+	assert.False(t, optimizer.FullOptimize)
+	assert.Equal(t, 2, optimizer.NumDirtyRelays)
+	assert.True(t, optimizer.NumDirtyEntries > 0)
+	assert.True(t, optimizer.NumDirtyEntries < core.TriMatrixLength(numRelays))
+
+	// change the number of relays. this forces a full optimize
+
+	numRelays++
+
+	cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays = randomOptimizeInputs(numRelays)
+
+	optimizer.Optimize(numRelays, numSegments, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+	assert.True(t, optimizer.FullOptimize)
+	assert.Equal(t, core.TriMatrixLength(numRelays), optimizer.NumDirtyEntries)
+}
+
+func TestOptimizeDirectional_Symmetric(t *testing.T) {
+
+	t.Parallel()
+
+	// when every relay is a destination relay, the direction of each route entry is ambiguous,
+	// so the result is the same as optimizing the average of both directions
+
+	numRelays := 8
+
+	_, jitter, packetLoss, relayPrice, relayDatacenter, destRelays := randomOptimizeInputs(numRelays)
+
+	for i := range destRelays {
+		destRelays[i] = true
+	}
+
+	directionalCost := make([]uint8, core.SquareMatrixLength(numRelays))
+	for i := range directionalCost {
+		if rand.Intn(10) == 0 {
+			directionalCost[i] = 255
+		} else {
+			directionalCost[i] = uint8(5 + rand.Intn(200))
+		}
+	}
+
+	cost := make([]uint8, core.TriMatrixLength(numRelays))
+	for i := 0; i < numRelays; i++ {
+		for j := 0; j < i; j++ {
+			a := directionalCost[core.SquareMatrixIndex(numRelays, i, j)]
+			b := directionalCost[core.SquareMatrixIndex(numRelays, j, i)]
+			if a == 255 || b == 255 {
+				cost[core.TriMatrixIndex(i, j)] = 255
+			} else {
+				cost[core.TriMatrixIndex(i, j)] = uint8(math.Ceil(float64(a)*0.5 + float64(b)*0.5))
+			}
+		}
+	}
+
+	expected := core.Optimize3(numRelays, numRelays, cost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays)
+
+	actual := core.OptimizeDirectional(numRelays, numRelays, directionalCost, jitter, packetLoss, relayPrice, relayDatacenter, destRelays, 0.75)
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestOptimizeDirectional_Asymmetric(t *testing.T) {
+
+	t.Parallel()
+
+	// relay 0 is near the client, relay 2 is the destination relay near the server.
+	// the direct path is fast client -> server, but slow server -> client. going through relay 1 is 30ms each way.
+
+	numRelays := 3
+
+	directionalCost := make([]uint8, core.SquareMatrixLength(numRelays))
+	for i := range directionalCost {
+		directionalCost[i] = 255
+	}
+
+	setCost := func(from int, to int, cost uint8) {
+		directionalCost[core.SquareMatrixIndex(numRelays, from, to)] = cost
+	}
+
+	setCost(0, 2, 10)
+	setCost(2, 0, 100)
+	setCost(0, 1, 30)
+	setCost(1, 0, 30)
+	setCost(1, 2, 30)
+	setCost(2, 1, 30)
+
+	relayPrice := make([]uint8, numRelays)
+	relayDatacenter := []uint64{0, 1, 2}
+	destRelays := []bool{false, false, true}
+
+	// weighing both directions equally, direct is 55 and beats 60 through relay 1
+
+	routes := core.OptimizeDirectional(numRelays, 1, directionalCost, nil, nil, relayPrice, relayDatacenter, destRelays, 0.5)
+
+	entry := routes[core.TriMatrixIndex(2, 0)]
+	assert.Equal(t, int32(55), entry.DirectCost)
+	assert.Equal(t, int32(1), entry.NumRoutes)
+	assert.Equal(t, int32(55), entry.RouteCost[0])
+	assert.Equal(t, int32(2), entry.RouteNumRelays[0])
+
+	// weighing the server -> client direction more heavily, the direct route costs 78, so we go through relay 1.
+	// the route entry is (2,0) so the route starts at relay 2, even though the client side is relay 0.
+
+	routes = core.OptimizeDirectional(numRelays, 1, directionalCost, nil, nil, relayPrice, relayDatacenter, destRelays, 0.75)
+
+	entry = routes[core.TriMatrixIndex(2, 0)]
+	assert.Equal(t, int32(78), entry.DirectCost)
+	assert.Equal(t, int32(2), entry.NumRoutes)
+	assert.Equal(t, int32(60), entry.RouteCost[0])
+	assert.Equal(t, int32(3), entry.RouteNumRelays[0])
+	assert.Equal(t, [3]int32{2, 1, 0}, [3]int32(entry.RouteRelays[0][:3]))
+	assert.Equal(t, core.RouteHash(2, 1, 0), entry.RouteHash[0])
+	assert.Equal(t, int32(78), entry.RouteCost[1])
+
+	// when most traffic goes client -> server, the direct route is best. a symmetric optimize over the max of both directions would go through relay 1
+
+	routes = core.OptimizeDirectional(numRelays, 1, directionalCost, nil, nil, relayPrice, relayDatacenter, destRelays, 0.25)
+
+	entry = routes[core.TriMatrixIndex(2, 0)]
+	assert.Equal(t, int32(33), entry.DirectCost)
+	assert.Equal(t, int32(1), entry.NumRoutes)
+	assert.Equal(t, [2]int32{2, 0}, [2]int32(entry.RouteRelays[0][:2]))
+
+	cost := make([]uint8, core.TriMatrixLength(numRelays))
+	cost[core.TriMatrixIndex(0, 1)] = 30
+	cost[core.TriMatrixIndex(1, 2)] = 30
+	cost[core.TriMatrixIndex(0, 2)] = 100
+
+	routes = core.Optimize2(numRelays, 1, cost, relayPrice, relayDatacenter, destRelays)
+
+	entry = routes[core.TriMatrixIndex(2, 0)]
+	assert.Equal(t, int32(60), entry.RouteCost[0])
+	assert.Equal(t, int32(3), entry.RouteNumRelays[0])
+}
+
+func TestOptimize3_RouteQuality(t *testing.T) {
+
+	t.Parallel()
+
+	env := NewTestEnvironment()
+
+	env.AddRelay("losangeles", "10.0.0.1")
+	env.AddRelay("chicago", "10.0.0.2")
+	env.AddRelay("a", "10.0.0.3")
+
+	env.SetCost("losangeles", "chicago", 100)
+	env.SetCost("losangeles", "a", 10)
+	env.SetCost("a", "chicago", 10)
+
+	env.SetJitter("losangeles", "chicago", 1)
+	env.SetJitter("losangeles", "a", 3)
+	env.SetJitter("a", "chicago", 4)
+
+	env.SetPacketLoss("losangeles", "a", 5)
+	env.SetPacketLoss("a", "chicago", 7)
+
+	costMatrix, numRelays := env.GetCostMatrix()
+	jitterMatrix, packetLossMatrix := env.GetJitterAndPacketLossMatrix()
+
+	routeMatrix := core.Optimize3(numRelays, numRelays, costMatrix, jitterMatrix, packetLossMatrix, env.price, env.GetRelayDatacenters(), env.GetDestRelays())
+
+	routes := env.GetRoutes(routeMatrix, "losangeles", "chicago")
+
+	assert.Equal(t, 2, len(routes))
+
+	assert.Equal(t, []string{"losangeles", "a", "chicago"}, routes[0].relays)
+	assert.Equal(t, int32(7), routes[0].jitter)
+	assert.Equal(t, int32(12), routes[0].packetLoss)
+
+	assert.Equal(t, []string{"losangeles", "chicago"}, routes[1].relays)
+	assert.Equal(t, int32(1), routes[1].jitter)
+	assert.Equal(t, int32(0), routes[1].packetLoss)
+
+	// without jitter and packet loss the route matrix is exactly the same as optimize2, with zero quality
+
+	routeMatrix = core.Optimize3(numRelays, numRelays, costMatrix, nil, nil, env.price, env.GetRelayDatacenters(), env.GetDestRelays())
+
+	assert.Equal(t, core.Optimize2(numRelays, numRelays, costMatrix, env.price, env.GetRelayDatacenters(), env.GetDestRelays()), routeMatrix)
+
+	routes = env.GetRoutes(routeMatrix, "losangeles", "chicago")
+
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, int32(0), routes[0].jitter)
+	assert.Equal(t, int32(0), routes[0].packetLoss)
+}
+
+func TestRoutePenalty(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, int32(0), core.RoutePenalty(10, 20, 0, 0))
+	assert.Equal(t, int32(10), core.RoutePenalty(10, 20, 1, 0))
+	assert.Equal(t, int32(10), core.RoutePenalty(10, 20, 0, 5))
+	assert.Equal(t, int32(2), core.RoutePenalty(3, 5, 0.5, 1))
+	assert.Equal(t, int32(0), core.RoutePenalty(0, 0, 1, 1))
+}
+
+func TestRelayPeakHour(t *testing.T) {
+
+	t.Parallel()
+
+	// no peak hours when start and end are the same
+
+	assert.False(t, core.RelayPeakHour(0, 0, 0))
+	assert.False(t, core.RelayPeakHour(12, 12, 12))
+
+	// peak hours within a day
+
+	assert.False(t, core.RelayPeakHour(8, 9, 17))
+	assert.True(t, core.RelayPeakHour(9, 9, 17))
+	assert.True(t, core.RelayPeakHour(16, 9, 17))
+	assert.False(t, core.RelayPeakHour(17, 9, 17))
+
+	// peak hours that wrap around midnight
+
+	assert.True(t, core.RelayPeakHour(22, 22, 6))
+	assert.True(t, core.RelayPeakHour(0, 22, 6))
+	assert.True(t, core.RelayPeakHour(5, 22, 6))
+	assert.False(t, core.RelayPeakHour(6, 22, 6))
+	assert.False(t, core.RelayPeakHour(12, 22, 6))
+}
+
+func TestEffectiveRelayPrice(t *testing.T) {
+
+	t.Parallel()
+
+	// off peak and unloaded relays are charged the bandwidth price
+
+	assert.Equal(t, uint8(10), core.EffectiveRelayPrice(10, 8, 9, 17, 2.0, 0, 100))
+	assert.Equal(t, uint8(10), core.EffectiveRelayPrice(10, 12, 0, 0, 2.0, 0, 100))
+
+	// peak hours apply the multiplier, clamped to max relay price
+
+	assert.Equal(t, uint8(20), core.EffectiveRelayPrice(10, 12, 9, 17, 2.0, 0, 100))
+	assert.Equal(t, uint8(255), core.EffectiveRelayPrice(200, 12, 9, 17, 2.0, 0, 100))
+	assert.Equal(t, uint8(10), core.EffectiveRelayPrice(10, 12, 9, 17, 0.0, 0, 100))
+
+	// load below the threshold doesn't change the price
+
+	assert.Equal(t, uint8(10), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 50, 100))
+
+	// load above the threshold ramps the price up to max relay price at max sessions
+
+	assert.Equal(t, uint8(133), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 75, 100))
+	assert.Equal(t, uint8(255), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 100, 100))
+	assert.Equal(t, uint8(255), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 200, 100))
+
+	// small changes in load don't change the price
+
+	assert.Equal(t, uint8(10), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 52, 100))
+	assert.Equal(t, uint8(133), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 74, 100))
+	assert.Equal(t, uint8(133), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 76, 100))
+
+	// relays without max sessions are never load priced
+
+	assert.Equal(t, uint8(10), core.EffectiveRelayPrice(10, 12, 0, 0, 1.0, 1000, 0))
+}
+
+func TestRelayHeadroom(t *testing.T) {
+
+	t.Parallel()
+
+	// relays without limits always have full headroom
+
+	assert.Equal(t, uint8(100), core.RelayHeadroom(0, 0, 0, 0))
+	assert.Equal(t, uint8(100), core.RelayHeadroom(1000, 0, 1000000, 0))
+
+	// headroom is set by sessions or bandwidth, whichever is closer to the limit
+
+	assert.Equal(t, uint8(75), core.RelayHeadroom(25, 100, 0, 1000))
+	assert.Equal(t, uint8(40), core.RelayHeadroom(25, 100, 600000, 1000))
+	assert.Equal(t, uint8(10), core.RelayHeadroom(90, 100, 600000, 1000))
+
+	// relays at max sessions or port speed have no headroom
+
+	assert.Equal(t, uint8(0), core.RelayHeadroom(100, 100, 0, 1000))
+	assert.Equal(t, uint8(0), core.RelayHeadroom(200, 100, 0, 1000))
+	assert.Equal(t, uint8(0), core.RelayHeadroom(0, 100, 1000000, 1000))
+	assert.Equal(t, uint8(0), core.RelayHeadroom(99, 100, 999999, 1000))
+}
+
+func TestRouteShader_RelayAllowed(t *testing.T) {
+
+	t.Parallel()
+
+	routeShader := core.NewRouteShader()
+
+	assert.False(t, routeShader.HasRelayPolicy())
+	assert.True(t, routeShader.RelayAllowed(1, 2, 3))
+
+	// deny lists exclude only the matching relays
+
+	routeShader.DeniedSellers = []uint64{2}
+
+	assert.True(t, routeShader.HasRelayPolicy())
+	assert.False(t, routeShader.RelayAllowed(1, 2, 3))
+	assert.True(t, routeShader.RelayAllowed(1, 4, 3))
+
+	// allow lists exclude everything that doesn't match
+
+	routeShader = core.NewRouteShader()
+	routeShader.AllowedDatacenters = []uint64{3, 5}
+
+	assert.True(t, routeShader.RelayAllowed(1, 2, 3))
+	assert.True(t, routeShader.RelayAllowed(1, 2, 5))
+	assert.False(t, routeShader.RelayAllowed(1, 2, 4))
+
+	// deny wins over allow
+
+	routeShader.DeniedRelays = []uint64{1}
+
+	assert.False(t, routeShader.RelayAllowed(1, 2, 3))
+	assert.True(t, routeShader.RelayAllowed(6, 2, 3))
+
+	// deny all excludes every relay, even with no lists
+
+	routeShader = core.NewRouteShader()
+	routeShader.RelayPolicyDenyAll = true
+
+	assert.True(t, routeShader.HasRelayPolicy())
+	assert.False(t, routeShader.RelayAllowed(1, 2, 3))
+}
+
+func TestRouteShader_InheritRelayPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	parent := core.NewRouteShader()
+	parent.DeniedSellers = []uint64{2}
+
+	// a route shader without a relay policy takes the parent relay policy
+
+	child := core.NewRouteShader()
+	child.InheritRelayPolicy(&parent)
+
+	assert.False(t, child.RelayAllowed(1, 2, 3))
+
+	// a route shader with its own relay policy keeps it
+
+	child = core.NewRouteShader()
+	child.AllowedRelays = []uint64{1}
+	child.InheritRelayPolicy(&parent)
+
+	assert.True(t, child.RelayAllowed(1, 2, 3))
+	assert.False(t, child.RelayAllowed(4, 5, 6))
+}
+
+func TestGetBestRoutes_ExcludedRelays(t *testing.T) {
+
+	t.Parallel()
+
+	env := NewTestEnvironment()
+
+	env.AddRelay("losangeles", "10.0.0.1")
+	env.AddRelay("chicago", "10.0.0.2")
+	env.AddRelay("a", "10.0.0.3")
+	env.AddRelay("b", "10.0.0.4")
+
+	env.SetCost("losangeles", "chicago", 100)
+	env.SetCost("losangeles", "a", 10)
+	env.SetCost("a", "chicago", 10)
+	env.SetCost("losangeles", "b", 20)
+	env.SetCost("b", "chicago", 20)
+
+	costMatrix, numRelays := env.GetCostMatrix()
+
+	routeMatrix := core.Optimize(numRelays, numRelays, costMatrix, env.price, env.GetRelayDatacenters())
+
+	sourceRelays, destRelays := env.ReframeRelays([]string{"losangeles"}, []string{"chicago"})
+	sourceRelayCost := []int32{1}
+
+	excludedRelays := make([]bool, numRelays)
+	excludedRelays[env.GetRelayIndex("a")] = true
+
+	// the best route cost skips the faster route through "a"
+
+	bestRouteCost := core.GetBestRouteCost(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, 0, 0)
+
+	assert.Equal(t, int32(1+40+constants.CostBias), bestRouteCost)
+
+	// none of the best routes go through "a"
+
+	bestRoutes := make([]core.BestRoute, 1024)
+	numBestRoutes := 0
+	core.GetBestRoutes(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, 1000, 0, 0, bestRoutes, &numBestRoutes)
+
+	assert.True(t, numBestRoutes > 0)
+	for i := 0; i < numBestRoutes; i++ {
+		for j := 0; j < int(bestRoutes[i].NumRelays); j++ {
+			assert.NotEqual(t, int32(env.GetRelayIndex("a")), bestRoutes[i].Relays[j])
+		}
+	}
+
+	// excluding every relay leaves no routes
+
+	for i := range excludedRelays {
+		excludedRelays[i] = true
+	}
+
+	core.GetBestRoutes(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, 1000, 0, 0, bestRoutes, &numBestRoutes)
+
+	assert.Equal(t, 0, numBestRoutes)
+}
+
+func TestRoutesAreRelayDisjoint(t *testing.T) {
+
+	t.Parallel()
+
+	assert.True(t, core.RoutesAreRelayDisjoint(2, []int32{0, 1}, 2, []int32{2, 3}))
+	assert.True(t, core.RoutesAreRelayDisjoint(0, []int32{}, 3, []int32{0, 1, 2}))
+	assert.False(t, core.RoutesAreRelayDisjoint(3, []int32{0, 1, 2}, 3, []int32{3, 1, 4}))
+	assert.False(t, core.RoutesAreRelayDisjoint(2, []int32{0, 1}, 2, []int32{1, 0}))
+
+	// relays past the number of relays in each route are ignored
+
+	assert.True(t, core.RoutesAreRelayDisjoint(1, []int32{0, 1}, 1, []int32{1, 0}))
+}
+
+func TestGetBestDisjointRoute(t *testing.T) {
+
+	t.Parallel()
+
+	env := NewTestEnvironment()
+
+	env.AddRelay("losangeles.a", "10.0.0.1")
+	env.AddRelay("losangeles.b", "10.0.0.2")
+	env.AddRelay("chicago.a", "10.0.0.3")
+	env.AddRelay("chicago.b", "10.0.0.4")
+	env.AddRelay("denver", "10.0.0.5")
+	env.AddRelay("dallas", "10.0.0.6")
+
+	env.SetCost("losangeles.a", "chicago.a", 20)
+	env.SetCost("losangeles.b", "denver", 10)
+	env.SetCost("denver", "chicago.b", 15)
+	env.SetCost("losangeles.b", "dallas", 20)
+	env.SetCost("dallas", "chicago.b", 20)
+	env.SetCost("losangeles.a", "denver", 10)
+
+	costMatrix, numRelays := env.GetCostMatrix()
+
+	routeMatrix := core.Optimize(numRelays, numRelays, costMatrix, env.price, env.GetRelayDatacenters())
+
+	sourceRelays, destRelays := env.ReframeRelays([]string{"losangeles.a", "losangeles.b"}, []string{"chicago.a", "chicago.b"})
+	sourceRelayCost := []int32{1, 2}
+
+	routeNumRelays := int32(2)
+	routeRelays := []int32{int32(env.GetRelayIndex("losangeles.a")), int32(env.GetRelayIndex("chicago.a"))}
+
+	// the lowest cost disjoint route goes losangeles.b -> denver -> chicago.b
+
+	disjointRouteCost := int32(0)
+	disjointRouteNumRelays := int32(0)
+	disjointRouteRelays := [constants.MaxRouteRelays]int32{}
+
+	result := core.GetBestDisjointRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, nil, 1000, 0, 0, routeNumRelays, routeRelays, &disjointRouteCost, &disjointRouteNumRelays, &disjointRouteRelays, nil)
+
+	assert.True(t, result)
+	assert.Equal(t, int32(2+25+constants.CostBias), disjointRouteCost)
+	assert.Equal(t, int32(3), disjointRouteNumRelays)
+	assert.Equal(t, int32(env.GetRelayIndex("losangeles.b")), disjointRouteRelays[0])
+	assert.Equal(t, int32(env.GetRelayIndex("denver")), disjointRouteRelays[1])
+	assert.Equal(t, int32(env.GetRelayIndex("chicago.b")), disjointRouteRelays[2])
+	assert.True(t, core.RoutesAreRelayDisjoint(routeNumRelays, routeRelays, disjointRouteNumRelays, disjointRouteRelays[:]))
+
+	// excluding denver picks the route via dallas
+
+	excludedRelays := make([]bool, numRelays)
+	excludedRelays[env.GetRelayIndex("denver")] = true
+
+	result = core.GetBestDisjointRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, excludedRelays, 1000, 0, 0, routeNumRelays, routeRelays, &disjointRouteCost, &disjointRouteNumRelays, &disjointRouteRelays, nil)
+
+	assert.True(t, result)
+	assert.Equal(t, int32(2+40+constants.CostBias), disjointRouteCost)
+	assert.Equal(t, int32(env.GetRelayIndex("dallas")), disjointRouteRelays[1])
+
+	// no disjoint route under max cost
+
+	result = core.GetBestDisjointRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, nil, 20, 0, 0, routeNumRelays, routeRelays, &disjointRouteCost, &disjointRouteNumRelays, &disjointRouteRelays, nil)
+
+	assert.False(t, result)
+
+	// with a single dest relay there is no disjoint route
+
+	sourceRelays, destRelays = env.ReframeRelays([]string{"losangeles.a", "losangeles.b"}, []string{"chicago.a"})
+
+	result = core.GetBestDisjointRoute(routeMatrix, sourceRelays, sourceRelayCost, destRelays, nil, 1000, 0, 0, routeNumRelays, routeRelays, &disjointRouteCost, &disjointRouteNumRelays, &disjointRouteRelays, nil)
+
+	assert.False(t, result)
+}
+
 func TestRouteToken(t *testing.T) {
 
 	t.Parallel()
@@ -2239,21 +2943,67 @@ func TestGetRandomBestRoute_LowestPrice(t *testing.T) {
 	env.SetCost("losangeles.a", "a", 10)
 	env.SetCost("losangeles.a", "b", 10)
 
-	env.SetCost("losangeles.b", "a", 10)
-	env.SetCost("losangeles.b", "b", 10)
+	env.SetCost("losangeles.b", "a", 10)
+	env.SetCost("losangeles.b", "b", 10)
+
+	env.SetCost("a", "chicago.a", 20)
+	env.SetCost("a", "chicago.b", 20)
+	env.SetCost("a", "b", 10)
+
+	env.SetCost("b", "chicago.a", 5)
+	env.SetCost("b", "chicago.b", 5)
+
+	env.SetCost("losangeles.b", "chicago.a", 50)
+	env.SetCost("losangeles.b", "chicago.b", 50)
+
+	env.SetPrice("losangeles.b", 10)
+	env.SetPrice("chicago.b", 10)
+
+	costMatrix, numRelays := env.GetCostMatrix()
+
+	relayDatacenters := env.GetRelayDatacenters()
+
+	numSegments := numRelays
+
+	routeMatrix := core.Optimize(numRelays, numSegments, costMatrix, env.price, relayDatacenters)
+
+	sourceRelayNames := []string{"losangeles.a", "losangeles.b"}
+	sourceRelayCosts := []int32{5, 2}
+
+	destRelayNames := []string{"chicago.a", "chicago.b"}
+
+	maxCost := int32(100)
+
+	bestRoute := env.GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelayNames, sourceRelayCosts, destRelayNames, maxCost)
+
+	assert.True(t, bestRoute != nil)
+	assert.True(t, bestRoute.cost > 0)
+	assert.True(t, bestRoute.cost <= maxCost)
+
+	assert.True(t, bestRoute.cost == 20+constants.CostBias)
+
+	assert.Equal(t, []string{"losangeles.a", "b", "chicago.a"}, bestRoute.relays)
+}
+
+func TestGetRandomBestRoute_LowestPrice_RelayLoaded(t *testing.T) {
+
+	t.Parallel()
+
+	env := NewTestEnvironment()
 
-	env.SetCost("a", "chicago.a", 20)
-	env.SetCost("a", "chicago.b", 20)
-	env.SetCost("a", "b", 10)
+	env.AddRelay("losangeles", "10.0.0.1")
+	env.AddRelay("chicago", "10.0.0.2")
+	env.AddRelay("a", "10.0.0.3")
+	env.AddRelay("b", "10.0.0.4")
 
-	env.SetCost("b", "chicago.a", 5)
-	env.SetCost("b", "chicago.b", 5)
+	env.SetCost("losangeles", "a", 10)
+	env.SetCost("a", "chicago", 6)
 
-	env.SetCost("losangeles.b", "chicago.a", 50)
-	env.SetCost("losangeles.b", "chicago.b", 50)
+	env.SetCost("losangeles", "b", 10)
+	env.SetCost("b", "chicago", 5)
 
-	env.SetPrice("losangeles.b", 10)
-	env.SetPrice("chicago.b", 10)
+	env.SetPrice("a", core.EffectiveRelayPrice(5, 12, 0, 0, 1.0, 0, 100))
+	env.SetPrice("b", core.EffectiveRelayPrice(0, 12, 0, 0, 1.0, 0, 100))
 
 	costMatrix, numRelays := env.GetCostMatrix()
 
@@ -2261,24 +3011,32 @@ func TestGetRandomBestRoute_LowestPrice(t *testing.T) {
 
 	numSegments := numRelays
 
-	routeMatrix := core.Optimize(numRelays, numSegments, costMatrix, env.price, relayDatacenters)
-
-	sourceRelayNames := []string{"losangeles.a", "losangeles.b"}
-	sourceRelayCosts := []int32{5, 2}
+	sourceRelayNames := []string{"losangeles"}
+	sourceRelayCosts := []int32{5}
 
-	destRelayNames := []string{"chicago.a", "chicago.b"}
+	destRelayNames := []string{"chicago"}
 
 	maxCost := int32(100)
 
+	// relay b is faster and cheaper, so it is selected
+
+	routeMatrix := core.Optimize(numRelays, numSegments, costMatrix, env.price, relayDatacenters)
+
 	bestRoute := env.GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelayNames, sourceRelayCosts, destRelayNames, maxCost)
 
 	assert.True(t, bestRoute != nil)
-	assert.True(t, bestRoute.cost > 0)
-	assert.True(t, bestRoute.cost <= maxCost)
+	assert.Equal(t, []string{"losangeles", "b", "chicago"}, bestRoute.relays)
 
-	assert.True(t, bestRoute.cost == 20+constants.CostBias)
+	// once relay b is heavily loaded its effective price goes up, and traffic moves to relay a
 
-	assert.Equal(t, []string{"losangeles.a", "b", "chicago.a"}, bestRoute.relays)
+	env.SetPrice("b", core.EffectiveRelayPrice(0, 12, 0, 0, 1.0, 75, 100))
+
+	routeMatrix = core.Optimize(numRelays, numSegments, costMatrix, env.price, relayDatacenters)
+
+	bestRoute = env.GetRandomBestRoute_LowestPrice(routeMatrix, sourceRelayNames, sourceRelayCosts, destRelayNames, maxCost)
+
+	assert.True(t, bestRoute != nil)
+	assert.Equal(t, []string{"losangeles", "a", "chicago"}, bestRoute.relays)
 }
 
 func TestGetRandomBestRoute_RelaysFull(t *testing.T) {
@@ -2883,6 +3641,8 @@ type TestData struct {
 
 	destRelays []int32
 
+	excludedRelays []bool
+
 	routeCost      int32
 	routeNumRelays int32
 	routeRelays    [constants.MaxRouteRelays]int32
@@ -2936,11 +3696,13 @@ func (test *TestData) TakeNetworkNext() bool {
 		test.sourceRelays,
 		test.sourceRelayCosts,
 		test.destRelays,
+		test.excludedRelays,
 		&test.routeCost,
 		&test.routeNumRelays,
 		test.routeRelays[:],
 		&test.debug,
 		test.sliceNumber,
+		nil,
 	)
 }
 
@@ -2960,10 +3722,12 @@ func (test *TestData) StayOnNetworkNext() (bool, bool) {
 		test.sourceRelays,
 		test.sourceRelayCosts,
 		test.destRelays,
+		test.excludedRelays,
 		&test.routeCost,
 		&test.routeNumRelays,
 		test.routeRelays[:],
 		&test.debug,
+		nil,
 	)
 }
 
@@ -4134,6 +4898,217 @@ func TestStayOnNetworkNext_ForceNext_RouteSwitched(t *testing.T) {
 
 // -------------------------------------------------------------
 
+func TestUpdateFlapDamping(t *testing.T) {
+
+	t.Parallel()
+
+	routeShader := core.NewRouteShader()
+	routeShader.FlapHoldSlices = 2
+	routeShader.FlapMaxHoldSlices = 6
+	routeShader.FlapDecaySlices = 3
+
+	routeState := core.RouteState{}
+
+	// each switch doubles the hold, up to the max hold slices
+
+	core.UpdateFlapDamping(&routeShader, &routeState, true)
+	assert.Equal(t, uint32(1), routeState.FlapCount)
+	assert.Equal(t, uint32(2), routeState.FlapHoldSlices)
+	assert.True(t, core.FlapDampingHold(&routeShader, &routeState))
+
+	core.UpdateFlapDamping(&routeShader, &routeState, true)
+	assert.Equal(t, uint32(2), routeState.FlapCount)
+	assert.Equal(t, uint32(4), routeState.FlapHoldSlices)
+
+	core.UpdateFlapDamping(&routeShader, &routeState, true)
+	assert.Equal(t, uint32(3), routeState.FlapCount)
+	assert.Equal(t, uint32(6), routeState.FlapHoldSlices)
+
+	// the hold counts down each slice without a switch, and one switch is forgotten every decay slices
+
+	core.UpdateFlapDamping(&routeShader, &routeState, false)
+	core.UpdateFlapDamping(&routeShader, &routeState, false)
+	assert.Equal(t, uint32(4), routeState.FlapHoldSlices)
+	assert.Equal(t, uint32(3), routeState.FlapCount)
+
+	core.UpdateFlapDamping(&routeShader, &routeState, false)
+	assert.Equal(t, uint32(3), routeState.FlapHoldSlices)
+	assert.Equal(t, uint32(2), routeState.FlapCount)
+
+	for i := 0; i < 3; i++ {
+		core.UpdateFlapDamping(&routeShader, &routeState, false)
+	}
+	assert.Equal(t, uint32(0), routeState.FlapHoldSlices)
+	assert.Equal(t, uint32(1), routeState.FlapCount)
+	assert.False(t, core.FlapDampingHold(&routeShader, &routeState))
+
+	// disabling flap damping clears the flap state
+
+	routeShader.FlapHoldSlices = 0
+
+	core.UpdateFlapDamping(&routeShader, &routeState, true)
+	assert.Equal(t, core.RouteState{}, routeState)
+	assert.False(t, core.FlapDampingHold(&routeShader, &routeState))
+}
+
+func NewTestData_Oscillating(aCost uint8, bCost uint8) *TestData {
+
+	// two routes from losangeles to chicago, one via "a" and one via "b"
+
+	env := NewTestEnvironment()
+
+	env.AddRelay("losangeles", "10.0.0.1")
+	env.AddRelay("chicago", "10.0.0.2")
+	env.AddRelay("a", "10.0.0.3")
+	env.AddRelay("b", "10.0.0.4")
+
+	env.SetCost("losangeles", "a", aCost)
+	env.SetCost("a", "chicago", aCost)
+	env.SetCost("losangeles", "b", bCost)
+	env.SetCost("b", "chicago", bCost)
+
+	test := NewTestData(env)
+
+	test.routeShader.RouteSelectThreshold = 0
+
+	test.directLatency = 200
+
+	test.sourceRelays = []int32{0}
+	test.sourceRelayCosts = []int32{1}
+
+	test.destRelays = []int32{1}
+
+	test.sliceNumber = 1
+
+	return test
+}
+
+func simulateOscillatingRoutes(t *testing.T, routeShader core.RouteShader, numSlices int) []int {
+
+	// latency via "a" and "b" swaps every slice, so without damping the session switches routes every slice
+
+	fast := NewTestData_Oscillating(10, 30)
+	slow := NewTestData_Oscillating(30, 10)
+
+	routeState := core.RouteState{}
+	routeNumRelays := int32(0)
+	routeRelays := [constants.MaxRouteRelays]int32{}
+
+	switchSlices := []int{}
+
+	for i := 0; i < numSlices; i++ {
+
+		test := fast
+		if i%2 == 1 {
+			test = slow
+		}
+
+		test.routeShader = routeShader
+		test.routeState = routeState
+
+		if i == 0 {
+			assert.True(t, test.TakeNetworkNext())
+		} else {
+			test.currentRouteNumRelays = routeNumRelays
+			test.currentRouteRelays = routeRelays
+			stayOnNext, routeSwitched := test.StayOnNetworkNext()
+			assert.True(t, stayOnNext)
+			if routeSwitched {
+				switchSlices = append(switchSlices, i)
+			}
+		}
+
+		routeState = test.routeState
+		routeNumRelays = test.routeNumRelays
+		routeRelays = test.routeRelays
+	}
+
+	return switchSlices
+}
+
+func TestStayOnNetworkNext_FlapDamping_Oscillating(t *testing.T) {
+
+	t.Parallel()
+
+	numSlices := 40
+
+	// without flap damping, the session switches route every slice
+
+	routeShader := core.NewRouteShader()
+	routeShader.RouteSelectThreshold = 0
+
+	undamped := simulateOscillatingRoutes(t, routeShader, numSlices)
+
+	assert.Equal(t, numSlices-1, len(undamped))
+
+	// with flap damping, the time between switches backs off exponentially, up to the max hold slices
+
+	routeShader.FlapHoldSlices = 1
+	routeShader.FlapMaxHoldSlices = 8
+	routeShader.FlapDecaySlices = 100
+
+	damped := simulateOscillatingRoutes(t, routeShader, numSlices)
+
+	assert.True(t, len(damped) > 0)
+	assert.True(t, len(damped) < len(undamped)/3)
+
+	for i := 1; i < len(damped); i++ {
+		gap := damped[i] - damped[i-1]
+		if i > 1 {
+			assert.True(t, gap >= damped[i-1]-damped[i-2])
+		}
+		assert.True(t, gap <= 8+2)
+	}
+}
+
+func TestStayOnNetworkNext_FlapDamping_HoldInsteadOfDirect(t *testing.T) {
+
+	t.Parallel()
+
+	// the current route via "a" is lost. the only other route via "b" reduces latency, but by less than the latency reduction threshold
+
+	test := NewTestData_Oscillating(10, 20)
+
+	test.directLatency = 50
+
+	test.excludedRelays = make([]bool, test.numRelays)
+	test.excludedRelays[2] = true
+
+	test.routeState.Next = true
+	test.routeState.ReduceLatency = true
+
+	test.currentRouteNumRelays = int32(3)
+	test.currentRouteRelays = [constants.MaxRouteRelays]int32{0, 2, 1}
+
+	// without flap damping, the session goes back to direct
+
+	stayOnNext, _ := test.StayOnNetworkNext()
+
+	assert.False(t, stayOnNext)
+	assert.True(t, test.routeState.Veto)
+
+	// while flap damping is holding the route, the session stays on network next via "b"
+
+	test.routeShader.FlapHoldSlices = 2
+
+	test.routeState = core.RouteState{}
+	test.routeState.Next = true
+	test.routeState.ReduceLatency = true
+	test.routeState.FlapCount = 1
+	test.routeState.FlapHoldSlices = 2
+
+	stayOnNext, routeSwitched := test.StayOnNetworkNext()
+
+	assert.True(t, stayOnNext)
+	assert.True(t, routeSwitched)
+	assert.Equal(t, int32(3), test.routeNumRelays)
+	assert.Equal(t, int32(3), test.routeRelays[1])
+	assert.Equal(t, uint32(2), test.routeState.FlapCount)
+	assert.Equal(t, uint32(4), test.routeState.FlapHoldSlices)
+}
+
+// -------------------------------------------------------------
+
 func randomBytes(buffer []byte) {
 	for i := 0; i < len(buffer); i++ {
 		buffer[i] = byte(rand.Intn(256))
@@ -4337,3 +5312,154 @@ func TestPagination(t *testing.T) {
 	}
 
 }
+
+// -------------------------------------------------------------------------------
+
+func NewTestData_RouteQuality() *TestData {
+
+	// two equivalent routes from losangeles to chicago, except the slightly faster route via "a" has packet loss
+
+	env := NewTestEnvironment()
+
+	env.AddRelay("losangeles", "10.0.0.1")
+	env.AddRelay("chicago", "10.0.0.2")
+	env.AddRelay("a", "10.0.0.3")
+	env.AddRelay("b", "10.0.0.4")
+
+	env.SetCost("losangeles", "a", 10)
+	env.SetCost("a", "chicago", 10)
+	env.SetCost("losangeles", "b", 11)
+	env.SetCost("b", "chicago", 11)
+
+	env.SetPacketLoss("losangeles", "a", 20)
+
+	test := NewTestData(env)
+
+	jitterMatrix, packetLossMatrix := env.GetJitterAndPacketLossMatrix()
+
+	test.routeMatrix = core.Optimize3(test.numRelays, test.numRelays, test.costMatrix, jitterMatrix, packetLossMatrix, env.price, test.relayDatacenters, env.GetDestRelays())
+
+	test.routeShader.RouteSelectThreshold = 0
+
+	test.directLatency = 100
+
+	test.sourceRelays = []int32{0}
+	test.sourceRelayCosts = []int32{1}
+
+	test.destRelays = []int32{1}
+
+	test.sliceNumber = 1
+
+	return test
+}
+
+func TestTakeNetworkNext_RouteQuality_Unweighted(t *testing.T) {
+
+	t.Parallel()
+
+	test := NewTestData_RouteQuality()
+
+	// without weights the route via "a" is the lowest cost, but "b" is within the cost bias of it, so either can be taken
+
+	assert.Equal(t, int32(1+20+constants.CostBias), core.GetBestRouteCost(test.routeMatrix, test.sourceRelays, test.sourceRelayCosts, test.destRelays, nil, 0, 0))
+
+	result := test.TakeNetworkNext()
+
+	assert.True(t, result)
+	assert.Equal(t, int32(3), test.routeNumRelays)
+}
+
+func TestTakeNetworkNext_RouteQuality_PacketLossWeight(t *testing.T) {
+
+	t.Parallel()
+
+	test := NewTestData_RouteQuality()
+
+	// 2% packet loss costs 6ms, so the route via "b" that is 2ms slower wins, and "a" is no longer within the cost bias of it
+
+	test.routeShader.PacketLossWeight = 3.0
+
+	assert.Equal(t, int32(1+22+constants.CostBias), core.GetBestRouteCost(test.routeMatrix, test.sourceRelays, test.sourceRelayCosts, test.destRelays, nil, 0, 3.0))
+
+	result := test.TakeNetworkNext()
+
+	assert.True(t, result)
+	assert.Equal(t, int32(3), test.routeNumRelays)
+	assert.Equal(t, "b", test.relayNames[test.routeRelays[1]])
+}
+
+// -------------------------------------------------------------------------------
+
+func NewTestData_ExcludedRelays() *TestData {
+
+	env := NewTestEnvironment()
+
+	env.AddRelay("losangeles", "10.0.0.1")
+	env.AddRelay("chicago", "10.0.0.2")
+	env.AddRelay("a", "10.0.0.3")
+	env.AddRelay("b", "10.0.0.4")
+
+	env.SetCost("losangeles", "a", 10)
+	env.SetCost("a", "chicago", 10)
+	env.SetCost("losangeles", "b", 11)
+	env.SetCost("b", "chicago", 11)
+
+	test := NewTestData(env)
+
+	test.directLatency = 100
+
+	test.sourceRelays = []int32{0}
+	test.sourceRelayCosts = []int32{1}
+
+	test.destRelays = []int32{1}
+
+	test.sliceNumber = 1
+
+	test.excludedRelays = make([]bool, test.numRelays)
+	test.excludedRelays[2] = true
+
+	return test
+}
+
+func TestTakeNetworkNext_ExcludedRelays(t *testing.T) {
+
+	t.Parallel()
+
+	for i := 0; i < 100; i++ {
+
+		test := NewTestData_ExcludedRelays()
+
+		result := test.TakeNetworkNext()
+
+		assert.True(t, result)
+		for j := 0; j < int(test.routeNumRelays); j++ {
+			assert.NotEqual(t, "a", test.relayNames[test.routeRelays[j]])
+		}
+	}
+}
+
+func TestStayOnNetworkNext_ExcludedRelays(t *testing.T) {
+
+	t.Parallel()
+
+	// the session is currently on a route through "a", which has since been excluded
+
+	test := NewTestData_ExcludedRelays()
+
+	test.routeState.Next = true
+
+	test.nextLatency = 30
+	test.predictedLatency = 30
+
+	test.currentRouteNumRelays = 3
+	test.currentRouteRelays = [constants.MaxRouteRelays]int32{0, 2, 1}
+
+	result, nextRouteSwitched := test.StayOnNetworkNext()
+
+	assert.True(t, result)
+	assert.True(t, nextRouteSwitched)
+	assert.Equal(t, int32(3), test.routeNumRelays)
+	for j := 0; j < int(test.routeNumRelays); j++ {
+		assert.NotEqual(t, "a", test.relayNames[test.routeRelays[j]])
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"net"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/networknext/next/modules/core"
@@ -49,19 +50,24 @@ type Relay struct {
 }
 
 type Buyer struct {
-	Id          uint64           `json:"id,string"`
-	Name        string           `json:"name"`
-	Code        string           `json:"code"`
-	Live        bool             `json:"live"`
-	Debug       bool             `json:"debug"`
-	PublicKey   []byte           `json:"public_key"`
-	RouteShader core.RouteShader `json:"route_shader"`
+	Id              uint64           `json:"id,string"`
+	Name            string           `json:"name"`
+	Code            string           `json:"code"`
+	Live            bool             `json:"live"`
+	Debug           bool             `json:"debug"`
+	PublicKey       []byte           `json:"public_key"`
+	RouteShader     core.RouteShader `json:"route_shader"`
+	PacketRateLimit int              `json:"packet_rate_limit"` // packets per-second. zero uses the server backend default
+	PacketRateBurst int              `json:"packet_rate_burst"` // packets. zero uses the packet rate limit
 }
 
 type Seller struct {
-	Id   uint64 `json:"id,string"`
-	Name string `json:"name"`
-	Code string `json:"code"`
+	Id                  uint64  `json:"id,string"`
+	Name                string  `json:"name"`
+	Code                string  `json:"code"`
+	PeakStartHour       int     `json:"peak_start_hour"` // hour of day in UTC
+	PeakEndHour         int     `json:"peak_end_hour"`   // hour of day in UTC. peak hours end before this hour
+	PeakPriceMultiplier float32 `json:"peak_price_multiplier"`
 }
 
 type Datacenter struct {
@@ -79,40 +85,56 @@ type BuyerDatacenterSettings struct {
 	EnableAcceleration bool   `json:"enable_acceleration"`
 }
 
+type BuyerDatacenterRouteShader struct {
+	BuyerId      uint64           `json:"buyer_id,string"`
+	DatacenterId uint64           `json:"datacenter_id,string"`
+	RouteShader  core.RouteShader `json:"route_shader"`
+}
+
+type BuyerCountryRouteShader struct {
+	BuyerId     uint64           `json:"buyer_id,string"`
+	Country     string           `json:"country"`
+	RouteShader core.RouteShader `json:"route_shader"`
+}
+
 type Database struct {
-	CreationTime            string                                         `json:"creation_time"`
-	Creator                 string                                         `json:"creator"`
-	Relays                  []Relay                                        `json:"relays"`
-	BuyerMap                map[uint64]*Buyer                              `json:"buyer_map"`
-	SellerMap               map[uint64]*Seller                             `json:"seller_map"`
-	DatacenterMap           map[uint64]*Datacenter                         `json:"datacenter"`
-	DatacenterRelays        map[uint64][]uint64                            `json:"datacenter_relays"`
-	BuyerDatacenterSettings map[uint64]map[uint64]*BuyerDatacenterSettings `json:"buyer_datacenter_settings"`
-	RelayMap                map[uint64]*Relay
-	RelayNameMap            map[string]*Relay
-	BuyerCodeMap            map[string]*Buyer
-	SellerCodeMap           map[string]*Seller
-	DatacenterNameMap       map[string]*Datacenter
-	RelaySecretKeys         map[uint64][]byte
+	CreationTime                string                                            `json:"creation_time"`
+	Creator                     string                                            `json:"creator"`
+	Relays                      []Relay                                           `json:"relays"`
+	BuyerMap                    map[uint64]*Buyer                                 `json:"buyer_map"`
+	SellerMap                   map[uint64]*Seller                                `json:"seller_map"`
+	DatacenterMap               map[uint64]*Datacenter                            `json:"datacenter"`
+	DatacenterRelays            map[uint64][]uint64                               `json:"datacenter_relays"`
+	BuyerDatacenterSettings     map[uint64]map[uint64]*BuyerDatacenterSettings    `json:"buyer_datacenter_settings"`
+	BuyerDatacenterRouteShaders map[uint64]map[uint64]*BuyerDatacenterRouteShader `json:"buyer_datacenter_route_shaders"`
+	BuyerCountryRouteShaders    map[uint64]map[string]*BuyerCountryRouteShader    `json:"buyer_country_route_shaders"`
+	RelayMap                    map[uint64]*Relay
+	RelayNameMap                map[string]*Relay
+	BuyerCodeMap                map[string]*Buyer
+	SellerCodeMap               map[string]*Seller
+	DatacenterNameMap           map[string]*Datacenter
+	RelaySecretKeys             map[uint64][]byte
 }
 
 func CreateDatabase() *Database {
 
 	database := &Database{
-		CreationTime:            "",
-		Creator:                 "",
-		Relays:                  []Relay{},
-		BuyerMap:                make(map[uint64]*Buyer),
-		SellerMap:               make(map[uint64]*Seller),
-		DatacenterMap:           make(map[uint64]*Datacenter),
-		DatacenterRelays:        make(map[uint64][]uint64),
-		BuyerDatacenterSettings: make(map[uint64]map[uint64]*BuyerDatacenterSettings),
-		RelayMap:                make(map[uint64]*Relay),
-		RelayNameMap:            make(map[string]*Relay),
-		BuyerCodeMap:            make(map[string]*Buyer),
-		SellerCodeMap:           make(map[string]*Seller),
-		DatacenterNameMap:       make(map[string]*Datacenter),
-		RelaySecretKeys:         make(map[uint64][]byte),
+		CreationTime:                "",
+		Creator:                     "",
+		Relays:                      []Relay{},
+		BuyerMap:                    make(map[uint64]*Buyer),
+		SellerMap:                   make(map[uint64]*Seller),
+		DatacenterMap:               make(map[uint64]*Datacenter),
+		DatacenterRelays:            make(map[uint64][]uint64),
+		BuyerDatacenterSettings:     make(map[uint64]map[uint64]*BuyerDatacenterSettings),
+		BuyerDatacenterRouteShaders: make(map[uint64]map[uint64]*BuyerDatacenterRouteShader),
+		BuyerCountryRouteShaders:    make(map[uint64]map[string]*BuyerCountryRouteShader),
+		RelayMap:                    make(map[uint64]*Relay),
+		RelayNameMap:                make(map[string]*Relay),
+		BuyerCodeMap:                make(map[string]*Buyer),
+		SellerCodeMap:               make(map[string]*Seller),
+		DatacenterNameMap:           make(map[string]*Datacenter),
+		RelaySecretKeys:             make(map[uint64][]byte),
 	}
 
 	return database
@@ -170,6 +192,24 @@ func (database *Database) Fixup() {
 	if len(database.RelaySecretKeys) == 0 {
 		database.RelaySecretKeys = make(map[uint64][]byte)
 	}
+
+	// route shader overrides replace the buyer route shader, but they must not drop the buyer's relay policy
+
+	for buyerId, overrides := range database.BuyerDatacenterRouteShaders {
+		if buyer := database.BuyerMap[buyerId]; buyer != nil {
+			for _, override := range overrides {
+				override.RouteShader.InheritRelayPolicy(&buyer.RouteShader)
+			}
+		}
+	}
+
+	for buyerId, overrides := range database.BuyerCountryRouteShaders {
+		if buyer := database.BuyerMap[buyerId]; buyer != nil {
+			for _, override := range overrides {
+				override.RouteShader.InheritRelayPolicy(&buyer.RouteShader)
+			}
+		}
+	}
 }
 
 func (database *Database) GenerateRelaySecretKeys(relayBackendPublicKey []byte, relayBackendPrivateKey []byte) int {
@@ -355,6 +395,28 @@ func (database *Database) Validate() error {
 		}
 	}
 
+	for buyerId, buyerMap := range database.BuyerDatacenterRouteShaders {
+		for datacenterId, override := range buyerMap {
+			if override.DatacenterId != datacenterId {
+				return fmt.Errorf("bad datacenter id in buyer datacenter route shader: %d vs %d", datacenterId, override.DatacenterId)
+			}
+			if override.BuyerId != buyerId {
+				return fmt.Errorf("bad buyer id in buyer datacenter route shader: %d vs %d", buyerId, override.BuyerId)
+			}
+		}
+	}
+
+	for buyerId, buyerMap := range database.BuyerCountryRouteShaders {
+		for country, override := range buyerMap {
+			if override.Country != country {
+				return fmt.Errorf("bad country in buyer country route shader: '%s' vs '%s'", country, override.Country)
+			}
+			if override.BuyerId != buyerId {
+				return fmt.Errorf("bad buyer id in buyer country route shader: %d vs %d", buyerId, override.BuyerId)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -392,6 +454,14 @@ func (database *Database) IsEmpty() bool {
 		return false
 	}
 
+	if len(database.BuyerDatacenterRouteShaders) != 0 {
+		return false
+	}
+
+	if len(database.BuyerCountryRouteShaders) != 0 {
+		return false
+	}
+
 	return true
 }
 
@@ -411,6 +481,36 @@ func (database *Database) DatacenterEnabled(buyerId uint64, datacenterId uint64)
 	return settings.EnableAcceleration
 }
 
+func buyerRateLimitString(buyer *Buyer) string {
+	if buyer.PacketRateLimit <= 0 {
+		return "default"
+	}
+	if buyer.PacketRateBurst <= 0 {
+		return fmt.Sprintf("%d/s", buyer.PacketRateLimit)
+	}
+	return fmt.Sprintf("%d/s (burst %d)", buyer.PacketRateLimit, buyer.PacketRateBurst)
+}
+
+func (database *Database) HasCountryRouteShaders(buyerId uint64) bool {
+	return len(database.BuyerCountryRouteShaders[buyerId]) != 0
+}
+
+/*
+	Route shader overrides are layered on top of the buyer route shader.
+
+	An override for the player's country wins over an override for the server's datacenter, which wins over the buyer route shader.
+*/
+
+func (database *Database) GetRouteShader(buyer *Buyer, datacenterId uint64, country string) *core.RouteShader {
+	if override := database.BuyerCountryRouteShaders[buyer.Id][country]; override != nil {
+		return &override.RouteShader
+	}
+	if override := database.BuyerDatacenterRouteShaders[buyer.Id][datacenterId]; override != nil {
+		return &override.RouteShader
+	}
+	return &buyer.RouteShader
+}
+
 func (database *Database) GetRelay(relayId uint64) *Relay {
 	return database.RelayMap[relayId]
 }
@@ -467,6 +567,45 @@ func (database *Database) GetDatacenterRelays(datacenterId uint64) []uint64 {
 	return database.DatacenterRelays[datacenterId]
 }
 
+func (database *Database) sellerCodes(sellerIds []uint64) string {
+	codes := make([]string, 0, len(sellerIds))
+	for _, sellerId := range sellerIds {
+		seller := database.SellerMap[sellerId]
+		if seller != nil {
+			codes = append(codes, seller.Code)
+		} else {
+			codes = append(codes, fmt.Sprintf("%d", sellerId))
+		}
+	}
+	return strings.Join(codes, ",")
+}
+
+func (database *Database) datacenterNames(datacenterIds []uint64) string {
+	names := make([]string, 0, len(datacenterIds))
+	for _, datacenterId := range datacenterIds {
+		datacenter := database.DatacenterMap[datacenterId]
+		if datacenter != nil {
+			names = append(names, datacenter.Name)
+		} else {
+			names = append(names, fmt.Sprintf("%x", datacenterId))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (database *Database) relayNames(relayIds []uint64) string {
+	names := make([]string, 0, len(relayIds))
+	for _, relayId := range relayIds {
+		relay := database.RelayMap[relayId]
+		if relay != nil {
+			names = append(names, relay.Name)
+		} else {
+			names = append(names, fmt.Sprintf("%x", relayId))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
 func (database *Database) String() string {
 
 	output := "Headers:\n\n"
@@ -493,6 +632,7 @@ func (database *Database) String() string {
 		Id              string
 		Live            string
 		Debug           string
+		RateLimit       string
 		PublicKeyBase64 string
 	}
 
@@ -509,6 +649,7 @@ func (database *Database) String() string {
 			Name:            v.Name,
 			Live:            fmt.Sprintf("%v", v.Live),
 			Debug:           fmt.Sprintf("%v", v.Debug),
+			RateLimit:       buyerRateLimitString(v),
 			PublicKeyBase64: base64.StdEncoding.EncodeToString(data),
 		}
 
@@ -524,8 +665,10 @@ func (database *Database) String() string {
 	output += "\n\nSellers:\n\n"
 
 	type SellerRow struct {
-		Name string
-		Id   string
+		Name      string
+		Id        string
+		PeakHours string
+		PeakPrice string
 	}
 
 	sellers := []SellerRow{}
@@ -533,8 +676,10 @@ func (database *Database) String() string {
 	for _, v := range database.SellerMap {
 
 		row := SellerRow{
-			Id:   fmt.Sprintf("%d", v.Id),
-			Name: v.Name,
+			Id:        fmt.Sprintf("%d", v.Id),
+			Name:      v.Name,
+			PeakHours: fmt.Sprintf("%d-%d", v.PeakStartHour, v.PeakEndHour),
+			PeakPrice: fmt.Sprintf("%.2f", v.PeakPriceMultiplier),
 		}
 
 		sellers = append(sellers, row)
@@ -648,6 +793,19 @@ func (database *Database) String() string {
 		properties = append(properties, PropertyRow{"Route Select Threshold", fmt.Sprintf("%dms", routeShader.RouteSelectThreshold)})
 		properties = append(properties, PropertyRow{"Route Switch Threshold", fmt.Sprintf("%dms", routeShader.RouteSwitchThreshold)})
 		properties = append(properties, PropertyRow{"Max Latency Trade Off", fmt.Sprintf("%dms", routeShader.MaxLatencyTradeOff)})
+		properties = append(properties, PropertyRow{"Jitter Weight", fmt.Sprintf("%.2f", routeShader.JitterWeight)})
+		properties = append(properties, PropertyRow{"Packet Loss Weight", fmt.Sprintf("%.2f", routeShader.PacketLossWeight)})
+		properties = append(properties, PropertyRow{"Redundant Route", fmt.Sprintf("%v", routeShader.RedundantRoute)})
+		properties = append(properties, PropertyRow{"Flap Hold Slices", fmt.Sprintf("%d", routeShader.FlapHoldSlices)})
+		properties = append(properties, PropertyRow{"Flap Max Hold Slices", fmt.Sprintf("%d", routeShader.FlapMaxHoldSlices)})
+		properties = append(properties, PropertyRow{"Flap Decay Slices", fmt.Sprintf("%d", routeShader.FlapDecaySlices)})
+		properties = append(properties, PropertyRow{"Allowed Sellers", database.sellerCodes(routeShader.AllowedSellers)})
+		properties = append(properties, PropertyRow{"Denied Sellers", database.sellerCodes(routeShader.DeniedSellers)})
+		properties = append(properties, PropertyRow{"Allowed Datacenters", database.datacenterNames(routeShader.AllowedDatacenters)})
+		properties = append(properties, PropertyRow{"Denied Datacenters", database.datacenterNames(routeShader.DeniedDatacenters)})
+		properties = append(properties, PropertyRow{"Allowed Relays", database.relayNames(routeShader.AllowedRelays)})
+		properties = append(properties, PropertyRow{"Denied Relays", database.relayNames(routeShader.DeniedRelays)})
+		properties = append(properties, PropertyRow{"Relay Policy Deny All", fmt.Sprintf("%v", routeShader.RelayPolicyDenyAll)})
 
 		output += table.Table(properties)
 	}
@@ -693,9 +851,75 @@ func (database *Database) String() string {
 
 	output += table.Table(destinationDatacenters)
 
+	// route shader overrides
+
+	output += "\n\nRoute shader overrides:\n\n"
+
+	output += table.Table(database.routeShaderOverrides())
+
 	return output
 }
 
+type routeShaderOverrideRow struct {
+	Buyer                     string
+	Override                  string
+	DisableNetworkNext        bool
+	ForceNext                 bool
+	AcceptableLatency         int32
+	LatencyReductionThreshold int32
+	RouteSelectThreshold      int32
+	RouteSwitchThreshold      int32
+	MaxLatencyTradeOff        int32
+}
+
+func (database *Database) routeShaderOverrides() []routeShaderOverrideRow {
+
+	rows := make([]routeShaderOverrideRow, 0)
+
+	addRow := func(buyerId uint64, override string, routeShader *core.RouteShader) {
+		buyerName := fmt.Sprintf("%016x", buyerId)
+		if buyer := database.BuyerMap[buyerId]; buyer != nil {
+			buyerName = buyer.Name
+		}
+		rows = append(rows, routeShaderOverrideRow{
+			Buyer:                     buyerName,
+			Override:                  override,
+			DisableNetworkNext:        routeShader.DisableNetworkNext,
+			ForceNext:                 routeShader.ForceNext,
+			AcceptableLatency:         routeShader.AcceptableLatency,
+			LatencyReductionThreshold: routeShader.LatencyReductionThreshold,
+			RouteSelectThreshold:      routeShader.RouteSelectThreshold,
+			RouteSwitchThreshold:      routeShader.RouteSwitchThreshold,
+			MaxLatencyTradeOff:        routeShader.MaxLatencyTradeOff,
+		})
+	}
+
+	for buyerId, buyerMap := range database.BuyerDatacenterRouteShaders {
+		for datacenterId, override := range buyerMap {
+			datacenterName := fmt.Sprintf("%016x", datacenterId)
+			if datacenter := database.DatacenterMap[datacenterId]; datacenter != nil {
+				datacenterName = datacenter.Name
+			}
+			addRow(buyerId, "datacenter "+datacenterName, &override.RouteShader)
+		}
+	}
+
+	for buyerId, buyerMap := range database.BuyerCountryRouteShaders {
+		for country, override := range buyerMap {
+			addRow(buyerId, "country "+country, &override.RouteShader)
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Buyer != rows[j].Buyer {
+			return rows[i].Buyer < rows[j].Buyer
+		}
+		return rows[i].Override < rows[j].Override
+	})
+
+	return rows
+}
+
 // ---------------------------------------------------------------------
 
 func (database *Database) WriteHTML(w io.Writer) {
@@ -736,6 +960,7 @@ func (database *Database) WriteHTML(w io.Writer) {
 		Id              string
 		Live            string
 		Debug           string
+		RateLimit       string
 		PublicKeyBase64 string
 	}
 
@@ -752,6 +977,7 @@ func (database *Database) WriteHTML(w io.Writer) {
 			Name:            v.Name,
 			Live:            fmt.Sprintf("%v", v.Live),
 			Debug:           fmt.Sprintf("%v", v.Debug),
+			RateLimit:       buyerRateLimitString(v),
 			PublicKeyBase64: base64.StdEncoding.EncodeToString(data),
 		}
 
@@ -762,17 +988,19 @@ func (database *Database) WriteHTML(w io.Writer) {
 
 	fmt.Fprintf(w, "<br><br>Buyers:<br><br>")
 	fmt.Fprintf(w, "<table>\n")
-	fmt.Fprintf(w, "<tr><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td></tr>\n", "Name", "Id", "Live", "Debug", "Public Key Base64")
+	fmt.Fprintf(w, "<tr><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td></tr>\n", "Name", "Id", "Live", "Debug", "Rate Limit", "Public Key Base64")
 	for i := range buyers {
-		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n", buyers[i].Name, buyers[i].Id, buyers[i].Live, buyers[i].Debug, buyers[i].PublicKeyBase64)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n", buyers[i].Name, buyers[i].Id, buyers[i].Live, buyers[i].Debug, buyers[i].RateLimit, buyers[i].PublicKeyBase64)
 	}
 	fmt.Fprintf(w, "</table>\n")
 
 	// sellers
 
 	type SellerRow struct {
-		Name string
-		Id   string
+		Name      string
+		Id        string
+		PeakHours string
+		PeakPrice string
 	}
 
 	sellers := []SellerRow{}
@@ -780,8 +1008,10 @@ func (database *Database) WriteHTML(w io.Writer) {
 	for _, v := range database.SellerMap {
 
 		row := SellerRow{
-			Id:   fmt.Sprintf("%016x", v.Id),
-			Name: v.Name,
+			Id:        fmt.Sprintf("%016x", v.Id),
+			Name:      v.Name,
+			PeakHours: fmt.Sprintf("%d-%d", v.PeakStartHour, v.PeakEndHour),
+			PeakPrice: fmt.Sprintf("%.2f", v.PeakPriceMultiplier),
 		}
 
 		sellers = append(sellers, row)
@@ -791,9 +1021,9 @@ func (database *Database) WriteHTML(w io.Writer) {
 
 	fmt.Fprintf(w, "<br><br>Sellers:<br><br>")
 	fmt.Fprintf(w, "<table>\n")
-	fmt.Fprintf(w, "<tr><td><b>%s</b></td><td><b>%s</b></td></tr>\n", "Name", "Id")
+	fmt.Fprintf(w, "<tr><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td></tr>\n", "Name", "Id", "Peak Hours", "Peak Price")
 	for i := range sellers {
-		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td></tr>\n", sellers[i].Name, sellers[i].Id)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n", sellers[i].Name, sellers[i].Id, sellers[i].PeakHours, sellers[i].PeakPrice)
 	}
 	fmt.Fprintf(w, "</table>\n")
 
@@ -897,6 +1127,19 @@ func (database *Database) WriteHTML(w io.Writer) {
 		fmt.Fprintf(w, "<tr><td>%s</td><td>%dms</td>\n", "Route Select Threshold", routeShader.RouteSelectThreshold)
 		fmt.Fprintf(w, "<tr><td>%s</td><td>%dms</td>\n", "Route Switch Threshold", routeShader.RouteSwitchThreshold)
 		fmt.Fprintf(w, "<tr><td>%s</td><td>%dms</td>\n", "Max Latency Trade Off", routeShader.MaxLatencyTradeOff)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%.2f</td>\n", "Jitter Weight", routeShader.JitterWeight)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%.2f</td>\n", "Packet Loss Weight", routeShader.PacketLossWeight)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%v</td>\n", "Redundant Route", routeShader.RedundantRoute)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td>\n", "Flap Hold Slices", routeShader.FlapHoldSlices)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td>\n", "Flap Max Hold Slices", routeShader.FlapMaxHoldSlices)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td>\n", "Flap Decay Slices", routeShader.FlapDecaySlices)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td>\n", "Allowed Sellers", database.sellerCodes(routeShader.AllowedSellers))
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td>\n", "Denied Sellers", database.sellerCodes(routeShader.DeniedSellers))
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td>\n", "Allowed Datacenters", database.datacenterNames(routeShader.AllowedDatacenters))
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td>\n", "Denied Datacenters", database.datacenterNames(routeShader.DeniedDatacenters))
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td>\n", "Allowed Relays", database.relayNames(routeShader.AllowedRelays))
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td>\n", "Denied Relays", database.relayNames(routeShader.DeniedRelays))
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%v</td>\n", "Relay Policy Deny All", routeShader.RelayPolicyDenyAll)
 		fmt.Fprintf(w, "</table>\n")
 	}
 
@@ -945,6 +1188,19 @@ func (database *Database) WriteHTML(w io.Writer) {
 	}
 	fmt.Fprintf(w, "</table>\n")
 
+	// route shader overrides
+
+	routeShaderOverrides := database.routeShaderOverrides()
+
+	fmt.Fprintf(w, "<br><br>Route shader overrides:<br><br>")
+	fmt.Fprintf(w, "<table>\n")
+	fmt.Fprintf(w, "<tr><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td><td><b>%s</b></td></tr>\n", "Buyer", "Override", "Disable Network Next", "Force Next", "Acceptable Latency", "Latency Threshold", "Route Select Threshold", "Route Switch Threshold", "Max Latency Trade Off")
+	for i := range routeShaderOverrides {
+		row := &routeShaderOverrides[i]
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%v</td><td>%v</td><td>%dms</td><td>%dms</td><td>%dms</td><td>%dms</td><td>%dms</td></tr>\n", row.Buyer, row.Override, row.DisableNetworkNext, row.ForceNext, row.AcceptableLatency, row.LatencyReductionThreshold, row.RouteSelectThreshold, row.RouteSwitchThreshold, row.MaxLatencyTradeOff)
+	}
+	fmt.Fprintf(w, "</table>\n")
+
 	const htmlFooter = `</body></html>`
 
 	fmt.Fprintf(w, "%s\n", htmlFooter)
@@ -1046,11 +1302,13 @@ func ExtractDatabase(config string) (*Database, error) {
 		route_shader_id   uint64
 		live              bool
 		debug             bool
+		packet_rate_limit int
+		packet_rate_burst int
 	}
 
 	buyerRows := make([]BuyerRow, 0)
 	{
-		rows, err := pgsql.Query("SELECT buyer_id, buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug FROM buyers")
+		rows, err := pgsql.Query("SELECT buyer_id, buyer_name, buyer_code, public_key_base64, route_shader_id, live, debug, packet_rate_limit, packet_rate_burst FROM buyers")
 		if err != nil {
 			return nil, fmt.Errorf("could not extract buyers: %v\n", err)
 		}
@@ -1059,7 +1317,7 @@ func ExtractDatabase(config string) (*Database, error) {
 
 		for rows.Next() {
 			row := BuyerRow{}
-			if err := rows.Scan(&row.buyer_id, &row.buyer_name, &row.buyer_code, &row.public_key_base64, &row.route_shader_id, &row.live, &row.debug); err != nil {
+			if err := rows.Scan(&row.buyer_id, &row.buyer_name, &row.buyer_code, &row.public_key_base64, &row.route_shader_id, &row.live, &row.debug, &row.packet_rate_limit, &row.packet_rate_burst); err != nil {
 				return nil, fmt.Errorf("failed to scan buyer row: %v\n", err)
 			}
 			buyerRows = append(buyerRows, row)
@@ -1069,14 +1327,17 @@ func ExtractDatabase(config string) (*Database, error) {
 	// sellers
 
 	type SellerRow struct {
-		seller_id   uint64
-		seller_name string
-		seller_code string
+		seller_id             uint64
+		seller_name           string
+		seller_code           string
+		peak_start_hour       int
+		peak_end_hour         int
+		peak_price_multiplier float32
 	}
 
 	sellerRows := make([]SellerRow, 0)
 	{
-		rows, err := pgsql.Query("SELECT seller_id, seller_name, seller_code FROM sellers")
+		rows, err := pgsql.Query("SELECT seller_id, seller_name, seller_code, peak_start_hour, peak_end_hour, peak_price_multiplier FROM sellers")
 		if err != nil {
 			return nil, fmt.Errorf("could not extract sellers: %v\n", err)
 		}
@@ -1085,7 +1346,7 @@ func ExtractDatabase(config string) (*Database, error) {
 
 		for rows.Next() {
 			row := SellerRow{}
-			if err := rows.Scan(&row.seller_id, &row.seller_name, &row.seller_code); err != nil {
+			if err := rows.Scan(&row.seller_id, &row.seller_name, &row.seller_code, &row.peak_start_hour, &row.peak_end_hour, &row.peak_price_multiplier); err != nil {
 				return nil, fmt.Errorf("failed to scan seller row: %v\n", err)
 			}
 			sellerRows = append(sellerRows, row)
@@ -1108,11 +1369,23 @@ func ExtractDatabase(config string) (*Database, error) {
 		route_switch_threshold           int
 		route_select_threshold           int
 		force_next                       bool
+		jitter_weight                    float32
+		packet_loss_weight               float32
+		allowed_sellers                  string
+		denied_sellers                   string
+		allowed_datacenters              string
+		denied_datacenters               string
+		allowed_relays                   string
+		denied_relays                    string
+		redundant_route                  bool
+		flap_hold_slices                 int
+		flap_max_hold_slices             int
+		flap_decay_slices                int
 	}
 
 	routeShaderRows := make([]RouteShaderRow, 0)
 	{
-		rows, err := pgsql.Query("SELECT route_shader_id, ab_test, acceptable_latency, acceptable_packet_loss, bandwidth_envelope_down_kbps, bandwidth_envelope_up_kbps, disable_network_next, latency_reduction_threshold, selection_percent, max_latency_trade_off, route_switch_threshold, route_select_threshold, force_next FROM route_shaders")
+		rows, err := pgsql.Query("SELECT route_shader_id, ab_test, acceptable_latency, acceptable_packet_loss, bandwidth_envelope_down_kbps, bandwidth_envelope_up_kbps, disable_network_next, latency_reduction_threshold, selection_percent, max_latency_trade_off, route_switch_threshold, route_select_threshold, force_next, jitter_weight, packet_loss_weight, allowed_sellers, denied_sellers, allowed_datacenters, denied_datacenters, allowed_relays, denied_relays, redundant_route, flap_hold_slices, flap_max_hold_slices, flap_decay_slices FROM route_shaders")
 		if err != nil {
 			return nil, fmt.Errorf("could not extract route shaders: %v\n", err)
 		}
@@ -1121,7 +1394,7 @@ func ExtractDatabase(config string) (*Database, error) {
 
 		for rows.Next() {
 			row := RouteShaderRow{}
-			if err := rows.Scan(&row.route_shader_id, &row.ab_test, &row.acceptable_latency, &row.acceptable_packet_loss, &row.bandwidth_envelope_down_kbps, &row.bandwidth_envelope_up_kbps, &row.disable_network_next, &row.latency_reduction_threshold, &row.selection_percent, &row.max_latency_trade_off, &row.route_switch_threshold, &row.route_select_threshold, &row.force_next); err != nil {
+			if err := rows.Scan(&row.route_shader_id, &row.ab_test, &row.acceptable_latency, &row.acceptable_packet_loss, &row.bandwidth_envelope_down_kbps, &row.bandwidth_envelope_up_kbps, &row.disable_network_next, &row.latency_reduction_threshold, &row.selection_percent, &row.max_latency_trade_off, &row.route_switch_threshold, &row.route_select_threshold, &row.force_next, &row.jitter_weight, &row.packet_loss_weight, &row.allowed_sellers, &row.denied_sellers, &row.allowed_datacenters, &row.denied_datacenters, &row.allowed_relays, &row.denied_relays, &row.redundant_route, &row.flap_hold_slices, &row.flap_max_hold_slices, &row.flap_decay_slices); err != nil {
 				return nil, fmt.Errorf("failed to scan route shader row: %v\n", err)
 			}
 			routeShaderRows = append(routeShaderRows, row)
@@ -1154,6 +1427,58 @@ func ExtractDatabase(config string) (*Database, error) {
 		}
 	}
 
+	// buyer datacenter route shaders
+
+	type BuyerDatacenterRouteShaderRow struct {
+		buyer_id        uint64
+		datacenter_id   uint64
+		route_shader_id uint64
+	}
+
+	buyerDatacenterRouteShaderRows := make([]BuyerDatacenterRouteShaderRow, 0)
+	{
+		rows, err := pgsql.Query("SELECT buyer_id, datacenter_id, route_shader_id FROM buyer_datacenter_route_shaders")
+		if err != nil {
+			return nil, fmt.Errorf("could not extract buyer datacenter route shaders: %v\n", err)
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			row := BuyerDatacenterRouteShaderRow{}
+			if err := rows.Scan(&row.buyer_id, &row.datacenter_id, &row.route_shader_id); err != nil {
+				return nil, fmt.Errorf("failed to scan buyer datacenter route shader row: %v\n", err)
+			}
+			buyerDatacenterRouteShaderRows = append(buyerDatacenterRouteShaderRows, row)
+		}
+	}
+
+	// buyer country route shaders
+
+	type BuyerCountryRouteShaderRow struct {
+		buyer_id        uint64
+		country         string
+		route_shader_id uint64
+	}
+
+	buyerCountryRouteShaderRows := make([]BuyerCountryRouteShaderRow, 0)
+	{
+		rows, err := pgsql.Query("SELECT buyer_id, country, route_shader_id FROM buyer_country_route_shaders")
+		if err != nil {
+			return nil, fmt.Errorf("could not extract buyer country route shaders: %v\n", err)
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			row := BuyerCountryRouteShaderRow{}
+			if err := rows.Scan(&row.buyer_id, &row.country, &row.route_shader_id); err != nil {
+				return nil, fmt.Errorf("failed to scan buyer country route shader row: %v\n", err)
+			}
+			buyerCountryRouteShaderRows = append(buyerCountryRouteShaderRows, row)
+		}
+	}
+
 	// print out rows
 
 	fmt.Printf("\nrelays:\n")
@@ -1173,12 +1498,12 @@ func ExtractDatabase(config string) (*Database, error) {
 
 	fmt.Printf("\nsellers:\n")
 	for _, row := range sellerRows {
-		fmt.Printf("%d: %s, %s\n", row.seller_id, row.seller_name, row.seller_code)
+		fmt.Printf("%d: %s, %s, %d, %d, %.2f\n", row.seller_id, row.seller_name, row.seller_code, row.peak_start_hour, row.peak_end_hour, row.peak_price_multiplier)
 	}
 
 	fmt.Printf("\nroute shaders:\n")
 	for _, row := range routeShaderRows {
-		fmt.Printf("%d: %v, %d, %.1f, %d, %d, %v, %d, %d, %d, %d, %d, %v\n",
+		fmt.Printf("%d: %v, %d, %.1f, %d, %d, %v, %d, %d, %d, %d, %d, %v, %.2f, %.2f, '%s', '%s', '%s', '%s', '%s', '%s', %v, %d, %d, %d\n",
 			row.route_shader_id,
 			row.ab_test,
 			row.acceptable_latency,
@@ -1191,7 +1516,19 @@ func ExtractDatabase(config string) (*Database, error) {
 			row.max_latency_trade_off,
 			row.route_switch_threshold,
 			row.route_select_threshold,
-			row.force_next)
+			row.force_next,
+			row.jitter_weight,
+			row.packet_loss_weight,
+			row.allowed_sellers,
+			row.denied_sellers,
+			row.allowed_datacenters,
+			row.denied_datacenters,
+			row.allowed_relays,
+			row.denied_relays,
+			row.redundant_route,
+			row.flap_hold_slices,
+			row.flap_max_hold_slices,
+			row.flap_decay_slices)
 	}
 
 	fmt.Printf("\nbuyer datacenter settings:\n")
@@ -1199,6 +1536,16 @@ func ExtractDatabase(config string) (*Database, error) {
 		fmt.Printf("(%d,%d): %v\n", row.buyer_id, row.datacenter_id, row.enable_acceleration)
 	}
 
+	fmt.Printf("\nbuyer datacenter route shaders:\n")
+	for _, row := range buyerDatacenterRouteShaderRows {
+		fmt.Printf("(%d,%d): %d\n", row.buyer_id, row.datacenter_id, row.route_shader_id)
+	}
+
+	fmt.Printf("\nbuyer country route shaders:\n")
+	for _, row := range buyerCountryRouteShaderRows {
+		fmt.Printf("(%d,%s): %d\n", row.buyer_id, row.country, row.route_shader_id)
+	}
+
 	// index datacenters by postgres id
 
 	datacenterIndex := make(map[uint64]DatacenterRow)
@@ -1227,6 +1574,31 @@ func ExtractDatabase(config string) (*Database, error) {
 		routeShaderIndex[row.route_shader_id] = row
 	}
 
+	// convert route shader rows to route shaders. the relay policy is resolved later, once sellers, datacenters and relays exist
+
+	routeShaderFromRow := func(row RouteShaderRow) core.RouteShader {
+		routeShader := core.RouteShader{}
+		routeShader.DisableNetworkNext = row.disable_network_next
+		routeShader.SelectionPercent = row.selection_percent
+		routeShader.ABTest = row.ab_test
+		routeShader.AcceptableLatency = int32(row.acceptable_latency)
+		routeShader.LatencyReductionThreshold = int32(row.latency_reduction_threshold)
+		routeShader.AcceptablePacketLoss = row.acceptable_packet_loss
+		routeShader.BandwidthEnvelopeUpKbps = int32(row.bandwidth_envelope_up_kbps)
+		routeShader.BandwidthEnvelopeDownKbps = int32(row.bandwidth_envelope_down_kbps)
+		routeShader.RouteSelectThreshold = int32(row.route_select_threshold)
+		routeShader.RouteSwitchThreshold = int32(row.route_switch_threshold)
+		routeShader.MaxLatencyTradeOff = int32(row.max_latency_trade_off)
+		routeShader.ForceNext = row.force_next
+		routeShader.JitterWeight = row.jitter_weight
+		routeShader.PacketLossWeight = row.packet_loss_weight
+		routeShader.RedundantRoute = row.redundant_route
+		routeShader.FlapHoldSlices = int32(row.flap_hold_slices)
+		routeShader.FlapMaxHoldSlices = int32(row.flap_max_hold_slices)
+		routeShader.FlapDecaySlices = int32(row.flap_decay_slices)
+		return routeShader
+	}
+
 	// build database
 
 	fmt.Printf("\nbuilding network next database...\n\n")
@@ -1245,12 +1617,19 @@ func ExtractDatabase(config string) (*Database, error) {
 		seller.Id = row.seller_id
 		seller.Name = row.seller_name
 		seller.Code = row.seller_code
+		seller.PeakStartHour = row.peak_start_hour
+		seller.PeakEndHour = row.peak_end_hour
+		seller.PeakPriceMultiplier = row.peak_price_multiplier
 
 		database.SellerMap[seller.Id] = &seller
 
 		fmt.Printf("seller %d: %s %s [%d]\n", i, seller.Name, seller.Code, seller.Id)
 	}
 
+	buyerRouteShaderRows := make(map[uint64]RouteShaderRow)
+
+	buyerRuntimeIds := make(map[uint64]uint64)
+
 	for i, row := range buyerRows {
 
 		buyer := Buyer{}
@@ -1274,28 +1653,23 @@ func ExtractDatabase(config string) (*Database, error) {
 
 		buyer.Live = row.live
 		buyer.Debug = row.debug
+		buyer.PacketRateLimit = row.packet_rate_limit
+		buyer.PacketRateBurst = row.packet_rate_burst
 
 		route_shader_row, route_shader_exists := routeShaderIndex[row.route_shader_id]
 		if !route_shader_exists {
 			return nil, fmt.Errorf("buyer %s does not have a route shader\n", buyer.Name)
 		}
 
-		buyer.RouteShader.DisableNetworkNext = route_shader_row.disable_network_next
-		buyer.RouteShader.SelectionPercent = route_shader_row.selection_percent
-		buyer.RouteShader.ABTest = route_shader_row.ab_test
-		buyer.RouteShader.AcceptableLatency = int32(route_shader_row.acceptable_latency)
-		buyer.RouteShader.LatencyReductionThreshold = int32(route_shader_row.latency_reduction_threshold)
-		buyer.RouteShader.AcceptablePacketLoss = route_shader_row.acceptable_packet_loss
-		buyer.RouteShader.BandwidthEnvelopeUpKbps = int32(route_shader_row.bandwidth_envelope_up_kbps)
-		buyer.RouteShader.BandwidthEnvelopeDownKbps = int32(route_shader_row.bandwidth_envelope_down_kbps)
-		buyer.RouteShader.RouteSelectThreshold = int32(route_shader_row.route_select_threshold)
-		buyer.RouteShader.RouteSwitchThreshold = int32(route_shader_row.route_switch_threshold)
-		buyer.RouteShader.MaxLatencyTradeOff = int32(route_shader_row.max_latency_trade_off)
-		buyer.RouteShader.ForceNext = route_shader_row.force_next
+		buyer.RouteShader = routeShaderFromRow(route_shader_row)
+
+		buyerRouteShaderRows[buyer.Id] = route_shader_row
+
+		buyerRuntimeIds[row.buyer_id] = buyer.Id
 
 		database.BuyerMap[buyer.Id] = &buyer
 
-		fmt.Printf("buyer %d: %s %s [%x] (live=%v, debug=%v)\n", i, buyer.Name, buyer.Code, buyer.Id, buyer.Live, buyer.Debug)
+		fmt.Printf("buyer %d: %s %s [%x] (live=%v, debug=%v, rate limit=%s)\n", i, buyer.Name, buyer.Code, buyer.Id, buyer.Live, buyer.Debug, buyerRateLimitString(&buyer))
 	}
 
 	for i, row := range datacenterRows {
@@ -1400,6 +1774,76 @@ func ExtractDatabase(config string) (*Database, error) {
 		database.RelayNameMap[relay.Name] = relay
 	}
 
+	// resolve route shader relay policy now that sellers, datacenters and relays exist
+
+	sellerLookup := func(code string) (uint64, bool) {
+		for _, seller := range database.SellerMap {
+			if seller.Code == code {
+				return seller.Id, true
+			}
+		}
+		return 0, false
+	}
+
+	datacenterLookup := func(name string) (uint64, bool) {
+		datacenterId := HashString(name)
+		_, exists := database.DatacenterMap[datacenterId]
+		return datacenterId, exists
+	}
+
+	relayLookup := func(name string) (uint64, bool) {
+		relay, exists := database.RelayNameMap[name]
+		if !exists {
+			return 0, false
+		}
+		return relay.Id, true
+	}
+
+	resolveRelayPolicy := func(routeShader *core.RouteShader, route_shader_row RouteShaderRow, owner string) {
+
+		resolve := func(listName string, list string, lookup func(name string) (uint64, bool)) []uint64 {
+			var ids []uint64
+			for _, name := range strings.Split(list, ",") {
+				name = strings.TrimSpace(name)
+				if name == "" {
+					continue
+				}
+				id, ok := lookup(name)
+				if !ok {
+					// IMPORTANT: Downgrade to a warning otherwise the API service can get stuck in a broken state
+					fmt.Printf("warning: route shader for %s has unknown %s '%s'\n", owner, listName, name)
+					continue
+				}
+				ids = append(ids, id)
+			}
+			return ids
+		}
+
+		// an allow list where nothing resolves must not turn into an empty list, because empty allows everything
+
+		resolveAllowed := func(listName string, list string, lookup func(name string) (uint64, bool)) []uint64 {
+			ids := resolve(listName, list, lookup)
+			if len(ids) == 0 && strings.TrimSpace(strings.ReplaceAll(list, ",", "")) != "" {
+				fmt.Printf("warning: route shader for %s has no known allowed %ss. denying all relays\n", owner, listName)
+				routeShader.RelayPolicyDenyAll = true
+			}
+			return ids
+		}
+
+		routeShader.RelayPolicyDenyAll = false
+		routeShader.AllowedSellers = resolveAllowed("seller", route_shader_row.allowed_sellers, sellerLookup)
+		routeShader.DeniedSellers = resolve("seller", route_shader_row.denied_sellers, sellerLookup)
+		routeShader.AllowedDatacenters = resolveAllowed("datacenter", route_shader_row.allowed_datacenters, datacenterLookup)
+		routeShader.DeniedDatacenters = resolve("datacenter", route_shader_row.denied_datacenters, datacenterLookup)
+		routeShader.AllowedRelays = resolveAllowed("relay", route_shader_row.allowed_relays, relayLookup)
+		routeShader.DeniedRelays = resolve("relay", route_shader_row.denied_relays, relayLookup)
+	}
+
+	for buyerId, route_shader_row := range buyerRouteShaderRows {
+		buyer := database.BuyerMap[buyerId]
+		resolveRelayPolicy(&buyer.RouteShader, route_shader_row, fmt.Sprintf("buyer '%s'", buyer.Name))
+	}
+
 	for i, row := range buyerDatacenterSettingsRows {
 
 		buyer_row, buyer_exists := buyerIndex[row.buyer_id]
@@ -1440,6 +1884,73 @@ func ExtractDatabase(config string) (*Database, error) {
 		database.BuyerDatacenterSettings[buyerId][datacenterId] = &settings
 	}
 
+	for i, row := range buyerDatacenterRouteShaderRows {
+
+		buyer_row, buyer_exists := buyerIndex[row.buyer_id]
+		if !buyer_exists {
+			return nil, fmt.Errorf("buyer datacenter route shader doesn't have a buyer\n")
+		}
+
+		datacenter_row, datacenter_exists := datacenterIndex[row.datacenter_id]
+		if !datacenter_exists {
+			return nil, fmt.Errorf("buyer datacenter route shader doesn't have a datacenter\n")
+		}
+
+		route_shader_row, route_shader_exists := routeShaderIndex[row.route_shader_id]
+		if !route_shader_exists {
+			return nil, fmt.Errorf("buyer datacenter route shader doesn't have a route shader\n")
+		}
+
+		buyerName := buyer_row.buyer_name
+		buyerId := buyerRuntimeIds[row.buyer_id]
+		datacenterName := datacenter_row.datacenter_name
+		datacenterId := HashString(datacenterName)
+
+		fmt.Printf("buyer datacenter route shader %d: %s [%x] -> %s [%x] route shader %d\n", i, buyerName, buyerId, datacenterName, datacenterId, row.route_shader_id)
+
+		override := BuyerDatacenterRouteShader{}
+		override.BuyerId = buyerId
+		override.DatacenterId = datacenterId
+		override.RouteShader = routeShaderFromRow(route_shader_row)
+		resolveRelayPolicy(&override.RouteShader, route_shader_row, fmt.Sprintf("buyer '%s' in datacenter '%s'", buyerName, datacenterName))
+		if database.BuyerDatacenterRouteShaders[buyerId] == nil {
+			database.BuyerDatacenterRouteShaders[buyerId] = make(map[uint64]*BuyerDatacenterRouteShader)
+		}
+		database.BuyerDatacenterRouteShaders[buyerId][datacenterId] = &override
+	}
+
+	for i, row := range buyerCountryRouteShaderRows {
+
+		buyer_row, buyer_exists := buyerIndex[row.buyer_id]
+		if !buyer_exists {
+			return nil, fmt.Errorf("buyer country route shader doesn't have a buyer\n")
+		}
+
+		route_shader_row, route_shader_exists := routeShaderIndex[row.route_shader_id]
+		if !route_shader_exists {
+			return nil, fmt.Errorf("buyer country route shader doesn't have a route shader\n")
+		}
+
+		buyerName := buyer_row.buyer_name
+		buyerId := buyerRuntimeIds[row.buyer_id]
+
+		// countries are ISO codes, as returned by ip2location
+
+		country := strings.ToUpper(strings.TrimSpace(row.country))
+
+		fmt.Printf("buyer country route shader %d: %s [%x] -> %s route shader %d\n", i, buyerName, buyerId, country, row.route_shader_id)
+
+		override := BuyerCountryRouteShader{}
+		override.BuyerId = buyerId
+		override.Country = country
+		override.RouteShader = routeShaderFromRow(route_shader_row)
+		resolveRelayPolicy(&override.RouteShader, route_shader_row, fmt.Sprintf("buyer '%s' in country '%s'", buyerName, country))
+		if database.BuyerCountryRouteShaders[buyerId] == nil {
+			database.BuyerCountryRouteShaders[buyerId] = make(map[string]*BuyerCountryRouteShader)
+		}
+		database.BuyerCountryRouteShaders[buyerId][country] = &override
+	}
+
 	for i := range database.Relays {
 		relayId := database.Relays[i].Id
 		datacenterId := database.Relays[i].Datacenter.Id
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"hash/fnv"
 	"net"
 	"time"
 
@@ -52,7 +53,16 @@ const (
 
 	SDK_HandlerEvent_SentPortalServerUpdateMessage = 29
 
-	SDK_HandlerEvent_NumEvents = 30
+	SDK_HandlerEvent_SourceAddressRateLimited = 30
+	SDK_HandlerEvent_BuyerRateLimited         = 31
+
+	SDK_HandlerEvent_UnknownPacketType = 32
+
+	SDK_HandlerEvent_MigrateServer = 33
+
+	SDK_HandlerEvent_LearnedClientRelays = 34
+
+	SDK_HandlerEvent_NumEvents = 35
 )
 
 type SDK_Handler struct {
@@ -72,8 +82,26 @@ type SDK_Handler struct {
 
 	PortalNextSessionsOnly bool
 
+	RelayCapacityThreshold int
+
+	SourceAddressRateLimiter *common.RateLimiter
+	SourceAddressRateLimit   common.RateLimit
+	BuyerRateLimiter         *common.RateLimiter
+	BuyerRateLimit           common.RateLimit
+
+	SessionStore *common.SessionStore
+
+	BackendAffinity *common.BackendAffinity
+
+	ClientRelayModel *common.ClientRelayModel
+
 	FallbackToDirectChannel chan<- uint64
 
+	ClientRelayPingChannel chan<- *messages.AnalyticsClientRelayPingMessage
+
+	SourceAddressRateLimitedChannel chan<- net.UDPAddr
+	BuyerRateLimitedChannel         chan<- uint64
+
 	PortalServerUpdateMessageChannel      chan<- *messages.PortalServerUpdateMessage
 	PortalSessionUpdateMessageChannel     chan<- *messages.PortalSessionUpdateMessage
 	PortalClientRelayUpdateMessageChannel chan<- *messages.PortalClientRelayUpdateMessage
@@ -87,6 +115,13 @@ type SDK_Handler struct {
 	AnalyticsSessionSummaryMessageChannel  chan<- *messages.AnalyticsSessionSummaryMessage
 }
 
+// sourceAddressKey hashes the source IP address for the rate limiter. the port is left out, so a flood from many ports on one machine is still limited
+func sourceAddressKey(from *net.UDPAddr) uint64 {
+	hash := fnv.New64a()
+	hash.Write(from.IP.To16())
+	return hash.Sum64()
+}
+
 func SDK_PacketHandler(handler *SDK_Handler, conn *net.UDPConn, from *net.UDPAddr, packetData []byte) {
 
 	// ignore packets that are too small
@@ -115,8 +150,43 @@ func SDK_PacketHandler(handler *SDK_Handler, conn *net.UDPConn, from *net.UDPAdd
 	toAddressData := core.GetAddressData(to)
 
 	if !core.AdvancedPacketFilter(packetData, emptyMagic[:], fromAddressData, toAddressData, len(packetData)) {
-		core.Debug("advanced packet filter failed for %d byte packet from %s to %s", len(packetData), from.String(), to.String())
-		handler.Events[SDK_HandlerEvent_AdvancedPacketFilterFailed] = true
+
+		// with backend affinity, servers send packets straight to this instance instead of the load balancer
+
+		if handler.BackendAffinity == nil {
+			core.Debug("advanced packet filter failed for %d byte packet from %s to %s", len(packetData), from.String(), to.String())
+			handler.Events[SDK_HandlerEvent_AdvancedPacketFilterFailed] = true
+			return
+		}
+
+		instanceAddress := handler.BackendAffinity.Address()
+		instanceAddressData := core.GetAddressData(&instanceAddress)
+
+		if !core.AdvancedPacketFilter(packetData, emptyMagic[:], fromAddressData, instanceAddressData, len(packetData)) {
+			core.Debug("advanced packet filter failed for %d byte packet from %s to %s", len(packetData), from.String(), to.String())
+			handler.Events[SDK_HandlerEvent_AdvancedPacketFilterFailed] = true
+			return
+		}
+
+		// IMPORTANT: the handler is per-packet, so this only changes the address we send the response from
+
+		handler.ServerBackendAddress = instanceAddress
+	}
+
+	// rate limit packets per source address, so one misbehaving server can't starve everybody else.
+	// this is the only rate limit before the signature check, because checking signatures is expensive
+
+	currentTime := time.Now()
+
+	if handler.SourceAddressRateLimiter != nil && !handler.SourceAddressRateLimiter.Allow(sourceAddressKey(from), currentTime, handler.SourceAddressRateLimit) {
+		core.Debug("rate limited packet from %s", from.String())
+		handler.Events[SDK_HandlerEvent_SourceAddressRateLimited] = true
+		if handler.SourceAddressRateLimitedChannel != nil {
+			select {
+			case handler.SourceAddressRateLimitedChannel <- *from:
+			default:
+			}
+		}
 		return
 	}
 
@@ -155,6 +225,27 @@ func SDK_PacketHandler(handler *SDK_Handler, conn *net.UDPConn, from *net.UDPAdd
 		return
 	}
 
+	// rate limit packets per buyer. this must be done after the signature check, otherwise anybody who knows a buyer id could use up their packets
+
+	if handler.BuyerRateLimiter != nil {
+		limit := handler.BuyerRateLimit
+		if buyer.PacketRateLimit > 0 {
+			limit.PacketsPerSecond = float64(buyer.PacketRateLimit)
+			limit.Burst = float64(buyer.PacketRateBurst)
+		}
+		if !handler.BuyerRateLimiter.Allow(buyerId, currentTime, limit) {
+			core.Debug("rate limited packet for buyer %016x from %s", buyerId, from.String())
+			handler.Events[SDK_HandlerEvent_BuyerRateLimited] = true
+			if handler.BuyerRateLimitedChannel != nil {
+				select {
+				case handler.BuyerRateLimitedChannel <- buyerId:
+				default:
+				}
+			}
+			return
+		}
+	}
+
 	// process the packet according to type
 
 	packetType := packetData[0]
@@ -214,7 +305,9 @@ func SDK_PacketHandler(handler *SDK_Handler, conn *net.UDPConn, from *net.UDPAdd
 		break
 
 	default:
-		panic("unknown packet type")
+		// IMPORTANT: don't panic here. a buggy or newer SDK can send packet types we don't know about
+		core.Debug("unknown packet type %d from %s", packetType, from.String())
+		handler.Events[SDK_HandlerEvent_UnknownPacketType] = true
 	}
 }
 
@@ -274,6 +367,7 @@ func SDK_ProcessServerInitRequestPacket(handler *SDK_Handler, conn *net.UDPConn,
 		core.Debug("match id: %016x", requestPacket.MatchId)
 		core.Debug("request id: %016x", requestPacket.RequestId)
 		core.Debug("datacenter: \"%s\" [%016x]", requestPacket.DatacenterName, requestPacket.DatacenterId)
+		core.Debug("server id: %016x", requestPacket.ServerId)
 		core.Debug("---------------------------------------------------------------------------")
 	}
 
@@ -282,10 +376,17 @@ func SDK_ProcessServerInitRequestPacket(handler *SDK_Handler, conn *net.UDPConn,
 	responsePacket := &packets.SDK_ServerInitResponsePacket{}
 	responsePacket.RequestId = requestPacket.RequestId
 	responsePacket.Response = packets.SDK_ServerInitResponseOK
+	responsePacket.Version = requestPacket.Version
 	copy(responsePacket.UpcomingMagic[:], upcomingMagic[:])
 	copy(responsePacket.CurrentMagic[:], currentMagic[:])
 	copy(responsePacket.PreviousMagic[:], previousMagic[:])
 
+	// key on the server id, same as server updates. it's the hash of the server address configured in the SDK, which isn't the address we see for servers behind NAT
+
+	if handler.BackendAffinity != nil && requestPacket.Version.Supports(packets.SDKVersion{Major: 1, Minor: 2, Patch: 13}) {
+		responsePacket.BackendAddress, responsePacket.HasBackendAddress = handler.BackendAffinity.PreferredBackend(requestPacket.ServerId)
+	}
+
 	buyer, exists := handler.Database.BuyerMap[requestPacket.BuyerId]
 	if !exists {
 		core.Warn("unknown buyer: %016x", requestPacket.BuyerId)
@@ -436,10 +537,20 @@ func SDK_ProcessServerUpdateRequestPacket(handler *SDK_Handler, conn *net.UDPCon
 
 	responsePacket := &packets.SDK_ServerUpdateResponsePacket{}
 	responsePacket.RequestId = requestPacket.RequestId
+	responsePacket.Version = requestPacket.Version
 	copy(responsePacket.UpcomingMagic[:], upcomingMagic[:])
 	copy(responsePacket.CurrentMagic[:], currentMagic[:])
 	copy(responsePacket.PreviousMagic[:], previousMagic[:])
 
+	if handler.BackendAffinity != nil {
+		responsePacket.BackendAddress, responsePacket.HasBackendAddress = handler.BackendAffinity.PreferredBackend(requestPacket.ServerId)
+		responsePacket.Migrate = handler.BackendAffinity.IsDraining()
+		if responsePacket.Migrate && requestPacket.Version.Supports(packets.SDKVersion{Major: 1, Minor: 2, Patch: 13}) {
+			core.Debug("server %016x is migrating off this server backend", requestPacket.ServerId)
+			handler.Events[SDK_HandlerEvent_MigrateServer] = true
+		}
+	}
+
 	_, exists = handler.Database.DatacenterMap[requestPacket.DatacenterId]
 	if !exists {
 		// IMPORTANT: Let the server update succeed, even if the datacenter is unknown
@@ -487,8 +598,14 @@ func SDK_ProcessSessionUpdateRequestPacket(handler *SDK_Handler, conn *net.UDPCo
 
 	state.PortalNextSessionsOnly = handler.PortalNextSessionsOnly
 
+	state.RelayCapacityThreshold = handler.RelayCapacityThreshold
+
+	state.SessionStore = handler.SessionStore
+
 	state.FallbackToDirectChannel = handler.FallbackToDirectChannel
 
+	state.ClientRelayPingChannel = handler.ClientRelayPingChannel
+
 	state.PortalSessionUpdateMessageChannel = handler.PortalSessionUpdateMessageChannel
 	state.PortalClientRelayUpdateMessageChannel = handler.PortalClientRelayUpdateMessageChannel
 	state.PortalServerRelayUpdateMessageChannel = handler.PortalServerRelayUpdateMessageChannel
@@ -649,6 +766,30 @@ func SDK_ProcessClientRelayRequestPacket(handler *SDK_Handler, conn *net.UDPConn
 		serverLongitude,
 	)
 
+	// use the client relays that actually ping best for clients like this one, with geography as the fallback
+
+	if handler.ClientRelayModel != nil {
+
+		isp, country := handler.GetISPAndCountry(requestPacket.ClientAddress.IP)
+
+		cellKey := handler.ClientRelayModel.CellKey(isp, country, clientLatitude, clientLongitude)
+
+		var numLearned int
+		clientRelayIds, clientRelayAddresses, numLearned = handler.ClientRelayModel.GetClientRelays(cellKey,
+			constants.MaxClientRelays,
+			time.Now(),
+			handler.RouteMatrix.RelayIds,
+			handler.RouteMatrix.RelayAddresses,
+			clientRelayIds,
+			clientRelayAddresses,
+		)
+
+		if numLearned > 0 {
+			core.Debug("%d client relays are from the client relay model", numLearned)
+			handler.Events[SDK_HandlerEvent_LearnedClientRelays] = true
+		}
+	}
+
 	numClientRelays := len(clientRelayIds)
 
 	core.Debug("found %d client relays", numClientRelays)
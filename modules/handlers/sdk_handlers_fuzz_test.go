@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/next/modules/common"
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/core"
+	"github.com/networknext/next/modules/crypto"
+	"github.com/networknext/next/modules/database"
+	"github.com/networknext/next/modules/encoding"
+	"github.com/networknext/next/modules/packets"
+)
+
+/*
+	Fuzz target for the SDK packet handler.
+
+	Run with eg. "go test ./modules/handlers -run '^$' -fuzz FuzzSDK_PacketHandler -fuzztime 60s"
+
+	The fuzzer mutates the packet type and the packet body. Each packet is run through the handler as is, then
+	again with the buyer id, signature, pittle and chonkle fixed up, so mutated packets get past the packet
+	filters and signature check and reach the packet read and process functions.
+*/
+
+const fuzzBuyerId = uint64(0x1111111122222222)
+const fuzzDatacenterId = uint64(0x3333333344444444)
+
+// addHandlerSeed adds the body of a request packet to the seed corpus
+func addHandlerSeed[P packets.Packet](f *testing.F, packetType int, packet P) {
+	buffer := make([]byte, constants.MaxPacketBytes)
+	packetData, err := packets.WritePacket(buffer, packet)
+	if err != nil {
+		f.Fatalf("could not write seed packet: %v", err)
+	}
+	f.Add(uint8(packetType), packetData)
+}
+
+func FuzzSDK_PacketHandler(f *testing.F) {
+
+	version := packets.SDKVersion{Major: 1, Minor: 2, Patch: 11}
+
+	addHandlerSeed(f, packets.SDK_SERVER_INIT_REQUEST_PACKET, &packets.SDK_ServerInitRequestPacket{Version: version, BuyerId: fuzzBuyerId, DatacenterId: fuzzDatacenterId, DatacenterName: "local"})
+	addHandlerSeed(f, packets.SDK_SERVER_UPDATE_REQUEST_PACKET, &packets.SDK_ServerUpdateRequestPacket{Version: version, BuyerId: fuzzBuyerId, DatacenterId: fuzzDatacenterId, NumSessions: 10})
+	addHandlerSeed(f, packets.SDK_CLIENT_RELAY_REQUEST_PACKET, &packets.SDK_ClientRelayRequestPacket{Version: version, BuyerId: fuzzBuyerId, DatacenterId: fuzzDatacenterId, ClientAddress: core.ParseAddress("127.0.0.1:30000")})
+	addHandlerSeed(f, packets.SDK_SERVER_RELAY_REQUEST_PACKET, &packets.SDK_ServerRelayRequestPacket{Version: version, BuyerId: fuzzBuyerId, DatacenterId: fuzzDatacenterId})
+	for sliceNumber := uint32(0); sliceNumber < 2; sliceNumber++ {
+		addHandlerSeed(f, packets.SDK_SESSION_UPDATE_REQUEST_PACKET, &packets.SDK_SessionUpdateRequestPacket{Version: version, BuyerId: fuzzBuyerId, DatacenterId: fuzzDatacenterId, SessionId: 0x12345, SliceNumber: sliceNumber, ClientAddress: core.ParseAddress("127.0.0.1:30000"), ServerAddress: core.ParseAddress("127.0.0.1:40000")})
+	}
+	f.Add(uint8(60), []byte{})
+
+	harness := CreateTestHarness()
+
+	// don't send analytics messages. nobody reads them here
+
+	harness.handler.AnalyticsServerInitMessageChannel = nil
+	harness.handler.AnalyticsServerUpdateMessageChannel = nil
+
+	serverBackendPublicKey, serverBackendPrivateKey := crypto.Sign_KeyPair()
+	relayBackendPublicKey, relayBackendPrivateKey := crypto.Box_KeyPair()
+
+	harness.handler.ServerBackendPublicKey = serverBackendPublicKey
+	harness.handler.ServerBackendPrivateKey = serverBackendPrivateKey
+	harness.handler.RelayBackendPublicKey = relayBackendPublicKey
+	harness.handler.RelayBackendPrivateKey = relayBackendPrivateKey
+	harness.handler.PingKey = make([]byte, crypto.Auth_KeySize)
+	harness.handler.LocateIP = locateIP_Local
+	harness.handler.GetISPAndCountry = func(ip net.IP) (string, string) { return "", "" }
+
+	harness.handler.RouteMatrix = &common.RouteMatrix{CreatedAt: uint64(time.Now().Unix())}
+	harness.handler.Database = database.CreateDatabase()
+
+	var buyerPublicKey [crypto.SDK_CRYPTO_SIGN_PUBLIC_KEY_BYTES]byte
+	var buyerPrivateKey [crypto.SDK_CRYPTO_SIGN_PRIVATE_KEY_BYTES]byte
+	crypto.SDK_SignKeypair(buyerPublicKey[:], buyerPrivateKey[:])
+
+	buyer := &database.Buyer{Id: fuzzBuyerId, Live: true, PublicKey: buyerPublicKey[:]}
+	harness.handler.Database.BuyerMap[fuzzBuyerId] = buyer
+
+	datacenter := &database.Datacenter{Id: fuzzDatacenterId, Name: "local"}
+	harness.handler.Database.DatacenterMap[fuzzDatacenterId] = datacenter
+
+	magic := [8]byte{}
+	fromAddress := core.GetAddressData(&harness.from)
+	toAddress := core.GetAddressData(&harness.handler.ServerBackendAddress)
+
+	f.Fuzz(func(t *testing.T, packetType uint8, body []byte) {
+
+		packetData := make([]byte, 18+len(body)+crypto.SDK_CRYPTO_SIGN_BYTES)
+		packetData[0] = packetType
+		copy(packetData[18:], body)
+
+		// first as is
+
+		harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+		SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+		// then with the buyer id, signature and packet filters fixed up
+
+		if len(packetData) < packets.SDK_MinPacketBytes {
+			return
+		}
+
+		index := 18 + 3
+		encoding.WriteUint64(packetData, &index, fuzzBuyerId)
+
+		crypto.SDK_SignPacket(packetData, buyerPrivateKey[:])
+
+		core.GeneratePittle(packetData[1:3], fromAddress, toAddress, len(packetData))
+		core.GenerateChonkle(packetData[3:18], magic[:], fromAddress, toAddress, len(packetData))
+
+		harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+		SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+	})
+}
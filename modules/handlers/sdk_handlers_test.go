@@ -288,6 +288,202 @@ func TestSignatureCheckFailed_SDK(t *testing.T) {
 	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
 }
 
+func TestUnknownPacketType_SDK(t *testing.T) {
+
+	t.Parallel()
+
+	harness := CreateTestHarness()
+
+	// setup a dummy packet with a future packet type that gets through the basic packet filter
+
+	packetData := make([]byte, 100)
+	packetData[0] = 60
+	for i := 1; i < len(packetData); i++ {
+		packetData[i] = byte(i)
+	}
+
+	// generate pittle and chonkle so the packet gets through the basic and advanced packet filters
+
+	magic := [8]byte{}
+	fromAddress := [4]byte{127, 0, 0, 1}
+	toAddress := [4]byte{127, 0, 0, 1}
+	packetLength := len(packetData)
+
+	core.GeneratePittle(packetData[1:3], fromAddress[:], toAddress[:], packetLength)
+
+	core.GenerateChonkle(packetData[3:18], magic[:], fromAddress[:], toAddress[:], packetLength)
+
+	// setup a buyer in the database with keypair
+
+	harness.handler.RouteMatrix = &common.RouteMatrix{}
+	harness.handler.Database = database.CreateDatabase()
+
+	buyerId := uint64(0x1111111122222222)
+
+	var buyerPublicKey [crypto.SDK_CRYPTO_SIGN_PUBLIC_KEY_BYTES]byte
+	var buyerPrivateKey [crypto.SDK_CRYPTO_SIGN_PRIVATE_KEY_BYTES]byte
+	crypto.SDK_SignKeypair(buyerPublicKey[:], buyerPrivateKey[:])
+
+	buyer := &database.Buyer{}
+	buyer.PublicKey = buyerPublicKey[:]
+
+	harness.handler.Database.BuyerMap[buyerId] = buyer
+
+	index := 18 + 3
+	encoding.WriteUint64(packetData[:], &index, buyerId)
+
+	// sign the packet, so it passes the signature check
+
+	crypto.SDK_SignPacket(packetData[:], buyerPrivateKey[:])
+
+	// the packet is dropped instead of taking down the server backend
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.False(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_UnknownPacketType])
+}
+
+// createRateLimitTestPacket creates a packet that gets through the packet filters and the unknown buyer check.
+// unless signed is set, it fails the signature check
+func createRateLimitTestPacket(harness *TestHarness, buyerId uint64, signed bool) ([]byte, *database.Buyer) {
+
+	packetData := make([]byte, 100)
+	packetData[0] = packets.SDK_SERVER_INIT_REQUEST_PACKET
+	for i := 1; i < len(packetData); i++ {
+		packetData[i] = byte(i)
+	}
+
+	index := 18 + 3
+	encoding.WriteUint64(packetData[:], &index, buyerId)
+
+	harness.handler.RouteMatrix = &common.RouteMatrix{}
+	harness.handler.Database = database.CreateDatabase()
+
+	var buyerPublicKey [crypto.SDK_CRYPTO_SIGN_PUBLIC_KEY_BYTES]byte
+	var buyerPrivateKey [crypto.SDK_CRYPTO_SIGN_PRIVATE_KEY_BYTES]byte
+	crypto.SDK_SignKeypair(buyerPublicKey[:], buyerPrivateKey[:])
+
+	buyer := &database.Buyer{Id: buyerId, PublicKey: buyerPublicKey[:]}
+
+	harness.handler.Database.BuyerMap[buyerId] = buyer
+
+	if signed {
+		crypto.SDK_SignPacket(packetData[:], buyerPrivateKey[:])
+	}
+
+	magic := [8]byte{}
+	fromAddress := [4]byte{127, 0, 0, 1}
+	toAddress := [4]byte{127, 0, 0, 1}
+	packetLength := len(packetData)
+
+	core.GeneratePittle(packetData[1:3], fromAddress[:], toAddress[:], packetLength)
+
+	core.GenerateChonkle(packetData[3:18], magic[:], fromAddress[:], toAddress[:], packetLength)
+
+	return packetData, buyer
+}
+
+func TestSourceAddressRateLimited_SDK(t *testing.T) {
+
+	t.Parallel()
+
+	harness := CreateTestHarness()
+
+	packetData, _ := createRateLimitTestPacket(harness, 0x1111111122222222, false)
+
+	rateLimitedChannel := make(chan net.UDPAddr, 1024)
+
+	harness.handler.SourceAddressRateLimiter = common.CreateRateLimiter(0)
+	harness.handler.SourceAddressRateLimit = common.RateLimit{PacketsPerSecond: 1, Burst: 2}
+	harness.handler.SourceAddressRateLimitedChannel = rateLimitedChannel
+
+	// the first packets in the burst get through to the signature check
+
+	for i := 0; i < 2; i++ {
+		harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+		SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+		assert.False(t, harness.handler.Events[SDK_HandlerEvent_SourceAddressRateLimited])
+		assert.True(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
+	}
+
+	// then packets from the same address are dropped before the signature check, even from a different port
+
+	harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+	from := core.ParseAddress("127.0.0.1:20000")
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SourceAddressRateLimited])
+	assert.False(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
+
+	select {
+	case address := <-rateLimitedChannel:
+		assert.Equal(t, from.String(), address.String())
+	default:
+		panic("no rate limited address found on channel")
+	}
+}
+
+func TestBuyerRateLimited_SDK(t *testing.T) {
+
+	t.Parallel()
+
+	harness := CreateTestHarness()
+
+	buyerId := uint64(0x1111111122222222)
+
+	packetData, buyer := createRateLimitTestPacket(harness, buyerId, true)
+
+	rateLimitedChannel := make(chan uint64, 1024)
+
+	harness.handler.BuyerRateLimiter = common.CreateRateLimiter(0)
+	harness.handler.BuyerRateLimit = common.RateLimit{PacketsPerSecond: 1000}
+	harness.handler.BuyerRateLimitedChannel = rateLimitedChannel
+
+	// the per-buyer limit in the database overrides the default
+
+	buyer.PacketRateLimit = 1
+	buyer.PacketRateBurst = 3
+
+	// packets that fail the signature check don't use up the buyer's packets
+
+	spoofedPacketData := make([]byte, len(packetData))
+	copy(spoofedPacketData, packetData)
+	spoofedPacketData[len(spoofedPacketData)-1] ^= 0xFF
+
+	for i := 0; i < 10; i++ {
+		harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+		SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, spoofedPacketData)
+		assert.False(t, harness.handler.Events[SDK_HandlerEvent_BuyerRateLimited])
+		assert.True(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
+	}
+
+	// signed packets get through until the buyer's burst is used up
+
+	for i := 0; i < 3; i++ {
+		harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+		SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+		assert.False(t, harness.handler.Events[SDK_HandlerEvent_BuyerRateLimited])
+		assert.False(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
+	}
+
+	harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_BuyerRateLimited])
+	assert.False(t, harness.handler.Events[SDK_HandlerEvent_SignatureCheckFailed])
+
+	select {
+	case id := <-rateLimitedChannel:
+		assert.Equal(t, buyerId, id)
+	default:
+		panic("no rate limited buyer found on channel")
+	}
+}
+
 // ---------------------------------------------------------------------------------------
 
 // tests for the server init handler
@@ -1137,6 +1333,177 @@ func Test_ServerUpdateHandler_ServerUpdateResponse_SDK(t *testing.T) {
 
 // ---------------------------------------------------------------------------------------
 
+// tests for backend affinity
+
+// readResponsePacket reads a response packet sent by the handler, as the SDK would if it sent the request to the given server backend address
+func readResponsePacket[P packets.Packet](t *testing.T, harness *TestHarness, clientConn *net.UDPConn, clientAddress net.UDPAddr, serverBackendAddress net.UDPAddr, packetType int, responsePacket P) {
+
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var buffer [constants.MaxPacketBytes]byte
+
+	packetBytes, _, err := clientConn.ReadFromUDP(buffer[:])
+	if err != nil {
+		t.Fatalf("did not receive response packet: %v", err)
+	}
+
+	packetData := buffer[:packetBytes]
+
+	assert.Equal(t, uint8(packetType), packetData[0])
+
+	var emptyMagic [8]byte
+
+	fromAddressData := core.GetAddressData(&serverBackendAddress)
+	toAddressData := core.GetAddressData(&clientAddress)
+
+	assert.True(t, core.AdvancedPacketFilter(packetData, emptyMagic[:], fromAddressData, toAddressData, len(packetData)))
+	assert.True(t, crypto.SDK_CheckPacketSignature(packetData, harness.signPublicKey[:]))
+
+	packetData = packetData[18 : len(packetData)-(crypto.SDK_CRYPTO_SIGN_BYTES)]
+
+	err = packets.ReadPacket(packetData, responsePacket)
+	assert.Nil(t, err)
+}
+
+func Test_BackendAffinity_SDK(t *testing.T) {
+
+	t.Parallel()
+
+	harness := CreateTestHarness()
+
+	harness.handler.AnalyticsServerInitMessageChannel = nil
+	harness.handler.AnalyticsServerUpdateMessageChannel = nil
+
+	ctx := context.Background()
+
+	lc := net.ListenConfig{}
+
+	lp, err := lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+	if err != nil {
+		panic("could not bind client socket")
+	}
+
+	clientConn := lp.(*net.UDPConn)
+
+	clientAddress := core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", clientConn.LocalAddr().(*net.UDPAddr).Port))
+
+	harness.from = clientAddress
+
+	// setup a buyer and datacenter in the database
+
+	harness.handler.RouteMatrix = &common.RouteMatrix{}
+	harness.handler.Database = database.CreateDatabase()
+
+	buyerId := uint64(0x1111111122222222)
+
+	var buyerPublicKey [crypto.SDK_CRYPTO_SIGN_PUBLIC_KEY_BYTES]byte
+	var buyerPrivateKey [crypto.SDK_CRYPTO_SIGN_PRIVATE_KEY_BYTES]byte
+	crypto.SDK_SignKeypair(buyerPublicKey[:], buyerPrivateKey[:])
+
+	harness.handler.Database.BuyerMap[buyerId] = &database.Buyer{Id: buyerId, Live: true, PublicKey: buyerPublicKey[:]}
+
+	datacenterId := common.DatacenterId("local")
+
+	harness.handler.Database.DatacenterMap[datacenterId] = &database.Datacenter{Id: datacenterId, Name: "local"}
+
+	// this instance is reached directly on a different address to the load balancer
+
+	instanceAddress := core.ParseAddress("127.0.0.1:50000")
+
+	harness.handler.BackendAffinity = common.CreateBackendAffinity(nil, common.BackendAffinityConfig{Address: instanceAddress})
+
+	loadBalancerAddress := harness.handler.ServerBackendAddress
+
+	version := packets.SDKVersion{Major: 1, Minor: 2, Patch: 13}
+
+	// the server init response tells the server which instance to talk to
+
+	serverId := common.HashString("10.0.0.1:30000")
+
+	initRequest := packets.SDK_ServerInitRequestPacket{Version: version, BuyerId: buyerId, DatacenterId: datacenterId, DatacenterName: "local", ServerId: serverId}
+
+	packetData, err := packets.SDK_WritePacket(&initRequest, packets.SDK_SERVER_INIT_REQUEST_PACKET, constants.MaxPacketBytes, &clientAddress, &loadBalancerAddress, buyerPrivateKey[:])
+	assert.Nil(t, err)
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SentServerInitResponsePacket])
+
+	initResponse := packets.SDK_ServerInitResponsePacket{Version: version}
+
+	readResponsePacket(t, harness, clientConn, clientAddress, loadBalancerAddress, packets.SDK_SERVER_INIT_RESPONSE_PACKET, &initResponse)
+
+	assert.True(t, initResponse.HasBackendAddress)
+	assert.Equal(t, instanceAddress.String(), initResponse.BackendAddress.String())
+
+	// server updates sent straight to the instance are accepted, and the response comes from the instance address
+
+	updateRequest := packets.SDK_ServerUpdateRequestPacket{Version: version, BuyerId: buyerId, DatacenterId: datacenterId, ServerId: serverId}
+
+	packetData, err = packets.SDK_WritePacket(&updateRequest, packets.SDK_SERVER_UPDATE_REQUEST_PACKET, constants.MaxPacketBytes, &clientAddress, &instanceAddress, buyerPrivateKey[:])
+	assert.Nil(t, err)
+
+	harness.handler.ServerBackendAddress = loadBalancerAddress
+	harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.False(t, harness.handler.Events[SDK_HandlerEvent_AdvancedPacketFilterFailed])
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SentServerUpdateResponsePacket])
+	assert.False(t, harness.handler.Events[SDK_HandlerEvent_MigrateServer])
+
+	updateResponse := packets.SDK_ServerUpdateResponsePacket{Version: version}
+
+	readResponsePacket(t, harness, clientConn, clientAddress, instanceAddress, packets.SDK_SERVER_UPDATE_RESPONSE_PACKET, &updateResponse)
+
+	assert.True(t, updateResponse.HasBackendAddress)
+	assert.Equal(t, instanceAddress.String(), updateResponse.BackendAddress.String())
+	assert.False(t, updateResponse.Migrate)
+
+	// when the instance drains, it tells the server to migrate. there is no other instance, so the server goes back to the load balancer
+
+	harness.handler.BackendAffinity.SetDraining(true)
+
+	harness.handler.ServerBackendAddress = loadBalancerAddress
+	harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_MigrateServer])
+
+	updateResponse = packets.SDK_ServerUpdateResponsePacket{Version: version}
+
+	readResponsePacket(t, harness, clientConn, clientAddress, instanceAddress, packets.SDK_SERVER_UPDATE_RESPONSE_PACKET, &updateResponse)
+
+	assert.False(t, updateResponse.HasBackendAddress)
+	assert.True(t, updateResponse.Migrate)
+
+	// older SDKs can't read the backend address, so they don't get one
+
+	oldVersion := packets.SDKVersion{Major: 1, Minor: 2, Patch: 12}
+
+	initRequest = packets.SDK_ServerInitRequestPacket{Version: oldVersion, BuyerId: buyerId, DatacenterId: datacenterId, DatacenterName: "local"}
+
+	packetData, err = packets.SDK_WritePacket(&initRequest, packets.SDK_SERVER_INIT_REQUEST_PACKET, constants.MaxPacketBytes, &clientAddress, &loadBalancerAddress, buyerPrivateKey[:])
+	assert.Nil(t, err)
+
+	harness.handler.BackendAffinity.SetDraining(false)
+	harness.handler.ServerBackendAddress = loadBalancerAddress
+	harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SentServerInitResponsePacket])
+
+	initResponse = packets.SDK_ServerInitResponsePacket{Version: oldVersion}
+
+	readResponsePacket(t, harness, clientConn, clientAddress, loadBalancerAddress, packets.SDK_SERVER_INIT_RESPONSE_PACKET, &initResponse)
+
+	assert.False(t, initResponse.HasBackendAddress)
+}
+
+// ---------------------------------------------------------------------------------------
+
 // tests for the client relay request handler
 
 func Test_ClientRelayRequestHandler_BuyerNotLive_SDK(t *testing.T) {
@@ -1637,6 +2004,114 @@ func Test_ClientRelayRequestResponse_SDK(t *testing.T) {
 	assert.True(t, receivedResponse != 0)
 }
 
+func Test_ClientRelayRequestResponse_ClientRelayModel_SDK(t *testing.T) {
+
+	t.Parallel()
+
+	harness := CreateTestHarness()
+
+	harness.handler.LocateIP = locateIP_Local
+	harness.handler.GetISPAndCountry = func(ip net.IP) (string, string) { return "Local", "Local" }
+
+	// setup a UDP socket to listen on so we can get the response packets
+
+	ctx := context.Background()
+
+	lc := net.ListenConfig{}
+
+	lp, err := lc.ListenPacket(ctx, "udp", "127.0.0.1:0")
+	if err != nil {
+		panic("could not bind client socket")
+	}
+
+	clientConn := lp.(*net.UDPConn)
+
+	clientAddress := core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", clientConn.LocalAddr().(*net.UDPAddr).Port))
+
+	// setup a buyer and a "local" datacenter in the database
+
+	harness.handler.Database = database.CreateDatabase()
+
+	buyerId := uint64(0x1111111122222222)
+
+	var buyerPublicKey [crypto.SDK_CRYPTO_SIGN_PUBLIC_KEY_BYTES]byte
+	var buyerPrivateKey [crypto.SDK_CRYPTO_SIGN_PRIVATE_KEY_BYTES]byte
+	crypto.SDK_SignKeypair(buyerPublicKey[:], buyerPrivateKey[:])
+
+	harness.handler.Database.BuyerMap[buyerId] = &database.Buyer{Live: true, PublicKey: buyerPublicKey[:]}
+
+	localDatacenterId := common.DatacenterId("local")
+
+	harness.handler.Database.DatacenterMap[localDatacenterId] = &database.Datacenter{Id: localDatacenterId, Name: "local", Latitude: 10, Longitude: 20}
+
+	// generate a route matrix with relays near the client
+
+	relayIds := []uint64{1, 2, 3, 4}
+
+	costMatrix := make([]uint8, core.TriMatrixLength(len(relayIds)))
+	for i := range costMatrix {
+		costMatrix[i] = 10
+	}
+
+	relayDatacenters := []uint64{1, 2, 3, 4}
+
+	harness.handler.RouteMatrix = generateRouteMatrix(relayIds, costMatrix, relayDatacenters)
+
+	packet := packets.SDK_ClientRelayRequestPacket{
+		Version:       packets.SDKVersion{Major: 1, Minor: 0, Patch: 0},
+		BuyerId:       buyerId,
+		RequestId:     0x12345,
+		DatacenterId:  localDatacenterId,
+		ClientAddress: clientAddress,
+	}
+
+	packetData, err := packets.SDK_WritePacket(&packet, packets.SDK_CLIENT_RELAY_REQUEST_PACKET, constants.MaxPacketBytes, &clientAddress, &harness.handler.ServerBackendAddress, buyerPrivateKey[:])
+	assert.Nil(t, err)
+
+	harness.from = clientAddress
+
+	// before the model has learned anything, client relays come from geography
+
+	clientRelayModel := common.CreateClientRelayModel(common.ClientRelayModelConfig{})
+
+	harness.handler.ClientRelayModel = clientRelayModel
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SentClientRelayResponsePacket])
+	assert.False(t, harness.handler.Events[SDK_HandlerEvent_LearnedClientRelays])
+
+	responsePacket := packets.SDK_ClientRelayResponsePacket{}
+	readResponsePacket(t, harness, clientConn, clientAddress, harness.handler.ServerBackendAddress, packets.SDK_CLIENT_RELAY_RESPONSE_PACKET, &responsePacket)
+
+	assert.Equal(t, int32(4), responsePacket.NumClientRelays)
+
+	// once clients in the same cell have reported pings, the relays that ping best come first
+
+	cellKey := clientRelayModel.CellKey("Local", "Local", responsePacket.Latitude, responsePacket.Longitude)
+
+	currentTime := time.Now()
+	for i := 0; i < 10; i++ {
+		clientRelayModel.AddSample(cellKey, 4, 10, 0, 0, currentTime)
+		clientRelayModel.AddSample(cellKey, 3, 20, 0, 0, currentTime)
+	}
+
+	harness.handler.Events = [SDK_HandlerEvent_NumEvents]bool{}
+
+	SDK_PacketHandler(&harness.handler, harness.conn, &harness.from, packetData)
+
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_SentClientRelayResponsePacket])
+	assert.True(t, harness.handler.Events[SDK_HandlerEvent_LearnedClientRelays])
+
+	responsePacket = packets.SDK_ClientRelayResponsePacket{}
+	readResponsePacket(t, harness, clientConn, clientAddress, harness.handler.ServerBackendAddress, packets.SDK_CLIENT_RELAY_RESPONSE_PACKET, &responsePacket)
+
+	assert.Equal(t, int32(4), responsePacket.NumClientRelays)
+	assert.Equal(t, uint64(4), responsePacket.ClientRelayIds[0])
+	assert.Equal(t, uint64(3), responsePacket.ClientRelayIds[1])
+	assert.Equal(t, harness.handler.RouteMatrix.RelayAddresses[3].String(), responsePacket.ClientRelayAddresses[0].String())
+}
+
 // ---------------------------------------------------------------------------------------
 
 // tests for the server relay request handler
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/networknext/next/modules/common"
@@ -48,6 +50,7 @@ type SessionUpdateState struct {
 	Datacenter    *db.Datacenter
 	BuyerId       uint64
 	Buyer         *db.Buyer
+	RouteShader   *core.RouteShader // buyer route shader, with any datacenter or country override applied
 	Debug         *string
 	StaleDuration time.Duration
 
@@ -64,6 +67,11 @@ type SessionUpdateState struct {
 	// error flags for this update
 	Error uint64
 
+	// structured record of the route decision, sent to the portal so we can see why a session was (or wasn't) accelerated
+	DecisionReason     uint8
+	NumCandidateRoutes int
+	CandidateRoutes    [constants.MaxDecisionCandidateRoutes]core.BestRoute
+
 	// ip2location function to get ISP and country from IP
 	GetISPAndCountry func(ip net.IP) (string, string)
 
@@ -74,14 +82,23 @@ type SessionUpdateState struct {
 	// if true, only network next sessions are sent to portal
 	PortalNextSessionsOnly bool
 
+	// new sessions avoid relays with utilization above this percentage. zero disables. relays that are full are always avoided
+	RelayCapacityThreshold int
+
+	// optional server side copy of session data. if nil, session data only comes from the SDK
+	SessionStore *common.SessionStore
+
 	// codepath flags (for unit testing etc...)
 	ClientPingTimedOut                          bool
 	RouteChanged                                bool
 	RouteContinued                              bool
+	SecondRouteChanged                          bool
+	SecondRouteContinued                        bool
 	TakeNetworkNext                             bool
 	StayDirect                                  bool
 	FirstUpdate                                 bool
 	ReadSessionData                             bool
+	ReadSessionDataFromStore                    bool
 	NotUpdatingClientRelaysDatacenterNotEnabled bool
 	NotUpdatingServerRelaysDatacenterNotEnabled bool
 	SentPortalSessionUpdateMessage              bool
@@ -96,6 +113,8 @@ type SessionUpdateState struct {
 
 	FallbackToDirectChannel chan<- uint64
 
+	ClientRelayPingChannel chan<- *messages.AnalyticsClientRelayPingMessage
+
 	PortalSessionUpdateMessageChannel     chan<- *messages.PortalSessionUpdateMessage
 	PortalClientRelayUpdateMessageChannel chan<- *messages.PortalClientRelayUpdateMessage
 	PortalServerRelayUpdateMessageChannel chan<- *messages.PortalServerRelayUpdateMessage
@@ -112,6 +131,29 @@ func SessionUpdate_ReadSessionData(state *SessionUpdateState) bool {
 		return true
 	}
 
+	// prefer the server side session data, and fall back to the session data echoed back by the SDK.
+	// the session store only has the latest session data, so retried session updates for an earlier slice use the echoed session data.
+	// IMPORTANT: the first time we see a session, or when it comes back from another server backend instance, this waits for redis
+
+	if state.SessionStore != nil {
+		data, found := state.SessionStore.Get(context.Background(), state.Request.SessionId, packets.ServerSessionDataVersion_Write, state.Request.SliceNumber)
+		if found {
+			serverSessionData := packets.ServerSessionData{}
+			readStream := encoding.CreateReadStream(data)
+			err := serverSessionData.Serialize(readStream)
+			if err != nil {
+				core.Debug("failed to read session data from session store: %v", err)
+			} else if serverSessionData.SessionData.SessionId != state.Request.SessionId || serverSessionData.SessionData.SliceNumber != state.Request.SliceNumber {
+				core.Debug("session store has session data for session %016x slice %d, but the request is for session %016x slice %d", serverSessionData.SessionData.SessionId, serverSessionData.SessionData.SliceNumber, state.Request.SessionId, state.Request.SliceNumber)
+			} else {
+				state.Input = serverSessionData.SessionData
+				state.ReadSessionData = true
+				state.ReadSessionDataFromStore = true
+				return true
+			}
+		}
+	}
+
 	if !crypto.Verify(state.Request.SessionData[:state.Request.SessionDataBytes], state.ServerBackendPublicKey[:], state.Request.SessionDataSignature[:]) {
 		core.Error("session data signature check failed")
 		state.Error |= constants.SessionError_SessionDataSignatureCheckFailed
@@ -242,6 +284,20 @@ func SessionUpdate_Pre(state *SessionUpdateState) bool {
 
 	state.Datacenter = state.Database.GetDatacenter(state.Request.DatacenterId)
 
+	/*
+		Resolve the route shader for this session.
+
+		Buyers can override their route shader per-datacenter and per-country. We only look up
+		the player's country when the buyer has country overrides, because the lookup isn't free.
+	*/
+
+	country := ""
+	if state.Database.HasCountryRouteShaders(state.Buyer.Id) && state.GetISPAndCountry != nil {
+		_, country = state.GetISPAndCountry(state.Request.ClientAddress.IP)
+	}
+
+	state.RouteShader = state.Database.GetRouteShader(state.Buyer, state.Request.DatacenterId, country)
+
 	/*
 		The debug string is appended to during the rest of the handler and sent down to the SDK
 		when Buyer.Debug is true. We use this to debug route decisions when something is not working.
@@ -264,7 +320,7 @@ func SessionUpdate_NewSession(state *SessionUpdateState) {
 	state.Input.SliceNumber = 0
 	state.Input.StartTimestamp = uint64(time.Now().Unix())
 	state.Input.ExpireTimestamp = state.Input.StartTimestamp
-	state.Input.RouteState.ABTest = state.Buyer.RouteShader.ABTest
+	state.Input.RouteState.ABTest = state.RouteShader.ABTest
 
 	state.Output = state.Input
 	state.Output.SliceNumber += 1
@@ -308,8 +364,8 @@ func SessionUpdate_ExistingSession(state *SessionUpdateState) {
 	*/
 
 	if state.Request.Next {
-		state.Output.NextEnvelopeBytesUpSum += uint64(state.Buyer.RouteShader.BandwidthEnvelopeUpKbps) * 1000 * packets.SDK_SliceSeconds / 8
-		state.Output.NextEnvelopeBytesDownSum += uint64(state.Buyer.RouteShader.BandwidthEnvelopeDownKbps) * 1000 * packets.SDK_SliceSeconds / 8
+		state.Output.NextEnvelopeBytesUpSum += uint64(state.RouteShader.BandwidthEnvelopeUpKbps) * 1000 * packets.SDK_SliceSeconds / 8
+		state.Output.NextEnvelopeBytesDownSum += uint64(state.RouteShader.BandwidthEnvelopeDownKbps) * 1000 * packets.SDK_SliceSeconds / 8
 	}
 
 	/*
@@ -581,6 +637,12 @@ func SessionUpdate_BuildNextTokens(state *SessionUpdateState, routeNumRelays int
 
 	state.Output.SessionVersion++
 
+	state.Response.RouteType = packets.SDK_RouteTypeNew
+	state.Response.NumTokens, state.Response.Tokens = SessionUpdate_WriteNextTokens(state, routeNumRelays, routeRelays)
+}
+
+func SessionUpdate_WriteNextTokens(state *SessionUpdateState, routeNumRelays int32, routeRelays []int32) (int32, []byte) {
+
 	numTokens := routeNumRelays + 2
 
 	var routePublicAddresses [constants.NextMaxNodes]net.UDPAddr
@@ -633,17 +695,20 @@ func SessionUpdate_BuildNextTokens(state *SessionUpdateState, routeNumRelays int
 	sessionId := state.Output.SessionId
 	sessionVersion := uint8(state.Output.SessionVersion)
 	expireTimestamp := state.Output.ExpireTimestamp
-	envelopeUpKbps := uint32(state.Buyer.RouteShader.BandwidthEnvelopeUpKbps)
-	envelopeDownKbps := uint32(state.Buyer.RouteShader.BandwidthEnvelopeDownKbps)
+	envelopeUpKbps := uint32(state.RouteShader.BandwidthEnvelopeUpKbps)
+	envelopeDownKbps := uint32(state.RouteShader.BandwidthEnvelopeDownKbps)
 
 	core.WriteRouteTokens(tokenData, expireTimestamp, sessionId, sessionVersion, envelopeUpKbps, envelopeDownKbps, int(numTokens), routePublicAddresses[:], routeHasInternalAddresses[:], routeInternalAddresses[:], routeInternalGroups[:], routeSellers[:], routeSecretKeys[:])
 
-	state.Response.RouteType = packets.SDK_RouteTypeNew
-	state.Response.NumTokens = numTokens
-	state.Response.Tokens = tokenData
+	return numTokens, tokenData
 }
 
 func SessionUpdate_BuildContinueTokens(state *SessionUpdateState, routeNumRelays int32, routeRelays []int32) {
+	state.Response.RouteType = packets.SDK_RouteTypeContinue
+	state.Response.NumTokens, state.Response.Tokens = SessionUpdate_WriteContinueTokens(state, routeNumRelays, routeRelays)
+}
+
+func SessionUpdate_WriteContinueTokens(state *SessionUpdateState, routeNumRelays int32, routeRelays []int32) (int32, []byte) {
 
 	numTokens := routeNumRelays + 2
 
@@ -679,9 +744,206 @@ func SessionUpdate_BuildContinueTokens(state *SessionUpdateState, routeNumRelays
 
 	core.WriteContinueTokens(tokenData, expireTimestamp, sessionId, sessionVersion, int(numTokens), routeSecretKeys[:])
 
-	state.Response.RouteType = packets.SDK_RouteTypeContinue
-	state.Response.NumTokens = numTokens
-	state.Response.Tokens = tokenData
+	return numTokens, tokenData
+}
+
+func SessionUpdate_UpdateSecondRoute(state *SessionUpdateState, excludedRelays []bool, routeCost int32, routeNumRelays int32, routeRelays []int32) {
+
+	/*
+		In redundant route mode we pick a second network next route that shares no relays with
+		the primary route, so a single relay failing can't take out both.
+
+		IMPORTANT: The SDK can't send packets across a second route yet, so the second route is
+		only picked and recorded in session data and analytics, so we can see how often a second
+		route is available and what it costs. It is not sent to the SDK.
+	*/
+
+	secondRouteCost := int32(0)
+	secondRouteNumRelays := int32(0)
+	secondRouteRelays := [constants.MaxRouteRelays]int32{}
+
+	if state.Input.SecondRouteNumRelays > 0 {
+		if core.ReframeRoute(state.RouteMatrix.RelayIdToIndex, state.Input.SecondRouteRelayIds[:state.Input.SecondRouteNumRelays], &secondRouteRelays) &&
+			core.RoutesAreRelayDisjoint(routeNumRelays, routeRelays, state.Input.SecondRouteNumRelays, secondRouteRelays[:]) {
+			secondRouteNumRelays = state.Input.SecondRouteNumRelays
+			secondRouteCost = core.GetCurrentRouteCost(state.RouteMatrix.RouteEntries, secondRouteNumRelays, secondRouteRelays, state.SourceRelays, state.SourceRelayRTT, state.DestRelays, excludedRelays, state.Debug)
+		}
+	}
+
+	if secondRouteNumRelays > 0 && secondRouteCost >= 0 {
+
+		state.SecondRouteContinued = true
+
+	} else {
+
+		maxCost := routeCost + state.RouteShader.MaxLatencyTradeOff
+
+		if !core.GetBestDisjointRoute(state.RouteMatrix.RouteEntries,
+			state.SourceRelays,
+			state.SourceRelayRTT,
+			state.DestRelays,
+			excludedRelays,
+			maxCost,
+			state.RouteShader.JitterWeight,
+			state.RouteShader.PacketLossWeight,
+			routeNumRelays,
+			routeRelays,
+			&secondRouteCost,
+			&secondRouteNumRelays,
+			&secondRouteRelays,
+			state.Debug) {
+			return
+		}
+
+		state.SecondRouteChanged = true
+	}
+
+	if secondRouteCost > constants.MaxRouteCost {
+		secondRouteCost = constants.MaxRouteCost
+	}
+
+	state.Output.SecondRouteCost = secondRouteCost
+	state.Output.SecondRouteNumRelays = secondRouteNumRelays
+
+	for i := int32(0); i < secondRouteNumRelays; i++ {
+		state.Output.SecondRouteRelayIds[i] = state.RouteMatrix.RelayIds[secondRouteRelays[i]]
+	}
+
+	if state.Debug != nil {
+		if state.SecondRouteChanged {
+			*state.Debug += "second route: "
+		} else {
+			*state.Debug += "second route continued: "
+		}
+		for i, routeRelay := range secondRouteRelays[:secondRouteNumRelays] {
+			if i != int(secondRouteNumRelays-1) {
+				*state.Debug += fmt.Sprintf("%s - ", state.RouteMatrix.RelayNames[routeRelay])
+			} else {
+				*state.Debug += fmt.Sprintf("%s\n", state.RouteMatrix.RelayNames[routeRelay])
+			}
+		}
+	}
+}
+
+func SessionUpdate_GetExcludedRelays(state *SessionUpdateState) []bool {
+
+	/*
+		Relays that don't satisfy the buyer's route shader relay policy (seller, datacenter and relay allow and deny lists)
+		are excluded from all routes for this session. Relays that are no longer in the database have no seller.
+	*/
+
+	routeShader := state.RouteShader
+
+	numRelays := len(state.RouteMatrix.RelayIds)
+
+	excludedRelays := make([]bool, numRelays)
+
+	for i := 0; i < numRelays; i++ {
+
+		relayId := state.RouteMatrix.RelayIds[i]
+
+		sellerId := uint64(0)
+		relay := state.Database.GetRelay(relayId)
+		if relay != nil && relay.Seller != nil {
+			sellerId = relay.Seller.Id
+		}
+
+		datacenterId := uint64(0)
+		if i < len(state.RouteMatrix.RelayDatacenterIds) {
+			datacenterId = state.RouteMatrix.RelayDatacenterIds[i]
+		}
+
+		excludedRelays[i] = !routeShader.RelayAllowed(relayId, sellerId, datacenterId)
+	}
+
+	return excludedRelays
+}
+
+func SessionUpdate_ExcludeRelaysOverCapacity(state *SessionUpdateState, excludedRelays []bool) []bool {
+
+	/*
+		Relays at max sessions are excluded for every session, including sessions already routed through them.
+
+		The capacity threshold only applies to sessions that are not on network next yet, so sessions
+		already on network next are not moved off a relay just because it is getting busy.
+	*/
+
+	minHeadroom := 1
+	if !state.Input.RouteState.Next && state.RelayCapacityThreshold > 0 && 100-state.RelayCapacityThreshold > minHeadroom {
+		minHeadroom = 100 - state.RelayCapacityThreshold
+	}
+
+	numExcludedRelays := 0
+
+	for i := range state.RouteMatrix.RelayHeadroom {
+		if int(state.RouteMatrix.RelayHeadroom[i]) >= minHeadroom {
+			continue
+		}
+		if excludedRelays == nil {
+			excludedRelays = make([]bool, len(state.RouteMatrix.RelayIds))
+		}
+		if !excludedRelays[i] {
+			excludedRelays[i] = true
+			numExcludedRelays++
+		}
+	}
+
+	if state.Debug != nil && numExcludedRelays > 0 {
+		*state.Debug += fmt.Sprintf("%d relays excluded by capacity\n", numExcludedRelays)
+	}
+
+	return excludedRelays
+}
+
+func SessionUpdate_GetCandidateRoutes(state *SessionUpdateState, candidates *core.RouteCandidates) {
+
+	/*
+		Record the best routes the route decision considered, so we can see how they compare to the route that was chosen.
+
+		IMPORTANT: These are the routes the route decision already found, so we don't search the route matrix again.
+		Route decisions that don't search for routes, like continuing the current route, record no candidates.
+	*/
+
+	bestRoutes := candidates.Routes
+
+	sort.SliceStable(bestRoutes, func(i, j int) bool { return bestRoutes[i].WeightedCost < bestRoutes[j].WeightedCost })
+
+	state.NumCandidateRoutes = len(bestRoutes)
+	if state.NumCandidateRoutes > constants.MaxDecisionCandidateRoutes {
+		state.NumCandidateRoutes = constants.MaxDecisionCandidateRoutes
+	}
+
+	for i := 0; i < state.NumCandidateRoutes; i++ {
+
+		route := bestRoutes[i]
+
+		// IMPORTANT: bias candidate costs the same way as the selected route, so they can be compared directly
+		route.Cost += constants.CostBias
+		route.WeightedCost += constants.CostBias
+
+		if route.NeedToReverse {
+			for j := int32(0); j < route.NumRelays; j++ {
+				route.Relays[j] = bestRoutes[i].Relays[route.NumRelays-1-j]
+			}
+			route.NeedToReverse = false
+		}
+
+		state.CandidateRoutes[i] = route
+	}
+}
+
+func sessionUpdate_EarlyOutReason(routeState *core.RouteState) uint8 {
+	switch {
+	case routeState.Disabled:
+		return constants.RouteDecision_Disabled
+	case routeState.Veto:
+		return constants.RouteDecision_Veto
+	case routeState.NotSelected:
+		return constants.RouteDecision_NotSelected
+	case routeState.B:
+		return constants.RouteDecision_ABTestB
+	}
+	return constants.RouteDecision_None
 }
 
 func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
@@ -696,16 +958,47 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 		state.Output.RouteState.Next = false
 		state.Output.RouteState.Veto = true
 		state.Error |= constants.SessionError_NoRouteRelays
+		state.DecisionReason = constants.RouteDecision_NoRouteRelays
 		if state.Debug != nil {
 			*state.Debug += "no route relays?!\n"
 		}
 		return
 	}
 
+	/*
+		If the buyer has a relay policy in their route shader, work out which relays
+		can't be used. Routes through these relays are filtered out of route selection.
+	*/
+
+	var excludedRelays []bool
+
+	if state.RouteShader.HasRelayPolicy() {
+		excludedRelays = SessionUpdate_GetExcludedRelays(state)
+		if state.Debug != nil {
+			numExcludedRelays := 0
+			for i := range excludedRelays {
+				if excludedRelays[i] {
+					numExcludedRelays++
+				}
+			}
+			*state.Debug += fmt.Sprintf("%d relays excluded by route shader\n", numExcludedRelays)
+		}
+	}
+
+	/*
+		Relays that are full can't take any more sessions, and new sessions are steered away
+		from relays above the capacity threshold (if set), leaving room for the sessions already on them.
+	*/
+
+	if len(state.RouteMatrix.RelayHeadroom) == len(state.RouteMatrix.RelayIds) {
+		excludedRelays = SessionUpdate_ExcludeRelaysOverCapacity(state, excludedRelays)
+	}
+
 	var stayOnNext bool
 	var routeChanged bool
 	var routeCost int32
 	var routeNumRelays int32
+	var candidates core.RouteCandidates
 
 	routeRelays := [constants.MaxRouteRelays]int32{}
 
@@ -717,21 +1010,31 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 
 		if core.MakeRouteDecision_TakeNetworkNext(state.Request.UserHash,
 			state.RouteMatrix.RouteEntries,
-			&state.Buyer.RouteShader,
+			state.RouteShader,
 			&state.Output.RouteState,
 			int32(state.Request.DirectRTT),
 			state.RealPacketLoss,
 			state.SourceRelays,
 			state.SourceRelayRTT,
 			state.DestRelays,
+			excludedRelays,
 			&routeCost,
 			&routeNumRelays,
 			routeRelays[:],
 			state.Debug,
-			sliceNumber) {
+			sliceNumber,
+			&candidates) {
 
 			state.TakeNetworkNext = true
 
+			if state.Output.RouteState.ForcedNext {
+				state.DecisionReason = constants.RouteDecision_ForceNext
+			} else {
+				state.DecisionReason = constants.RouteDecision_TakeNetworkNext
+			}
+
+			SessionUpdate_GetCandidateRoutes(state, &candidates)
+
 			SessionUpdate_BuildNextTokens(state, routeNumRelays, routeRelays[:routeNumRelays])
 
 			if state.Debug != nil {
@@ -751,6 +1054,17 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 
 			state.StayDirect = true
 
+			state.DecisionReason = sessionUpdate_EarlyOutReason(&state.Output.RouteState)
+
+			if state.DecisionReason == constants.RouteDecision_None {
+				if !state.RouteShader.ForceNext && int32(state.Request.DirectRTT) <= state.RouteShader.AcceptableLatency && state.RealPacketLoss <= state.RouteShader.AcceptablePacketLoss {
+					state.DecisionReason = constants.RouteDecision_LatencyAcceptable
+				} else {
+					state.DecisionReason = constants.RouteDecision_NoRoute
+					SessionUpdate_GetCandidateRoutes(state, &candidates)
+				}
+			}
+
 			if state.Debug != nil {
 				*state.Debug += "staying direct\n"
 			}
@@ -769,6 +1083,7 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 			state.Output.RouteState.Next = false
 			state.Output.RouteState.Veto = true
 			state.Error |= constants.SessionError_Aborted
+			state.DecisionReason = constants.RouteDecision_Aborted
 			if state.Debug != nil {
 				*state.Debug += "aborted\n"
 			}
@@ -795,7 +1110,7 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 		stayOnNext, routeChanged = core.MakeRouteDecision_StayOnNetworkNext(state.Request.UserHash,
 			state.RouteMatrix.RouteEntries,
 			state.RouteMatrix.RelayNames,
-			&state.Buyer.RouteShader,
+			state.RouteShader,
 			&state.Output.RouteState,
 			directLatency,
 			nextLatency,
@@ -807,10 +1122,12 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 			state.SourceRelays,
 			state.SourceRelayRTT,
 			state.DestRelays,
+			excludedRelays,
 			&routeCost,
 			&routeNumRelays,
 			routeRelays[:],
-			state.Debug)
+			state.Debug,
+			&candidates)
 
 		if stayOnNext {
 
@@ -822,6 +1139,10 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 
 				state.RouteChanged = true
 
+				state.DecisionReason = constants.RouteDecision_RouteChanged
+
+				SessionUpdate_GetCandidateRoutes(state, &candidates)
+
 				SessionUpdate_BuildNextTokens(state, routeNumRelays, routeRelays[:routeNumRelays])
 
 				if state.Debug != nil {
@@ -843,6 +1164,10 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 
 				state.RouteContinued = true
 
+				state.DecisionReason = constants.RouteDecision_RouteContinued
+
+				SessionUpdate_GetCandidateRoutes(state, &candidates)
+
 				SessionUpdate_BuildContinueTokens(state, routeNumRelays, routeRelays[:routeNumRelays])
 				if state.Debug != nil {
 					*state.Debug += "route continued\n"
@@ -854,6 +1179,13 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 
 			// leave network next
 
+			if state.Output.RouteState.NoRoute {
+				state.DecisionReason = constants.RouteDecision_RouteNoLongerSuitable
+				SessionUpdate_GetCandidateRoutes(state, &candidates)
+			} else {
+				state.DecisionReason = sessionUpdate_EarlyOutReason(&state.Output.RouteState)
+			}
+
 			if state.Output.RouteState.NoRoute {
 				core.Debug("route no longer exists")
 				state.Error |= constants.SessionError_RouteNoLongerExists
@@ -896,6 +1228,18 @@ func SessionUpdate_MakeRouteDecision(state *SessionUpdateState) {
 		relayId := state.RouteMatrix.RelayIds[routeRelays[i]]
 		state.Output.RouteRelayIds[i] = relayId
 	}
+
+	/*
+		If the buyer has redundant routes enabled, and the SDK supports it,
+		find a second route that shares no relays with the current route.
+	*/
+
+	state.Output.SecondRouteCost = 0
+	state.Output.SecondRouteNumRelays = 0
+
+	if state.Output.RouteState.Next && routeNumRelays > 0 && state.RouteShader.RedundantRoute {
+		SessionUpdate_UpdateSecondRoute(state, excludedRelays, routeCost, routeNumRelays, routeRelays[:routeNumRelays])
+	}
 }
 
 func SessionUpdate_Post(state *SessionUpdateState) {
@@ -1033,6 +1377,21 @@ func SessionUpdate_Post(state *SessionUpdateState) {
 
 	copy(state.Response.SessionDataSignature[:], crypto.Sign(state.Response.SessionData[:state.Response.SessionDataBytes], state.ServerBackendPrivateKey))
 
+	// store the server side session data. the next session update from the SDK has the slice number of the output session data
+
+	if state.SessionStore != nil {
+		serverSessionData := packets.ServerSessionData{Version: packets.ServerSessionDataVersion_Write, SessionData: state.Output}
+		buffer := make([]byte, packets.ServerSessionDataMaxBytes)
+		serverWriteStream := encoding.CreateWriteStream(buffer)
+		err = serverSessionData.Serialize(serverWriteStream)
+		if err != nil {
+			core.Error("failed to write server session data: %v", err)
+		} else {
+			serverWriteStream.Flush()
+			state.SessionStore.Put(state.Request.SessionId, packets.ServerSessionDataVersion_Write, state.Output.SliceNumber, buffer[:serverWriteStream.GetBytesProcessed()])
+		}
+	}
+
 	/*
 		Write the session update response packet.
 	*/
@@ -1155,6 +1514,30 @@ func sendPortalSessionUpdateMessage(state *SessionUpdateState) {
 	message.BestDirectRTT = state.Output.BestDirectRTT
 	message.BestNextRTT = state.Output.BestNextRTT
 
+	message.DecisionReason = state.DecisionReason
+	message.DecisionRouteStateFlags = state.Output.RouteState.Flags()
+	if state.RouteShader != nil {
+		message.DecisionAcceptableLatency = state.RouteShader.AcceptableLatency
+		message.DecisionLatencyReductionThreshold = state.RouteShader.LatencyReductionThreshold
+	}
+	if state.Output.RouteState.Next {
+		message.DecisionRouteCost = state.Output.RouteCost
+		message.DecisionRouteNumRelays = uint32(state.Output.RouteNumRelays)
+		for i := 0; i < int(message.DecisionRouteNumRelays); i++ {
+			message.DecisionRouteRelayId[i] = state.Output.RouteRelayIds[i]
+		}
+	}
+	message.NumCandidateRoutes = uint32(state.NumCandidateRoutes)
+	for i := 0; i < state.NumCandidateRoutes; i++ {
+		route := &state.CandidateRoutes[i]
+		message.CandidateRouteCost[i] = route.Cost
+		message.CandidateRouteWeightedCost[i] = route.WeightedCost
+		message.CandidateRouteNumRelays[i] = uint32(route.NumRelays)
+		for j := 0; j < int(route.NumRelays); j++ {
+			message.CandidateRouteRelayId[i][j] = state.RouteMatrix.RelayIds[route.Relays[j]]
+		}
+	}
+
 	message.Retry = state.Request.RetryNumber != 0
 	message.FallbackToDirect = state.Request.FallbackToDirect
 	message.SendToPortal = !state.PortalNextSessionsOnly || (state.PortalNextSessionsOnly && state.Output.DurationOnNext > 0)
@@ -1247,6 +1630,15 @@ func sendAnalyticsClientRelayPingMessages(state *SessionUpdateState) {
 			state.SentAnalyticsClientRelayPingMessage = true
 		}
 
+		// the client relay model learns from the same pings. drop them if it can't keep up
+
+		if state.ClientRelayPingChannel != nil {
+			select {
+			case state.ClientRelayPingChannel <- &message:
+			default:
+			}
+		}
+
 	}
 }
 
@@ -1320,6 +1712,10 @@ func sendAnalyticsSessionUpdateMessage(state *SessionUpdateState) {
 		for i := range state.Input.RouteRelayIds {
 			message.NextRouteRelays[i] = int64(state.Input.RouteRelayIds[i])
 		}
+		message.NextSecondRouteRelays = make([]int64, state.Input.SecondRouteNumRelays)
+		for i := range message.NextSecondRouteRelays {
+			message.NextSecondRouteRelays[i] = int64(state.Input.SecondRouteRelayIds[i])
+		}
 	}
 
 	// flags
@@ -1,6 +1,7 @@
 package handlers_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -36,6 +37,7 @@ func CreateState() *handlers.SessionUpdateState {
 	state.Input.Latitude = 35.0
 	state.Input.Longitude = -75.0
 	state.Buyer = &db.Buyer{}
+	state.RouteShader = &state.Buyer.RouteShader
 	state.Datacenter = &db.Datacenter{}
 	state.PingKey = make([]byte, crypto.Auth_KeySize)
 	common.RandomBytes(state.PingKey)
@@ -101,6 +103,24 @@ func WriteSessionData(sessionData packets.SDK_SessionData) []byte {
 	return buffer[:sessionDataBytes]
 }
 
+func WriteServerSessionData(sessionData packets.SDK_SessionData) []byte {
+
+	buffer := [packets.ServerSessionDataMaxBytes]byte{}
+
+	writeStream := encoding.CreateWriteStream(buffer[:])
+
+	serverSessionData := packets.ServerSessionData{Version: packets.ServerSessionDataVersion_Write, SessionData: sessionData}
+
+	err := serverSessionData.Serialize(writeStream)
+	if err != nil {
+		panic(err)
+	}
+
+	writeStream.Flush()
+
+	return buffer[:writeStream.GetBytesProcessed()]
+}
+
 func Test_SessionUpdate_Pre_FallbackToDirect(t *testing.T) {
 
 	t.Parallel()
@@ -280,6 +300,60 @@ func Test_SessionUpdate_Pre_Debug(t *testing.T) {
 	assert.NotNil(t, state.Debug)
 }
 
+func Test_SessionUpdate_Pre_RouteShaderOverrides(t *testing.T) {
+
+	t.Parallel()
+
+	buyerId := uint64(0x12345)
+	saoPauloId := uint64(1)
+	frankfurtId := uint64(2)
+
+	buyer := &db.Buyer{Id: buyerId}
+	buyer.RouteShader = core.NewRouteShader()
+	buyer.RouteShader.DeniedRelays = []uint64{7}
+
+	saoPaulo := &db.BuyerDatacenterRouteShader{BuyerId: buyerId, DatacenterId: saoPauloId, RouteShader: core.NewRouteShader()}
+	saoPaulo.RouteShader.LatencyReductionThreshold = 20
+
+	peru := &db.BuyerCountryRouteShader{BuyerId: buyerId, Country: "PE", RouteShader: core.NewRouteShader()}
+	peru.RouteShader.LatencyReductionThreshold = 5
+	peru.RouteShader.AllowedRelays = []uint64{8}
+
+	run := func(datacenterId uint64, country string) *core.RouteShader {
+		state := CreateState()
+		state.Buyer = buyer
+		state.Request.BuyerId = buyerId
+		state.Request.DatacenterId = datacenterId
+		state.Database.BuyerMap[buyerId] = buyer
+		state.Database.BuyerDatacenterRouteShaders[buyerId] = map[uint64]*db.BuyerDatacenterRouteShader{saoPauloId: saoPaulo}
+		state.Database.BuyerCountryRouteShaders[buyerId] = map[string]*db.BuyerCountryRouteShader{"PE": peru}
+		state.Database.Fixup()
+		state.GetISPAndCountry = func(ip net.IP) (string, string) { return "ISP", country }
+		handlers.SessionUpdate_Pre(state)
+		return state.RouteShader
+	}
+
+	// no override applies, so we get the buyer route shader
+
+	assert.Same(t, &buyer.RouteShader, run(frankfurtId, "DE"))
+
+	// datacenter override
+
+	assert.Same(t, &saoPaulo.RouteShader, run(saoPauloId, "BR"))
+
+	// the country override wins over the datacenter override
+
+	assert.Same(t, &peru.RouteShader, run(saoPauloId, "PE"))
+	assert.Same(t, &peru.RouteShader, run(frankfurtId, "PE"))
+
+	// overrides without a relay policy keep the buyer relay policy, overrides with their own relay policy use it
+
+	assert.False(t, saoPaulo.RouteShader.RelayAllowed(7, 0, 0))
+	assert.True(t, peru.RouteShader.RelayAllowed(8, 0, 0))
+	assert.False(t, peru.RouteShader.RelayAllowed(9, 0, 0))
+	assert.Equal(t, 0, len(peru.RouteShader.DeniedRelays))
+}
+
 // --------------------------------------------------------------
 
 func Test_SessionUpdate_NewSession(t *testing.T) {
@@ -361,6 +435,110 @@ func Test_SessionUpdate_Pre_ReadSessionData(t *testing.T) {
 	assert.False(t, (state.Error&constants.SessionError_FailedToReadSessionData) != 0)
 }
 
+func Test_SessionUpdate_Pre_ReadSessionDataFromStore(t *testing.T) {
+
+	t.Parallel()
+
+	state := CreateState()
+
+	serverBackendPublicKey, serverBackendPrivateKey := crypto.Sign_KeyPair()
+
+	state.ServerBackendPublicKey = serverBackendPublicKey
+	state.ServerBackendPrivateKey = serverBackendPrivateKey
+
+	state.SessionStore = common.CreateSessionStore(context.Background(), nil, common.SessionStoreConfig{})
+
+	sessionData := packets.GenerateRandomSessionData()
+	sessionData.SliceNumber = 10
+
+	state.SessionStore.Put(sessionData.SessionId, packets.ServerSessionDataVersion_Write, sessionData.SliceNumber, WriteServerSessionData(sessionData))
+
+	// the SDK didn't echo back any session data, but we have it in the session store
+
+	state.Request.SessionId = sessionData.SessionId
+	state.Request.SliceNumber = 10
+
+	handlers.SessionUpdate_Pre(state)
+
+	assert.True(t, state.ReadSessionData)
+	assert.True(t, state.ReadSessionDataFromStore)
+	assert.Equal(t, sessionData.SessionId, state.Input.SessionId)
+	assert.False(t, (state.Error&constants.SessionError_SessionDataSignatureCheckFailed) != 0)
+}
+
+func Test_SessionUpdate_Pre_ReadSessionDataStoreMiss(t *testing.T) {
+
+	t.Parallel()
+
+	state := CreateState()
+
+	serverBackendPublicKey, serverBackendPrivateKey := crypto.Sign_KeyPair()
+
+	state.ServerBackendPublicKey = serverBackendPublicKey
+	state.ServerBackendPrivateKey = serverBackendPrivateKey
+
+	state.SessionStore = common.CreateSessionStore(context.Background(), nil, common.SessionStoreConfig{})
+
+	sessionData := packets.GenerateRandomSessionData()
+	sessionData.SliceNumber = 10
+
+	writeSessionData := WriteSessionData(sessionData)
+
+	state.Request.SessionDataBytes = int32(len(writeSessionData))
+	copy(state.Request.SessionData[:], writeSessionData)
+	copy(state.Request.SessionDataSignature[:], crypto.Sign(writeSessionData, state.ServerBackendPrivateKey))
+
+	// the session store doesn't have this session, so we fall back to the session data echoed back by the SDK
+
+	state.Request.SessionId = sessionData.SessionId
+	state.Request.SliceNumber = 10
+
+	handlers.SessionUpdate_Pre(state)
+
+	assert.True(t, state.ReadSessionData)
+	assert.False(t, state.ReadSessionDataFromStore)
+	assert.Equal(t, sessionData.SessionId, state.Input.SessionId)
+}
+
+func Test_SessionUpdate_Pre_ReadSessionDataStoreRetry(t *testing.T) {
+
+	t.Parallel()
+
+	state := CreateState()
+
+	serverBackendPublicKey, serverBackendPrivateKey := crypto.Sign_KeyPair()
+
+	state.ServerBackendPublicKey = serverBackendPublicKey
+	state.ServerBackendPrivateKey = serverBackendPrivateKey
+
+	state.SessionStore = common.CreateSessionStore(context.Background(), nil, common.SessionStoreConfig{})
+
+	sessionData := packets.GenerateRandomSessionData()
+	sessionData.SliceNumber = 10
+
+	writeSessionData := WriteSessionData(sessionData)
+
+	state.Request.SessionDataBytes = int32(len(writeSessionData))
+	copy(state.Request.SessionData[:], writeSessionData)
+	copy(state.Request.SessionDataSignature[:], crypto.Sign(writeSessionData, state.ServerBackendPrivateKey))
+
+	// the session store already has the session data for the next slice, so a retry of this slice uses the session data echoed back by the SDK
+
+	nextSessionData := sessionData
+	nextSessionData.SliceNumber = 11
+
+	state.SessionStore.Put(sessionData.SessionId, packets.ServerSessionDataVersion_Write, nextSessionData.SliceNumber, WriteServerSessionData(nextSessionData))
+
+	state.Request.SessionId = sessionData.SessionId
+	state.Request.SliceNumber = 10
+
+	handlers.SessionUpdate_Pre(state)
+
+	assert.True(t, state.ReadSessionData)
+	assert.False(t, state.ReadSessionDataFromStore)
+	assert.Equal(t, uint32(10), state.Input.SliceNumber)
+}
+
 func Test_SessionUpdate_ExistingSession_BadSessionId(t *testing.T) {
 
 	t.Parallel()
@@ -1170,6 +1348,7 @@ func Test_SessionUpdate_MakeRouteDecision_NoRouteRelays(t *testing.T) {
 	assert.False(t, state.Output.RouteState.Next)
 	assert.True(t, state.Output.RouteState.Veto)
 	assert.True(t, (state.Error&constants.SessionError_NoRouteRelays) != 0)
+	assert.Equal(t, uint8(constants.RouteDecision_NoRouteRelays), state.DecisionReason)
 }
 
 func Test_SessionUpdate_MakeRouteDecision_StayDirect(t *testing.T) {
@@ -1238,6 +1417,35 @@ func Test_SessionUpdate_MakeRouteDecision_StayDirect(t *testing.T) {
 	assert.True(t, state.StayDirect)
 	assert.False(t, state.TakeNetworkNext)
 	assert.False(t, state.Output.RouteState.Next)
+
+	// verify decision record
+
+	assert.Equal(t, uint8(constants.RouteDecision_NoRoute), state.DecisionReason)
+	assert.Equal(t, 0, state.NumCandidateRoutes)
+}
+
+func Test_SessionUpdate_MakeRouteDecision_StayDirect_LatencyAcceptable(t *testing.T) {
+
+	t.Parallel()
+
+	state := CreateState()
+
+	state.Input.RouteState.Next = false
+	state.Request.DirectRTT = 20
+	state.Request.SliceNumber = 100
+
+	state.Buyer.RouteShader = core.NewRouteShader()
+	state.Buyer.RouteShader.AcceptableLatency = 50
+
+	state.SourceRelays = []int32{0}
+	state.SourceRelayRTT = []int32{10}
+	state.DestRelays = []int32{0}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.StayDirect)
+	assert.Equal(t, uint8(constants.RouteDecision_LatencyAcceptable), state.DecisionReason)
+	assert.Equal(t, 0, state.NumCandidateRoutes)
 }
 
 func Test_SessionUpdate_MakeRouteDecision_TakeNetworkNext(t *testing.T) {
@@ -1367,6 +1575,19 @@ func Test_SessionUpdate_MakeRouteDecision_TakeNetworkNext(t *testing.T) {
 	assert.Equal(t, state.Output.RouteRelayIds[1], uint64(2))
 	assert.Equal(t, state.Output.RouteRelayIds[2], uint64(3))
 
+	// verify decision record
+
+	assert.Equal(t, uint8(constants.RouteDecision_TakeNetworkNext), state.DecisionReason)
+	assert.True(t, state.NumCandidateRoutes > 0)
+	assert.Equal(t, state.Output.RouteCost, state.CandidateRoutes[0].Cost)
+	assert.Equal(t, state.Output.RouteNumRelays, state.CandidateRoutes[0].NumRelays)
+	for i := 0; i < int(state.CandidateRoutes[0].NumRelays); i++ {
+		assert.Equal(t, state.Output.RouteRelayIds[i], state.RouteMatrix.RelayIds[state.CandidateRoutes[0].Relays[i]])
+	}
+	for i := 1; i < state.NumCandidateRoutes; i++ {
+		assert.True(t, state.CandidateRoutes[i].WeightedCost >= state.CandidateRoutes[i-1].WeightedCost)
+	}
+
 	// verify route tokens
 
 	const NumTokens = 5
@@ -1658,6 +1879,11 @@ func Test_SessionUpdate_MakeRouteDecision_RouteContinued(t *testing.T) {
 
 	assert.Equal(t, state.Response.RouteType, int32(packets.SDK_RouteTypeContinue))
 
+	// continuing the route doesn't search for routes, so there are no candidates to record
+
+	assert.Equal(t, uint8(constants.RouteDecision_RouteContinued), state.DecisionReason)
+	assert.Equal(t, 0, state.NumCandidateRoutes)
+
 	assert.Equal(t, state.Response.NumTokens, int32(NumTokens))
 	assert.Equal(t, len(state.Response.Tokens), NumTokens*packets.SDK_EncryptedContinueRouteTokenSize)
 
@@ -2627,6 +2853,425 @@ func Test_SessionUpdate_MakeRouteDecision_RouteNoLongerExists_MidRelay(t *testin
 
 // --------------------------------------------------------------
 
+func createExcludedRelaysState() *handlers.SessionUpdateState {
+
+	state := CreateState()
+
+	state.Input.RouteState.Next = false
+	state.Request.DirectRTT = 100
+	state.Request.SliceNumber = 100
+	state.Debug = new(string)
+
+	routingPublicKey, routingPrivateKey := crypto.Box_KeyPair()
+
+	clientPublicKey, _ := crypto.Box_KeyPair()
+
+	serverPublicKey, _ := crypto.Box_KeyPair()
+
+	state.RelayBackendPublicKey = routingPublicKey
+	state.RelayBackendPrivateKey = routingPrivateKey
+	copy(state.Request.ClientRoutePublicKey[:], clientPublicKey)
+	copy(state.Request.ServerRoutePublicKey[:], serverPublicKey)
+
+	serverAddress := core.ParseAddress("127.0.0.1:50000")
+
+	state.From = &serverAddress
+
+	state.Output.SessionId = 0x123457
+	state.Output.SessionVersion = 100
+
+	// initialize database with four relays, each with their own seller and datacenter
+
+	const NumRelays = 4
+
+	state.Database.Relays = make([]db.Relay, NumRelays)
+
+	for i := 0; i < NumRelays; i++ {
+		name := fmt.Sprintf("%c", 'a'+i)
+		seller := &db.Seller{Id: uint64(i + 1), Name: name, Code: name}
+		datacenter := &db.Datacenter{Id: uint64(i + 1), Name: name, SellerId: seller.Id}
+		relayPublicKey, _ := crypto.Box_KeyPair()
+		state.Database.Relays[i] = db.Relay{Id: uint64(i + 1), Name: name, PublicAddress: core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 40000+i)), Seller: seller, Datacenter: datacenter, DatacenterId: datacenter.Id, PublicKey: relayPublicKey}
+		state.Database.SellerMap[seller.Id] = seller
+		state.Database.DatacenterMap[datacenter.Id] = datacenter
+		state.Database.RelayMap[state.Database.Relays[i].Id] = &state.Database.Relays[i]
+	}
+
+	state.Database.GenerateRelaySecretKeys(routingPublicKey, routingPrivateKey)
+
+	// setup cost matrix with a fast route a -> b -> c, and a slightly slower route a -> d -> c
+
+	entryCount := core.TriMatrixLength(NumRelays)
+
+	costMatrix := make([]uint8, entryCount)
+
+	for i := range costMatrix {
+		costMatrix[i] = 255
+	}
+
+	costMatrix[core.TriMatrixIndex(0, 1)] = 10
+	costMatrix[core.TriMatrixIndex(1, 2)] = 10
+	costMatrix[core.TriMatrixIndex(0, 3)] = 15
+	costMatrix[core.TriMatrixIndex(3, 2)] = 15
+	costMatrix[core.TriMatrixIndex(0, 2)] = 100
+
+	// generate route matrix
+
+	relayIds := [...]uint64{1, 2, 3, 4}
+
+	relayDatacenters := [...]uint64{1, 2, 3, 4}
+
+	state.RouteMatrix = generateRouteMatrix(relayIds[:], costMatrix, relayDatacenters[:], state.Database)
+
+	// setup route shader. only select the best route, so route selection is deterministic
+
+	state.Buyer.RouteShader = core.NewRouteShader()
+	state.Buyer.RouteShader.RouteSelectThreshold = 0
+
+	// setup source and dest relays
+
+	state.SourceRelays = []int32{0}
+	state.SourceRelayRTT = []int32{1}
+
+	state.DestRelays = []int32{2}
+
+	return state
+}
+
+func Test_SessionUpdate_MakeRouteDecision_TakeNetworkNext_ExcludedRelays(t *testing.T) {
+
+	t.Parallel()
+
+	// without a relay policy we take the fastest route through relay b
+
+	state := createExcludedRelaysState()
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, int32(3), state.Output.RouteNumRelays)
+	assert.Equal(t, uint64(2), state.Output.RouteRelayIds[1])
+
+	// deny lists by seller, datacenter and relay all keep us off relay b
+
+	for i := 0; i < 3; i++ {
+
+		state := createExcludedRelaysState()
+
+		switch i {
+		case 0:
+			state.Buyer.RouteShader.DeniedSellers = []uint64{2}
+		case 1:
+			state.Buyer.RouteShader.DeniedDatacenters = []uint64{2}
+		case 2:
+			state.Buyer.RouteShader.DeniedRelays = []uint64{2}
+		}
+
+		handlers.SessionUpdate_MakeRouteDecision(state)
+
+		assert.True(t, state.TakeNetworkNext)
+		assert.Equal(t, int32(3), state.Output.RouteNumRelays)
+		for j := 0; j < int(state.Output.RouteNumRelays); j++ {
+			assert.NotEqual(t, uint64(2), state.Output.RouteRelayIds[j])
+		}
+	}
+
+	// an allow list that doesn't include the dest relay leaves no route, so we stay direct
+
+	state = createExcludedRelaysState()
+
+	state.Buyer.RouteShader.AllowedSellers = []uint64{1, 2, 4}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.False(t, state.TakeNetworkNext)
+	assert.True(t, state.StayDirect)
+}
+
+func Test_SessionUpdate_MakeRouteDecision_RouteChanged_ExcludedRelays(t *testing.T) {
+
+	t.Parallel()
+
+	// take network next through relay b
+
+	state := createExcludedRelaysState()
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, uint64(2), state.Output.RouteRelayIds[1])
+
+	// deny relay b. the session must move off it, even though it's still the fastest route
+
+	state.Input = state.Output
+	state.Request.Next = true
+	state.Request.NextRTT = 30
+
+	state.Buyer.RouteShader.DeniedRelays = []uint64{2}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.RouteChanged)
+	assert.True(t, state.Output.RouteState.Next)
+	assert.Equal(t, int32(3), state.Output.RouteNumRelays)
+	for j := 0; j < int(state.Output.RouteNumRelays); j++ {
+		assert.NotEqual(t, uint64(2), state.Output.RouteRelayIds[j])
+	}
+}
+
+func Test_SessionUpdate_MakeRouteDecision_TakeNetworkNext_RelayCapacity(t *testing.T) {
+
+	t.Parallel()
+
+	// relay b is below the capacity threshold, so we take the fastest route through it
+
+	state := createExcludedRelaysState()
+
+	state.RelayCapacityThreshold = 80
+	state.RouteMatrix.RelayHeadroom = []byte{100, 30, 100, 100}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, uint64(2), state.Output.RouteRelayIds[1])
+
+	// relay b is above the capacity threshold, so new sessions go through relay d instead
+
+	state = createExcludedRelaysState()
+
+	state.RelayCapacityThreshold = 80
+	state.RouteMatrix.RelayHeadroom = []byte{100, 10, 100, 100}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, uint64(4), state.Output.RouteRelayIds[1])
+
+	// with the capacity threshold disabled, only full relays are avoided
+
+	state = createExcludedRelaysState()
+
+	state.RouteMatrix.RelayHeadroom = []byte{100, 10, 100, 100}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, uint64(2), state.Output.RouteRelayIds[1])
+
+	state = createExcludedRelaysState()
+
+	state.RouteMatrix.RelayHeadroom = []byte{100, 0, 100, 100}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, uint64(4), state.Output.RouteRelayIds[1])
+}
+
+func Test_SessionUpdate_MakeRouteDecision_RouteContinued_RelayCapacity(t *testing.T) {
+
+	t.Parallel()
+
+	// take network next through relay b
+
+	state := createExcludedRelaysState()
+
+	state.RelayCapacityThreshold = 80
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.Equal(t, uint64(2), state.Output.RouteRelayIds[1])
+
+	// relay b goes above the capacity threshold. sessions already on it stay on it
+
+	state.Input = state.Output
+	state.Request.Next = true
+	state.Request.NextRTT = 30
+
+	state.RouteMatrix.RelayHeadroom = []byte{100, 10, 100, 100}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.False(t, state.RouteChanged)
+	assert.True(t, state.Output.RouteState.Next)
+	assert.Equal(t, uint64(2), state.Output.RouteRelayIds[1])
+
+	// relay b fills up. sessions on it move to relay d
+
+	state.Input = state.Output
+	state.Request.Next = true
+	state.Request.NextRTT = 30
+
+	state.RouteMatrix.RelayHeadroom = []byte{100, 0, 100, 100}
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.RouteChanged)
+	assert.True(t, state.Output.RouteState.Next)
+	assert.Equal(t, uint64(4), state.Output.RouteRelayIds[1])
+}
+
+func createRedundantRouteState() *handlers.SessionUpdateState {
+
+	state := CreateState()
+
+	state.Input.RouteState.Next = false
+	state.Request.DirectRTT = 100
+	state.Request.SliceNumber = 100
+	state.Debug = new(string)
+
+	routingPublicKey, routingPrivateKey := crypto.Box_KeyPair()
+
+	clientPublicKey, _ := crypto.Box_KeyPair()
+
+	serverPublicKey, _ := crypto.Box_KeyPair()
+
+	state.RelayBackendPublicKey = routingPublicKey
+	state.RelayBackendPrivateKey = routingPrivateKey
+	copy(state.Request.ClientRoutePublicKey[:], clientPublicKey)
+	copy(state.Request.ServerRoutePublicKey[:], serverPublicKey)
+
+	serverAddress := core.ParseAddress("127.0.0.1:50000")
+
+	state.From = &serverAddress
+
+	state.Output.SessionId = 0x123457
+	state.Output.SessionVersion = 100
+
+	// initialize database with four relays
+
+	const NumRelays = 4
+
+	state.Database.Relays = make([]db.Relay, NumRelays)
+
+	for i := 0; i < NumRelays; i++ {
+		name := fmt.Sprintf("%c", 'a'+i)
+		seller := &db.Seller{Id: uint64(i + 1), Name: name, Code: name}
+		datacenter := &db.Datacenter{Id: uint64(i + 1), Name: name, SellerId: seller.Id}
+		relayPublicKey, _ := crypto.Box_KeyPair()
+		state.Database.Relays[i] = db.Relay{Id: uint64(i + 1), Name: name, PublicAddress: core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", 40000+i)), Seller: seller, Datacenter: datacenter, DatacenterId: datacenter.Id, PublicKey: relayPublicKey}
+		state.Database.SellerMap[seller.Id] = seller
+		state.Database.DatacenterMap[datacenter.Id] = datacenter
+		state.Database.RelayMap[state.Database.Relays[i].Id] = &state.Database.Relays[i]
+	}
+
+	state.Database.GenerateRelaySecretKeys(routingPublicKey, routingPrivateKey)
+
+	// setup cost matrix with a fast route a -> c, and a slower route b -> d that shares no relays with it
+
+	entryCount := core.TriMatrixLength(NumRelays)
+
+	costMatrix := make([]uint8, entryCount)
+
+	for i := range costMatrix {
+		costMatrix[i] = 255
+	}
+
+	costMatrix[core.TriMatrixIndex(0, 2)] = 20
+	costMatrix[core.TriMatrixIndex(1, 3)] = 24
+
+	// generate route matrix
+
+	relayIds := [...]uint64{1, 2, 3, 4}
+
+	relayDatacenters := [...]uint64{1, 2, 3, 4}
+
+	state.RouteMatrix = generateRouteMatrix(relayIds[:], costMatrix, relayDatacenters[:], state.Database)
+
+	// setup route shader. only select the best route, so route selection is deterministic
+
+	state.Buyer.RouteShader = core.NewRouteShader()
+	state.Buyer.RouteShader.RouteSelectThreshold = 0
+	state.Buyer.RouteShader.RedundantRoute = true
+
+	// setup source and dest relays
+
+	state.SourceRelays = []int32{0, 1}
+	state.SourceRelayRTT = []int32{1, 2}
+
+	state.DestRelays = []int32{2, 3}
+
+	return state
+}
+
+func Test_SessionUpdate_MakeRouteDecision_TakeNetworkNext_RedundantRoute(t *testing.T) {
+
+	t.Parallel()
+
+	state := createRedundantRouteState()
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.True(t, state.SecondRouteChanged)
+
+	// primary route is a -> c
+
+	assert.Equal(t, int32(2), state.Output.RouteNumRelays)
+	assert.Equal(t, uint64(1), state.Output.RouteRelayIds[0])
+	assert.Equal(t, uint64(3), state.Output.RouteRelayIds[1])
+
+	assert.Equal(t, int32(packets.SDK_RouteTypeNew), state.Response.RouteType)
+	assert.Equal(t, int32(4), state.Response.NumTokens)
+
+	// second route is b -> d. it is recorded in the session data, but the SDK doesn't take it yet
+
+	assert.Equal(t, int32(2), state.Output.SecondRouteNumRelays)
+	assert.Equal(t, uint64(2), state.Output.SecondRouteRelayIds[0])
+	assert.Equal(t, uint64(4), state.Output.SecondRouteRelayIds[1])
+	assert.Equal(t, int32(2+24+constants.CostBias), state.Output.SecondRouteCost)
+}
+
+func Test_SessionUpdate_MakeRouteDecision_RouteContinued_RedundantRoute(t *testing.T) {
+
+	t.Parallel()
+
+	state := createRedundantRouteState()
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.True(t, state.SecondRouteChanged)
+
+	// next slice both routes continue
+
+	state.Input = state.Output
+	state.Request.Next = true
+	state.Request.NextRTT = 30
+	state.Response = packets.SDK_SessionUpdateResponsePacket{}
+	state.SecondRouteChanged = false
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.RouteContinued)
+	assert.True(t, state.SecondRouteContinued)
+	assert.False(t, state.SecondRouteChanged)
+
+	assert.Equal(t, int32(packets.SDK_RouteTypeContinue), state.Response.RouteType)
+
+	assert.Equal(t, int32(2), state.Output.SecondRouteNumRelays)
+	assert.Equal(t, uint64(2), state.Output.SecondRouteRelayIds[0])
+	assert.Equal(t, uint64(4), state.Output.SecondRouteRelayIds[1])
+}
+
+func Test_SessionUpdate_MakeRouteDecision_RedundantRoute_TooSlow(t *testing.T) {
+
+	t.Parallel()
+
+	// the second route must be within max latency trade off of the primary route
+
+	state := createRedundantRouteState()
+
+	state.Buyer.RouteShader.MaxLatencyTradeOff = 1
+
+	handlers.SessionUpdate_MakeRouteDecision(state)
+
+	assert.True(t, state.TakeNetworkNext)
+	assert.False(t, state.SecondRouteChanged)
+	assert.Equal(t, int32(0), state.Output.SecondRouteNumRelays)
+}
+
 func Test_SessionUpdate_UpdateClientRelays_DatacenterNotEnabled(t *testing.T) {
 
 	t.Parallel()
@@ -2882,6 +3527,50 @@ func Test_SessionUpdate_Post_SliceZero(t *testing.T) {
 	handlers.SessionUpdate_Post(state)
 }
 
+func Test_SessionUpdate_Post_SessionStore(t *testing.T) {
+
+	t.Parallel()
+
+	state := CreateState()
+
+	serverBackendPublicKey, serverBackendPrivateKey := crypto.Sign_KeyPair()
+
+	state.ServerBackendPublicKey = serverBackendPublicKey
+	state.ServerBackendPrivateKey = serverBackendPrivateKey
+
+	from := core.ParseAddress("127.0.0.1:40000")
+	state.From = &from
+	serverBackendAddress := core.ParseAddress("127.0.0.1:50000")
+	state.ServerBackendAddress = &serverBackendAddress
+
+	sessionStore := common.CreateSessionStore(context.Background(), nil, common.SessionStoreConfig{})
+
+	state.SessionStore = sessionStore
+
+	state.Request.SessionId = 0x12345
+	state.Request.SliceNumber = 10
+	state.Output.SessionId = 0x12345
+	state.Output.SliceNumber = 11
+
+	handlers.SessionUpdate_Post(state)
+
+	// the next session update reads the session data written by post from the session store
+
+	state = CreateState()
+
+	state.ServerBackendPublicKey = serverBackendPublicKey
+	state.ServerBackendPrivateKey = serverBackendPrivateKey
+	state.SessionStore = sessionStore
+
+	state.Request.SessionId = 0x12345
+	state.Request.SliceNumber = 11
+
+	assert.True(t, handlers.SessionUpdate_ReadSessionData(state))
+	assert.True(t, state.ReadSessionDataFromStore)
+	assert.Equal(t, uint64(0x12345), state.Input.SessionId)
+	assert.Equal(t, uint32(11), state.Input.SliceNumber)
+}
+
 func Test_SessionUpdate_Post_DurationOnNext(t *testing.T) {
 
 	t.Parallel()
@@ -29,11 +29,12 @@ type AnalyticsSessionUpdateMessage struct {
 
 	// next only
 
-	NextRTT          float32 `avro:"next_rtt"`
-	NextJitter       float32 `avro:"next_jitter"`
-	NextPacketLoss   float32 `avro:"next_packet_loss"`
-	NextPredictedRTT float32 `avro:"next_predicted_rtt"`
-	NextRouteRelays  []int64 `avro:"next_route_relays"`
+	NextRTT               float32 `avro:"next_rtt"`
+	NextJitter            float32 `avro:"next_jitter"`
+	NextPacketLoss        float32 `avro:"next_packet_loss"`
+	NextPredictedRTT      float32 `avro:"next_predicted_rtt"`
+	NextRouteRelays       []int64 `avro:"next_route_relays"`
+	NextSecondRouteRelays []int64 `avro:"next_second_route_relays"`
 
 	// flags
 
@@ -195,6 +196,7 @@ type AnalyticsRouteMatrixUpdateMessage struct {
 	RouteMatrixSize         int32   `avro:"route_matrix_size"`
 	DatabaseSize            int32   `avro:"database_size"`
 	OptimizeTime            int32   `avro:"optimize_time"`
+	CostEstimator           string  `avro:"cost_estimator"`
 }
 
 // ----------------------------------------------------------------------------------------
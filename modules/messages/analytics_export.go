@@ -0,0 +1,155 @@
+package messages
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/hamba/avro/ocf"
+)
+
+/*
+	Reading analytics messages back out of BigQuery.
+
+	Analytics messages are published to pubsub and written to BigQuery tables with a column for each avro field.
+	Export a table with "bq extract --destination_format=AVRO" and read the files back with ReadAnalyticsExport.
+
+	The export has its own avro schema: integers are longs, floats are doubles, timestamps are timestamp-micros
+	and nullable columns are unions with null. So each record is decoded generically, then copied into the
+	message by its avro tags. Columns that aren't in the export are left zero.
+*/
+
+func ReadAnalyticsExport[T any](reader io.Reader) ([]T, error) {
+
+	decoder, err := ocf.NewDecoder(reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not read avro file: %v", err)
+	}
+
+	messageType := reflect.TypeOf((*T)(nil)).Elem()
+	if messageType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%v is not a struct", messageType)
+	}
+
+	fields := make(map[string]int)
+	for i := 0; i < messageType.NumField(); i++ {
+		if tag := messageType.Field(i).Tag.Get("avro"); tag != "" {
+			fields[tag] = i
+		}
+	}
+
+	result := []T{}
+
+	for decoder.HasNext() {
+
+		var record any
+		if err := decoder.Decode(&record); err != nil {
+			return result, fmt.Errorf("could not decode record %d: %v", len(result), err)
+		}
+
+		columns, ok := record.(map[string]any)
+		if !ok {
+			return result, fmt.Errorf("record %d is not a record", len(result))
+		}
+
+		var message T
+		value := reflect.ValueOf(&message).Elem()
+
+		for name, column := range columns {
+			index, ok := fields[name]
+			if !ok {
+				continue
+			}
+			if err := setAnalyticsField(value.Field(index), column); err != nil {
+				return result, fmt.Errorf("could not read %s in record %d: %v", name, len(result), err)
+			}
+		}
+
+		result = append(result, message)
+	}
+
+	if err := decoder.Error(); err != nil {
+		return result, fmt.Errorf("could not read avro file: %v", err)
+	}
+
+	return result, nil
+}
+
+func setAnalyticsField(field reflect.Value, column any) error {
+
+	// nullable columns are unions, decoded as a map from the type name to the value
+
+	if union, ok := column.(map[string]any); ok && len(union) == 1 {
+		for _, value := range union {
+			column = value
+		}
+	}
+
+	if column == nil {
+		return nil
+	}
+
+	switch field.Kind() {
+
+	case reflect.Bool:
+		value, ok := column.(bool)
+		if !ok {
+			return fmt.Errorf("expected boolean, got %T", column)
+		}
+		field.SetBool(value)
+
+	case reflect.Int32, reflect.Int64:
+		switch value := column.(type) {
+		case int:
+			field.SetInt(int64(value))
+		case int32:
+			field.SetInt(int64(value))
+		case int64:
+			field.SetInt(value)
+		case time.Time:
+			field.SetInt(value.UnixMicro())
+		default:
+			return fmt.Errorf("expected integer, got %T", column)
+		}
+
+	case reflect.Float32, reflect.Float64:
+		switch value := column.(type) {
+		case float32:
+			field.SetFloat(float64(value))
+		case float64:
+			field.SetFloat(value)
+		case int:
+			field.SetFloat(float64(value))
+		case int64:
+			field.SetFloat(float64(value))
+		default:
+			return fmt.Errorf("expected float, got %T", column)
+		}
+
+	case reflect.String:
+		value, ok := column.(string)
+		if !ok {
+			return fmt.Errorf("expected string, got %T", column)
+		}
+		field.SetString(value)
+
+	case reflect.Slice:
+		values, ok := column.([]any)
+		if !ok {
+			return fmt.Errorf("expected array, got %T", column)
+		}
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i := range values {
+			if err := setAnalyticsField(slice.Index(i), values[i]); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+
+	default:
+		return fmt.Errorf("unsupported field type %v", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package messages
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/ocf"
+	"github.com/stretchr/testify/assert"
+)
+
+// the schema BigQuery uses when it exports a session update table with "bq extract --destination_format=AVRO"
+
+const exportSessionUpdateSchema = `{
+	"type": "record",
+	"name": "Root",
+	"fields": [
+		{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "session_id", "type": "long"},
+		{"name": "slice_number", "type": ["null", "long"]},
+		{"name": "direct_rtt", "type": "double"},
+		{"name": "next_rtt", "type": ["null", "double"]},
+		{"name": "next", "type": "boolean"},
+		{"name": "next_route_relays", "type": {"type": "array", "items": "long"}},
+		{"name": "subscription_name", "type": "string"}
+	]
+}`
+
+func TestReadAnalyticsExport(t *testing.T) {
+
+	t.Parallel()
+
+	timestamp := time.Unix(1700000000, 123456000).UTC()
+
+	var buffer bytes.Buffer
+
+	encoder, err := ocf.NewEncoder(exportSessionUpdateSchema, &buffer)
+	assert.NoError(t, err)
+
+	assert.NoError(t, encoder.Encode(map[string]any{
+		"timestamp":         timestamp,
+		"session_id":        int64(0x12345),
+		"slice_number":      map[string]any{"long": int64(10)},
+		"direct_rtt":        100.5,
+		"next_rtt":          map[string]any{"double": 25.5},
+		"next":              true,
+		"next_route_relays": []any{int64(1), int64(2), int64(3)},
+		"subscription_name": "session_update",
+	}))
+
+	assert.NoError(t, encoder.Encode(map[string]any{
+		"timestamp":         timestamp,
+		"session_id":        int64(0x12345),
+		"slice_number":      map[string]any{"long": int64(11)},
+		"direct_rtt":        100.0,
+		"next_rtt":          nil,
+		"next":              false,
+		"next_route_relays": []any{},
+		"subscription_name": "session_update",
+	}))
+
+	assert.NoError(t, encoder.Close())
+
+	messages, err := ReadAnalyticsExport[AnalyticsSessionUpdateMessage](&buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(messages))
+
+	assert.Equal(t, timestamp.UnixMicro(), messages[0].Timestamp)
+	assert.Equal(t, int64(0x12345), messages[0].SessionId)
+	assert.Equal(t, int32(10), messages[0].SliceNumber)
+	assert.Equal(t, float32(100.5), messages[0].DirectRTT)
+	assert.Equal(t, float32(25.5), messages[0].NextRTT)
+	assert.True(t, messages[0].Next)
+	assert.Equal(t, []int64{1, 2, 3}, messages[0].NextRouteRelays)
+
+	assert.Equal(t, int32(11), messages[1].SliceNumber)
+	assert.Equal(t, float32(0), messages[1].NextRTT)
+	assert.False(t, messages[1].Next)
+	assert.Equal(t, []int64{}, messages[1].NextRouteRelays)
+}
+
+func TestReadAnalyticsExport_BadType(t *testing.T) {
+
+	t.Parallel()
+
+	var buffer bytes.Buffer
+
+	encoder, err := ocf.NewEncoder(`{"type": "record", "name": "Root", "fields": [{"name": "session_id", "type": "string"}]}`, &buffer)
+	assert.NoError(t, err)
+	assert.NoError(t, encoder.Encode(map[string]any{"session_id": "not a session id"}))
+	assert.NoError(t, encoder.Close())
+
+	_, err = ReadAnalyticsExport[AnalyticsSessionUpdateMessage](&buffer)
+	assert.Error(t, err)
+}
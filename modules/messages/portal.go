@@ -143,6 +143,19 @@ type PortalSessionUpdateMessage struct {
 	BestDirectRTT uint32
 	BestNextRTT   uint32
 
+	DecisionReason                    uint8
+	DecisionRouteStateFlags           uint32
+	DecisionAcceptableLatency         int32
+	DecisionLatencyReductionThreshold int32
+	DecisionRouteCost                 int32
+	DecisionRouteNumRelays            uint32
+	DecisionRouteRelayId              [constants.MaxRouteRelays]uint64
+	NumCandidateRoutes                uint32
+	CandidateRouteCost                [constants.MaxDecisionCandidateRoutes]int32
+	CandidateRouteWeightedCost        [constants.MaxDecisionCandidateRoutes]int32
+	CandidateRouteNumRelays           [constants.MaxDecisionCandidateRoutes]uint32
+	CandidateRouteRelayId             [constants.MaxDecisionCandidateRoutes][constants.MaxRouteRelays]uint64
+
 	Retry            bool
 	FallbackToDirect bool
 	SendToPortal     bool
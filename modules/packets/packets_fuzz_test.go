@@ -0,0 +1,193 @@
+package packets_test
+
+import (
+	"testing"
+
+	"github.com/networknext/next/modules/constants"
+	"github.com/networknext/next/modules/packets"
+)
+
+// ------------------------------------------------------------------------
+
+/*
+	Fuzz targets for packet read paths.
+
+	Run with eg. "go test ./modules/packets -run '^$' -fuzz FuzzSDK_SessionUpdateRequestPacket -fuzztime 60s"
+
+	Without -fuzz, each target runs its seed corpus as a regular test.
+*/
+
+const NumFuzzSeeds = 10
+
+// addPacketSeeds adds serialized random packets from the packet test fixtures to the seed corpus
+func addPacketSeeds[P packets.Packet](f *testing.F, generate func() P) {
+	for i := 0; i < NumFuzzSeeds; i++ {
+		buffer := make([]byte, constants.MaxPacketBytes)
+		packetData, err := packets.WritePacket(buffer, generate())
+		if err != nil {
+			f.Fatalf("could not write seed packet: %v", err)
+		}
+		f.Add(packetData)
+	}
+	f.Add([]byte{})
+}
+
+// fuzzPacketRead reads arbitrary data into a packet. It must not panic, and if it reads, the packet must write again
+func fuzzPacketRead[P packets.Packet](f *testing.F, create func() P) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet := create()
+		if err := packets.ReadPacket(data, packet); err != nil {
+			return
+		}
+		buffer := make([]byte, constants.MaxPacketBytes*2)
+		if _, err := packets.WritePacket(buffer, packet); err != nil {
+			t.Fatalf("packet was read, but could not be written: %v", err)
+		}
+	})
+}
+
+func FuzzSDK_ServerInitRequestPacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ServerInitRequestPacket {
+		packet := GenerateRandomServerInitRequestPacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ServerInitRequestPacket {
+		return &packets.SDK_ServerInitRequestPacket{}
+	})
+}
+
+func FuzzSDK_ServerInitResponsePacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ServerInitResponsePacket {
+		packet := GenerateRandomServerInitResponsePacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ServerInitResponsePacket {
+		return &packets.SDK_ServerInitResponsePacket{}
+	})
+}
+
+func FuzzSDK_ServerUpdateRequestPacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ServerUpdateRequestPacket {
+		packet := GenerateRandomServerUpdateRequestPacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ServerUpdateRequestPacket {
+		return &packets.SDK_ServerUpdateRequestPacket{}
+	})
+}
+
+func FuzzSDK_ServerUpdateResponsePacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ServerUpdateResponsePacket {
+		packet := GenerateRandomServerUpdateResponsePacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ServerUpdateResponsePacket {
+		return &packets.SDK_ServerUpdateResponsePacket{}
+	})
+}
+
+func FuzzSDK_ClientRelayRequestPacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ClientRelayRequestPacket {
+		packet := GenerateRandomClientRelayRequestPacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ClientRelayRequestPacket {
+		return &packets.SDK_ClientRelayRequestPacket{}
+	})
+}
+
+func FuzzSDK_ClientRelayResponsePacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ClientRelayResponsePacket {
+		packet := GenerateRandomClientRelayResponsePacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ClientRelayResponsePacket {
+		return &packets.SDK_ClientRelayResponsePacket{}
+	})
+}
+
+func FuzzSDK_ServerRelayRequestPacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ServerRelayRequestPacket {
+		packet := GenerateRandomServerRelayRequestPacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ServerRelayRequestPacket {
+		return &packets.SDK_ServerRelayRequestPacket{}
+	})
+}
+
+func FuzzSDK_ServerRelayResponsePacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_ServerRelayResponsePacket {
+		packet := GenerateRandomServerRelayResponsePacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_ServerRelayResponsePacket {
+		return &packets.SDK_ServerRelayResponsePacket{}
+	})
+}
+
+func FuzzSDK_SessionUpdateRequestPacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_SessionUpdateRequestPacket {
+		packet := GenerateRandomSessionUpdateRequestPacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_SessionUpdateRequestPacket {
+		return &packets.SDK_SessionUpdateRequestPacket{}
+	})
+}
+
+func FuzzSDK_SessionUpdateResponsePacket(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_SessionUpdateResponsePacket {
+		packet := GenerateRandomSessionUpdateResponsePacket()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_SessionUpdateResponsePacket {
+		return &packets.SDK_SessionUpdateResponsePacket{}
+	})
+}
+
+func FuzzSDK_SessionData(f *testing.F) {
+	addPacketSeeds(f, func() *packets.SDK_SessionData {
+		packet := packets.GenerateRandomSessionData()
+		return &packet
+	})
+	fuzzPacketRead(f, func() *packets.SDK_SessionData {
+		return &packets.SDK_SessionData{}
+	})
+}
+
+// ------------------------------------------------------------------------
+
+func FuzzRelayUpdateRequestPacket(f *testing.F) {
+	for i := 0; i < NumFuzzSeeds; i++ {
+		buffer := make([]byte, 150*1024)
+		packet := GenerateRandomRelayUpdateRequestPacket()
+		f.Add(packet.Write(buffer))
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet := packets.RelayUpdateRequestPacket{}
+		if err := packet.Read(data); err != nil {
+			return
+		}
+		buffer := make([]byte, 150*1024)
+		packet.Write(buffer)
+	})
+}
+
+func FuzzRelayUpdateResponsePacket(f *testing.F) {
+	for i := 0; i < NumFuzzSeeds; i++ {
+		buffer := make([]byte, 150*1024)
+		packet := GenerateRandomRelayUpdateResponsePacket()
+		f.Add(packet.Write(buffer))
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet := packets.RelayUpdateResponsePacket{}
+		if err := packet.Read(data); err != nil {
+			return
+		}
+		buffer := make([]byte, 150*1024)
+		packet.Write(buffer)
+	})
+}
@@ -87,6 +87,21 @@ func TestVersionAtLeast(t *testing.T) {
 	})
 }
 
+func TestVersionSupports(t *testing.T) {
+
+	t.Run("released", func(t *testing.T) {
+		assert.True(t, packets.SDKVersion{1, 2, 12}.Supports(packets.SDKVersion{1, 2, 11}))
+		assert.False(t, packets.SDKVersion{1, 2, 11}.Supports(packets.SDKVersion{1, 2, 12}))
+	})
+
+	t.Run("internal", func(t *testing.T) {
+		internal := packets.SDKVersion{255, 255, 255}
+		assert.True(t, internal.IsInternal())
+		assert.True(t, internal.Supports(packets.SDKVersionLatest))
+		assert.False(t, internal.Supports(packets.SDKVersion{packets.SDKVersionLatest.Major, packets.SDKVersionLatest.Minor, packets.SDKVersionLatest.Patch + 1}))
+	})
+}
+
 // -------------------------------------------------------------------------
 
 func PacketSerializationTest[P packets.Packet](writePacket P, readPacket P, t *testing.T) {
@@ -111,7 +126,7 @@ func PacketSerializationTest[P packets.Packet](writePacket P, readPacket P, t *t
 
 func GenerateRandomServerInitRequestPacket() packets.SDK_ServerInitRequestPacket {
 
-	return packets.SDK_ServerInitRequestPacket{
+	packet := packets.SDK_ServerInitRequestPacket{
 		Version:        packets.SDKVersion{1, 2, 11},
 		BuyerId:        rand.Uint64(),
 		MatchId:        rand.Uint64(),
@@ -119,6 +134,13 @@ func GenerateRandomServerInitRequestPacket() packets.SDK_ServerInitRequestPacket
 		DatacenterId:   rand.Uint64(),
 		DatacenterName: common.RandomString(packets.SDK_MaxDatacenterNameLength),
 	}
+
+	if common.RandomBool() {
+		packet.Version = packets.SDKVersion{1, 2, 13}
+		packet.ServerId = rand.Uint64()
+	}
+
+	return packet
 }
 
 func GenerateRandomServerInitResponsePacket() packets.SDK_ServerInitResponsePacket {
@@ -132,6 +154,16 @@ func GenerateRandomServerInitResponsePacket() packets.SDK_ServerInitResponsePack
 	common.RandomBytes(packet.CurrentMagic[:])
 	common.RandomBytes(packet.PreviousMagic[:])
 
+	if common.RandomBool() {
+		packet.Version = packets.SDKVersion{1, 2, 13}
+		packet.HasBackendAddress = common.RandomBool()
+		if packet.HasBackendAddress {
+			packet.BackendAddress = common.RandomAddress()
+		}
+	} else {
+		packet.Version = packets.SDKVersion{1, 2, 12}
+	}
+
 	return packet
 }
 
@@ -158,6 +190,17 @@ func GenerateRandomServerUpdateResponsePacket() packets.SDK_ServerUpdateResponse
 	common.RandomBytes(packet.CurrentMagic[:])
 	common.RandomBytes(packet.PreviousMagic[:])
 
+	if common.RandomBool() {
+		packet.Version = packets.SDKVersion{1, 2, 13}
+		packet.HasBackendAddress = common.RandomBool()
+		if packet.HasBackendAddress {
+			packet.BackendAddress = common.RandomAddress()
+		}
+		packet.Migrate = common.RandomBool()
+	} else {
+		packet.Version = packets.SDKVersion{1, 2, 12}
+	}
+
 	return packet
 }
 
@@ -371,7 +414,7 @@ func Test_SDK_ServerInitResponsePacket(t *testing.T) {
 
 		writePacket := GenerateRandomServerInitResponsePacket()
 
-		readPacket := packets.SDK_ServerInitResponsePacket{}
+		readPacket := packets.SDK_ServerInitResponsePacket{Version: writePacket.Version}
 
 		PacketSerializationTest[*packets.SDK_ServerInitResponsePacket](&writePacket, &readPacket, t)
 	}
@@ -399,7 +442,7 @@ func Test_SDK_ServerUpdateResponsePacket(t *testing.T) {
 
 		writePacket := GenerateRandomServerUpdateResponsePacket()
 
-		readPacket := packets.SDK_ServerUpdateResponsePacket{}
+		readPacket := packets.SDK_ServerUpdateResponsePacket{Version: writePacket.Version}
 
 		PacketSerializationTest[*packets.SDK_ServerUpdateResponsePacket](&writePacket, &readPacket, t)
 	}
@@ -612,4 +655,13 @@ func TestSessionUpdate(t *testing.T) {
 	}
 }
 
+func TestServerSessionData(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < NumSessionDataIterations; i++ {
+		writeMessage := packets.GenerateRandomServerSessionData()
+		readMessage := packets.ServerSessionData{}
+		PacketSerializationTest[*packets.ServerSessionData](&writeMessage, &readMessage, t)
+	}
+}
+
 // ------------------------------------------------------------------
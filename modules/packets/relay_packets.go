@@ -102,9 +102,11 @@ func (packet *RelayUpdateRequestPacket) Read(buffer []byte) error {
 
 	index := 0
 
-	encoding.ReadUint8(buffer, &index, &packet.Version)
+	if !encoding.ReadUint8(buffer, &index, &packet.Version) {
+		return errors.New("could not read version")
+	}
 
-	if packet.Version < RelayUpdateRequestPacket_VersionMin && packet.Version > RelayUpdateRequestPacket_VersionMax {
+	if packet.Version < RelayUpdateRequestPacket_VersionMin || packet.Version > RelayUpdateRequestPacket_VersionMax {
 		return errors.New("invalid relay update request packet version")
 	}
 
@@ -212,6 +214,11 @@ func (packet *RelayUpdateRequestPacket) Read(buffer []byte) error {
 	return nil
 }
 
+// BandwidthKbps returns the bandwidth the relay is using in whichever direction is busiest
+func (packet *RelayUpdateRequestPacket) BandwidthKbps() int {
+	return max(int(packet.EnvelopeBandwidthUpKbps), int(packet.EnvelopeBandwidthDownKbps), int(packet.BandwidthSentKbps), int(packet.BandwidthReceivedKbps))
+}
+
 // --------------------------------------------------------------------------
 
 type RelayUpdateResponsePacket struct {
@@ -64,6 +64,7 @@ type SDK_ServerInitRequestPacket struct {
 	RequestId      uint64
 	DatacenterId   uint64
 	DatacenterName string
+	ServerId       uint64
 }
 
 func (packet *SDK_ServerInitRequestPacket) Serialize(stream encoding.Stream) error {
@@ -75,17 +76,25 @@ func (packet *SDK_ServerInitRequestPacket) Serialize(stream encoding.Stream) err
 	stream.SerializeUint64(&packet.RequestId)
 	stream.SerializeUint64(&packet.DatacenterId)
 	stream.SerializeString(&packet.DatacenterName, SDK_MaxDatacenterNameLength)
+	if packet.Version.Supports(SDKVersion{1, 2, 13}) {
+		stream.SerializeUint64(&packet.ServerId)
+	}
 	return stream.Error()
 }
 
 // ------------------------------------------------------------
 
 type SDK_ServerInitResponsePacket struct {
-	RequestId     uint64
-	Response      uint32
-	UpcomingMagic [8]byte
-	CurrentMagic  [8]byte
-	PreviousMagic [8]byte
+	RequestId         uint64
+	Response          uint32
+	UpcomingMagic     [8]byte
+	CurrentMagic      [8]byte
+	PreviousMagic     [8]byte
+	HasBackendAddress bool
+	BackendAddress    net.UDPAddr
+
+	// IMPORTANT: not serialized. set to the SDK version from the server init request before reading or writing
+	Version SDKVersion
 }
 
 func (packet *SDK_ServerInitResponsePacket) Serialize(stream encoding.Stream) error {
@@ -94,6 +103,12 @@ func (packet *SDK_ServerInitResponsePacket) Serialize(stream encoding.Stream) er
 	stream.SerializeBytes(packet.UpcomingMagic[:])
 	stream.SerializeBytes(packet.CurrentMagic[:])
 	stream.SerializeBytes(packet.PreviousMagic[:])
+	if packet.Version.Supports(SDKVersion{1, 2, 13}) {
+		stream.SerializeBool(&packet.HasBackendAddress)
+		if packet.HasBackendAddress {
+			stream.SerializeAddress(&packet.BackendAddress)
+		}
+	}
 	return stream.Error()
 }
 
@@ -141,10 +156,16 @@ func (packet *SDK_ServerUpdateRequestPacket) Serialize(stream encoding.Stream) e
 // ------------------------------------------------------------
 
 type SDK_ServerUpdateResponsePacket struct {
-	RequestId     uint64
-	UpcomingMagic [8]byte
-	CurrentMagic  [8]byte
-	PreviousMagic [8]byte
+	RequestId         uint64
+	UpcomingMagic     [8]byte
+	CurrentMagic      [8]byte
+	PreviousMagic     [8]byte
+	HasBackendAddress bool
+	BackendAddress    net.UDPAddr
+	Migrate           bool // the server backend is draining. send packets to the backend address, or back through the load balancer if there is none
+
+	// IMPORTANT: not serialized. set to the SDK version from the server update request before reading or writing
+	Version SDKVersion
 }
 
 func (packet *SDK_ServerUpdateResponsePacket) Serialize(stream encoding.Stream) error {
@@ -152,6 +173,13 @@ func (packet *SDK_ServerUpdateResponsePacket) Serialize(stream encoding.Stream)
 	stream.SerializeBytes(packet.UpcomingMagic[:])
 	stream.SerializeBytes(packet.CurrentMagic[:])
 	stream.SerializeBytes(packet.PreviousMagic[:])
+	if packet.Version.Supports(SDKVersion{1, 2, 13}) {
+		stream.SerializeBool(&packet.HasBackendAddress)
+		if packet.HasBackendAddress {
+			stream.SerializeAddress(&packet.BackendAddress)
+		}
+		stream.SerializeBool(&packet.Migrate)
+	}
 	return stream.Error()
 }
 
@@ -500,6 +528,16 @@ func GenerateRandomSessionData() SDK_SessionData {
 		sessionData.RouteRelayIds[i] = rand.Uint64()
 	}
 
+	if sessionData.Version >= 8 {
+		sessionData.SecondRouteNumRelays = int32(common.RandomInt(0, SDK_MaxRelaysPerRoute))
+		if sessionData.SecondRouteNumRelays > 0 {
+			sessionData.SecondRouteCost = int32(common.RandomInt(0, SDK_InvalidRouteValue))
+		}
+		for i := 0; i < int(sessionData.SecondRouteNumRelays); i++ {
+			sessionData.SecondRouteRelayIds[i] = rand.Uint64()
+		}
+	}
+
 	sessionData.Latitude = rand.Float32()
 	sessionData.Longitude = rand.Float32()
 
@@ -516,6 +554,12 @@ func GenerateRandomSessionData() SDK_SessionData {
 	sessionData.RouteState.NoRoute = common.RandomBool()
 	sessionData.RouteState.RouteLost = common.RandomBool()
 
+	if sessionData.Version >= 9 {
+		sessionData.RouteState.FlapCount = uint32(common.RandomInt(0, constants.MaxFlapCount))
+		sessionData.RouteState.FlapHoldSlices = uint32(common.RandomInt(0, constants.MaxFlapHoldSlices))
+		sessionData.RouteState.FlapQuietSlices = uint32(common.RandomInt(0, constants.MaxFlapQuietSlices))
+	}
+
 	for i := range sessionData.ExcludeClientRelay {
 		sessionData.ExcludeClientRelay[i] = common.RandomBool()
 	}
@@ -592,6 +636,9 @@ type SDK_SessionData struct {
 	RouteNumRelays                      int32
 	RouteCost                           int32
 	RouteRelayIds                       [SDK_MaxRelaysPerRoute]uint64
+	SecondRouteNumRelays                int32
+	SecondRouteCost                     int32
+	SecondRouteRelayIds                 [SDK_MaxRelaysPerRoute]uint64
 	RouteState                          core.RouteState
 	WriteSummary                        bool
 	WroteSummary                        bool
@@ -657,6 +704,9 @@ func (sessionData *SDK_SessionData) Serialize(stream encoding.Stream) error {
 
 	if hasRoute {
 		stream.SerializeInteger(&sessionData.RouteNumRelays, 0, SDK_MaxTokens)
+		if stream.IsReading() && sessionData.RouteNumRelays > SDK_MaxRelaysPerRoute {
+			return errors.New(fmt.Sprintf("invalid route num relays: %d", sessionData.RouteNumRelays))
+		}
 		for i := int32(0); i < sessionData.RouteNumRelays; i++ {
 			stream.SerializeUint64(&sessionData.RouteRelayIds[i])
 		}
@@ -747,6 +797,27 @@ func (sessionData *SDK_SessionData) Serialize(stream encoding.Stream) error {
 		stream.SerializeBool(&sessionData.AllClientRelaysAreZero)
 	}
 
+	if sessionData.Version >= 8 {
+		hasSecondRoute := sessionData.SecondRouteNumRelays > 0
+		stream.SerializeBool(&hasSecondRoute)
+		if hasSecondRoute {
+			stream.SerializeInteger(&sessionData.SecondRouteCost, 0, SDK_InvalidRouteValue)
+			stream.SerializeInteger(&sessionData.SecondRouteNumRelays, 0, SDK_MaxTokens)
+			if stream.IsReading() && sessionData.SecondRouteNumRelays > SDK_MaxRelaysPerRoute {
+				return errors.New(fmt.Sprintf("invalid second route num relays: %d", sessionData.SecondRouteNumRelays))
+			}
+			for i := int32(0); i < sessionData.SecondRouteNumRelays; i++ {
+				stream.SerializeUint64(&sessionData.SecondRouteRelayIds[i])
+			}
+		}
+	}
+
+	if sessionData.Version >= 9 {
+		stream.SerializeBits(&sessionData.RouteState.FlapCount, 4)
+		stream.SerializeBits(&sessionData.RouteState.FlapHoldSlices, 8)
+		stream.SerializeBits(&sessionData.RouteState.FlapQuietSlices, 8)
+	}
+
 	return stream.Error()
 }
 
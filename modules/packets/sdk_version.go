@@ -17,6 +17,10 @@ type SDKVersion struct {
 	Patch int32
 }
 
+// SDKVersionLatest is the newest SDK version implemented in sdk/. Internal builds of the SDK report 255.255.255,
+// but they are built from sdk/, so they only support what this version supports. Bump it with each SDK release.
+var SDKVersionLatest = SDKVersion{1, 2, 13}
+
 func (version *SDKVersion) Serialize(stream encoding.Stream) error {
 	stream.SerializeInteger(&version.Major, 0, 255)
 	stream.SerializeInteger(&version.Minor, 0, 255)
@@ -51,6 +55,18 @@ func (a SDKVersion) AtLeast(b SDKVersion) bool {
 	return a.Compare(b) != SDKVersionOlder
 }
 
+func (v SDKVersion) IsInternal() bool {
+	return v.Major == 255
+}
+
+// Supports returns true if an SDK with this version implements the protocol added in the target version
+func (v SDKVersion) Supports(target SDKVersion) bool {
+	if v.IsInternal() {
+		v = SDKVersionLatest
+	}
+	return v.AtLeast(target)
+}
+
 func (v SDKVersion) String() string {
 	if v.Major == 255 {
 		return "internal"
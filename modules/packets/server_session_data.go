@@ -0,0 +1,62 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/networknext/next/modules/encoding"
+)
+
+/*
+	Server side session data.
+
+	This is what the server backend keeps in the session store for each session. It is never sent to the SDK,
+	so unlike SDK_SessionData it isn't limited to what fits in the session update response packet, and state
+	that only the server backend needs can be added here without an SDK update.
+
+	It has its own version, separate from the session data version. Bump it whenever you add fields, and read
+	older versions the same way SDK_SessionData does.
+*/
+
+const (
+	ServerSessionDataVersion_Min   = 1
+	ServerSessionDataVersion_Max   = 1
+	ServerSessionDataVersion_Write = 1
+
+	ServerSessionDataMaxBytes = 4096
+)
+
+type ServerSessionData struct {
+	Version     uint32
+	SessionData SDK_SessionData
+}
+
+func (serverSessionData *ServerSessionData) Serialize(stream encoding.Stream) error {
+
+	if stream.IsWriting() {
+		if serverSessionData.Version < ServerSessionDataVersion_Min || serverSessionData.Version > ServerSessionDataVersion_Max {
+			panic(fmt.Sprintf("invalid server session data version: %d", serverSessionData.Version))
+		}
+	}
+
+	stream.SerializeBits(&serverSessionData.Version, 8)
+
+	if stream.IsReading() {
+		if serverSessionData.Version < ServerSessionDataVersion_Min || serverSessionData.Version > ServerSessionDataVersion_Max {
+			return errors.New(fmt.Sprintf("invalid server session data version: %d", serverSessionData.Version))
+		}
+	}
+
+	if err := serverSessionData.SessionData.Serialize(stream); err != nil {
+		return err
+	}
+
+	return stream.Error()
+}
+
+func GenerateRandomServerSessionData() ServerSessionData {
+	return ServerSessionData{
+		Version:     ServerSessionDataVersion_Write,
+		SessionData: GenerateRandomSessionData(),
+	}
+}
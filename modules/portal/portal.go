@@ -374,6 +374,249 @@ func GenerateRandomSliceData() *SliceData {
 
 // --------------------------------------------------------------------------------------------------
 
+type DecisionRoute struct {
+	Cost         int32                            `json:"cost"`
+	WeightedCost int32                            `json:"weighted_cost"`
+	NumRelays    uint32                           `json:"num_relays"`
+	RelayIds     [constants.MaxRouteRelays]uint64 `json:"relay_ids"`
+}
+
+type DecisionData struct {
+	Timestamp                 uint64                                              `json:"timestamp,string"`
+	SliceNumber               uint32                                              `json:"slice_number"`
+	Reason                    uint8                                               `json:"reason"`
+	RouteStateFlags           uint32                                              `json:"route_state_flags"`
+	DirectRTT                 uint32                                              `json:"direct_rtt"`
+	NextRTT                   uint32                                              `json:"next_rtt"`
+	AcceptableLatency         int32                                               `json:"acceptable_latency"`
+	LatencyReductionThreshold int32                                               `json:"latency_reduction_threshold"`
+	RouteCost                 int32                                               `json:"route_cost"`
+	RouteNumRelays            uint32                                              `json:"route_num_relays"`
+	RouteRelayIds             [constants.MaxRouteRelays]uint64                    `json:"route_relay_ids"`
+	NumCandidateRoutes        uint32                                              `json:"num_candidate_routes"`
+	CandidateRoutes           [constants.MaxDecisionCandidateRoutes]DecisionRoute `json:"candidate_routes"`
+}
+
+func (data *DecisionData) Value() string {
+	output := fmt.Sprintf("%x|%d|%d|%x|%d|%d|%d|%d|%d|%d",
+		data.Timestamp,
+		data.SliceNumber,
+		data.Reason,
+		data.RouteStateFlags,
+		data.DirectRTT,
+		data.NextRTT,
+		data.AcceptableLatency,
+		data.LatencyReductionThreshold,
+		data.RouteCost,
+		data.RouteNumRelays,
+	)
+	for i := 0; i < int(data.RouteNumRelays); i++ {
+		output += fmt.Sprintf("|%x", data.RouteRelayIds[i])
+	}
+	output += fmt.Sprintf("|%d", data.NumCandidateRoutes)
+	for i := 0; i < int(data.NumCandidateRoutes); i++ {
+		route := &data.CandidateRoutes[i]
+		output += fmt.Sprintf("|%d|%d|%d", route.Cost, route.WeightedCost, route.NumRelays)
+		for j := 0; j < int(route.NumRelays); j++ {
+			output += fmt.Sprintf("|%x", route.RelayIds[j])
+		}
+	}
+	return output
+}
+
+func (data *DecisionData) Parse(value string) {
+	values := strings.Split(value, "|")
+	if len(values) < 11 {
+		return
+	}
+	timestamp, err := strconv.ParseUint(values[0], 16, 64)
+	if err != nil {
+		return
+	}
+	sliceNumber, err := strconv.ParseUint(values[1], 10, 32)
+	if err != nil {
+		return
+	}
+	reason, err := strconv.ParseUint(values[2], 10, 8)
+	if err != nil {
+		return
+	}
+	routeStateFlags, err := strconv.ParseUint(values[3], 16, 32)
+	if err != nil {
+		return
+	}
+	directRTT, err := strconv.ParseUint(values[4], 10, 32)
+	if err != nil {
+		return
+	}
+	nextRTT, err := strconv.ParseUint(values[5], 10, 32)
+	if err != nil {
+		return
+	}
+	acceptableLatency, err := strconv.ParseInt(values[6], 10, 32)
+	if err != nil {
+		return
+	}
+	latencyReductionThreshold, err := strconv.ParseInt(values[7], 10, 32)
+	if err != nil {
+		return
+	}
+	routeCost, err := strconv.ParseInt(values[8], 10, 32)
+	if err != nil {
+		return
+	}
+	routeNumRelays, err := strconv.ParseUint(values[9], 10, 32)
+	if err != nil || routeNumRelays > constants.MaxRouteRelays {
+		return
+	}
+	index := 10
+	if len(values) < index+int(routeNumRelays)+1 {
+		return
+	}
+	routeRelayIds := [constants.MaxRouteRelays]uint64{}
+	for i := 0; i < int(routeNumRelays); i++ {
+		routeRelayIds[i], err = strconv.ParseUint(values[index], 16, 64)
+		if err != nil {
+			return
+		}
+		index++
+	}
+	numCandidateRoutes, err := strconv.ParseUint(values[index], 10, 32)
+	if err != nil || numCandidateRoutes > constants.MaxDecisionCandidateRoutes {
+		return
+	}
+	index++
+	candidateRoutes := [constants.MaxDecisionCandidateRoutes]DecisionRoute{}
+	for i := 0; i < int(numCandidateRoutes); i++ {
+		if len(values) < index+3 {
+			return
+		}
+		cost, err := strconv.ParseInt(values[index], 10, 32)
+		if err != nil {
+			return
+		}
+		weightedCost, err := strconv.ParseInt(values[index+1], 10, 32)
+		if err != nil {
+			return
+		}
+		numRelays, err := strconv.ParseUint(values[index+2], 10, 32)
+		if err != nil || numRelays > constants.MaxRouteRelays {
+			return
+		}
+		index += 3
+		if len(values) < index+int(numRelays) {
+			return
+		}
+		candidateRoutes[i].Cost = int32(cost)
+		candidateRoutes[i].WeightedCost = int32(weightedCost)
+		candidateRoutes[i].NumRelays = uint32(numRelays)
+		for j := 0; j < int(numRelays); j++ {
+			candidateRoutes[i].RelayIds[j], err = strconv.ParseUint(values[index], 16, 64)
+			if err != nil {
+				return
+			}
+			index++
+		}
+	}
+	if index != len(values) {
+		return
+	}
+
+	data.Timestamp = timestamp
+	data.SliceNumber = uint32(sliceNumber)
+	data.Reason = uint8(reason)
+	data.RouteStateFlags = uint32(routeStateFlags)
+	data.DirectRTT = uint32(directRTT)
+	data.NextRTT = uint32(nextRTT)
+	data.AcceptableLatency = int32(acceptableLatency)
+	data.LatencyReductionThreshold = int32(latencyReductionThreshold)
+	data.RouteCost = int32(routeCost)
+	data.RouteNumRelays = uint32(routeNumRelays)
+	data.RouteRelayIds = routeRelayIds
+	data.NumCandidateRoutes = uint32(numCandidateRoutes)
+	data.CandidateRoutes = candidateRoutes
+}
+
+func GenerateRandomDecisionData() *DecisionData {
+	data := DecisionData{}
+	data.Timestamp = rand.Uint64()
+	data.SliceNumber = rand.Uint32()
+	data.Reason = uint8(common.RandomInt(0, constants.NumRouteDecisions-1))
+	data.RouteStateFlags = rand.Uint32()
+	data.DirectRTT = rand.Uint32()
+	data.NextRTT = rand.Uint32()
+	data.AcceptableLatency = int32(common.RandomInt(0, 100))
+	data.LatencyReductionThreshold = int32(common.RandomInt(0, 20))
+	data.RouteCost = int32(common.RandomInt(0, 255))
+	data.RouteNumRelays = uint32(common.RandomInt(0, constants.MaxRouteRelays))
+	for i := 0; i < int(data.RouteNumRelays); i++ {
+		data.RouteRelayIds[i] = rand.Uint64()
+	}
+	data.NumCandidateRoutes = uint32(common.RandomInt(0, constants.MaxDecisionCandidateRoutes))
+	for i := 0; i < int(data.NumCandidateRoutes); i++ {
+		route := &data.CandidateRoutes[i]
+		route.Cost = int32(common.RandomInt(0, 255))
+		route.WeightedCost = int32(common.RandomInt(0, 255))
+		route.NumRelays = uint32(common.RandomInt(1, constants.MaxRouteRelays))
+		for j := 0; j < int(route.NumRelays); j++ {
+			route.RelayIds[j] = rand.Uint64()
+		}
+	}
+	return &data
+}
+
+var decisionReasonStrings = [constants.NumRouteDecisions]string{
+	"none",
+	"no route relays",
+	"aborted",
+	"disabled",
+	"veto",
+	"not selected",
+	"ab test b",
+	"latency acceptable",
+	"no route",
+	"take network next",
+	"force next",
+	"route continued",
+	"route changed",
+	"route no longer suitable",
+}
+
+func DecisionReasonString(reason uint8) string {
+	if int(reason) >= len(decisionReasonStrings) {
+		return "unknown"
+	}
+	return decisionReasonStrings[reason]
+}
+
+var routeStateFlagStrings = []string{
+	"next",
+	"veto",
+	"disabled",
+	"not selected",
+	"ab test",
+	"a",
+	"b",
+	"forced next",
+	"reduce latency",
+	"reduce packet loss",
+	"route lost",
+	"no route",
+	"flap damping",
+}
+
+func RouteStateFlagStrings(flags uint32) []string {
+	output := make([]string, 0)
+	for i := range routeStateFlagStrings {
+		if (flags & (1 << i)) != 0 {
+			output = append(output, routeStateFlagStrings[i])
+		}
+	}
+	return output
+}
+
+// --------------------------------------------------------------------------------------------------
+
 type ClientRelayData struct {
 	Timestamp             uint64                             `json:"timestamp,string"`
 	NumClientRelays       uint32                             `json:"num_client_relays"`
@@ -624,17 +867,19 @@ func GenerateRandomServerData() *ServerData {
 // --------------------------------------------------------------------------------------------------
 
 type RelayData struct {
-	RelayName    string `json:"relay_name"`
-	RelayId      uint64 `json:"relay_id,string"`
-	NumSessions  uint32 `json:"num_sessions"`
-	MaxSessions  uint32 `json:"max_sessions"`
-	StartTime    uint64 `json:"start_time,string"`
-	RelayFlags   uint64 `json:"relay_flags,string"`
-	RelayVersion string `json:"relay_version"`
+	RelayName    string  `json:"relay_name"`
+	RelayId      uint64  `json:"relay_id,string"`
+	NumSessions  uint32  `json:"num_sessions"`
+	MaxSessions  uint32  `json:"max_sessions"`
+	StartTime    uint64  `json:"start_time,string"`
+	RelayFlags   uint64  `json:"relay_flags,string"`
+	RelayVersion string  `json:"relay_version"`
+	Utilization  uint32  `json:"utilization"`  // percentage of the relay's capacity in use [0,100]
+	HealthScore  float32 `json:"health_score"` // relay health score [0,100]. zero until the relay backend has scored the relay
 }
 
 func (data *RelayData) Value() string {
-	return fmt.Sprintf("%s|%x|%d|%d|%x|%x|%s",
+	return fmt.Sprintf("%s|%x|%d|%d|%x|%x|%s|%d|%.1f",
 		data.RelayName,
 		data.RelayId,
 		data.NumSessions,
@@ -642,13 +887,16 @@ func (data *RelayData) Value() string {
 		data.StartTime,
 		data.RelayFlags,
 		data.RelayVersion,
+		data.Utilization,
+		data.HealthScore,
 	)
 }
 
 func (data *RelayData) Parse(value string) {
 
+	// IMPORTANT: relay data written before utilization was added has 7 values, and before health score was added has 8 values
 	values := strings.Split(value, "|")
-	if len(values) != 7 {
+	if len(values) < 7 || len(values) > 9 {
 		return
 	}
 	relayName := values[0]
@@ -673,6 +921,20 @@ func (data *RelayData) Parse(value string) {
 		return
 	}
 	relayVersion := values[6]
+	utilization := uint64(0)
+	if len(values) >= 8 {
+		utilization, err = strconv.ParseUint(values[7], 10, 32)
+		if err != nil {
+			return
+		}
+	}
+	healthScore := float64(0)
+	if len(values) == 9 {
+		healthScore, err = strconv.ParseFloat(values[8], 32)
+		if err != nil {
+			return
+		}
+	}
 
 	data.RelayName = relayName
 	data.RelayId = relayId
@@ -681,6 +943,8 @@ func (data *RelayData) Parse(value string) {
 	data.StartTime = startTime
 	data.RelayFlags = relayFlags
 	data.RelayVersion = relayVersion
+	data.Utilization = uint32(utilization)
+	data.HealthScore = float32(healthScore)
 }
 
 func GenerateRandomRelayData() *RelayData {
@@ -692,6 +956,8 @@ func GenerateRandomRelayData() *RelayData {
 	data.StartTime = rand.Uint64()
 	data.RelayFlags = rand.Uint64()
 	data.RelayVersion = common.RandomString(constants.MaxRelayVersionLength)
+	data.Utilization = uint32(common.RandomInt(0, 100))
+	data.HealthScore = float32(common.RandomInt(0, 1000)) / 10
 	return &data
 }
 
@@ -1034,7 +1300,7 @@ func CreateSessionInserter(ctx context.Context, redisClient redis.Cmdable, sessi
 	return &inserter
 }
 
-func (inserter *SessionInserter) Insert(ctx context.Context, sessionId uint64, next bool, score uint32, sessionData *SessionData, sliceData *SliceData) {
+func (inserter *SessionInserter) Insert(ctx context.Context, sessionId uint64, next bool, score uint32, sessionData *SessionData, sliceData *SliceData, decisionData *DecisionData) {
 
 	currentTime := time.Now()
 
@@ -1062,6 +1328,11 @@ func (inserter *SessionInserter) Insert(ctx context.Context, sessionId uint64, n
 	key = fmt.Sprintf("sl-%s", sessionIdString)
 	inserter.pipeline.RPush(ctx, key, sliceData.Value())
 
+	if decisionData != nil {
+		key = fmt.Sprintf("dd-%s", sessionIdString)
+		inserter.pipeline.RPush(ctx, key, decisionData.Value())
+	}
+
 	key = fmt.Sprintf("svs-%s-%d", serverIdString, minutes)
 	inserter.pipeline.HSet(ctx, key, sessionIdString, currentTime.Unix())
 
@@ -1295,6 +1566,22 @@ func GetSessionData(ctx context.Context, redisClient redis.Cmdable, sessionId ui
 	return &sessionData, sliceData, clientRelayData, serverRelayData
 }
 
+func GetSessionDecisions(ctx context.Context, redisClient redis.Cmdable, sessionId uint64) []DecisionData {
+
+	redis_decision_data, err := redisClient.LRange(ctx, fmt.Sprintf("dd-%016x", sessionId), 0, -1).Result()
+	if err != nil {
+		core.Error("failed to get session decisions: %v", err)
+		return nil
+	}
+
+	decisionData := make([]DecisionData, len(redis_decision_data))
+	for i := 0; i < len(redis_decision_data); i++ {
+		decisionData[i].Parse(redis_decision_data[i])
+	}
+
+	return decisionData
+}
+
 func GetSessionList(ctx context.Context, redisClient redis.Cmdable, sessionIds []uint64) []*SessionData {
 
 	pipeline := redisClient.Pipeline()
@@ -3,6 +3,7 @@ package portal_test
 import (
 	"testing"
 
+	"github.com/networknext/next/modules/constants"
 	"github.com/networknext/next/modules/portal"
 
 	"github.com/stretchr/testify/assert"
@@ -32,6 +33,25 @@ func TestSliceData(t *testing.T) {
 	}
 }
 
+func TestDecisionData(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < NumIterations; i++ {
+		writeData := portal.GenerateRandomDecisionData()
+		value := writeData.Value()
+		readData := portal.DecisionData{}
+		readData.Parse(value)
+		assert.Equal(t, *writeData, readData)
+	}
+}
+
+func TestRouteStateFlagStrings(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []string{}, portal.RouteStateFlagStrings(0))
+	assert.Equal(t, []string{"next", "reduce latency"}, portal.RouteStateFlagStrings(constants.RouteStateFlags_Next|constants.RouteStateFlags_ReduceLatency))
+	assert.Equal(t, "take network next", portal.DecisionReasonString(constants.RouteDecision_TakeNetworkNext))
+	assert.Equal(t, "unknown", portal.DecisionReasonString(constants.NumRouteDecisions))
+}
+
 func TestClientRelayData(t *testing.T) {
 	t.Parallel()
 	for i := 0; i < NumIterations; i++ {
@@ -74,6 +94,18 @@ func TestRelayData(t *testing.T) {
 		readData.Parse(value)
 		assert.Equal(t, *writeData, readData)
 	}
+
+	// relay data written before utilization was added still parses
+
+	readData := portal.RelayData{}
+	readData.Parse("relay|1|10|100|2|0|1.0.0")
+	assert.Equal(t, portal.RelayData{RelayName: "relay", RelayId: 1, NumSessions: 10, MaxSessions: 100, StartTime: 2, RelayVersion: "1.0.0"}, readData)
+
+	// and so does relay data written before health score was added
+
+	readData = portal.RelayData{}
+	readData.Parse("relay|1|10|100|2|0|1.0.0|25")
+	assert.Equal(t, portal.RelayData{RelayName: "relay", RelayId: 1, NumSessions: 10, MaxSessions: 100, StartTime: 2, RelayVersion: "1.0.0", Utilization: 25}, readData)
 }
 
 func TestRelaySample(t *testing.T) {
@@ -155,6 +155,16 @@ int read_config( struct config_t * config )
 
     strncpy( config->relay_backend_url, relay_backend_url, sizeof(config->relay_backend_url) - 1 );
 
+    // optional: send relay updates over a relay stream to the relay gateway, falling back to http when it's not available
+
+    const char * relay_gateway_stream_address = getenv( "RELAY_GATEWAY_STREAM_ADDRESS" );
+    if ( relay_gateway_stream_address )
+    {
+        printf( "Relay gateway stream address is %s\n", relay_gateway_stream_address );
+
+        strncpy( config->relay_gateway_stream_address, relay_gateway_stream_address, sizeof(config->relay_gateway_stream_address) - 1 );
+    }
+
 #endif // #if !RELAY_DEBUG
 
     // -----------------------------------------------------------------------------------------------------------------------------
@@ -16,6 +16,7 @@ struct config_t
     uint8_t gateway_ethernet_address[RELAY_ETHERNET_ADDRESS_BYTES];
     uint8_t use_gateway_ethernet_address;
     char relay_backend_url[256];
+    char relay_gateway_stream_address[256];
 };
 
 int read_config( struct config_t * config );
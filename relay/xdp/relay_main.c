@@ -73,6 +73,11 @@ int main_init( struct main_t * main, struct config_t * config, struct bpf_t * bp
 
     main->start_time = time( NULL );
     main->relay_backend_url = config->relay_backend_url;
+    if ( config->relay_gateway_stream_address[0] != '\0' )
+    {
+        relay_stream_init( &main->relay_stream, config->relay_gateway_stream_address );
+        main->use_relay_stream = true;
+    }
     main->relay_port = config->relay_port;
     main->relay_public_address = config->relay_public_address;
     main->relay_internal_address = config->relay_internal_address;
@@ -117,6 +122,8 @@ int main_init( struct main_t * main, struct config_t * config, struct bpf_t * bp
 
 int main_update( struct main_t * main );
 
+int main_process_update_response( struct main_t * main, const uint8_t * update_response_data );
+
 extern bool quit;
 extern bool relay_clean_shutdown;
 
@@ -196,6 +203,11 @@ void main_shutdown( struct main_t * main )
         curl_easy_cleanup( main->curl );
     }
 
+    if ( main->use_relay_stream )
+    {
+        relay_stream_close( &main->relay_stream );
+    }
+
     if ( main->update_response_memory )
     {
         free( main->update_response_memory );
@@ -537,6 +549,45 @@ int main_update( struct main_t * main )
 
     const int update_data_length = p - update_data;
 
+    // send relay update over the relay stream if we have one. if the relay stream fails, fall back to http for this update
+
+    if ( main->use_relay_stream )
+    {
+        int response_bytes = 0;
+        if ( relay_stream_request( &main->relay_stream, update_data, update_data_length, main->update_response_memory, RELAY_RESPONSE_MAX_BYTES, &response_bytes ) == RELAY_OK )
+        {
+            if ( response_bytes == 0 )
+            {
+                printf( "error: relay update was rejected\n" );
+                fflush( stdout );
+                return RELAY_ERROR;
+            }
+
+            // relay stream responses are not protected by TLS, so they are encrypted to the relay
+
+            if ( response_bytes < crypto_box_MACBYTES + crypto_box_NONCEBYTES )
+            {
+                printf( "error: relay stream response is too small\n" );
+                fflush( stdout );
+                return RELAY_ERROR;
+            }
+
+            const uint8_t * response_nonce = main->update_response_memory + response_bytes - crypto_box_NONCEBYTES;
+
+            if ( crypto_box_open_easy( main->update_response_memory, main->update_response_memory, response_bytes - crypto_box_NONCEBYTES, response_nonce, main->relay_backend_public_key, main->relay_private_key ) != 0 )
+            {
+                printf( "error: failed to decrypt relay stream response\n" );
+                fflush( stdout );
+                return RELAY_ERROR;
+            }
+
+            return main_process_update_response( main, main->update_response_memory );
+        }
+
+        printf( "warning: could not send relay update over relay stream. falling back to http\n" );
+        fflush( stdout );
+    }
+
     // post relay update to the backend
 
     struct curl_slist * slist = curl_slist_append( NULL, "Content-Type:application/octet-stream" );
@@ -584,12 +635,14 @@ int main_update( struct main_t * main )
         return RELAY_ERROR;
     }
 
-    // parse response from relay backend
+    return main_process_update_response( main, update_response_buffer.data );
+}
 
-    curl_off_t response_size;
-    curl_easy_getinfo( main->curl, CURLINFO_SIZE_DOWNLOAD_T, &response_size );
+int main_process_update_response( struct main_t * main, const uint8_t * update_response_data )
+{
+    // parse response from relay backend
 
-    const uint8_t * q = update_response_buffer.data;
+    const uint8_t * q = update_response_data;
 
     uint8_t version = relay_read_uint8( &q );
 
@@ -7,6 +7,7 @@
 
 #include "relay.h"
 #include "relay_messages.h"
+#include "relay_stream.h"
 
 struct main_t
 {
@@ -14,6 +15,8 @@ struct main_t
     uint64_t start_time;
     uint64_t current_timestamp;
     const char * relay_backend_url;
+    bool use_relay_stream;
+    struct relay_stream_t relay_stream;
     uint8_t * update_response_memory;
     uint32_t relay_public_address;
     uint32_t relay_internal_address;
@@ -0,0 +1,210 @@
+/*
+    Network Next XDP Relay
+*/
+
+#include "relay_stream.h"
+
+#include <stdio.h>
+#include <string.h>
+#include <errno.h>
+#include <unistd.h>
+#include <netdb.h>
+#include <sys/socket.h>
+#include <sys/time.h>
+#include <netinet/in.h>
+#include <netinet/tcp.h>
+
+void relay_stream_init( struct relay_stream_t * stream, const char * address )
+{
+    assert( stream );
+    assert( address );
+    memset( stream, 0, sizeof(struct relay_stream_t) );
+    strncpy( stream->address, address, sizeof(stream->address) - 1 );
+    stream->socket = -1;
+}
+
+static int relay_stream_write( struct relay_stream_t * stream, const uint8_t * data, int bytes )
+{
+    while ( bytes > 0 )
+    {
+        ssize_t result = send( stream->socket, data, bytes, MSG_NOSIGNAL );
+        if ( result <= 0 )
+        {
+            if ( result < 0 && errno == EINTR )
+                continue;
+            return RELAY_ERROR;
+        }
+        data += result;
+        bytes -= (int) result;
+    }
+    return RELAY_OK;
+}
+
+static int relay_stream_read( struct relay_stream_t * stream, uint8_t * data, int bytes )
+{
+    while ( bytes > 0 )
+    {
+        ssize_t result = recv( stream->socket, data, bytes, 0 );
+        if ( result <= 0 )
+        {
+            if ( result < 0 && errno == EINTR )
+                continue;
+            return RELAY_ERROR;
+        }
+        data += result;
+        bytes -= (int) result;
+    }
+    return RELAY_OK;
+}
+
+static int relay_stream_connect( struct relay_stream_t * stream )
+{
+    if ( stream->socket >= 0 )
+        return RELAY_OK;
+
+    // split address into host and port
+
+    char host[256];
+    strncpy( host, stream->address, sizeof(host) - 1 );
+    host[sizeof(host)-1] = '\0';
+
+    char * port = strrchr( host, ':' );
+    if ( !port )
+    {
+        printf( "error: relay stream address '%s' is missing a port\n", stream->address );
+        fflush( stdout );
+        return RELAY_ERROR;
+    }
+
+    *port = '\0';
+    port++;
+
+    struct addrinfo hints;
+    memset( &hints, 0, sizeof(hints) );
+    hints.ai_family = AF_INET;
+    hints.ai_socktype = SOCK_STREAM;
+
+    struct addrinfo * result = NULL;
+    int error = getaddrinfo( host, port, &hints, &result );
+    if ( error != 0 )
+    {
+        printf( "error: could not resolve relay stream address '%s' (%s)\n", stream->address, gai_strerror( error ) );
+        fflush( stdout );
+        return RELAY_ERROR;
+    }
+
+    int socket_handle = socket( result->ai_family, result->ai_socktype, result->ai_protocol );
+    if ( socket_handle < 0 )
+    {
+        printf( "error: could not create relay stream socket (%s)\n", strerror( errno ) );
+        fflush( stdout );
+        freeaddrinfo( result );
+        return RELAY_ERROR;
+    }
+
+    // IMPORTANT: the send timeout also applies to connect on linux
+
+    struct timeval timeout;
+    timeout.tv_sec = RELAY_STREAM_TIMEOUT_SECONDS;
+    timeout.tv_usec = 0;
+    setsockopt( socket_handle, SOL_SOCKET, SO_RCVTIMEO, &timeout, sizeof(timeout) );
+    setsockopt( socket_handle, SOL_SOCKET, SO_SNDTIMEO, &timeout, sizeof(timeout) );
+
+    int no_delay = 1;
+    setsockopt( socket_handle, IPPROTO_TCP, TCP_NODELAY, &no_delay, sizeof(no_delay) );
+
+    if ( connect( socket_handle, result->ai_addr, result->ai_addrlen ) != 0 )
+    {
+        printf( "error: could not connect relay stream to %s (%s)\n", stream->address, strerror( errno ) );
+        fflush( stdout );
+        close( socket_handle );
+        freeaddrinfo( result );
+        return RELAY_ERROR;
+    }
+
+    freeaddrinfo( result );
+
+    stream->socket = socket_handle;
+
+    const uint8_t header[RELAY_STREAM_HEADER_BYTES] = { 'N', 'N', 'R', 'S', RELAY_STREAM_VERSION };
+    if ( relay_stream_write( stream, header, RELAY_STREAM_HEADER_BYTES ) != RELAY_OK )
+    {
+        printf( "error: could not write relay stream header to %s\n", stream->address );
+        fflush( stdout );
+        relay_stream_close( stream );
+        return RELAY_ERROR;
+    }
+
+    printf( "Relay stream connected to %s\n", stream->address );
+    fflush( stdout );
+
+    return RELAY_OK;
+}
+
+int relay_stream_request( struct relay_stream_t * stream, const uint8_t * request_data, int request_bytes, uint8_t * response_data, int max_response_bytes, int * response_bytes )
+{
+    assert( stream );
+    assert( request_data );
+    assert( request_bytes >= 0 );
+    assert( response_data );
+    assert( response_bytes );
+
+    *response_bytes = 0;
+
+    if ( relay_stream_connect( stream ) != RELAY_OK )
+        return RELAY_ERROR;
+
+    uint8_t length[RELAY_STREAM_FRAME_OVERHEAD];
+    length[0] = request_bytes & 0xFF;
+    length[1] = ( request_bytes >> 8 ) & 0xFF;
+    length[2] = ( request_bytes >> 16 ) & 0xFF;
+    length[3] = ( request_bytes >> 24 ) & 0xFF;
+
+    if ( relay_stream_write( stream, length, RELAY_STREAM_FRAME_OVERHEAD ) != RELAY_OK || relay_stream_write( stream, request_data, request_bytes ) != RELAY_OK )
+    {
+        printf( "error: could not write relay stream frame to %s (%s)\n", stream->address, strerror( errno ) );
+        fflush( stdout );
+        relay_stream_close( stream );
+        return RELAY_ERROR;
+    }
+
+    if ( relay_stream_read( stream, length, RELAY_STREAM_FRAME_OVERHEAD ) != RELAY_OK )
+    {
+        printf( "error: could not read relay stream frame from %s (%s)\n", stream->address, strerror( errno ) );
+        fflush( stdout );
+        relay_stream_close( stream );
+        return RELAY_ERROR;
+    }
+
+    const uint32_t frame_bytes = ( (uint32_t) length[0] ) | ( ( (uint32_t) length[1] ) << 8 ) | ( ( (uint32_t) length[2] ) << 16 ) | ( ( (uint32_t) length[3] ) << 24 );
+
+    if ( frame_bytes > (uint32_t) max_response_bytes )
+    {
+        printf( "error: relay stream frame from %s is too large (%d bytes)\n", stream->address, (int) frame_bytes );
+        fflush( stdout );
+        relay_stream_close( stream );
+        return RELAY_ERROR;
+    }
+
+    if ( relay_stream_read( stream, response_data, (int) frame_bytes ) != RELAY_OK )
+    {
+        printf( "error: could not read relay stream frame from %s (%s)\n", stream->address, strerror( errno ) );
+        fflush( stdout );
+        relay_stream_close( stream );
+        return RELAY_ERROR;
+    }
+
+    *response_bytes = (int) frame_bytes;
+
+    return RELAY_OK;
+}
+
+void relay_stream_close( struct relay_stream_t * stream )
+{
+    assert( stream );
+    if ( stream->socket >= 0 )
+    {
+        close( stream->socket );
+        stream->socket = -1;
+    }
+}
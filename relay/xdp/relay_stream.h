@@ -0,0 +1,35 @@
+/*
+    Network Next XDP Relay
+*/
+
+#ifndef RELAY_STREAM_H
+#define RELAY_STREAM_H
+
+#include "relay.h"
+
+/*
+    Relay streams send relay updates to the relay gateway over a persistent TCP connection, instead of one HTTP POST per-update.
+
+    The connection starts with the header "NNRS" followed by the version byte, then each relay update is sent as a frame:
+    a 4 byte little endian length followed by the encrypted relay update. Each frame is answered with a frame containing
+    the relay update response encrypted to the relay, followed by the nonce. An empty response frame means the update was rejected.
+*/
+
+#define RELAY_STREAM_VERSION                                                                      1
+#define RELAY_STREAM_HEADER_BYTES                                                                 5
+#define RELAY_STREAM_FRAME_OVERHEAD                                                               4
+#define RELAY_STREAM_TIMEOUT_SECONDS                                                             10
+
+struct relay_stream_t
+{
+    char address[256];
+    int socket;
+};
+
+void relay_stream_init( struct relay_stream_t * stream, const char * address );
+
+int relay_stream_request( struct relay_stream_t * stream, const uint8_t * request_data, int request_bytes, uint8_t * response_data, int max_response_bytes, int * response_bytes );
+
+void relay_stream_close( struct relay_stream_t * stream );
+
+#endif // #ifndef RELAY_STREAM_H
@@ -0,0 +1,3 @@
+ALTER TABLE buyers
+ADD COLUMN packet_rate_limit integer not null default 0,
+ADD COLUMN packet_rate_burst integer not null default 0;
@@ -0,0 +1,18 @@
+create table buyer_datacenter_route_shaders (
+  buyer_id integer not null,
+  datacenter_id integer not null,
+  route_shader_id integer not null,
+  primary key (buyer_id, datacenter_id),
+  constraint fk_buyer foreign key (buyer_id) references buyers(buyer_id),
+  constraint fk_datacenter foreign key (datacenter_id) references datacenters(datacenter_id),
+  constraint fk_route_shader_id foreign key (route_shader_id) references route_shaders(route_shader_id)
+);
+
+create table buyer_country_route_shaders (
+  buyer_id integer not null,
+  country varchar not null,
+  route_shader_id integer not null,
+  primary key (buyer_id, country),
+  constraint fk_buyer foreign key (buyer_id) references buyers(buyer_id),
+  constraint fk_route_shader_id foreign key (route_shader_id) references route_shaders(route_shader_id)
+);
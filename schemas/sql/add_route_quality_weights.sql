@@ -0,0 +1,3 @@
+ALTER TABLE route_shaders
+ADD COLUMN jitter_weight numeric not null default 0.0,
+ADD COLUMN packet_loss_weight numeric not null default 0.0;
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE route_shaders
+ADD COLUMN flap_hold_slices integer not null default 0,
+ADD COLUMN flap_max_hold_slices integer not null default 0,
+ADD COLUMN flap_decay_slices integer not null default 0;
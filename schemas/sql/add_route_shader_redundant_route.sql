@@ -0,0 +1,2 @@
+ALTER TABLE route_shaders
+ADD COLUMN redundant_route boolean not null default false;
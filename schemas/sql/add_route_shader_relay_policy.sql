@@ -0,0 +1,7 @@
+ALTER TABLE route_shaders
+ADD COLUMN allowed_sellers varchar not null default '',
+ADD COLUMN denied_sellers varchar not null default '',
+ADD COLUMN allowed_datacenters varchar not null default '',
+ADD COLUMN denied_datacenters varchar not null default '',
+ADD COLUMN allowed_relays varchar not null default '',
+ADD COLUMN denied_relays varchar not null default '';
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- peak hours are hours of day in UTC. peak hours end before peak_end_hour
+
+ALTER TABLE sellers
+ADD COLUMN peak_start_hour integer not null default 0,
+ADD COLUMN peak_end_hour integer not null default 0,
+ADD COLUMN peak_price_multiplier numeric not null default 1.0;
@@ -14,6 +14,18 @@ CREATE TABLE route_shaders (
   route_switch_threshold integer not null default 10,
   route_select_threshold integer not null default 5,
   force_next boolean not null default false,
+  jitter_weight numeric not null default 0.0,
+  packet_loss_weight numeric not null default 0.0,
+  allowed_sellers varchar not null default '',
+  denied_sellers varchar not null default '',
+  allowed_datacenters varchar not null default '',
+  denied_datacenters varchar not null default '',
+  allowed_relays varchar not null default '',
+  denied_relays varchar not null default '',
+  redundant_route boolean not null default false,
+  flap_hold_slices integer not null default 0,
+  flap_max_hold_slices integer not null default 0,
+  flap_decay_slices integer not null default 0,
   primary key (route_shader_id),
   constraint route_shader_short_name_constraint unique(route_shader_name)
 );
@@ -26,6 +38,8 @@ CREATE TABLE buyers (
   debug boolean not null default false,
   public_key_base64 varchar not null,
   route_shader_id integer not null,
+  packet_rate_limit integer not null default 0,
+  packet_rate_burst integer not null default 0,
   primary key (buyer_id),
   constraint fk_route_shader_id foreign key (route_shader_id) references route_shaders(route_shader_id),
   constraint buyer_name_constraint unique(buyer_name),
@@ -36,6 +50,9 @@ CREATE TABLE sellers (
   seller_id integer generated by default as identity,
   seller_name varchar not null,
   seller_code varchar not null,
+  peak_start_hour integer not null default 0, -- hour of day in UTC
+  peak_end_hour integer not null default 0, -- hour of day in UTC
+  peak_price_multiplier numeric not null default 1.0,
   primary key (seller_id),
   constraint seller_name_constraint unique(seller_name),
   constraint seller_code_constraint unique(seller_code)
@@ -90,6 +107,25 @@ create table buyer_datacenter_settings (
   constraint datacenter_map_unique_constraint unique(buyer_id, datacenter_id)
 );
 
+create table buyer_datacenter_route_shaders (
+  buyer_id integer not null,
+  datacenter_id integer not null,
+  route_shader_id integer not null,
+  primary key (buyer_id, datacenter_id),
+  constraint fk_buyer foreign key (buyer_id) references buyers(buyer_id),
+  constraint fk_datacenter foreign key (datacenter_id) references datacenters(datacenter_id),
+  constraint fk_route_shader_id foreign key (route_shader_id) references route_shaders(route_shader_id)
+);
+
+create table buyer_country_route_shaders (
+  buyer_id integer not null,
+  country varchar not null,
+  route_shader_id integer not null,
+  primary key (buyer_id, country),
+  constraint fk_buyer foreign key (buyer_id) references buyers(buyer_id),
+  constraint fk_route_shader_id foreign key (route_shader_id) references route_shaders(route_shader_id)
+);
+
 CREATE TABLE buyer_keypairs (
   buyer_keypair_id integer generated by default as identity,
   public_key_base64 varchar not null,
@@ -407,6 +407,7 @@ struct NextBackendServerInitRequestPacket
     uint64_t request_id;
     uint64_t datacenter_id;
     char datacenter_name[NEXT_MAX_DATACENTER_NAME_LENGTH];
+    uint64_t server_id;
 
     NextBackendServerInitRequestPacket()
     {
@@ -418,6 +419,7 @@ struct NextBackendServerInitRequestPacket
         request_id = 0;
         datacenter_id = 0;
         datacenter_name[0] = '\0';
+        server_id = 0;
     }
 
     template <typename Stream> bool Serialize( Stream & stream )
@@ -430,6 +432,7 @@ struct NextBackendServerInitRequestPacket
         serialize_uint64( stream, request_id );
         serialize_uint64( stream, datacenter_id );
         serialize_string( stream, datacenter_name, NEXT_MAX_DATACENTER_NAME_LENGTH );
+        serialize_uint64( stream, server_id );
         return true;
     }
 };
@@ -443,6 +446,8 @@ struct NextBackendServerInitResponsePacket
     uint8_t upcoming_magic[8];
     uint8_t current_magic[8];
     uint8_t previous_magic[8];
+    bool has_backend_address;
+    next_address_t backend_address;
 
     NextBackendServerInitResponsePacket()
     {
@@ -456,6 +461,11 @@ struct NextBackendServerInitResponsePacket
         serialize_bytes( stream, upcoming_magic, 8 );
         serialize_bytes( stream, current_magic, 8 );
         serialize_bytes( stream, previous_magic, 8 );
+        serialize_bool( stream, has_backend_address );
+        if ( has_backend_address )
+        {
+            serialize_address( stream, backend_address );
+        }
         return true;
     }
 };
@@ -522,6 +532,9 @@ struct NextBackendServerUpdateResponsePacket
     uint8_t upcoming_magic[8];
     uint8_t current_magic[8];
     uint8_t previous_magic[8];
+    bool has_backend_address;
+    next_address_t backend_address;
+    bool migrate;
 
     NextBackendServerUpdateResponsePacket()
     {
@@ -534,6 +547,12 @@ struct NextBackendServerUpdateResponsePacket
         serialize_bytes( stream, upcoming_magic, 8 );
         serialize_bytes( stream, current_magic, 8 );
         serialize_bytes( stream, previous_magic, 8 );
+        serialize_bool( stream, has_backend_address );
+        if ( has_backend_address )
+        {
+            serialize_address( stream, backend_address );
+        }
+        serialize_bool( stream, migrate );
         return true;
     }
 };
@@ -253,6 +253,7 @@ struct next_server_internal_t
     uint64_t upgrade_sequence;
     double next_resolve_hostname_time;
     next_address_t backend_address;
+    next_address_t load_balancer_address;
     uint64_t server_id;
     uint64_t match_id;
     next_address_t server_address;
@@ -1767,6 +1768,13 @@ void next_server_internal_process_network_next_packet( next_server_internal_t *
 
             next_printf( NEXT_LOG_LEVEL_INFO, "welcome to network next :)" );
 
+            if ( packet.has_backend_address )
+            {
+                server->backend_address = packet.backend_address;
+                char address_buffer[NEXT_MAX_ADDRESS_STRING_LENGTH];
+                next_printf( NEXT_LOG_LEVEL_INFO, "server backend address is %s", next_address_to_string( &server->backend_address, address_buffer ) );
+            }
+
             memcpy( server->upcoming_magic, packet.upcoming_magic, 8 );
             memcpy( server->current_magic, packet.current_magic, 8 );
             memcpy( server->previous_magic, packet.previous_magic, 8 );
@@ -1918,6 +1926,18 @@ void next_server_internal_process_network_next_packet( next_server_internal_t *
         server->server_update_request_id = 0;
         server->server_update_resend_time = 0.0;
 
+        if ( packet.has_backend_address && !next_address_equal( &packet.backend_address, &server->backend_address ) )
+        {
+            server->backend_address = packet.backend_address;
+            char address_buffer[NEXT_MAX_ADDRESS_STRING_LENGTH];
+            next_printf( NEXT_LOG_LEVEL_INFO, "server backend address changed to %s", next_address_to_string( &server->backend_address, address_buffer ) );
+        }
+        else if ( packet.migrate && !next_address_equal( &server->backend_address, &server->load_balancer_address ) )
+        {
+            server->backend_address = server->load_balancer_address;
+            next_printf( NEXT_LOG_LEVEL_INFO, "server backend is migrating. falling back to load balancer" );
+        }
+
         if ( memcmp( packet.upcoming_magic, server->upcoming_magic, 8 ) != 0 )
         {
             memcpy( server->upcoming_magic, packet.upcoming_magic, 8 );
@@ -3347,6 +3367,7 @@ static bool next_server_internal_update_resolve_hostname( next_server_internal_t
     server->resolve_hostname_thread = NULL;
     server->resolving_hostname = false;
     server->backend_address = result;
+    server->load_balancer_address = result;
 
     char address_buffer[NEXT_MAX_ADDRESS_STRING_LENGTH];
 
@@ -3589,6 +3610,7 @@ void next_server_internal_update_init( next_server_internal_t * server )
     packet.datacenter_id = server->datacenter_id;
     next_copy_string( packet.datacenter_name, server->datacenter_name, NEXT_MAX_DATACENTER_NAME_LENGTH );
     packet.datacenter_name[NEXT_MAX_DATACENTER_NAME_LENGTH-1] = '\0';
+    packet.server_id = server->server_id;
 
     uint8_t magic[8];
     memset( magic, 0, sizeof(magic) );
@@ -3748,6 +3770,14 @@ void next_server_internal_backend_update( next_server_internal_t * server )
 
     if ( server->server_update_request_id && server->server_update_resend_time <= current_time )
     {
+        // if our server backend has gone away, the load balancer will find us another one
+
+        if ( !next_address_equal( &server->backend_address, &server->load_balancer_address ) )
+        {
+            server->backend_address = server->load_balancer_address;
+            next_printf( NEXT_LOG_LEVEL_INFO, "server backend did not respond. falling back to load balancer" );
+        }
+
         NextBackendServerUpdateRequestPacket packet;
 
         packet.request_id = server->server_update_request_id;
@@ -3641,6 +3641,7 @@ void test_server_init_request_packet()
         in.buyer_id = 1231234127431LL;
         in.datacenter_id = next_datacenter_id( "local" );
         strcpy( in.datacenter_name, "local" );
+        in.server_id = 0x12345678910;
 
         int packet_bytes = 0;
         next_check( next_write_backend_packet( NEXT_BACKEND_SERVER_INIT_REQUEST_PACKET, &in, packet_data, &packet_bytes, next_signed_packets, private_key, magic, from_address, to_address ) == NEXT_OK );
@@ -3665,6 +3666,7 @@ void test_server_init_request_packet()
         next_check( in.buyer_id == out.buyer_id );
         next_check( in.datacenter_id == out.datacenter_id );
         next_check( strcmp( in.datacenter_name, out.datacenter_name ) == 0 );
+        next_check( in.server_id == out.server_id );
     }
 }
 
@@ -3691,6 +3693,8 @@ void test_server_init_response_packet()
         next_crypto_random_bytes( in.upcoming_magic, 8 );
         next_crypto_random_bytes( in.current_magic, 8 );
         next_crypto_random_bytes( in.previous_magic, 8 );
+        in.has_backend_address = true;
+        next_address_parse( &in.backend_address, "10.0.0.1:40000" );
 
         int packet_bytes = 0;
         next_check( next_write_backend_packet( NEXT_BACKEND_SERVER_INIT_RESPONSE_PACKET, &in, packet_data, &packet_bytes, next_signed_packets, private_key, magic, from_address, to_address ) == NEXT_OK );
@@ -3713,6 +3717,8 @@ void test_server_init_response_packet()
         next_check( memcmp( in.upcoming_magic, out.upcoming_magic, 8 ) == 0 );
         next_check( memcmp( in.current_magic, out.current_magic, 8 ) == 0 );
         next_check( memcmp( in.previous_magic, out.previous_magic, 8 ) == 0 );
+        next_check( in.has_backend_address == out.has_backend_address );
+        next_check( next_address_equal( &in.backend_address, &out.backend_address ) );
     }
 }
 
@@ -3791,6 +3797,9 @@ void test_server_update_response_packet()
         next_crypto_random_bytes( in.upcoming_magic, 8 );
         next_crypto_random_bytes( in.current_magic, 8 );
         next_crypto_random_bytes( in.previous_magic, 8 );
+        in.has_backend_address = true;
+        next_address_parse( &in.backend_address, "10.0.0.1:40000" );
+        in.migrate = true;
 
         int packet_bytes = 0;
         next_check( next_write_backend_packet( NEXT_BACKEND_SERVER_UPDATE_RESPONSE_PACKET, &in, packet_data, &packet_bytes, next_signed_packets, private_key, magic, from_address, to_address ) == NEXT_OK );
@@ -3812,6 +3821,9 @@ void test_server_update_response_packet()
         next_check( memcmp( in.upcoming_magic, out.upcoming_magic, 8 ) == 0 );
         next_check( memcmp( in.current_magic, out.current_magic, 8 ) == 0 );
         next_check( memcmp( in.previous_magic, out.previous_magic, 8 ) == 0 );
+        next_check( in.has_backend_address == out.has_backend_address );
+        next_check( next_address_equal( &in.backend_address, &out.backend_address ) );
+        next_check( in.migrate == out.migrate );
     }
 }
 
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/networknext/next/modules/common"
@@ -66,9 +67,78 @@ func RunOptimizeThread(ctx context.Context) {
 	}()
 }
 
+func RunIncrementalOptimizeThread(ctx context.Context) {
+
+	go func() {
+
+		ticker := time.NewTicker(time.Second)
+
+		iteration := uint64(0)
+
+		numRelays := constants.MaxRelays
+
+		size := core.TriMatrixLength(numRelays)
+
+		costs := make([]uint8, size)
+
+		for i := 0; i < numRelays; i++ {
+			for j := 0; j < i; j++ {
+				index := core.TriMatrixIndex(i, j)
+				costs[index] = uint8(common.RandomInt(0, 255))
+			}
+		}
+
+		numSegments := 256
+
+		relayDatacenterIds := make([]uint64, numRelays)
+		for i := range relayDatacenterIds {
+			relayDatacenterIds[i] = uint64(i)
+		}
+
+		destRelays := make([]bool, numRelays)
+		for i := range destRelays {
+			destRelays[i] = true
+		}
+
+		relayPrice := make([]byte, numRelays)
+
+		optimizer := core.Optimizer{}
+
+		for {
+
+			select {
+
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+
+				// only a few relay pairs change cost between each route matrix update
+
+				numChanges := common.RandomInt(0, 10)
+				for i := 0; i < numChanges; i++ {
+					costs[common.RandomInt(0, size-1)] = uint8(common.RandomInt(0, 255))
+				}
+
+				start := time.Now()
+
+				optimizer.Optimize(numRelays, numSegments, costs, nil, nil, relayPrice, relayDatacenterIds, destRelays)
+
+				fmt.Printf("iteration %d: incremental optimize %d relays, %d dirty relays, %d dirty entries (%dms)\n", iteration, numRelays, optimizer.NumDirtyRelays, optimizer.NumDirtyEntries, time.Since(start).Milliseconds())
+
+				iteration++
+			}
+		}
+	}()
+}
+
 func main() {
 
-	RunOptimizeThread(context.Background())
+	if len(os.Args) > 1 && os.Args[1] == "incremental" {
+		RunIncrementalOptimizeThread(context.Background())
+	} else {
+		RunOptimizeThread(context.Background())
+	}
 
 	time.Sleep(time.Minute)
 }
@@ -410,7 +410,7 @@ func main() {
 
 	var optimizeCommand = &ffcli.Command{
 		Name:       "optimize",
-		ShortUsage: "next optimize [rtt] [input_file] [output_file]",
+		ShortUsage: "next optimize [rtt] [input_file] [output_file] [downstream_weight]",
 		ShortHelp:  "Optimize cost matrix into a route matrix",
 		Exec: func(ctx context.Context, args []string) error {
 			input := "cost.bin"
@@ -433,7 +433,17 @@ func main() {
 				output = args[2]
 			}
 
-			optimizeCostMatrix(input, output, rtt)
+			downstreamWeight := float32(0.75)
+
+			if len(args) > 3 {
+				if res, err := strconv.ParseFloat(args[3], 32); err == nil {
+					downstreamWeight = float32(res)
+				} else {
+					handleRunTimeError(fmt.Sprintf("could not parse 4th argument to number: %v\n", err), 1)
+				}
+			}
+
+			optimizeCostMatrix(input, output, rtt, downstreamWeight)
 
 			fmt.Printf("Generated route matrix %s from %s\n\n", output, input)
 
@@ -2817,7 +2827,13 @@ func getCostMatrix(env Environment, fileName string) {
 
 	fmt.Fprintf(w, "%s\n", htmlHeader)
 
-	fmt.Fprintf(w, "cost matrix:<br><br><table>\n")
+	directional := len(costMatrix.DirectionalCosts) > 0
+
+	if directional {
+		fmt.Fprintf(w, "cost matrix (row -> column / column -> row):<br><br><table>\n")
+	} else {
+		fmt.Fprintf(w, "cost matrix:<br><br><table>\n")
+	}
 
 	fmt.Fprintf(w, "<tr><td></td>")
 
@@ -2838,7 +2854,16 @@ func getCostMatrix(env Environment, fileName string) {
 			costString := ""
 			index := core.TriMatrixIndex(i, j)
 			cost := costMatrix.Costs[index]
-			if cost >= 0 && cost < 255 {
+			if directional {
+				numRelays := len(costMatrix.RelayIds)
+				ijCost := costMatrix.DirectionalCosts[core.SquareMatrixIndex(numRelays, i, j)]
+				jiCost := costMatrix.DirectionalCosts[core.SquareMatrixIndex(numRelays, j, i)]
+				if ijCost < 255 && jiCost < 255 {
+					costString = fmt.Sprintf("%d/%d", ijCost, jiCost)
+				} else {
+					nope = true
+				}
+			} else if cost >= 0 && cost < 255 {
 				costString = fmt.Sprintf("%d", cost)
 			} else {
 				nope = true
@@ -2859,7 +2884,7 @@ func getCostMatrix(env Environment, fileName string) {
 	fmt.Fprintf(w, "%s\n", htmlFooter)
 }
 
-func optimizeCostMatrix(costMatrixFilename, routeMatrixFilename string, costThreshold int32) {
+func optimizeCostMatrix(costMatrixFilename, routeMatrixFilename string, costThreshold int32, downstreamWeight float32) {
 
 	costMatrixData, err := os.ReadFile(costMatrixFilename)
 	if err != nil {
@@ -2900,11 +2925,18 @@ func optimizeCostMatrix(costMatrixFilename, routeMatrixFilename string, costThre
 		RelayLongitudes:    costMatrix.RelayLongitudes,
 		RelayDatacenterIds: costMatrix.RelayDatacenterIds,
 		DestRelays:         costMatrix.DestRelays,
-		RouteEntries:       core.Optimize2(numRelays, numSegments, costMatrix.Costs, costMatrix.RelayPrice, costMatrix.RelayDatacenterIds, costMatrix.DestRelays),
 		Costs:              costMatrix.Costs,
 		RelayPrice:         costMatrix.RelayPrice,
 	}
 
+	if len(costMatrix.DirectionalCosts) > 0 {
+		routeMatrix.RouteEntries = core.OptimizeDirectional(numRelays, numSegments, costMatrix.DirectionalCosts, nil, nil, costMatrix.RelayPrice, costMatrix.RelayDatacenterIds, costMatrix.DestRelays, downstreamWeight)
+		routeMatrix.DirectionalCosts = costMatrix.DirectionalCosts
+		routeMatrix.DownstreamWeight = downstreamWeight
+	} else {
+		routeMatrix.RouteEntries = core.Optimize2(numRelays, numSegments, costMatrix.Costs, costMatrix.RelayPrice, costMatrix.RelayDatacenterIds, costMatrix.DestRelays)
+	}
+
 	routeMatrixData, err := routeMatrix.Write()
 	if err != nil {
 		handleRunTimeError(fmt.Sprintf("could not write route matrix: %v", err), 1)
@@ -2958,6 +2990,8 @@ func analyzeRouteMatrix(inputFile string) {
 	fmt.Printf("    %.1f%% of relay pairs have only one route\n", analysis.OneRoutePercent)
 	fmt.Printf("    %.1f%% of relay pairs have no direct route\n", analysis.NoDirectRoutePercent)
 	fmt.Printf("    %.1f%% of relay pairs have no route\n", analysis.NoRoutePercent)
+	fmt.Printf("    %d relay pairs below speed of light\n", analysis.SpeedOfLightViolations)
+	fmt.Printf("    %d relay pairs violate triangle inequality\n", analysis.TriangleViolations)
 
 	fmt.Printf("\n")
 }